@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// exchangeAllocBudget is the maximum number of allocations we allow for
+// a single [*Transport.ExchangeWithStreamOpener] over an in-memory stream.
+//
+// Bump this number consciously when adding features to the hot path.
+const exchangeAllocBudget = 23
+
+// newBenchHandler returns the [*dnstest.Handler] used by the benchmarks.
+func newBenchHandler() *dnstest.Handler {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.4.4"))
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	return dnstest.NewHandler(config)
+}
+
+// newBenchTransportTCP returns a [*Transport] using a loopback DNS-over-TCP server.
+func newBenchTransportTCP(b *testing.B) *Transport {
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+	b.Cleanup(srv.Close)
+	dialer := NewStreamOpenerDialerTCP(&net.Dialer{})
+	return NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+}
+
+// newBenchTransportTLS returns a [*Transport] using a loopback DNS-over-TLS server.
+func newBenchTransportTLS(b *testing.B) *Transport {
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+	b.Cleanup(srv.Close)
+	dialer := NewStreamOpenerDialerTLS(&tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    newTestClientTLSConfig("dot"),
+	})
+	return NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+}
+
+// newBenchTransportQUIC returns a [*Transport] using a loopback DNS-over-QUIC server.
+func newBenchTransportQUIC(b *testing.B) *Transport {
+	srv := newDoQTestServer(b, newBenchHandler().PrepareResponse)
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(b, err)
+	b.Cleanup(func() { pconn.Close() })
+	qd := NewQUICDialer(pconn, "example.com")
+	qd.TLSConfig = newTestClientTLSConfig("doq")
+	return NewTransport(NewStreamOpenerDialerQUIC(qd), srv.Endpoint())
+}
+
+// benchExchange measures [*Transport.Exchange] using a new connection per exchange.
+func benchExchange(b *testing.B, dt *Transport) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := dt.Exchange(context.Background(), query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchExchangeWithStreamOpener measures [*Transport.ExchangeWithStreamOpener]
+// reusing the same connection for all the exchanges.
+func benchExchangeWithStreamOpener(b *testing.B, dt *Transport) {
+	conn, err := dt.Dial(context.Background())
+	require.NoError(b, err)
+	defer conn.Close()
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := dt.ExchangeWithStreamOpener(context.Background(), conn, query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExchangeTCP(b *testing.B) {
+	benchExchange(b, newBenchTransportTCP(b))
+}
+
+func BenchmarkExchangeTLS(b *testing.B) {
+	benchExchange(b, newBenchTransportTLS(b))
+}
+
+func BenchmarkExchangeQUIC(b *testing.B) {
+	benchExchange(b, newBenchTransportQUIC(b))
+}
+
+func BenchmarkExchangeWithStreamOpenerTCP(b *testing.B) {
+	benchExchangeWithStreamOpener(b, newBenchTransportTCP(b))
+}
+
+func BenchmarkExchangeWithStreamOpenerTLS(b *testing.B) {
+	benchExchangeWithStreamOpener(b, newBenchTransportTLS(b))
+}
+
+func BenchmarkExchangeWithStreamOpenerQUIC(b *testing.B) {
+	benchExchangeWithStreamOpener(b, newBenchTransportQUIC(b))
+}
+
+// newMemoryStreamOpener returns a [StreamOpener] replaying a canned response.
+func newMemoryStreamOpener(t testing.TB, query *dnscodec.Query) StreamOpener {
+	queryMsg, err := query.NewMsg()
+	require.NoError(t, err)
+	respMsg := newBenchHandler().PrepareResponse(queryMsg)
+	rawResp, err := respMsg.Pack()
+	require.NoError(t, err)
+	frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+
+	reader := bytes.NewReader(frame)
+	stream := &FuncStream{
+		ReadFunc: reader.Read,
+	}
+	return &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			reader.Reset(frame)
+			return stream, nil
+		},
+	}
+}
+
+func BenchmarkExchangeWithStreamOpenerMemory(b *testing.B) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	conn := newMemoryStreamOpener(b, query)
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := dt.ExchangeWithStreamOpener(context.Background(), conn, query); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExchangeWithStreamOpenerAllocationBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector randomly drops sync.Pool items")
+	}
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	conn := newMemoryStreamOpener(t, query)
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, query)
+		require.NoError(t, err)
+	})
+	t.Logf("allocations per exchange: %v", allocs)
+	require.LessOrEqual(t, allocs, float64(exchangeAllocBudget))
+}
@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrMemoryBudgetExhausted indicates that buffering a response would exceed
+// the configured [*MemoryBudget].
+var ErrMemoryBudgetExhausted = errors.New("dnsoverstream: memory budget exhausted")
+
+// MemoryBudget bounds the bytes used by simultaneously buffered responses.
+//
+// Construct using [NewMemoryBudget] and assign to [*Transport] MemoryBudget
+// field. Share the same [*MemoryBudget] across several [*Transport] to bound
+// the worst-case memory usage of large scans against hostile servers.
+//
+// A [*MemoryBudget] is safe for concurrent use by multiple goroutines.
+type MemoryBudget struct {
+	// Block OPTIONALLY indicates that we should wait for memory to become
+	// available rather than failing with [ErrMemoryBudgetExhausted].
+	//
+	// Responses larger than the whole budget always fail.
+	Block bool
+
+	// limit is the maximum number of bytes.
+	limit int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// used is the number of bytes currently in use.
+	used int64
+
+	// released is closed and replaced whenever memory is released.
+	released chan struct{}
+}
+
+// NewMemoryBudget creates a new [*MemoryBudget] with the given byte limit.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{
+		limit:    limit,
+		released: make(chan struct{}),
+	}
+}
+
+// Acquire reserves size bytes from the budget.
+//
+// On success, it returns the function to release the bytes, which the caller
+// MUST call exactly once. On failure, it returns [ErrMemoryBudgetExhausted] or
+// the context error when blocking and the context is done.
+func (b *MemoryBudget) Acquire(ctx context.Context, size int64) (func(), error) {
+	if size > b.limit {
+		return nil, ErrMemoryBudgetExhausted
+	}
+	for {
+		b.mu.Lock()
+		if b.used+size <= b.limit {
+			b.used += size
+			b.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { b.release(size) }) }, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		if !b.Block {
+			return nil, ErrMemoryBudgetExhausted
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// InUse returns the number of bytes currently reserved.
+func (b *MemoryBudget) InUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// release returns size bytes to the budget and wakes up the waiters.
+func (b *MemoryBudget) release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= size
+	close(b.released)
+	b.released = make(chan struct{})
+}
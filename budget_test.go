@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudgetNonBlocking(t *testing.T) {
+	budget := NewMemoryBudget(100)
+
+	release1, err := budget.Acquire(context.Background(), 60)
+	require.NoError(t, err)
+	require.Equal(t, int64(60), budget.InUse())
+
+	_, err = budget.Acquire(context.Background(), 60)
+	require.ErrorIs(t, err, ErrMemoryBudgetExhausted)
+
+	release1()
+	release1() // idempotent
+	require.Zero(t, budget.InUse())
+
+	release2, err := budget.Acquire(context.Background(), 60)
+	require.NoError(t, err)
+	release2()
+}
+
+func TestMemoryBudgetTooLarge(t *testing.T) {
+	budget := NewMemoryBudget(100)
+	budget.Block = true
+
+	_, err := budget.Acquire(context.Background(), 101)
+	require.ErrorIs(t, err, ErrMemoryBudgetExhausted)
+}
+
+func TestMemoryBudgetBlocking(t *testing.T) {
+	budget := NewMemoryBudget(100)
+	budget.Block = true
+
+	release1, err := budget.Acquire(context.Background(), 60)
+	require.NoError(t, err)
+
+	t.Run("context done while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := budget.Acquire(ctx, 60)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("wakes up after release", func(t *testing.T) {
+		done := make(chan error)
+		go func() {
+			release, err := budget.Acquire(context.Background(), 60)
+			if err == nil {
+				release()
+			}
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		release1()
+		require.NoError(t, <-done)
+		require.Zero(t, budget.InUse())
+	})
+}
+
+func TestExchangeWithStreamOpenerMemoryBudget(t *testing.T) {
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	dt.MemoryBudget = NewMemoryBudget(16)
+
+	_, err := dt.ExchangeWithStreamOpener(context.Background(), newEchoStreamOpener(t), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, ErrMemoryBudgetExhausted)
+
+	dt.MemoryBudget = NewMemoryBudget(4096)
+	_, err = dt.ExchangeWithStreamOpener(context.Background(), newEchoStreamOpener(t), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.Zero(t, dt.MemoryBudget.InUse())
+}
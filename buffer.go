@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// streamBufferSize is the initial capacity of pooled buffers, which is enough
+// for packing typical queries and for reading responses whose size is bounded
+// by [dnscodec.QueryMaxResponseSizeTCP], plus the 2-byte length prefix.
+const streamBufferSize = dnscodec.QueryMaxResponseSizeTCP + 2
+
+// streamBufferMaxPooledSize is the maximum capacity of pooled buffers. We drop
+// larger buffers to avoid retaining memory after sporadic large messages.
+const streamBufferMaxPooledSize = math.MaxUint16 + 2
+
+// streamBufferPool recycles the buffers used for packing queries, building
+// frames, and reading responses, to reduce the GC pressure in high-throughput
+// scenarios. We cannot recycle [*dns.Msg] since they are returned to the
+// caller inside the [*dnscodec.Response].
+var streamBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, streamBufferSize)
+		return &buf
+	},
+}
+
+// getStreamBuffer returns a pooled buffer whose length is size.
+func getStreamBuffer(size int) *[]byte {
+	buf := streamBufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// putStreamBuffer returns a buffer obtained using [getStreamBuffer] to the pool.
+func putStreamBuffer(buf *[]byte) {
+	if cap(*buf) > streamBufferMaxPooledSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	streamBufferPool.Put(buf)
+}
+
+// DefaultReadBufferSize is the default [*Transport] ReadBufferSize, which
+// is the same default size used by [bufio.NewReader].
+const DefaultReadBufferSize = 4096
+
+// streamReaderPools maps a read buffer size to the [*sync.Pool]
+// recycling the [*bufio.Reader] of that size.
+var streamReaderPools sync.Map
+
+// getStreamReader returns a pooled [*bufio.Reader] reading from r whose
+// buffer size is the [*Transport] ReadBufferSize.
+func getStreamReader(dt *Transport, r io.Reader) *bufio.Reader {
+	size := dt.ReadBufferSize
+	if size <= 0 {
+		size = DefaultReadBufferSize
+	}
+	size = max(size, 16) // the minimum size used by [bufio.NewReaderSize]
+	pool, _ := streamReaderPools.LoadOrStore(size, &sync.Pool{})
+	if br, ok := pool.(*sync.Pool).Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+// putStreamReader returns a reader obtained using [getStreamReader] to the pool.
+//
+// The caller MUST NOT use the reader or the data it returned afterwards.
+func putStreamReader(br *bufio.Reader) {
+	if br.Size() > streamBufferMaxPooledSize {
+		return
+	}
+	br.Reset(nil) // do not retain the stream
+	if pool, ok := streamReaderPools.Load(br.Size()); ok {
+		pool.(*sync.Pool).Put(br)
+	}
+}
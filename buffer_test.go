@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetStreamBuffer(t *testing.T) {
+	t.Run("small buffer", func(t *testing.T) {
+		buf := getStreamBuffer(16)
+		require.Len(t, *buf, 16)
+		require.GreaterOrEqual(t, cap(*buf), 16)
+		putStreamBuffer(buf)
+		require.Empty(t, *buf)
+	})
+
+	t.Run("large buffer", func(t *testing.T) {
+		buf := getStreamBuffer(streamBufferMaxPooledSize + 1)
+		require.Len(t, *buf, streamBufferMaxPooledSize+1)
+		putStreamBuffer(buf)
+		require.Len(t, *buf, streamBufferMaxPooledSize+1) // not pooled
+	})
+}
+
+func TestAppendStreamMsgFrame(t *testing.T) {
+	frame := appendStreamMsgFrame(nil, []byte{0xde, 0xad, 0xbe, 0xef})
+	require.Equal(t, []byte{0x00, 0x04, 0xde, 0xad, 0xbe, 0xef}, frame)
+}
+
+func TestGetStreamReader(t *testing.T) {
+	t.Run("default size", func(t *testing.T) {
+		br := getStreamReader(&Transport{}, bytes.NewReader(nil))
+		require.Equal(t, DefaultReadBufferSize, br.Size())
+		putStreamReader(br)
+	})
+
+	t.Run("custom size", func(t *testing.T) {
+		br := getStreamReader(&Transport{ReadBufferSize: 512}, bytes.NewReader(nil))
+		require.Equal(t, 512, br.Size())
+		putStreamReader(br)
+	})
+
+	t.Run("minimum size", func(t *testing.T) {
+		br := getStreamReader(&Transport{ReadBufferSize: 1}, bytes.NewReader(nil))
+		require.Equal(t, 16, br.Size())
+		putStreamReader(br)
+	})
+
+	t.Run("recycled readers read from the new stream", func(t *testing.T) {
+		dt := &Transport{ReadBufferSize: 32}
+		for _, data := range []string{"first", "second"} {
+			br := getStreamReader(dt, bytes.NewReader([]byte(data)))
+			got, err := io.ReadAll(br)
+			require.NoError(t, err)
+			require.Equal(t, data, string(got))
+			putStreamReader(br)
+		}
+	})
+
+	t.Run("large reader", func(t *testing.T) {
+		br := getStreamReader(&Transport{ReadBufferSize: streamBufferMaxPooledSize + 1}, bytes.NewReader(nil))
+		require.Equal(t, streamBufferMaxPooledSize+1, br.Size())
+		putStreamReader(br) // not pooled
+	})
+}
@@ -0,0 +1,165 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ResponseClass is the classification of a DNS response returned by [ClassifyResponse].
+type ResponseClass int
+
+const (
+	// ResponseClassAnswer is a NOERROR response answering the question.
+	ResponseClassAnswer ResponseClass = iota
+
+	// ResponseClassNoData is a NOERROR response without records of the
+	// requested type for the name, possibly after following CNAMEs (RFC 2308 Section 2.2).
+	ResponseClassNoData
+
+	// ResponseClassReferral is a NOERROR response without answers delegating
+	// to other name servers through NS records in the authority section.
+	ResponseClassReferral
+
+	// ResponseClassNXDomain is a NXDOMAIN response (RFC 2308 Section 2.1).
+	ResponseClassNXDomain
+
+	// ResponseClassServFail is a SERVFAIL response. Use [ExtendedErrors]
+	// to obtain the reason, if the server provided one (RFC 8914).
+	ResponseClassServFail
+
+	// ResponseClassRefused is a REFUSED response.
+	ResponseClassRefused
+
+	// ResponseClassOther is a response with any other RCODE.
+	ResponseClassOther
+)
+
+// String implements [fmt.Stringer].
+func (c ResponseClass) String() string {
+	switch c {
+	case ResponseClassAnswer:
+		return "answer"
+	case ResponseClassNoData:
+		return "nodata"
+	case ResponseClassReferral:
+		return "referral"
+	case ResponseClassNXDomain:
+		return "nxdomain"
+	case ResponseClassServFail:
+		return "servfail"
+	case ResponseClassRefused:
+		return "refused"
+	default:
+		return "other"
+	}
+}
+
+// ClassifyResponse classifies a DNS response beyond its RCODE, so that
+// callers do not need to reimplement the RFC 2308 negative answers semantics.
+//
+// Before invoking this function, make sure the response is valid for
+// the query using [dnscodec.ValidateResponseForQuery].
+func ClassifyResponse(resp *dns.Msg) ResponseClass {
+	// 1. classify using the RCODE
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		// handled below
+	case dns.RcodeNameError:
+		return ResponseClassNXDomain
+	case dns.RcodeServerFailure:
+		return ResponseClassServFail
+	case dns.RcodeRefused:
+		return ResponseClassRefused
+	default:
+		return ResponseClassOther
+	}
+
+	// 2. check whether the answer contains records of the requested type
+	if responseHasAnswer(resp) {
+		return ResponseClassAnswer
+	}
+
+	// 3. distinguish NODATA from referrals using the authority section
+	var hasNS, hasSOA bool
+	for _, rr := range resp.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeNS:
+			hasNS = true
+		case dns.TypeSOA:
+			hasSOA = true
+		}
+	}
+	if hasNS && !hasSOA && !resp.Authoritative {
+		return ResponseClassReferral
+	}
+	return ResponseClassNoData
+}
+
+// responseHasAnswer returns whether the answer section contains records
+// of the requested type for the name, following the CNAME chain.
+func responseHasAnswer(resp *dns.Msg) bool {
+	// 1. without a question we can only check for a nonempty answer
+	if len(resp.Question) != 1 {
+		return len(resp.Answer) > 0
+	}
+
+	// 2. extract the answers matching the name or its aliases
+	q0 := resp.Question[0]
+	rrs, err := dnscodec.ResponseExtractValidAnswers(q0, resp)
+	if err != nil {
+		return false
+	}
+
+	// 3. a CNAME chain alone is NODATA unless we asked for CNAME or ANY
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrtype != dns.TypeCNAME || q0.Qtype == dns.TypeCNAME || q0.Qtype == dns.TypeANY {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNoData returns whether [ClassifyResponse] returns [ResponseClassNoData].
+func IsNoData(resp *dns.Msg) bool {
+	return ClassifyResponse(resp) == ResponseClassNoData
+}
+
+// IsNXDomain returns whether [ClassifyResponse] returns [ResponseClassNXDomain].
+func IsNXDomain(resp *dns.Msg) bool {
+	return ClassifyResponse(resp) == ResponseClassNXDomain
+}
+
+// IsRefused returns whether [ClassifyResponse] returns [ResponseClassRefused].
+func IsRefused(resp *dns.Msg) bool {
+	return ClassifyResponse(resp) == ResponseClassRefused
+}
+
+// ExtendedErrors returns the extended DNS errors (RFC 8914) contained
+// in the EDNS(0) OPT record of the response, if any.
+func ExtendedErrors(resp *dns.Msg) []*dns.EDNS0_EDE {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var out []*dns.EDNS0_EDE
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			out = append(out, ede)
+		}
+	}
+	return out
+}
+
+// Classify unpacks the raw response and classifies it using [ClassifyResponse].
+//
+// This method returns [dnscodec.ErrServerMisbehaving] if the response cannot be unpacked.
+func (r *RawResponse) Classify() (ResponseClass, error) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(r.Response); err != nil {
+		return ResponseClassOther, dnscodec.ErrServerMisbehaving
+	}
+	return ClassifyResponse(resp), nil
+}
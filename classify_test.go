@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newClassifyTestResponse returns a response for www.example.com with the given qtype and rcode.
+func newClassifyTestResponse(qtype uint16, rcode int) *dns.Msg {
+	query := &dns.Msg{}
+	query.SetQuestion("www.example.com.", qtype)
+	resp := &dns.Msg{}
+	resp.SetRcode(query, rcode)
+	return resp
+}
+
+func TestClassifyResponse(t *testing.T) {
+	aRecord := &dns.A{
+		Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, 1),
+	}
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "web.example.com.",
+	}
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns.example.com.", Mbox: "admin.example.com.",
+	}
+	ns := &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns.example.com.",
+	}
+
+	tests := []struct {
+		name     string
+		build    func() *dns.Msg
+		expected ResponseClass
+	}{{
+		name: "answer",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			resp.Answer = []dns.RR{aRecord}
+			return resp
+		},
+		expected: ResponseClassAnswer,
+	}, {
+		name: "nodata with SOA",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeAAAA, dns.RcodeSuccess)
+			resp.Ns = []dns.RR{soa}
+			return resp
+		},
+		expected: ResponseClassNoData,
+	}, {
+		name: "nodata after CNAME",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			resp.Answer = []dns.RR{cname}
+			return resp
+		},
+		expected: ResponseClassNoData,
+	}, {
+		name: "CNAME answering a CNAME query",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeCNAME, dns.RcodeSuccess)
+			resp.Answer = []dns.RR{cname}
+			return resp
+		},
+		expected: ResponseClassAnswer,
+	}, {
+		name: "nodata with records for another name",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			other := dns.Copy(aRecord)
+			other.Header().Name = "other.example.com."
+			resp.Answer = []dns.RR{other}
+			return resp
+		},
+		expected: ResponseClassNoData,
+	}, {
+		name: "referral",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			resp.Ns = []dns.RR{ns}
+			return resp
+		},
+		expected: ResponseClassReferral,
+	}, {
+		name: "authoritative NS without SOA is nodata",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			resp.Authoritative = true
+			resp.Ns = []dns.RR{ns}
+			return resp
+		},
+		expected: ResponseClassNoData,
+	}, {
+		name:     "nxdomain",
+		build:    func() *dns.Msg { return newClassifyTestResponse(dns.TypeA, dns.RcodeNameError) },
+		expected: ResponseClassNXDomain,
+	}, {
+		name:     "servfail",
+		build:    func() *dns.Msg { return newClassifyTestResponse(dns.TypeA, dns.RcodeServerFailure) },
+		expected: ResponseClassServFail,
+	}, {
+		name:     "refused",
+		build:    func() *dns.Msg { return newClassifyTestResponse(dns.TypeA, dns.RcodeRefused) },
+		expected: ResponseClassRefused,
+	}, {
+		name:     "other",
+		build:    func() *dns.Msg { return newClassifyTestResponse(dns.TypeA, dns.RcodeNotImplemented) },
+		expected: ResponseClassOther,
+	}, {
+		name: "answer without question",
+		build: func() *dns.Msg {
+			resp := newClassifyTestResponse(dns.TypeA, dns.RcodeSuccess)
+			resp.Question = nil
+			resp.Answer = []dns.RR{aRecord}
+			return resp
+		},
+		expected: ResponseClassAnswer,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.build()
+			require.Equal(t, tt.expected, ClassifyResponse(resp))
+			require.Equal(t, tt.expected == ResponseClassNoData, IsNoData(resp))
+			require.Equal(t, tt.expected == ResponseClassNXDomain, IsNXDomain(resp))
+			require.Equal(t, tt.expected == ResponseClassRefused, IsRefused(resp))
+		})
+	}
+}
+
+func TestResponseClassString(t *testing.T) {
+	require.Equal(t, "answer", ResponseClassAnswer.String())
+	require.Equal(t, "nodata", ResponseClassNoData.String())
+	require.Equal(t, "referral", ResponseClassReferral.String())
+	require.Equal(t, "nxdomain", ResponseClassNXDomain.String())
+	require.Equal(t, "servfail", ResponseClassServFail.String())
+	require.Equal(t, "refused", ResponseClassRefused.String())
+	require.Equal(t, "other", ResponseClassOther.String())
+}
+
+func TestExtendedErrors(t *testing.T) {
+	t.Run("without EDNS(0)", func(t *testing.T) {
+		resp := newClassifyTestResponse(dns.TypeA, dns.RcodeServerFailure)
+		require.Nil(t, ExtendedErrors(resp))
+	})
+
+	t.Run("with extended errors", func(t *testing.T) {
+		resp := newClassifyTestResponse(dns.TypeA, dns.RcodeServerFailure)
+		resp.SetEdns0(1232, false)
+		ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus, ExtraText: "bogus"}
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE}, ede)
+		require.Equal(t, []*dns.EDNS0_EDE{ede}, ExtendedErrors(resp))
+	})
+}
+
+func TestRawResponseClassify(t *testing.T) {
+	t.Run("with a valid response", func(t *testing.T) {
+		raw, err := newClassifyTestResponse(dns.TypeA, dns.RcodeRefused).Pack()
+		require.NoError(t, err)
+		class, err := (&RawResponse{Response: raw}).Classify()
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassRefused, class)
+	})
+
+	t.Run("with an invalid response", func(t *testing.T) {
+		class, err := (&RawResponse{Response: []byte{0}}).Classify()
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+		require.Equal(t, ResponseClassOther, class)
+	})
+}
@@ -0,0 +1,57 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultCloseTimeout is the default timeout for closing a connection.
+const DefaultCloseTimeout = time.Second
+
+// ErrCloseTimeout indicates that closing a connection did not complete in time.
+//
+// The close operation keeps running in the background until it completes.
+var ErrCloseTimeout = errors.New("dnsoverstream: timed out closing connection")
+
+// closeWithTimeout closes conn waiting at most timeout for the close to complete.
+//
+// Closing may block on dead network paths (e.g., when sending a QUIC
+// CONNECTION_CLOSE or a TLS close_notify), so we close in a background
+// goroutine and return [ErrCloseTimeout] if it takes too much time.
+//
+// A zero or negative timeout means [DefaultCloseTimeout].
+func closeWithTimeout(conn io.Closer, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.Close()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrCloseTimeout
+	}
+}
+
+// closeAllWithTimeout is like [closeWithTimeout] but closes several
+// connections in parallel and joins the resulting errors.
+func closeAllWithTimeout[T io.Closer](conns []T, timeout time.Duration) error {
+	errs := make([]error, len(conns))
+	wg := &sync.WaitGroup{}
+	for idx, conn := range conns {
+		wg.Go(func() {
+			errs[idx] = closeWithTimeout(conn, timeout)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// funcCloser implements [io.Closer] using a function.
+type funcCloser func() error
+
+// Close implements [io.Closer].
+func (fc funcCloser) Close() error {
+	return fc()
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	t.Run("returns the close error", func(t *testing.T) {
+		expected := errors.New("close failed")
+		err := closeWithTimeout(funcCloser(func() error { return expected }), 0)
+		require.ErrorIs(t, err, expected)
+	})
+
+	t.Run("returns ErrCloseTimeout when close blocks", func(t *testing.T) {
+		unblock := make(chan struct{})
+		defer close(unblock)
+		err := closeWithTimeout(funcCloser(func() error {
+			<-unblock
+			return nil
+		}), time.Millisecond)
+		require.ErrorIs(t, err, ErrCloseTimeout)
+	})
+}
+
+func TestCloseAllWithTimeout(t *testing.T) {
+	expected := errors.New("close failed")
+	unblock := make(chan struct{})
+	defer close(unblock)
+	conns := []funcCloser{
+		func() error { return nil },
+		func() error { return expected },
+		func() error {
+			<-unblock
+			return nil
+		},
+	}
+
+	err := closeAllWithTimeout(conns, 10*time.Millisecond)
+	require.ErrorIs(t, err, expected)
+	require.ErrorIs(t, err, ErrCloseTimeout)
+}
+
+func TestTransportCloseTimeout(t *testing.T) {
+	newTransport := func(closeFunc func() error) *Transport {
+		conn := &FuncStreamOpener{
+			CloseFunc:      closeFunc,
+			OpenStreamFunc: NewHandlerStreamOpener(newBenchHandler()).OpenStream,
+		}
+		dt := NewTransport(NewFuncStreamOpenerDialer(conn), netip.MustParseAddrPort("127.0.0.1:53"))
+		dt.CloseTimeout = 100 * time.Millisecond
+		return dt
+	}
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("Exchange waits for the close to complete", func(t *testing.T) {
+		var closed atomic.Bool
+		dt := newTransport(func() error {
+			closed.Store(true)
+			return nil
+		})
+		_, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.True(t, closed.Load())
+	})
+
+	t.Run("Exchange waits at most CloseTimeout", func(t *testing.T) {
+		unblock := make(chan struct{})
+		defer close(unblock)
+		dt := newTransport(func() error {
+			<-unblock
+			return nil
+		})
+		t0 := time.Now()
+		_, err := dt.Exchange(context.Background(), query)
+		elapsed := time.Since(t0)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, elapsed, dt.CloseTimeout)
+		require.Less(t, elapsed, DefaultCloseTimeout)
+	})
+}
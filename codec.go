@@ -0,0 +1,253 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// Codec serializes queries and parses responses, which allows using a DNS
+// library other than [dnscodec] without conversion overhead.
+//
+// Use [DefaultCodec] for [*dnscodec.Query], [MsgCodec] for [*dns.Msg], or
+// provide a custom implementation. Use with [ExchangeCodec].
+type Codec[Q, R any] interface {
+	// PackQuery serializes the query honouring the [QueryParams].
+	//
+	// The buf argument is a scratch buffer the codec MAY use to avoid
+	// allocating, like [*dns.Msg.PackBuffer] does. We recycle buf after
+	// the exchange, so the codec MUST NOT retain it.
+	PackQuery(buf []byte, query Q, params QueryParams) ([]byte, error)
+
+	// ParseResponse parses and validates the raw response to the raw query,
+	// which is the query we actually sent after applying the [QueryParams].
+	//
+	// We recycle rawQuery and rawResp after this method returns, so the
+	// codec MUST copy any data it needs to retain.
+	ParseResponse(query Q, rawQuery, rawResp []byte) (R, error)
+
+	// Question returns the query name and type, which we log.
+	Question(query Q) (name string, qtype uint16)
+}
+
+// QueryParams contains the query settings required by the protocol
+// in use and by the [*Transport] configuration.
+type QueryParams struct {
+	// Flags contains the [dnscodec] query flags required by the protocol
+	// (e.g., [dnscodec.QueryFlagBlockLengthPadding] for TLS and QUIC).
+	Flags uint16
+
+	// MaxSize is the maximum response size to advertise using EDNS(0).
+	//
+	// We also refuse responses larger than this size. When Verbatim is set,
+	// MaxSize is zero, since the caller's query already advertises its own
+	// maximum size, which we use instead (see [verbatimMaxSize]).
+	MaxSize uint16
+
+	// ZeroID indicates that the query ID MUST be zero, which is
+	// what DNS over QUIC requires (RFC 9250 Section 4.2.1).
+	ZeroID bool
+
+	// QueryClass is the question class to use, where the zero value
+	// means [dns.ClassINET] (see the [*Transport] QueryClass field).
+	QueryClass uint16
+
+	// NoRecursion indicates that the RD bit MUST be cleared (see
+	// the [*Transport] NoRecursion field).
+	NoRecursion bool
+
+	// NoCompression indicates that we MUST NOT compress names (see
+	// the [*Transport] NoCompression field).
+	NoCompression bool
+
+	// Verbatim indicates that MutateQuery MUST NOT modify the query (see
+	// the [*Transport] Verbatim field), in which case Flags is zero and
+	// ZeroID is false.
+	Verbatim bool
+}
+
+// newQueryParams returns the [QueryParams] for the given [*Transport] and [StreamOpener].
+//
+// We obtain the protocol settings by calling MutateQuery on a probe query
+// configured like the ones created by [dnscodec.NewQuery].
+func newQueryParams(dt *Transport, conn StreamOpener) QueryParams {
+	probe := &dnscodec.Query{ID: 1, MaxSize: dnscodec.QueryMaxResponseSizeUDP}
+	conn.MutateQuery(probe)
+	if dt.Verbatim {
+		return QueryParams{
+			QueryClass:    dt.QueryClass,
+			NoRecursion:   dt.NoRecursion,
+			NoCompression: dt.NoCompression,
+			Verbatim:      true,
+		}
+	}
+	return QueryParams{
+		Flags:         probe.Flags,
+		MaxSize:       probe.MaxSize,
+		ZeroID:        probe.ID == 0,
+		QueryClass:    dt.QueryClass,
+		NoRecursion:   dt.NoRecursion,
+		NoCompression: dt.NoCompression,
+	}
+}
+
+// MutateQuery applies the protocol settings to a [*dnscodec.Query].
+func (p QueryParams) MutateQuery(query *dnscodec.Query) {
+	if p.Verbatim {
+		return
+	}
+	query.Flags |= p.Flags
+	query.MaxSize = p.MaxSize
+	if p.ZeroID {
+		query.ID = 0
+	}
+}
+
+// MutateMsg applies the question class, the RD bit, and the
+// name compression setting to a [*dns.Msg].
+func (p QueryParams) MutateMsg(msg *dns.Msg) {
+	if p.NoCompression {
+		msg.Compress = false
+	}
+	if p.QueryClass != 0 {
+		for idx := range msg.Question {
+			msg.Question[idx].Qclass = p.QueryClass
+		}
+	}
+	if p.NoRecursion {
+		msg.RecursionDesired = false
+	}
+}
+
+// DefaultCodec is the [Codec] for [*dnscodec.Query], which is what
+// [*Transport.Exchange] uses.
+type DefaultCodec struct{}
+
+var _ Codec[*dnscodec.Query, *dnscodec.Response] = DefaultCodec{}
+
+// PackQuery implements [Codec].
+func (DefaultCodec) PackQuery(buf []byte, query *dnscodec.Query, params QueryParams) ([]byte, error) {
+	query = query.Clone()
+	params.MutateQuery(query)
+	msg, err := query.NewMsg()
+	if err != nil {
+		return nil, err
+	}
+	params.MutateMsg(msg)
+	return msg.PackBuffer(buf)
+}
+
+// ParseResponse implements [Codec].
+func (DefaultCodec) ParseResponse(query *dnscodec.Query, rawQuery, rawResp []byte) (*dnscodec.Response, error) {
+	queryMsg := new(dns.Msg)
+	if err := queryMsg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	return parseResponse(queryMsg, rawQuery, rawResp)
+}
+
+// Question implements [Codec].
+func (DefaultCodec) Question(query *dnscodec.Query) (string, uint16) {
+	return dnscodecQuestion(query)
+}
+
+// MsgCodec is the [Codec] for users who build their own [*dns.Msg] queries.
+//
+// We send a copy of the query after applying the [QueryParams], adding an
+// EDNS(0) OPT record when missing, unless Verbatim is set. The response is the validated [*dns.Msg],
+// whose RCODE is not mapped to errors, so the caller should check it.
+type MsgCodec struct{}
+
+var _ Codec[*dns.Msg, *dns.Msg] = MsgCodec{}
+
+// PackQuery implements [Codec].
+func (MsgCodec) PackQuery(buf []byte, query *dns.Msg, params QueryParams) ([]byte, error) {
+	msg := query.Copy()
+	if params.ZeroID {
+		msg.Id = 0
+	}
+	params.MutateMsg(msg)
+	if !params.Verbatim && msg.IsEdns0() == nil {
+		msg.SetEdns0(params.MaxSize, params.Flags&dnscodec.QueryFlagDNSSec != 0)
+		if params.Flags&dnscodec.QueryFlagBlockLengthPadding != 0 {
+			msgPadToBlockLength(msg)
+		}
+	}
+	return msg.PackBuffer(buf)
+}
+
+// verbatimMaxSize returns the maximum response size advertised by the raw
+// query we sent when Verbatim is set. Without EDNS(0), we use [dns.MaxMsgSize]
+// because the 512 octets limit (RFC 1035 Section 4.2.1) only applies to UDP.
+func verbatimMaxSize(rawQuery []byte) uint16 {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(rawQuery); err != nil {
+		return dns.MaxMsgSize
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return dns.MaxMsgSize
+	}
+	return max(opt.UDPSize(), dns.MinMsgSize)
+}
+
+// msgPadToBlockLength pads the message to the closest multiple of 128
+// octets (RFC 8467 Section 4.1), like [*dnscodec.Query.NewMsg] does.
+//
+// The message MUST contain an EDNS(0) OPT record.
+func msgPadToBlockLength(msg *dns.Msg) {
+	const desiredSize = 128
+	remainder := (desiredSize - uint16(msg.Len()+4)) % desiredSize
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, remainder)})
+}
+
+// ParseResponse implements [Codec].
+func (MsgCodec) ParseResponse(query *dns.Msg, rawQuery, rawResp []byte) (*dns.Msg, error) {
+	queryMsg := new(dns.Msg)
+	if err := queryMsg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	return parseValidatedMsg(queryMsg, rawQuery, rawResp)
+}
+
+// Question implements [Codec].
+func (MsgCodec) Question(query *dns.Msg) (string, uint16) {
+	if len(query.Question) <= 0 {
+		return "", 0
+	}
+	return query.Question[0].Name, query.Question[0].Qtype
+}
+
+// ExchangeCodec is like [*Transport.Exchange] but uses the given [Codec].
+//
+// This is a function rather than a method because Go methods
+// cannot have type parameters.
+func ExchangeCodec[Q, R any](ctx context.Context, dt *Transport, codec Codec[Q, R], query Q) (R, error) {
+	return transportExchange(ctx, dt, query, codec.Question, func(ctx context.Context, conn StreamOpener, query Q) (R, error) {
+		return ExchangeCodecWithStreamOpener(ctx, dt, codec, conn, query)
+	})
+}
+
+// ExchangeCodecWithStreamOpener is like [*Transport.ExchangeWithStreamOpener]
+// but uses the given [Codec]. See [ExchangeCodec] for more information.
+func ExchangeCodecWithStreamOpener[Q, R any](ctx context.Context,
+	dt *Transport, codec Codec[Q, R], conn StreamOpener, query Q) (R, error) {
+	pack := func(buf []byte) ([]byte, uint16, error) {
+		params := newQueryParams(dt, conn)
+		rawQuery, err := codec.PackQuery(buf, query, params)
+		if err != nil {
+			return nil, 0, err
+		}
+		if params.Verbatim {
+			return rawQuery, verbatimMaxSize(rawQuery), nil
+		}
+		return rawQuery, params.MaxSize, nil
+	}
+	return streamRoundTrip(ctx, dt, conn, pack, func(rawQuery, rawResp []byte) (R, error) {
+		return codec.ParseResponse(query, rawQuery, rawResp)
+	})
+}
@@ -0,0 +1,252 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newCodecTestTransport returns a [*Transport] using an in-memory server.
+func newCodecTestTransport() *Transport {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	return NewTransport(NewStreamOpenerDialerHandler(dnstest.NewHandler(config)), netip.AddrPort{})
+}
+
+// newQUICLikeStreamOpener returns a [StreamOpener] whose MutateQuery behaves like QUIC.
+func newQUICLikeStreamOpener() StreamOpener {
+	return &FuncStreamOpener{
+		MutateQueryFunc: func(msg *dnscodec.Query) {
+			msg.Flags |= dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec
+			msg.ID = 0
+			msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+		},
+	}
+}
+
+func TestNewQueryParams(t *testing.T) {
+	t.Run("TCP", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		params := newQueryParams(dt, &tcpStreamConn{})
+		require.Equal(t, QueryParams{MaxSize: dnscodec.QueryMaxResponseSizeTCP}, params)
+	})
+
+	t.Run("QUIC with transport settings", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		dt.QueryClass = dns.ClassCHAOS
+		dt.NoRecursion = true
+		params := newQueryParams(dt, newQUICLikeStreamOpener())
+		require.Equal(t, QueryParams{
+			Flags:       dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec,
+			MaxSize:     dnscodec.QueryMaxResponseSizeTCP,
+			ZeroID:      true,
+			QueryClass:  dns.ClassCHAOS,
+			NoRecursion: true,
+		}, params)
+	})
+
+	t.Run("QUIC with Verbatim", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		dt.Verbatim = true
+		params := newQueryParams(dt, newQUICLikeStreamOpener())
+		require.Equal(t, QueryParams{Verbatim: true}, params)
+		query := dnscodec.NewQuery("example.com", dns.TypeA)
+		orig := *query
+		params.MutateQuery(query)
+		require.Equal(t, orig, *query)
+	})
+}
+
+func TestCodecPackQuery(t *testing.T) {
+	params := QueryParams{
+		Flags:       dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec,
+		MaxSize:     dnscodec.QueryMaxResponseSizeTCP,
+		ZeroID:      true,
+		QueryClass:  dns.ClassCHAOS,
+		NoRecursion: true,
+	}
+
+	// requireMutated checks that the raw query honours the params.
+	requireMutated := func(t *testing.T, rawQuery []byte) {
+		require.Zero(t, len(rawQuery)%128)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Zero(t, msg.Id)
+		require.False(t, msg.RecursionDesired)
+		require.Equal(t, uint16(dns.ClassCHAOS), msg.Question[0].Qclass)
+		opt := msg.IsEdns0()
+		require.NotNil(t, opt)
+		require.True(t, opt.Do())
+		require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeTCP), opt.UDPSize())
+	}
+
+	t.Run("DefaultCodec", func(t *testing.T) {
+		query := dnscodec.NewQuery("version.bind", dns.TypeTXT)
+		query.ID = 1234
+		rawQuery, err := DefaultCodec{}.PackQuery(nil, query, params)
+		require.NoError(t, err)
+		requireMutated(t, rawQuery)
+		require.Equal(t, uint16(1234), query.ID) // caller's query intact
+	})
+
+	t.Run("MsgCodec", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("version.bind.", dns.TypeTXT)
+		query.Id = 1234
+		rawQuery, err := MsgCodec{}.PackQuery(nil, query, params)
+		require.NoError(t, err)
+		requireMutated(t, rawQuery)
+		require.Equal(t, uint16(1234), query.Id) // caller's query intact
+		require.Nil(t, query.IsEdns0())
+	})
+
+	t.Run("MsgCodec keeps the existing OPT record", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("dns.google.", dns.TypeA)
+		query.SetEdns0(512, false)
+		rawQuery, err := MsgCodec{}.PackQuery(nil, query, params)
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Equal(t, uint16(512), msg.IsEdns0().UDPSize())
+		require.False(t, msg.IsEdns0().Do())
+	})
+
+	t.Run("MsgCodec with Verbatim does not add the OPT record", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("version.bind.", dns.TypeTXT)
+		query.Id = 1234
+		verbatim := QueryParams{QueryClass: dns.ClassCHAOS, NoRecursion: true, Verbatim: true}
+		rawQuery, err := MsgCodec{}.PackQuery(nil, query, verbatim)
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Nil(t, msg.IsEdns0())
+		require.Equal(t, uint16(1234), msg.Id)
+		require.False(t, msg.RecursionDesired)
+		require.Equal(t, uint16(dns.ClassCHAOS), msg.Question[0].Qclass)
+	})
+}
+
+func TestVerbatimMaxSize(t *testing.T) {
+	pack := func(t *testing.T, udpSize uint16) []byte {
+		msg := new(dns.Msg)
+		msg.SetQuestion("dns.google.", dns.TypeA)
+		if udpSize > 0 {
+			msg.SetEdns0(udpSize, false)
+		}
+		rawQuery, err := msg.Pack()
+		require.NoError(t, err)
+		return rawQuery
+	}
+
+	t.Run("uses the advertised size", func(t *testing.T) {
+		require.Equal(t, uint16(1232), verbatimMaxSize(pack(t, 1232)))
+	})
+
+	t.Run("never goes below the minimum size", func(t *testing.T) {
+		require.Equal(t, uint16(dns.MinMsgSize), verbatimMaxSize(pack(t, 100)))
+	})
+
+	t.Run("without EDNS(0)", func(t *testing.T) {
+		require.Equal(t, uint16(dns.MaxMsgSize), verbatimMaxSize(pack(t, 0)))
+	})
+
+	t.Run("malformed query", func(t *testing.T) {
+		require.Equal(t, uint16(dns.MaxMsgSize), verbatimMaxSize([]byte{0x00}))
+	})
+}
+
+func TestExchangeCodec(t *testing.T) {
+	t.Run("DefaultCodec", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		resp, err := ExchangeCodec(context.Background(), dt, DefaultCodec{}, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+	})
+
+	t.Run("DefaultCodec maps the RCODE to errors", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		_, err := ExchangeCodec(context.Background(), dt, DefaultCodec{}, dnscodec.NewQuery("nonexistent.example.com", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrNoName)
+	})
+
+	t.Run("MsgCodec", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		var rawQueries [][]byte
+		dt.ObserveRawQuery = func(rawQuery []byte) {
+			rawQueries = append(rawQueries, rawQuery)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion("dns.google.", dns.TypeA)
+		resp, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, query)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+		require.Equal(t, "8.8.8.8", resp.Answer[0].(*dns.A).A.String())
+		require.Len(t, rawQueries, 1)
+	})
+
+	t.Run("MsgCodec with Verbatim", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		dt.Verbatim = true
+		var rawQueries [][]byte
+		dt.ObserveRawQuery = func(rawQuery []byte) {
+			rawQueries = append(rawQueries, rawQuery)
+		}
+		query := new(dns.Msg)
+		query.SetQuestion("dns.google.", dns.TypeA)
+		resp, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, query)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+		require.Len(t, rawQueries, 1)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQueries[0]))
+		require.Nil(t, msg.IsEdns0())
+	})
+
+	t.Run("MsgCodec does not map the RCODE to errors", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		query := new(dns.Msg)
+		query.SetQuestion("nonexistent.example.com.", dns.TypeA)
+		resp, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, query)
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("logs the codec question", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		dt := newCodecTestTransport()
+		dt.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+		query := new(dns.Msg)
+		query.SetQuestion("dns.google.", dns.TypeAAAA)
+		_, _ = ExchangeCodec(context.Background(), dt, MsgCodec{}, query)
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		require.Equal(t, "dns.google.", entry["qname"])
+		require.Equal(t, "AAAA", entry["qtype"])
+	})
+
+	t.Run("pack error", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		_, err := ExchangeCodec(context.Background(), dt, DefaultCodec{}, dnscodec.NewQuery("xn--invalid-\xff", dns.TypeA))
+		require.Error(t, err)
+	})
+}
+
+func TestMsgCodecQuestionEmpty(t *testing.T) {
+	name, qtype := MsgCodec{}.Question(new(dns.Msg))
+	require.Empty(t, name)
+	require.Zero(t, qtype)
+}
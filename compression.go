@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"encoding/binary"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ResponseCompression describes the name compression (RFC 1035
+// Section 4.1.4) the server used in a response.
+type ResponseCompression struct {
+	// Pointers is the number of compression pointers, including those
+	// inside the RDATA of the types RFC 3597 allows to compress.
+	Pointers int
+
+	// Size is the size of the raw response.
+	Size int
+
+	// UncompressedSize is the size of the response without compression.
+	UncompressedSize int
+
+	// BytesSaved is UncompressedSize minus Size.
+	BytesSaved int
+}
+
+// Compressed returns whether the response contains compression pointers.
+func (c ResponseCompression) Compressed() bool {
+	return c.Pointers > 0
+}
+
+// CheckResponseCompression checks how much name compression the server used in
+// the raw response, which is a protocol-behavior metric, since compression is
+// optional, and which matters for the responses close to the size limits.
+//
+// This function returns [dnscodec.ErrServerMisbehaving] if the response cannot be unpacked.
+func CheckResponseCompression(rawResp []byte) (ResponseCompression, error) {
+	// 1. unpack the response and compute its uncompressed size
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return ResponseCompression{}, dnscodec.ErrServerMisbehaving
+	}
+	resp.Compress = false
+	info := ResponseCompression{Size: len(rawResp), UncompressedSize: resp.Len()}
+	info.BytesSaved = info.UncompressedSize - info.Size
+
+	// 2. count the pointers, knowing that the response is well formed
+	pointers, err := compressionCountPointers(rawResp)
+	if err != nil {
+		return ResponseCompression{}, dnscodec.ErrServerMisbehaving
+	}
+	info.Pointers = pointers
+	return info, nil
+}
+
+// compressionCountPointers counts the compression pointers of the raw message.
+func compressionCountPointers(raw []byte) (int, error) {
+	// 1. walk the question section
+	hdr, err := DecodeHeader(raw)
+	if err != nil {
+		return 0, err
+	}
+	var pointers int
+	off := HeaderSize
+	for range hdr.QDCount {
+		if off, err = compressionSkipName(raw, off, &pointers); err != nil {
+			return 0, err
+		}
+		off += 4 // QTYPE and QCLASS
+	}
+
+	// 2. walk the resource records
+	count := int(hdr.ANCount) + int(hdr.NSCount) + int(hdr.ARCount)
+	for range count {
+		if off, err = compressionSkipName(raw, off, &pointers); err != nil {
+			return 0, err
+		}
+		if off+10 > len(raw) {
+			return 0, dnscodec.ErrServerMisbehaving
+		}
+		rrtype := binary.BigEndian.Uint16(raw[off:])
+		rdlength := int(binary.BigEndian.Uint16(raw[off+8:]))
+		off += 10
+		if off+rdlength > len(raw) {
+			return 0, dnscodec.ErrServerMisbehaving
+		}
+		if err := compressionSkipRdata(raw, off, rrtype, &pointers); err != nil {
+			return 0, err
+		}
+		off += rdlength
+	}
+	return pointers, nil
+}
+
+// compressionSkipRdata counts the pointers of the RDATA starting at off for
+// the types whose names RFC 3597 Section 4 allows to compress.
+func compressionSkipRdata(raw []byte, off int, rrtype uint16, pointers *int) error {
+	var err error
+	switch rrtype {
+	case dns.TypeNS, dns.TypeMD, dns.TypeMF, dns.TypeCNAME, dns.TypeMB,
+		dns.TypeMG, dns.TypeMR, dns.TypePTR:
+		_, err = compressionSkipName(raw, off, pointers)
+
+	case dns.TypeMX:
+		_, err = compressionSkipName(raw, off+2, pointers)
+
+	case dns.TypeSOA, dns.TypeMINFO:
+		if off, err = compressionSkipName(raw, off, pointers); err == nil {
+			_, err = compressionSkipName(raw, off, pointers)
+		}
+	}
+	return err
+}
+
+// compressionSkipName skips the name starting at off, incrementing pointers
+// if the name ends with a compression pointer, and returns the next offset.
+func compressionSkipName(raw []byte, off int, pointers *int) (int, error) {
+	for {
+		if off >= len(raw) {
+			return 0, dnscodec.ErrServerMisbehaving
+		}
+		length := int(raw[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+
+		case length&0xc0 == 0xc0:
+			*pointers++
+			return off + 2, nil
+
+		case length&0xc0 != 0:
+			return 0, dnscodec.ErrServerMisbehaving
+
+		default:
+			off += 1 + length
+		}
+	}
+}
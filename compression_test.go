@@ -0,0 +1,112 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newCompressionTestResponse returns a response for example.com containing
+// names that the server may compress, including in the RDATA.
+func newCompressionTestResponse(t *testing.T, query *dns.Msg, compress bool) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Compress = compress
+	for _, record := range []string{
+		"example.com. 60 IN MX 10 mail.example.com.",
+		"example.com. 60 IN NS ns.example.com.",
+		"example.com. 60 IN TXT \"example.com\"",
+	} {
+		rr, err := dns.NewRR(record)
+		require.NoError(t, err)
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
+
+func TestCheckResponseCompression(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeANY)
+
+	t.Run("with compression", func(t *testing.T) {
+		raw, err := newCompressionTestResponse(t, query, true).Pack()
+		require.NoError(t, err)
+		info, err := CheckResponseCompression(raw)
+		require.NoError(t, err)
+		require.True(t, info.Compressed())
+		// three owner names plus the MX and NS targets
+		require.Equal(t, 5, info.Pointers)
+		require.Equal(t, len(raw), info.Size)
+		require.Equal(t, info.UncompressedSize-info.Size, info.BytesSaved)
+		require.Positive(t, info.BytesSaved)
+	})
+
+	t.Run("without compression", func(t *testing.T) {
+		raw, err := newCompressionTestResponse(t, query, false).Pack()
+		require.NoError(t, err)
+		info, err := CheckResponseCompression(raw)
+		require.NoError(t, err)
+		require.False(t, info.Compressed())
+		require.Zero(t, info.BytesSaved)
+	})
+
+	t.Run("with an invalid response", func(t *testing.T) {
+		_, err := CheckResponseCompression([]byte{0, 1, 2})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
+
+func TestTransportCompression(t *testing.T) {
+	handler := HandlerFunc(func(query *dns.Msg) *dns.Msg {
+		return newCompressionTestResponse(t, query, true)
+	})
+	newQuery := func() *dns.Msg {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeANY)
+		query.Compress = true
+		rr, err := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+		require.NoError(t, err)
+		query.Extra = append(query.Extra, rr)
+		return query
+	}
+
+	t.Run("observes the compression of responses", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		var observed []ResponseCompression
+		dt.ObserveResponseCompression = func(info ResponseCompression) {
+			observed = append(observed, info)
+		}
+		_, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, newQuery())
+		require.NoError(t, err)
+		require.Len(t, observed, 1)
+		require.True(t, observed[0].Compressed())
+	})
+
+	for _, noCompression := range []bool{false, true} {
+		name := map[bool]string{false: "honours the message setting", true: "disables compression"}[noCompression]
+		t.Run(name, func(t *testing.T) {
+			dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+			dt.NoCompression = noCompression
+			var rawQueries [][]byte
+			dt.ObserveRawQuery = func(raw []byte) {
+				rawQueries = append(rawQueries, raw)
+			}
+			_, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, newQuery())
+			require.NoError(t, err)
+			_, err = dt.ExchangeUpdate(context.Background(), newQuery())
+			require.NoError(t, err)
+			require.Len(t, rawQueries, 2)
+			for _, raw := range rawQueries {
+				pointers, err := compressionCountPointers(raw)
+				require.NoError(t, err)
+				require.Equal(t, !noCompression, pointers > 0)
+			}
+		})
+	}
+}
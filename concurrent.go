@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/bassosimone/dnscodec"
+	"golang.org/x/net/http2"
+)
+
+// ErrConcurrentStreamsUnsupported indicates that the [StreamOpener] does not
+// support concurrent streams, as is the case for DNS over TCP and TLS, whose
+// exchanges share the same byte stream (see [*PipelinedTransport] instead).
+var ErrConcurrentStreamsUnsupported = errors.New("dnsoverstream: concurrent streams unsupported")
+
+// ConcurrentResult is the result of a single exchange performed by
+// [*Transport.ExchangeConcurrentWithStreamOpener].
+type ConcurrentResult struct {
+	// Response is the response or nil on failure.
+	Response *dnscodec.Response
+
+	// Err is the error or nil on success.
+	Err error
+}
+
+// concurrentStreamOpener is implemented by [StreamOpener] types whose
+// streams are independent, so that we can exchange over them concurrently.
+type concurrentStreamOpener interface {
+	// concurrentStreams returns the [StreamOpener] to use for a single
+	// concurrent exchange bounded by ctx, or false when unsupported.
+	concurrentStreams(ctx context.Context) (StreamOpener, bool)
+}
+
+// ExchangeConcurrentWithStreamOpener sends the queries concurrently over
+// conn, using a distinct stream for each query, and returns the results in
+// the same order as the queries.
+//
+// For DNS over QUIC, this follows the one query per stream model (RFC 9250
+// Section 4.2) and, when we reach the maximum number of streams allowed by the
+// server, we wait for the server to allow new streams. DNS over HTTPS using
+// HTTP/2 and DNS over HTTP/3 also support concurrent streams. Otherwise, this
+// method returns [ErrConcurrentStreamsUnsupported].
+//
+// Like [*Transport.ExchangeWithStreamOpener], this method does not close conn
+// unless ctx transfers its ownership to this method using
+// [WithStreamOpenerOwnership], in which case we close conn after all the
+// exchanges complete.
+func (dt *Transport) ExchangeConcurrentWithStreamOpener(ctx context.Context,
+	conn StreamOpener, queries []*dnscodec.Query) ([]ConcurrentResult, error) {
+	// 1. close the connection when done if we own it
+	ctx, cancel := takeStreamOpenerOwnership(ctx, dt, conn)
+	defer cancel()
+
+	// 2. make sure the streams are independent
+	cs, ok := conn.(concurrentStreamOpener)
+	if !ok {
+		return nil, ErrConcurrentStreamsUnsupported
+	}
+	if _, ok := cs.concurrentStreams(ctx); !ok {
+		return nil, ErrConcurrentStreamsUnsupported
+	}
+
+	// 3. exchange each query over its own stream
+	results := make([]ConcurrentResult, len(queries))
+	var wg sync.WaitGroup
+	for idx, query := range queries {
+		dt.executeGroup(&wg, func() {
+			sconn, _ := cs.concurrentStreams(ctx)
+			resp, err := dt.ExchangeWithStreamOpener(ctx, sconn, query)
+			results[idx] = ConcurrentResult{Response: resp, Err: err}
+		})
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// concurrentStreams implements concurrentStreamOpener.
+func (q *quicConnAdapter) concurrentStreams(ctx context.Context) (StreamOpener, bool) {
+	return &quicSyncStreamOpener{quicConnAdapter: q, ctx: ctx}, true
+}
+
+// concurrentStreams implements concurrentStreamOpener.
+func (c *http3Conn) concurrentStreams(ctx context.Context) (StreamOpener, bool) {
+	return c, true
+}
+
+// concurrentStreams implements concurrentStreamOpener.
+//
+// HTTP/1.1 does not support concurrent requests over the same connection.
+func (c *httpsConn) concurrentStreams(ctx context.Context) (StreamOpener, bool) {
+	_, ok := c.cc.(*http2.ClientConn)
+	return c, ok
+}
+
+// quicSyncStreamOpener is a [*quicConnAdapter] whose OpenStream waits for
+// the server to allow opening a new stream, bounded by the context.
+type quicSyncStreamOpener struct {
+	*quicConnAdapter
+	ctx context.Context
+}
+
+// OpenStream implements [StreamOpener].
+func (q *quicSyncStreamOpener) OpenStream() (Stream, error) {
+	return q.openStream(q.ctx, true)
+}
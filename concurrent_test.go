@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportExchangeConcurrentWithStreamOpener(t *testing.T) {
+	// the server allows two streams at a time, so we also wait for streams
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{newTestCert()}, NextProtos: []string{"doq"}}
+	srv := newDoQTestServerConfig(t, "127.0.0.1:0", tlsConfig, &quic.Config{MaxIncomingStreams: 2},
+		func(query *dns.Msg) []*dns.Msg { return []*dns.Msg{dohTestAnswer(query)} })
+
+	// dialDoQ returns a new DNS over QUIC connection to the server.
+	dialDoQ := func(t *testing.T) (*Transport, StreamOpener) {
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { pconn.Close() })
+		quicDialer := NewQUICDialer(pconn, "example.com")
+		quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+		dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint())
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		return dt, conn
+	}
+
+	var queries []*dnscodec.Query
+	for idx := range 8 {
+		queries = append(queries, dnscodec.NewQuery(fmt.Sprintf("q%d.example.com", idx), dns.TypeA))
+	}
+
+	t.Run("exchanges over parallel QUIC streams without closing", func(t *testing.T) {
+		dt, conn := dialDoQ(t)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		results, err := dt.ExchangeConcurrentWithStreamOpener(ctx, conn, queries)
+		require.NoError(t, err)
+		require.Len(t, results, len(queries))
+		for idx, result := range results {
+			require.NoError(t, result.Err)
+			require.Equal(t, dns.Fqdn(queries[idx].Name), result.Response.Response.Question[0].Name)
+		}
+
+		// the connection is still usable
+		require.False(t, StreamOpenerClosing(conn))
+		results, err = dt.ExchangeConcurrentWithStreamOpener(ctx, conn, queries[:1])
+		require.NoError(t, err)
+		require.NoError(t, results[0].Err)
+	})
+
+	t.Run("closes the connection when owning it", func(t *testing.T) {
+		dt, conn := dialDoQ(t)
+		ctx := WithStreamOpenerOwnership(context.Background(), true)
+		results, err := dt.ExchangeConcurrentWithStreamOpener(ctx, conn, queries[:2])
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		require.Eventually(t, func() bool {
+			return StreamOpenerClosing(conn)
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("refuses connections without concurrent streams", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		conn := NewTCPStreamOpener(client)
+		defer conn.Close()
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), srv.Endpoint())
+		_, err := dt.ExchangeConcurrentWithStreamOpener(context.Background(), conn, queries)
+		require.ErrorIs(t, err, ErrConcurrentStreamsUnsupported)
+	})
+}
@@ -0,0 +1,313 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package conformance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bassosimone/dnsoverstream"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqProtocolError is the DOQ_PROTOCOL_ERROR code (RFC 9250 Section 4.3).
+const doqProtocolError = 0x2
+
+// check is a single conformance check.
+type check struct {
+	// name is the check name.
+	name string
+
+	// reference is the specification the check is based on.
+	reference string
+
+	// protocols contains the protocols the check applies to.
+	protocols []string
+
+	// run runs the check and returns the status and the details.
+	run func(ctx context.Context, r *runner) (Status, string)
+}
+
+// Protocols the checks apply to.
+var (
+	allProtocols = []string{dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS, dnsoverstream.ProtocolQUIC}
+	tcpProtocols = []string{dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS}
+	encProtocols = []string{dnsoverstream.ProtocolTLS, dnsoverstream.ProtocolQUIC}
+)
+
+// checks contains the checks in the order in which [Run] runs them.
+var checks = []check{
+	{"query", "RFC 7766 Section 5; RFC 7858 Section 3; RFC 9250 Section 4", allProtocols, checkQuery},
+	{"connection-reuse", "RFC 7766 Section 6.2.1; RFC 9250 Section 5.5", allProtocols, checkConnectionReuse},
+	{"pipelining", "RFC 7766 Section 6.2.1.1", tcpProtocols, checkPipelining},
+	{"out-of-order", "RFC 7766 Section 7", tcpProtocols, checkOutOfOrder},
+	{"padding", "RFC 8467 Section 4", encProtocols, checkPadding},
+	{"keepalive", "RFC 7828 Section 3.3.2; RFC 7858 Section 3.4", tcpProtocols, checkKeepalive},
+	{"doq-nonzero-id", "RFC 9250 Section 4.2.1", []string{dnsoverstream.ProtocolQUIC}, checkDoQNonzeroID},
+	{"doq-keepalive", "RFC 9250 Section 5.5.2", []string{dnsoverstream.ProtocolQUIC}, checkDoQKeepalive},
+}
+
+// newQuery returns a new query for the given name and type.
+func newQuery(name string, qtype uint16) *dns.Msg {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	return query
+}
+
+// checkQuery checks whether the server answers a query.
+func checkQuery(ctx context.Context, r *runner) (Status, string) {
+	resp, err := dnsoverstream.ExchangeCodec(ctx, r.newTransport(), dnsoverstream.MsgCodec{}, newQuery(r.name, dns.TypeA))
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	return StatusPass, fmt.Sprintf("rcode %s", dns.RcodeToString[resp.Rcode])
+}
+
+// checkConnectionReuse checks whether the server answers several
+// sequential queries using the same connection.
+func checkConnectionReuse(ctx context.Context, r *runner) (Status, string) {
+	const count = 3
+	dt := r.newTransport()
+	conn, err := dt.Dial(ctx)
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	defer conn.Close()
+	for idx := range count {
+		_, err := dnsoverstream.ExchangeCodecWithStreamOpener(ctx, dt, dnsoverstream.MsgCodec{}, conn, newQuery(r.name, dns.TypeA))
+		if err != nil && idx <= 0 {
+			return StatusError, err.Error()
+		}
+		if err != nil {
+			return StatusUnsupported, fmt.Sprintf("query %d failed: %s", idx+1, err.Error())
+		}
+	}
+	return StatusPass, fmt.Sprintf("%d queries answered", count)
+}
+
+// checkPipelining checks whether the server answers all the queries
+// we send over a connection without waiting for the responses.
+func checkPipelining(ctx context.Context, r *runner) (Status, string) {
+	ids, err := r.pipeline(ctx)
+	if err != nil && len(ids) <= 0 {
+		return StatusError, err.Error()
+	}
+	if err != nil {
+		return StatusFail, fmt.Sprintf("%d responses before: %s", len(ids), err.Error())
+	}
+	return StatusPass, fmt.Sprintf("%d responses", len(ids))
+}
+
+// checkOutOfOrder checks whether the server answers pipelined queries
+// out of order, which shows that it processes them concurrently.
+func checkOutOfOrder(ctx context.Context, r *runner) (Status, string) {
+	ids, err := r.pipeline(ctx)
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	for idx := 1; idx < len(ids); idx++ {
+		if ids[idx] < ids[idx-1] {
+			return StatusPass, fmt.Sprintf("response IDs order: %v", ids)
+		}
+	}
+	return StatusUnsupported, "responses were in order, which may be coincidental"
+}
+
+// pipeline sends pipelined queries over a new connection and returns the
+// response IDs in the order in which we received them.
+//
+// The first query is for a random subdomain, which a recursive resolver
+// is unlikely to have cached, to give the server a chance to reorder.
+func (r *runner) pipeline(ctx context.Context) ([]uint16, error) {
+	// 1. create the queries
+	label := make([]byte, 8)
+	rand.Read(label)
+	queries := []*dns.Msg{
+		newQuery(hex.EncodeToString(label)+"."+r.name, dns.TypeA),
+		newQuery(r.name, dns.TypeA),
+		newQuery(r.name, dns.TypeAAAA),
+		newQuery(r.name, dns.TypeNS),
+	}
+	for idx, query := range queries {
+		query.Id = uint16(idx + 1)
+	}
+
+	// 2. send all the queries at once
+	stream, done, err := r.openStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := writeMsgs(stream, queries...); err != nil {
+		return nil, err
+	}
+
+	// 3. read all the responses
+	var ids []uint16
+	for range queries {
+		resp, err := readMsg(stream)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, resp.Id)
+	}
+	return ids, nil
+}
+
+// checkPadding checks whether the server pads the response to a padded query.
+func checkPadding(ctx context.Context, r *runner) (Status, string) {
+	var size int
+	dt := r.newTransport()
+	dt.ObserveRawResponse = func(rawResp []byte) {
+		size = len(rawResp)
+	}
+	resp, err := dnsoverstream.ExchangeCodec(ctx, dt, dnsoverstream.MsgCodec{}, newQuery(r.name, dns.TypeA))
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0PADDING {
+				return StatusPass, fmt.Sprintf("padded response size %d", size)
+			}
+		}
+	}
+	return StatusUnsupported, fmt.Sprintf("unpadded response size %d", size)
+}
+
+// checkKeepalive checks whether the server advertises an idle timeout when
+// the query contains an empty edns-tcp-keepalive option.
+func checkKeepalive(ctx context.Context, r *runner) (Status, string) {
+	query := newQuery(r.name, dns.TypeA)
+	query.SetEdns0(dns.DefaultMsgSize, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	resp, err := dnsoverstream.ExchangeCodec(ctx, r.newTransport(), dnsoverstream.MsgCodec{}, query)
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				timeout := time.Duration(keepalive.Timeout) * 100 * time.Millisecond
+				return StatusPass, fmt.Sprintf("idle timeout %s", timeout)
+			}
+		}
+	}
+	return StatusUnsupported, "no edns-tcp-keepalive option in the response"
+}
+
+// checkDoQNonzeroID checks whether the server treats a query with
+// a nonzero message ID as a protocol error.
+func checkDoQNonzeroID(ctx context.Context, r *runner) (Status, string) {
+	query := newQuery(r.name, dns.TypeA)
+	query.Id = 4242
+	return r.expectDoQProtocolError(ctx, query)
+}
+
+// checkDoQKeepalive checks whether the server treats a query with
+// the edns-tcp-keepalive option as a protocol error.
+func checkDoQKeepalive(ctx context.Context, r *runner) (Status, string) {
+	query := newQuery(r.name, dns.TypeA)
+	query.Id = 0
+	query.SetEdns0(dns.DefaultMsgSize, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	return r.expectDoQProtocolError(ctx, query)
+}
+
+// expectDoQProtocolError sends the query and checks whether the
+// server fails with the DOQ_PROTOCOL_ERROR code.
+func (r *runner) expectDoQProtocolError(ctx context.Context, query *dns.Msg) (Status, string) {
+	stream, done, err := r.openStream(ctx)
+	if err != nil {
+		return StatusError, err.Error()
+	}
+	defer done()
+	if err := writeMsgs(stream, query); err != nil {
+		return StatusError, err.Error()
+	}
+	stream.Close() // send STREAM FIN (RFC 9250 Section 4.2)
+	_, err = readMsg(stream)
+	if err == nil {
+		return StatusFail, "server answered"
+	}
+	code, ok := doqErrorCode(err)
+	switch {
+	case !ok:
+		return StatusFail, fmt.Sprintf("no DoQ error code: %s", err.Error())
+	case code != doqProtocolError:
+		return StatusFail, fmt.Sprintf("unexpected DoQ error code 0x%x", code)
+	default:
+		return StatusPass, "DOQ_PROTOCOL_ERROR"
+	}
+}
+
+// doqErrorCode returns the DoQ error code of a QUIC connection or stream error.
+func doqErrorCode(err error) (uint64, bool) {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) {
+		return uint64(appErr.ErrorCode), true
+	}
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return uint64(streamErr.ErrorCode), true
+	}
+	return 0, false
+}
+
+// openStream dials a new connection and opens a [dnsoverstream.Stream] whose
+// deadline is the context deadline. The caller MUST call done when done.
+func (r *runner) openStream(ctx context.Context) (dnsoverstream.Stream, func(), error) {
+	conn, err := r.newTransport().Dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := conn.OpenStream()
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	return stream, func() { conn.Close() }, nil
+}
+
+// writeMsgs packs and frames the messages and sends them using a single write.
+func writeMsgs(w io.Writer, msgs ...*dns.Msg) error {
+	var frames []byte
+	for _, msg := range msgs {
+		raw, err := msg.Pack()
+		if err != nil {
+			return err
+		}
+		frames = append(frames, byte(len(raw)>>8), byte(len(raw)))
+		frames = append(frames, raw...)
+	}
+	_, err := w.Write(frames)
+	return err
+}
+
+// readMsg reads and unpacks a single framed message.
+func readMsg(r io.Reader) (*dns.Msg, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, int(header[0])<<8|int(header[1]))
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,293 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package conformance
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/dnsoverstream"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is the PKI shared by tests requiring TLS.
+var testPKI = sync.OnceValue(func() *pkitest.PKI {
+	return pkitest.MustNewPKI("../testdata")
+})
+
+// newTestCert creates a certificate valid for example.com and 127.0.0.1.
+func newTestCert() tls.Certificate {
+	return testPKI().MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "example.com",
+		DNSNames:     []string{"example.com"},
+		IPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Organization: []string{"Example"},
+	})
+}
+
+// newTestClientTLSConfig returns the client [*tls.Config] trusting [testPKI].
+func newTestClientTLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		NextProtos: nextProtos,
+		RootCAs:    testPKI().CertPool(),
+		ServerName: "example.com",
+	}
+}
+
+// newTestHandler returns the [*dnstest.Handler] answering for example.com.
+func newTestHandler() *dnstest.Handler {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("example.com", netip.MustParseAddr("93.184.216.34"))
+	return dnstest.NewHandler(config)
+}
+
+// mutatingHandler returns a [dns.Handler] answering using [newTestHandler] after
+// applying mutate to the response and optionally closing the connection.
+func mutatingHandler(mutate func(resp *dns.Msg), closeConn bool) dns.Handler {
+	handler := newTestHandler()
+	return dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		resp := handler.PrepareResponse(query)
+		if mutate != nil {
+			mutate(resp)
+		}
+		w.WriteMsg(resp)
+		if closeConn {
+			w.Close()
+		}
+	})
+}
+
+// newTCPTestRunner returns a [*runner] for a DNS-over-TCP server using handler.
+func newTCPTestRunner(t *testing.T, handler dns.Handler) *runner {
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	t.Cleanup(srv.Close)
+	dialer := dnsoverstream.NewStreamOpenerDialerTCP(&net.Dialer{})
+	return newRunner(NewConfig(dialer, netip.MustParseAddrPort(srv.Address()), dnsoverstream.ProtocolTCP))
+}
+
+// newTLSTestRunner returns a [*runner] for a DNS-over-TLS server using handler.
+func newTLSTestRunner(t *testing.T, handler dns.Handler) *runner {
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), handler)
+	t.Cleanup(srv.Close)
+	dialer := dnsoverstream.NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")})
+	return newRunner(NewConfig(dialer, netip.MustParseAddrPort(srv.Address()), dnsoverstream.ProtocolTLS))
+}
+
+// newDoQTestRunner returns a [*runner] for a minimal DNS-over-QUIC server
+// that, when conformant, closes the connection with DOQ_PROTOCOL_ERROR when
+// the query has a nonzero ID or contains the edns-tcp-keepalive option.
+func newDoQTestRunner(t *testing.T, conformant bool) *runner {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{newTestCert()}, NextProtos: []string{"doq"}}
+	listener, err := quic.Listen(pconn, tlsConfig, &quic.Config{})
+	require.NoError(t, err)
+
+	handler := newTestHandler()
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					query, err := readMsg(stream)
+					if err != nil {
+						return
+					}
+					if conformant && (query.Id != 0 || doqTestHasKeepalive(query)) {
+						conn.CloseWithError(doqProtocolError, "")
+						return
+					}
+					writeMsgs(stream, handler.PrepareResponse(query))
+					stream.Close()
+				}
+			})
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		pconn.Close()
+		wg.Wait()
+	})
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { clientConn.Close() })
+	quicDialer := dnsoverstream.NewQUICDialer(clientConn, "example.com")
+	quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+	dialer := dnsoverstream.NewStreamOpenerDialerQUIC(quicDialer)
+	endpoint := listener.Addr().(*net.UDPAddr).AddrPort()
+	return newRunner(NewConfig(dialer, endpoint, dnsoverstream.ProtocolQUIC))
+}
+
+// doqTestHasKeepalive returns whether the query contains the edns-tcp-keepalive option.
+func doqTestHasKeepalive(query *dns.Msg) bool {
+	if opt := query.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if option.Option() == dns.EDNS0TCPKEEPALIVE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCheckQuery(t *testing.T) {
+	r := newTCPTestRunner(t, newTestHandler())
+	status, detail := checkQuery(context.Background(), r)
+	require.Equal(t, StatusPass, status)
+	require.Equal(t, "rcode NOERROR", detail)
+}
+
+func TestCheckConnectionReuse(t *testing.T) {
+	t.Run("supported", func(t *testing.T) {
+		r := newTCPTestRunner(t, newTestHandler())
+		status, _ := checkConnectionReuse(context.Background(), r)
+		require.Equal(t, StatusPass, status)
+	})
+
+	t.Run("server closing after each response", func(t *testing.T) {
+		r := newTCPTestRunner(t, mutatingHandler(nil, true))
+		status, detail := checkConnectionReuse(context.Background(), r)
+		require.Equal(t, StatusUnsupported, status)
+		require.Contains(t, detail, "query 2 failed")
+	})
+}
+
+func TestCheckPipelining(t *testing.T) {
+	t.Run("supported", func(t *testing.T) {
+		r := newTCPTestRunner(t, newTestHandler())
+		status, detail := checkPipelining(context.Background(), r)
+		require.Equal(t, StatusPass, status)
+		require.Equal(t, "4 responses", detail)
+	})
+
+	t.Run("server closing after the first response", func(t *testing.T) {
+		r := newTCPTestRunner(t, mutatingHandler(nil, true))
+		status, detail := checkPipelining(context.Background(), r)
+		require.Equal(t, StatusFail, status)
+		require.Contains(t, detail, "1 responses before")
+	})
+}
+
+func TestCheckOutOfOrder(t *testing.T) {
+	// The test server answers sequentially, so responses are in order.
+	r := newTCPTestRunner(t, newTestHandler())
+	status, _ := checkOutOfOrder(context.Background(), r)
+	require.Equal(t, StatusUnsupported, status)
+}
+
+func TestCheckPadding(t *testing.T) {
+	t.Run("unpadded", func(t *testing.T) {
+		r := newTLSTestRunner(t, newTestHandler())
+		status, _ := checkPadding(context.Background(), r)
+		require.Equal(t, StatusUnsupported, status)
+	})
+
+	t.Run("padded", func(t *testing.T) {
+		r := newTLSTestRunner(t, mutatingHandler(func(resp *dns.Msg) {
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 32)})
+		}, false))
+		status, detail := checkPadding(context.Background(), r)
+		require.Equal(t, StatusPass, status)
+		require.Contains(t, detail, "padded response size")
+	})
+}
+
+func TestCheckKeepalive(t *testing.T) {
+	t.Run("unsupported", func(t *testing.T) {
+		r := newTCPTestRunner(t, newTestHandler())
+		status, _ := checkKeepalive(context.Background(), r)
+		require.Equal(t, StatusUnsupported, status)
+	})
+
+	t.Run("supported", func(t *testing.T) {
+		r := newTCPTestRunner(t, mutatingHandler(func(resp *dns.Msg) {
+			resp.SetEdns0(dns.DefaultMsgSize, false)
+			opt := resp.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 300})
+		}, false))
+		status, detail := checkKeepalive(context.Background(), r)
+		require.Equal(t, StatusPass, status)
+		require.Equal(t, "idle timeout 30s", detail)
+	})
+}
+
+func TestCheckDoQ(t *testing.T) {
+	t.Run("conformant server", func(t *testing.T) {
+		r := newDoQTestRunner(t, true)
+		for _, check := range []func(context.Context, *runner) (Status, string){checkDoQNonzeroID, checkDoQKeepalive} {
+			status, detail := check(context.Background(), r)
+			require.Equal(t, StatusPass, status)
+			require.Equal(t, "DOQ_PROTOCOL_ERROR", detail)
+		}
+		status, _ := checkQuery(context.Background(), r)
+		require.Equal(t, StatusPass, status)
+	})
+
+	t.Run("nonconformant server", func(t *testing.T) {
+		r := newDoQTestRunner(t, false)
+		for _, check := range []func(context.Context, *runner) (Status, string){checkDoQNonzeroID, checkDoQKeepalive} {
+			status, detail := check(context.Background(), r)
+			require.Equal(t, StatusFail, status)
+			require.Equal(t, "server answered", detail)
+		}
+	})
+}
+
+func TestDoQErrorCode(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		code   uint64
+		hasErr bool
+	}{
+		{"application error", &quic.ApplicationError{ErrorCode: 0x2}, 0x2, true},
+		{"stream error", &quic.StreamError{ErrorCode: 0x3}, 0x3, true},
+		{"other error", io.ErrUnexpectedEOF, 0, false},
+		{"wrapped error", errors.Join(errors.New("x"), &quic.StreamError{ErrorCode: 0x4}), 0x4, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code, ok := doqErrorCode(tc.err)
+			require.Equal(t, tc.hasErr, ok)
+			require.Equal(t, tc.code, code)
+		})
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	// Use a closed port so that dialing fails.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	endpoint := listener.Addr().(*net.TCPAddr).AddrPort()
+	listener.Close()
+	dialer := dnsoverstream.NewStreamOpenerDialerTCP(&net.Dialer{})
+	r := newRunner(NewConfig(dialer, endpoint, dnsoverstream.ProtocolTCP))
+
+	for _, c := range checks {
+		t.Run(c.name, func(t *testing.T) {
+			status, detail := c.run(context.Background(), r)
+			require.Equal(t, StatusError, status)
+			require.NotEmpty(t, detail)
+		})
+	}
+}
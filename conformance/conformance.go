@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+// Package conformance runs client-observable conformance checks against
+// DNS over TCP (RFC 7766), TLS (RFC 7858), and QUIC (RFC 9250) servers.
+//
+// Use [Run] with a [*Config] and inspect or serialize the returned [*Report].
+//
+// The checks only observe what a client can see. For example, receiving
+// responses in order does not prove that a server cannot reorder them.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/bassosimone/dnsoverstream"
+)
+
+// DefaultName is the default [Config] Name.
+const DefaultName = "example.com"
+
+// DefaultCheckTimeout is the default [Config] CheckTimeout.
+const DefaultCheckTimeout = 5 * time.Second
+
+// Config configures [Run].
+//
+// Construct using [NewConfig].
+type Config struct {
+	// Dialer is the MANDATORY [dnsoverstream.StreamOpenerDialer] for the protocol.
+	Dialer dnsoverstream.StreamOpenerDialer
+
+	// Endpoint is the MANDATORY server endpoint.
+	Endpoint netip.AddrPort
+
+	// Protocol is the MANDATORY protocol, which must be one of
+	// [dnsoverstream.ProtocolTCP], [dnsoverstream.ProtocolTLS],
+	// or [dnsoverstream.ProtocolQUIC].
+	Protocol string
+
+	// Name is the OPTIONAL domain name to query. If empty, we use [DefaultName].
+	Name string
+
+	// CheckTimeout is the OPTIONAL timeout for each check. If zero or
+	// negative, we use [DefaultCheckTimeout].
+	CheckTimeout time.Duration
+}
+
+// NewConfig creates a new [*Config] with the given dialer, endpoint, and protocol.
+func NewConfig(dialer dnsoverstream.StreamOpenerDialer, endpoint netip.AddrPort, protocol string) *Config {
+	return &Config{Dialer: dialer, Endpoint: endpoint, Protocol: protocol}
+}
+
+// NewConfigFromSniff creates a new [*Config] using the protocol and the dialer
+// guessed by [*dnsoverstream.Sniffer], which allows to check unknown
+// encrypted endpoints. This function returns an error wrapping
+// [dnsoverstream.ErrUnknownProtocol] if we cannot check the protocol.
+func NewConfigFromSniff(result *dnsoverstream.SniffResult) (*Config, error) {
+	switch result.Protocol {
+	case dnsoverstream.ProtocolTLS, dnsoverstream.ProtocolQUIC:
+		return NewConfig(result.Dialer, result.Endpoint, result.Protocol), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", dnsoverstream.ErrUnknownProtocol, result.Protocol)
+	}
+}
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	// StatusPass indicates that the server behaves as specified.
+	StatusPass = Status("pass")
+
+	// StatusFail indicates that the server violates the specification.
+	StatusFail = Status("fail")
+
+	// StatusUnsupported indicates that the server does not implement
+	// an optional (i.e., SHOULD or MAY) behaviour.
+	StatusUnsupported = Status("unsupported")
+
+	// StatusSkip indicates that the check does not apply to the protocol.
+	StatusSkip = Status("skip")
+
+	// StatusError indicates that we could not run the check, for example,
+	// because the server is unreachable.
+	StatusError = Status("error")
+)
+
+// Result is the result of a single check.
+type Result struct {
+	// Check is the check name (e.g., "pipelining").
+	Check string `json:"check"`
+
+	// Reference is the specification the check is based on.
+	Reference string `json:"reference"`
+
+	// Status is the check [Status].
+	Status Status `json:"status"`
+
+	// Detail OPTIONALLY describes what we observed.
+	Detail string `json:"detail,omitempty"`
+
+	// Elapsed is the time spent running the check.
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+// Report is the structured report returned by [Run], which is
+// suitable for serializing using [encoding/json].
+type Report struct {
+	// Protocol is the protocol we checked.
+	Protocol string `json:"protocol"`
+
+	// Endpoint is the server endpoint.
+	Endpoint string `json:"endpoint"`
+
+	// StartTime is the time when we started running the checks.
+	StartTime time.Time `json:"startTime"`
+
+	// Results contains the [Result] of each check.
+	Results []Result `json:"results"`
+}
+
+// Failed returns whether any check has [StatusFail] or [StatusError].
+func (r *Report) Failed() bool {
+	return slices.ContainsFunc(r.Results, func(result Result) bool {
+		return result.Status == StatusFail || result.Status == StatusError
+	})
+}
+
+// Run runs all the checks sequentially and returns the [*Report].
+//
+// This function only fails if the config is invalid. Failed checks
+// are reported using the [Result] Status.
+func Run(ctx context.Context, config *Config) (*Report, error) {
+	// 1. validate the config
+	switch config.Protocol {
+	case dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS, dnsoverstream.ProtocolQUIC:
+	default:
+		return nil, fmt.Errorf("%w: %q", dnsoverstream.ErrUnknownProtocol, config.Protocol)
+	}
+	r := newRunner(config)
+
+	// 2. run each check bounding its duration
+	report := &Report{
+		Protocol:  config.Protocol,
+		Endpoint:  config.Endpoint.String(),
+		StartTime: time.Now(),
+	}
+	for _, c := range checks {
+		report.Results = append(report.Results, r.run(ctx, c))
+	}
+	return report, nil
+}
+
+// runner runs the checks using a given [*Config].
+type runner struct {
+	config  *Config
+	name    string
+	timeout time.Duration
+}
+
+// newRunner creates a new [*runner] applying the config defaults.
+func newRunner(config *Config) *runner {
+	r := &runner{config: config, name: config.Name, timeout: config.CheckTimeout}
+	if r.name == "" {
+		r.name = DefaultName
+	}
+	if r.timeout <= 0 {
+		r.timeout = DefaultCheckTimeout
+	}
+	return r
+}
+
+// run runs a single [check] and returns its [Result].
+func (r *runner) run(ctx context.Context, c check) Result {
+	result := Result{Check: c.name, Reference: c.reference}
+	if !slices.Contains(c.protocols, r.config.Protocol) {
+		result.Status = StatusSkip
+		result.Detail = fmt.Sprintf("not applicable to %s", r.config.Protocol)
+		return result
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	t0 := time.Now()
+	result.Status, result.Detail = c.run(ctx, r)
+	result.Elapsed = time.Since(t0)
+	return result
+}
+
+// newTransport creates a new [*dnsoverstream.Transport] for the endpoint.
+func (r *runner) newTransport() *dnsoverstream.Transport {
+	return dnsoverstream.NewTransport(r.config.Dialer, r.config.Endpoint)
+}
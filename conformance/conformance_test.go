@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnsoverstream"
+	"github.com/bassosimone/dnstest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Run("unknown protocol", func(t *testing.T) {
+		config := NewConfig(dnsoverstream.NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{}, "udp")
+		report, err := Run(context.Background(), config)
+		require.ErrorIs(t, err, dnsoverstream.ErrUnknownProtocol)
+		require.Nil(t, report)
+	})
+
+	t.Run("TCP server", func(t *testing.T) {
+		r := newTCPTestRunner(t, newTestHandler())
+		report, err := Run(context.Background(), r.config)
+		require.NoError(t, err)
+		require.False(t, report.Failed())
+		require.Equal(t, dnsoverstream.ProtocolTCP, report.Protocol)
+		require.Equal(t, r.config.Endpoint.String(), report.Endpoint)
+		require.Len(t, report.Results, len(checks))
+
+		statuses := make(map[string]Status)
+		for _, result := range report.Results {
+			statuses[result.Check] = result.Status
+			require.NotEmpty(t, result.Reference)
+		}
+		require.Equal(t, map[string]Status{
+			"query":            StatusPass,
+			"connection-reuse": StatusPass,
+			"pipelining":       StatusPass,
+			"out-of-order":     StatusUnsupported,
+			"padding":          StatusSkip,
+			"keepalive":        StatusUnsupported,
+			"doq-nonzero-id":   StatusSkip,
+			"doq-keepalive":    StatusSkip,
+		}, statuses)
+
+		data, err := json.Marshal(report)
+		require.NoError(t, err)
+		require.Contains(t, string(data), `"check":"pipelining"`)
+	})
+
+	t.Run("QUIC server", func(t *testing.T) {
+		r := newDoQTestRunner(t, true)
+		report, err := Run(context.Background(), r.config)
+		require.NoError(t, err)
+		require.False(t, report.Failed())
+	})
+}
+
+func TestReportFailed(t *testing.T) {
+	for _, tc := range []struct {
+		status   Status
+		expected bool
+	}{
+		{StatusPass, false},
+		{StatusUnsupported, false},
+		{StatusSkip, false},
+		{StatusFail, true},
+		{StatusError, true},
+	} {
+		t.Run(string(tc.status), func(t *testing.T) {
+			report := &Report{Results: []Result{{Status: StatusPass}, {Status: tc.status}}}
+			require.Equal(t, tc.expected, report.Failed())
+		})
+	}
+}
+
+func TestNewRunner(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		r := newRunner(&Config{})
+		require.Equal(t, DefaultName, r.name)
+		require.Equal(t, DefaultCheckTimeout, r.timeout)
+	})
+
+	t.Run("custom values", func(t *testing.T) {
+		r := newRunner(&Config{Name: "dns.google", CheckTimeout: time.Second})
+		require.Equal(t, "dns.google", r.name)
+		require.Equal(t, time.Second, r.timeout)
+	})
+}
+
+func TestNewConfigFromSniff(t *testing.T) {
+	t.Run("checks the sniffed protocol", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newTestHandler())
+		t.Cleanup(srv.Close)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		sniffer := dnsoverstream.NewSniffer(newTestClientTLSConfig())
+		result, err := sniffer.Sniff(ctx, netip.MustParseAddrPort(srv.Address()))
+		require.NoError(t, err)
+
+		config, err := NewConfigFromSniff(result)
+		require.NoError(t, err)
+		require.Equal(t, dnsoverstream.ProtocolTLS, config.Protocol)
+		require.Equal(t, result.Endpoint, config.Endpoint)
+		report, err := Run(context.Background(), config)
+		require.NoError(t, err)
+		require.False(t, report.Failed())
+	})
+
+	t.Run("fails with protocols we cannot check", func(t *testing.T) {
+		result := &dnsoverstream.SniffResult{Protocol: dnsoverstream.ProtocolHTTPS}
+		config, err := NewConfigFromSniff(result)
+		require.ErrorIs(t, err, dnsoverstream.ErrUnknownProtocol)
+		require.Nil(t, config)
+	})
+}
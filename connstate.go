@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ConnState is a snapshot of the state of a connection kept open across
+// exchanges, which allows operators to debug a live forwarder without extra
+// instrumentation.
+//
+// Obtain using [*Transport.ConnState], [*PersistentTransport.ConnState],
+// or [*PipelinedTransport.ConnState].
+type ConnState struct {
+	// Protocol is the protocol name (see [PoolKey] Protocol).
+	Protocol string
+
+	// Endpoint is the server endpoint.
+	Endpoint netip.AddrPort
+
+	// Age is the time elapsed since we dialed the connection.
+	Age time.Duration
+
+	// Queries is the number of exchanges performed over
+	// the connection, including the failed ones.
+	Queries uint64
+
+	// InFlight is the number of exchanges in progress.
+	InFlight int
+
+	// Idle is the time elapsed since the last exchange completed or, if
+	// none, since dialing, which is zero while exchanges are in progress.
+	Idle time.Duration
+
+	// LastErr is the error of the last failed exchange, if any.
+	LastErr error
+
+	// Closed indicates that we closed the connection (e.g., after LastErr
+	// or because the server signalled it is closing the connection) and
+	// that we will dial a new connection at the next exchange.
+	Closed bool
+
+	// KeepaliveAdvertised indicates that the server advertised an idle
+	// timeout using edns-tcp-keepalive (see [*Transport] TCPKeepalive).
+	KeepaliveAdvertised bool
+
+	// KeepaliveTimeout is the last idle timeout advertised by the server.
+	KeepaliveTimeout time.Duration
+}
+
+// connStats tracks the [ConnState] of a connection.
+type connStats struct {
+	// key identifies the connection protocol and endpoint.
+	key PoolKey
+
+	// created is when we dialed the connection, using the [*Pool] clock
+	// for pooled connections, since MaxLifetime uses the pool clock.
+	created time.Time
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// lastUsed is when the last exchange completed.
+	lastUsed time.Time
+
+	// queries is the number of exchanges.
+	queries uint64
+
+	// inFlight is the number of exchanges in progress.
+	inFlight int
+
+	// lastErr is the error of the last failed exchange.
+	lastErr error
+
+	// closed indicates that we closed the connection.
+	closed bool
+
+	// keepaliveAdvertised indicates that the server advertised keepaliveTimeout.
+	keepaliveAdvertised bool
+
+	// keepaliveTimeout is the idle timeout advertised using edns-tcp-keepalive.
+	keepaliveTimeout time.Duration
+}
+
+// newConnStats creates a new [*connStats] for a connection dialed at now.
+func newConnStats(key PoolKey, now time.Time) *connStats {
+	return &connStats{key: key, created: now, lastUsed: now}
+}
+
+// begin records that an exchange started.
+func (cs *connStats) begin() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.inFlight++
+}
+
+// end records that an exchange completed at now with the given error.
+func (cs *connStats) end(now time.Time, err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.inFlight--
+	cs.queries++
+	cs.lastUsed = now
+	if err != nil {
+		cs.lastErr = err
+	}
+}
+
+// markClosed records that we closed the connection, possibly because of err.
+func (cs *connStats) markClosed(err error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.closed = true
+	if err != nil {
+		cs.lastErr = err
+	}
+}
+
+// setKeepalive records the idle timeout advertised by the server.
+func (cs *connStats) setKeepalive(timeout time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.keepaliveAdvertised = true
+	cs.keepaliveTimeout = timeout
+}
+
+// keepalive returns the idle timeout advertised by the server, if any.
+func (cs *connStats) keepalive() (time.Duration, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.keepaliveTimeout, cs.keepaliveAdvertised
+}
+
+// connStatsKey is the context key for [withConnStats].
+type connStatsKey struct{}
+
+// withConnStats returns a copy of ctx carrying the [*connStats] of the
+// connection used by the exchange, so we can record what we learn while
+// exchanging (e.g., the edns-tcp-keepalive timeout).
+func withConnStats(ctx context.Context, stats *connStats) context.Context {
+	return context.WithValue(ctx, connStatsKey{}, stats)
+}
+
+// connStatsFromContext returns the [*connStats] carried by ctx or nil.
+func connStatsFromContext(ctx context.Context) *connStats {
+	stats, _ := ctx.Value(connStatsKey{}).(*connStats)
+	return stats
+}
+
+// snapshot returns the [ConnState] at now.
+func (cs *connStats) snapshot(now time.Time) ConnState {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	state := ConnState{
+		Protocol: cs.key.Protocol,
+		Endpoint: cs.key.Endpoint,
+		Age:      now.Sub(cs.created),
+		Queries:  cs.queries,
+		InFlight: cs.inFlight,
+		LastErr:  cs.lastErr,
+		Closed:   cs.closed,
+
+		KeepaliveAdvertised: cs.keepaliveAdvertised,
+		KeepaliveTimeout:    cs.keepaliveTimeout,
+	}
+	if cs.inFlight <= 0 {
+		state.Idle = now.Sub(cs.lastUsed)
+	}
+	return state
+}
+
+// ConnState returns a snapshot of the connections that the Pool keeps for the
+// transport endpoint, including those used by the exchanges in progress, sorted
+// from the oldest, or nil when Pool is nil.
+//
+// We compute the Age and Idle durations using the [*Pool] TimeNow.
+//
+// Use [*PersistentTransport.ConnState] and [*PipelinedTransport.ConnState]
+// for the connections of the transports built on top of this one.
+func (dt *Transport) ConnState() []ConnState {
+	if dt.Pool == nil {
+		return nil
+	}
+	return dt.Pool.connState(newPoolKey(dt.dialer, dt.endpoint), dt.Pool.now())
+}
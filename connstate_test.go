@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportConnState(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("returns nil without a pool", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort("127.0.0.1:53"))
+		require.Nil(t, dt.ConnState())
+	})
+
+	t.Run("reports the pooled connections", func(t *testing.T) {
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		t.Cleanup(srv.Close)
+		endpoint := netip.MustParseAddrPort(srv.Address())
+		dt := NewPooledTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint, 0)
+		defer dt.Pool.Close()
+		now := time.Now()
+		dt.Pool.TimeNow = func() time.Time { return now }
+
+		for range 2 {
+			_, err := dt.Exchange(context.Background(), query)
+			require.NoError(t, err)
+		}
+		now = now.Add(5 * time.Second)
+		require.Equal(t, []ConnState{{
+			Protocol: ProtocolTCP,
+			Endpoint: endpoint,
+			Age:      5 * time.Second,
+			Queries:  2,
+			Idle:     5 * time.Second,
+		}}, dt.ConnState())
+	})
+
+	t.Run("reports the connections in use", func(t *testing.T) {
+		release := make(chan struct{})
+		dt := NewPooledTransport(&FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return &FuncStreamOpener{OpenStreamFunc: func() (Stream, error) {
+					<-release
+					return NewHandlerStreamOpener(newBenchHandler()).OpenStream()
+				}}, nil
+			},
+		}, netip.MustParseAddrPort("127.0.0.1:53"), 0)
+		defer dt.Pool.Close()
+
+		done := make(chan error)
+		go func() {
+			_, err := dt.Exchange(context.Background(), query)
+			done <- err
+		}()
+		require.Eventually(t, func() bool {
+			states := dt.ConnState()
+			return len(states) == 1 && states[0].InFlight == 1 && states[0].Idle == 0
+		}, time.Second, time.Millisecond)
+		close(release)
+		require.NoError(t, <-done)
+		states := dt.ConnState()
+		require.Len(t, states, 1)
+		require.Equal(t, 0, states[0].InFlight)
+		require.Equal(t, uint64(1), states[0].Queries)
+	})
+}
+
+func TestPersistentTransportConnState(t *testing.T) {
+	broken := &closeCountingOpener{FuncStreamOpener: FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{ReadFunc: func(p []byte) (int, error) { return 0, io.ErrUnexpectedEOF }}, nil
+		},
+	}}
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return broken, nil
+		},
+	}
+	pt := NewPersistentTransport(NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53")))
+	defer pt.Close()
+	require.Nil(t, pt.ConnState())
+
+	_, err := pt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	states := pt.ConnState()
+	require.Len(t, states, 1)
+	require.Equal(t, uint64(1), states[0].Queries)
+	require.ErrorIs(t, states[0].LastErr, io.ErrUnexpectedEOF)
+	require.True(t, states[0].Closed)
+}
+
+func TestPipelinedTransportConnState(t *testing.T) {
+	// the server does not answer q1 queries
+	endpoint, _ := newPipelineTestServer(t, func(conn net.Conn) {
+		for {
+			query, err := pipelineTestReadQuery(conn)
+			if err != nil {
+				return
+			}
+			if query.Question[0].Name == "q1.example.com." {
+				continue
+			}
+			if err := pipelineTestWriteAnswer(conn, query); err != nil {
+				return
+			}
+		}
+	})
+	pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+	require.Nil(t, pt.ConnState())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pt.Exchange(ctx, dnscodec.NewQuery("q1.example.com", dns.TypeA))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = pt.Exchange(context.Background(), dnscodec.NewQuery("q2.example.com", dns.TypeA))
+	require.NoError(t, err)
+
+	// a failed exchange does not close the connection
+	states := pt.ConnState()
+	require.Len(t, states, 1)
+	require.Equal(t, ProtocolTCP, states[0].Protocol)
+	require.Equal(t, uint64(2), states[0].Queries)
+	require.ErrorIs(t, states[0].LastErr, context.DeadlineExceeded)
+	require.False(t, states[0].Closed)
+
+	require.NoError(t, pt.Close())
+	states = pt.ConnState()
+	require.True(t, states[0].Closed)
+	require.ErrorIs(t, states[0].LastErr, context.DeadlineExceeded)
+}
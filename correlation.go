@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// correlationIDKey is the context key for the correlation ID.
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the given correlation ID.
+//
+// The [*Transport] attaches the correlation ID to the log lines and to the
+// [ExchangeTiming] of the exchanges using the returned context, so that
+// measurement pipelines can join data collected by different sinks.
+//
+// If the context does not carry a correlation ID, the [*Transport]
+// generates one using [NewCorrelationID] for each exchange.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, if any.
+func CorrelationID(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationIDKey{}).(string)
+	return id, ok
+}
+
+// NewCorrelationID returns a new random (version 4) UUID (RFC 9562 Section 5.4).
+func NewCorrelationID() string {
+	var uuid [16]byte
+	rand.Read(uuid[:])
+	uuid[6] = (uuid[6] & 0x0f) | 0x40 // version 4
+	uuid[8] = (uuid[8] & 0x3f) | 0x80 // variant 10
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf[:])
+}
+
+// ensureCorrelationID returns a context carrying a correlation ID, generating
+// a new one using [NewCorrelationID] if needed, along with the ID itself.
+func ensureCorrelationID(ctx context.Context) (context.Context, string) {
+	if id, ok := CorrelationID(ctx); ok {
+		return ctx, id
+	}
+	id := NewCorrelationID()
+	return WithCorrelationID(ctx, id), id
+}
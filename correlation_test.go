@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCorrelationID(t *testing.T) {
+	uuidRegexp := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := NewCorrelationID(), NewCorrelationID()
+	require.Regexp(t, uuidRegexp, first)
+	require.Regexp(t, uuidRegexp, second)
+	require.NotEqual(t, first, second)
+}
+
+func TestCorrelationID(t *testing.T) {
+	t.Run("without correlation ID", func(t *testing.T) {
+		id, ok := CorrelationID(context.Background())
+		require.False(t, ok)
+		require.Empty(t, id)
+	})
+
+	t.Run("with correlation ID", func(t *testing.T) {
+		id, ok := CorrelationID(WithCorrelationID(context.Background(), "abc"))
+		require.True(t, ok)
+		require.Equal(t, "abc", id)
+	})
+}
+
+func TestTransportCorrelationID(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+
+	// newTransport returns a [*Transport] recording the logged
+	// and the observed correlation IDs.
+	newTransport := func(buf *bytes.Buffer, timings *[]ExchangeTiming) *Transport {
+		dt := NewTransport(NewStreamOpenerDialerHandler(dnstest.NewHandler(config)), netip.AddrPort{})
+		dt.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+		dt.ObserveTiming = func(timing ExchangeTiming) {
+			*timings = append(*timings, timing)
+		}
+		return dt
+	}
+
+	// loggedID returns the correlation ID of the single logged line.
+	loggedID := func(t *testing.T, buf *bytes.Buffer) string {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		return entry["correlationID"].(string)
+	}
+
+	t.Run("uses the correlation ID from the context", func(t *testing.T) {
+		buf, timings := &bytes.Buffer{}, []ExchangeTiming{}
+		dt := newTransport(buf, &timings)
+		ctx := WithCorrelationID(context.Background(), "my-id")
+		_, err := dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "my-id", loggedID(t, buf))
+		require.Len(t, timings, 1)
+		require.Equal(t, "my-id", timings[0].CorrelationID)
+	})
+
+	t.Run("generates the same correlation ID for all the sinks", func(t *testing.T) {
+		buf, timings := &bytes.Buffer{}, []ExchangeTiming{}
+		dt := newTransport(buf, &timings)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, timings, 1)
+		require.NotEmpty(t, timings[0].CorrelationID)
+		require.Equal(t, timings[0].CorrelationID, loggedID(t, buf))
+	})
+}
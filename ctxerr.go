@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// wrapContextError wraps an I/O error caused by the context being done, so
+// that errors.Is(err, context.Canceled) and errors.Is(err,
+// context.DeadlineExceeded) work regardless of which I/O operation failed
+// first. The original I/O error remains accessible via errors.Is and errors.As.
+//
+// Since we configure the stream deadline using the context deadline, the
+// stream deadline may expire slightly before the context is done, so we also
+// map [os.ErrDeadlineExceeded] to [context.DeadlineExceeded] when the context
+// deadline has already passed.
+func wrapContextError(ctx context.Context, err error) error {
+	ctxErr := ctx.Err()
+	if ctxErr == nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			ctxErr = context.DeadlineExceeded
+		}
+	}
+	if ctxErr == nil || errors.Is(err, ctxErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ctxErr, err)
+}
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapContextError(t *testing.T) {
+	t.Run("context not done", func(t *testing.T) {
+		err := wrapContextError(context.Background(), io.EOF)
+		require.Equal(t, io.EOF, err)
+	})
+
+	t.Run("context canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := wrapContextError(ctx, net.ErrClosed)
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, err, net.ErrClosed)
+	})
+
+	t.Run("error already wrapping the context error", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := wrapContextError(ctx, context.Canceled)
+		require.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("stream deadline expired before the context", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		err := wrapContextError(ctx, os.ErrDeadlineExceeded)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("stream deadline unrelated to the context", func(t *testing.T) {
+		err := wrapContextError(context.Background(), os.ErrDeadlineExceeded)
+		require.Equal(t, os.ErrDeadlineExceeded, err)
+	})
+}
+
+func TestExchangeWithStreamOpenerWrapsContextErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.ReadFunc = func(p []byte) (int, error) {
+				cancel() // simulate the context being canceled during the read
+				return 0, net.ErrClosed
+			}
+			return stub, nil
+		},
+	}
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	_, err := dt.ExchangeWithStreamOpener(ctx, conn, dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestExchangeDoesNotWrapServerErrors(t *testing.T) {
+	expected := errors.New("connection reset by peer")
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.ReadFunc = func(p []byte) (int, error) {
+				return 0, expected
+			}
+			return stub, nil
+		},
+	}
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+	require.Equal(t, expected, err)
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrWriteTimeout indicates that sending the query took longer than the
+// [*Transport] WriteTimeout, e.g., because the server is slow to accept data.
+var ErrWriteTimeout = errors.New("dnsoverstream: write timeout")
+
+// ErrReadTimeout indicates that receiving the response took longer than the
+// [*Transport] ReadTimeout, e.g., because the server is slow to answer.
+var ErrReadTimeout = errors.New("dnsoverstream: read timeout")
+
+// streamReadWriteDeadliner is implemented by [Stream] types supporting distinct
+// read and write deadlines (e.g., TCP, TLS, and QUIC streams).
+type streamReadWriteDeadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// streamSetDeadline sets the context deadline, if any, as the [Stream] deadline
+// and returns whether the caller should reset the deadline when done, which is
+// also the case when the [*Transport] has a WriteTimeout or a ReadTimeout.
+func streamSetDeadline(ctx context.Context, dt *Transport, stream Stream) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok && dt.WriteTimeout <= 0 && dt.ReadTimeout <= 0 {
+		return false
+	}
+	_ = stream.SetDeadline(deadline)
+	return true
+}
+
+// streamPhaseDeadline returns the earliest between the context deadline and
+// the given timeout from now, or the zero time when neither is set.
+func streamPhaseDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline, _ := ctx.Deadline()
+	if timeout > 0 {
+		if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline
+}
+
+// streamSetWriteDeadline sets the deadline for sending the query when
+// the [*Transport] has a WriteTimeout.
+//
+// When the [Stream] does not support distinct deadlines, we use SetDeadline
+// and rely on [streamSetReadDeadline] to replace the deadline when reading.
+func streamSetWriteDeadline(ctx context.Context, dt *Transport, stream Stream) {
+	if dt.WriteTimeout <= 0 {
+		return
+	}
+	deadline := streamPhaseDeadline(ctx, dt.WriteTimeout)
+	if sd, ok := stream.(streamReadWriteDeadliner); ok {
+		_ = sd.SetWriteDeadline(deadline)
+		return
+	}
+	_ = stream.SetDeadline(deadline)
+}
+
+// streamSetReadDeadline sets the deadline for receiving the response when
+// the [*Transport] has a WriteTimeout or a ReadTimeout.
+func streamSetReadDeadline(ctx context.Context, dt *Transport, stream Stream) {
+	if dt.WriteTimeout <= 0 && dt.ReadTimeout <= 0 {
+		return
+	}
+	deadline := streamPhaseDeadline(ctx, dt.ReadTimeout)
+	if sd, ok := stream.(streamReadWriteDeadliner); ok {
+		_ = sd.SetReadDeadline(deadline)
+		return
+	}
+	_ = stream.SetDeadline(deadline)
+}
+
+// wrapTimeoutError is like [wrapContextError] but also wraps sentinel (i.e.,
+// [ErrWriteTimeout] or [ErrReadTimeout]) when timeout is set and the error is
+// caused by the stream deadline expiring before the context deadline.
+func wrapTimeoutError(ctx context.Context, timeout time.Duration, sentinel, err error) error {
+	err = wrapContextError(ctx, err)
+	if timeout <= 0 || !errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ streamReadWriteDeadliner = &tcpStream{}
+	_ streamReadWriteDeadliner = &tlsStream{}
+	_ streamReadWriteDeadliner = &quicStream{}
+)
+
+// deadlineTestEndpoint is the endpoint used by the deadline tests.
+var deadlineTestEndpoint = netip.MustParseAddrPort("127.0.0.1:53")
+
+// deadlineTestReadQuery reads a framed query from conn.
+func deadlineTestReadQuery(conn net.Conn) (*dns.Msg, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	rawQuery := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, rawQuery); err != nil {
+		return nil, err
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// deadlineTestWriteResponse writes a framed response to query to conn.
+func deadlineTestWriteResponse(conn net.Conn, query *dns.Msg) error {
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(8, 8, 8, 8),
+	})
+	rawResp, err := resp.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(appendStreamMsgFrame(nil, rawResp))
+	return err
+}
+
+func TestTransportWriteAndReadTimeout(t *testing.T) {
+	t.Run("fails with ErrWriteTimeout when the server does not accept the query", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close() // we never read from the server side
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), deadlineTestEndpoint)
+		dt.WriteTimeout = 50 * time.Millisecond
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.ExchangeWithStreamOpener(ctx, NewTCPStreamOpener(client), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrWriteTimeout)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		require.NotErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("fails with ErrReadTimeout when the server does not answer", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go deadlineTestReadQuery(server)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), deadlineTestEndpoint)
+		dt.WriteTimeout = time.Second
+		dt.ReadTimeout = 50 * time.Millisecond
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.ExchangeWithStreamOpener(ctx, NewTCPStreamOpener(client), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrReadTimeout)
+		require.NotErrorIs(t, err, ErrWriteTimeout)
+		require.NotErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("WriteTimeout does not bound reading the response", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			query, err := deadlineTestReadQuery(server)
+			if err != nil {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+			deadlineTestWriteResponse(server, query)
+		}()
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), deadlineTestEndpoint)
+		dt.WriteTimeout = 50 * time.Millisecond
+
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), NewTCPStreamOpener(client), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+	})
+
+	t.Run("the context deadline wins when it expires first", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go deadlineTestReadQuery(server)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), deadlineTestEndpoint)
+		dt.ReadTimeout = time.Minute
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := dt.ExchangeWithStreamOpener(ctx, NewTCPStreamOpener(client), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.NotErrorIs(t, err, ErrReadTimeout)
+	})
+
+	t.Run("uses SetDeadline for each phase when the stream lacks distinct deadlines", func(t *testing.T) {
+		var deadlines []time.Time
+		conn := NewHandlerStreamOpener(HandlerFunc(dohTestAnswer))
+		opener := &FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				stream, err := conn.OpenStream()
+				if err != nil {
+					return nil, err
+				}
+				return &FuncStream{
+					SetDeadlineFunc: func(t time.Time) error {
+						deadlines = append(deadlines, t)
+						return nil
+					},
+					ReadFunc:  stream.Read,
+					WriteFunc: stream.Write,
+					CloseFunc: stream.Close,
+				}, nil
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerHandler(HandlerFunc(dohTestAnswer)), deadlineTestEndpoint)
+		dt.WriteTimeout = time.Minute
+		dt.ReadTimeout = time.Hour
+
+		t0 := time.Now()
+		_, err := dt.ExchangeWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, deadlines, 4)
+		require.True(t, deadlines[0].IsZero())
+		require.WithinDuration(t, t0.Add(time.Minute), deadlines[1], 5*time.Second)
+		require.WithinDuration(t, t0.Add(time.Hour), deadlines[2], 5*time.Second)
+		require.True(t, deadlines[3].IsZero())
+	})
+}
+
+func TestStreamPhaseDeadline(t *testing.T) {
+	t.Run("without deadline and timeout", func(t *testing.T) {
+		require.True(t, streamPhaseDeadline(context.Background(), 0).IsZero())
+	})
+
+	t.Run("with timeout", func(t *testing.T) {
+		deadline := streamPhaseDeadline(context.Background(), time.Minute)
+		require.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+	})
+
+	t.Run("with an earlier context deadline", func(t *testing.T) {
+		expected := time.Now().Add(time.Second)
+		ctx, cancel := context.WithDeadline(context.Background(), expected)
+		defer cancel()
+		require.Equal(t, expected, streamPhaseDeadline(ctx, time.Minute))
+	})
+
+	t.Run("with a later context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+		deadline := streamPhaseDeadline(ctx, time.Minute)
+		require.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+	})
+}
+
+func TestWrapTimeoutError(t *testing.T) {
+	t.Run("wraps the deadline error when the timeout is set", func(t *testing.T) {
+		err := wrapTimeoutError(context.Background(), time.Second, ErrReadTimeout, os.ErrDeadlineExceeded)
+		require.ErrorIs(t, err, ErrReadTimeout)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("does not wrap when the timeout is not set", func(t *testing.T) {
+		err := wrapTimeoutError(context.Background(), 0, ErrReadTimeout, os.ErrDeadlineExceeded)
+		require.NotErrorIs(t, err, ErrReadTimeout)
+	})
+
+	t.Run("does not wrap other errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		err := wrapTimeoutError(context.Background(), time.Second, ErrWriteTimeout, expected)
+		require.Equal(t, expected, err)
+	})
+
+	t.Run("does not wrap when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := wrapTimeoutError(ctx, time.Second, ErrWriteTimeout, os.ErrDeadlineExceeded)
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotErrorIs(t, err, ErrWriteTimeout)
+	})
+}
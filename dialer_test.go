@@ -8,8 +8,12 @@ import (
 	"net"
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -53,3 +57,103 @@ func TestTransportExchangeDialContextCanceled(t *testing.T) {
 	_, err := dt.Exchange(ctx, dnscodec.NewQuery("example.com", 1))
 	require.ErrorIs(t, err, context.Canceled)
 }
+
+func TestStreamOpenerDialerQUICDialContextDeadline(t *testing.T) {
+	// A UDP socket that never answers causes the handshake to stall
+	// until the context deadline expires.
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer blackhole.Close()
+
+	lc := &net.ListenConfig{}
+	pconn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pconn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	dialer := NewStreamOpenerDialerQUIC(NewQUICDialer(pconn, "example.com"))
+	endpoint := blackhole.LocalAddr().(*net.UDPAddr).AddrPort()
+	_, err = dialer.DialContext(ctx, endpoint)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// findLinkLocalAddr returns a link-local IPv6 address with zone of a local interface.
+func findLinkLocalAddr(t *testing.T) netip.Addr {
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if ok && ip.Is6() && ip.IsLinkLocalUnicast() {
+				return ip.WithZone(iface.Name)
+			}
+		}
+	}
+	t.Skip("no link-local IPv6 address available")
+	return netip.Addr{}
+}
+
+func TestTransportExchangeLinkLocalZone(t *testing.T) {
+	addr := findLinkLocalAddr(t)
+	handler := newBenchHandler()
+	cert := testPKI().MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "link-local",
+		IPAddrs:      []net.IP{addr.AsSlice()},
+		Organization: []string{"Example"},
+	})
+
+	// newServerEndpoint starts a server and returns its endpoint including the zone.
+	newServerEndpoint := func(t *testing.T, address string) netip.AddrPort {
+		endpoint := netip.MustParseAddrPort(address)
+		return netip.AddrPortFrom(endpoint.Addr().WithZone(addr.Zone()), endpoint.Port())
+	}
+	listenAddr := netip.AddrPortFrom(addr, 0).String()
+
+	t.Run("tcp", func(t *testing.T) {
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, listenAddr, handler)
+		t.Cleanup(srv.Close)
+		endpoint := newServerEndpoint(t, srv.Address())
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, listenAddr, cert, handler)
+		t.Cleanup(srv.Close)
+		endpoint := newServerEndpoint(t, srv.Address())
+		// leave the ServerName empty, so the dialer derives it from the zoned address
+		dialer := &tls.Dialer{NetDialer: &net.Dialer{}, Config: &tls.Config{RootCAs: testPKI().CertPool()}}
+		dt := NewTransport(NewStreamOpenerDialerTLS(dialer), endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	})
+
+	t.Run("quic", func(t *testing.T) {
+		srv := newDoQTestServerAt(t, listenAddr, cert, func(query *dns.Msg) []*dns.Msg {
+			return []*dns.Msg{handler.PrepareResponse(query)}
+		})
+		endpoint := newServerEndpoint(t, srv.Endpoint().String())
+		pconn, err := net.ListenPacket("udp", "[::]:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { pconn.Close() })
+		qd := NewQUICDialer(pconn, "")
+		qd.TLSConfig.RootCAs = testPKI().CertPool()
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qd), endpoint)
+		_, err = dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	})
+}
@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// WellKnownNAT64Prefix is the well-known NAT64 prefix (RFC 6052 Section 2.1).
+var WellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// ErrDNS64InvalidPrefix indicates that a NAT64 prefix is not an IPv6 prefix
+// with one of the lengths allowed by RFC 6052 Section 2.2.
+var ErrDNS64InvalidPrefix = errors.New("dnsoverstream: invalid NAT64 prefix")
+
+// ErrDNS64NoPrefix indicates that [*Transport.DiscoverNAT64Prefixes] did not
+// find any NAT64 prefix, i.e., that the network is not using DNS64.
+var ErrDNS64NoPrefix = errors.New("dnsoverstream: no NAT64 prefix found")
+
+// dns64DiscoveryName is the name queried to discover NAT64 prefixes (RFC 7050).
+const dns64DiscoveryName = "ipv4only.arpa."
+
+// dns64WellKnownAddrs are the addresses of ipv4only.arpa (RFC 7050 Section 2.2).
+var dns64WellKnownAddrs = []netip.Addr{
+	netip.MustParseAddr("192.0.0.170"),
+	netip.MustParseAddr("192.0.0.171"),
+}
+
+// dns64PrefixLengths are the prefix lengths allowed by RFC 6052 Section 2.2,
+// sorted from the most common to the least common.
+var dns64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+// DNS64Synthesize embeds the given IPv4 address into the given NAT64 prefix
+// according to RFC 6052 Section 2.2, skipping the reserved bits 64 to 71.
+func DNS64Synthesize(prefix netip.Prefix, v4 netip.Addr) (netip.Addr, error) {
+	// 1. make sure the arguments are valid
+	if !dns64ValidPrefix(prefix) || !v4.Is4() {
+		return netip.Addr{}, ErrDNS64InvalidPrefix
+	}
+
+	// 2. copy the IPv4 address after the prefix
+	out := prefix.Masked().Addr().As16()
+	idx := prefix.Bits() / 8
+	for _, b := range v4.As4() {
+		if idx == 8 {
+			idx++
+		}
+		out[idx] = b
+		idx++
+	}
+	return netip.AddrFrom16(out), nil
+}
+
+// dns64Extract is the inverse of [DNS64Synthesize] and returns the IPv4
+// address embedded into v6 assuming a prefix with the given length.
+func dns64Extract(bits int, v6 netip.Addr) (netip.Addr, bool) {
+	in := v6.As16()
+	if bits != 96 && in[8] != 0 {
+		return netip.Addr{}, false
+	}
+	var out [4]byte
+	idx := bits / 8
+	for i := range out {
+		if idx == 8 {
+			idx++
+		}
+		out[i] = in[idx]
+		idx++
+	}
+	return netip.AddrFrom4(out), true
+}
+
+// dns64ValidPrefix returns whether prefix is a valid NAT64 prefix.
+func dns64ValidPrefix(prefix netip.Prefix) bool {
+	if !prefix.IsValid() || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return false
+	}
+	return slices.Contains(dns64PrefixLengths, prefix.Bits())
+}
+
+// DiscoverNAT64Prefixes discovers the NAT64 prefixes used by the DNS64
+// server at the endpoint of the [*Transport] by resolving the AAAA records
+// of ipv4only.arpa (RFC 7050 Section 3), e.g., to configure the
+// [*IterativeResolver] DNS64Prefix field on an IPv6-only network.
+//
+// This method returns [ErrDNS64NoPrefix] when the response does not
+// contain any synthesized AAAA record.
+func (dt *Transport) DiscoverNAT64Prefixes(ctx context.Context) ([]netip.Prefix, error) {
+	// 1. resolve the AAAA records of the well-known name
+	resp, err := dt.exchangeMsg(ctx, dnscodec.NewQuery(dns64DiscoveryName, dns.TypeAAAA))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. find the prefixes embedding the well-known IPv4 addresses
+	var prefixes []netip.Prefix
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok || dns.CanonicalName(aaaa.Hdr.Name) != dns64DiscoveryName {
+			continue
+		}
+		v6, ok := netip.AddrFromSlice(aaaa.AAAA.To16())
+		if !ok {
+			continue
+		}
+		if prefix, ok := dns64PrefixFromWellKnownAddr(v6); ok && !slices.Contains(prefixes, prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) <= 0 {
+		return nil, ErrDNS64NoPrefix
+	}
+	return prefixes, nil
+}
+
+// dns64PrefixFromWellKnownAddr returns the prefix of a synthesized
+// address embedding one of the ipv4only.arpa IPv4 addresses.
+func dns64PrefixFromWellKnownAddr(v6 netip.Addr) (netip.Prefix, bool) {
+	for _, bits := range dns64PrefixLengths {
+		v4, ok := dns64Extract(bits, v6)
+		if !ok {
+			continue
+		}
+		for _, wk := range dns64WellKnownAddrs {
+			if v4 == wk {
+				return netip.PrefixFrom(v6, bits).Masked(), true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// dns64SynthesizeResponse builds the AAAA response synthesized from the
+// response to the A query and the original NODATA response to the AAAA
+// query according to RFC 6147 Section 5.1.
+func dns64SynthesizeResponse(prefix netip.Prefix, aaaaResp, aResp *dns.Msg) (*dns.Msg, error) {
+	// 1. the TTL must not exceed the negative caching TTL of the AAAA
+	// response, if any (RFC 6147 Section 5.1.7)
+	maxTTL := ^uint32(0)
+	for _, rr := range aaaaResp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	// 2. replace A records with AAAA records and keep the CNAMEs
+	synth := aResp.Copy()
+	synth.Id = aaaaResp.Id
+	synth.Question = aaaaResp.Copy().Question
+	synth.AuthenticatedData = false
+	synth.Answer = nil
+	for _, rr := range aResp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			synth.Answer = append(synth.Answer, dns.Copy(rr))
+			continue
+		}
+		v4, _ := netip.AddrFromSlice(a.A.To4())
+		v6, err := DNS64Synthesize(prefix, v4)
+		if err != nil {
+			return nil, err
+		}
+		synth.Answer = append(synth.Answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   a.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  a.Hdr.Class,
+				Ttl:    min(a.Hdr.Ttl, maxTTL),
+			},
+			AAAA: v6.AsSlice(),
+		})
+	}
+	return synth, nil
+}
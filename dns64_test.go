@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS64Synthesize(t *testing.T) {
+	// test vectors from RFC 6052 Section 2.4
+	cases := []struct {
+		prefix   string
+		expected string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for _, tc := range cases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			prefix := netip.MustParsePrefix(tc.prefix)
+			v6, err := DNS64Synthesize(prefix, v4)
+			require.NoError(t, err)
+			require.Equal(t, netip.MustParseAddr(tc.expected), v6)
+
+			extracted, ok := dns64Extract(prefix.Bits(), v6)
+			require.True(t, ok)
+			require.Equal(t, v4, extracted)
+		})
+	}
+
+	t.Run("rejects invalid arguments", func(t *testing.T) {
+		_, err := DNS64Synthesize(netip.MustParsePrefix("2001:db8::/33"), v4)
+		require.ErrorIs(t, err, ErrDNS64InvalidPrefix)
+		_, err = DNS64Synthesize(netip.MustParsePrefix("10.0.0.0/8"), v4)
+		require.ErrorIs(t, err, ErrDNS64InvalidPrefix)
+		_, err = DNS64Synthesize(netip.Prefix{}, v4)
+		require.ErrorIs(t, err, ErrDNS64InvalidPrefix)
+		_, err = DNS64Synthesize(WellKnownNAT64Prefix, netip.MustParseAddr("2001:db8::1"))
+		require.ErrorIs(t, err, ErrDNS64InvalidPrefix)
+	})
+}
+
+// newDNS64TestTransport returns a [*Transport] whose server answers
+// the AAAA query for ipv4only.arpa with the given addresses.
+func newDNS64TestTransport(addrs ...string) *Transport {
+	handler := HandlerFunc(func(query *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		for _, addr := range addrs {
+			resp.Answer = append(resp.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{
+					Name:   query.Question[0].Name,
+					Rrtype: dns.TypeAAAA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				AAAA: netip.MustParseAddr(addr).AsSlice(),
+			})
+		}
+		return resp
+	})
+	return NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("[2001:db8::53]:53"))
+}
+
+func TestTransportDiscoverNAT64Prefixes(t *testing.T) {
+	t.Run("finds the well-known prefix", func(t *testing.T) {
+		dt := newDNS64TestTransport("64:ff9b::c000:aa", "64:ff9b::c000:ab")
+		prefixes, err := dt.DiscoverNAT64Prefixes(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []netip.Prefix{WellKnownNAT64Prefix}, prefixes)
+	})
+
+	t.Run("finds network-specific prefixes", func(t *testing.T) {
+		dt := newDNS64TestTransport("2001:db8:122:3c0:0:aa::", "2001:db8:1c0:0:aa::")
+		prefixes, err := dt.DiscoverNAT64Prefixes(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, []netip.Prefix{
+			netip.MustParsePrefix("2001:db8:122:300::/56"),
+			netip.MustParsePrefix("2001:db8:100::/40"),
+		}, prefixes)
+	})
+
+	t.Run("returns ErrDNS64NoPrefix without synthesized records", func(t *testing.T) {
+		dt := newDNS64TestTransport("2001:db8::1")
+		_, err := dt.DiscoverNAT64Prefixes(context.Background())
+		require.ErrorIs(t, err, ErrDNS64NoPrefix)
+	})
+
+	t.Run("returns exchange errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return nil, expected
+			},
+		}
+		dt := NewTransport(dialer, netip.MustParseAddrPort("[2001:db8::53]:53"))
+		_, err := dt.DiscoverNAT64Prefixes(context.Background())
+		require.ErrorIs(t, err, expected)
+	})
+}
+
+func TestDNS64SynthesizeResponse(t *testing.T) {
+	aaaaQuery := new(dns.Msg)
+	aaaaQuery.SetQuestion("www.example.com.", dns.TypeAAAA)
+	aaaaResp := new(dns.Msg)
+	aaaaResp.SetReply(aaaaQuery)
+	aaaaResp.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Minttl: 30,
+	}}
+
+	aQuery := new(dns.Msg)
+	aQuery.SetQuestion("www.example.com.", dns.TypeA)
+	aResp := new(dns.Msg)
+	aResp.SetReply(aQuery)
+	aResp.AuthenticatedData = true
+	aResp.Answer = []dns.RR{
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: "web.example.com.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "web.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   netip.MustParseAddr("192.0.2.33").AsSlice(),
+		},
+	}
+
+	synth, err := dns64SynthesizeResponse(WellKnownNAT64Prefix, aaaaResp, aResp)
+	require.NoError(t, err)
+	require.Equal(t, aaaaResp.Id, synth.Id)
+	require.Equal(t, aaaaResp.Question, synth.Question)
+	require.False(t, synth.AuthenticatedData)
+	require.Len(t, synth.Answer, 2)
+	require.IsType(t, &dns.CNAME{}, synth.Answer[0])
+	aaaa := synth.Answer[1].(*dns.AAAA)
+	require.Equal(t, "web.example.com.", aaaa.Hdr.Name)
+	require.Equal(t, uint32(30), aaaa.Hdr.Ttl)
+	require.Equal(t, netip.MustParseAddr("64:ff9b::c000:221").AsSlice(), []byte(aaaa.AAAA))
+
+	// make sure the original A response is unchanged
+	require.IsType(t, &dns.A{}, aResp.Answer[1])
+	require.True(t, aResp.AuthenticatedData)
+
+	// make sure the synthesized response is valid for the query
+	_, err = dnscodec.ValidateResponseForQuery(aaaaQuery, synth)
+	require.NoError(t, err)
+	require.Equal(t, ResponseClassAnswer, ClassifyResponse(synth))
+}
@@ -0,0 +1,306 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ProtocolDNSCrypt is the protocol name used by [PoolKey] for DNSCrypt.
+const ProtocolDNSCrypt = "dnscrypt"
+
+// ErrDNSCryptNoCertificate indicates that the resolver did not provide any
+// valid DNSCrypt certificate signed by the provider key.
+var ErrDNSCryptNoCertificate = errors.New("dnsoverstream: no valid DNSCrypt certificate")
+
+// DNSCrypt protocol constants (see https://dnscrypt.info/protocol).
+const (
+	dnscryptCertMagic          = "DNSC"
+	dnscryptCertSize           = 124
+	dnscryptESXSalsa20         = 0x0001
+	dnscryptResolverMagic      = "r6fnvWj8"
+	dnscryptHalfNonceSize      = 12
+	dnscryptPaddingBlockSize   = 64
+	dnscryptMinQuerySize       = 256
+	dnscryptQueryHeaderSize    = 8 + 32 + dnscryptHalfNonceSize
+	dnscryptResponseHeaderSize = 8 + 24
+)
+
+// DNSCryptCertificate is a verified DNSCrypt v2 resolver certificate.
+type DNSCryptCertificate struct {
+	// ESVersion is the encryption system version (1 for X25519-XSalsa20Poly1305).
+	ESVersion uint16
+
+	// ResolverKey is the resolver short-term X25519 public key.
+	ResolverKey [32]byte
+
+	// ClientMagic is the prefix of the queries using this certificate.
+	ClientMagic [8]byte
+
+	// Serial is the certificate serial number.
+	Serial uint32
+
+	// ValidFrom is the beginning of the validity period.
+	ValidFrom time.Time
+
+	// ValidUntil is the end of the validity period.
+	ValidUntil time.Time
+}
+
+// StreamOpenerDialerDNSCrypt implements [StreamOpenerDialer] for DNSCrypt v2
+// over UDP, so that measurements can include DNSCrypt resolvers using the same
+// [*Transport] and raw observation hooks used for the other protocols.
+//
+// Dialing fetches the certificates of the provider from the resolver, verifies
+// them using the provider key, and uses the valid certificate with the highest
+// serial. We only support the X25519-XSalsa20Poly1305 encryption system, and
+// we use an ephemeral key pair for each connection. Like for
+// [*StreamOpenerDialerUDP], we do not retry over TCP when the response is
+// truncated, which for DNSCrypt also happens when the response is larger
+// than the padded query.
+//
+// Construct using [NewStreamOpenerDialerDNSCrypt].
+type StreamOpenerDialerDNSCrypt struct {
+	// Dialer is the underlying [NetDialer].
+	Dialer NetDialer
+
+	// ProviderName is the MANDATORY provider name (e.g., "2.dnscrypt-cert.example.com").
+	ProviderName string
+
+	// ProviderKey is the MANDATORY provider Ed25519 public key.
+	ProviderKey ed25519.PublicKey
+
+	// ObserveCertificate is an optional hook called with the
+	// [DNSCryptCertificate] we use for each connection.
+	ObserveCertificate func(DNSCryptCertificate)
+}
+
+// NewStreamOpenerDialerDNSCrypt creates a new [*StreamOpenerDialerDNSCrypt].
+func NewStreamOpenerDialerDNSCrypt(dialer NetDialer,
+	providerName string, providerKey ed25519.PublicKey) *StreamOpenerDialerDNSCrypt {
+	return &StreamOpenerDialerDNSCrypt{
+		Dialer:       dialer,
+		ProviderName: providerName,
+		ProviderKey:  providerKey,
+	}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerDNSCrypt{}
+
+// DialContext implements [StreamOpenerDialer].
+//
+// The context bounds both creating the UDP socket and fetching the certificate.
+func (d *StreamOpenerDialerDNSCrypt) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	// 1. create the connected UDP socket
+	conn, err := d.Dialer.DialContext(ctx, "udp", address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. fetch and verify the certificate, closing the socket
+	// to interrupt reading if the context is done meanwhile
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	cert, err := dnscryptFetchCertificate(ctx, conn, d.ProviderName, d.ProviderKey)
+	if !stop() {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, wrapContextError(ctx, err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if d.ObserveCertificate != nil {
+		d.ObserveCertificate(cert)
+	}
+
+	// 3. derive the key shared with the resolver
+	envelope, err := newDNSCryptEnvelope(cert)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &udpStreamConn{conn: conn, params: QueryParamsDNSCrypt(), envelope: envelope}, nil
+}
+
+// dnscryptFetchCertificate queries the certificates using plaintext DNS over
+// conn and returns the valid certificate with the highest serial.
+func dnscryptFetchCertificate(ctx context.Context, conn net.Conn,
+	providerName string, providerKey ed25519.PublicKey) (DNSCryptCertificate, error) {
+	// 1. send the TXT query and receive the response
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(providerName), dns.TypeTXT)
+	query.SetEdns0(QueryMaxSizeUDP, false)
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return DNSCryptCertificate{}, err
+	}
+	deadline, _ := ctx.Deadline()
+	rawResp, err := (&udpStreamConn{conn: conn}).roundTrip(rawQuery, deadline)
+	if err != nil {
+		return DNSCryptCertificate{}, wrapContextError(ctx, err)
+	}
+
+	// 2. parse the TXT records, which contain binary data
+	var parser dnsmessage.Parser
+	header, err := parser.Start(rawResp)
+	if err != nil || !header.Response || header.RCode != dnsmessage.RCodeSuccess {
+		return DNSCryptCertificate{}, dnscodec.ErrServerMisbehaving
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return DNSCryptCertificate{}, dnscodec.ErrServerMisbehaving
+	}
+	var (
+		best  DNSCryptCertificate
+		found bool
+		now   = time.Now()
+	)
+	for {
+		rrHeader, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return DNSCryptCertificate{}, dnscodec.ErrServerMisbehaving
+		}
+		if rrHeader.Type != dnsmessage.TypeTXT {
+			if err := parser.SkipAnswer(); err != nil {
+				return DNSCryptCertificate{}, dnscodec.ErrServerMisbehaving
+			}
+			continue
+		}
+		txt, err := parser.TXTResource()
+		if err != nil {
+			return DNSCryptCertificate{}, dnscodec.ErrServerMisbehaving
+		}
+
+		// 3. select the valid certificate with the highest serial
+		cert, ok := parseDNSCryptCertificate([]byte(strings.Join(txt.TXT, "")), providerKey)
+		if !ok || cert.ESVersion != dnscryptESXSalsa20 || now.Before(cert.ValidFrom) || now.After(cert.ValidUntil) {
+			continue
+		}
+		if !found || cert.Serial > best.Serial {
+			best, found = cert, true
+		}
+	}
+	if !found {
+		return DNSCryptCertificate{}, fmt.Errorf("%w: %s", ErrDNSCryptNoCertificate, providerName)
+	}
+	return best, nil
+}
+
+// parseDNSCryptCertificate parses a certificate and verifies its signature.
+func parseDNSCryptCertificate(data []byte, providerKey ed25519.PublicKey) (DNSCryptCertificate, bool) {
+	// 1. check the magic and the signature over the rest of the certificate
+	if len(data) < dnscryptCertSize || string(data[:4]) != dnscryptCertMagic {
+		return DNSCryptCertificate{}, false
+	}
+	if len(providerKey) != ed25519.PublicKeySize || !ed25519.Verify(providerKey, data[72:], data[8:72]) {
+		return DNSCryptCertificate{}, false
+	}
+
+	// 2. extract the fields ignoring the extensions
+	cert := DNSCryptCertificate{
+		ESVersion:  binary.BigEndian.Uint16(data[4:6]),
+		Serial:     binary.BigEndian.Uint32(data[112:116]),
+		ValidFrom:  time.Unix(int64(binary.BigEndian.Uint32(data[116:120])), 0),
+		ValidUntil: time.Unix(int64(binary.BigEndian.Uint32(data[120:124])), 0),
+	}
+	copy(cert.ResolverKey[:], data[72:104])
+	copy(cert.ClientMagic[:], data[104:112])
+	return cert, true
+}
+
+// dnscryptEnvelope implements [udpEnvelope] for DNSCrypt.
+type dnscryptEnvelope struct {
+	cert      DNSCryptCertificate
+	publicKey [32]byte
+	sharedKey [32]byte
+}
+
+// newDNSCryptEnvelope generates an ephemeral key pair and derives the key
+// shared with the resolver using the given certificate.
+func newDNSCryptEnvelope(cert DNSCryptCertificate) (*dnscryptEnvelope, error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	env := &dnscryptEnvelope{cert: cert, publicKey: *publicKey}
+	box.Precompute(&env.sharedKey, &cert.ResolverKey, privateKey)
+	return env, nil
+}
+
+// seal implements [udpEnvelope].
+func (e *dnscryptEnvelope) seal(rawQuery []byte) ([]byte, func(datagram []byte) ([]byte, error), error) {
+	// 1. generate the client half of the nonce
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:dnscryptHalfNonceSize]); err != nil {
+		return nil, nil, err
+	}
+
+	// 2. pad and encrypt the query
+	padded := dnscryptPad(rawQuery, dnscryptMinQuerySize)
+	datagram := make([]byte, 0, dnscryptQueryHeaderSize+len(padded)+box.Overhead)
+	datagram = append(datagram, e.cert.ClientMagic[:]...)
+	datagram = append(datagram, e.publicKey[:]...)
+	datagram = append(datagram, nonce[:dnscryptHalfNonceSize]...)
+	datagram = box.SealAfterPrecomputation(datagram, padded, &nonce, &e.sharedKey)
+
+	// 3. only accept authentic responses using our half of the nonce
+	open := func(datagram []byte) ([]byte, error) {
+		if len(datagram) < dnscryptResponseHeaderSize+box.Overhead ||
+			string(datagram[:8]) != dnscryptResolverMagic ||
+			!bytes.Equal(datagram[8:8+dnscryptHalfNonceSize], nonce[:dnscryptHalfNonceSize]) {
+			return nil, errUDPDatagramMismatch
+		}
+		var respNonce [24]byte
+		copy(respNonce[:], datagram[8:dnscryptResponseHeaderSize])
+		plaintext, ok := box.OpenAfterPrecomputation(nil, datagram[dnscryptResponseHeaderSize:], &respNonce, &e.sharedKey)
+		if !ok {
+			return nil, errUDPDatagramMismatch
+		}
+		return dnscryptUnpad(plaintext)
+	}
+	return datagram, open, nil
+}
+
+// dnscryptPad pads msg using 0x80 followed by zeros to a multiple of the
+// padding block size that is not smaller than minSize.
+func dnscryptPad(msg []byte, minSize int) []byte {
+	size := max(minSize, len(msg)+1)
+	if rem := size % dnscryptPaddingBlockSize; rem != 0 {
+		size += dnscryptPaddingBlockSize - rem
+	}
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+// dnscryptUnpad removes the padding added by [dnscryptPad].
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	idx := len(padded) - 1
+	for idx >= 0 && padded[idx] == 0 {
+		idx--
+	}
+	if idx < 0 || padded[idx] != 0x80 {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	return padded[:idx], nil
+}
@@ -0,0 +1,298 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// dnscryptTestProvider is the provider name used by the DNSCrypt tests.
+const dnscryptTestProvider = "2.dnscrypt-cert.example.com."
+
+// dnscryptTestCert describes a certificate served by [dnscryptTestServer].
+type dnscryptTestCert struct {
+	esVersion  uint16
+	serial     uint32
+	validFrom  time.Time
+	validUntil time.Time
+}
+
+// dnscryptTestServer is a minimal DNSCrypt server for testing.
+type dnscryptTestServer struct {
+	endpoint    netip.AddrPort
+	providerKey ed25519.PublicKey
+	queries     chan []byte
+}
+
+// newDNSCryptTestServer starts a DNSCrypt server answering using handler and
+// serving certs signed by its provider key and using the same resolver key.
+func newDNSCryptTestServer(t *testing.T, handler func(query *dns.Msg) *dns.Msg, certs ...dnscryptTestCert) *dnscryptTestServer {
+	// 1. generate the keys and the certificates
+	providerKey, providerSecret, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	resolverPK, resolverSK, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	clientMagic := []byte("abcdefgh")
+	var txt []string
+	for _, cert := range certs {
+		data := []byte(dnscryptCertMagic)
+		data = binary.BigEndian.AppendUint16(data, cert.esVersion)
+		data = append(data, 0, 0)
+		signed := append([]byte{}, resolverPK[:]...)
+		signed = append(signed, clientMagic...)
+		signed = binary.BigEndian.AppendUint32(signed, cert.serial)
+		signed = binary.BigEndian.AppendUint32(signed, uint32(cert.validFrom.Unix()))
+		signed = binary.BigEndian.AppendUint32(signed, uint32(cert.validUntil.Unix()))
+		data = append(data, ed25519.Sign(providerSecret, signed)...)
+		data = append(data, signed...)
+		txt = append(txt, string(data[:100]), string(data[100:])) // split across strings
+	}
+
+	// 2. serve the certificates and the encrypted queries
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pconn.Close() })
+	srv := &dnscryptTestServer{
+		endpoint:    netip.MustParseAddrPort(pconn.LocalAddr().String()),
+		providerKey: providerKey,
+		queries:     make(chan []byte, 16),
+	}
+	go func() {
+		buff := make([]byte, 1<<16)
+		for {
+			count, addr, err := pconn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			datagram := buff[:count]
+			if !bytes.HasPrefix(datagram, clientMagic) {
+				srv.answerCertificates(pconn, addr, datagram, txt)
+				continue
+			}
+			srv.answerEncrypted(pconn, addr, datagram, resolverSK, handler)
+		}
+	}()
+	return srv
+}
+
+// answerCertificates answers the plaintext query for the certificates.
+func (srv *dnscryptTestServer) answerCertificates(pconn net.PacketConn, addr net.Addr, datagram []byte, txt []string) {
+	query := new(dns.Msg)
+	if err := query.Unpack(datagram); err != nil || len(query.Question) != 1 {
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	if query.Question[0].Name == dnscryptTestProvider && query.Question[0].Qtype == dns.TypeTXT {
+		for idx := 0; idx+1 < len(txt); idx += 2 {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: dnscryptTestProvider, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{dnscryptTestEscape(txt[idx]), dnscryptTestEscape(txt[idx+1])},
+			})
+		}
+	}
+	rawResp, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	pconn.WriteTo(rawResp, addr)
+}
+
+// dnscryptTestEscape escapes binary data using the miekg/dns TXT presentation format.
+func dnscryptTestEscape(data string) string {
+	var sb strings.Builder
+	for idx := 0; idx < len(data); idx++ {
+		ch := data[idx]
+		if ch < ' ' || ch > '~' || ch == '"' || ch == '\\' {
+			sb.WriteString("\\")
+			sb.WriteByte('0' + ch/100)
+			sb.WriteByte('0' + ch/10%10)
+			sb.WriteByte('0' + ch%10)
+			continue
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String()
+}
+
+// answerEncrypted decrypts the query and sends the encrypted response.
+func (srv *dnscryptTestServer) answerEncrypted(pconn net.PacketConn, addr net.Addr,
+	datagram []byte, resolverSK *[32]byte, handler func(query *dns.Msg) *dns.Msg) {
+	// 1. decrypt the query
+	if len(datagram) < dnscryptQueryHeaderSize+box.Overhead {
+		return
+	}
+	var clientPK [32]byte
+	copy(clientPK[:], datagram[8:40])
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, &clientPK, resolverSK)
+	var nonce [24]byte
+	copy(nonce[:], datagram[40:dnscryptQueryHeaderSize])
+	padded, ok := box.OpenAfterPrecomputation(nil, datagram[dnscryptQueryHeaderSize:], &nonce, &sharedKey)
+	if !ok {
+		return
+	}
+	srv.queries <- padded
+	rawQuery, err := dnscryptUnpad(padded)
+	if err != nil {
+		return
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(rawQuery); err != nil {
+		return
+	}
+
+	// 2. encrypt the response using the server half of the nonce
+	rawResp, err := handler(query).Pack()
+	if err != nil {
+		return
+	}
+	rand.Read(nonce[dnscryptHalfNonceSize:])
+	out := append([]byte(dnscryptResolverMagic), nonce[:]...)
+	out = box.SealAfterPrecomputation(out, dnscryptPad(rawResp, 0), &nonce, &sharedKey)
+	pconn.WriteTo(out, addr)
+}
+
+// newDNSCryptTestTransport returns a [*Transport] for the [dnscryptTestServer].
+func newDNSCryptTestTransport(srv *dnscryptTestServer) *Transport {
+	dialer := NewStreamOpenerDialerDNSCrypt(&net.Dialer{}, dnscryptTestProvider, srv.providerKey)
+	return NewTransport(dialer, srv.endpoint)
+}
+
+func TestStreamOpenerDialerDNSCrypt(t *testing.T) {
+	now := time.Now()
+	validCert := dnscryptTestCert{dnscryptESXSalsa20, 10, now.Add(-time.Hour), now.Add(time.Hour)}
+
+	t.Run("exchanges using the certificate with the highest serial", func(t *testing.T) {
+		srv := newDNSCryptTestServer(t, dohTestAnswer,
+			dnscryptTestCert{dnscryptESXSalsa20, 1, now.Add(-time.Hour), now.Add(time.Hour)},
+			validCert,
+		)
+		dt := newDNSCryptTestTransport(srv)
+		var certs []DNSCryptCertificate
+		dt.dialer.(*StreamOpenerDialerDNSCrypt).ObserveCertificate = func(cert DNSCryptCertificate) {
+			certs = append(certs, cert)
+		}
+
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+		require.Len(t, certs, 1)
+		require.Equal(t, uint32(10), certs[0].Serial)
+		require.Equal(t, uint16(dnscryptESXSalsa20), certs[0].ESVersion)
+
+		// the server received a padded query
+		padded := <-srv.queries
+		require.Zero(t, len(padded)%dnscryptPaddingBlockSize)
+		require.GreaterOrEqual(t, len(padded), dnscryptMinQuerySize)
+	})
+
+	t.Run("reuses the connection for multiple exchanges", func(t *testing.T) {
+		srv := newDNSCryptTestServer(t, dohTestAnswer, validCert)
+		dt := newDNSCryptTestTransport(srv)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		for range 3 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("ignores invalid certificates", func(t *testing.T) {
+		cases := []struct {
+			name string
+			cert dnscryptTestCert
+		}{
+			{"expired", dnscryptTestCert{dnscryptESXSalsa20, 1, now.Add(-2 * time.Hour), now.Add(-time.Hour)}},
+			{"not yet valid", dnscryptTestCert{dnscryptESXSalsa20, 1, now.Add(time.Hour), now.Add(2 * time.Hour)}},
+			{"unsupported encryption system", dnscryptTestCert{2, 1, now.Add(-time.Hour), now.Add(time.Hour)}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				srv := newDNSCryptTestServer(t, dohTestAnswer, tc.cert)
+				_, err := newDNSCryptTestTransport(srv).Dial(context.Background())
+				require.ErrorIs(t, err, ErrDNSCryptNoCertificate)
+			})
+		}
+	})
+
+	t.Run("rejects certificates not signed by the provider", func(t *testing.T) {
+		srv := newDNSCryptTestServer(t, dohTestAnswer, validCert)
+		otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		dialer := NewStreamOpenerDialerDNSCrypt(&net.Dialer{}, dnscryptTestProvider, otherKey)
+		_, err = NewTransport(dialer, srv.endpoint).Dial(context.Background())
+		require.ErrorIs(t, err, ErrDNSCryptNoCertificate)
+	})
+
+	t.Run("propagates dial errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerDNSCrypt(dialer, dnscryptTestProvider, nil), netip.MustParseAddrPort("127.0.0.1:443"))
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	})
+
+	t.Run("honours the context while fetching the certificate", func(t *testing.T) {
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer pconn.Close()
+		dialer := NewStreamOpenerDialerDNSCrypt(&net.Dialer{}, dnscryptTestProvider, nil)
+		dt := NewTransport(dialer, netip.MustParseAddrPort(pconn.LocalAddr().String()))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err = dt.Dial(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestDNSCryptPadding(t *testing.T) {
+	for _, size := range []int{0, 1, 63, 64, 255, 256, 300} {
+		msg := bytes.Repeat([]byte{0x80}, size) // worst case for unpadding
+		padded := dnscryptPad(msg, dnscryptMinQuerySize)
+		require.Zero(t, len(padded)%dnscryptPaddingBlockSize)
+		require.GreaterOrEqual(t, len(padded), dnscryptMinQuerySize)
+		unpadded, err := dnscryptUnpad(padded)
+		require.NoError(t, err)
+		require.Equal(t, msg, unpadded)
+	}
+
+	t.Run("rejects invalid padding", func(t *testing.T) {
+		_, err := dnscryptUnpad([]byte{1, 2, 0, 0})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+		_, err = dnscryptUnpad([]byte{0, 0})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
+
+func TestDnscryptStreamConnMutateQuery(t *testing.T) {
+	query := dnscodec.NewQuery("example.com", 1)
+	QueryParamsDNSCrypt().MutateQuery(query)
+	require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeUDP), query.MaxSize)
+	require.Zero(t, query.Flags&dnscodec.QueryFlagBlockLengthPadding)
+	require.NotZero(t, query.Flags&dnscodec.QueryFlagDNSSec)
+}
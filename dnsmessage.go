@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsOptionPadding is the EDNS(0) padding option code (RFC 7830).
+const ednsOptionPadding = 12
+
+// DNSMessageCodec is the [Codec] for projects using [dnsmessage.Message].
+//
+// We send a copy of the query after applying the [QueryParams], adding an
+// EDNS(0) OPT record when missing, unless Verbatim is set. The response is
+// the validated message, whose RCODE is not mapped to errors, so the caller
+// should check it.
+type DNSMessageCodec struct{}
+
+var _ Codec[*dnsmessage.Message, *dnsmessage.Message] = DNSMessageCodec{}
+
+// PackQuery implements [Codec].
+func (DNSMessageCodec) PackQuery(buf []byte, query *dnsmessage.Message, params QueryParams) ([]byte, error) {
+	// 1. copy the query and apply the params
+	msg := *query
+	msg.Questions = slices.Clone(query.Questions)
+	msg.Additionals = slices.Clone(query.Additionals)
+	if params.ZeroID {
+		msg.Header.ID = 0
+	}
+	if params.QueryClass != 0 {
+		for idx := range msg.Questions {
+			msg.Questions[idx].Class = dnsmessage.Class(params.QueryClass)
+		}
+	}
+	if params.NoRecursion {
+		msg.Header.RecursionDesired = false
+	}
+	if params.Verbatim || dnsMessageHasOPT(&msg) {
+		return msg.AppendPack(buf[:0])
+	}
+
+	// 2. add the EDNS(0) OPT record
+	var hdr dnsmessage.ResourceHeader
+	dnssecOK := params.Flags&dnscodec.QueryFlagDNSSec != 0
+	if err := hdr.SetEDNS0(int(params.MaxSize), dnsmessage.RCodeSuccess, dnssecOK); err != nil {
+		return nil, err
+	}
+	opt := &dnsmessage.OPTResource{}
+	msg.Additionals = append(msg.Additionals, dnsmessage.Resource{Header: hdr, Body: opt})
+	if params.Flags&dnscodec.QueryFlagBlockLengthPadding == 0 {
+		return msg.AppendPack(buf[:0])
+	}
+
+	// 3. pad to the closest multiple of 128 octets (RFC 8467 Section 4.1)
+	// accounting for the 4 octets of the padding option header
+	unpadded, err := msg.AppendPack(buf[:0])
+	if err != nil {
+		return nil, err
+	}
+	const desiredSize = 128
+	remainder := (desiredSize - uint16(len(unpadded)+4)) % desiredSize
+	opt.Options = append(opt.Options, dnsmessage.Option{Code: ednsOptionPadding, Data: make([]byte, remainder)})
+	return msg.AppendPack(buf[:0])
+}
+
+// dnsMessageHasOPT returns whether the message contains an OPT record.
+func dnsMessageHasOPT(msg *dnsmessage.Message) bool {
+	for _, rr := range msg.Additionals {
+		if rr.Header.Type == dnsmessage.TypeOPT {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseResponse implements [Codec].
+//
+// The validation is equivalent to [dnscodec.ValidateResponseForQuery].
+func (DNSMessageCodec) ParseResponse(query *dnsmessage.Message, rawQuery, rawResp []byte) (*dnsmessage.Message, error) {
+	// 1. only parse the header and the questions of the query we sent
+	var parser dnsmessage.Parser
+	queryHdr, err := parser.Start(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	queryQuestions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	if len(queryQuestions) != 1 {
+		return nil, dnscodec.ErrInvalidQuery
+	}
+
+	// 2. parse the response, which copies the data it needs
+	resp := &dnsmessage.Message{}
+	if err := resp.Unpack(rawResp); err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 3. make sure the response matches the query
+	if !resp.Header.Response || resp.Header.ID != queryHdr.ID || len(resp.Questions) != 1 {
+		return nil, dnscodec.ErrInvalidResponse
+	}
+	query0, resp0 := queryQuestions[0], resp.Questions[0]
+	if !strings.EqualFold(resp0.Name.String(), query0.Name.String()) ||
+		resp0.Class != query0.Class || resp0.Type != query0.Type {
+		return nil, dnscodec.ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+// Question implements [Codec].
+func (DNSMessageCodec) Question(query *dnsmessage.Message) (string, uint16) {
+	if len(query.Questions) <= 0 {
+		return "", 0
+	}
+	return query.Questions[0].Name.String(), uint16(query.Questions[0].Type)
+}
+
+// ExchangeDNSMessage is like [*Transport.Exchange] but uses [DNSMessageCodec].
+func (dt *Transport) ExchangeDNSMessage(ctx context.Context, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	return ExchangeCodec(ctx, dt, DNSMessageCodec{}, query)
+}
+
+// ExchangeDNSMessageWithStreamOpener is like [*Transport.ExchangeWithStreamOpener]
+// but uses [DNSMessageCodec]. See [*Transport.ExchangeDNSMessage] for more information.
+func (dt *Transport) ExchangeDNSMessageWithStreamOpener(ctx context.Context,
+	conn StreamOpener, query *dnsmessage.Message) (*dnsmessage.Message, error) {
+	return ExchangeCodecWithStreamOpener(ctx, dt, DNSMessageCodec{}, conn, query)
+}
+
+// MsgToDNSMessage converts a [*dns.Msg] to a [*dnsmessage.Message].
+func MsgToDNSMessage(msg *dns.Msg) (*dnsmessage.Message, error) {
+	raw, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := &dnsmessage.Message{}
+	if err := out.Unpack(raw); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DNSMessageToMsg converts a [*dnsmessage.Message] to a [*dns.Msg].
+func DNSMessageToMsg(msg *dnsmessage.Message) (*dns.Msg, error) {
+	raw, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	out := &dns.Msg{}
+	if err := out.Unpack(raw); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newDNSMessageQuery returns a [*dnsmessage.Message] query.
+func newDNSMessageQuery(name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+func TestTransportExchangeDNSMessage(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		resp, err := dt.ExchangeDNSMessage(context.Background(), newDNSMessageQuery("dns.google.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, dnsmessage.RCodeSuccess, resp.Header.RCode)
+		require.Len(t, resp.Answers, 1)
+		addr := resp.Answers[0].Body.(*dnsmessage.AResource).A
+		require.Equal(t, netip.MustParseAddr("8.8.8.8"), netip.AddrFrom4(addr))
+	})
+
+	t.Run("does not map the RCODE to errors", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		resp, err := dt.ExchangeDNSMessage(context.Background(), newDNSMessageQuery("nonexistent.example.com.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, dnsmessage.RCodeNameError, resp.Header.RCode)
+	})
+
+	t.Run("with stream opener", func(t *testing.T) {
+		dt := newCodecTestTransport()
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		resp, err := dt.ExchangeDNSMessageWithStreamOpener(context.Background(), conn, newDNSMessageQuery("dns.google.", dnsmessage.TypeA))
+		require.NoError(t, err)
+		require.Len(t, resp.Answers, 1)
+	})
+}
+
+func TestDNSMessageCodecPackQuery(t *testing.T) {
+	params := QueryParams{
+		Flags:       dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec,
+		MaxSize:     dnscodec.QueryMaxResponseSizeTCP,
+		ZeroID:      true,
+		QueryClass:  dns.ClassCHAOS,
+		NoRecursion: true,
+	}
+
+	t.Run("applies the params", func(t *testing.T) {
+		query := newDNSMessageQuery("version.bind.", dnsmessage.TypeTXT)
+		rawQuery, err := DNSMessageCodec{}.PackQuery(nil, query, params)
+		require.NoError(t, err)
+		require.Zero(t, len(rawQuery)%128)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Zero(t, msg.Id)
+		require.False(t, msg.RecursionDesired)
+		require.Equal(t, uint16(dns.ClassCHAOS), msg.Question[0].Qclass)
+		require.True(t, msg.IsEdns0().Do())
+		require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeTCP), msg.IsEdns0().UDPSize())
+
+		// the caller's query is intact
+		require.Equal(t, uint16(1234), query.Header.ID)
+		require.Equal(t, dnsmessage.ClassINET, query.Questions[0].Class)
+		require.Empty(t, query.Additionals)
+	})
+
+	t.Run("without padding", func(t *testing.T) {
+		query := newDNSMessageQuery("dns.google.", dnsmessage.TypeA)
+		rawQuery, err := DNSMessageCodec{}.PackQuery(nil, query, QueryParams{MaxSize: 512})
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Equal(t, uint16(1234), msg.Id)
+		require.Equal(t, uint16(512), msg.IsEdns0().UDPSize())
+		require.Empty(t, msg.IsEdns0().Option)
+	})
+
+	t.Run("keeps the existing OPT record", func(t *testing.T) {
+		query := newDNSMessageQuery("dns.google.", dnsmessage.TypeA)
+		var hdr dnsmessage.ResourceHeader
+		require.NoError(t, hdr.SetEDNS0(1232, dnsmessage.RCodeSuccess, false))
+		query.Additionals = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.OPTResource{}}}
+		rawQuery, err := DNSMessageCodec{}.PackQuery(nil, query, params)
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Equal(t, uint16(1232), msg.IsEdns0().UDPSize())
+		require.False(t, msg.IsEdns0().Do())
+	})
+
+	t.Run("with Verbatim does not add the OPT record", func(t *testing.T) {
+		query := newDNSMessageQuery("dns.google.", dnsmessage.TypeA)
+		rawQuery, err := DNSMessageCodec{}.PackQuery(nil, query, QueryParams{Verbatim: true})
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.Equal(t, uint16(1234), msg.Id)
+		require.Nil(t, msg.IsEdns0())
+	})
+}
+
+func TestDNSMessageCodecParseResponse(t *testing.T) {
+	query := newDNSMessageQuery("dns.google.", dnsmessage.TypeA)
+	rawQuery, err := query.Pack()
+	require.NoError(t, err)
+
+	// newResponse returns a raw response after applying the given mutation.
+	newResponse := func(t *testing.T, mutate func(resp *dns.Msg)) []byte {
+		queryMsg := new(dns.Msg)
+		require.NoError(t, queryMsg.Unpack(rawQuery))
+		resp := new(dns.Msg)
+		resp.SetReply(queryMsg)
+		mutate(resp)
+		rawResp, err := resp.Pack()
+		require.NoError(t, err)
+		return rawResp
+	}
+
+	t.Run("valid response with different case", func(t *testing.T) {
+		rawResp := newResponse(t, func(resp *dns.Msg) { resp.Question[0].Name = "DNS.Google." })
+		resp, err := DNSMessageCodec{}.ParseResponse(query, rawQuery, rawResp)
+		require.NoError(t, err)
+		require.True(t, resp.Header.Response)
+	})
+
+	cases := map[string]func(resp *dns.Msg){
+		"not a response": func(resp *dns.Msg) { resp.Response = false },
+		"ID mismatch":    func(resp *dns.Msg) { resp.Id++ },
+		"no question":    func(resp *dns.Msg) { resp.Question = nil },
+		"name mismatch":  func(resp *dns.Msg) { resp.Question[0].Name = "example.com." },
+		"type mismatch":  func(resp *dns.Msg) { resp.Question[0].Qtype = dns.TypeAAAA },
+		"class mismatch": func(resp *dns.Msg) { resp.Question[0].Qclass = dns.ClassCHAOS },
+	}
+	for name, mutate := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := DNSMessageCodec{}.ParseResponse(query, rawQuery, newResponse(t, mutate))
+			require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+		})
+	}
+
+	t.Run("malformed response", func(t *testing.T) {
+		_, err := DNSMessageCodec{}.ParseResponse(query, rawQuery, []byte{0x00})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("query without question", func(t *testing.T) {
+		rawQuery, err := (&dnsmessage.Message{}).Pack()
+		require.NoError(t, err)
+		_, err = DNSMessageCodec{}.ParseResponse(query, rawQuery, nil)
+		require.ErrorIs(t, err, dnscodec.ErrInvalidQuery)
+	})
+}
+
+func TestDNSMessageCodecQuestion(t *testing.T) {
+	name, qtype := DNSMessageCodec{}.Question(newDNSMessageQuery("dns.google.", dnsmessage.TypeAAAA))
+	require.Equal(t, "dns.google.", name)
+	require.Equal(t, dns.TypeAAAA, qtype)
+
+	name, qtype = DNSMessageCodec{}.Question(&dnsmessage.Message{})
+	require.Empty(t, name)
+	require.Zero(t, qtype)
+}
+
+func TestDNSMessageConversion(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("dns.google.", dns.TypeA)
+	msg.Id = 1234
+
+	converted, err := MsgToDNSMessage(msg)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1234), converted.Header.ID)
+	require.Equal(t, "dns.google.", converted.Questions[0].Name.String())
+
+	back, err := DNSMessageToMsg(converted)
+	require.NoError(t, err)
+	require.Equal(t, msg.Question, back.Question)
+	require.Equal(t, msg.Id, back.Id)
+
+	_, err = MsgToDNSMessage(&dns.Msg{Question: []dns.Question{{Name: "invalid"}}})
+	require.Error(t, err)
+}
@@ -1,9 +1,22 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 
-// Package dnsoverstream implements DNS over TCP, TLS, and QUIC transports.
+// Package dnsoverstream implements DNS over UDP, TCP, TLS, DTLS, QUIC, and HTTPS
+// transports, as well as DNSCrypt and Oblivious DoH.
 //
 // The API is intentionally small and designed for measurement use cases.
 //
-// Each Transport targets a single netip.AddrPort endpoint and does not reuse
-// connections across requests.
+// Each Transport targets a single netip.AddrPort endpoint and, by default,
+// does not reuse connections across requests. Use NewPooledTransport or
+// assign a shared Pool to reuse idle connections across requests and endpoints.
+//
+// # Mocking
+//
+// The Stream, StreamOpener, and StreamOpenerDialer interfaces are stable,
+// so downstream code can implement them to mock this package. We will not
+// add methods to them, since that would break existing implementations, and
+// we detect optional capabilities (e.g., HandshakeKind) by type assertion.
+//
+// Use FuncStream, FuncStreamOpener, and FuncStreamOpenerDialer to inject
+// specific failures, and NewStreamOpenerDialerHandler with a Handler to
+// answer queries in memory without touching the network.
 package dnsoverstream
@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ProtocolHTTPSJSON is the protocol name used by [PoolKey] for
+// DNS over HTTPS using the JSON API (see [StreamOpenerDialerHTTPSJSON]).
+const ProtocolHTTPSJSON = "https-json"
+
+// DefaultHTTPSJSONPath is the URL path of the Google JSON API, while
+// Cloudflare serves the JSON API using [DefaultHTTPSPath].
+const DefaultHTTPSJSONPath = "/resolve"
+
+// httpsJSONContentType is the media type of the JSON API.
+const httpsJSONContentType = "application/dns-json"
+
+// StreamOpenerDialerHTTPSJSON implements [StreamOpenerDialer] for the JSON API
+// of DNS over HTTPS implemented by Google and Cloudflare, where each query is a
+// GET request containing the name and the type and each response is a JSON
+// document, so that measurements can compare it with RFC 8484.
+//
+// We convert each JSON response back into a DNS message having the ID and the
+// question class of the query, so the [*Transport] returns [*dnscodec.Response]
+// as usual, and the [*Transport] hooks observe such messages. Note that the JSON
+// API cannot carry EDNS(0) options, including padding, nor the question class,
+// and ObserveJSONResponse observes the JSON documents.
+//
+// Construct using [NewStreamOpenerDialerHTTPSJSON].
+type StreamOpenerDialerHTTPSJSON struct {
+	// Dialer is the MANDATORY [*StreamOpenerDialerHTTPS], whose Path is the path
+	// of the JSON API (e.g., [DefaultHTTPSJSONPath] for Google).
+	Dialer *StreamOpenerDialerHTTPS
+
+	// ObserveJSONResponse is an optional hook called with each
+	// JSON document received in response, before converting it.
+	ObserveJSONResponse func([]byte)
+}
+
+// NewStreamOpenerDialerHTTPSJSON creates a new [*StreamOpenerDialerHTTPSJSON].
+func NewStreamOpenerDialerHTTPSJSON(dialer *StreamOpenerDialerHTTPS) *StreamOpenerDialerHTTPSJSON {
+	return &StreamOpenerDialerHTTPSJSON{Dialer: dialer}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerHTTPSJSON{}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *StreamOpenerDialerHTTPSJSON) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	conn, err := d.Dialer.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	hc := conn.(*httpsConn)
+	hc.envelope = &httpsJSONEnvelope{observeResponse: d.ObserveJSONResponse}
+	return hc, nil
+}
+
+// httpsJSONEnvelope implements [httpsEnvelope] for the JSON API.
+type httpsJSONEnvelope struct {
+	observeResponse func([]byte)
+}
+
+// contentType implements [httpsEnvelope].
+func (e *httpsJSONEnvelope) contentType() string {
+	return httpsJSONContentType
+}
+
+// acceptsContentType implements [httpsEnvelope].
+//
+// Cloudflare uses application/dns-json while Google uses application/json.
+func (e *httpsJSONEnvelope) acceptsContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(value)
+	return err == nil && (mediaType == httpsJSONContentType || mediaType == "application/json")
+}
+
+// method implements [httpsEnvelope].
+func (e *httpsJSONEnvelope) method() string {
+	return http.MethodGet
+}
+
+// seal implements [httpsEnvelope].
+func (e *httpsJSONEnvelope) seal(rawQuery []byte) ([]byte, func(body []byte) ([]byte, error), error) {
+	// 1. parse the query we should send
+	query := new(dns.Msg)
+	if err := query.Unpack(rawQuery); err != nil {
+		return nil, nil, err
+	}
+	if len(query.Question) != 1 {
+		return nil, nil, dnscodec.ErrInvalidQuery
+	}
+
+	// 2. map the query to the URL query string
+	values := url.Values{
+		"name": {query.Question[0].Name},
+		"type": {strconv.Itoa(int(query.Question[0].Qtype))},
+	}
+	if opt := query.IsEdns0(); opt != nil && opt.Do() {
+		values.Set("do", "1")
+	}
+	if query.CheckingDisabled {
+		values.Set("cd", "1")
+	}
+
+	// 3. convert the response back into a DNS message
+	open := func(body []byte) ([]byte, error) {
+		if e.observeResponse != nil {
+			e.observeResponse(body)
+		}
+		return httpsJSONUnmarshalResponse(query, body)
+	}
+	return []byte(values.Encode()), open, nil
+}
+
+// httpsJSONResponse is the JSON document returned by the JSON API.
+type httpsJSONResponse struct {
+	Status     int                 `json:"Status"`
+	TC         bool                `json:"TC"`
+	RD         bool                `json:"RD"`
+	RA         bool                `json:"RA"`
+	AD         bool                `json:"AD"`
+	CD         bool                `json:"CD"`
+	Question   []httpsJSONQuestion `json:"Question"`
+	Answer     []httpsJSONRecord   `json:"Answer"`
+	Authority  []httpsJSONRecord   `json:"Authority"`
+	Additional []httpsJSONRecord   `json:"Additional"`
+}
+
+// httpsJSONQuestion is a question of a [httpsJSONResponse].
+type httpsJSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+// httpsJSONRecord is a resource record of a [httpsJSONResponse].
+type httpsJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// httpsJSONUnmarshalResponse converts the JSON document into the raw
+// DNS message answering the given query.
+//
+// This function returns [dnscodec.ErrServerMisbehaving] when the
+// document is not valid or contains invalid records.
+func httpsJSONUnmarshalResponse(query *dns.Msg, body []byte) ([]byte, error) {
+	// 1. parse the JSON document
+	var doc httpsJSONResponse
+	if err := json.Unmarshal(body, &doc); err != nil || doc.Status < 0 || doc.Status > 0xfff {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 2. fill the header and the question using the query for
+	// the fields that the JSON document does not contain
+	msg := new(dns.Msg)
+	msg.SetReply(query)
+	msg.Rcode = doc.Status
+	msg.Truncated = doc.TC
+	msg.RecursionDesired = doc.RD
+	msg.RecursionAvailable = doc.RA
+	msg.AuthenticatedData = doc.AD
+	msg.CheckingDisabled = doc.CD
+	if len(doc.Question) > 0 {
+		msg.Question = nil
+		for _, q := range doc.Question {
+			msg.Question = append(msg.Question, dns.Question{
+				Name:   dns.Fqdn(q.Name),
+				Qtype:  q.Type,
+				Qclass: query.Question[0].Qclass,
+			})
+		}
+	}
+
+	// 3. parse the records using their presentation format
+	var err error
+	if msg.Answer, err = httpsJSONParseRecords(doc.Answer); err != nil {
+		return nil, err
+	}
+	if msg.Ns, err = httpsJSONParseRecords(doc.Authority); err != nil {
+		return nil, err
+	}
+	if msg.Extra, err = httpsJSONParseRecords(doc.Additional); err != nil {
+		return nil, err
+	}
+
+	// 4. add the OPT record, which also carries extended RCODEs
+	if opt := query.IsEdns0(); opt != nil {
+		msg.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return msg.Pack()
+}
+
+// httpsJSONParseRecords parses the records of a [httpsJSONResponse].
+func httpsJSONParseRecords(records []httpsJSONRecord) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s",
+			dns.Fqdn(record.Name), record.TTL, dns.Type(record.Type), record.Data))
+		if err != nil || rr == nil {
+			return nil, dnscodec.ErrServerMisbehaving
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
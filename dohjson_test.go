@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newHTTPSJSONTestHandler returns an [http.Handler] implementing the JSON
+// API by replying with the given content type and document.
+func newHTTPSJSONTestHandler(contentType, document string, requests *[]*http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r)
+		w.Header().Set("Content-Type", contentType)
+		w.Write([]byte(document))
+	})
+}
+
+// newHTTPSJSONTestTransport returns a [*Transport] for the JSON API trusting [testPKI].
+func newHTTPSJSONTestTransport(endpoint netip.AddrPort) (*Transport, *StreamOpenerDialerHTTPSJSON) {
+	https := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: newTestClientTLSConfig("h2")})
+	https.Path = DefaultHTTPSJSONPath
+	dialer := NewStreamOpenerDialerHTTPSJSON(https)
+	return NewTransport(dialer, endpoint), dialer
+}
+
+func TestStreamOpenerDialerHTTPSJSON(t *testing.T) {
+	const document = `{"Status":0,"TC":false,"RD":true,"RA":true,"AD":false,"CD":false,
+		"Question":[{"name":"dns.google.","type":1}],
+		"Answer":[{"name":"dns.google.","type":1,"TTL":300,"data":"8.8.8.8"},
+			{"name":"dns.google.","type":1,"TTL":300,"data":"8.8.4.4"}]}`
+
+	t.Run("exchanges using GET", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newHTTPSJSONTestHandler(
+			"application/json; charset=UTF-8", document, &requests))
+		dt, dialer := newHTTPSJSONTestTransport(endpoint)
+		var observed []byte
+		dialer.ObserveJSONResponse = func(data []byte) {
+			observed = data
+		}
+
+		query := dnscodec.NewQuery("dns.google", dns.TypeA)
+		query.Flags |= dnscodec.QueryFlagDNSSec
+		resp, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8", "8.8.4.4"}, addrs)
+		require.JSONEq(t, document, string(observed))
+
+		require.Len(t, requests, 1)
+		require.Equal(t, http.MethodGet, requests[0].Method)
+		require.Equal(t, "/resolve", requests[0].URL.Path)
+		require.Equal(t, "dns.google.", requests[0].URL.Query().Get("name"))
+		require.Equal(t, "1", requests[0].URL.Query().Get("type"))
+		require.Equal(t, "1", requests[0].URL.Query().Get("do"))
+		require.Equal(t, "application/dns-json", requests[0].Header.Get("Accept"))
+	})
+
+	t.Run("maps the status to the RCODE", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newHTTPSJSONTestHandler("application/dns-json",
+			`{"Status":3,"Question":[{"name":"nxdomain.example.","type":1}]}`, &requests))
+		dt, _ := newHTTPSJSONTestTransport(endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("nxdomain.example", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrNoName)
+	})
+
+	t.Run("rejects responses for another question", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newHTTPSJSONTestHandler("application/dns-json", document, &requests))
+		dt, _ := newHTTPSJSONTestTransport(endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+	})
+
+	t.Run("rejects unexpected content types", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newHTTPSJSONTestHandler("text/html", document, &requests))
+		dt, _ := newHTTPSJSONTestTransport(endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("uses its own pool protocol", func(t *testing.T) {
+		dt, _ := newHTTPSJSONTestTransport(netip.MustParseAddrPort("127.0.0.1:443"))
+		key := newPoolKey(dt.dialer, dt.endpoint)
+		require.Equal(t, ProtocolHTTPSJSON, key.Protocol)
+		require.Equal(t, "example.com", key.ServerName)
+	})
+}
+
+func TestHTTPSJSONUnmarshalResponse(t *testing.T) {
+	newQuery := func() *dns.Msg {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeTXT)
+		query.SetEdns0(1232, true)
+		return query
+	}
+
+	t.Run("converts all the sections", func(t *testing.T) {
+		query := newQuery()
+		raw, err := httpsJSONUnmarshalResponse(query, []byte(`{"Status":0,"AD":true,
+			"Question":[{"name":"example.com.","type":16}],
+			"Answer":[{"name":"example.com.","type":16,"TTL":60,"data":"\"hello world\""}],
+			"Authority":[{"name":"example.com.","type":2,"TTL":60,"data":"ns.example.com."}],
+			"Additional":[{"name":"ns.example.com.","type":1,"TTL":60,"data":"192.0.2.1"}]}`))
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(raw))
+		require.Equal(t, query.Id, msg.Id)
+		require.True(t, msg.Response)
+		require.True(t, msg.AuthenticatedData)
+		require.Equal(t, []string{"hello world"}, msg.Answer[0].(*dns.TXT).Txt)
+		require.Equal(t, "ns.example.com.", msg.Ns[0].(*dns.NS).Ns)
+		require.Len(t, msg.Extra, 2) // the A record and the OPT record
+		require.True(t, msg.IsEdns0().Do())
+	})
+
+	t.Run("rejects invalid documents", func(t *testing.T) {
+		_, err := httpsJSONUnmarshalResponse(newQuery(), []byte(`{`))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("rejects invalid records", func(t *testing.T) {
+		_, err := httpsJSONUnmarshalResponse(newQuery(), []byte(
+			`{"Status":0,"Answer":[{"name":"example.com.","type":1,"TTL":60,"data":"not-an-address"}]}`))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
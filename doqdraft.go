@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// DoQDraftALPNs contains the ALPN tokens of the DNS-over-QUIC drafts that
+// preceded RFC 9250, from the newest to the oldest, which older servers (e.g.,
+// early AdGuard deployments) may still use.
+//
+// The drafts up to doq-i02 (and "dq") send DNS messages without the 2-byte
+// length prefix, which we handle when the server selects one of them.
+var DoQDraftALPNs = []string{
+	"doq-i11", "doq-i10", "doq-i09", "doq-i08", "doq-i07", "doq-i06",
+	"doq-i05", "doq-i04", "doq-i03", "doq-i02", "doq-i01", "doq-i00", "dq",
+}
+
+// doqUnframedALPNs contains the [DoQDraftALPNs] without the length prefix.
+var doqUnframedALPNs = []string{"doq-i02", "doq-i01", "doq-i00", "dq"}
+
+// NewTLSConfigDNSOverQUICWithALPN is like [NewTLSConfigDNSOverQUIC] but
+// advertises the given ALPN tokens, in order of preference, to measure
+// servers implementing DoQ drafts (e.g., "doq" followed by [DoQDraftALPNs]).
+//
+// Use [StreamOpenerNegotiatedProtocol] to know which token the server selected.
+func NewTLSConfigDNSOverQUICWithALPN(serverName string, alpn ...string) *tls.Config {
+	config := NewTLSConfigDNSOverQUIC(serverName)
+	config.NextProtos = slices.Clone(alpn)
+	return config
+}
+
+// doqUnframed returns whether the given negotiated ALPN token
+// identifies a draft sending DNS messages without length prefix.
+func doqUnframed(alpn string) bool {
+	return slices.Contains(doqUnframedALPNs, alpn)
+}
+
+// doqUnframedStream adapts a [Stream] using the drafts without length prefix,
+// where each stream carries a single query and a single response.
+//
+// Like [*udpStream], it buffers the query frame written by the caller, sends
+// the query without length prefix when the caller closes the stream, and
+// returns the response read until the end of the stream as a frame.
+type doqUnframedStream struct {
+	Stream
+	query bytes.Buffer
+	resp  io.Reader
+}
+
+// Write implements [Stream].
+func (s *doqUnframedStream) Write(data []byte) (int, error) {
+	return s.query.Write(data)
+}
+
+// Close implements [Stream].
+func (s *doqUnframedStream) Close() error {
+	// 1. remove the length prefix from the query frame
+	frame := s.query.Bytes()
+	if len(frame) < 2 || int(binary.BigEndian.Uint16(frame)) != len(frame)-2 {
+		s.Stream.Close()
+		return io.ErrUnexpectedEOF
+	}
+
+	// 2. send the query and signal we are done writing
+	if _, err := s.Stream.Write(frame[2:]); err != nil {
+		return err
+	}
+	return s.Stream.Close()
+}
+
+// Read implements [Stream].
+func (s *doqUnframedStream) Read(buff []byte) (int, error) {
+	if s.resp == nil {
+		// the response is all the data until the end of the stream
+		rawResp, err := io.ReadAll(io.LimitReader(s.Stream, math.MaxUint16+1))
+		if err != nil {
+			return 0, err
+		}
+		if len(rawResp) > math.MaxUint16 {
+			return 0, dnscodec.ErrServerMisbehaving
+		}
+		respFrame := binary.BigEndian.AppendUint16(nil, uint16(len(rawResp)))
+		s.resp = bytes.NewReader(append(respFrame, rawResp...))
+	}
+	return s.resp.Read(buff)
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newDoQDraftTestServer starts a DNS-over-QUIC server only accepting
+// the given ALPN token, which sends unframed messages when [doqUnframed].
+func newDoQDraftTestServer(t *testing.T, alpn string) netip.AddrPort {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{newTestCert()},
+		NextProtos:   []string{alpn},
+	}
+	listener, err := quic.Listen(pconn, tlsConfig, &quic.Config{})
+	require.NoError(t, err)
+
+	handler := func(query *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{newBenchHandler().PrepareResponse(query)}
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				defer conn.CloseWithError(0, "")
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					if !doqUnframed(alpn) {
+						go serveTestStream(stream, handler)
+						continue
+					}
+					go serveDoQDraftTestStream(stream, handler)
+				}
+			})
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		pconn.Close()
+		wg.Wait()
+	})
+	return listener.Addr().(*net.UDPAddr).AddrPort()
+}
+
+// serveDoQDraftTestStream reads a single unframed query until the end of
+// the stream and writes the unframed response.
+func serveDoQDraftTestStream(stream *quic.Stream, handler func(query *dns.Msg) []*dns.Msg) {
+	defer stream.Close()
+	rawQuery, err := io.ReadAll(stream)
+	if err != nil {
+		return
+	}
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return
+	}
+	rawResp, err := handler(query)[0].Pack()
+	if err != nil {
+		return
+	}
+	stream.Write(rawResp)
+}
+
+func TestDoQDraft(t *testing.T) {
+	for _, alpn := range []string{"doq", "doq-i11", "doq-i02", "dq"} {
+		t.Run(alpn, func(t *testing.T) {
+			endpoint := newDoQDraftTestServer(t, alpn)
+			tlsConfig := NewTLSConfigDNSOverQUICWithALPN("example.com", append([]string{"doq"}, DoQDraftALPNs...)...)
+			tlsConfig.RootCAs = testPKI().CertPool()
+			dialer := NewStreamOpenerDialerQUIC(&QUICDialer{TLSConfig: tlsConfig, ConnectedUDP: true})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := dialer.DialContext(ctx, endpoint)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.Equal(t, alpn, StreamOpenerNegotiatedProtocol(conn))
+
+			dt := NewTransport(dialer, endpoint)
+			resp, err := dt.ExchangeWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+			addrs, err := resp.RecordsA()
+			require.NoError(t, err)
+			require.NotEmpty(t, addrs)
+		})
+	}
+}
+
+func TestNewTLSConfigDNSOverQUICWithALPN(t *testing.T) {
+	alpn := []string{"doq", "doq-i02"}
+	config := NewTLSConfigDNSOverQUICWithALPN("dns.adguard-dns.com", alpn...)
+	require.Equal(t, "dns.adguard-dns.com", config.ServerName)
+	require.Equal(t, alpn, config.NextProtos)
+	alpn[0] = "dq"
+	require.Equal(t, "doq", config.NextProtos[0])
+}
+
+func TestDoQUnframedStream(t *testing.T) {
+	t.Run("rejects writes not containing a single frame", func(t *testing.T) {
+		var closed bool
+		stream := &doqUnframedStream{Stream: &FuncStream{CloseFunc: func() error {
+			closed = true
+			return nil
+		}}}
+		_, err := stream.Write([]byte{0, 4, 1})
+		require.NoError(t, err)
+		require.ErrorIs(t, stream.Close(), io.ErrUnexpectedEOF)
+		require.True(t, closed)
+	})
+}
@@ -0,0 +1,317 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// OpcodeDSO is the opcode of DNS Stateful Operations messages (RFC 8490).
+const OpcodeDSO = 6
+
+// DSO TLV types (RFC 8490 Section 10.3).
+const (
+	// DSOTypeKeepalive is the Keepalive TLV, which establishes a DSO session
+	// and carries the inactivity timeout and the keepalive interval.
+	DSOTypeKeepalive uint16 = 0x0001
+
+	// DSOTypeRetryDelay is the Retry Delay TLV, which servers send
+	// to tell clients to close the session and wait before retrying.
+	DSOTypeRetryDelay uint16 = 0x0002
+
+	// DSOTypeEncryptionPadding is the Encryption Padding TLV.
+	DSOTypeEncryptionPadding uint16 = 0x0003
+)
+
+// RcodeDSOTypeNI is the RCODE indicating that the server does
+// not implement the primary TLV of a DSO request (RFC 8490 Section 10.2).
+const RcodeDSOTypeNI = 11
+
+// ErrDSOInvalidMessage indicates that a DSO message is malformed.
+var ErrDSOInvalidMessage = errors.New("dnsoverstream: invalid DSO message")
+
+// ErrDSOUnsupportedProtocol indicates that the protocol requires zero message
+// IDs, as DNS over QUIC does, which forbids using DSO (RFC 9250 Section 5.4).
+var ErrDSOUnsupportedProtocol = errors.New("dnsoverstream: DSO unsupported by the protocol")
+
+// ErrDSORejected indicates that the server rejected a DSO request.
+var ErrDSORejected = errors.New("dnsoverstream: DSO request rejected")
+
+// DSORejectedError is the error returned by [*Transport.EstablishDSOSession]
+// when the response has a nonzero RCODE, which carries the RCODE.
+//
+// Servers not supporting DSO reply with [dns.RcodeNotImplemented] or
+// [dns.RcodeFormatError], while [RcodeDSOTypeNI] indicates that the server
+// does not implement the primary TLV.
+//
+// Use [errors.As] to obtain it and [errors.Is] with [ErrDSORejected] to check it.
+type DSORejectedError struct {
+	// Rcode is the RCODE of the response.
+	Rcode int
+}
+
+// Error implements error.
+func (e *DSORejectedError) Error() string {
+	return fmt.Sprintf("%s (rcode %d)", ErrDSORejected, e.Rcode)
+}
+
+// Unwrap returns [ErrDSORejected].
+func (e *DSORejectedError) Unwrap() error {
+	return ErrDSORejected
+}
+
+// DSOTLV is a DSO TLV (RFC 8490 Section 5.4).
+type DSOTLV struct {
+	// Type is the DSO-TYPE (e.g., [DSOTypeKeepalive]).
+	Type uint16
+
+	// Data is the DSO-DATA.
+	Data []byte
+}
+
+// DSOMessage is a DNS Stateful Operations message (RFC 8490), whose first
+// TLV is the primary TLV and whose other TLVs are additional TLVs.
+//
+// Decode using [DecodeDSOMessage].
+type DSOMessage struct {
+	// ID is the message ID, which is zero for unidirectional messages.
+	ID uint16
+
+	// Response is the QR bit.
+	Response bool
+
+	// Rcode is the response code.
+	Rcode int
+
+	// TLVs contains the TLVs.
+	TLVs []DSOTLV
+}
+
+// appendDSOMessage appends the serialized msg to buf.
+func appendDSOMessage(buf []byte, msg *DSOMessage) ([]byte, error) {
+	// 1. append the header, where all the counts are zero (RFC 8490 Section 5.4)
+	flags := uint16(OpcodeDSO)<<11 | uint16(msg.Rcode&0x0f)
+	if msg.Response {
+		flags |= 1 << 15
+	}
+	buf = binary.BigEndian.AppendUint16(buf, msg.ID)
+	buf = binary.BigEndian.AppendUint16(buf, flags)
+	buf = append(buf, make([]byte, 8)...)
+
+	// 2. append the TLVs
+	for _, tlv := range msg.TLVs {
+		if len(tlv.Data) > math.MaxUint16 {
+			return nil, ErrDSOInvalidMessage
+		}
+		buf = binary.BigEndian.AppendUint16(buf, tlv.Type)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(tlv.Data)))
+		buf = append(buf, tlv.Data...)
+	}
+	return buf, nil
+}
+
+// DecodeDSOMessage decodes a raw DSO message.
+//
+// This function returns [ErrDSOInvalidMessage] if the message does not use
+// the DSO opcode, has nonzero counts, or contains truncated TLVs.
+func DecodeDSOMessage(raw []byte) (*DSOMessage, error) {
+	// 1. decode and check the header
+	hdr, err := DecodeHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Opcode != OpcodeDSO || hdr.QDCount != 0 || hdr.ANCount != 0 || hdr.NSCount != 0 || hdr.ARCount != 0 {
+		return nil, ErrDSOInvalidMessage
+	}
+	msg := &DSOMessage{ID: hdr.ID, Response: hdr.Response, Rcode: hdr.Rcode}
+
+	// 2. decode the TLVs
+	for raw = raw[HeaderSize:]; len(raw) > 0; {
+		if len(raw) < 4 {
+			return nil, ErrDSOInvalidMessage
+		}
+		length := int(binary.BigEndian.Uint16(raw[2:4]))
+		if len(raw) < 4+length {
+			return nil, ErrDSOInvalidMessage
+		}
+		msg.TLVs = append(msg.TLVs, DSOTLV{
+			Type: binary.BigEndian.Uint16(raw[0:2]),
+			Data: append([]byte{}, raw[4:4+length]...),
+		})
+		raw = raw[4+length:]
+	}
+	return msg, nil
+}
+
+// DSOKeepalive contains the timeouts of the Keepalive TLV (RFC 8490
+// Section 7.1), which have millisecond granularity.
+type DSOKeepalive struct {
+	// InactivityTimeout is the time after which the client
+	// should close an idle session.
+	InactivityTimeout time.Duration
+
+	// KeepaliveInterval is the maximum time between messages
+	// the client should send to keep the session alive.
+	KeepaliveInterval time.Duration
+}
+
+// TLV returns the Keepalive [DSOTLV], where durations longer than 0xffffffff
+// milliseconds become 0xffffffff, which means infinity.
+func (k DSOKeepalive) TLV() DSOTLV {
+	data := binary.BigEndian.AppendUint32(nil, dsoMilliseconds(k.InactivityTimeout))
+	data = binary.BigEndian.AppendUint32(data, dsoMilliseconds(k.KeepaliveInterval))
+	return DSOTLV{Type: DSOTypeKeepalive, Data: data}
+}
+
+// dsoMilliseconds converts d to milliseconds saturating to [math.MaxUint32].
+func dsoMilliseconds(d time.Duration) uint32 {
+	return uint32(min(max(d.Milliseconds(), 0), math.MaxUint32))
+}
+
+// ParseDSOKeepalive parses a Keepalive [DSOTLV].
+//
+// This function returns [ErrDSOInvalidMessage] if the TLV is not valid.
+func ParseDSOKeepalive(tlv DSOTLV) (DSOKeepalive, error) {
+	if tlv.Type != DSOTypeKeepalive || len(tlv.Data) != 8 {
+		return DSOKeepalive{}, ErrDSOInvalidMessage
+	}
+	return DSOKeepalive{
+		InactivityTimeout: time.Duration(binary.BigEndian.Uint32(tlv.Data[0:4])) * time.Millisecond,
+		KeepaliveInterval: time.Duration(binary.BigEndian.Uint32(tlv.Data[4:8])) * time.Millisecond,
+	}, nil
+}
+
+// ParseDSORetryDelay parses a Retry Delay [DSOTLV] (RFC 8490 Section 7.2).
+//
+// This function returns [ErrDSOInvalidMessage] if the TLV is not valid.
+func ParseDSORetryDelay(tlv DSOTLV) (time.Duration, error) {
+	if tlv.Type != DSOTypeRetryDelay || len(tlv.Data) != 4 {
+		return 0, ErrDSOInvalidMessage
+	}
+	return time.Duration(binary.BigEndian.Uint32(tlv.Data)) * time.Millisecond, nil
+}
+
+// DSOCodec is the [Codec] for [*DSOMessage] requests.
+//
+// We send the request using a random nonzero ID, since DSO requests require a
+// response, and, when the protocol requires padding and the request lacks an
+// Encryption Padding TLV, we append one padding to the block length (RFC 8467).
+//
+// The response must have the same ID and use the DSO opcode. We do not map the
+// RCODE to errors, so the caller should check it (e.g., [RcodeDSOTypeNI]).
+//
+// DSO requires a connection where the message IDs are nonzero, so use this
+// codec with TCP and TLS, and note that DNS over QUIC forbids DSO.
+type DSOCodec struct{}
+
+var _ Codec[*DSOMessage, *DSOMessage] = DSOCodec{}
+
+// PackQuery implements [Codec].
+func (DSOCodec) PackQuery(buf []byte, query *DSOMessage, params QueryParams) ([]byte, error) {
+	// 1. make sure we can use DSO
+	if params.ZeroID {
+		return nil, ErrDSOUnsupportedProtocol
+	}
+
+	// 2. serialize the request using a random ID
+	msg := *query
+	msg.ID = dns.Id()
+	raw, err := appendDSOMessage(buf[:0], &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. pad the request, if needed
+	if params.Verbatim || params.Flags&dnscodec.QueryFlagBlockLengthPadding == 0 || dsoHasPadding(&msg) {
+		return raw, nil
+	}
+	const blockSize = 128
+	raw = binary.BigEndian.AppendUint16(raw, DSOTypeEncryptionPadding)
+	padding := (blockSize - (len(raw)+2)%blockSize) % blockSize
+	raw = binary.BigEndian.AppendUint16(raw, uint16(padding))
+	return append(raw, make([]byte, padding)...), nil
+}
+
+// dsoHasPadding returns whether msg contains an Encryption Padding TLV.
+func dsoHasPadding(msg *DSOMessage) bool {
+	for _, tlv := range msg.TLVs {
+		if tlv.Type == DSOTypeEncryptionPadding {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseResponse implements [Codec].
+func (DSOCodec) ParseResponse(query *DSOMessage, rawQuery, rawResp []byte) (*DSOMessage, error) {
+	// 1. decode the response, where servers not supporting DSO may
+	// reply with a message using the DSO opcode but nonzero counts
+	resp, err := DecodeDSOMessage(rawResp)
+	if err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 2. make sure the response matches the request
+	if !resp.Response || resp.ID != binary.BigEndian.Uint16(rawQuery) {
+		return nil, dnscodec.ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+// Question implements [Codec].
+//
+// DSO messages do not contain a question, so we return an empty name.
+func (DSOCodec) Question(query *DSOMessage) (string, uint16) {
+	return "", 0
+}
+
+// ExchangeDSOWithStreamOpener is like [*Transport.ExchangeWithStreamOpener] but
+// sends a DSO request (RFC 8490) using [DSOCodec] and returns the response.
+//
+// Since a DSO session lives as long as the connection, use [*Transport.Dial] to
+// obtain a connection to reuse for the subsequent queries and DSO requests.
+func (dt *Transport) ExchangeDSOWithStreamOpener(ctx context.Context,
+	conn StreamOpener, msg *DSOMessage) (*DSOMessage, error) {
+	return ExchangeCodecWithStreamOpener(ctx, dt, DSOCodec{}, conn, msg)
+}
+
+// EstablishDSOSession establishes a DSO session on the given connection by
+// sending a Keepalive TLV containing the timeouts we would like to use and
+// returns the timeouts the server wants us to use (RFC 8490 Section 7.1).
+//
+// Sending another Keepalive TLV on the same connection refreshes the session,
+// which is how clients keep idle sessions alive.
+//
+// This method returns a [*DSORejectedError] when the response has a nonzero
+// RCODE, e.g., because the server does not support DSO, and [ErrDSOInvalidMessage]
+// when the response does not contain a valid Keepalive TLV.
+//
+// We do not handle unidirectional messages the server may send (e.g., a Retry
+// Delay TLV), which cause the subsequent exchanges to fail, so measurements
+// interested in them should read the connection themselves.
+func (dt *Transport) EstablishDSOSession(ctx context.Context,
+	conn StreamOpener, keepalive DSOKeepalive) (DSOKeepalive, error) {
+	// 1. send the keepalive as the primary TLV
+	req := &DSOMessage{TLVs: []DSOTLV{keepalive.TLV()}}
+	resp, err := dt.ExchangeDSOWithStreamOpener(ctx, conn, req)
+	if err != nil {
+		return DSOKeepalive{}, err
+	}
+
+	// 2. make sure the server accepted establishing the session
+	if resp.Rcode != dns.RcodeSuccess {
+		return DSOKeepalive{}, &DSORejectedError{Rcode: resp.Rcode}
+	}
+	if len(resp.TLVs) <= 0 {
+		return DSOKeepalive{}, ErrDSOInvalidMessage
+	}
+	return ParseDSOKeepalive(resp.TLVs[0])
+}
@@ -0,0 +1,233 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newDSOTestServer starts a TCP server handling multiple messages per
+// connection, which replies to DSO requests using reply and to queries
+// using [dohTestAnswer], and returns its endpoint and the DSO requests.
+func newDSOTestServer(t *testing.T, reply func(req *DSOMessage) *DSOMessage) (netip.AddrPort, func() []*DSOMessage) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var (
+		mu       sync.Mutex
+		received []*DSOMessage
+		wg       sync.WaitGroup
+	)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			// 1. read the next message
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			raw := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(conn, raw); err != nil {
+				return
+			}
+
+			// 2. create the response
+			var rawResp []byte
+			if req, err := DecodeDSOMessage(raw); err == nil {
+				mu.Lock()
+				received = append(received, req)
+				mu.Unlock()
+				rawResp, _ = appendDSOMessage(nil, reply(req))
+			} else {
+				query := new(dns.Msg)
+				if err := query.Unpack(raw); err != nil {
+					return
+				}
+				rawResp, _ = dohTestAnswer(query).Pack()
+			}
+
+			// 3. send the response
+			if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(rawResp))), rawResp...)); err != nil {
+				return
+			}
+		}
+	}
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Go(func() { serve(conn) })
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	return listener.Addr().(*net.TCPAddr).AddrPort(), func() []*DSOMessage {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*DSOMessage{}, received...)
+	}
+}
+
+func TestTransportEstablishDSOSession(t *testing.T) {
+	t.Run("establishes the session and keeps using the connection", func(t *testing.T) {
+		endpoint, received := newDSOTestServer(t, func(req *DSOMessage) *DSOMessage {
+			keepalive := DSOKeepalive{InactivityTimeout: 15 * time.Second, KeepaliveInterval: time.Hour}
+			return &DSOMessage{ID: req.ID, Response: true, TLVs: []DSOTLV{keepalive.TLV()}}
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		keepalive, err := dt.EstablishDSOSession(context.Background(), conn, DSOKeepalive{
+			InactivityTimeout: time.Minute,
+			KeepaliveInterval: 30 * time.Second,
+		})
+		require.NoError(t, err)
+		require.Equal(t, DSOKeepalive{InactivityTimeout: 15 * time.Second, KeepaliveInterval: time.Hour}, keepalive)
+
+		// the session lives as long as the connection
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+		msgs := received()
+		require.Len(t, msgs, 1)
+		require.NotZero(t, msgs[0].ID)
+		require.False(t, msgs[0].Response)
+		require.Len(t, msgs[0].TLVs, 1)
+		sent, err := ParseDSOKeepalive(msgs[0].TLVs[0])
+		require.NoError(t, err)
+		require.Equal(t, time.Minute, sent.InactivityTimeout)
+		require.Equal(t, 30*time.Second, sent.KeepaliveInterval)
+	})
+
+	t.Run("returns DSORejectedError for nonzero RCODEs", func(t *testing.T) {
+		endpoint, _ := newDSOTestServer(t, func(req *DSOMessage) *DSOMessage {
+			return &DSOMessage{ID: req.ID, Response: true, Rcode: RcodeDSOTypeNI}
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = dt.EstablishDSOSession(context.Background(), conn, DSOKeepalive{})
+		require.ErrorIs(t, err, ErrDSORejected)
+		var rejectErr *DSORejectedError
+		require.True(t, errors.As(err, &rejectErr))
+		require.Equal(t, RcodeDSOTypeNI, rejectErr.Rcode)
+		require.Equal(t, "dnsoverstream: DSO request rejected (rcode 11)", err.Error())
+	})
+
+	t.Run("rejects responses without the keepalive", func(t *testing.T) {
+		endpoint, _ := newDSOTestServer(t, func(req *DSOMessage) *DSOMessage {
+			return &DSOMessage{ID: req.ID, Response: true}
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = dt.EstablishDSOSession(context.Background(), conn, DSOKeepalive{})
+		require.ErrorIs(t, err, ErrDSOInvalidMessage)
+	})
+
+	t.Run("rejects responses with another ID", func(t *testing.T) {
+		endpoint, _ := newDSOTestServer(t, func(req *DSOMessage) *DSOMessage {
+			return &DSOMessage{ID: req.ID + 1, Response: true}
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = dt.EstablishDSOSession(context.Background(), conn, DSOKeepalive{})
+		require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+	})
+}
+
+func TestDSOCodec(t *testing.T) {
+	req := &DSOMessage{TLVs: []DSOTLV{DSOKeepalive{}.TLV()}}
+
+	t.Run("pads to the block length when required", func(t *testing.T) {
+		raw, err := DSOCodec{}.PackQuery(nil, req, QueryParamsTLS())
+		require.NoError(t, err)
+		require.Zero(t, len(raw)%128)
+		msg, err := DecodeDSOMessage(raw)
+		require.NoError(t, err)
+		require.Len(t, msg.TLVs, 2)
+		require.Equal(t, DSOTypeEncryptionPadding, msg.TLVs[1].Type)
+	})
+
+	t.Run("refuses protocols requiring zero IDs", func(t *testing.T) {
+		_, err := DSOCodec{}.PackQuery(nil, req, QueryParamsQUIC())
+		require.ErrorIs(t, err, ErrDSOUnsupportedProtocol)
+	})
+
+	t.Run("rejects responses not using DSO", func(t *testing.T) {
+		rawQuery, err := DSOCodec{}.PackQuery(nil, req, QueryParamsTCP())
+		require.NoError(t, err)
+		resp := new(dns.Msg)
+		resp.SetQuestion("example.com.", dns.TypeA)
+		resp.Id = binary.BigEndian.Uint16(rawQuery)
+		resp.Response = true
+		resp.Opcode = OpcodeDSO
+		rawResp, err := resp.Pack()
+		require.NoError(t, err)
+		_, err = DSOCodec{}.ParseResponse(req, rawQuery, rawResp)
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
+
+func TestDecodeDSOMessage(t *testing.T) {
+	raw, err := appendDSOMessage(nil, &DSOMessage{ID: 7, Response: true, TLVs: []DSOTLV{{
+		Type: DSOTypeRetryDelay,
+		Data: binary.BigEndian.AppendUint32(nil, 5000),
+	}}})
+	require.NoError(t, err)
+
+	t.Run("decodes the TLVs", func(t *testing.T) {
+		msg, err := DecodeDSOMessage(raw)
+		require.NoError(t, err)
+		require.Equal(t, uint16(7), msg.ID)
+		require.True(t, msg.Response)
+		delay, err := ParseDSORetryDelay(msg.TLVs[0])
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Second, delay)
+	})
+
+	t.Run("rejects truncated TLVs", func(t *testing.T) {
+		_, err := DecodeDSOMessage(raw[:len(raw)-1])
+		require.ErrorIs(t, err, ErrDSOInvalidMessage)
+	})
+
+	t.Run("rejects short messages", func(t *testing.T) {
+		_, err := DecodeDSOMessage(raw[:4])
+		require.ErrorIs(t, err, ErrShortHeader)
+	})
+}
+
+func TestDSOKeepaliveTLV(t *testing.T) {
+	tlv := DSOKeepalive{InactivityTimeout: 2000 * time.Hour, KeepaliveInterval: -time.Second}.TLV()
+	keepalive, err := ParseDSOKeepalive(tlv)
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0xffffffff)*time.Millisecond, keepalive.InactivityTimeout)
+	require.Zero(t, keepalive.KeepaliveInterval)
+
+	_, err = ParseDSOKeepalive(DSOTLV{Type: DSOTypeKeepalive})
+	require.ErrorIs(t, err, ErrDSOInvalidMessage)
+}
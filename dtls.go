@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// DTLSDialer dials DTLS connections (e.g., a wrapper around pion/dtls).
+//
+// The returned [net.Conn] must have completed the DTLS handshake and must
+// preserve message boundaries: each Write sends a DTLS record containing
+// the whole buffer and each Read returns a single DTLS record.
+type DTLSDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// StreamOpenerDialerDTLS implements [StreamOpenerDialer] for DNS over DTLS
+// (RFC 8094), using a pluggable [DTLSDialer], since the standard library does
+// not implement DTLS.
+//
+// Each [Stream] behaves like the ones of [*StreamOpenerDialerUDP], except that
+// queries and responses travel inside DTLS records, so the [*Transport]
+// hooks observe the raw messages as usual.
+//
+// Construct using [NewStreamOpenerDialerDTLS].
+type StreamOpenerDialerDTLS struct {
+	// Dialer is the underlying [DTLSDialer].
+	Dialer DTLSDialer
+}
+
+// NewStreamOpenerDialerDTLS creates a new [*StreamOpenerDialerDTLS].
+func NewStreamOpenerDialerDTLS(dialer DTLSDialer) *StreamOpenerDialerDTLS {
+	return &StreamOpenerDialerDTLS{Dialer: dialer}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerDTLS{}
+
+// NewDTLSStreamOpener creates a [StreamOpener] from an existing DTLS connection.
+//
+// This allows callers who already hold a DTLS connection to use
+// [*Transport.ExchangeWithStreamOpener] without dialing.
+func NewDTLSStreamOpener(conn net.Conn) StreamOpener {
+	return &udpStreamConn{conn: conn, params: QueryParamsDTLS()}
+}
+
+// DialContext implements [StreamOpenerDialer].
+//
+// We pass the context to the [DTLSDialer], which should use it to bound the
+// DTLS handshake, consistently with the other protocols.
+func (d *StreamOpenerDialerDTLS) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	conn, err := d.Dialer.DialContext(ctx, "udp", address.String())
+	if err != nil {
+		return nil, err
+	}
+	return &udpStreamConn{conn: conn, params: QueryParamsDTLS()}, nil
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamOpenerDialerDTLS(t *testing.T) {
+	t.Run("exchanges using the DTLS dialer", func(t *testing.T) {
+		// We do not have a DTLS implementation, so we use a dialer returning
+		// plain UDP sockets, which preserve message boundaries like DTLS.
+		srv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer srv.Close()
+		var network string
+		dialer := &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, nw, address string) (net.Conn, error) {
+				network = nw
+				return (&net.Dialer{}).DialContext(ctx, nw, address)
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerDTLS(dialer), netip.MustParseAddrPort(srv.Address()))
+		var rawQuery []byte
+		dt.ObserveRawQuery = func(data []byte) {
+			rawQuery = data
+		}
+
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"8.8.4.4", "8.8.8.8"}, addrs)
+		require.Equal(t, "udp", network)
+
+		// make sure we padded the query like for DNS over TLS
+		query := new(dns.Msg)
+		require.NoError(t, query.Unpack(rawQuery))
+		opt := query.IsEdns0()
+		require.NotNil(t, opt)
+		require.Equal(t, QueryMaxSizeDTLS, opt.UDPSize())
+		require.True(t, opt.Do())
+		require.Zero(t, len(rawQuery)%128)
+	})
+
+	t.Run("propagates dial errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerDTLS(dialer), netip.MustParseAddrPort("127.0.0.1:853"))
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	})
+}
+
+func TestDtlsStreamConnMutateQuery(t *testing.T) {
+	opener := NewDTLSStreamOpener(nil)
+	query := dnscodec.NewQuery("example.com", 1)
+
+	opener.MutateQuery(query)
+
+	require.Equal(t, QueryMaxSizeDTLS, query.MaxSize)
+	require.NotZero(t, query.Flags&dnscodec.QueryFlagBlockLengthPadding)
+	require.NotZero(t, query.Flags&dnscodec.QueryFlagDNSSec)
+}
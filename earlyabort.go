@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/miekg/dns"
+)
+
+// ErrEarlyAbort indicates that an [EarlyAbortFunc] stopped reading the response.
+var ErrEarlyAbort = errors.New("dnsoverstream: early abort")
+
+// EarlyAbortError is the error returned when an [EarlyAbortFunc] stops
+// reading the response, which carries the response [Header].
+//
+// Use [errors.As] to obtain it and [errors.Is] with [ErrEarlyAbort] to check it.
+type EarlyAbortError struct {
+	// Header is the response [Header].
+	Header Header
+}
+
+// Error implements error.
+func (e *EarlyAbortError) Error() string {
+	return fmt.Sprintf("%s (rcode %s)", ErrEarlyAbort, dns.RcodeToString[e.Header.Rcode])
+}
+
+// Unwrap returns [ErrEarlyAbort].
+func (e *EarlyAbortError) Unwrap() error {
+	return ErrEarlyAbort
+}
+
+// EarlyAbortFunc inspects the [Header] of a response as soon as we read it and
+// returns true to stop reading the rest of the response, which saves bandwidth
+// for scanners only needing, e.g., the RCODE or the answer count.
+type EarlyAbortFunc func(hdr Header) bool
+
+// earlyAbortKey is the context key for the [EarlyAbortFunc].
+type earlyAbortKey struct{}
+
+// WithEarlyAbort returns a copy of ctx carrying the given [EarlyAbortFunc].
+//
+// The exchanges using the returned context invoke the function with the header
+// of each response before reading the rest of the response. If the function
+// returns true, the exchange fails with an [*EarlyAbortError] and we do not
+// observe the raw response. When using DoQ, we also cancel reading the stream.
+//
+// Since the connection is left in an unknown state, we do not return it to the
+// [*Pool], and callers reusing connections should close them.
+func WithEarlyAbort(ctx context.Context, fx EarlyAbortFunc) context.Context {
+	return context.WithValue(ctx, earlyAbortKey{}, fx)
+}
+
+// streamReadEarlyAbort reads the response header into buf when ctx carries an
+// [EarlyAbortFunc] and returns the number of bytes read, or the
+// [*EarlyAbortError] when the function decides to stop reading.
+func streamReadEarlyAbort(ctx context.Context, r io.Reader, buf []byte) (int, error) {
+	fx, _ := ctx.Value(earlyAbortKey{}).(EarlyAbortFunc)
+	if fx == nil || len(buf) < HeaderSize {
+		return 0, nil
+	}
+	if _, err := io.ReadFull(r, buf[:HeaderSize]); err != nil {
+		return 0, err
+	}
+	hdr, _ := DecodeHeader(buf)
+	if fx(hdr) {
+		return 0, &EarlyAbortError{Header: hdr}
+	}
+	return HeaderSize, nil
+}
+
+// streamCancelReadOnEarlyAbort cancels reading the stream when
+// err is [ErrEarlyAbort] and the stream allows doing that.
+func streamCancelReadOnEarlyAbort(stream Stream, err error) {
+	if rc, ok := stream.(streamReadCanceler); ok && errors.Is(err, ErrEarlyAbort) {
+		rc.CancelRead(doqRequestCancelled)
+	}
+}
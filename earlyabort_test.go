@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithEarlyAbort(t *testing.T) {
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+	newTransport := func(observed *int) *Transport {
+		dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.MustParseAddrPort("127.0.0.1:53"))
+		dt.ObserveRawResponse = func([]byte) { *observed++ }
+		return dt
+	}
+
+	t.Run("stops reading when the function returns true", func(t *testing.T) {
+		var observed int
+		dt := newTransport(&observed)
+		ctx := WithEarlyAbort(context.Background(), func(hdr Header) bool {
+			return hdr.Rcode == dns.RcodeSuccess
+		})
+		resp, err := dt.Exchange(ctx, newQuery())
+		require.ErrorIs(t, err, ErrEarlyAbort)
+		require.Nil(t, resp)
+		var abortErr *EarlyAbortError
+		require.True(t, errors.As(err, &abortErr))
+		require.True(t, abortErr.Header.Response)
+		require.Equal(t, uint16(2), abortErr.Header.ANCount)
+		require.Equal(t, "dnsoverstream: early abort (rcode NOERROR)", err.Error())
+		require.Zero(t, observed)
+	})
+
+	t.Run("reads the whole response when the function returns false", func(t *testing.T) {
+		var observed int
+		dt := newTransport(&observed)
+		var calls int
+		ctx := WithEarlyAbort(context.Background(), func(hdr Header) bool {
+			calls++
+			return false
+		})
+		resp, err := dt.Exchange(ctx, newQuery())
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Len(t, addrs, 2)
+		require.Equal(t, 1, calls)
+		require.Equal(t, 1, observed)
+	})
+
+	t.Run("cancels reading the DoQ stream", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.AddrPort{})
+		opener, canceled := newXFRStreamOpener(t, 1, io.EOF)
+		ctx := WithEarlyAbort(context.Background(), func(Header) bool { return true })
+		_, err := dt.ExchangeWithStreamOpener(ctx, opener, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.ErrorIs(t, err, ErrEarlyAbort)
+		require.Equal(t, 1, *canceled)
+	})
+}
@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// endpointKey is the context key for the endpoint override.
+type endpointKey struct{}
+
+// WithEndpoint returns a copy of ctx overriding the endpoint used by a [*Transport].
+//
+// This allows a single [*Transport], along with its [*Pool], [*Limiter], and
+// other shared resources, to serve scans across many endpoints without
+// constructing a [*Transport] per endpoint. The override applies to Dial,
+// to Exchange and similar methods, to the [*Pool] keys, and to the
+// per-endpoint [*Limiter] slots.
+func WithEndpoint(ctx context.Context, endpoint netip.AddrPort) context.Context {
+	return context.WithValue(ctx, endpointKey{}, endpoint)
+}
+
+// EndpointFromContext returns the endpoint override carried by ctx, if any.
+func EndpointFromContext(ctx context.Context) (netip.AddrPort, bool) {
+	endpoint, ok := ctx.Value(endpointKey{}).(netip.AddrPort)
+	return endpoint, ok
+}
+
+// endpointFor returns the endpoint to use given the context.
+func (dt *Transport) endpointFor(ctx context.Context) netip.AddrPort {
+	if endpoint, ok := EndpointFromContext(ctx); ok {
+		return endpoint
+	}
+	return dt.endpoint
+}
+
+// Protocol names used by [ParseEndpoint], [ParseEndpointURL], and [PoolKey].
+const (
+	ProtocolUDP  = "udp"
+	ProtocolTCP  = "tcp"
+	ProtocolTLS  = "tls"
+	ProtocolQUIC = "quic"
+	ProtocolDTLS = "dtls"
+)
+
+// Default ports for each protocol (RFC 1035, RFC 7858, RFC 9250, and RFC 8094).
+const (
+	DefaultPortUDP  = 53
+	DefaultPortTCP  = 53
+	DefaultPortTLS  = 853
+	DefaultPortQUIC = 853
+	DefaultPortDTLS = 853
+)
+
+// DefaultPortTLS443 is the port some resolvers use to serve DNS over TLS
+// in addition to [DefaultPortTLS], to traverse networks blocking port 853
+// (see [NewTLSConfigDNSOverTLS443]).
+const DefaultPortTLS443 = 443
+
+// ErrInvalidEndpoint indicates that we cannot parse an endpoint.
+var ErrInvalidEndpoint = errors.New("dnsoverstream: invalid endpoint")
+
+// ErrUnknownProtocol indicates that a protocol is not one of [ProtocolUDP],
+// [ProtocolTCP], [ProtocolTLS], [ProtocolQUIC], and [ProtocolDTLS].
+var ErrUnknownProtocol = errors.New("dnsoverstream: unknown protocol")
+
+// DefaultPort returns the default port for the given protocol.
+//
+// This function returns [ErrUnknownProtocol] for unknown protocols.
+func DefaultPort(protocol string) (uint16, error) {
+	switch protocol {
+	case ProtocolUDP:
+		return DefaultPortUDP, nil
+	case ProtocolTCP:
+		return DefaultPortTCP, nil
+	case ProtocolTLS:
+		return DefaultPortTLS, nil
+	case ProtocolQUIC:
+		return DefaultPortQUIC, nil
+	case ProtocolDTLS:
+		return DefaultPortDTLS, nil
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownProtocol, protocol)
+	}
+}
+
+// ParseEndpoint parses an IP address with an optional port and returns
+// the endpoint, using the default port for the protocol if needed.
+//
+// Accepted formats include "8.8.8.8", "8.8.8.8:53", "2001:4860:4860::8888",
+// "[2001:4860:4860::8888]", "[2001:4860:4860::8888]:53", and "fe80::1%eth0".
+// Hostnames are not accepted, since resolving them is the caller's job.
+//
+// This function returns errors wrapping [ErrUnknownProtocol] or [ErrInvalidEndpoint].
+func ParseEndpoint(protocol, endpoint string) (netip.AddrPort, error) {
+	// 1. figure out the default port
+	port, err := DefaultPort(protocol)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// 2. try with an address without port, with or without brackets
+	host := endpoint
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr, port), nil
+	}
+
+	// 3. try with an address with port, rejecting the zero port
+	addrport, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q: expected an IP address with optional port", ErrInvalidEndpoint, endpoint)
+	}
+	if addrport.Port() == 0 {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q: port must not be zero", ErrInvalidEndpoint, endpoint)
+	}
+	return addrport, nil
+}
+
+// ParseEndpointURL parses a URL such as "tcp://8.8.8.8", "tls://8.8.8.8:853",
+// or "quic://[2a10:50c0::ad1:ff]" and returns the protocol and the endpoint,
+// using the default port for the protocol if the URL does not contain a port.
+//
+// The "dot" and "doq" schemes are aliases for [ProtocolTLS] and [ProtocolQUIC].
+//
+// This function returns errors wrapping [ErrUnknownProtocol] or [ErrInvalidEndpoint].
+func ParseEndpointURL(rawURL string) (string, netip.AddrPort, error) {
+	// 1. split the scheme from the rest of the URL
+	scheme, rest, found := strings.Cut(rawURL, "://")
+	if !found {
+		return "", netip.AddrPort{}, fmt.Errorf("%w: %q: missing scheme", ErrInvalidEndpoint, rawURL)
+	}
+
+	// 2. map the scheme to the protocol
+	protocol := strings.ToLower(scheme)
+	switch protocol {
+	case "dot":
+		protocol = ProtocolTLS
+	case "doq":
+		protocol = ProtocolQUIC
+	}
+
+	// 3. reject paths, queries, and fragments, which are meaningless here
+	rest = strings.TrimSuffix(rest, "/")
+	if strings.ContainsAny(rest, "/?#") {
+		return "", netip.AddrPort{}, fmt.Errorf("%w: %q: unexpected path, query, or fragment", ErrInvalidEndpoint, rawURL)
+	}
+
+	// 4. parse the endpoint
+	endpoint, err := ParseEndpoint(protocol, rest)
+	if err != nil {
+		return "", netip.AddrPort{}, err
+	}
+	return protocol, endpoint, nil
+}
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointFromContext(t *testing.T) {
+	t.Run("without override", func(t *testing.T) {
+		endpoint, ok := EndpointFromContext(context.Background())
+		require.False(t, ok)
+		require.False(t, endpoint.IsValid())
+	})
+
+	t.Run("with override", func(t *testing.T) {
+		expected := netip.MustParseAddrPort("10.0.0.1:53")
+		endpoint, ok := EndpointFromContext(WithEndpoint(context.Background(), expected))
+		require.True(t, ok)
+		require.Equal(t, expected, endpoint)
+	})
+}
+
+func TestTransportWithEndpoint(t *testing.T) {
+	var dialed []netip.AddrPort
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			dialed = append(dialed, address)
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	defaultEndpoint := netip.MustParseAddrPort("127.0.0.1:53")
+	dt := NewTransport(dialer, defaultEndpoint)
+	dt.Pool = NewPool(8)
+	dt.Limiter = NewLimiter(0, 1)
+
+	endpoints := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:53"),
+		netip.MustParseAddrPort("10.0.0.2:53"),
+	}
+	for _, endpoint := range endpoints {
+		ctx := WithEndpoint(context.Background(), endpoint)
+		_, err := dt.Exchange(ctx, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+	}
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+
+	// each endpoint uses its own pool entry, so we dial once per endpoint
+	require.Equal(t, append(endpoints, defaultEndpoint), dialed)
+	require.Equal(t, 3, dt.Pool.Stats().Idle)
+}
+
+func TestDefaultPort(t *testing.T) {
+	for protocol, expected := range map[string]uint16{
+		ProtocolUDP:  53,
+		ProtocolTCP:  53,
+		ProtocolTLS:  853,
+		ProtocolQUIC: 853,
+		ProtocolDTLS: 853,
+	} {
+		port, err := DefaultPort(protocol)
+		require.NoError(t, err)
+		require.Equal(t, expected, port)
+	}
+
+	_, err := DefaultPort("sctp")
+	require.ErrorIs(t, err, ErrUnknownProtocol)
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		input    string
+		expected string
+		err      error
+	}{
+		{"IPv4 without port over TCP", ProtocolTCP, "8.8.8.8", "8.8.8.8:53", nil},
+		{"IPv4 without port over TLS", ProtocolTLS, "8.8.8.8", "8.8.8.8:853", nil},
+		{"IPv4 without port over QUIC", ProtocolQUIC, "8.8.8.8", "8.8.8.8:853", nil},
+		{"IPv4 with port", ProtocolTLS, "8.8.8.8:443", "8.8.8.8:443", nil},
+		{"IPv6 without port", ProtocolTCP, "2001:4860:4860::8888", "[2001:4860:4860::8888]:53", nil},
+		{"IPv6 with brackets", ProtocolTLS, "[2001:4860:4860::8888]", "[2001:4860:4860::8888]:853", nil},
+		{"IPv6 with port", ProtocolTLS, "[2001:4860:4860::8888]:443", "[2001:4860:4860::8888]:443", nil},
+		{"IPv6 with zone", ProtocolTCP, "fe80::1%eth0", "[fe80::1%eth0]:53", nil},
+		{"hostname", ProtocolTCP, "dns.google", "", ErrInvalidEndpoint},
+		{"hostname with port", ProtocolTCP, "dns.google:53", "", ErrInvalidEndpoint},
+		{"zero port", ProtocolTCP, "8.8.8.8:0", "", ErrInvalidEndpoint},
+		{"empty", ProtocolTCP, "", "", ErrInvalidEndpoint},
+		{"IPv4 without port over UDP", ProtocolUDP, "8.8.8.8", "8.8.8.8:53", nil},
+		{"unknown protocol", "sctp", "8.8.8.8", "", ErrUnknownProtocol},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := ParseEndpoint(tt.protocol, tt.input)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				require.False(t, endpoint.IsValid())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, endpoint.String())
+		})
+	}
+}
+
+func TestParseEndpointURL(t *testing.T) {
+	tests := []struct {
+		name             string
+		input            string
+		expectedProtocol string
+		expectedEndpoint string
+		err              error
+	}{
+		{"udp", "udp://8.8.8.8", ProtocolUDP, "8.8.8.8:53", nil},
+		{"tcp", "tcp://8.8.8.8", ProtocolTCP, "8.8.8.8:53", nil},
+		{"tls", "tls://8.8.8.8", ProtocolTLS, "8.8.8.8:853", nil},
+		{"dot alias", "dot://8.8.8.8", ProtocolTLS, "8.8.8.8:853", nil},
+		{"quic", "quic://[2a10:50c0::ad1:ff]", ProtocolQUIC, "[2a10:50c0::ad1:ff]:853", nil},
+		{"doq alias with port", "DoQ://94.140.14.14:784", ProtocolQUIC, "94.140.14.14:784", nil},
+		{"trailing slash", "tls://8.8.8.8/", ProtocolTLS, "8.8.8.8:853", nil},
+		{"missing scheme", "8.8.8.8", "", "", ErrInvalidEndpoint},
+		{"unknown scheme", "https://8.8.8.8", "", "", ErrUnknownProtocol},
+		{"with path", "tls://8.8.8.8/dns-query", "", "", ErrInvalidEndpoint},
+		{"with hostname", "tls://dns.google", "", "", ErrInvalidEndpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocol, endpoint, err := ParseEndpointURL(tt.input)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				require.Empty(t, protocol)
+				require.False(t, endpoint.IsValid())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedProtocol, protocol)
+			require.Equal(t, tt.expectedEndpoint, endpoint.String())
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import "time"
+
+// EvictionReason is the reason why a [*Pool] closed a connection instead of
+// keeping it idle or reusing it, which [*Pool] ObserveEviction receives.
+type EvictionReason int
+
+const (
+	// EvictionCapacity means that the pool exceeded MaxIdle or MaxIdlePerKey
+	// and we closed the least recently used idle connection.
+	EvictionCapacity EvictionReason = iota
+
+	// EvictionIdleTimeout means that the connection was idle for longer than
+	// the [*Pool] IdleTimeout or the [PrewarmConfig] MaxIdleAge.
+	EvictionIdleTimeout
+
+	// EvictionMaxLifetime means that we dialed the connection longer than
+	// the [*Pool] MaxLifetime ago.
+	EvictionMaxLifetime
+
+	// EvictionKeepalive means that the connection was idle for longer than
+	// the timeout the server advertised using edns-tcp-keepalive (see
+	// [*Transport] TCPKeepalive).
+	EvictionKeepalive
+
+	// EvictionClosing means that the server signalled it is closing the
+	// connection (see [StreamOpenerClosing]) or advertised a zero
+	// edns-tcp-keepalive timeout.
+	EvictionClosing
+
+	// EvictionPoolClosed means that the [*Pool] is closed.
+	EvictionPoolClosed
+)
+
+// String implements [fmt.Stringer].
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionIdleTimeout:
+		return "idle_timeout"
+	case EvictionMaxLifetime:
+		return "max_lifetime"
+	case EvictionKeepalive:
+		return "keepalive"
+	case EvictionClosing:
+		return "closing"
+	case EvictionPoolClosed:
+		return "pool_closed"
+	default:
+		return "unknown"
+	}
+}
+
+// poolEviction is a connection the [*Pool] closes along with the reason.
+type poolEviction struct {
+	key    PoolKey
+	conn   StreamOpener
+	reason EvictionReason
+}
+
+// expiredLocked returns whether the idle entry expired at now and why.
+//
+// The caller MUST hold the mutex.
+func (p *Pool) expiredLocked(entry *poolEntry, now time.Time) (EvictionReason, bool) {
+	if p.IdleTimeout > 0 && now.Sub(entry.since) >= p.IdleTimeout {
+		return EvictionIdleTimeout, true
+	}
+	if p.MaxLifetime > 0 && now.Sub(entry.stats.created) >= p.MaxLifetime {
+		return EvictionMaxLifetime, true
+	}
+	if timeout, found := entry.stats.keepalive(); found && now.Sub(entry.since) >= timeout {
+		return EvictionKeepalive, true
+	}
+	return 0, false
+}
+
+// sweepLocked removes the idle connections that expired at now, counting
+// them as Expired, and returns them, so the caller can evict them.
+//
+// The caller MUST hold the mutex.
+func (p *Pool) sweepLocked(now time.Time) (evicted []poolEviction) {
+	for elem := p.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*poolEntry)
+		if reason, found := p.expiredLocked(entry, now); found {
+			p.removeLocked(elem)
+			p.stats.Expired++
+			evicted = append(evicted, poolEviction{key: entry.key, conn: entry.conn, reason: reason})
+		}
+		elem = prev
+	}
+	return
+}
+
+// evict closes the given connections in the background, since closing may
+// block, and calls ObserveEviction for each of them.
+//
+// The caller MUST NOT hold the mutex.
+func (p *Pool) evict(evicted []poolEviction) {
+	for _, ev := range evicted {
+		go closeWithTimeout(ev.conn, p.CloseTimeout)
+		if p.ObserveEviction != nil {
+			p.ObserveEviction(ev.key, ev.reason)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// collectEvictions sets the pool ObserveEviction hook and returns a function
+// returning the reasons observed so far, without synchronization, since the
+// hook runs in the goroutine calling the pool methods.
+func collectEvictions(pool *Pool) func() []EvictionReason {
+	var reasons []EvictionReason
+	pool.ObserveEviction = func(key PoolKey, reason EvictionReason) {
+		reasons = append(reasons, reason)
+	}
+	return func() []EvictionReason {
+		return reasons
+	}
+}
+
+// newFakeClock sets the pool TimeNow to a fake clock and returns a function
+// advancing it, without synchronization, like [collectEvictions].
+func newFakeClock(pool *Pool) func(time.Duration) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	pool.TimeNow = func() time.Time {
+		return now
+	}
+	return func(delta time.Duration) {
+		now = now.Add(delta)
+	}
+}
+
+func TestPoolEviction(t *testing.T) {
+	key := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+
+	t.Run("closes connections idle for longer than IdleTimeout", func(t *testing.T) {
+		pool := NewPool(0)
+		pool.IdleTimeout = time.Minute
+		advance := newFakeClock(pool)
+		reasons := collectEvictions(pool)
+		conn := &closeCountingOpener{}
+		pool.Put(key, conn)
+
+		advance(59 * time.Second)
+		require.Equal(t, 1, pool.count(key))
+		advance(time.Second)
+		_, found := pool.Get(key)
+		require.False(t, found)
+		requireEventuallyClosed(t, conn)
+		require.Equal(t, []EvictionReason{EvictionIdleTimeout}, reasons())
+		require.Equal(t, uint64(1), pool.Stats().Expired)
+	})
+
+	t.Run("sweeps the expired connections of other keys", func(t *testing.T) {
+		pool := NewPool(0)
+		pool.IdleTimeout = time.Minute
+		advance := newFakeClock(pool)
+		reasons := collectEvictions(pool)
+		other := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.2:53")}
+		conn := &closeCountingOpener{}
+		pool.Put(other, conn)
+
+		advance(time.Minute)
+		pool.Put(key, &closeCountingOpener{})
+		requireEventuallyClosed(t, conn)
+		require.Equal(t, []EvictionReason{EvictionIdleTimeout}, reasons())
+		require.Equal(t, 1, pool.Stats().Idle)
+	})
+
+	t.Run("closes idle connections older than MaxLifetime", func(t *testing.T) {
+		pool := NewPool(0)
+		pool.MaxLifetime = time.Hour
+		advance := newFakeClock(pool)
+		reasons := collectEvictions(pool)
+		conn := &closeCountingOpener{}
+		pool.Put(key, conn)
+
+		// reusing the connection does not extend its lifetime
+		advance(30 * time.Minute)
+		reused, stats, found := pool.get(key)
+		require.True(t, found)
+		pool.put(key, reused, stats)
+		advance(30 * time.Minute)
+		_, found = pool.Get(key)
+		require.False(t, found)
+		requireEventuallyClosed(t, conn)
+		require.Equal(t, []EvictionReason{EvictionMaxLifetime}, reasons())
+	})
+
+	t.Run("does not pool connections older than MaxLifetime", func(t *testing.T) {
+		pool := NewPool(0)
+		pool.MaxLifetime = time.Minute
+		advance := newFakeClock(pool)
+		reasons := collectEvictions(pool)
+		conn := &closeCountingOpener{}
+		stats := newConnStats(key, pool.now())
+		advance(time.Hour)
+		pool.put(key, conn, stats)
+
+		requireEventuallyClosed(t, conn)
+		require.Equal(t, []EvictionReason{EvictionMaxLifetime}, reasons())
+		poolStats := pool.Stats()
+		require.Equal(t, uint64(1), poolStats.Expired)
+		require.Zero(t, poolStats.Puts)
+	})
+
+	t.Run("reports capacity and pool closed evictions", func(t *testing.T) {
+		pool := NewPool(1)
+		reasons := collectEvictions(pool)
+		conn1, conn2, conn3 := &closeCountingOpener{}, &closeCountingOpener{}, &closeCountingOpener{}
+		pool.Put(key, conn1)
+		pool.Put(key, conn2)
+		requireEventuallyClosed(t, conn1)
+
+		require.NoError(t, pool.Close())
+		require.Equal(t, int64(1), conn2.closed.Load())
+		pool.Put(key, conn3)
+		requireEventuallyClosed(t, conn3)
+		require.Equal(t, []EvictionReason{EvictionCapacity, EvictionPoolClosed, EvictionPoolClosed}, reasons())
+	})
+
+	t.Run("reports connections the server is closing", func(t *testing.T) {
+		pool := NewPool(0)
+		reasons := collectEvictions(pool)
+		conn := &closingTestOpener{}
+		conn.closing.Store(true)
+		pool.Put(key, conn)
+		require.Equal(t, []EvictionReason{EvictionClosing}, reasons())
+	})
+}
+
+func TestEvictionReasonString(t *testing.T) {
+	cases := map[EvictionReason]string{
+		EvictionCapacity:    "capacity",
+		EvictionIdleTimeout: "idle_timeout",
+		EvictionMaxLifetime: "max_lifetime",
+		EvictionKeepalive:   "keepalive",
+		EvictionClosing:     "closing",
+		EvictionPoolClosed:  "pool_closed",
+		EvictionReason(-1):  "unknown",
+	}
+	for reason, expect := range cases {
+		require.Equal(t, expect, reason.String())
+	}
+}
@@ -105,3 +105,48 @@ func Example_withLocalTLSServer() {
 	// Output:
 	// [8.8.4.4 8.8.8.8]
 }
+
+func Example_withUserspaceNetworkStack() {
+	// 1. Create PKI and DNS server for testing
+	//
+	// See https://github.com/bassosimone/pkitest and https://github.com/bassosimone/dnstest
+	pki := pkitest.MustNewPKI("testdata")
+	cert := pki.MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "example.com",
+		DNSNames:     []string{"example.com"},
+		IPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Organization: []string{"Example"},
+	})
+	dnsConfig := dnstest.NewHandlerConfig()
+	dnsConfig.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	dnsHandler := dnstest.NewHandler(dnsConfig)
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", cert, dnsHandler)
+	defer srv.Close()
+
+	// 2. Obtain the dialer of the userspace network stack
+	//
+	// With wireguard-go, this would be the *netstack.Net returned by
+	// netstack.CreateNetTUN, whose DialContext method implements NetDialer.
+	var netDialer dnsoverstream.NetDialer = &net.Dialer{}
+
+	// 3. Create the DNS transport using the NetTLSDialer, since the
+	// *tls.Dialer only accepts a *net.Dialer (for QUIC, pass the
+	// net.PacketConn of the userspace stack to NewQUICDialer)
+	endpoint := runtimex.PanicOnError1(netip.ParseAddrPort(srv.Address()))
+	tlsConfig := &tls.Config{
+		RootCAs:    pki.CertPool(),
+		ServerName: "example.com",
+	}
+	tlsDialer := dnsoverstream.NewNetTLSDialer(netDialer, tlsConfig)
+	dt := dnsoverstream.NewTransport(dnsoverstream.NewStreamOpenerDialerTLS(tlsDialer), endpoint)
+
+	// 4. Exchange with the server
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	resp := runtimex.PanicOnError1(dt.Exchange(context.Background(), query))
+
+	// 5. Print the A records
+	fmt.Printf("%+v\n", runtimex.PanicOnError1(resp.RecordsA()))
+
+	// Output:
+	// [8.8.8.8]
+}
@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"iter"
+	"math"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqRequestCancelled is the DOQ_REQUEST_CANCELLED error code (RFC 9250 Section 4.3).
+const doqRequestCancelled = 0x3
+
+// streamReadCanceler is implemented by [Stream] types that allow the
+// client to stop receiving data (e.g., [*quic.Stream]).
+type streamReadCanceler interface {
+	CancelRead(code quic.StreamErrorCode)
+}
+
+// ExchangeStream is like [*Transport.ExchangeStreamWithStreamOpener] but
+// dials a new connection, which is closed when the iteration ends.
+//
+// This method honours the [*Limiter] but does not use the [*Pool], since
+// the connection may be left in an unknown state by early termination. It
+// refuses downgrades according to the [*Policy] but does not record facts.
+func (dt *Transport) ExchangeStream(ctx context.Context, query *dnscodec.Query) iter.Seq2[*dns.Msg, error] {
+	return func(yield func(*dns.Msg, error) bool) {
+		ctx, dt := sampleExchange(ctx, dt)
+
+		// 1. honour the concurrency limits when configured.
+		if dt.Limiter != nil {
+			release, queued, err := dt.Limiter.Acquire(ctx, dt.endpointFor(ctx))
+			if dt.ObserveQueueTime != nil {
+				dt.ObserveQueueTime(queued)
+			}
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			defer release()
+		}
+
+		// 2. refuse downgrades when configured.
+		if err := dt.policyCheck(dt.endpointFor(ctx)); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		// 3. create the connection
+		conn, err := dt.Dial(ctx)
+		if err != nil {
+			yield(nil, wrapContextError(ctx, err))
+			return
+		}
+		defer closeWithTimeout(conn, dt.CloseTimeout)
+
+		// 4. close the connection if the context is done during the iteration
+		stop := context.AfterFunc(ctx, func() {
+			conn.Close()
+		})
+		defer stop()
+
+		// 5. defer to the stream opener iterator.
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(withBorrowedStreamOpener(ctx), conn, query) {
+			if !yield(msg, err) {
+				return
+			}
+		}
+	}
+}
+
+// ExchangeStreamWithStreamOpener sends a [*dnscodec.Query] and returns an
+// iterator over the response messages received on the same [Stream].
+//
+// This method is useful for zone transfers (AXFR and IXFR), where the server
+// sends several messages in response to a single query.
+//
+// For DoQ, per RFC 9250 Section 4.3, the server sends all the messages on the
+// same stream and then closes it using the STREAM FIN mechanism, which ends the
+// iteration. For TCP and TLS, the connection stays open after the last message,
+// so the caller MUST stop iterating after recognizing the last message (e.g.,
+// the final SOA record of an AXFR), otherwise the iteration blocks until the
+// context is done or the server closes the connection. Use
+// [*Transport.ExchangeXFRWithStreamOpener] to detect the last message.
+//
+// Each message is unpacked and validated as a response to the query, but we
+// do not map the RCODE to errors nor extract the valid answers. Messages may be
+// up to 65535 bytes (RFC 5936 Section 2.2). The iteration stops after the first
+// error. When the caller stops iterating early using DoQ, we cancel reading
+// the stream using the DOQ_REQUEST_CANCELLED error code. We do not close conn
+// unless ctx transfers its ownership using [WithStreamOpenerOwnership].
+func (dt *Transport) ExchangeStreamWithStreamOpener(ctx context.Context,
+	conn StreamOpener, query *dnscodec.Query) iter.Seq2[*dns.Msg, error] {
+	return func(yield func(*dns.Msg, error) bool) {
+		ctx, dt := sampleExchange(ctx, dt)
+
+		// 1. Open the stream for sending the query, closing
+		// the connection when done if we own it.
+		ctx, cancel := takeStreamOpenerOwnership(ctx, dt, conn)
+		defer cancel()
+		stream, err := conn.OpenStream()
+		if err != nil {
+			yield(nil, wrapContextError(ctx, err))
+			return
+		}
+		defer stream.Close()
+
+		// 2. Use the context deadline to limit the stream lifetime.
+		if streamSetDeadline(ctx, dt, stream) {
+			defer stream.SetDeadline(time.Time{})
+		}
+
+		// 3. Mutate, serialize, and send the query.
+		packBuf := getStreamBuffer(streamBufferSize)
+		defer putStreamBuffer(packBuf)
+		query, queryMsg, rawQuery, err := streamPackQuery(dt, conn, query, *packBuf)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if _, err := streamSendRawQuery(ctx, dt, conn, stream, rawQuery, query.MaxSize); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		// 4. Read and yield messages until the stream ends.
+		br := getStreamReader(dt, stream)
+		defer putStreamReader(br)
+		for count := 0; ; count++ {
+			streamSetReadDeadline(ctx, dt, stream)
+			msg, err := streamReadMsg(ctx, dt, br, queryMsg)
+			switch {
+			case err == io.EOF && count > 0:
+				return // DoQ STREAM FIN after the last message
+
+			case err == io.EOF:
+				yield(nil, io.ErrUnexpectedEOF)
+				return
+
+			case err != nil:
+				streamCancelReadOnEarlyAbort(stream, err)
+				yield(nil, err)
+				return
+
+			case !yield(msg, nil):
+				if rc, ok := stream.(streamReadCanceler); ok {
+					rc.CancelRead(doqRequestCancelled)
+				}
+				return
+			}
+		}
+	}
+}
+
+// streamReadMsg reads, unpacks, and validates a single message of a
+// multi-message response. It returns [io.EOF] if the stream ended cleanly
+// before the message, which happens after the last message using DoQ.
+func streamReadMsg(ctx context.Context, dt *Transport, br *bufio.Reader, queryMsg *dns.Msg) (*dns.Msg, error) {
+	// 1. distinguish a clean end of stream from a truncated message
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	// 2. read the raw message
+	frame, err := streamReadFrame(ctx, dt, br, math.MaxUint16)
+	if err != nil {
+		return nil, err
+	}
+	defer frame.done()
+
+	// 3. unpack and validate the message, noting that messages after the
+	// first one may omit the question section (RFC 5936 Section 2.2).
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(frame.bytes()); err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	if len(respMsg.Question) <= 0 {
+		if !respMsg.Response || respMsg.Id != queryMsg.Id {
+			return nil, dnscodec.ErrInvalidResponse
+		}
+		return respMsg, nil
+	}
+	if _, err := dnscodec.ValidateResponseForQuery(queryMsg, respMsg); err != nil {
+		return nil, err
+	}
+	return respMsg, nil
+}
@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// newXFRTestMessages returns count responses to query emulating a zone transfer
+// where only the first message contains the question section.
+func newXFRTestMessages(query *dns.Msg, count int) []*dns.Msg {
+	var msgs []*dns.Msg
+	for idx := range count {
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		if idx > 0 {
+			resp.Question = nil
+		}
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   query.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    1,
+			},
+			A: net.IPv4(10, 0, 0, byte(idx+1)),
+		}}
+		msgs = append(msgs, resp)
+	}
+	return msgs
+}
+
+// newXFRStreamOpener returns a [*FuncStreamOpener] whose stream replies to the
+// query using the given messages and then returns the given error when reading.
+func newXFRStreamOpener(t *testing.T, count int, finalErr error) (*FuncStreamOpener, *int) {
+	canceled := new(int)
+	stream := &xfrStreamStub{FuncStream: &FuncStream{}, canceled: canceled}
+	stream.WriteFunc = func(p []byte) (int, error) {
+		query := &dns.Msg{}
+		require.NoError(t, query.Unpack(p[2:]))
+		var buf bytes.Buffer
+		for _, msg := range newXFRTestMessages(query, count) {
+			raw, err := msg.Pack()
+			require.NoError(t, err)
+			buf.Write(appendStreamMsgFrame(nil, raw))
+		}
+		reader := &errorAfterReader{r: bytes.NewReader(buf.Bytes()), err: finalErr}
+		stream.ReadFunc = reader.Read
+		return len(p), nil
+	}
+	opener := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) { return stream, nil },
+	}
+	return opener, canceled
+}
+
+// xfrStreamStub is a [*FuncStream] that records calls to CancelRead.
+type xfrStreamStub struct {
+	*FuncStream
+	canceled *int
+}
+
+// CancelRead implements [streamReadCanceler].
+func (s *xfrStreamStub) CancelRead(code quic.StreamErrorCode) {
+	if code == doqRequestCancelled {
+		*s.canceled++
+	}
+}
+
+func TestTransportExchangeStreamWithStreamOpener(t *testing.T) {
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+
+	t.Run("returns all messages until EOF", func(t *testing.T) {
+		opener, canceled := newXFRStreamOpener(t, 3, io.EOF)
+		var addrs []string
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			require.NoError(t, err)
+			addrs = append(addrs, msg.Answer[0].(*dns.A).A.String())
+		}
+		require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, addrs)
+		require.Zero(t, *canceled)
+	})
+
+	t.Run("cancels reading when the caller stops early", func(t *testing.T) {
+		opener, canceled := newXFRStreamOpener(t, 3, io.EOF)
+		count := 0
+		for _, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			require.NoError(t, err)
+			count++
+			break
+		}
+		require.Equal(t, 1, count)
+		require.Equal(t, 1, *canceled)
+	})
+
+	t.Run("returns io.ErrUnexpectedEOF for an empty stream", func(t *testing.T) {
+		opener, _ := newXFRStreamOpener(t, 0, io.EOF)
+		var errs []error
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			require.Nil(t, msg)
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 1)
+		require.ErrorIs(t, errs[0], io.ErrUnexpectedEOF)
+	})
+
+	t.Run("returns read errors after the messages", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		opener, _ := newXFRStreamOpener(t, 2, expected)
+		var count int
+		var lastErr error
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			require.NotNil(t, msg)
+			count++
+		}
+		require.Equal(t, 2, count)
+		require.ErrorIs(t, lastErr, expected)
+	})
+
+	t.Run("rejects messages with the wrong ID", func(t *testing.T) {
+		stream := &FuncStream{}
+		stream.WriteFunc = func(p []byte) (int, error) {
+			query := &dns.Msg{}
+			require.NoError(t, query.Unpack(p[2:]))
+			resp := newXFRTestMessages(query, 2)[1]
+			resp.Id++
+			raw, err := resp.Pack()
+			require.NoError(t, err)
+			stream.ReadFunc = bytes.NewReader(appendStreamMsgFrame(nil, raw)).Read
+			return len(p), nil
+		}
+		opener := &FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) { return stream, nil },
+		}
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			require.Nil(t, msg)
+			require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+		}
+	})
+
+	t.Run("returns OpenStream errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		opener := &FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) { return nil, expected },
+		}
+		for msg, err := range dt.ExchangeStreamWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeA)) {
+			require.Nil(t, msg)
+			require.ErrorIs(t, err, expected)
+		}
+	})
+}
+
+func TestTransportExchangeStreamQUIC(t *testing.T) {
+	srv := newDoQTestServerMulti(t, func(query *dns.Msg) []*dns.Msg {
+		return newXFRTestMessages(query, 3)
+	})
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pconn.Close() })
+	qd := NewQUICDialer(pconn, "example.com")
+	qd.TLSConfig = newTestClientTLSConfig("doq")
+	dt := NewTransport(NewStreamOpenerDialerQUIC(qd), srv.Endpoint())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var addrs []string
+	for msg, err := range dt.ExchangeStream(ctx, dnscodec.NewQuery("example.com", dns.TypeAXFR)) {
+		require.NoError(t, err)
+		addrs = append(addrs, msg.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, addrs)
+}
+
+func TestTransportExchangeStreamDialError(t *testing.T) {
+	expected := errors.New("mocked error")
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, endpoint netip.AddrPort) (StreamOpener, error) {
+			return nil, expected
+		},
+	}
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	for msg, err := range dt.ExchangeStream(context.Background(), dnscodec.NewQuery("example.com", dns.TypeAXFR)) {
+		require.Nil(t, msg)
+		require.ErrorIs(t, err, expected)
+	}
+}
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import "sync"
+
+// Executor runs functions concurrently with the caller on behalf of the
+// features performing several operations at once, which allows embedding this
+// package in frameworks with their own worker pools, rather than spawning
+// goroutines internally.
+//
+// We use the [*Transport] Executor for the attempts of [*HappyEyeballs] and
+// [*Hedge] and for the exchanges of [*Transport.ExchangeConcurrentWithStreamOpener]
+// and [*Verifier]. Closing connections in the background and reading the
+// responses of a [*PipelinedTransport] still use internal goroutines.
+//
+// Implementations MUST eventually run each function. They MAY queue functions
+// when all workers are busy, but then the queued operations start late and
+// their time budget shrinks. Running the function synchronously is also
+// possible, but serializes the operations (e.g., a [*Hedge] attempt must
+// complete before starting the next one).
+type Executor interface {
+	// Go runs fn.
+	Go(fn func())
+}
+
+// ExecutorFunc adapts a function to the [Executor] interface.
+type ExecutorFunc func(fn func())
+
+var _ Executor = ExecutorFunc(nil)
+
+// Go implements [Executor].
+func (f ExecutorFunc) Go(fn func()) {
+	f(fn)
+}
+
+// execute runs fn using the Executor or, if nil, a new goroutine.
+func (dt *Transport) execute(fn func()) {
+	if dt.Executor != nil {
+		dt.Executor.Go(fn)
+		return
+	}
+	go fn()
+}
+
+// executeGroup is like [*Transport.execute] but also tracks fn using wg.
+func (dt *Transport) executeGroup(wg *sync.WaitGroup, fn func()) {
+	wg.Add(1)
+	dt.execute(func() {
+		defer wg.Done()
+		fn()
+	})
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingExecutor returns an [Executor] spawning goroutines and the
+// counter of the functions it ran.
+func newCountingExecutor() (Executor, *atomic.Int64) {
+	var count atomic.Int64
+	return ExecutorFunc(func(fn func()) {
+		count.Add(1)
+		go fn()
+	}), &count
+}
+
+func TestTransportExecutor(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("runs the happy eyeballs attempts", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: happyEyeballsTestHang,
+			happyEyeballsTestV4: hedgeTestAnswer,
+		})
+		executor, count := newCountingExecutor()
+		dt.Executor = executor
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		he.AttemptDelay = time.Millisecond
+		conn, _, err := he.Dial(context.Background())
+		require.NoError(t, err)
+		conn.Close()
+		require.Equal(t, int64(2), count.Load())
+	})
+
+	t.Run("runs the hedge attempts synchronously", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			hedgeTestFirst:  func(ctx context.Context) (StreamOpener, error) { return nil, errors.New("connection refused") },
+			hedgeTestSecond: hedgeTestAnswer,
+		})
+		var count int
+		dt.Executor = ExecutorFunc(func(fn func()) {
+			count++
+			fn()
+		})
+		_, attempts, err := NewHedge(dt, hedgeTestFirst, hedgeTestSecond).Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+		require.Equal(t, HedgeFailed, attempts[0].Outcome)
+		require.Equal(t, HedgeWon, attempts[1].Outcome)
+	})
+
+	t.Run("runs the verifier exchanges", func(t *testing.T) {
+		newTransport := func() *Transport {
+			return newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+				happyEyeballsTestV4: hedgeTestAnswer,
+			})
+		}
+		first, second := newTransport(), newTransport()
+		executor, count := newCountingExecutor()
+		first.Executor = executor
+		_, result, err := NewVerifier(first, second).Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.True(t, result.Consistent)
+		require.Equal(t, int64(2), count.Load())
+	})
+}
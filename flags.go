@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ResponseFlags bundles the response header flags and the response code,
+// so that measurement pipelines can aggregate on them without re-parsing.
+//
+// Construct using [NewResponseFlags] or [DecodeResponseFlags].
+type ResponseFlags struct {
+	// Authoritative is the AA bit.
+	Authoritative bool
+
+	// Truncated is the TC bit.
+	Truncated bool
+
+	// RecursionAvailable is the RA bit.
+	RecursionAvailable bool
+
+	// AuthenticatedData is the AD bit.
+	AuthenticatedData bool
+
+	// CheckingDisabled is the CD bit.
+	CheckingDisabled bool
+
+	// Rcode is the response code, including the EDNS(0) extended
+	// response code bits when the response contains an OPT record.
+	Rcode int
+}
+
+// NewResponseFlags returns the [ResponseFlags] of the given response.
+func NewResponseFlags(resp *dns.Msg) ResponseFlags {
+	return ResponseFlags{
+		Authoritative:      resp.Authoritative,
+		Truncated:          resp.Truncated,
+		RecursionAvailable: resp.RecursionAvailable,
+		AuthenticatedData:  resp.AuthenticatedData,
+		CheckingDisabled:   resp.CheckingDisabled,
+		Rcode:              resp.Rcode,
+	}
+}
+
+// DecodeResponseFlags unpacks the raw response and returns its [ResponseFlags].
+//
+// Unlike [DecodeHeader], we unpack the whole response to obtain the extended
+// response code. This function returns [dnscodec.ErrServerMisbehaving] if the
+// response cannot be unpacked.
+func DecodeResponseFlags(rawResp []byte) (ResponseFlags, error) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return ResponseFlags{}, dnscodec.ErrServerMisbehaving
+	}
+	return NewResponseFlags(resp), nil
+}
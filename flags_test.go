@@ -0,0 +1,42 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeResponseFlags(t *testing.T) {
+	t.Run("decodes the flags and the extended rcode", func(t *testing.T) {
+		resp := new(dns.Msg)
+		resp.SetQuestion("dns.google.", dns.TypeA)
+		resp.Response = true
+		resp.Authoritative = true
+		resp.RecursionAvailable = true
+		resp.AuthenticatedData = true
+		resp.CheckingDisabled = true
+		resp.Rcode = dns.RcodeBadVers
+		resp.SetEdns0(1232, false)
+		raw, err := resp.Pack()
+		require.NoError(t, err)
+
+		flags, err := DecodeResponseFlags(raw)
+		require.NoError(t, err)
+		require.Equal(t, ResponseFlags{
+			Authoritative:      true,
+			RecursionAvailable: true,
+			AuthenticatedData:  true,
+			CheckingDisabled:   true,
+			Rcode:              dns.RcodeBadVers,
+		}, flags)
+	})
+
+	t.Run("fails for invalid responses", func(t *testing.T) {
+		_, err := DecodeResponseFlags([]byte{0x00})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
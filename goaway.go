@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// closingNotifier is implemented by [StreamOpener] types that know
+// whether the server signalled that it is closing the connection.
+type closingNotifier interface {
+	Closing() bool
+}
+
+// StreamOpenerClosing returns whether the server signalled that it is closing
+// the connection, in which case we should not use the connection for new
+// exchanges, while the exchanges in progress may still complete.
+//
+// We detect the equivalents of the HTTP/2 GOAWAY frame for each protocol:
+//
+//   - DNS over HTTPS using HTTP/2 detects the GOAWAY frame;
+//
+//   - DNS over QUIC and HTTP/3 detect the QUIC CONNECTION_CLOSE frame
+//     and any other event that closed the connection (e.g., idle timeout);
+//
+//   - DNS over TCP, TLS, and HTTPS using HTTP/1.1 detect the TCP FIN or RST
+//     received while the connection is idle, as well as any data received
+//     while idle, such as the TLS close_notify alert, which we can only observe
+//     on Linux and macOS, by peeking at the socket without consuming data.
+//
+// Because the server should not send data over an idle connection, call this
+// function only when no exchange is using conn. We tolerate the TLS 1.3
+// post-handshake messages (e.g., session tickets), which we consume.
+//
+// Other [StreamOpener] types return false unless they implement a Closing
+// method returning bool. The [*Pool] and the [*PersistentTransport] use this
+// function to stop assigning exchanges to closing connections.
+func StreamOpenerClosing(conn StreamOpener) bool {
+	if cn, ok := conn.(closingNotifier); ok {
+		return cn.Closing()
+	}
+	return false
+}
+
+// Closing returns whether the server closed the TCP connection.
+func (s *tcpStreamConn) Closing() bool {
+	return netConnPeerClosed(s.conn)
+}
+
+// Closing returns whether the server closed the TCP connection.
+func (s *tlsStreamConn) Closing() bool {
+	return netConnPeerClosed(s.conn)
+}
+
+// Closing returns whether the server sent GOAWAY or closed the TCP connection.
+func (c *httpsConn) Closing() bool {
+	if cc, ok := c.cc.(*http2.ClientConn); ok {
+		state := cc.State()
+		return state.Closing || state.Closed
+	}
+	return netConnPeerClosed(c.conn)
+}
+
+// Closing returns whether the QUIC connection is closed.
+func (q *quicConnAdapter) Closing() bool {
+	return q.qconn.Context().Err() != nil
+}
+
+// Closing returns whether the QUIC connection is closed.
+func (c *http3Conn) Closing() bool {
+	return c.qconn.Context().Err() != nil
+}
+
+// socketState is the state of an idle connection returned by [socketPeek].
+type socketState int
+
+const (
+	// socketIdle means that we did not receive anything.
+	socketIdle = socketState(iota)
+
+	// socketPending means that we received data.
+	socketPending
+
+	// socketClosed means that we received FIN or RST.
+	socketClosed
+)
+
+// tlsPendingReadTimeout is the timeout for processing the TLS records
+// pending on an idle connection, which we already received.
+const tlsPendingReadTimeout = 10 * time.Millisecond
+
+// netConnPeerClosed returns whether the peer is closing the idle TCP
+// connection underlying conn, which may be a [*tls.Conn].
+func netConnPeerClosed(conn net.Conn) bool {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return socketPeek(conn) != socketIdle
+	}
+	switch socketPeek(tc.NetConn()) {
+	case socketIdle:
+		return false
+	case socketPending:
+		return tlsPeerClosing(tc)
+	default:
+		return true
+	}
+}
+
+// tlsPeerClosing reads the TLS records pending on the idle connection and
+// returns whether the peer is closing it. Because TLS 1.3 encrypts the record
+// types, we must read to distinguish the close_notify alert, which causes the
+// read to fail with [io.EOF], from the post-handshake messages (e.g., session
+// tickets), which [*tls.Conn] consumes. Reading application data also means
+// closing, since we cannot use the connection after consuming it.
+func tlsPeerClosing(tc *tls.Conn) bool {
+	if err := tc.SetReadDeadline(time.Now().Add(tlsPendingReadTimeout)); err != nil {
+		return true
+	}
+	defer tc.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1)
+	count, err := tc.Read(buf)
+	if count > 0 {
+		return true
+	}
+	var netErr net.Error
+	return !errors.As(err, &netErr) || !netErr.Timeout()
+}
@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !linux && !darwin
+
+package dnsoverstream
+
+import "net"
+
+// socketPeek returns [socketIdle], since we cannot peek at the socket.
+//
+// Therefore, on systems other than Linux and macOS (e.g., Windows and the
+// BSDs), [StreamOpenerClosing] is a no-op for DNS over TCP, TLS, and HTTPS
+// using HTTP/1.1, and we only notice that the server closed an idle connection
+// when the next exchange using it fails.
+func socketPeek(conn net.Conn) socketState {
+	return socketIdle
+}
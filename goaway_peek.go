@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build linux || darwin
+
+package dnsoverstream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketPeek returns the [socketState] of the idle connection by peeking at
+// the socket without blocking, where reading zero bytes means we received FIN,
+// failing with ECONNRESET means we received RST, and reading one byte means
+// that the peer sent data. No data at all means the connection is still open.
+func socketPeek(conn net.Conn) socketState {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return socketIdle
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return socketIdle
+	}
+	state := socketIdle
+	buf := make([]byte, 1)
+	err = rawConn.Read(func(fd uintptr) bool {
+		count, _, err := unix.Recvfrom(int(fd), buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, unix.ECONNRESET):
+			state = socketClosed
+		case err != nil:
+			// EAGAIN: no data at all
+		case count > 0:
+			state = socketPending
+		default:
+			state = socketClosed
+		}
+		return true // never wait for the socket to become readable
+	})
+	if err != nil {
+		return socketIdle
+	}
+	return state
+}
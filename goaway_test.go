@@ -0,0 +1,243 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// closingTestOpener is a [*closeCountingOpener] whose server may signal closing.
+type closingTestOpener struct {
+	closeCountingOpener
+	closing atomic.Bool
+}
+
+// Closing implements closingNotifier.
+func (c *closingTestOpener) Closing() bool {
+	return c.closing.Load()
+}
+
+func TestStreamOpenerClosing(t *testing.T) {
+	t.Run("detects the server closing an idle TCP connection", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("cannot peek at the socket on this system")
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		dialer := NewStreamOpenerDialerTCP(&net.Dialer{})
+		conn, err := dialer.DialContext(context.Background(), listener.Addr().(*net.TCPAddr).AddrPort())
+		require.NoError(t, err)
+		defer conn.Close()
+		serverConn := <-accepted
+		require.False(t, StreamOpenerClosing(conn))
+
+		require.NoError(t, serverConn.Close())
+		require.Eventually(t, func() bool {
+			return StreamOpenerClosing(conn)
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("detects the server resetting an idle TCP connection", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("cannot peek at the socket on this system")
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		dialer := NewStreamOpenerDialerTCP(&net.Dialer{})
+		conn, err := dialer.DialContext(context.Background(), listener.Addr().(*net.TCPAddr).AddrPort())
+		require.NoError(t, err)
+		defer conn.Close()
+		serverConn := <-accepted
+		require.False(t, StreamOpenerClosing(conn))
+
+		require.NoError(t, serverConn.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, serverConn.Close())
+		require.Eventually(t, func() bool {
+			return socketPeek(conn.(*tcpStreamConn).conn) == socketClosed
+		}, time.Second, time.Millisecond)
+		require.True(t, StreamOpenerClosing(conn))
+	})
+
+	t.Run("detects unsolicited data on an idle TCP connection", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("cannot peek at the socket on this system")
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}()
+
+		dialer := NewStreamOpenerDialerTCP(&net.Dialer{})
+		conn, err := dialer.DialContext(context.Background(), listener.Addr().(*net.TCPAddr).AddrPort())
+		require.NoError(t, err)
+		defer conn.Close()
+		serverConn := <-accepted
+		defer serverConn.Close()
+		require.False(t, StreamOpenerClosing(conn))
+
+		_, err = serverConn.Write([]byte{0x00})
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return StreamOpenerClosing(conn)
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("detects the TLS close_notify alert on an idle connection", func(t *testing.T) {
+		if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+			t.Skip("cannot peek at the socket on this system")
+		}
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{newTestCert()},
+		})
+		require.NoError(t, err)
+		defer listener.Close()
+		accepted := make(chan *tls.Conn, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				accepted <- tc
+			}
+		}()
+
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig()})
+		conn, err := dialer.DialContext(context.Background(), listener.Addr().(*net.TCPAddr).AddrPort())
+		require.NoError(t, err)
+		defer conn.Close()
+		serverConn := <-accepted
+		defer serverConn.Close()
+
+		// 1. reading the pending records times out without data and
+		// leaves the connection usable, so the server can still write
+		tc := conn.(*tlsStreamConn).conn.(*tls.Conn)
+		require.False(t, StreamOpenerClosing(conn))
+		require.False(t, tlsPeerClosing(tc))
+		_, err = serverConn.Write([]byte("ok"))
+		require.NoError(t, err)
+		buf := make([]byte, 2)
+		_, err = io.ReadFull(tc, buf)
+		require.NoError(t, err)
+		require.Equal(t, "ok", string(buf))
+
+		// 2. the close_notify alert without TCP FIN means closing
+		require.NoError(t, serverConn.CloseWrite())
+		require.Eventually(t, func() bool {
+			return StreamOpenerClosing(conn)
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("returns false for openers not knowing", func(t *testing.T) {
+		require.False(t, StreamOpenerClosing(NewHandlerStreamOpener(newBenchHandler())))
+	})
+}
+
+func TestPoolClosing(t *testing.T) {
+	key := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+
+	t.Run("does not pool connections the server is closing", func(t *testing.T) {
+		pool := NewPool(4)
+		conn := &closingTestOpener{}
+		conn.closing.Store(true)
+		pool.Put(key, conn)
+		requireEventuallyClosed(t, &conn.closeCountingOpener)
+		stats := pool.Stats()
+		require.Equal(t, uint64(0), stats.Puts)
+		require.Equal(t, uint64(1), stats.Closing)
+		require.Equal(t, 0, stats.Idle)
+	})
+
+	t.Run("skips idle connections the server is closing", func(t *testing.T) {
+		pool := NewPool(4)
+		older, newer := &closingTestOpener{}, &closingTestOpener{}
+		pool.Put(key, older)
+		pool.Put(key, newer)
+		newer.closing.Store(true)
+
+		conn, found := pool.Get(key)
+		require.True(t, found)
+		require.Same(t, older, conn)
+		requireEventuallyClosed(t, &newer.closeCountingOpener)
+
+		older.closing.Store(true)
+		pool.Put(key, older)
+		_, found = pool.Get(key)
+		require.False(t, found)
+		stats := pool.Stats()
+		require.Equal(t, uint64(1), stats.Hits)
+		require.Equal(t, uint64(1), stats.Misses)
+		require.Equal(t, uint64(2), stats.Closing)
+	})
+}
+
+func TestPersistentTransportClosing(t *testing.T) {
+	var dials atomic.Int64
+	var conns []*closingTestOpener
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			dials.Add(1)
+			conn := &closingTestOpener{closeCountingOpener: closeCountingOpener{FuncStreamOpener: FuncStreamOpener{
+				OpenStreamFunc: func() (Stream, error) {
+					return NewHandlerStreamOpener(newBenchHandler()).OpenStream()
+				},
+			}}}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+	pt := NewPersistentTransport(NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53")))
+	defer pt.Close()
+	var closing atomic.Int64
+	pt.ObserveClosing = func() {
+		closing.Add(1)
+	}
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	_, err := pt.Exchange(context.Background(), query)
+	require.NoError(t, err)
+	conns[0].closing.Store(true)
+	_, err = pt.Exchange(context.Background(), query)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(2), dials.Load())
+	require.Equal(t, int64(1), closing.Load())
+	require.Equal(t, int64(1), conns[0].closed.Load())
+}
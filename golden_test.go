@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// goldenFrame is a canonical test vector containing the exact frame, including
+// the 2-byte length prefix, we write for a query with a fixed ID.
+//
+// Changing any of these frames changes the wire behavior observable by servers
+// and by downstream consumers, so it requires a deliberate decision.
+type goldenFrame struct {
+	// name is the test vector name.
+	name string
+
+	// params is the [QueryParams] preset of the protocol.
+	params QueryParams
+
+	// setup OPTIONALLY configures the [*Transport].
+	setup func(dt *Transport)
+
+	// qtype is the type of the query for example.com.
+	qtype uint16
+
+	// frame is the hex-encoded expected frame.
+	frame string
+}
+
+// goldenFrames contains the canonical test vectors for each protocol.
+var goldenFrames = []goldenFrame{{
+	name:   "TCP",
+	params: QueryParamsTCP(),
+	qtype:  dns.TypeA,
+	frame: "0028" + // length prefix
+		"123401000001000000000001076578616d706c6503636f6d0000010001" + // header and question
+		"0000291000000000000000", // EDNS(0) advertising 4096 bytes
+}, {
+	name:   "TLS",
+	params: QueryParamsTLS(),
+	qtype:  dns.TypeAAAA,
+	frame: "0080" + // length prefix
+		"123401000001000000000001076578616d706c6503636f6d00001c0001" + // header and question
+		"000029100000008000" + // EDNS(0) advertising 4096 bytes with the DO bit
+		"0058000c0054" + zeroHex(84), // padding to 128 bytes (RFC 8467)
+}, {
+	name:   "QUIC",
+	params: QueryParamsQUIC(),
+	qtype:  dns.TypeHTTPS,
+	frame: "0080" + // length prefix
+		"000001000001000000000001076578616d706c6503636f6d0000410001" + // zero ID (RFC 9250)
+		"000029100000008000" + // EDNS(0) advertising 4096 bytes with the DO bit
+		"0058000c0054" + zeroHex(84), // padding to 128 bytes (RFC 8467)
+}, {
+	name:   "TCP without recursion in the CHAOS class",
+	params: QueryParamsTCP(),
+	setup: func(dt *Transport) {
+		dt.NoRecursion = true
+		dt.QueryClass = dns.ClassCHAOS
+	},
+	qtype: dns.TypeTXT,
+	frame: "0028" + // length prefix
+		"123400000001000000000001076578616d706c6503636f6d0000100003" + // no RD bit and CH class
+		"0000291000000000000000", // EDNS(0) advertising 4096 bytes
+}, {
+	name:   "TCP using a padding oracle",
+	params: QueryParamsTCP(),
+	setup: func(dt *Transport) {
+		dt.PaddingOracle = NewBlockPaddingOracle(64)
+	},
+	qtype: dns.TypeA,
+	frame: "0040" + // length prefix
+		"123401000001000000000001076578616d706c6503636f6d0000010001" + // header and question
+		"000029100000000000" + // EDNS(0) advertising 4096 bytes
+		"0018000c0014" + zeroHex(20), // padding to 64 bytes
+}}
+
+// zeroHex returns the hex encoding of count zero bytes.
+func zeroHex(count int) string {
+	return hex.EncodeToString(make([]byte, count))
+}
+
+// goldenFrameWritten returns the frame written by the [*Transport] for the
+// query of the given [goldenFrame] using the given ID.
+func goldenFrameWritten(t *testing.T, gf goldenFrame, id uint16) []byte {
+	var written bytes.Buffer
+	conn := &FuncStreamOpener{
+		MutateQueryFunc: gf.params.MutateQuery,
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{WriteFunc: written.Write}, nil
+		},
+	}
+	dt := NewTransport(NewFuncStreamOpenerDialer(conn), netip.MustParseAddrPort("127.0.0.1:53"))
+	if gf.setup != nil {
+		gf.setup(dt)
+	}
+	query := dnscodec.NewQuery("example.com", gf.qtype)
+	query.ID = id
+
+	// the stream returns EOF, so the exchange fails after writing
+	_, err := dt.Exchange(context.Background(), query)
+	require.Error(t, err)
+	return written.Bytes()
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, gf := range goldenFrames {
+		t.Run(gf.name, func(t *testing.T) {
+			expected, err := hex.DecodeString(gf.frame)
+			require.NoError(t, err)
+			written := goldenFrameWritten(t, gf, 0x1234)
+			require.Equal(t, hex.EncodeToString(expected), hex.EncodeToString(written))
+
+			// the length prefix describes the message, which is valid
+			require.Equal(t, len(written)-2, int(written[0])<<8|int(written[1]))
+			msg := new(dns.Msg)
+			require.NoError(t, msg.Unpack(written[2:]))
+			require.Equal(t, dns.Fqdn("example.com"), msg.Question[0].Name)
+			require.Equal(t, gf.qtype, msg.Question[0].Qtype)
+		})
+	}
+}
+
+func TestGoldenFramesAreStable(t *testing.T) {
+	// writing the same query twice must produce the same bytes, so the
+	// frames only depend on the query and on the configuration
+	for _, gf := range goldenFrames {
+		t.Run(gf.name, func(t *testing.T) {
+			require.Equal(t, goldenFrameWritten(t, gf, 0x1234), goldenFrameWritten(t, gf, 0x1234))
+		})
+	}
+}
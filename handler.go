@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// Handler prepares the response to a DNS query.
+//
+// This interface is compatible with [*dnstest.Handler], so the same
+// implementation can back a real test server listening on the network
+// as well as the in-memory [StreamOpener] created by [NewHandlerStreamOpener].
+//
+// Returning nil causes the server to close the stream without answering.
+type Handler interface {
+	PrepareResponse(query *dns.Msg) *dns.Msg
+}
+
+// HandlerFunc adapts a function to the [Handler] interface.
+type HandlerFunc func(query *dns.Msg) *dns.Msg
+
+var _ Handler = HandlerFunc(nil)
+
+// PrepareResponse implements [Handler].
+func (fx HandlerFunc) PrepareResponse(query *dns.Msg) *dns.Msg {
+	return fx(query)
+}
+
+// StreamOpenerDialerHandler implements [StreamOpenerDialer] using a [Handler].
+//
+// This allows using [*Transport.Exchange] in tests without touching the network.
+//
+// Construct using [NewStreamOpenerDialerHandler].
+type StreamOpenerDialerHandler struct {
+	// Handler is the [Handler] answering queries.
+	Handler Handler
+}
+
+// NewStreamOpenerDialerHandler creates a new [*StreamOpenerDialerHandler].
+func NewStreamOpenerDialerHandler(handler Handler) *StreamOpenerDialerHandler {
+	return &StreamOpenerDialerHandler{Handler: handler}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerHandler{}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *StreamOpenerDialerHandler) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return NewHandlerStreamOpener(d.Handler), nil
+}
+
+// NewHandlerStreamOpener creates an in-memory [StreamOpener] using a [Handler].
+//
+// Each [Stream] reads a single framed query and answers using the [Handler]
+// with the same framing used by DNS over TCP, TLS, and QUIC. Queries are
+// mutated like for DNS over TCP.
+func NewHandlerStreamOpener(handler Handler) StreamOpener {
+	return &handlerStreamConn{handler: handler}
+}
+
+// handlerStreamConn implements [StreamOpener] using a [Handler].
+type handlerStreamConn struct {
+	handler Handler
+	mu      sync.Mutex
+	closed  bool
+}
+
+// Close implements [StreamOpener].
+func (s *handlerStreamConn) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return nil
+}
+
+// MutateQuery implements [StreamOpener].
+func (s *handlerStreamConn) MutateQuery(msg *dnscodec.Query) {
+	QueryParamsTCP().MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (s *handlerStreamConn) OpenStream() (Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	return &handlerStream{conn: s}, nil
+}
+
+// handlerStream implements [Stream] using a [Handler].
+type handlerStream struct {
+	conn     *handlerStreamConn
+	query    bytes.Buffer
+	response bytes.Reader
+}
+
+// Close implements [Stream].
+func (s *handlerStream) Close() error {
+	return nil
+}
+
+// Read implements [Stream].
+//
+// Reading before the whole query has been written returns [io.EOF], as
+// if the server had closed the stream without answering.
+func (s *handlerStream) Read(buff []byte) (int, error) {
+	return s.response.Read(buff)
+}
+
+// SetDeadline implements [Stream].
+func (s *handlerStream) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// Write implements [Stream].
+func (s *handlerStream) Write(data []byte) (int, error) {
+	// 1. refuse writing after the connection has been closed
+	s.conn.mu.Lock()
+	closed := s.conn.closed
+	s.conn.mu.Unlock()
+	if closed {
+		return 0, net.ErrClosed
+	}
+
+	// 2. wait until we have received the whole query
+	s.query.Write(data)
+	raw := s.query.Bytes()
+	if len(raw) < 2 || len(raw)-2 < int(raw[0])<<8|int(raw[1]) {
+		return len(data), nil
+	}
+
+	// 3. answer the query, ignoring unparseable queries like a server would
+	queryMsg := &dns.Msg{}
+	if err := queryMsg.Unpack(raw[2:]); err != nil {
+		return len(data), nil
+	}
+	respMsg := s.conn.handler.PrepareResponse(queryMsg)
+	if respMsg == nil {
+		return len(data), nil
+	}
+	rawResp, err := respMsg.Pack()
+	if err != nil {
+		return len(data), nil
+	}
+	s.response.Reset(appendStreamMsgFrame(nil, rawResp))
+	return len(data), nil
+}
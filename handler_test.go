@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerSharedWithDNSTest(t *testing.T) {
+	// Use the same handler for a real server and for the in-memory dialer.
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	handler := dnstest.NewHandler(config)
+
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	t.Cleanup(srv.Close)
+
+	transports := map[string]*Transport{
+		"tcp":     NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address())),
+		"handler": NewTransport(NewStreamOpenerDialerHandler(handler), netip.AddrPort{}),
+	}
+	for name, dt := range transports {
+		t.Run(name, func(t *testing.T) {
+			resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+			addrs, err := resp.RecordsA()
+			require.NoError(t, err)
+			require.Equal(t, []string{"8.8.8.8"}, addrs)
+		})
+	}
+}
+
+func TestHandlerStreamOpener(t *testing.T) {
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+
+	t.Run("HandlerFunc returning nil causes io.EOF", func(t *testing.T) {
+		conn := NewHandlerStreamOpener(HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			return nil
+		}))
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, io.EOF)
+		require.Nil(t, resp)
+	})
+
+	t.Run("MutateQuery applies the TCP settings", func(t *testing.T) {
+		conn := NewHandlerStreamOpener(HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			return nil
+		}))
+		query := dnscodec.NewQuery("dns.google", dns.TypeA)
+		conn.MutateQuery(query)
+		require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeTCP), query.MaxSize)
+	})
+
+	t.Run("OpenStream fails after Close", func(t *testing.T) {
+		conn := NewHandlerStreamOpener(HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			return nil
+		}))
+		require.NoError(t, conn.Close())
+		stream, err := conn.OpenStream()
+		require.ErrorIs(t, err, net.ErrClosed)
+		require.Nil(t, stream)
+	})
+
+	t.Run("DialContext fails with a canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		dialer := NewStreamOpenerDialerHandler(HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			return nil
+		}))
+		conn, err := dialer.DialContext(ctx, netip.AddrPort{})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Nil(t, conn)
+	})
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+
+	"github.com/quic-go/quic-go"
+)
+
+// HandshakeKind classifies the handshake of the connection used by an exchange,
+// which allows to bucket latency measurements by handshake type.
+type HandshakeKind int
+
+const (
+	// HandshakeUnknown means that the handshake kind is not observable, which
+	// is the case for DNS over TCP and for custom [StreamOpener] types.
+	HandshakeUnknown HandshakeKind = iota
+
+	// HandshakeFull is a full TLS handshake.
+	HandshakeFull
+
+	// HandshakeResumed is an abbreviated handshake resuming a previous
+	// session using a session ticket, without sending early data.
+	HandshakeResumed
+
+	// HandshakeEarlyData is a resumed handshake where the server accepted
+	// the query sent as 0-RTT early data (see [QUICDialer] Allow0RTT and
+	// [*StreamOpenerDialerTLS] AllowEarlyData).
+	HandshakeEarlyData
+
+	// HandshakeEarlyDataRejected is a resumed handshake where the server
+	// rejected the query sent as 0-RTT early data, so that we resent it
+	// after the handshake completed.
+	HandshakeEarlyDataRejected
+)
+
+// String implements [fmt.Stringer].
+func (k HandshakeKind) String() string {
+	switch k {
+	case HandshakeFull:
+		return "full"
+	case HandshakeResumed:
+		return "resumed"
+	case HandshakeEarlyData:
+		return "earlyData"
+	case HandshakeEarlyDataRejected:
+		return "earlyDataRejected"
+	default:
+		return "unknown"
+	}
+}
+
+// handshakeKinder is implemented by [StreamOpener] types that
+// know the [HandshakeKind] of their connection.
+type handshakeKinder interface {
+	HandshakeKind() HandshakeKind
+}
+
+// StreamOpenerHandshakeKind returns the [HandshakeKind] of the connection.
+//
+// The TLS and QUIC [StreamOpener] types know the kind once the handshake has
+// completed, while other types return [HandshakeUnknown] unless they implement
+// a HandshakeKind method returning [HandshakeKind] (e.g., for utls or uquic).
+func StreamOpenerHandshakeKind(conn StreamOpener) HandshakeKind {
+	if hk, ok := conn.(handshakeKinder); ok {
+		return hk.HandshakeKind()
+	}
+	return HandshakeUnknown
+}
+
+// tlsHandshakeKind returns the [HandshakeKind] given the [tls.ConnectionState].
+func tlsHandshakeKind(state tls.ConnectionState) HandshakeKind {
+	switch {
+	case !state.HandshakeComplete:
+		return HandshakeUnknown
+	case state.DidResume:
+		return HandshakeResumed
+	default:
+		return HandshakeFull
+	}
+}
+
+// HandshakeKind returns the [HandshakeKind] when the connection is a [*tls.Conn].
+func (s *tlsStreamConn) HandshakeKind() HandshakeKind {
+	if tc, ok := s.conn.(*tls.Conn); ok {
+		return tlsHandshakeKind(tc.ConnectionState())
+	}
+	return HandshakeUnknown
+}
+
+// HandshakeKind returns the [HandshakeKind] when the connection is a [*tls.Conn].
+func (c *httpsConn) HandshakeKind() HandshakeKind {
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		return tlsHandshakeKind(tc.ConnectionState())
+	}
+	return HandshakeUnknown
+}
+
+// HandshakeKind returns the [HandshakeKind] once the handshake has completed.
+func (q *quicConnAdapter) HandshakeKind() HandshakeKind {
+	kind := quicHandshakeKind(q.qconn)
+	if kind != HandshakeUnknown && q.earlyDataRejected.Load() {
+		return HandshakeEarlyDataRejected
+	}
+	return kind
+}
+
+// HandshakeKind returns the [HandshakeKind] once the handshake has completed.
+func (c *http3Conn) HandshakeKind() HandshakeKind {
+	return quicHandshakeKind(c.qconn)
+}
+
+// quicHandshakeKind returns the [HandshakeKind] of a [*quic.Conn].
+func quicHandshakeKind(qconn *quic.Conn) HandshakeKind {
+	select {
+	case <-qconn.HandshakeComplete():
+	default:
+		return HandshakeUnknown
+	}
+	state := qconn.ConnectionState()
+	if state.Used0RTT {
+		return HandshakeEarlyData
+	}
+	return tlsHandshakeKind(state.TLS)
+}
+
+// negotiatedProtocoler is implemented by [StreamOpener] types that
+// know the protocol negotiated using ALPN by their connection.
+type negotiatedProtocoler interface {
+	NegotiatedProtocol() string
+}
+
+// StreamOpenerNegotiatedProtocol returns the protocol the server selected
+// using ALPN (e.g., "dot", "doq", or "h2"), which reports which protocol
+// actually answered, or the empty string if the server did not use ALPN
+// or the [StreamOpener] does not know the negotiated protocol.
+func StreamOpenerNegotiatedProtocol(conn StreamOpener) string {
+	if np, ok := conn.(negotiatedProtocoler); ok {
+		return np.NegotiatedProtocol()
+	}
+	return ""
+}
+
+// NegotiatedProtocol returns the protocol negotiated using ALPN.
+func (s *tlsStreamConn) NegotiatedProtocol() string {
+	return tlsNegotiatedProtocol(s.conn)
+}
+
+// NegotiatedProtocol returns the protocol negotiated using ALPN.
+func (c *httpsConn) NegotiatedProtocol() string {
+	return tlsNegotiatedProtocol(c.conn)
+}
+
+// NegotiatedProtocol returns the protocol negotiated using ALPN.
+func (q *quicConnAdapter) NegotiatedProtocol() string {
+	return q.qconn.ConnectionState().TLS.NegotiatedProtocol
+}
+
+// NegotiatedProtocol returns the protocol negotiated using ALPN.
+func (c *http3Conn) NegotiatedProtocol() string {
+	return c.qconn.ConnectionState().TLS.NegotiatedProtocol
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeKindString(t *testing.T) {
+	for _, tc := range []struct {
+		kind     HandshakeKind
+		expected string
+	}{
+		{HandshakeUnknown, "unknown"},
+		{HandshakeFull, "full"},
+		{HandshakeResumed, "resumed"},
+		{HandshakeEarlyData, "earlyData"},
+		{HandshakeEarlyDataRejected, "earlyDataRejected"},
+		{HandshakeKind(42), "unknown"},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.kind.String())
+		})
+	}
+}
+
+func TestTLSHandshakeKind(t *testing.T) {
+	require.Equal(t, HandshakeUnknown, tlsHandshakeKind(tls.ConnectionState{}))
+	require.Equal(t, HandshakeFull, tlsHandshakeKind(tls.ConnectionState{HandshakeComplete: true}))
+	require.Equal(t, HandshakeResumed, tlsHandshakeKind(tls.ConnectionState{HandshakeComplete: true, DidResume: true}))
+}
+
+func TestStreamOpenerHandshakeKind(t *testing.T) {
+	t.Run("custom stream opener", func(t *testing.T) {
+		require.Equal(t, HandshakeUnknown, StreamOpenerHandshakeKind(&FuncStreamOpener{}))
+	})
+
+	t.Run("TLS stream opener over a non-TLS connection", func(t *testing.T) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+		require.Equal(t, HandshakeUnknown, StreamOpenerHandshakeKind(NewTLSStreamOpener(conn1)))
+	})
+}
+
+func TestStreamOpenerNegotiatedProtocol(t *testing.T) {
+	t.Run("custom stream opener", func(t *testing.T) {
+		require.Empty(t, StreamOpenerNegotiatedProtocol(&FuncStreamOpener{}))
+	})
+
+	t.Run("TLS stream opener over a non-TLS connection", func(t *testing.T) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+		require.Empty(t, StreamOpenerNegotiatedProtocol(NewTLSStreamOpener(conn1)))
+	})
+
+	t.Run("TLS stream opener negotiating dot", func(t *testing.T) {
+		conn1, conn2 := net.Pipe()
+		defer conn1.Close()
+		defer conn2.Close()
+		server := tls.Server(conn2, &tls.Config{Certificates: []tls.Certificate{newTestCert()}, NextProtos: []string{"dot"}})
+		go server.Handshake()
+		client := tls.Client(conn1, newTestClientTLSConfig("dot", "h2", "http/1.1"))
+		require.NoError(t, client.Handshake())
+		require.Equal(t, "dot", StreamOpenerNegotiatedProtocol(NewTLSStreamOpener(client)))
+	})
+
+	t.Run("QUIC stream opener", func(t *testing.T) {
+		srv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		qd := &QUICDialer{TLSConfig: newTestClientTLSConfig("doq"), ConnectedUDP: true, UDPDialer: &net.Dialer{}}
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qd), srv.Endpoint())
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, "doq", StreamOpenerNegotiatedProtocol(conn))
+	})
+}
+
+// collectHandshakeKinds returns the [*Transport] ObserveTiming hook and
+// a function returning the observed [HandshakeKind] values.
+func collectHandshakeKinds() (func(ExchangeTiming), func() []HandshakeKind) {
+	var kinds []HandshakeKind
+	observe := func(timing ExchangeTiming) {
+		kinds = append(kinds, timing.Handshake)
+	}
+	return observe, func() []HandshakeKind { return kinds }
+}
+
+func TestExchangeTimingHandshakeTLS(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+	t.Cleanup(srv.Close)
+
+	tlsConfig := newTestClientTLSConfig("dot")
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+	dt := NewTransport(NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig}), netip.MustParseAddrPort(srv.Address()))
+	observe, kinds := collectHandshakeKinds()
+	dt.ObserveTiming = observe
+
+	// The first exchange receives the session ticket that the second one uses.
+	for range 2 {
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	}
+	require.Equal(t, []HandshakeKind{HandshakeFull, HandshakeResumed}, kinds())
+}
+
+func TestExchangeTimingHandshakeQUIC(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := newDoQTestServer(t, dnstest.NewHandler(config).PrepareResponse)
+
+	for _, tc := range []struct {
+		name      string
+		allow0RTT bool
+		expected  []HandshakeKind
+	}{
+		{"without 0-RTT", false, []HandshakeKind{HandshakeFull, HandshakeResumed}},
+		{"with 0-RTT", true, []HandshakeKind{HandshakeFull, HandshakeEarlyData}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer pconn.Close()
+			quicDialer := NewQUICDialer(pconn, "example.com")
+			quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+			quicDialer.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+			quicDialer.Allow0RTT = tc.allow0RTT
+			dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint())
+			observe, kinds := collectHandshakeKinds()
+			dt.ObserveTiming = observe
+
+			for range 2 {
+				_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expected, kinds())
+		})
+	}
+}
+
+func TestExchangeTimingHandshakeQUICEarlyDataRejected(t *testing.T) {
+	// the servers share the session ticket keys, so the client resumes the
+	// session with the second server, which however rejects early data
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	handler := func(query *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{dnstest.NewHandler(config).PrepareResponse(query)}
+	}
+	newServer := func(allow0RTT bool) *doqTestServer {
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{newTestCert()},
+			NextProtos:   []string{"doq"},
+		}
+		tlsConfig.SetSessionTicketKeys([][32]byte{{1, 2, 3, 4}})
+		return newDoQTestServerConfig(t, "127.0.0.1:0", tlsConfig, &quic.Config{Allow0RTT: allow0RTT}, handler)
+	}
+	accepting, rejecting := newServer(true), newServer(false)
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pconn.Close()
+	quicDialer := NewQUICDialer(pconn, "example.com")
+	quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+	quicDialer.TLSConfig.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+	quicDialer.Allow0RTT = true
+	observe, kinds := collectHandshakeKinds()
+
+	for _, srv := range []*doqTestServer{accepting, rejecting} {
+		dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint())
+		dt.ObserveTiming = observe
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+	}
+	require.Equal(t, []HandshakeKind{HandshakeFull, HandshakeEarlyDataRejected}, kinds())
+}
+
+func TestExchangeTimingHandshakeTCP(t *testing.T) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	observe, kinds := collectHandshakeKinds()
+	dt.ObserveTiming = observe
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, []HandshakeKind{HandshakeUnknown}, kinds())
+}
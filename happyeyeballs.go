@@ -0,0 +1,260 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// DefaultHappyEyeballsAttemptDelay is the default delay between connection
+// attempts used by [*HappyEyeballs] (RFC 8305 Section 5).
+const DefaultHappyEyeballsAttemptDelay = 250 * time.Millisecond
+
+// ErrHappyEyeballsNoEndpoints indicates that [*HappyEyeballs] has no endpoints.
+var ErrHappyEyeballsNoEndpoints = errors.New("dnsoverstream: no endpoints to race")
+
+// HappyEyeballsOutcome is the outcome of a [HappyEyeballsAttempt].
+type HappyEyeballsOutcome int
+
+const (
+	// HappyEyeballsNotStarted means that we did not start the attempt
+	// because another attempt won the race before its turn.
+	HappyEyeballsNotStarted HappyEyeballsOutcome = iota
+
+	// HappyEyeballsWon means that the attempt connected first.
+	HappyEyeballsWon
+
+	// HappyEyeballsLost means that the attempt connected after another
+	// attempt had already won, so we closed the connection.
+	HappyEyeballsLost
+
+	// HappyEyeballsFailed means that the attempt failed to connect.
+	HappyEyeballsFailed
+
+	// HappyEyeballsCanceled means that we canceled the attempt because
+	// another attempt won the race or the context was done.
+	HappyEyeballsCanceled
+)
+
+// String returns the name of the outcome.
+func (o HappyEyeballsOutcome) String() string {
+	switch o {
+	case HappyEyeballsNotStarted:
+		return "notStarted"
+	case HappyEyeballsWon:
+		return "won"
+	case HappyEyeballsLost:
+		return "lost"
+	case HappyEyeballsFailed:
+		return "failed"
+	case HappyEyeballsCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// HappyEyeballsAttempt describes a connection attempt made by [*HappyEyeballs],
+// including the attempts that lost the race, so that it is possible to
+// analyze the racing behavior and not just the winner.
+type HappyEyeballsAttempt struct {
+	// Endpoint is the endpoint we dialed.
+	Endpoint netip.AddrPort
+
+	// Outcome is the [HappyEyeballsOutcome] of the attempt.
+	Outcome HappyEyeballsOutcome
+
+	// Started is the time elapsed since the beginning of the race when we
+	// started the attempt, which is zero for [HappyEyeballsNotStarted].
+	Started time.Duration
+
+	// DialTime is the time spent dialing, which includes the TCP connect
+	// and the TLS or QUIC handshake.
+	DialTime time.Duration
+
+	// Err is the dial error or nil when the attempt connected.
+	Err error
+}
+
+// HappyEyeballs races connection attempts to several endpoints of the same
+// server, such as its IPv6 and IPv4 addresses, using the connection attempt
+// delay of Happy Eyeballs v2 (RFC 8305 Section 5) and records each attempt.
+//
+// We dial each endpoint using the [*Transport] with [WithEndpoint], so the
+// endpoints must be valid for the [*Transport] dialer (e.g., they must all
+// be DNS over TLS endpoints for the same server name).
+//
+// Construct using [NewHappyEyeballs].
+type HappyEyeballs struct {
+	// Transport is the MANDATORY [*Transport] used to dial and exchange.
+	Transport *Transport
+
+	// Endpoints contains the MANDATORY endpoints to race, which we reorder
+	// to interleave the address families starting with IPv6 (RFC 8305
+	// Section 4) while preserving the order within each family.
+	Endpoints []netip.AddrPort
+
+	// AttemptDelay is the OPTIONAL delay before starting the next attempt
+	// while the previous ones are still pending. If zero or negative, we
+	// use [DefaultHappyEyeballsAttemptDelay]. We start the next attempt
+	// immediately when an attempt fails.
+	AttemptDelay time.Duration
+
+	// ObserveAttempt is an optional hook called after the race for each
+	// attempt, in the order we started them.
+	ObserveAttempt func(HappyEyeballsAttempt)
+}
+
+// NewHappyEyeballs creates a new [*HappyEyeballs] with the given [*Transport] and endpoints.
+func NewHappyEyeballs(dt *Transport, endpoints ...netip.AddrPort) *HappyEyeballs {
+	return &HappyEyeballs{Transport: dt, Endpoints: endpoints}
+}
+
+// happyEyeballsResult is the result of a single dial.
+type happyEyeballsResult struct {
+	index   int
+	conn    StreamOpener
+	elapsed time.Duration
+	err     error
+}
+
+// Dial races the connection attempts and returns the winning [StreamOpener]
+// along with all the attempts, regardless of whether the race succeeded.
+//
+// We wait for the losing attempts to complete before returning, so that
+// their outcome is known, and close the connections they establish.
+func (he *HappyEyeballs) Dial(ctx context.Context) (StreamOpener, []HappyEyeballsAttempt, error) {
+	// 1. prepare the attempts interleaving the address families
+	endpoints := happyEyeballsInterleave(he.Endpoints)
+	attempts := make([]HappyEyeballsAttempt, len(endpoints))
+	for idx, endpoint := range endpoints {
+		attempts[idx].Endpoint = endpoint
+	}
+	if len(attempts) <= 0 {
+		return nil, nil, ErrHappyEyeballsNoEndpoints
+	}
+	delay := he.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultHappyEyeballsAttemptDelay
+	}
+
+	// 2. start the first attempt
+	dt := he.Transport
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan happyEyeballsResult, len(attempts))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	t0 := dt.now()
+	var next, running int
+	start := func() {
+		idx := next
+		next++
+		running++
+		attempts[idx].Started = dt.since(t0)
+		dt.execute(func() {
+			t := dt.now()
+			conn, err := dt.Dial(WithEndpoint(raceCtx, attempts[idx].Endpoint))
+			results <- happyEyeballsResult{index: idx, conn: conn, elapsed: dt.since(t), err: err}
+		})
+		timer.Reset(delay)
+	}
+	start()
+
+	// 3. start the next attempt when the delay expires or the previous
+	// attempt fails, until an attempt wins or all attempts fail
+	var winner StreamOpener
+	for running > 0 {
+		var timerC <-chan time.Time
+		if winner == nil && next < len(attempts) {
+			timerC = timer.C
+		}
+		select {
+		case <-timerC:
+			start()
+
+		case result := <-results:
+			running--
+			attempt := &attempts[result.index]
+			attempt.DialTime, attempt.Err = result.elapsed, result.err
+			switch {
+			case result.err == nil && winner == nil:
+				attempt.Outcome = HappyEyeballsWon
+				winner = result.conn
+				cancel()
+			case result.err == nil:
+				attempt.Outcome = HappyEyeballsLost
+				result.conn.Close()
+			case raceCtx.Err() != nil:
+				attempt.Outcome = HappyEyeballsCanceled
+			default:
+				attempt.Outcome = HappyEyeballsFailed
+				if next < len(attempts) && ctx.Err() == nil {
+					start()
+				}
+			}
+		}
+	}
+
+	// 4. emit the telemetry and return the outcome
+	if he.ObserveAttempt != nil {
+		for _, attempt := range attempts {
+			he.ObserveAttempt(attempt)
+		}
+	}
+	if winner == nil {
+		var errs []error
+		for _, attempt := range attempts {
+			errs = append(errs, attempt.Err)
+		}
+		return nil, attempts, wrapContextError(ctx, errors.Join(errs...))
+	}
+	return winner, attempts, nil
+}
+
+// Exchange dials using [*HappyEyeballs.Dial] and uses the winning connection
+// to send a [*dnscodec.Query] and receive a [*dnscodec.Response].
+func (he *HappyEyeballs) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, []HappyEyeballsAttempt, error) {
+	conn, attempts, err := he.Dial(ctx)
+	if err != nil {
+		return nil, attempts, err
+	}
+	defer conn.Close()
+	for _, attempt := range attempts {
+		if attempt.Outcome == HappyEyeballsWon {
+			ctx = WithEndpoint(ctx, attempt.Endpoint)
+		}
+	}
+	resp, err := he.Transport.ExchangeWithStreamOpener(withBorrowedStreamOpener(ctx), conn, query)
+	return resp, attempts, err
+}
+
+// happyEyeballsInterleave returns a copy of the endpoints alternating
+// IPv6 and IPv4 endpoints, starting with IPv6 (RFC 8305 Section 4).
+func happyEyeballsInterleave(endpoints []netip.AddrPort) []netip.AddrPort {
+	var v6, v4 []netip.AddrPort
+	for _, endpoint := range endpoints {
+		if endpoint.Addr().Unmap().Is4() {
+			v4 = append(v4, endpoint)
+			continue
+		}
+		v6 = append(v6, endpoint)
+	}
+	out := make([]netip.AddrPort, 0, len(endpoints))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			out = append(out, v6[0])
+			v6 = v6[1:]
+		}
+		if len(v4) > 0 {
+			out = append(out, v4[0])
+			v4 = v4[1:]
+		}
+	}
+	return out
+}
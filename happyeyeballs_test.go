@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Endpoints used by the [*HappyEyeballs] tests.
+var (
+	happyEyeballsTestV6 = netip.MustParseAddrPort("[2001:db8::1]:53")
+	happyEyeballsTestV4 = netip.MustParseAddrPort("192.0.2.1:53")
+)
+
+// newHappyEyeballsTestTransport returns a [*Transport] whose dialer
+// invokes the function associated with the endpoint being dialed.
+func newHappyEyeballsTestTransport(dials map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error)) *Transport {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return dials[address](ctx)
+		},
+	}
+	return NewTransport(dialer, happyEyeballsTestV4)
+}
+
+// happyEyeballsTestSucceed is a dial function succeeding immediately.
+func happyEyeballsTestSucceed(ctx context.Context) (StreamOpener, error) {
+	return &FuncStreamOpener{}, nil
+}
+
+// happyEyeballsTestHang is a dial function blocking until the context is done.
+func happyEyeballsTestHang(ctx context.Context) (StreamOpener, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	t.Run("the first attempt wins", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: happyEyeballsTestSucceed,
+			happyEyeballsTestV4: happyEyeballsTestSucceed,
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV4, happyEyeballsTestV6)
+		he.AttemptDelay = time.Hour
+		conn, attempts, err := he.Dial(context.Background())
+		require.NoError(t, err)
+		require.NotNil(t, conn)
+		require.Len(t, attempts, 2)
+		require.Equal(t, happyEyeballsTestV6, attempts[0].Endpoint)
+		require.Equal(t, HappyEyeballsWon, attempts[0].Outcome)
+		require.Equal(t, happyEyeballsTestV4, attempts[1].Endpoint)
+		require.Equal(t, HappyEyeballsNotStarted, attempts[1].Outcome)
+	})
+
+	t.Run("starts the next attempt after the delay", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: happyEyeballsTestHang,
+			happyEyeballsTestV4: happyEyeballsTestSucceed,
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		he.AttemptDelay = 10 * time.Millisecond
+		_, attempts, err := he.Dial(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, HappyEyeballsCanceled, attempts[0].Outcome)
+		require.ErrorIs(t, attempts[0].Err, context.Canceled)
+		require.Equal(t, HappyEyeballsWon, attempts[1].Outcome)
+		require.GreaterOrEqual(t, attempts[1].Started, he.AttemptDelay)
+	})
+
+	t.Run("starts the next attempt immediately on failure", func(t *testing.T) {
+		expected := errors.New("network unreachable")
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: func(ctx context.Context) (StreamOpener, error) { return nil, expected },
+			happyEyeballsTestV4: happyEyeballsTestSucceed,
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		he.AttemptDelay = time.Hour
+		_, attempts, err := he.Dial(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, HappyEyeballsFailed, attempts[0].Outcome)
+		require.ErrorIs(t, attempts[0].Err, expected)
+		require.Equal(t, HappyEyeballsWon, attempts[1].Outcome)
+	})
+
+	t.Run("closes the connections of the losers", func(t *testing.T) {
+		var closed atomic.Int64
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: func(ctx context.Context) (StreamOpener, error) {
+				<-ctx.Done() // ignore the cancellation and connect anyway
+				return &FuncStreamOpener{CloseFunc: func() error {
+					closed.Add(1)
+					return nil
+				}}, nil
+			},
+			happyEyeballsTestV4: happyEyeballsTestSucceed,
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		he.AttemptDelay = time.Millisecond
+		_, attempts, err := he.Dial(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, HappyEyeballsLost, attempts[0].Outcome)
+		require.NoError(t, attempts[0].Err)
+		require.Equal(t, HappyEyeballsWon, attempts[1].Outcome)
+		require.Equal(t, int64(1), closed.Load())
+	})
+
+	t.Run("returns all the errors when all attempts fail", func(t *testing.T) {
+		errV6 := errors.New("network unreachable")
+		errV4 := errors.New("connection refused")
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: func(ctx context.Context) (StreamOpener, error) { return nil, errV6 },
+			happyEyeballsTestV4: func(ctx context.Context) (StreamOpener, error) { return nil, errV4 },
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		var observed []HappyEyeballsAttempt
+		he.ObserveAttempt = func(attempt HappyEyeballsAttempt) {
+			observed = append(observed, attempt)
+		}
+		conn, attempts, err := he.Dial(context.Background())
+		require.ErrorIs(t, err, errV6)
+		require.ErrorIs(t, err, errV4)
+		require.Nil(t, conn)
+		require.Equal(t, attempts, observed)
+		require.Equal(t, HappyEyeballsFailed, attempts[0].Outcome)
+		require.Equal(t, HappyEyeballsFailed, attempts[1].Outcome)
+	})
+
+	t.Run("honours the context", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV6: happyEyeballsTestHang,
+			happyEyeballsTestV4: happyEyeballsTestHang,
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		he.AttemptDelay = time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, attempts, err := he.Dial(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, HappyEyeballsCanceled, attempts[0].Outcome)
+		require.Equal(t, HappyEyeballsCanceled, attempts[1].Outcome)
+	})
+
+	t.Run("fails without endpoints", func(t *testing.T) {
+		he := NewHappyEyeballs(newHappyEyeballsTestTransport(nil))
+		_, _, err := he.Dial(context.Background())
+		require.ErrorIs(t, err, ErrHappyEyeballsNoEndpoints)
+	})
+}
+
+func TestHappyEyeballsExchange(t *testing.T) {
+	t.Run("uses the winning connection", func(t *testing.T) {
+		handler := HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			resp := &dns.Msg{}
+			resp.SetReply(query)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   netip.MustParseAddr("8.8.8.8").AsSlice(),
+			}}
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), happyEyeballsTestV4)
+		he := NewHappyEyeballs(dt, happyEyeballsTestV6, happyEyeballsTestV4)
+		resp, attempts, err := he.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, HappyEyeballsWon, attempts[0].Outcome)
+	})
+
+	t.Run("returns the dial error", func(t *testing.T) {
+		expected := errors.New("network unreachable")
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV4: func(ctx context.Context) (StreamOpener, error) { return nil, expected },
+		})
+		he := NewHappyEyeballs(dt, happyEyeballsTestV4)
+		_, attempts, err := he.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+		require.Len(t, attempts, 1)
+	})
+}
+
+func TestHappyEyeballsInterleave(t *testing.T) {
+	v6a := netip.MustParseAddrPort("[2001:db8::1]:53")
+	v6b := netip.MustParseAddrPort("[2001:db8::2]:53")
+	v4a := netip.MustParseAddrPort("192.0.2.1:53")
+	v4b := netip.MustParseAddrPort("192.0.2.2:53")
+	v4c := netip.MustParseAddrPort("[::ffff:192.0.2.3]:53")
+	require.Equal(t,
+		[]netip.AddrPort{v6a, v4a, v6b, v4b, v4c},
+		happyEyeballsInterleave([]netip.AddrPort{v4a, v4b, v6a, v4c, v6b}),
+	)
+}
+
+func TestHappyEyeballsOutcomeString(t *testing.T) {
+	require.Equal(t, "notStarted", HappyEyeballsNotStarted.String())
+	require.Equal(t, "won", HappyEyeballsWon.String())
+	require.Equal(t, "lost", HappyEyeballsLost.String())
+	require.Equal(t, "failed", HappyEyeballsFailed.String())
+	require.Equal(t, "canceled", HappyEyeballsCanceled.String())
+	require.Equal(t, "unknown", HappyEyeballsOutcome(42).String())
+}
@@ -0,0 +1,96 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrShortHeader indicates that a raw message is shorter than the DNS header.
+var ErrShortHeader = errors.New("dnsoverstream: message shorter than DNS header")
+
+// HeaderSize is the size of the DNS message header (RFC 1035 Section 4.1.1).
+const HeaderSize = 12
+
+// Header is the DNS message header decoded without unpacking the whole message.
+//
+// Construct using [DecodeHeader].
+type Header struct {
+	// ID is the message ID.
+	ID uint16
+
+	// Response is the QR bit.
+	Response bool
+
+	// Opcode is the 4-bit opcode.
+	Opcode int
+
+	// Authoritative is the AA bit.
+	Authoritative bool
+
+	// Truncated is the TC bit.
+	Truncated bool
+
+	// RecursionDesired is the RD bit.
+	RecursionDesired bool
+
+	// RecursionAvailable is the RA bit.
+	RecursionAvailable bool
+
+	// Zero is the Z bit.
+	Zero bool
+
+	// AuthenticatedData is the AD bit.
+	AuthenticatedData bool
+
+	// CheckingDisabled is the CD bit.
+	CheckingDisabled bool
+
+	// Rcode is the 4-bit response code.
+	//
+	// Extended response codes require parsing the EDNS(0) OPT record,
+	// so this field only contains the lower 4 bits.
+	Rcode int
+
+	// QDCount is the number of entries in the question section.
+	QDCount uint16
+
+	// ANCount is the number of RRs in the answer section.
+	ANCount uint16
+
+	// NSCount is the number of RRs in the authority section.
+	NSCount uint16
+
+	// ARCount is the number of RRs in the additional section.
+	ARCount uint16
+}
+
+// DecodeHeader decodes the [Header] from the first [HeaderSize] bytes of
+// a raw DNS message, without unpacking the rest of the message.
+//
+// This function returns [ErrShortHeader] if the message is too short.
+func DecodeHeader(raw []byte) (Header, error) {
+	if len(raw) < HeaderSize {
+		return Header{}, ErrShortHeader
+	}
+	flags := binary.BigEndian.Uint16(raw[2:4])
+	hdr := Header{
+		ID:                 binary.BigEndian.Uint16(raw[0:2]),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             int(flags>>11) & 0x0f,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		Zero:               flags&(1<<6) != 0,
+		AuthenticatedData:  flags&(1<<5) != 0,
+		CheckingDisabled:   flags&(1<<4) != 0,
+		Rcode:              int(flags & 0x0f),
+		QDCount:            binary.BigEndian.Uint16(raw[4:6]),
+		ANCount:            binary.BigEndian.Uint16(raw[6:8]),
+		NSCount:            binary.BigEndian.Uint16(raw[8:10]),
+		ARCount:            binary.BigEndian.Uint16(raw[10:12]),
+	}
+	return hdr, nil
+}
@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	t.Run("with a packed message", func(t *testing.T) {
+		query := &dns.Msg{}
+		query.SetQuestion("example.com.", dns.TypeA)
+		msg := &dns.Msg{}
+		msg.SetRcode(query, dns.RcodeRefused)
+		msg.Id = 0xabcd
+		msg.Opcode = dns.OpcodeNotify
+		msg.Authoritative = true
+		msg.Truncated = true
+		msg.RecursionDesired = true
+		msg.RecursionAvailable = true
+		msg.Zero = true
+		msg.AuthenticatedData = true
+		msg.CheckingDisabled = true
+		msg.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}}}
+		msg.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.example.com."}}
+		msg.SetEdns0(1232, false)
+		raw, err := msg.Pack()
+		require.NoError(t, err)
+
+		hdr, err := DecodeHeader(raw)
+		require.NoError(t, err)
+		require.Equal(t, Header{
+			ID:                 0xabcd,
+			Response:           true,
+			Opcode:             dns.OpcodeNotify,
+			Authoritative:      true,
+			Truncated:          true,
+			RecursionDesired:   true,
+			RecursionAvailable: true,
+			Zero:               true,
+			AuthenticatedData:  true,
+			CheckingDisabled:   true,
+			Rcode:              dns.RcodeRefused,
+			QDCount:            1,
+			ANCount:            1,
+			NSCount:            1,
+			ARCount:            1,
+		}, hdr)
+	})
+
+	t.Run("with a short message", func(t *testing.T) {
+		_, err := DecodeHeader(make([]byte, HeaderSize-1))
+		require.ErrorIs(t, err, ErrShortHeader)
+	})
+}
@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// DefaultHedgeDelay is the default delay after which [*Hedge] sends
+// the query again if it did not receive a response yet.
+const DefaultHedgeDelay = 100 * time.Millisecond
+
+// HedgeOutcome is the outcome of a [HedgeAttempt].
+type HedgeOutcome int
+
+const (
+	// HedgeNotStarted means that we did not start the attempt because
+	// another attempt received a response before its turn.
+	HedgeNotStarted HedgeOutcome = iota
+
+	// HedgeWon means that the attempt received the response we returned.
+	HedgeWon
+
+	// HedgeFailed means that the attempt failed.
+	HedgeFailed
+
+	// HedgeCanceled means that we canceled the attempt because another
+	// attempt received a response or the context was done.
+	HedgeCanceled
+)
+
+// String returns the name of the outcome.
+func (o HedgeOutcome) String() string {
+	switch o {
+	case HedgeNotStarted:
+		return "notStarted"
+	case HedgeWon:
+		return "won"
+	case HedgeFailed:
+		return "failed"
+	case HedgeCanceled:
+		return "canceled"
+	default:
+		return "unknown"
+	}
+}
+
+// HedgeAttempt describes an exchange attempt made by [*Hedge], including the
+// attempts that did not win, so that it is possible to analyze how often
+// hedging helps and which endpoint answered first.
+type HedgeAttempt struct {
+	// Endpoint is the endpoint we queried.
+	Endpoint netip.AddrPort
+
+	// Outcome is the [HedgeOutcome] of the attempt.
+	Outcome HedgeOutcome
+
+	// Started is the time elapsed since the beginning of the exchange when
+	// we started the attempt, which is zero for [HedgeNotStarted].
+	Started time.Duration
+
+	// ExchangeTime is the time spent by the attempt, which includes dialing.
+	ExchangeTime time.Duration
+
+	// Err is the error or nil when the attempt received a response.
+	Err error
+}
+
+// Hedge implements hedged requests, a tail-latency mitigation where, if
+// we do not receive a response within a delay, we send the same query using
+// another connection, possibly to another endpoint, and use the first
+// response, while canceling the other attempts.
+//
+// Each attempt performs a [*Transport.Exchange] using [WithEndpoint], so it
+// dials its own connection unless the [*Transport] uses a [*Pool], and the
+// endpoints must be valid for the [*Transport] dialer.
+//
+// Construct using [NewHedge].
+type Hedge struct {
+	// Transport is the MANDATORY [*Transport] used to exchange.
+	Transport *Transport
+
+	// Endpoints contains the OPTIONAL endpoints to query in order. If empty,
+	// we send the query twice to the [*Transport] endpoint, which is useful
+	// to mitigate losses and slow connections to a single server.
+	Endpoints []netip.AddrPort
+
+	// Delay is the OPTIONAL delay before starting the next attempt while
+	// the previous ones are still pending. If zero or negative, we use
+	// [DefaultHedgeDelay]. We start the next attempt immediately when
+	// an attempt fails.
+	Delay time.Duration
+
+	// ObserveAttempt is an optional hook called after the exchange for
+	// each attempt, in the order we started them.
+	ObserveAttempt func(HedgeAttempt)
+}
+
+// NewHedge creates a new [*Hedge] with the given [*Transport] and endpoints.
+func NewHedge(dt *Transport, endpoints ...netip.AddrPort) *Hedge {
+	return &Hedge{Transport: dt, Endpoints: endpoints}
+}
+
+// hedgeResult is the result of a single exchange.
+type hedgeResult struct {
+	index   int
+	resp    *dnscodec.Response
+	elapsed time.Duration
+	err     error
+}
+
+// Exchange sends the query, sending it again after the delay until receiving a
+// response, and returns the first response along with all the attempts,
+// regardless of whether the exchange succeeded.
+//
+// We wait for the canceled attempts to complete before returning, so
+// that their outcome is known.
+func (h *Hedge) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, []HedgeAttempt, error) {
+	// 1. prepare the attempts
+	dt := h.Transport
+	endpoints := h.Endpoints
+	if len(endpoints) <= 0 {
+		endpoints = []netip.AddrPort{dt.endpointFor(ctx), dt.endpointFor(ctx)}
+	}
+	attempts := make([]HedgeAttempt, len(endpoints))
+	for idx, endpoint := range endpoints {
+		attempts[idx].Endpoint = endpoint
+	}
+	delay := h.Delay
+	if delay <= 0 {
+		delay = DefaultHedgeDelay
+	}
+
+	// 2. start the first attempt
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, len(attempts))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	t0 := dt.now()
+	var next, running int
+	start := func() {
+		idx := next
+		next++
+		running++
+		attempts[idx].Started = dt.since(t0)
+		dt.execute(func() {
+			t := dt.now()
+			resp, err := dt.Exchange(WithEndpoint(hedgeCtx, attempts[idx].Endpoint), query)
+			results <- hedgeResult{index: idx, resp: resp, elapsed: dt.since(t), err: err}
+		})
+		timer.Reset(delay)
+	}
+	start()
+
+	// 3. start the next attempt when the delay expires or the previous
+	// attempt fails, until an attempt wins or all attempts fail
+	var winner *dnscodec.Response
+	for running > 0 {
+		var timerC <-chan time.Time
+		if winner == nil && next < len(attempts) {
+			timerC = timer.C
+		}
+		select {
+		case <-timerC:
+			start()
+
+		case result := <-results:
+			running--
+			attempt := &attempts[result.index]
+			attempt.ExchangeTime, attempt.Err = result.elapsed, result.err
+			switch {
+			case result.err == nil && winner == nil:
+				attempt.Outcome = HedgeWon
+				winner = result.resp
+				cancel()
+			case result.err == nil || hedgeCtx.Err() != nil:
+				// a response arriving after the winner counts as canceled
+				attempt.Outcome = HedgeCanceled
+			default:
+				attempt.Outcome = HedgeFailed
+				if next < len(attempts) && ctx.Err() == nil {
+					start()
+				}
+			}
+		}
+	}
+
+	// 4. emit the telemetry and return the outcome
+	if h.ObserveAttempt != nil {
+		for _, attempt := range attempts {
+			h.ObserveAttempt(attempt)
+		}
+	}
+	if winner == nil {
+		var errs []error
+		for _, attempt := range attempts {
+			errs = append(errs, attempt.Err)
+		}
+		return nil, attempts, wrapContextError(ctx, errors.Join(errs...))
+	}
+	return winner, attempts, nil
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Endpoints used by the [*Hedge] tests.
+var (
+	hedgeTestFirst  = netip.MustParseAddrPort("192.0.2.1:53")
+	hedgeTestSecond = netip.MustParseAddrPort("192.0.2.2:53")
+)
+
+// hedgeTestAnswer is a dial function returning a connection answering queries.
+func hedgeTestAnswer(ctx context.Context) (StreamOpener, error) {
+	return NewHandlerStreamOpener(newBenchHandler()), nil
+}
+
+func TestHedgeExchange(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("does not hedge when the first attempt answers", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			hedgeTestFirst:  hedgeTestAnswer,
+			hedgeTestSecond: hedgeTestAnswer,
+		})
+		hedge := NewHedge(dt, hedgeTestFirst, hedgeTestSecond)
+		hedge.Delay = time.Hour
+		resp, attempts, err := hedge.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Len(t, attempts, 2)
+		require.Equal(t, HedgeWon, attempts[0].Outcome)
+		require.Equal(t, HedgeNotStarted, attempts[1].Outcome)
+	})
+
+	t.Run("hedges after the delay", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			hedgeTestFirst:  happyEyeballsTestHang,
+			hedgeTestSecond: hedgeTestAnswer,
+		})
+		hedge := NewHedge(dt, hedgeTestFirst, hedgeTestSecond)
+		hedge.Delay = 10 * time.Millisecond
+		var observed []HedgeAttempt
+		hedge.ObserveAttempt = func(attempt HedgeAttempt) {
+			observed = append(observed, attempt)
+		}
+		resp, attempts, err := hedge.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Equal(t, HedgeCanceled, attempts[0].Outcome)
+		require.ErrorIs(t, attempts[0].Err, context.Canceled)
+		require.Equal(t, HedgeWon, attempts[1].Outcome)
+		require.GreaterOrEqual(t, attempts[1].Started, hedge.Delay)
+		require.Equal(t, attempts, observed)
+	})
+
+	t.Run("hedges immediately on failure", func(t *testing.T) {
+		expected := errors.New("connection refused")
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			hedgeTestFirst:  func(ctx context.Context) (StreamOpener, error) { return nil, expected },
+			hedgeTestSecond: hedgeTestAnswer,
+		})
+		hedge := NewHedge(dt, hedgeTestFirst, hedgeTestSecond)
+		hedge.Delay = time.Hour
+		_, attempts, err := hedge.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, HedgeFailed, attempts[0].Outcome)
+		require.ErrorIs(t, attempts[0].Err, expected)
+		require.Equal(t, HedgeWon, attempts[1].Outcome)
+	})
+
+	t.Run("returns all the errors when all attempts fail", func(t *testing.T) {
+		err1, err2 := errors.New("connection refused"), errors.New("network unreachable")
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			hedgeTestFirst:  func(ctx context.Context) (StreamOpener, error) { return nil, err1 },
+			hedgeTestSecond: func(ctx context.Context) (StreamOpener, error) { return nil, err2 },
+		})
+		hedge := NewHedge(dt, hedgeTestFirst, hedgeTestSecond)
+		_, attempts, err := hedge.Exchange(context.Background(), query)
+		require.ErrorIs(t, err, err1)
+		require.ErrorIs(t, err, err2)
+		require.Equal(t, HedgeFailed, attempts[0].Outcome)
+		require.Equal(t, HedgeFailed, attempts[1].Outcome)
+	})
+
+	t.Run("sends the query twice to the transport endpoint by default", func(t *testing.T) {
+		dt := newHappyEyeballsTestTransport(map[netip.AddrPort]func(ctx context.Context) (StreamOpener, error){
+			happyEyeballsTestV4: happyEyeballsTestHang,
+		})
+		hedge := NewHedge(dt)
+		hedge.Delay = time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, attempts, err := hedge.Exchange(ctx, query)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Len(t, attempts, 2)
+		for _, attempt := range attempts {
+			require.Equal(t, happyEyeballsTestV4, attempt.Endpoint)
+			require.Equal(t, HedgeCanceled, attempt.Outcome)
+		}
+	})
+}
+
+func TestHedgeOutcomeString(t *testing.T) {
+	require.Equal(t, "notStarted", HedgeNotStarted.String())
+	require.Equal(t, "won", HedgeWon.String())
+	require.Equal(t, "failed", HedgeFailed.String())
+	require.Equal(t, "canceled", HedgeCanceled.String())
+	require.Equal(t, "unknown", HedgeOutcome(42).String())
+}
@@ -0,0 +1,176 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// HPKE identifiers of the only suite we support (RFC 9180 Section 7),
+// which is the one Oblivious DoH targets commonly use.
+const (
+	hpkeKEMX25519HKDFSHA256 = 0x0020
+	hpkeKDFHKDFSHA256       = 0x0001
+	hpkeAEADAES128GCM       = 0x0001
+)
+
+// HPKE sizes for the suite we support.
+const (
+	hpkeKeySize   = 16
+	hpkeNonceSize = 12
+	hpkeHashSize  = 32
+)
+
+// hpkeContext is an HPKE base mode context (RFC 9180 Section 5.1).
+//
+// We only use each context to seal or open a single message, since
+// Oblivious DoH uses a new context for each query, so we always use
+// the base nonce rather than tracking the sequence number.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+// hpkeSetupBaseS creates a sender context for pkR using an ephemeral
+// key pair and returns the encapsulated key along with the context.
+func hpkeSetupBaseS(pkR []byte, info []byte) ([]byte, *hpkeContext, error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hpkeSetupBaseSWithKey(pkR, info, skE)
+}
+
+// hpkeSetupBaseSWithKey is like [hpkeSetupBaseS] with an explicit
+// ephemeral private key, which allows to use test vectors.
+func hpkeSetupBaseSWithKey(pkR []byte, info []byte, skE *ecdh.PrivateKey) ([]byte, *hpkeContext, error) {
+	// 1. compute the shared secret (RFC 9180 Section 4.1)
+	pub, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := skE.ECDH(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := skE.PublicKey().Bytes()
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	secret, err := hpkeExtractAndExpand(dh, kemContext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2. derive the context using the shared secret
+	ctx, err := hpkeKeySchedule(secret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// hpkeExtractAndExpand derives the KEM shared secret (RFC 9180 Section 4.1).
+func hpkeExtractAndExpand(dh, kemContext []byte) ([]byte, error) {
+	suiteID := binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519HKDFSHA256)
+	prk, err := hpkeLabeledExtract(suiteID, nil, "eae_prk", dh)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeLabeledExpand(suiteID, prk, "shared_secret", kemContext, hpkeHashSize)
+}
+
+// hpkeKeySchedule derives the base mode context (RFC 9180 Section 5.1).
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	// 1. compute the key schedule context without PSK
+	suiteID := hpkeSuiteID()
+	pskIDHash, err := hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)
+	if err != nil {
+		return nil, err
+	}
+	infoHash, err := hpkeLabeledExtract(suiteID, nil, "info_hash", info)
+	if err != nil {
+		return nil, err
+	}
+	scheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...)
+
+	// 2. derive the key, the base nonce, and the exporter secret
+	secret, err := hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hpkeLabeledExpand(suiteID, secret, "key", scheduleContext, hpkeKeySize)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce, err := hpkeLabeledExpand(suiteID, secret, "base_nonce", scheduleContext, hpkeNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	exporterSecret, err := hpkeLabeledExpand(suiteID, secret, "exp", scheduleContext, hpkeHashSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. create the AEAD
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{aead: aead, baseNonce: baseNonce, exporterSecret: exporterSecret}, nil
+}
+
+// seal encrypts the first and only message of the context.
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.baseNonce, plaintext, aad)
+}
+
+// open decrypts the first and only message of the context.
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.baseNonce, ciphertext, aad)
+}
+
+// export derives a secret from the context (RFC 9180 Section 5.3).
+func (c *hpkeContext) export(exporterContext string, length int) ([]byte, error) {
+	return hpkeLabeledExpand(hpkeSuiteID(), c.exporterSecret, "sec", []byte(exporterContext), length)
+}
+
+// hpkeSuiteID returns the suite identifier of the context (RFC 9180 Section 5.1).
+func hpkeSuiteID() []byte {
+	suiteID := []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKEMX25519HKDFSHA256)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKDFHKDFSHA256)
+	return binary.BigEndian.AppendUint16(suiteID, hpkeAEADAES128GCM)
+}
+
+// hpkeLabeledExtract implements LabeledExtract (RFC 9180 Section 4).
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) ([]byte, error) {
+	labeled := append([]byte("HPKE-v1"), suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, ikm...)
+	return hkdf.Extract(sha256.New, labeled, salt)
+}
+
+// hpkeLabeledExpand implements LabeledExpand (RFC 9180 Section 4).
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeled := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeled = append(labeled, "HPKE-v1"...)
+	labeled = append(labeled, suiteID...)
+	labeled = append(labeled, label...)
+	labeled = append(labeled, info...)
+	return hkdf.Expand(sha256.New, prk, string(labeled), length)
+}
+
+// newAESGCM creates an AES-GCM [cipher.AEAD] using key.
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
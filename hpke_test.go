@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hpkeSetupBaseR creates a recipient context, which we only need
+// for implementing Oblivious DoH targets in tests.
+func hpkeSetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, enc...), skR.PublicKey().Bytes()...)
+	secret, err := hpkeExtractAndExpand(dh, kemContext)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeKeySchedule(secret, info)
+}
+
+// mustDecodeHex decodes a hex string or panics.
+func mustDecodeHex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestHPKETestVector(t *testing.T) {
+	// RFC 9180 Appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	info := mustDecodeHex("4f6465206f6e2061204772656369616e2055726e")
+	skE, err := ecdh.X25519().NewPrivateKey(mustDecodeHex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	require.NoError(t, err)
+	skR, err := ecdh.X25519().NewPrivateKey(mustDecodeHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	require.NoError(t, err)
+	pkR := mustDecodeHex("3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	require.Equal(t, pkR, skR.PublicKey().Bytes())
+
+	t.Run("sender", func(t *testing.T) {
+		enc, ctx, err := hpkeSetupBaseSWithKey(pkR, info, skE)
+		require.NoError(t, err)
+		require.Equal(t, mustDecodeHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"), enc)
+		ciphertext := ctx.seal([]byte("Count-0"), []byte("Beauty is truth, truth beauty"))
+		require.Equal(t, mustDecodeHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"), ciphertext)
+		exported, err := ctx.export("", 32)
+		require.NoError(t, err)
+		require.Equal(t, mustDecodeHex("3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"), exported)
+	})
+
+	t.Run("recipient", func(t *testing.T) {
+		enc := mustDecodeHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+		ctx, err := hpkeSetupBaseR(enc, skR, info)
+		require.NoError(t, err)
+		plaintext, err := ctx.open([]byte("Count-0"), mustDecodeHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"))
+		require.NoError(t, err)
+		require.Equal(t, "Beauty is truth, truth beauty", string(plaintext))
+	})
+}
+
+func TestHPKESetupBaseS(t *testing.T) {
+	t.Run("uses a new ephemeral key each time", func(t *testing.T) {
+		skR, err := ecdh.X25519().GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		enc1, _, err := hpkeSetupBaseS(skR.PublicKey().Bytes(), nil)
+		require.NoError(t, err)
+		enc2, _, err := hpkeSetupBaseS(skR.PublicKey().Bytes(), nil)
+		require.NoError(t, err)
+		require.NotEqual(t, enc1, enc2)
+	})
+
+	t.Run("fails with an invalid public key", func(t *testing.T) {
+		_, _, err := hpkeSetupBaseS([]byte{1, 2, 3}, nil)
+		require.Error(t, err)
+	})
+}
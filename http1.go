@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errHTTP1Unusable indicates that a previous request left the HTTP/1.1
+// connection in an unknown state, so we cannot send more requests.
+var errHTTP1Unusable = errors.New("dnsoverstream: HTTP/1.1 connection unusable")
+
+// http1ClientConn is a minimal HTTP/1.1 client connection for DNS over HTTPS.
+//
+// Unlike [*http.Transport], it never dials new connections, so that all the
+// requests of a [*httpsConn] use the same connection, like for HTTP/2. Since
+// HTTP/1.1 does not multiplex requests, we send one request at a time.
+type http1ClientConn struct {
+	br     *bufio.Reader
+	conn   net.Conn
+	mu     sync.Mutex
+	broken bool
+}
+
+// newHTTP1ClientConn creates a new [*http1ClientConn] using conn.
+func newHTTP1ClientConn(conn net.Conn) *http1ClientConn {
+	return &http1ClientConn{br: bufio.NewReader(conn), conn: conn}
+}
+
+// Close closes the underlying connection.
+func (c *http1ClientConn) Close() error {
+	return c.conn.Close()
+}
+
+// RoundTrip sends the request and returns the response, whose body
+// we read in full, so that the connection is ready for the next request.
+func (c *http1ClientConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	// 1. wait for previous requests to complete
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return nil, errHTTP1Unusable
+	}
+
+	// 2. honour the request context by interrupting any pending I/O
+	stop := context.AfterFunc(req.Context(), func() {
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	// 3. perform the round trip
+	resp, err := c.roundTrip(req)
+
+	// 4. give up on the connection when its state is unknown
+	if !stop() || err != nil || resp.Close {
+		c.broken = true
+	}
+	return resp, err
+}
+
+// roundTrip is the internal implementation of RoundTrip.
+func (c *http1ClientConn) roundTrip(req *http.Request) (*http.Response, error) {
+	// 1. send the request
+	if err := req.Write(c.conn); err != nil {
+		return nil, err
+	}
+
+	// 2. read the response and the body, which must fit into a frame
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) >= 1<<16 {
+		resp.Close = true // we did not consume the whole body
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
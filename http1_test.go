@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// serveHTTP1TestConn reads a request from conn and writes the raw response.
+func serveHTTP1TestConn(conn net.Conn, rawResp string) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	io.Copy(io.Discard, req.Body)
+	io.WriteString(conn, rawResp)
+}
+
+func TestHTTP1ClientConn(t *testing.T) {
+	newRequest := func() *http.Request {
+		req, err := http.NewRequestWithContext(context.Background(),
+			http.MethodPost, "https://example.com/dns-query", bytes.NewReader([]byte{1, 2, 3}))
+		require.NoError(t, err)
+		return req
+	}
+
+	t.Run("gives up on the connection when the server closes it", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveHTTP1TestConn(server, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok")
+		cc := newHTTP1ClientConn(client)
+		resp, err := cc.RoundTrip(newRequest())
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, "ok", string(body))
+		_, err = cc.RoundTrip(newRequest())
+		require.ErrorIs(t, err, errHTTP1Unusable)
+	})
+
+	t.Run("gives up on the connection when the body is too large", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveHTTP1TestConn(server, "HTTP/1.1 200 OK\r\nContent-Length: 65537\r\n\r\n"+strings.Repeat("x", 65537))
+		cc := newHTTP1ClientConn(client)
+		resp, err := cc.RoundTrip(newRequest())
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Len(t, body, 1<<16)
+		_, err = cc.RoundTrip(newRequest())
+		require.ErrorIs(t, err, errHTTP1Unusable)
+	})
+
+	t.Run("returns the read error", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			serveHTTP1TestConn(server, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nok")
+			server.Close()
+		}()
+		_, err := newHTTP1ClientConn(client).RoundTrip(newRequest())
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
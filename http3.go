@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ProtocolHTTP3 is the protocol name used by [PoolKey] for DNS over HTTP/3.
+const ProtocolHTTP3 = "http3"
+
+// http3NoError is the H3_NO_ERROR error code (RFC 9114 Section 8.1).
+const http3NoError = quic.ApplicationErrorCode(http3.ErrCodeNoError)
+
+// NewTLSConfigDNSOverHTTP3 returns the [*tls.Config] to use for DNS-over-HTTP/3.
+func NewTLSConfigDNSOverHTTP3(serverName string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h3"},
+		ServerName: serverName,
+	}
+}
+
+// StreamOpenerDialerHTTP3 implements [StreamOpenerDialer] for DNS over HTTPS
+// using HTTP/3 (RFC 8484 and RFC 9114), where each [Stream] is a POST request
+// sent over a QUIC stream, so that it is possible to compare DoH/H3 with DoH/H2
+// and DoQ using the same [*Transport].
+//
+// We use quic-go's HTTP/3 client on top of the QUIC connection.
+//
+// Construct using [NewStreamOpenerDialerHTTP3].
+type StreamOpenerDialerHTTP3 struct {
+	// Dialer is the underlying [*QUICDialer], whose [*tls.Config] must
+	// include "h3" in NextProtos (see [NewTLSConfigDNSOverHTTP3]).
+	Dialer *QUICDialer
+
+	// Path is the OPTIONAL URL path. If empty, we use [DefaultHTTPSPath].
+	Path string
+
+	// Host is the OPTIONAL host used for the HTTP authority. If empty, we
+	// use the TLS ServerName of the Dialer or, if unknown, the endpoint.
+	Host string
+}
+
+// NewStreamOpenerDialerHTTP3 creates a new [*StreamOpenerDialerHTTP3].
+func NewStreamOpenerDialerHTTP3(dialer *QUICDialer) *StreamOpenerDialerHTTP3 {
+	return &StreamOpenerDialerHTTP3{Dialer: dialer}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerHTTP3{}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *StreamOpenerDialerHTTP3) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	// 1. establish the QUIC connection
+	qconn, err := d.Dialer.Dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. create the HTTP/3 client connection, which sends SETTINGS
+	// on the control stream (RFC 9114 Section 6.2.1)
+	cc := (&http3.Transport{DisableCompression: true}).NewClientConn(qconn)
+
+	// 3. compute the request URL
+	var serverName string
+	if d.Dialer.TLSConfig != nil {
+		serverName = d.Dialer.TLSConfig.ServerName
+	}
+	host := httpsAuthority(d.Host, serverName, address)
+	conn := &http3Conn{
+		cc:    &http3ClientConn{cc: cc},
+		qconn: qconn,
+		url:   (&url.URL{Scheme: "https", Host: host, Path: httpsPath(d.Path)}).String(),
+	}
+	return conn, nil
+}
+
+// http3ClientConn adapts a [*http3.ClientConn] to [httpsRoundTripper].
+type http3ClientConn struct {
+	cc   *http3.ClientConn
+	once sync.Once
+}
+
+// Close implements [httpsRoundTripper].
+//
+// This closes the connection using H3_NO_ERROR (RFC 9114 Section 5.2).
+func (c *http3ClientConn) Close() (err error) {
+	c.once.Do(func() {
+		err = c.cc.CloseWithError(http3NoError, "")
+	})
+	return
+}
+
+// RoundTrip implements [httpsRoundTripper].
+func (c *http3ClientConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.cc.RoundTrip(req)
+	if err != nil {
+		return nil, wrapICMPError(err)
+	}
+	return resp, nil
+}
+
+// http3Conn implements [StreamOpener] for DNS over HTTP/3.
+//
+// Each [Stream] is a [*httpsStream], so that the request and the response
+// checks are the same as for DNS over HTTP/2 and HTTP/1.1.
+type http3Conn struct {
+	cc    *http3ClientConn
+	qconn *quic.Conn
+	url   string
+}
+
+// Close implements [StreamOpener].
+func (c *http3Conn) Close() error {
+	return c.cc.Close()
+}
+
+// MutateQuery implements [StreamOpener].
+func (c *http3Conn) MutateQuery(msg *dnscodec.Query) {
+	QueryParamsHTTPS().MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (c *http3Conn) OpenStream() (Stream, error) {
+	return &httpsStream{cc: c.cc, url: c.url}, nil
+}
@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+// newDoH3TestServer starts an HTTP/3 DNS-over-HTTPS server on 127.0.0.1
+// using handler and returns its endpoint.
+func newDoH3TestServer(t *testing.T, handler http.Handler) netip.AddrPort {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{newTestCert()}}),
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() { srv.Serve(pconn) })
+	t.Cleanup(func() {
+		srv.Close()
+		wg.Wait()
+		pconn.Close()
+	})
+	return pconn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// recordDoH3TestRequests returns a handler sending each request to the returned
+// channel before invoking handler, since the server uses a goroutine per request.
+func recordDoH3TestRequests(handler http.Handler) (http.Handler, <-chan *http.Request) {
+	requests := make(chan *http.Request, 16)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		handler.ServeHTTP(w, r)
+	}), requests
+}
+
+// newDoH3TestTransport returns a [*Transport] for DNS over HTTP/3 trusting [testPKI].
+func newDoH3TestTransport(t *testing.T, endpoint netip.AddrPort) *Transport {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pconn.Close() })
+	qd := NewQUICDialer(pconn, "example.com")
+	qd.TLSConfig = newTestClientTLSConfig("h3")
+	return NewTransport(NewStreamOpenerDialerHTTP3(qd), endpoint)
+}
+
+func TestStreamOpenerDialerHTTP3(t *testing.T) {
+	t.Run("exchanges using POST", func(t *testing.T) {
+		handler, requests := recordDoH3TestRequests(newDoHTestHandler(dohTestAnswer, nil))
+		endpoint := newDoH3TestServer(t, handler)
+		dt := newDoH3TestTransport(t, endpoint)
+		var rawQuery []byte
+		dt.ObserveRawQuery = func(data []byte) {
+			rawQuery = data
+		}
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+		require.Len(t, requests, 1)
+		req := <-requests
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "/dns-query", req.URL.Path)
+		require.Equal(t, "example.com", req.Host)
+		require.Equal(t, "application/dns-message", req.Header.Get("Content-Type"))
+		require.Equal(t, "application/dns-message", req.Header.Get("Accept"))
+		require.Empty(t, req.Header.Get("Accept-Encoding"))
+		require.Equal(t, int64(len(rawQuery)), req.ContentLength)
+		require.Equal(t, 3, req.ProtoMajor)
+
+		// the query ID is zero (RFC 8484 Section 4.1)
+		query := &dns.Msg{}
+		require.NoError(t, query.Unpack(rawQuery))
+		require.Zero(t, query.Id)
+	})
+
+	t.Run("reuses the connection for multiple requests", func(t *testing.T) {
+		endpoint := newDoH3TestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		dt := newDoH3TestTransport(t, endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, HandshakeFull, StreamOpenerHandshakeKind(conn))
+		for range 3 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("uses the configured path and host", func(t *testing.T) {
+		handler, requests := recordDoH3TestRequests(newDoHTestHandler(dohTestAnswer, nil))
+		endpoint := newDoH3TestServer(t, handler)
+		dt := newDoH3TestTransport(t, endpoint)
+		dt.dialer.(*StreamOpenerDialerHTTP3).Path = "/custom"
+		dt.dialer.(*StreamOpenerDialerHTTP3).Host = "dns.example.com"
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		req := <-requests
+		require.Equal(t, "/custom", req.URL.Path)
+		require.Equal(t, "dns.example.com", req.Host)
+	})
+
+	t.Run("returns HTTPSStatusError for unexpected status codes", func(t *testing.T) {
+		endpoint := newDoH3TestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		_, err := newDoH3TestTransport(t, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		var statusErr *HTTPSStatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusTeapot, statusErr.StatusCode)
+	})
+
+	t.Run("rejects unexpected content types", func(t *testing.T) {
+		endpoint := newDoH3TestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+		}))
+		_, err := newDoH3TestTransport(t, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("honours the context deadline", func(t *testing.T) {
+		endpoint := newDoH3TestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := newDoH3TestTransport(t, endpoint).Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("uses the pool key protocol and server name", func(t *testing.T) {
+		dt := newDoH3TestTransport(t, netip.MustParseAddrPort("127.0.0.1:443"))
+		key := newPoolKey(dt.dialer, dt.endpoint)
+		require.Equal(t, ProtocolHTTP3, key.Protocol)
+		require.Equal(t, "example.com", key.ServerName)
+	})
+}
+
+func TestHTTP3StreamRejectsInvalidFrames(t *testing.T) {
+	endpoint := newDoH3TestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+	dt := newDoH3TestTransport(t, endpoint)
+	conn, err := dt.Dial(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := conn.OpenStream()
+	require.NoError(t, err)
+	_, err = stream.Write([]byte{0, 5, 1})
+	require.NoError(t, err)
+	_, err = stream.Read(make([]byte, 2))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestNewTLSConfigDNSOverHTTP3(t *testing.T) {
+	cfg := NewTLSConfigDNSOverHTTP3("dns.example.com")
+
+	require.Equal(t, "dns.example.com", cfg.ServerName)
+	require.Equal(t, []string{"h3"}, cfg.NextProtos)
+}
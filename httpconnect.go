@@ -0,0 +1,164 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ErrHTTPConnect indicates that the HTTP proxy refused or failed our CONNECT request.
+var ErrHTTPConnect = errors.New("dnsoverstream: HTTP CONNECT proxy error")
+
+// HTTPConnectDialer implements [NetDialer] and [TLSDialer] by tunneling the
+// connection through an HTTP or HTTPS proxy using the CONNECT method (RFC 9110
+// Section 9.3.6), so that DNS over TCP and DNS over TLS (using [*NetTLSDialer])
+// work from behind corporate proxies.
+//
+// DialContext performs the CONNECT handshake, so the context bounds the
+// connect to the proxy, the TLS handshake with HTTPS proxies, and the CONNECT
+// request. We pass the destination host to the proxy as is, so that the proxy
+// resolves domain names.
+//
+// Construct using [NewHTTPConnectDialer].
+type HTTPConnectDialer struct {
+	// Dialer is the underlying [NetDialer] connecting to the proxy.
+	Dialer NetDialer
+
+	// ProxyURL is the MANDATORY proxy URL, whose scheme must be "http" or
+	// "https" (e.g., "http://proxy.example.com:3128"). When the URL has no
+	// port, we use the default port of the scheme. When the URL contains a
+	// username, we authenticate using the Basic scheme (RFC 7617).
+	ProxyURL *url.URL
+
+	// ProxyTLSConfig is the OPTIONAL [*tls.Config] for "https" proxies. Like
+	// [*NetTLSDialer], when the ServerName is empty we use the proxy host.
+	ProxyTLSConfig *tls.Config
+
+	// Header contains OPTIONAL additional headers for the CONNECT request.
+	Header http.Header
+}
+
+// NewHTTPConnectDialer creates a new [*HTTPConnectDialer] using the given
+// [NetDialer] to connect to the proxy at the given URL.
+func NewHTTPConnectDialer(dialer NetDialer, proxyURL *url.URL) *HTTPConnectDialer {
+	return &HTTPConnectDialer{Dialer: dialer, ProxyURL: proxyURL}
+}
+
+var (
+	_ NetDialer = &HTTPConnectDialer{}
+	_ TLSDialer = &HTTPConnectDialer{}
+)
+
+// DialContext implements [NetDialer] and [TLSDialer].
+//
+// We only support the "tcp", "tcp4", and "tcp6" networks.
+func (d *HTTPConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// 1. make sure we can proxy the network
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported network %q", ErrHTTPConnect, network)
+	}
+
+	// 2. connect to the proxy
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. send the CONNECT request bounded by the context
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	tunnel, err := d.handshake(conn, address)
+	if !stop() {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, wrapContextError(ctx, err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// dialProxy connects to the proxy using TLS for "https" proxies.
+func (d *HTTPConnectDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	var port string
+	switch d.ProxyURL.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	default:
+		return nil, fmt.Errorf("%w: unsupported proxy scheme %q", ErrHTTPConnect, d.ProxyURL.Scheme)
+	}
+	if d.ProxyURL.Port() != "" {
+		port = d.ProxyURL.Port()
+	}
+	proxyAddress := net.JoinHostPort(d.ProxyURL.Hostname(), port)
+	if d.ProxyURL.Scheme == "https" {
+		return NewNetTLSDialer(d.Dialer, d.ProxyTLSConfig).DialContext(ctx, "tcp", proxyAddress)
+	}
+	return d.Dialer.DialContext(ctx, "tcp", proxyAddress)
+}
+
+// handshake sends the CONNECT request for the given address and returns
+// the tunneled connection when the proxy accepts the request.
+func (d *HTTPConnectDialer) handshake(conn net.Conn, address string) (net.Conn, error) {
+	// 1. send the CONNECT request
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: d.Header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	if user := d.ProxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	// 2. read the response
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%w: %s", ErrHTTPConnect, resp.Status)
+	}
+
+	// 3. make sure we do not lose the data the proxy sent after the response
+	if reader.Buffered() > 0 {
+		return &httpConnectConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// httpConnectConn is a [net.Conn] reading the data buffered
+// while reading the CONNECT response before the connection.
+type httpConnectConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements [net.Conn].
+func (c *httpConnectConn) Read(data []byte) (int, error) {
+	return c.reader.Read(data)
+}
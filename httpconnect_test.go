@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/runtimex"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// httpConnectTestProxy is a minimal HTTP CONNECT proxy for testing.
+type httpConnectTestProxy struct {
+	// username and password, if set, require authentication.
+	username, password string
+
+	// stall, if set, makes the proxy never answer.
+	stall bool
+
+	// mu protects targets.
+	mu sync.Mutex
+
+	// targets contains the addresses the clients asked to connect to.
+	targets []string
+}
+
+// ServeHTTP implements [http.Handler].
+func (p *httpConnectTestProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 1. make sure the request is acceptable
+	if p.stall {
+		<-r.Context().Done()
+		return
+	}
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if p.username != "" {
+		r.Header.Set("Authorization", r.Header.Get("Proxy-Authorization"))
+		username, password, ok := r.BasicAuth()
+		if !ok || username != p.username || password != p.password {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.mu.Unlock()
+
+	// 2. connect to the target and relay
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(upstream, rw)
+	io.Copy(conn, upstream)
+}
+
+// Targets returns the addresses the clients asked to connect to.
+func (p *httpConnectTestProxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+
+	t.Run("DNS over TCP through an HTTP proxy", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := &httpConnectTestProxy{}
+		proxySrv := httptest.NewServer(proxy)
+		defer proxySrv.Close()
+		dialer := NewHTTPConnectDialer(&net.Dialer{}, runtimex.PanicOnError1(url.Parse(proxySrv.URL)))
+		dt := NewTransport(NewStreamOpenerDialerTCP(dialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+		require.Equal(t, []string{dnsSrv.Address()}, proxy.Targets())
+	})
+
+	t.Run("DNS over TLS through an HTTPS proxy with authentication", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := &httpConnectTestProxy{username: "alice", password: "secret"}
+		proxySrv := httptest.NewTLSServer(proxy)
+		defer proxySrv.Close()
+		proxyURL := runtimex.PanicOnError1(url.Parse(proxySrv.URL))
+		proxyURL.User = url.UserPassword("alice", "secret")
+		dialer := NewHTTPConnectDialer(&net.Dialer{}, proxyURL)
+		pool := x509.NewCertPool()
+		pool.AddCert(proxySrv.Certificate())
+		dialer.ProxyTLSConfig = &tls.Config{RootCAs: pool}
+		tlsDialer := NewNetTLSDialer(dialer, newTestClientTLSConfig())
+		dt := NewTransport(NewStreamOpenerDialerTLS(tlsDialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+	})
+
+	t.Run("fails with wrong credentials", func(t *testing.T) {
+		proxySrv := httptest.NewServer(&httpConnectTestProxy{username: "alice", password: "secret"})
+		defer proxySrv.Close()
+		proxyURL := runtimex.PanicOnError1(url.Parse(proxySrv.URL))
+		proxyURL.User = url.UserPassword("alice", "wrong")
+		conn, err := NewHTTPConnectDialer(&net.Dialer{}, proxyURL).DialContext(context.Background(), "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrHTTPConnect)
+		require.ErrorContains(t, err, "407")
+		require.Nil(t, conn)
+	})
+
+	t.Run("rejects unsupported networks and schemes", func(t *testing.T) {
+		dialer := NewHTTPConnectDialer(&net.Dialer{}, runtimex.PanicOnError1(url.Parse("http://127.0.0.1:1")))
+		conn, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrHTTPConnect)
+		require.Nil(t, conn)
+
+		dialer = NewHTTPConnectDialer(&net.Dialer{}, runtimex.PanicOnError1(url.Parse("socks5://127.0.0.1:1")))
+		conn, err = dialer.DialContext(context.Background(), "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrHTTPConnect)
+		require.Nil(t, conn)
+	})
+
+	t.Run("the context bounds the handshake", func(t *testing.T) {
+		proxySrv := httptest.NewServer(&httpConnectTestProxy{stall: true})
+		defer proxySrv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		conn, err := NewHTTPConnectDialer(&net.Dialer{}, runtimex.PanicOnError1(url.Parse(proxySrv.URL))).DialContext(ctx, "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Nil(t, conn)
+	})
+}
@@ -0,0 +1,353 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"golang.org/x/net/http2"
+)
+
+// ProtocolHTTPS is the protocol name used by [PoolKey] for DNS over HTTPS.
+const ProtocolHTTPS = "https"
+
+// ProtocolHTTP1 is the protocol name used by [PoolKey] for DNS over HTTPS
+// using HTTP/1.1, so that a shared [*Pool] does not mix HTTP versions.
+const ProtocolHTTP1 = "http1"
+
+// DefaultPortHTTPS is the default port for DNS over HTTPS (RFC 8484).
+const DefaultPortHTTPS = 443
+
+// DefaultHTTPSPath is the default URL path for DNS over HTTPS (RFC 8484 Section 3).
+const DefaultHTTPSPath = "/dns-query"
+
+// httpsContentType is the media type of DNS over HTTPS (RFC 8484 Section 6).
+const httpsContentType = "application/dns-message"
+
+// ErrHTTPSNoHTTP2 indicates that the server did not negotiate HTTP/2 using ALPN.
+var ErrHTTPSNoHTTP2 = errors.New("dnsoverstream: server did not negotiate HTTP/2")
+
+// ErrHTTPSNoHTTP1 indicates that the server negotiated a protocol other than
+// HTTP/1.1 using ALPN when using [StreamOpenerDialerHTTPS] HTTP1 mode.
+var ErrHTTPSNoHTTP1 = errors.New("dnsoverstream: server did not negotiate HTTP/1.1")
+
+// HTTPSStatusError indicates that a DNS over HTTPS server answered with an
+// HTTP status code other than 200, which RFC 8484 Section 4.2.1 says to
+// interpret as a failure to obtain a DNS response.
+type HTTPSStatusError struct {
+	// StatusCode is the HTTP status code.
+	StatusCode int
+}
+
+// Error implements error.
+func (e *HTTPSStatusError) Error() string {
+	return fmt.Sprintf("dnsoverstream: unexpected HTTP status code %d", e.StatusCode)
+}
+
+// NewTLSConfigDNSOverHTTPS returns the [*tls.Config] to use for DNS-over-HTTPS.
+func NewTLSConfigDNSOverHTTPS(serverName string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"h2"},
+		ServerName: serverName,
+	}
+}
+
+// StreamOpenerDialerHTTPS implements [StreamOpenerDialer] for DNS over HTTPS
+// using HTTP/2 (RFC 8484), or HTTP/1.1 when configured, where each [Stream] is
+// a POST request, so that it is possible to compare DoH with DoT and DoQ using
+// the same [*Transport].
+//
+// Construct using [NewStreamOpenerDialerHTTPS].
+type StreamOpenerDialerHTTPS struct {
+	// Dialer is the underlying [TLSDialer], whose [*tls.Config] must
+	// include "h2" in NextProtos (see [NewTLSConfigDNSOverHTTPS]).
+	Dialer TLSDialer
+
+	// Path is the OPTIONAL URL path. If empty, we use [DefaultHTTPSPath].
+	Path string
+
+	// Host is the OPTIONAL host used for the HTTP authority. If empty, we
+	// use the TLS ServerName of the Dialer or, if unknown, the endpoint.
+	Host string
+
+	// HTTP1 OPTIONALLY uses HTTP/1.1 rather than HTTP/2, which allows to
+	// compare how middleboxes treat each version. In such a case, the
+	// [*tls.Config] of the Dialer must include "http/1.1" in NextProtos, or
+	// not use ALPN at all, and each connection sends one request at a time.
+	HTTP1 bool
+}
+
+// NewStreamOpenerDialerHTTPS creates a new [*StreamOpenerDialerHTTPS].
+//
+// The caller is responsible for ensuring the dialer actually performs TLS.
+func NewStreamOpenerDialerHTTPS(dialer TLSDialer) *StreamOpenerDialerHTTPS {
+	return &StreamOpenerDialerHTTPS{Dialer: dialer}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerHTTPS{}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *StreamOpenerDialerHTTPS) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	// 1. establish the TLS connection
+	conn, err := tlsDialerForEndpoint(d.Dialer, address.String()).DialContext(ctx, "tcp", address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. make sure the server speaks the HTTP version we want
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := d.checkProtocol(tc.ConnectionState().NegotiatedProtocol); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// 3. create the HTTP client connection
+	if d.HTTP1 {
+		return &httpsConn{cc: newHTTP1ClientConn(conn), conn: conn, url: d.url(address)}, nil
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &httpsConn{cc: cc, conn: conn, url: d.url(address)}, nil
+}
+
+// checkProtocol returns an error if the protocol negotiated using ALPN
+// does not match the HTTP version we want to use.
+func (d *StreamOpenerDialerHTTPS) checkProtocol(proto string) error {
+	switch {
+	case d.HTTP1 && proto != "http/1.1" && proto != "":
+		return ErrHTTPSNoHTTP1
+	case !d.HTTP1 && proto != "h2":
+		return ErrHTTPSNoHTTP2
+	default:
+		return nil
+	}
+}
+
+// url returns the URL to use for the given endpoint.
+func (d *StreamOpenerDialerHTTPS) url(address netip.AddrPort) string {
+	var serverName string
+	if config, ok := tlsDialerConfig(d.Dialer); ok && config != nil {
+		serverName = config.ServerName
+	}
+	host := httpsAuthority(d.Host, serverName, address)
+	return (&url.URL{Scheme: "https", Host: host, Path: httpsPath(d.Path)}).String()
+}
+
+// httpsAuthority returns the HTTP authority given the configured host, the
+// TLS server name, and the endpoint, in this order of preference.
+func httpsAuthority(host, serverName string, address netip.AddrPort) string {
+	if host == "" {
+		host = serverName
+	}
+	if host == "" {
+		host = netip.AddrPortFrom(address.Addr().WithZone(""), address.Port()).String()
+	}
+	return host
+}
+
+// httpsPath returns the configured path or [DefaultHTTPSPath] if empty.
+func httpsPath(path string) string {
+	if path == "" {
+		path = DefaultHTTPSPath
+	}
+	return path
+}
+
+// httpsRoundTripper is the client connection used by [*httpsConn], which
+// is either a [*http2.ClientConn] or a [*http1ClientConn].
+type httpsRoundTripper interface {
+	Close() error
+	RoundTrip(req *http.Request) (*http.Response, error)
+}
+
+// httpsEnvelope encapsulates the messages exchanged using DNS over
+// HTTPS, which allows to implement Oblivious DoH (RFC 9230).
+type httpsEnvelope interface {
+	// contentType returns the media type of the encapsulated messages.
+	contentType() string
+
+	// acceptsContentType returns whether the media type of a response is valid.
+	acceptsContentType(value string) bool
+
+	// method returns the HTTP method, where [http.MethodGet] means that
+	// the sealed query is the URL query string rather than the body.
+	method() string
+
+	// seal encapsulates rawQuery and returns the request body along with a
+	// function to decapsulate the corresponding response body.
+	seal(rawQuery []byte) ([]byte, func(body []byte) ([]byte, error), error)
+}
+
+// httpsConn implements [StreamOpener] for DNS over HTTPS.
+type httpsConn struct {
+	cc   httpsRoundTripper
+	conn net.Conn
+	url  string
+
+	// envelope is the OPTIONAL [httpsEnvelope].
+	envelope httpsEnvelope
+}
+
+// Close implements [StreamOpener].
+func (c *httpsConn) Close() error {
+	return c.cc.Close()
+}
+
+// MutateQuery implements [StreamOpener].
+func (c *httpsConn) MutateQuery(msg *dnscodec.Query) {
+	QueryParamsHTTPS().MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (c *httpsConn) OpenStream() (Stream, error) {
+	return &httpsStream{cc: c.cc, url: c.url, envelope: c.envelope}, nil
+}
+
+// httpsStream implements [Stream] for DNS over HTTPS.
+//
+// It buffers the query frame written by the caller, sends the query when
+// the caller starts reading, and returns the response as a frame, so that
+// the framing is the same as for DNS over TCP, TLS, and QUIC.
+type httpsStream struct {
+	cc       httpsRoundTripper
+	url      string
+	envelope httpsEnvelope
+	deadline time.Time
+	query    bytes.Buffer
+	resp     io.Reader
+}
+
+// Close implements [Stream].
+func (s *httpsStream) Close() error {
+	// We complete the request when reading, so there is nothing to do.
+	return nil
+}
+
+// Read implements [Stream].
+func (s *httpsStream) Read(buff []byte) (int, error) {
+	if s.resp == nil {
+		body, err := s.roundTrip()
+		if err != nil {
+			return 0, err
+		}
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(body)))
+		s.resp = bytes.NewReader(append(frame, body...))
+	}
+	return s.resp.Read(buff)
+}
+
+// roundTrip sends the query using POST (RFC 8484 Section 4.1) and returns the response body.
+func (s *httpsStream) roundTrip() ([]byte, error) {
+	// 1. remove the length prefix from the query frame
+	frame := s.query.Bytes()
+	if len(frame) < 2 || int(binary.BigEndian.Uint16(frame)) != len(frame)-2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	// 2. encapsulate the query, if needed
+	var (
+		body        = frame[2:]
+		contentType = httpsContentType
+		method      = http.MethodPost
+		open        func(body []byte) ([]byte, error)
+	)
+	if s.envelope != nil {
+		var err error
+		contentType, method = s.envelope.contentType(), s.envelope.method()
+		if body, open, err = s.envelope.seal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. create the request honouring the deadline
+	ctx, cancel := context.WithCancel(context.Background())
+	if !s.deadline.IsZero() {
+		ctx, cancel = context.WithDeadline(ctx, s.deadline)
+	}
+	defer cancel()
+	req, err := s.newRequest(ctx, method, body)
+	if err != nil {
+		return nil, err
+	}
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", contentType)
+
+	// 4. send the request and check the response
+	resp, err := s.cc.RoundTrip(req)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %w", os.ErrDeadlineExceeded, err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPSStatusError{StatusCode: resp.StatusCode}
+	}
+	accepts := func(value string) bool { return value == contentType }
+	if s.envelope != nil {
+		accepts = s.envelope.acceptsContentType
+	}
+	if !accepts(resp.Header.Get("Content-Type")) {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 5. read the response body, which must fit into a frame
+	body, err = io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) >= 1<<16 {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 6. decapsulate the response, if needed
+	if open != nil {
+		return open(body)
+	}
+	return body, nil
+}
+
+// newRequest creates the request using the given method, where body
+// is the URL query string when using GET and the body otherwise.
+func (s *httpsStream) newRequest(ctx context.Context, method string, body []byte) (*http.Request, error) {
+	if method != http.MethodGet {
+		return http.NewRequestWithContext(ctx, method, s.url, bytes.NewReader(body))
+	}
+	URL, err := url.Parse(s.url)
+	if err != nil {
+		return nil, err
+	}
+	URL.RawQuery = string(body)
+	return http.NewRequestWithContext(ctx, method, URL.String(), nil)
+}
+
+// SetDeadline implements [Stream].
+func (s *httpsStream) SetDeadline(t time.Time) error {
+	s.deadline = t
+	return nil
+}
+
+// Write implements [Stream].
+func (s *httpsStream) Write(data []byte) (int, error) {
+	return s.query.Write(data)
+}
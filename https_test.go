@@ -0,0 +1,287 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newDoHTestServer starts an HTTP/2 DNS-over-HTTPS server at /dns-query using
+// handler and returns it along with its endpoint.
+func newDoHTestServer(t *testing.T, handler http.Handler) (*httptest.Server, netip.AddrPort) {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = true
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{newTestCert()}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, netip.MustParseAddrPort(srv.Listener.Addr().String())
+}
+
+// newDoHTestHandler returns an [http.Handler] implementing DNS over HTTPS
+// using handler and recording the requests it receives.
+func newDoHTestHandler(handler func(query *dns.Msg) *dns.Msg, requests *[]*http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			*requests = append(*requests, r)
+		}
+		rawQuery, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rawResp, err := handler(query).Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(rawResp)
+	})
+}
+
+// dohTestAnswer answers all queries with 8.8.8.8.
+func dohTestAnswer(query *dns.Msg) *dns.Msg {
+	resp := &dns.Msg{}
+	resp.SetReply(query)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(8, 8, 8, 8),
+	}}
+	return resp
+}
+
+// newDoHTestTransport returns a [*Transport] for DNS over HTTPS trusting [testPKI].
+func newDoHTestTransport(endpoint netip.AddrPort) *Transport {
+	dialer := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: newTestClientTLSConfig("h2")})
+	return NewTransport(dialer, endpoint)
+}
+
+func TestStreamOpenerDialerHTTPS(t *testing.T) {
+	t.Run("exchanges using POST", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, &requests))
+		dt := newDoHTestTransport(endpoint)
+		var rawQuery []byte
+		dt.ObserveRawQuery = func(data []byte) {
+			rawQuery = data
+		}
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+		require.Len(t, requests, 1)
+		require.Equal(t, http.MethodPost, requests[0].Method)
+		require.Equal(t, "/dns-query", requests[0].URL.Path)
+		require.Equal(t, "example.com", requests[0].Host)
+		require.Equal(t, "application/dns-message", requests[0].Header.Get("Content-Type"))
+		require.Equal(t, "application/dns-message", requests[0].Header.Get("Accept"))
+		require.Equal(t, 2, requests[0].ProtoMajor)
+
+		// the query ID is zero (RFC 8484 Section 4.1)
+		query := &dns.Msg{}
+		require.NoError(t, query.Unpack(rawQuery))
+		require.Zero(t, query.Id)
+	})
+
+	t.Run("reuses the connection for multiple requests", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		dt := newDoHTestTransport(endpoint)
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, HandshakeFull, StreamOpenerHandshakeKind(conn))
+		for range 3 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("uses the configured path and host", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, &requests))
+		dt := newDoHTestTransport(endpoint)
+		dt.dialer.(*StreamOpenerDialerHTTPS).Path = "/custom"
+		dt.dialer.(*StreamOpenerDialerHTTPS).Host = "dns.example.com"
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "/custom", requests[0].URL.Path)
+		require.Equal(t, "dns.example.com", requests[0].Host)
+	})
+
+	t.Run("returns HTTPSStatusError for unexpected status codes", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		_, err := newDoHTestTransport(endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		var statusErr *HTTPSStatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusTeapot, statusErr.StatusCode)
+		require.Equal(t, "dnsoverstream: unexpected HTTP status code 418", statusErr.Error())
+	})
+
+	t.Run("rejects unexpected content types", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+		}))
+		_, err := newDoHTestTransport(endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("rejects servers without HTTP/2", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		dialer := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: newTestClientTLSConfig("http/1.1")})
+		_, err := NewTransport(dialer, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrHTTPSNoHTTP2)
+	})
+
+	t.Run("honours the context deadline", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := newDoHTestTransport(endpoint).Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("uses the pool key protocol and server name", func(t *testing.T) {
+		dt := newDoHTestTransport(netip.MustParseAddrPort("127.0.0.1:443"))
+		key := newPoolKey(dt.dialer, dt.endpoint)
+		require.Equal(t, ProtocolHTTPS, key.Protocol)
+		require.Equal(t, "example.com", key.ServerName)
+	})
+}
+
+// newDoHTestTransportHTTP1 is like [newDoHTestTransport] but uses HTTP/1.1.
+func newDoHTestTransportHTTP1(endpoint netip.AddrPort, nextProtos ...string) *Transport {
+	dialer := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: newTestClientTLSConfig(nextProtos...)})
+	dialer.HTTP1 = true
+	return NewTransport(dialer, endpoint)
+}
+
+func TestStreamOpenerDialerHTTPSHTTP1(t *testing.T) {
+	t.Run("exchanges using POST", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, &requests))
+		resp, err := newDoHTestTransportHTTP1(endpoint, "http/1.1").Exchange(
+			context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+		require.Len(t, requests, 1)
+		require.Equal(t, http.MethodPost, requests[0].Method)
+		require.Equal(t, "/dns-query", requests[0].URL.Path)
+		require.Equal(t, "example.com", requests[0].Host)
+		require.Equal(t, "application/dns-message", requests[0].Header.Get("Content-Type"))
+		require.Equal(t, "application/dns-message", requests[0].Header.Get("Accept"))
+		require.Equal(t, 1, requests[0].ProtoMajor)
+		require.Equal(t, 1, requests[0].ProtoMinor)
+	})
+
+	t.Run("reuses the connection for multiple requests", func(t *testing.T) {
+		var requests []*http.Request
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, &requests))
+		dt := newDoHTestTransportHTTP1(endpoint, "http/1.1")
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		for range 3 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Len(t, requests, 3)
+		require.Equal(t, requests[0].RemoteAddr, requests[2].RemoteAddr)
+	})
+
+	t.Run("works without ALPN", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		_, err := newDoHTestTransportHTTP1(endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	})
+
+	t.Run("rejects servers negotiating HTTP/2", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		_, err := newDoHTestTransportHTTP1(endpoint, "h2", "http/1.1").Exchange(
+			context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrHTTPSNoHTTP1)
+	})
+
+	t.Run("returns HTTPSStatusError for unexpected status codes", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		_, err := newDoHTestTransportHTTP1(endpoint, "http/1.1").Exchange(
+			context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		var statusErr *HTTPSStatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusTeapot, statusErr.StatusCode)
+	})
+
+	t.Run("honours the context deadline and gives up on the connection", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.ReadAll(r.Body) // so that the server notices when we close the connection
+			<-r.Context().Done()
+		}))
+		dt := newDoHTestTransportHTTP1(endpoint, "http/1.1")
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = dt.ExchangeWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		_, err = dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, errHTTP1Unusable)
+	})
+
+	t.Run("uses a distinct pool key protocol", func(t *testing.T) {
+		dt := newDoHTestTransportHTTP1(netip.MustParseAddrPort("127.0.0.1:443"), "http/1.1")
+		key := newPoolKey(dt.dialer, dt.endpoint)
+		require.Equal(t, ProtocolHTTP1, key.Protocol)
+		require.Equal(t, "example.com", key.ServerName)
+	})
+}
+
+func TestStreamOpenerDialerHTTPSURL(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("[fe80::1%eth0]:443")
+	dialer := NewStreamOpenerDialerHTTPS(&tls.Dialer{})
+	require.Equal(t, "https://[fe80::1]:443/dns-query", dialer.url(endpoint))
+	dialer = NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: NewTLSConfigDNSOverHTTPS("dns.google")})
+	require.Equal(t, "https://dns.google/dns-query", dialer.url(endpoint))
+}
+
+func TestHTTPSStreamRejectsInvalidFrames(t *testing.T) {
+	stream := &httpsStream{}
+	_, err := stream.Write([]byte{0, 5, 1})
+	require.NoError(t, err)
+	_, err = stream.Read(make([]byte, 2))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestNewTLSConfigDNSOverHTTPS(t *testing.T) {
+	cfg := NewTLSConfigDNSOverHTTPS("dns.example.com")
+
+	require.Equal(t, "dns.example.com", cfg.ServerName)
+	require.Equal(t, []string{"h2"}, cfg.NextProtos)
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// ErrICMPUnreachable indicates that an ICMP destination unreachable message
+// (e.g., port unreachable) caused an operation on a connected UDP socket to
+// fail. The error also wraps the underlying [syscall.Errno], such as
+// [syscall.ECONNREFUSED] for port unreachable. Use [ClassifyICMPUnreachable]
+// to obtain the kind of destination unreachable message.
+var ErrICMPUnreachable = errors.New("dnsoverstream: destination unreachable (ICMP)")
+
+// ICMPUnreachableKind is the kind of ICMP destination unreachable message
+// returned by [ClassifyICMPUnreachable].
+type ICMPUnreachableKind int
+
+const (
+	// ICMPUnreachableNone means that the error is not caused by an ICMP
+	// destination unreachable message, e.g., because the server did not
+	// answer before the context was done.
+	ICMPUnreachableNone ICMPUnreachableKind = iota
+
+	// ICMPUnreachablePort means that the host is reachable but nothing is
+	// listening on the port, which distinguishes a server not running DNS
+	// over QUIC from a firewall silently dropping UDP traffic.
+	ICMPUnreachablePort
+
+	// ICMPUnreachableHost means that the host is unreachable, which includes
+	// firewalls configured to reject packets using host unreachable or
+	// administratively prohibited messages.
+	ICMPUnreachableHost
+
+	// ICMPUnreachableNetwork means that the network is unreachable.
+	ICMPUnreachableNetwork
+)
+
+// String implements [fmt.Stringer].
+func (k ICMPUnreachableKind) String() string {
+	switch k {
+	case ICMPUnreachablePort:
+		return "port"
+	case ICMPUnreachableHost:
+		return "host"
+	case ICMPUnreachableNetwork:
+		return "network"
+	default:
+		return "none"
+	}
+}
+
+// ClassifyICMPUnreachable returns the [ICMPUnreachableKind] of an error
+// returned by DNS over UDP or QUIC (including HTTP/3), so that measurements can
+// distinguish filtered ports from unresponsive servers.
+//
+// The kernel only reports ICMP errors for connected UDP sockets, so this
+// function returns [ICMPUnreachableNone] for QUIC unless QUICDialer
+// ConnectedUDP is set, while [*StreamOpenerDialerUDP] always uses connected
+// sockets. Since we only consider errors wrapping [ErrICMPUnreachable], this
+// function also returns [ICMPUnreachableNone] for refused TCP connections.
+func ClassifyICMPUnreachable(err error) ICMPUnreachableKind {
+	if !errors.Is(err, ErrICMPUnreachable) {
+		return ICMPUnreachableNone
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ICMPUnreachablePort
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ICMPUnreachableHost
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ICMPUnreachableNetwork
+	default:
+		return ICMPUnreachableNone
+	}
+}
+
+// wrapICMPError wraps errors caused by ICMP messages with [ErrICMPUnreachable].
+func wrapICMPError(err error) error {
+	switch {
+	case errors.Is(err, ErrICMPUnreachable):
+		return err
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return fmt.Errorf("%w: %w", ErrICMPUnreachable, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapICMPError(t *testing.T) {
+	for _, errno := range []syscall.Errno{syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		err := wrapICMPError(&net.OpError{Op: "read", Net: "udp", Err: errno})
+		require.ErrorIs(t, err, ErrICMPUnreachable)
+		require.ErrorIs(t, err, errno)
+
+		// wrapping twice is a no-op
+		require.Equal(t, err, wrapICMPError(err))
+	}
+	expected := errors.New("mocked error")
+	require.Equal(t, expected, wrapICMPError(expected))
+}
+
+func TestClassifyICMPUnreachable(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected ICMPUnreachableKind
+	}{
+		{"port unreachable", wrapICMPError(syscall.ECONNREFUSED), ICMPUnreachablePort},
+		{"host unreachable", wrapICMPError(syscall.EHOSTUNREACH), ICMPUnreachableHost},
+		{"network unreachable", wrapICMPError(syscall.ENETUNREACH), ICMPUnreachableNetwork},
+		{"refused TCP connection", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ICMPUnreachableNone},
+		{"bare sentinel", ErrICMPUnreachable, ICMPUnreachableNone},
+		{"other error", errors.New("mocked error"), ICMPUnreachableNone},
+		{"nil", nil, ICMPUnreachableNone},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, ClassifyICMPUnreachable(tc.err))
+		})
+	}
+}
+
+func TestICMPUnreachableKindString(t *testing.T) {
+	require.Equal(t, "none", ICMPUnreachableNone.String())
+	require.Equal(t, "port", ICMPUnreachablePort.String())
+	require.Equal(t, "host", ICMPUnreachableHost.String())
+	require.Equal(t, "network", ICMPUnreachableNetwork.String())
+	require.Equal(t, "none", ICMPUnreachableKind(42).String())
+}
@@ -1,67 +1,274 @@
 // SPDX-License-Identifier: GPL-3.0-or-later
 
+//go:build integration
+
 package dnsoverstream_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net"
 	"net/netip"
 	"os"
 	"slices"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/bassosimone/dnscodec"
 	"github.com/bassosimone/dnsoverstream"
 	"github.com/miekg/dns"
-	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// run exchanges a query for dns.google with the given client and URL and
-// verifies that the response is the one we expect.
-func run(t *testing.T, dt *dnsoverstream.Transport) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	query := dnscodec.NewQuery("dns.google", dns.TypeA)
-	resp, err := dt.Exchange(ctx, query)
-	require.NoError(t, err)
-	addrs, err := resp.RecordsA()
-	require.NoError(t, err)
-	slices.Sort(addrs)
-	expectAddrs := []string{"8.8.4.4", "8.8.8.8"}
-	assert.Equal(t, expectAddrs, addrs)
+// The integration tests exchange with public resolvers and only build
+// when using the integration build tag, to keep offline CI green:
+//
+//	go test -tags integration -run TestIntegration ./...
+//
+// Set DNSOVERSTREAM_INTEGRATION_REPORT to the path of a file to also
+// append the [integrationRecord] of each cell of the matrix as JSONL.
+
+// integrationResolver describes a public resolver of the matrix.
+type integrationResolver struct {
+	// name is the subtest name.
+	name string
+
+	// address is the resolver IPv4 address.
+	address netip.Addr
+
+	// serverName is the TLS server name.
+	serverName string
+
+	// protocols contains the protocols the resolver supports.
+	protocols []string
+}
+
+// integrationResolvers contains the public resolvers of the matrix.
+var integrationResolvers = []integrationResolver{
+	{
+		name:       "google",
+		address:    netip.MustParseAddr("8.8.8.8"),
+		serverName: "dns.google",
+		protocols:  []string{dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS},
+	},
+	{
+		name:       "cloudflare",
+		address:    netip.MustParseAddr("1.1.1.1"),
+		serverName: "cloudflare-dns.com",
+		protocols:  []string{dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS},
+	},
+	{
+		name:       "quad9",
+		address:    netip.MustParseAddr("9.9.9.9"),
+		serverName: "dns.quad9.net",
+		protocols:  []string{dnsoverstream.ProtocolTCP, dnsoverstream.ProtocolTLS},
+	},
+	{
+		name:       "adguard",
+		address:    netip.MustParseAddr("94.140.14.14"),
+		serverName: "dns.adguard-dns.com",
+		protocols: []string{
+			dnsoverstream.ProtocolTCP,
+			dnsoverstream.ProtocolTLS,
+			dnsoverstream.ProtocolQUIC,
+		},
+	},
 }
 
-func TestIntegrationDNSOverTCPWorks(t *testing.T) {
-	dialer := dnsoverstream.NewStreamOpenerDialerTCP(&net.Dialer{})
-	dt := dnsoverstream.NewTransport(dialer, netip.MustParseAddrPort("8.8.8.8:53"))
-	run(t, dt)
+// integrationProtocols contains the protocols of the matrix.
+var integrationProtocols = []string{
+	dnsoverstream.ProtocolTCP,
+	dnsoverstream.ProtocolTLS,
+	dnsoverstream.ProtocolQUIC,
+}
+
+// Values of the [integrationRecord] Status.
+const (
+	integrationStatusOK          = "ok"
+	integrationStatusFailed      = "failed"
+	integrationStatusUnreachable = "unreachable"
+	integrationStatusUnsupported = "unsupported"
+)
+
+// integrationRecord is the structured outcome of a cell of the matrix.
+type integrationRecord struct {
+	Resolver     string        `json:"resolver"`
+	Protocol     string        `json:"protocol"`
+	Endpoint     string        `json:"endpoint"`
+	Status       string        `json:"status"`
+	Error        string        `json:"error,omitempty"`
+	DialTime     time.Duration `json:"dial_time_ns,omitempty"`
+	ExchangeTime time.Duration `json:"exchange_time_ns,omitempty"`
+	Answers      []string      `json:"answers,omitempty"`
 }
 
-func TestIntegrationDNSOverTLSWorks(t *testing.T) {
-	tlsDialer := dnsoverstream.NewTLSDialerDNSOverTLS("dns.google")
-	dialer := dnsoverstream.NewStreamOpenerDialerTLS(tlsDialer)
-	dt := dnsoverstream.NewTransport(dialer, netip.MustParseAddrPort("8.8.8.8:853"))
-	run(t, dt)
+// integrationReport collects the [integrationRecord] of the matrix.
+type integrationReport struct {
+	mu      sync.Mutex
+	records []integrationRecord
 }
 
-func TestIntegrationDNSOverQUICWorks(t *testing.T) {
-	udpAddr, err := net.ResolveUDPAddr("udp4", "dns.adguard.com:853")
+// add logs the record and appends it to the report.
+func (r *integrationReport) add(t *testing.T, record integrationRecord) {
+	data, err := json.Marshal(record)
 	require.NoError(t, err)
+	t.Log(string(data))
+	r.mu.Lock()
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+}
 
-	lc := &net.ListenConfig{}
-	pconn, err := lc.ListenPacket(context.Background(), "udp", ":0")
+// write appends the records as JSONL to the file named by the
+// DNSOVERSTREAM_INTEGRATION_REPORT environment variable, if set.
+func (r *integrationReport) write(t *testing.T) {
+	path := os.Getenv("DNSOVERSTREAM_INTEGRATION_REPORT")
+	if path == "" {
+		return
+	}
+	filep, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 	require.NoError(t, err)
-	defer pconn.Close()
-	quicDialer := dnsoverstream.NewQUICDialer(pconn, "dns.adguard.com")
-	dialer := dnsoverstream.NewStreamOpenerDialerQUIC(quicDialer)
+	defer filep.Close()
+	encoder := json.NewEncoder(filep)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, record := range r.records {
+		require.NoError(t, encoder.Encode(record))
+	}
+}
 
-	dt := dnsoverstream.NewTransport(dialer, udpAddr.AddrPort())
-	run(t, dt)
+// integrationUnreachable returns whether the error indicates that we cannot
+// reach the resolver (e.g., because we are offline or a firewall drops or
+// resets the traffic) rather than a regression, such as an invalid certificate
+// or a TLS alert, which we report as failures.
+func integrationUnreachable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	for _, errno := range []error{
+		syscall.ECONNREFUSED,
+		syscall.ECONNRESET,
+		syscall.EHOSTUNREACH,
+		syscall.ENETUNREACH,
+	} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return errors.Is(err, context.DeadlineExceeded)
 }
 
-func TestMain(m *testing.M) {
-	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
-	os.Exit(m.Run())
+// newIntegrationTransport returns the [*dnsoverstream.Transport] for the given
+// resolver and protocol, registering the cleanup of the resources it uses.
+func newIntegrationTransport(t *testing.T, resolver integrationResolver,
+	protocol string, endpoint netip.AddrPort) *dnsoverstream.Transport {
+	switch protocol {
+	case dnsoverstream.ProtocolTCP:
+		dialer := dnsoverstream.NewStreamOpenerDialerTCP(&net.Dialer{})
+		return dnsoverstream.NewTransport(dialer, endpoint)
+
+	case dnsoverstream.ProtocolTLS:
+		dialer := dnsoverstream.NewStreamOpenerDialerTLS(dnsoverstream.NewTLSDialerDNSOverTLS(resolver.serverName))
+		return dnsoverstream.NewTransport(dialer, endpoint)
+
+	default:
+		pconn, err := (&net.ListenConfig{}).ListenPacket(context.Background(), "udp", ":0")
+		require.NoError(t, err)
+		t.Cleanup(func() { pconn.Close() })
+		dialer := dnsoverstream.NewStreamOpenerDialerQUIC(dnsoverstream.NewQUICDialer(pconn, resolver.serverName))
+		return dnsoverstream.NewTransport(dialer, endpoint)
+	}
+}
+
+// runIntegration exchanges a query for dns.google using the given resolver
+// and protocol and returns the outcome, which is successful when the response
+// contains the addresses we expect.
+func runIntegration(t *testing.T, resolver integrationResolver, protocol string) integrationRecord {
+	endpoint := netip.AddrPortFrom(resolver.address, 853)
+	if protocol == dnsoverstream.ProtocolTCP {
+		endpoint = netip.AddrPortFrom(resolver.address, 53)
+	}
+	dt := newIntegrationTransport(t, resolver, protocol, endpoint)
+	record := integrationRecord{
+		Resolver: resolver.name,
+		Protocol: protocol,
+		Endpoint: endpoint.String(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 1. dial separately to measure the dial and exchange times
+	t0 := time.Now()
+	conn, err := dt.Dial(ctx)
+	record.DialTime = time.Since(t0)
+	if err != nil {
+		record.Status, record.Error = integrationStatusFailed, err.Error()
+		if integrationUnreachable(err) {
+			record.Status = integrationStatusUnreachable
+		}
+		return record
+	}
+
+	// 2. exchange transferring the connection ownership
+	t0 = time.Now()
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	resp, err := dt.ExchangeWithStreamOpener(dnsoverstream.WithStreamOpenerOwnership(ctx, true), conn, query)
+	record.ExchangeTime = time.Since(t0)
+	if err != nil {
+		record.Status, record.Error = integrationStatusFailed, err.Error()
+		if integrationUnreachable(err) {
+			record.Status = integrationStatusUnreachable
+		}
+		return record
+	}
+
+	// 3. make sure we received the expected addresses
+	addrs, err := resp.RecordsA()
+	if err != nil {
+		record.Status, record.Error = integrationStatusFailed, err.Error()
+		return record
+	}
+	slices.Sort(addrs)
+	record.Answers = addrs
+	record.Status = integrationStatusOK
+	if !slices.Equal(addrs, []string{"8.8.4.4", "8.8.8.8"}) {
+		record.Status, record.Error = integrationStatusFailed, "unexpected answers"
+	}
+	return record
+}
+
+func TestIntegrationMatrix(t *testing.T) {
+	report := &integrationReport{}
+	t.Cleanup(func() { report.write(t) })
+
+	for _, resolver := range integrationResolvers {
+		for _, protocol := range integrationProtocols {
+			t.Run(resolver.name+"/"+protocol, func(t *testing.T) {
+				t.Parallel()
+				if !slices.Contains(resolver.protocols, protocol) {
+					report.add(t, integrationRecord{
+						Resolver: resolver.name,
+						Protocol: protocol,
+						Status:   integrationStatusUnsupported,
+					})
+					t.Skip("the resolver does not support the protocol")
+				}
+				record := runIntegration(t, resolver, protocol)
+				report.add(t, record)
+				switch record.Status {
+				case integrationStatusUnreachable:
+					t.Skipf("the resolver is unreachable: %s", record.Error)
+				case integrationStatusFailed:
+					t.Fatalf("the exchange failed: %s", record.Error)
+				}
+			})
+		}
+	}
 }
@@ -0,0 +1,333 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// DefaultIterativeMaxQueries is the default maximum number of queries
+// sent by [*IterativeResolver] to resolve a single name.
+const DefaultIterativeMaxQueries = 32
+
+// iterativeMaxDepth is the maximum nesting level when resolving the
+// addresses of name servers for which the referral contains no glue.
+const iterativeMaxDepth = 3
+
+// ErrIterativeMaxQueries indicates that [*IterativeResolver] sent too many queries.
+var ErrIterativeMaxQueries = errors.New("dnsoverstream: too many iterative queries")
+
+// ErrIterativeNoServers indicates that [*IterativeResolver] could not
+// find the addresses of the name servers of a zone.
+var ErrIterativeNoServers = errors.New("dnsoverstream: no usable name servers")
+
+// IterativeStep describes a query sent by [*IterativeResolver].
+type IterativeStep struct {
+	// Zone is the zone whose name server we queried.
+	Zone string
+
+	// Server is the name server endpoint.
+	Server netip.AddrPort
+
+	// Name is the query name, which is minimized unless querying for the full name.
+	Name string
+
+	// Type is the query type, which is A for minimized queries (RFC 9156 Section 2.1).
+	Type uint16
+
+	// Minimized indicates whether the query name was minimized.
+	Minimized bool
+
+	// Response is the response or nil on failure.
+	Response *dns.Msg
+
+	// Err is the exchange error or nil on success.
+	Err error
+}
+
+// IterativeResolver is an EXPERIMENTAL iterative resolver using QNAME
+// minimization (RFC 9156), which walks the hierarchy from the root servers
+// down to the authoritative servers using a [*Transport] per server.
+//
+// The main use case is measuring support for DNS over TCP or TLS by
+// authoritative servers, so the resolver does not cache, does not validate
+// DNSSEC, and does not follow CNAMEs outside of the response.
+//
+// Construct using [NewIterativeResolver].
+type IterativeResolver struct {
+	// NewTransport is the MANDATORY function creating the [*Transport]
+	// used to query the name server at the given endpoint.
+	//
+	// The resolver sets the NoRecursion field of the returned [*Transport].
+	NewTransport func(endpoint netip.AddrPort) *Transport
+
+	// RootServers contains the MANDATORY root server endpoints.
+	RootServers []netip.AddrPort
+
+	// Port is the OPTIONAL port used for the name servers discovered
+	// through referrals. If zero, we use port 53. Use port 853 when
+	// creating transports for DNS over TLS.
+	Port uint16
+
+	// MaxQueries is the OPTIONAL maximum number of queries sent to resolve
+	// a name. If zero or negative, we use [DefaultIterativeMaxQueries].
+	MaxQueries int
+
+	// DNS64Prefix is the OPTIONAL NAT64 prefix (RFC 6052) used to
+	// synthesize AAAA records from A records (RFC 6147) when resolving
+	// AAAA records for a name without them, e.g., when measuring from an
+	// IPv6-only network. If invalid, we do not synthesize AAAA records.
+	//
+	// Use [WellKnownNAT64Prefix] or [*Transport.DiscoverNAT64Prefixes].
+	DNS64Prefix netip.Prefix
+
+	// ObserveStep is an optional hook called after each query.
+	ObserveStep func(IterativeStep)
+}
+
+// NewIterativeResolver creates a new [*IterativeResolver].
+func NewIterativeResolver(newTransport func(endpoint netip.AddrPort) *Transport, rootServers []netip.AddrPort) *IterativeResolver {
+	return &IterativeResolver{
+		NewTransport: newTransport,
+		RootServers:  rootServers,
+	}
+}
+
+// iterativeState is the state of a single [*IterativeResolver.Resolve] call.
+type iterativeState struct {
+	queries int
+}
+
+// Resolve iteratively resolves the given name and query type and returns the
+// final response, which may be a negative response such as NXDOMAIN or NODATA.
+//
+// Use [ClassifyResponse] to classify the returned response.
+func (r *IterativeResolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	// 1. resolve the name and query type
+	st := &iterativeState{}
+	resp, err := r.resolve(ctx, st, name, qtype, 0)
+	if err != nil || qtype != dns.TypeAAAA || !r.DNS64Prefix.IsValid() {
+		return resp, err
+	}
+	if ClassifyResponse(resp) != ResponseClassNoData {
+		return resp, nil
+	}
+
+	// 2. synthesize AAAA records when the name only has A records,
+	// otherwise return the original response (RFC 6147 Section 5.1.6)
+	aResp, err := r.resolve(ctx, st, name, dns.TypeA, 0)
+	if err != nil || ClassifyResponse(aResp) != ResponseClassAnswer {
+		return resp, nil
+	}
+	return dns64SynthesizeResponse(r.DNS64Prefix, resp, aResp)
+}
+
+// resolve implements [*IterativeResolver.Resolve].
+func (r *IterativeResolver) resolve(ctx context.Context, st *iterativeState, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	// 1. start from the root zone querying for a single label
+	name = dns.CanonicalName(name)
+	labels := dns.SplitDomainName(name)
+	zone, servers, count := ".", r.RootServers, 1
+
+	for {
+		// 2. build the minimized query name by adding a label to the
+		// closest known ancestor (RFC 9156 Section 3)
+		count = min(count, len(labels))
+		qname := dns.Fqdn(strings.Join(labels[len(labels)-count:], "."))
+		minimized := count < len(labels)
+		qt := qtype
+		if minimized {
+			qt = dns.TypeA
+		}
+
+		// 3. query the servers of the current zone
+		resp, err := r.query(ctx, st, zone, servers, qname, qt, minimized)
+		if err != nil {
+			return nil, err
+		}
+
+		// 4. handle the response
+		switch class := ClassifyResponse(resp); {
+		case class == ResponseClassReferral:
+			child, addrs, err := r.followReferral(ctx, st, zone, name, resp, depth)
+			if err != nil {
+				return nil, err
+			}
+			zone, servers, count = child, addrs, dns.CountLabel(child)+1
+
+		case minimized && (class == ResponseClassAnswer || class == ResponseClassNoData):
+			count++ // no zone cut here, so add another label
+
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// query sends a query to the servers of a zone and returns the first valid response.
+func (r *IterativeResolver) query(ctx context.Context, st *iterativeState,
+	zone string, servers []netip.AddrPort, qname string, qtype uint16, minimized bool) (*dns.Msg, error) {
+	var (
+		err  error = ErrIterativeNoServers
+		lame *dns.Msg
+	)
+	for _, server := range servers {
+		// 1. make sure we do not loop forever
+		maxQueries := r.MaxQueries
+		if maxQueries <= 0 {
+			maxQueries = DefaultIterativeMaxQueries
+		}
+		if st.queries >= maxQueries {
+			return nil, ErrIterativeMaxQueries
+		}
+		st.queries++
+
+		// 2. send a non-recursive query
+		dt := r.NewTransport(server)
+		dt.NoRecursion = true
+		var resp *dns.Msg
+		resp, err = dt.exchangeMsg(ctx, dnscodec.NewQuery(qname, qtype))
+		if r.ObserveStep != nil {
+			r.ObserveStep(IterativeStep{
+				Zone:      zone,
+				Server:    server,
+				Name:      qname,
+				Type:      qtype,
+				Minimized: minimized,
+				Response:  resp,
+				Err:       err,
+			})
+		}
+
+		// 3. try the next server on failure, including when the server
+		// is lame and refuses to answer or fails (RFC 4697 Section 2.1)
+		if ctx.Err() != nil {
+			return nil, wrapContextError(ctx, ctx.Err())
+		}
+		if err != nil {
+			continue
+		}
+		switch ClassifyResponse(resp) {
+		case ResponseClassRefused, ResponseClassServFail:
+			lame = resp
+			continue
+		}
+		return resp, nil
+	}
+	if lame != nil {
+		return lame, nil
+	}
+	return nil, err
+}
+
+// followReferral returns the child zone and the name server endpoints of a referral.
+func (r *IterativeResolver) followReferral(ctx context.Context,
+	st *iterativeState, zone, name string, resp *dns.Msg, depth int) (string, []netip.AddrPort, error) {
+	// 1. collect the delegated zone and its name servers
+	var (
+		child   string
+		nsNames []string
+	)
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			child = dns.CanonicalName(ns.Hdr.Name)
+			nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+		}
+	}
+
+	// 2. reject referrals not moving closer to the name
+	if child == zone || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, name) {
+		return "", nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 3. use the glue records, if any
+	port := r.Port
+	if port == 0 {
+		port = 53
+	}
+	var addrs []netip.AddrPort
+	for _, rr := range resp.Extra {
+		if addr, ok := iterativeGlueAddr(rr, nsNames); ok {
+			addrs = append(addrs, netip.AddrPortFrom(addr, port))
+		}
+	}
+	if len(addrs) > 0 {
+		return child, addrs, nil
+	}
+
+	// 4. otherwise, resolve the addresses of the name servers
+	if depth >= iterativeMaxDepth {
+		return "", nil, ErrIterativeNoServers
+	}
+	for _, nsName := range nsNames {
+		nsResp, err := r.resolve(ctx, st, nsName, dns.TypeA, depth+1)
+		if ctx.Err() != nil {
+			return "", nil, wrapContextError(ctx, ctx.Err())
+		}
+		if errors.Is(err, ErrIterativeMaxQueries) {
+			return "", nil, err
+		}
+		if err != nil {
+			continue
+		}
+		for _, rr := range nsResp.Answer {
+			if addr, ok := iterativeGlueAddr(rr, []string{nsName}); ok {
+				addrs = append(addrs, netip.AddrPortFrom(addr, port))
+			}
+		}
+		if len(addrs) > 0 {
+			return child, addrs, nil
+		}
+	}
+	return "", nil, ErrIterativeNoServers
+}
+
+// iterativeGlueAddr returns the address of an A or AAAA record owned by one of the given names.
+func iterativeGlueAddr(rr dns.RR, names []string) (netip.Addr, bool) {
+	var (
+		addr netip.Addr
+		ok   bool
+	)
+	switch v := rr.(type) {
+	case *dns.A:
+		addr, ok = netip.AddrFromSlice(v.A.To4())
+	case *dns.AAAA:
+		addr, ok = netip.AddrFromSlice(v.AAAA.To16())
+	}
+	if !ok {
+		return netip.Addr{}, false
+	}
+	owner := dns.CanonicalName(rr.Header().Name)
+	for _, name := range names {
+		if owner == name {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// exchangeMsg is like [*Transport.Exchange] but returns the validated
+// response message without mapping the RCODE to errors.
+func (dt *Transport) exchangeMsg(ctx context.Context, query *dnscodec.Query) (*dns.Msg, error) {
+	return transportExchange(ctx, dt, query, dnscodecQuestion, func(ctx context.Context, conn StreamOpener, query *dnscodec.Query) (*dns.Msg, error) {
+		return streamExchange(ctx, dt, conn, query, parseValidatedMsg)
+	})
+}
+
+// parseValidatedMsg is the [parseFunc] used by [*Transport.exchangeMsg].
+func parseValidatedMsg(queryMsg *dns.Msg, rawQuery, rawResp []byte) (*dns.Msg, error) {
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(rawResp); err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	if _, err := dnscodec.ValidateResponseForQuery(queryMsg, respMsg); err != nil {
+		return nil, err
+	}
+	return respMsg, nil
+}
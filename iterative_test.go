@@ -0,0 +1,269 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// iterativeTestDelegation describes a delegation to a child zone.
+type iterativeTestDelegation struct {
+	// nsName is the name of the child zone name server.
+	nsName string
+
+	// glue is the child name server address or invalid for no glue.
+	glue netip.Addr
+}
+
+// iterativeTestZone describes the behavior of a fake name server.
+type iterativeTestZone struct {
+	// children maps delegated zones to their name servers.
+	children map[string]iterativeTestDelegation
+
+	// answers maps names inside the zone to addresses.
+	answers map[string]netip.Addr
+}
+
+// newIterativeTestResolver creates a [*IterativeResolver] using in-memory
+// name servers and returns it along with the queries received by each server.
+func newIterativeTestResolver(zones map[netip.Addr]*iterativeTestZone) (*IterativeResolver, map[netip.Addr][]string) {
+	seen := make(map[netip.Addr][]string)
+	newTransport := func(endpoint netip.AddrPort) *Transport {
+		handler := HandlerFunc(func(query *dns.Msg) *dns.Msg {
+			q0 := query.Question[0]
+			seen[endpoint.Addr()] = append(seen[endpoint.Addr()], q0.Name)
+			resp := &dns.Msg{}
+			resp.SetReply(query)
+			zone := zones[endpoint.Addr()]
+			if query.RecursionDesired || zone == nil {
+				resp.Rcode = dns.RcodeRefused
+				return resp
+			}
+			for child, delegation := range zone.children {
+				if !dns.IsSubDomain(child, q0.Name) {
+					continue
+				}
+				resp.Ns = []dns.RR{&dns.NS{
+					Hdr: dns.RR_Header{Name: child, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+					Ns:  delegation.nsName,
+				}}
+				if delegation.glue.IsValid() {
+					resp.Extra = []dns.RR{&dns.A{
+						Hdr: dns.RR_Header{Name: delegation.nsName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   delegation.glue.AsSlice(),
+					}}
+				}
+				return resp
+			}
+			resp.Authoritative = true
+			addr, found := zone.answers[q0.Name]
+			switch {
+			case found && q0.Qtype == dns.TypeA:
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: q0.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   addr.AsSlice(),
+				}}
+			case !found && !iterativeTestIsEmptyNonTerminal(zone, q0.Name):
+				resp.Rcode = dns.RcodeNameError
+			}
+			return resp
+		})
+		return NewTransport(NewStreamOpenerDialerHandler(handler), endpoint)
+	}
+	roots := []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:53")}
+	return NewIterativeResolver(newTransport, roots), seen
+}
+
+// iterativeTestIsEmptyNonTerminal returns whether name has descendants but no records.
+func iterativeTestIsEmptyNonTerminal(zone *iterativeTestZone, name string) bool {
+	for other := range zone.answers {
+		if other != name && dns.IsSubDomain(name, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// newIterativeTestZones returns a hierarchy with the root, com., example.com.,
+// and example.net. zones, where the latter hosts the example.org. name server.
+func newIterativeTestZones() map[netip.Addr]*iterativeTestZone {
+	return map[netip.Addr]*iterativeTestZone{
+		netip.MustParseAddr("10.0.0.1"): {
+			children: map[string]iterativeTestDelegation{
+				"com.": {nsName: "a.gtld.", glue: netip.MustParseAddr("10.0.0.2")},
+				"net.": {nsName: "a.gtld.", glue: netip.MustParseAddr("10.0.0.2")},
+				"org.": {nsName: "a.gtld.", glue: netip.MustParseAddr("10.0.0.2")},
+			},
+		},
+		netip.MustParseAddr("10.0.0.2"): {
+			children: map[string]iterativeTestDelegation{
+				"example.com.": {nsName: "ns.example.com.", glue: netip.MustParseAddr("10.0.0.3")},
+				"example.net.": {nsName: "ns.example.net.", glue: netip.MustParseAddr("10.0.0.4")},
+				"example.org.": {nsName: "ns.example.net."},
+			},
+		},
+		netip.MustParseAddr("10.0.0.3"): {
+			answers: map[string]netip.Addr{
+				"example.com.":         netip.MustParseAddr("10.0.1.1"),
+				"www.example.com.":     netip.MustParseAddr("10.0.1.2"),
+				"a.b.www.example.com.": netip.MustParseAddr("10.0.1.3"), // b.www is an empty non-terminal
+			},
+		},
+		netip.MustParseAddr("10.0.0.4"): {
+			answers: map[string]netip.Addr{
+				"example.net.":    netip.MustParseAddr("10.0.2.1"),
+				"ns.example.net.": netip.MustParseAddr("10.0.0.5"),
+			},
+		},
+		netip.MustParseAddr("10.0.0.5"): {
+			answers: map[string]netip.Addr{
+				"example.org.": netip.MustParseAddr("10.0.3.1"),
+			},
+		},
+	}
+}
+
+func TestIterativeResolver(t *testing.T) {
+	t.Run("resolves using QNAME minimization", func(t *testing.T) {
+		resolver, seen := newIterativeTestResolver(newIterativeTestZones())
+		var steps []IterativeStep
+		resolver.ObserveStep = func(step IterativeStep) {
+			steps = append(steps, step)
+		}
+		resp, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassAnswer, ClassifyResponse(resp))
+		require.Equal(t, net.IPv4(10, 0, 1, 2).To4(), resp.Answer[0].(*dns.A).A.To4())
+
+		// the root and TLD servers only see the minimized names
+		require.Equal(t, []string{"com."}, seen[netip.MustParseAddr("10.0.0.1")])
+		require.Equal(t, []string{"example.com."}, seen[netip.MustParseAddr("10.0.0.2")])
+		require.Equal(t, []string{"www.example.com."}, seen[netip.MustParseAddr("10.0.0.3")])
+
+		require.Len(t, steps, 3)
+		require.Equal(t, ".", steps[0].Zone)
+		require.True(t, steps[0].Minimized)
+		require.Equal(t, "example.com.", steps[2].Zone)
+		require.False(t, steps[2].Minimized)
+		require.Equal(t, dns.TypeA, steps[2].Type)
+	})
+
+	t.Run("adds labels without zone cuts", func(t *testing.T) {
+		resolver, seen := newIterativeTestResolver(newIterativeTestZones())
+		resp, err := resolver.Resolve(context.Background(), "a.b.www.example.com", dns.TypeA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassAnswer, ClassifyResponse(resp))
+		require.Equal(t, []string{
+			"www.example.com.", "b.www.example.com.", "a.b.www.example.com.",
+		}, seen[netip.MustParseAddr("10.0.0.3")])
+	})
+
+	t.Run("stops at NXDOMAIN for a minimized name", func(t *testing.T) {
+		resolver, seen := newIterativeTestResolver(newIterativeTestZones())
+		resp, err := resolver.Resolve(context.Background(), "x.nonexistent.example.com", dns.TypeA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassNXDomain, ClassifyResponse(resp))
+		require.Equal(t, []string{"nonexistent.example.com."}, seen[netip.MustParseAddr("10.0.0.3")])
+	})
+
+	t.Run("resolves name servers without glue", func(t *testing.T) {
+		resolver, seen := newIterativeTestResolver(newIterativeTestZones())
+		resp, err := resolver.Resolve(context.Background(), "example.org", dns.TypeA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassAnswer, ClassifyResponse(resp))
+		require.Equal(t, []string{"ns.example.net."}, seen[netip.MustParseAddr("10.0.0.4")])
+		require.Equal(t, []string{"example.org."}, seen[netip.MustParseAddr("10.0.0.5")])
+	})
+
+	t.Run("rejects referrals not moving closer to the name", func(t *testing.T) {
+		zones := newIterativeTestZones()
+		zones[netip.MustParseAddr("10.0.0.1")].children["."] = iterativeTestDelegation{nsName: "a.root."}
+		delete(zones[netip.MustParseAddr("10.0.0.1")].children, "com.")
+		resolver, _ := newIterativeTestResolver(zones)
+		_, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeA)
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("gives up without name server addresses", func(t *testing.T) {
+		zones := newIterativeTestZones()
+		zones[netip.MustParseAddr("10.0.0.2")].children["example.com."] = iterativeTestDelegation{nsName: "ns.nonexistent.com."}
+		resolver, _ := newIterativeTestResolver(zones)
+		_, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeA)
+		require.ErrorIs(t, err, ErrIterativeNoServers)
+	})
+
+	t.Run("enforces the maximum number of queries", func(t *testing.T) {
+		resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+		resolver.MaxQueries = 2
+		_, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeA)
+		require.ErrorIs(t, err, ErrIterativeMaxQueries)
+	})
+
+	t.Run("fails when the context is done after a successful step", func(t *testing.T) {
+		for _, name := range []string{"www.example.com", "example.org"} {
+			resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+			ctx, cancel := context.WithCancel(context.Background())
+			resolver.ObserveStep = func(step IterativeStep) {
+				require.NoError(t, step.Err)
+				cancel()
+			}
+			resp, err := resolver.Resolve(ctx, name, dns.TypeA)
+			require.ErrorIs(t, err, context.Canceled)
+			require.Nil(t, resp)
+		}
+	})
+
+	t.Run("tries the next server on failure", func(t *testing.T) {
+		resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+		resolver.RootServers = append([]netip.AddrPort{netip.MustParseAddrPort("10.9.9.9:53")}, resolver.RootServers...)
+		resp, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassAnswer, ClassifyResponse(resp))
+	})
+}
+
+func TestIterativeResolverDNS64(t *testing.T) {
+	t.Run("synthesizes AAAA records from A records", func(t *testing.T) {
+		resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+		resolver.DNS64Prefix = WellKnownNAT64Prefix
+		resp, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeAAAA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassAnswer, ClassifyResponse(resp))
+		require.Equal(t, dns.TypeAAAA, resp.Question[0].Qtype)
+		aaaa := resp.Answer[0].(*dns.AAAA)
+		require.Equal(t, netip.MustParseAddr("64:ff9b::a00:102").AsSlice(), []byte(aaaa.AAAA))
+	})
+
+	t.Run("does not synthesize without a prefix", func(t *testing.T) {
+		resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+		resp, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeAAAA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassNoData, ClassifyResponse(resp))
+	})
+
+	t.Run("does not synthesize for NXDOMAIN", func(t *testing.T) {
+		resolver, seen := newIterativeTestResolver(newIterativeTestZones())
+		resolver.DNS64Prefix = WellKnownNAT64Prefix
+		resp, err := resolver.Resolve(context.Background(), "nonexistent.example.com", dns.TypeAAAA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassNXDomain, ClassifyResponse(resp))
+		require.Equal(t, []string{"nonexistent.example.com."}, seen[netip.MustParseAddr("10.0.0.3")])
+	})
+
+	t.Run("returns the original response when the A query fails", func(t *testing.T) {
+		resolver, _ := newIterativeTestResolver(newIterativeTestZones())
+		resolver.DNS64Prefix = WellKnownNAT64Prefix
+		resolver.MaxQueries = 3
+		resp, err := resolver.Resolve(context.Background(), "www.example.com", dns.TypeAAAA)
+		require.NoError(t, err)
+		require.Equal(t, ResponseClassNoData, ClassifyResponse(resp))
+		require.Equal(t, dns.TypeAAAA, resp.Question[0].Qtype)
+	})
+}
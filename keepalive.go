@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// streamOpenerTCPKeepalive returns whether conn uses DNS over TCP or TLS,
+// which are the protocols allowing the edns-tcp-keepalive option, since
+// DNS over QUIC forbids it (RFC 9250 Section 5.5.2).
+func streamOpenerTCPKeepalive(conn StreamOpener) bool {
+	switch conn := conn.(type) {
+	case *tcpStreamConn, *tlsStreamConn, *tlsEarlyStreamConn:
+		return true
+	case *pipelineStreamOpener:
+		return streamOpenerTCPKeepalive(conn.pipe.conn)
+	default:
+		return false
+	}
+}
+
+// msgAddTCPKeepalive adds an empty edns-tcp-keepalive option to the query
+// (RFC 7828 Section 3.2.1), adding the EDNS(0) OPT record if needed using
+// maxSize and flags, and padding again to account for the option size.
+func msgAddTCPKeepalive(msg *dns.Msg, maxSize, flags uint16) {
+	if msg.IsEdns0() == nil {
+		msg.SetEdns0(maxSize, flags&dnscodec.QueryFlagDNSSec != 0)
+	}
+	opt := msg.IsEdns0()
+	opt.Option = slices.DeleteFunc(opt.Option, func(option dns.EDNS0) bool {
+		return option.Option() == dns.EDNS0PADDING
+	})
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	if flags&dnscodec.QueryFlagBlockLengthPadding != 0 {
+		msgPadToBlockLength(msg)
+	}
+}
+
+// queryAddTCPKeepalive is like [msgAddTCPKeepalive] but operates on the raw
+// query produced by any [Codec], padding again when the query was padded. We
+// return the raw query unchanged if it already contains the option.
+func queryAddTCPKeepalive(rawQuery []byte, maxSize uint16) ([]byte, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	if msgTCPKeepalive(msg) != nil {
+		return rawQuery, nil
+	}
+	var flags uint16
+	if opt := msg.IsEdns0(); opt != nil && slices.ContainsFunc(opt.Option, func(option dns.EDNS0) bool {
+		return option.Option() == dns.EDNS0PADDING
+	}) {
+		flags |= dnscodec.QueryFlagBlockLengthPadding
+	}
+	msgAddTCPKeepalive(msg, maxSize, flags)
+	return msg.Pack()
+}
+
+// msgTCPKeepalive returns the edns-tcp-keepalive option of the response, if any.
+func msgTCPKeepalive(resp *dns.Msg) *dns.EDNS0_TCP_KEEPALIVE {
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+				return keepalive
+			}
+		}
+	}
+	return nil
+}
+
+// tcpKeepaliveTimeout converts the edns-tcp-keepalive timeout, which is
+// expressed in units of 100 milliseconds, to a [time.Duration].
+func tcpKeepaliveTimeout(keepalive *dns.EDNS0_TCP_KEEPALIVE) time.Duration {
+	return time.Duration(keepalive.Timeout) * 100 * time.Millisecond
+}
+
+// responseTCPKeepalive returns the idle timeout advertised by the server
+// using the edns-tcp-keepalive option of the raw response, if any.
+func responseTCPKeepalive(rawResp []byte) (time.Duration, bool) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return 0, false
+	}
+	keepalive := msgTCPKeepalive(resp)
+	if keepalive == nil {
+		return 0, false
+	}
+	return tcpKeepaliveTimeout(keepalive), true
+}
+
+// streamObserveTCPKeepalive observes the idle timeout advertised by the
+// raw response, if any, and records it into the [*connStats] carried by ctx.
+func streamObserveTCPKeepalive(ctx context.Context, dt *Transport, rawResp []byte) {
+	timeout, found := responseTCPKeepalive(rawResp)
+	if !found {
+		return
+	}
+	if dt.ObserveTCPKeepalive != nil {
+		dt.ObserveTCPKeepalive(timeout)
+	}
+	if stats := connStatsFromContext(ctx); stats != nil {
+		stats.setKeepalive(timeout)
+	}
+}
@@ -0,0 +1,186 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newKeepaliveTestServer starts a DNS-over-TCP server answering queries
+// until the client closes the connection and advertising the given timeout,
+// in units of 100 milliseconds, to the queries containing edns-tcp-keepalive.
+//
+// It returns the endpoint, the number of accepted connections, and the
+// number of queries containing edns-tcp-keepalive.
+func newKeepaliveTestServer(t *testing.T, timeout uint16) (netip.AddrPort, *atomic.Int64, *atomic.Int64) {
+	var keepalives atomic.Int64
+	endpoint, accepted := newPipelineTestServer(t, func(conn net.Conn) {
+		for {
+			query, err := pipelineTestReadQuery(conn)
+			if err != nil {
+				return
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(8, 8, 8, 8),
+			}}
+			if msgTCPKeepalive(query) != nil {
+				keepalives.Add(1)
+				resp.SetEdns0(dns.DefaultMsgSize, false)
+				opt := resp.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{
+					Code: dns.EDNS0TCPKEEPALIVE, Length: 2, Timeout: timeout})
+			}
+			raw, err := resp.Pack()
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(appendStreamMsgFrame(nil, raw)); err != nil {
+				return
+			}
+		}
+	})
+	return endpoint, accepted, &keepalives
+}
+
+func TestTransportTCPKeepalive(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("does not send the option by default", func(t *testing.T) {
+		endpoint, _, keepalives := newKeepaliveTestServer(t, 100)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		dt.ObserveTCPKeepalive = func(time.Duration) {
+			t.Fatal("unexpected keepalive")
+		}
+		_, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Zero(t, keepalives.Load())
+	})
+
+	t.Run("observes the advertised timeout", func(t *testing.T) {
+		endpoint, _, keepalives := newKeepaliveTestServer(t, 15)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		dt.TCPKeepalive = true
+		var timeouts []time.Duration
+		dt.ObserveTCPKeepalive = func(timeout time.Duration) {
+			timeouts = append(timeouts, timeout)
+		}
+		_, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), keepalives.Load())
+		require.Equal(t, []time.Duration{1500 * time.Millisecond}, timeouts)
+	})
+
+	t.Run("observes the advertised timeout using a codec", func(t *testing.T) {
+		endpoint, _, keepalives := newKeepaliveTestServer(t, 15)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		dt.TCPKeepalive = true
+		var timeouts []time.Duration
+		dt.ObserveTCPKeepalive = func(timeout time.Duration) {
+			timeouts = append(timeouts, timeout)
+		}
+		msg := new(dns.Msg)
+		msg.SetQuestion("dns.google.", dns.TypeA)
+		_, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, msg)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), keepalives.Load())
+		require.Equal(t, []time.Duration{1500 * time.Millisecond}, timeouts)
+	})
+
+	t.Run("pools the connection and surfaces the timeout", func(t *testing.T) {
+		endpoint, accepted, _ := newKeepaliveTestServer(t, 100)
+		dt := NewPooledTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint, 0)
+		defer dt.Pool.Close()
+		dt.TCPKeepalive = true
+		for range 2 {
+			_, err := dt.Exchange(context.Background(), query)
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(1), accepted.Load())
+		states := dt.ConnState()
+		require.Len(t, states, 1)
+		require.True(t, states[0].KeepaliveAdvertised)
+		require.Equal(t, 10*time.Second, states[0].KeepaliveTimeout)
+	})
+
+	t.Run("does not pool connections with a zero timeout", func(t *testing.T) {
+		endpoint, accepted, _ := newKeepaliveTestServer(t, 0)
+		dt := NewPooledTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint, 0)
+		defer dt.Pool.Close()
+		dt.TCPKeepalive = true
+		for range 2 {
+			_, err := dt.Exchange(context.Background(), query)
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(2), accepted.Load())
+		stats := dt.Pool.Stats()
+		require.Equal(t, uint64(2), stats.Closing)
+		require.Zero(t, stats.Idle)
+	})
+
+	t.Run("does not reuse connections idle for longer than the timeout", func(t *testing.T) {
+		endpoint, accepted, _ := newKeepaliveTestServer(t, 1)
+		dt := NewPooledTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint, 0)
+		defer dt.Pool.Close()
+		advance := newFakeClock(dt.Pool)
+		dt.TCPKeepalive = true
+		_, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		advance(100 * time.Millisecond)
+		_, err = dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), accepted.Load())
+		require.Equal(t, uint64(1), dt.Pool.Stats().Expired)
+	})
+
+	t.Run("never sends the option over QUIC", func(t *testing.T) {
+		conn := &quicConnAdapter{}
+		require.False(t, streamOpenerTCPKeepalive(conn))
+		require.True(t, streamOpenerTCPKeepalive(&tcpStreamConn{}))
+	})
+}
+
+func TestQueryAddTCPKeepalive(t *testing.T) {
+	pack := func(t *testing.T, flags uint16) []byte {
+		query := dnscodec.NewQuery("dns.google", dns.TypeA)
+		query.Flags = flags
+		msg, err := query.NewMsg()
+		require.NoError(t, err)
+		rawQuery, err := msg.Pack()
+		require.NoError(t, err)
+		return rawQuery
+	}
+
+	t.Run("adds the option and pads again", func(t *testing.T) {
+		rawQuery, err := queryAddTCPKeepalive(pack(t, dnscodec.QueryFlagBlockLengthPadding), 1232)
+		require.NoError(t, err)
+		require.Zero(t, len(rawQuery)%128)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		require.NotNil(t, msgTCPKeepalive(msg))
+	})
+
+	t.Run("does not add the option twice", func(t *testing.T) {
+		rawQuery, err := queryAddTCPKeepalive(pack(t, 0), 1232)
+		require.NoError(t, err)
+		again, err := queryAddTCPKeepalive(rawQuery, 1232)
+		require.NoError(t, err)
+		require.Equal(t, rawQuery, again)
+	})
+
+	t.Run("malformed query", func(t *testing.T) {
+		_, err := queryAddTCPKeepalive([]byte{0x00}, 1232)
+		require.Error(t, err)
+	})
+}
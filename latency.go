@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/bits"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// LatencySnapshot contains the latency distribution of an endpoint.
+//
+// The percentiles have a relative error of at most 1/32 (about 3%).
+type LatencySnapshot struct {
+	// Count is the number of successful exchanges.
+	Count uint64
+
+	// Errors is the number of failed exchanges, including timeouts.
+	Errors uint64
+
+	// Timeouts is the number of exchanges that failed because
+	// the context deadline or the I/O deadline expired.
+	Timeouts uint64
+
+	// Min is the minimum latency of successful exchanges.
+	Min time.Duration
+
+	// Max is the maximum latency of successful exchanges.
+	Max time.Duration
+
+	// Mean is the mean latency of successful exchanges.
+	Mean time.Duration
+
+	// P50 is the 50th percentile latency of successful exchanges.
+	P50 time.Duration
+
+	// P95 is the 95th percentile latency of successful exchanges.
+	P95 time.Duration
+
+	// P99 is the 99th percentile latency of successful exchanges.
+	P99 time.Duration
+}
+
+// LatencyTracker tracks the per-endpoint latency distributions of exchanges.
+//
+// Construct using [NewLatencyTracker] and assign to [*Transport] LatencyTracker
+// field. Share the same [*LatencyTracker] across several [*Transport] to compare
+// the tail latency of upstream resolvers.
+//
+// We record the total time of each exchange using HDR-style histograms with
+// bounded relative error and constant memory per endpoint, so that tracking
+// does not grow with the number of exchanges.
+//
+// A [*LatencyTracker] is safe for concurrent use by multiple goroutines.
+type LatencyTracker struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// endpoints contains the per-endpoint histograms.
+	endpoints map[netip.AddrPort]*latencyHistogram
+}
+
+// NewLatencyTracker creates a new [*LatencyTracker].
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{endpoints: make(map[netip.AddrPort]*latencyHistogram)}
+}
+
+// Record records the outcome of an exchange with the given endpoint
+// that took the given time and failed with err, if not nil.
+//
+// The [*Transport] calls this method automatically. Call it directly to
+// record exchanges performed otherwise (e.g., using [*Transport.Dial]).
+func (lt *LatencyTracker) Record(endpoint netip.AddrPort, elapsed time.Duration, err error) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	hist := lt.endpoints[endpoint]
+	if hist == nil {
+		hist = &latencyHistogram{}
+		lt.endpoints[endpoint] = hist
+	}
+	switch {
+	case err == nil:
+		hist.record(elapsed)
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded):
+		hist.errors++
+		hist.timeouts++
+	default:
+		hist.errors++
+	}
+}
+
+// Snapshot returns the [LatencySnapshot] of the given endpoint, which
+// is the zero value when we have not recorded any exchange with it.
+func (lt *LatencyTracker) Snapshot(endpoint netip.AddrPort) LatencySnapshot {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if hist := lt.endpoints[endpoint]; hist != nil {
+		return hist.snapshot()
+	}
+	return LatencySnapshot{}
+}
+
+// Snapshots returns the [LatencySnapshot] of each endpoint we have
+// recorded exchanges with.
+func (lt *LatencyTracker) Snapshots() map[netip.AddrPort]LatencySnapshot {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	snapshots := make(map[netip.AddrPort]LatencySnapshot, len(lt.endpoints))
+	for endpoint, hist := range lt.endpoints {
+		snapshots[endpoint] = hist.snapshot()
+	}
+	return snapshots
+}
+
+// Reset discards all the recorded exchanges.
+func (lt *LatencyTracker) Reset() {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	clear(lt.endpoints)
+}
+
+// latencySubBucketBits is the log2 of the number of sub-buckets, which
+// bounds the relative error to 2^-(latencySubBucketBits-1).
+const latencySubBucketBits = 6
+
+// latencySubBuckets is the number of sub-buckets.
+const latencySubBuckets = 1 << latencySubBucketBits
+
+// latencyHalfSubBuckets is half the number of sub-buckets.
+const latencyHalfSubBuckets = latencySubBuckets / 2
+
+// latencyNumBuckets is the number of buckets required to cover int64 values.
+const latencyNumBuckets = latencySubBuckets + (64-latencySubBucketBits)*latencyHalfSubBuckets
+
+// latencyHistogram is an HDR-style histogram of nanosecond latencies.
+//
+// Values below [latencySubBuckets] have their own bucket. Larger values share
+// a bucket with the values having the same [latencySubBucketBits] most
+// significant bits, so each power-of-two range has [latencyHalfSubBuckets]
+// linear buckets.
+type latencyHistogram struct {
+	counts   [latencyNumBuckets]uint64
+	count    uint64
+	errors   uint64
+	timeouts uint64
+	sum      float64
+	min      time.Duration
+	max      time.Duration
+}
+
+// latencyBucketIndex returns the bucket index for the value.
+func latencyBucketIndex(value uint64) int {
+	if value < latencySubBuckets {
+		return int(value)
+	}
+	shift := bits.Len64(value) - latencySubBucketBits
+	top := value >> shift
+	return latencySubBuckets + (shift-1)*latencyHalfSubBuckets + int(top-latencyHalfSubBuckets)
+}
+
+// latencyBucketHighest returns the highest value mapping to the bucket index.
+func latencyBucketHighest(index int) uint64 {
+	if index < latencySubBuckets {
+		return uint64(index)
+	}
+	offset := index - latencySubBuckets
+	shift := offset/latencyHalfSubBuckets + 1
+	top := uint64(offset%latencyHalfSubBuckets + latencyHalfSubBuckets)
+	return (top+1)<<shift - 1
+}
+
+// record records a successful exchange latency.
+func (h *latencyHistogram) record(elapsed time.Duration) {
+	elapsed = max(elapsed, 0)
+	h.counts[latencyBucketIndex(uint64(elapsed))]++
+	if h.count <= 0 || elapsed < h.min {
+		h.min = elapsed
+	}
+	h.max = max(h.max, elapsed)
+	h.count++
+	h.sum += float64(elapsed)
+}
+
+// percentile returns the latency below which the given percentage
+// of the successful exchanges falls, clamped to the recorded range.
+func (h *latencyHistogram) percentile(pct float64) time.Duration {
+	if h.count <= 0 {
+		return 0
+	}
+	rank := max(uint64(math.Ceil(pct/100*float64(h.count))), 1)
+	var seen uint64
+	for index, count := range h.counts {
+		if seen += count; seen >= rank {
+			value := time.Duration(min(latencyBucketHighest(index), math.MaxInt64))
+			return min(max(value, h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// snapshot returns the [LatencySnapshot] of the histogram.
+func (h *latencyHistogram) snapshot() LatencySnapshot {
+	snap := LatencySnapshot{
+		Count:    h.count,
+		Errors:   h.errors,
+		Timeouts: h.timeouts,
+		Min:      h.min,
+		Max:      h.max,
+		P50:      h.percentile(50),
+		P95:      h.percentile(95),
+		P99:      h.percentile(99),
+	}
+	if h.count > 0 {
+		snap.Mean = time.Duration(h.sum / float64(h.count))
+	}
+	return snap
+}
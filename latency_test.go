@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBucketIndex(t *testing.T) {
+	// Each value must map to a bucket whose range contains it.
+	values := []uint64{0, 1, 63, 64, 65, 127, 128, 1000, 1 << 20, 123456789, math.MaxInt64, math.MaxUint64}
+	for _, value := range values {
+		t.Run(fmt.Sprint(value), func(t *testing.T) {
+			index := latencyBucketIndex(value)
+			require.Less(t, index, latencyNumBuckets)
+			require.GreaterOrEqual(t, latencyBucketHighest(index), value)
+			if index > 0 {
+				require.Less(t, latencyBucketHighest(index-1), value)
+			}
+		})
+	}
+}
+
+func TestLatencyTrackerPercentiles(t *testing.T) {
+	lt := NewLatencyTracker()
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+	for ms := 1; ms <= 1000; ms++ {
+		lt.Record(endpoint, time.Duration(ms)*time.Millisecond, nil)
+	}
+
+	snap := lt.Snapshot(endpoint)
+	require.Equal(t, uint64(1000), snap.Count)
+	require.Equal(t, time.Millisecond, snap.Min)
+	require.Equal(t, time.Second, snap.Max)
+	require.Equal(t, 500500*time.Microsecond, snap.Mean)
+	for _, tc := range []struct {
+		got, expected time.Duration
+	}{
+		{snap.P50, 500 * time.Millisecond},
+		{snap.P95, 950 * time.Millisecond},
+		{snap.P99, 990 * time.Millisecond},
+	} {
+		require.GreaterOrEqual(t, tc.got, tc.expected)
+		require.LessOrEqual(t, float64(tc.got-tc.expected), float64(tc.expected)/32)
+	}
+}
+
+func TestLatencyTrackerErrors(t *testing.T) {
+	lt := NewLatencyTracker()
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+	lt.Record(endpoint, time.Second, context.DeadlineExceeded)
+	lt.Record(endpoint, time.Second, fmt.Errorf("read: %w", os.ErrDeadlineExceeded))
+	lt.Record(endpoint, time.Millisecond, errors.New("connection refused"))
+	lt.Record(endpoint, 10*time.Millisecond, nil)
+
+	require.Equal(t, LatencySnapshot{
+		Count:    1,
+		Errors:   3,
+		Timeouts: 2,
+		Min:      10 * time.Millisecond,
+		Max:      10 * time.Millisecond,
+		Mean:     10 * time.Millisecond,
+		P50:      10 * time.Millisecond,
+		P95:      10 * time.Millisecond,
+		P99:      10 * time.Millisecond,
+	}, lt.Snapshot(endpoint))
+}
+
+func TestLatencyTrackerSnapshots(t *testing.T) {
+	lt := NewLatencyTracker()
+	endpoint1 := netip.MustParseAddrPort("127.0.0.1:53")
+	endpoint2 := netip.MustParseAddrPort("127.0.0.2:53")
+	require.Zero(t, lt.Snapshot(endpoint1))
+	require.Empty(t, lt.Snapshots())
+
+	lt.Record(endpoint1, time.Millisecond, nil)
+	lt.Record(endpoint2, time.Second, nil)
+	snapshots := lt.Snapshots()
+	require.Len(t, snapshots, 2)
+	require.Equal(t, time.Millisecond, snapshots[endpoint1].P99)
+	require.Equal(t, time.Second, snapshots[endpoint2].P99)
+
+	lt.Reset()
+	require.Empty(t, lt.Snapshots())
+}
+
+func TestTransportExchangeWithLatencyTracker(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+	var fail bool
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			if fail {
+				return nil, errors.New("connection refused")
+			}
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	dt := NewTransport(dialer, endpoint)
+	dt.LatencyTracker = NewLatencyTracker()
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+
+	fail = true
+	_, err = dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.Error(t, err)
+
+	// The endpoint overridden using the context is tracked separately.
+	other := netip.MustParseAddrPort("127.0.0.2:53")
+	_, err = dt.Exchange(WithEndpoint(context.Background(), other), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.Error(t, err)
+
+	snap := dt.LatencyTracker.Snapshot(endpoint)
+	require.Equal(t, uint64(1), snap.Count)
+	require.Equal(t, uint64(1), snap.Errors)
+	require.Zero(t, snap.Timeouts)
+	require.Equal(t, uint64(1), dt.LatencyTracker.Snapshot(other).Errors)
+}
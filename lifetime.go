@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// ConnCloseKind is how the server closed a connection.
+type ConnCloseKind int
+
+const (
+	// ConnCloseNone means that the server did not close the connection
+	// before the context was done.
+	ConnCloseNone ConnCloseKind = iota
+
+	// ConnCloseFIN means that the server closed the TCP connection gracefully.
+	ConnCloseFIN
+
+	// ConnCloseRST means that the server reset the TCP connection or,
+	// for QUIC, sent a stateless reset.
+	ConnCloseRST
+
+	// ConnCloseIdleTimeout means that the QUIC connection timed out because
+	// of inactivity, without the server sending a CONNECTION_CLOSE frame.
+	ConnCloseIdleTimeout
+
+	// ConnCloseApplication means that the server closed the QUIC connection
+	// with an application error code, where DOQ_NO_ERROR is the equivalent of
+	// a GOAWAY (RFC 9250 Section 5.5).
+	ConnCloseApplication
+
+	// ConnCloseTransport means that the server closed the QUIC connection
+	// with a transport error code.
+	ConnCloseTransport
+
+	// ConnCloseOther means that the connection failed otherwise.
+	ConnCloseOther
+)
+
+// String implements [fmt.Stringer].
+func (k ConnCloseKind) String() string {
+	switch k {
+	case ConnCloseNone:
+		return "none"
+	case ConnCloseFIN:
+		return "fin"
+	case ConnCloseRST:
+		return "rst"
+	case ConnCloseIdleTimeout:
+		return "idleTimeout"
+	case ConnCloseApplication:
+		return "application"
+	case ConnCloseTransport:
+		return "transport"
+	default:
+		return "other"
+	}
+}
+
+// LifetimeResult is the result of [*Transport.MeasureConnLifetime].
+type LifetimeResult struct {
+	// KeepaliveAdvertised indicates that the response contained
+	// the edns-tcp-keepalive option (RFC 7828).
+	KeepaliveAdvertised bool
+
+	// KeepaliveTimeout is the idle timeout advertised by the server
+	// using the edns-tcp-keepalive option, if any.
+	KeepaliveTimeout time.Duration
+
+	// Lifetime is the time between receiving the response and
+	// observing the connection close, or the context being done.
+	Lifetime time.Duration
+
+	// Close is how the server closed the connection.
+	Close ConnCloseKind
+
+	// ErrorCode is the QUIC error code for [ConnCloseApplication]
+	// and [ConnCloseTransport], and zero otherwise.
+	ErrorCode uint64
+
+	// Err is the error revealing the close or nil for [ConnCloseNone].
+	Err error
+}
+
+// MeasureConnLifetime dials a connection, sends the query, and then holds the
+// connection open, without sending other queries, until the server closes it
+// or the context is done, which allows to measure server lifetime policies.
+//
+// For DNS over TCP and TLS, the query contains an empty edns-tcp-keepalive
+// option, so that the server may advertise its idle timeout (RFC 7828 Section
+// 3.2.1), which we compare to the actual lifetime. DNS over QUIC forbids this
+// option (RFC 9250 Section 5.5.2), so set the [*QUICDialer] QUICConfig
+// KeepAlivePeriod to prevent the QUIC idle timeout from closing the connection
+// before the server does.
+//
+// The context bounds the whole experiment and this method returns an error
+// only if dialing or exchanging the query fails.
+func (dt *Transport) MeasureConnLifetime(ctx context.Context, query *dnscodec.Query) (*LifetimeResult, error) {
+	// 1. dial the connection
+	conn, err := dt.Dial(ctx)
+	if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// 2. exchange the query, asking for the idle timeout when allowed
+	_, isQUIC := conn.(*quicConnAdapter)
+	codec := lifetimeCodec{keepalive: !isQUIC}
+	resp, err := ExchangeCodecWithStreamOpener(withBorrowedStreamOpener(ctx), dt, codec, conn, query)
+	if err != nil {
+		return nil, err
+	}
+	t0 := dt.now()
+	result := &LifetimeResult{}
+	if keepalive := msgTCPKeepalive(resp); keepalive != nil {
+		result.KeepaliveAdvertised = true
+		result.KeepaliveTimeout = tcpKeepaliveTimeout(keepalive)
+	}
+
+	// 3. wait for the server to close the connection, knowing that
+	// we close the connection when the context is done
+	if qc, ok := conn.(*quicConnAdapter); ok {
+		err = lifetimeWaitQUIC(ctx, qc.qconn)
+	} else {
+		err = lifetimeWaitStream(conn)
+	}
+	result.Lifetime = dt.since(t0)
+	if ctx.Err() == nil {
+		result.Err = err
+		result.Close, result.ErrorCode = classifyConnClose(err)
+	}
+	return result, nil
+}
+
+// lifetimeWaitQUIC waits for the QUIC connection to be closed and returns
+// the close error or the context error.
+func lifetimeWaitQUIC(ctx context.Context, qconn *quic.Conn) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-qconn.Context().Done():
+		return context.Cause(qconn.Context())
+	}
+}
+
+// lifetimeWaitStream reads from the connection, discarding any data, until
+// reading fails because the server closed it or we closed it.
+func lifetimeWaitStream(conn StreamOpener) error {
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1024)
+	for {
+		if _, err := stream.Read(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// classifyConnClose returns the [ConnCloseKind] and the QUIC error code of the close error.
+func classifyConnClose(err error) (ConnCloseKind, uint64) {
+	var (
+		idleErr      *quic.IdleTimeoutError
+		appErr       *quic.ApplicationError
+		transportErr *quic.TransportError
+		resetErr     *quic.StatelessResetError
+	)
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ConnCloseFIN, 0
+	case errors.Is(err, syscall.ECONNRESET), errors.As(err, &resetErr):
+		return ConnCloseRST, 0
+	case errors.As(err, &idleErr):
+		return ConnCloseIdleTimeout, 0
+	case errors.As(err, &appErr):
+		return ConnCloseApplication, uint64(appErr.ErrorCode)
+	case errors.As(err, &transportErr):
+		return ConnCloseTransport, uint64(transportErr.ErrorCode)
+	default:
+		return ConnCloseOther, 0
+	}
+}
+
+// lifetimeCodec is the [Codec] used by [*Transport.MeasureConnLifetime], which
+// optionally adds an empty edns-tcp-keepalive option to the query.
+type lifetimeCodec struct {
+	keepalive bool
+}
+
+var _ Codec[*dnscodec.Query, *dns.Msg] = lifetimeCodec{}
+
+// PackQuery implements [Codec].
+func (c lifetimeCodec) PackQuery(buf []byte, query *dnscodec.Query, params QueryParams) ([]byte, error) {
+	// 1. build the query like [DefaultCodec] does
+	query = query.Clone()
+	params.MutateQuery(query)
+	msg, err := query.NewMsg()
+	if err != nil {
+		return nil, err
+	}
+	params.MutateMsg(msg)
+
+	// 2. add the option, padding again to account for its size
+	if c.keepalive {
+		msgAddTCPKeepalive(msg, query.MaxSize, query.Flags)
+	}
+	return msg.PackBuffer(buf)
+}
+
+// ParseResponse implements [Codec].
+func (lifetimeCodec) ParseResponse(query *dnscodec.Query, rawQuery, rawResp []byte) (*dns.Msg, error) {
+	queryMsg := new(dns.Msg)
+	if err := queryMsg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	return parseValidatedMsg(queryMsg, rawQuery, rawResp)
+}
+
+// Question implements [Codec].
+func (lifetimeCodec) Question(query *dnscodec.Query) (string, uint16) {
+	return dnscodecQuestion(query)
+}
@@ -0,0 +1,225 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnCloseKindString(t *testing.T) {
+	for _, tc := range []struct {
+		kind     ConnCloseKind
+		expected string
+	}{
+		{ConnCloseNone, "none"},
+		{ConnCloseFIN, "fin"},
+		{ConnCloseRST, "rst"},
+		{ConnCloseIdleTimeout, "idleTimeout"},
+		{ConnCloseApplication, "application"},
+		{ConnCloseTransport, "transport"},
+		{ConnCloseOther, "other"},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.kind.String())
+		})
+	}
+}
+
+func TestClassifyConnClose(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind ConnCloseKind
+		code uint64
+	}{
+		{io.EOF, ConnCloseFIN, 0},
+		{io.ErrUnexpectedEOF, ConnCloseFIN, 0},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), ConnCloseRST, 0},
+		{&quic.StatelessResetError{}, ConnCloseRST, 0},
+		{&quic.IdleTimeoutError{}, ConnCloseIdleTimeout, 0},
+		{&quic.ApplicationError{Remote: true, ErrorCode: 0}, ConnCloseApplication, 0},
+		{&quic.ApplicationError{Remote: true, ErrorCode: 0x5}, ConnCloseApplication, 0x5},
+		{&quic.TransportError{ErrorCode: quic.ProtocolViolation}, ConnCloseTransport, uint64(quic.ProtocolViolation)},
+		{errors.New("mocked error"), ConnCloseOther, 0},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			kind, code := classifyConnClose(tc.err)
+			require.Equal(t, tc.kind, kind)
+			require.Equal(t, tc.code, code)
+		})
+	}
+}
+
+func TestLifetimeCodecPackQuery(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("with keepalive and padding", func(t *testing.T) {
+		raw, err := lifetimeCodec{keepalive: true}.PackQuery(nil, query, QueryParamsTLS())
+		require.NoError(t, err)
+		require.Zero(t, len(raw)%128)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(raw))
+		require.NotNil(t, msgTCPKeepalive(msg))
+	})
+
+	t.Run("without keepalive", func(t *testing.T) {
+		raw, err := lifetimeCodec{}.PackQuery(nil, query, QueryParamsQUIC())
+		require.NoError(t, err)
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(raw))
+		require.Nil(t, msgTCPKeepalive(msg))
+		require.Zero(t, msg.Id)
+	})
+}
+
+// newLifetimeTCPServer starts a DNS-over-TCP server answering a single query
+// per connection, advertising a 1s idle timeout, and then invoking after.
+func newLifetimeTCPServer(t *testing.T, after func(conn *net.TCPConn)) netip.AddrPort {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				rawQuery := make([]byte, int(header[0])<<8|int(header[1]))
+				if _, err := io.ReadFull(conn, rawQuery); err != nil {
+					return
+				}
+				query := new(dns.Msg)
+				if err := query.Unpack(rawQuery); err != nil {
+					return
+				}
+				resp := new(dns.Msg)
+				resp.SetReply(query)
+				resp.SetEdns0(dns.DefaultMsgSize, false)
+				opt := resp.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 10})
+				rawResp, err := resp.Pack()
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...))
+				after(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).AddrPort()
+}
+
+func TestMeasureConnLifetimeTCP(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	for _, tc := range []struct {
+		name  string
+		after func(conn *net.TCPConn)
+		kind  ConnCloseKind
+	}{
+		{"fin", func(conn *net.TCPConn) { time.Sleep(50 * time.Millisecond) }, ConnCloseFIN},
+		{"rst", func(conn *net.TCPConn) { conn.SetLinger(0) }, ConnCloseRST},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint := newLifetimeTCPServer(t, tc.after)
+			dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+			result, err := dt.MeasureConnLifetime(context.Background(), query)
+			require.NoError(t, err)
+			require.True(t, result.KeepaliveAdvertised)
+			require.Equal(t, time.Second, result.KeepaliveTimeout)
+			require.Equal(t, tc.kind, result.Close)
+			require.Error(t, result.Err)
+		})
+	}
+
+	t.Run("the server does not close", func(t *testing.T) {
+		config := dnstest.NewHandlerConfig()
+		config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", dnstest.NewHandler(config))
+		t.Cleanup(srv.Close)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		result, err := dt.MeasureConnLifetime(ctx, query)
+		require.NoError(t, err)
+		require.False(t, result.KeepaliveAdvertised)
+		require.Equal(t, ConnCloseNone, result.Close)
+		require.NoError(t, result.Err)
+		require.Positive(t, result.Lifetime)
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return nil, expected
+			},
+		}
+		_, err := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53")).MeasureConnLifetime(context.Background(), query)
+		require.ErrorIs(t, err, expected)
+	})
+}
+
+func TestMeasureConnLifetimeQUIC(t *testing.T) {
+	// Use a server that closes the connection with DOQ_NO_ERROR after
+	// answering, which is the DoQ equivalent of a GOAWAY.
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pconn.Close() })
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{newTestCert()}, NextProtos: []string{"doq"}}
+	listener, err := quic.Listen(pconn, tlsConfig, &quic.Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		serveTestStream(stream, func(query *dns.Msg) []*dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(query)
+			return []*dns.Msg{resp}
+		})
+		time.Sleep(50 * time.Millisecond)
+		conn.CloseWithError(0, "")
+	}()
+
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer clientConn.Close()
+	quicDialer := NewQUICDialer(clientConn, "example.com")
+	quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+	dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), listener.Addr().(*net.UDPAddr).AddrPort())
+
+	result, err := dt.MeasureConnLifetime(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.NoError(t, err)
+	require.False(t, result.KeepaliveAdvertised)
+	require.Equal(t, ConnCloseApplication, result.Close)
+	require.Zero(t, result.ErrorCode)
+	require.Positive(t, result.Lifetime)
+}
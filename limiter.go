@@ -0,0 +1,198 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// LimiterStats contains [*Limiter] metrics.
+type LimiterStats struct {
+	// Acquired is the number of successful [*Limiter.Acquire] calls.
+	Acquired uint64
+
+	// Canceled is the number of [*Limiter.Acquire] calls that failed
+	// because the context was done while queueing.
+	Canceled uint64
+
+	// Queued is the number of [*Limiter.Acquire] calls that had to wait.
+	Queued uint64
+
+	// TotalQueueTime is the total time spent waiting in the queue.
+	TotalQueueTime time.Duration
+
+	// MaxQueueTime is the maximum time spent waiting in the queue.
+	MaxQueueTime time.Duration
+}
+
+// Limiter limits the number of concurrent exchanges globally and per endpoint.
+//
+// Construct using [NewLimiter] and assign to [*Transport] Limiter field. Share
+// the same [*Limiter] across several [*Transport] (e.g., the transports using
+// the same [*Pool]) to enforce a global limit across all of them.
+//
+// Callers exceeding the limits are queued until either a slot becomes
+// available or their context is done.
+//
+// A [*Limiter] is safe for concurrent use by multiple goroutines.
+type Limiter struct {
+	// global is the global semaphore or nil if unlimited.
+	global chan struct{}
+
+	// perEndpoint is the per-endpoint limit or zero if unlimited.
+	perEndpoint int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// endpoints contains the per-endpoint semaphores.
+	endpoints map[netip.AddrPort]*limiterEndpoint
+
+	// stats contains the limiter metrics.
+	stats LimiterStats
+}
+
+// limiterEndpoint is a reference-counted per-endpoint semaphore.
+type limiterEndpoint struct {
+	sema chan struct{}
+	refs int
+}
+
+// NewLimiter creates a new [*Limiter].
+//
+// The maxGlobal argument is the maximum number of concurrent exchanges
+// and maxPerEndpoint is the maximum number of concurrent exchanges for each
+// endpoint. A zero or negative value means unlimited.
+func NewLimiter(maxGlobal, maxPerEndpoint int) *Limiter {
+	lim := &Limiter{
+		perEndpoint: max(maxPerEndpoint, 0),
+		endpoints:   make(map[netip.AddrPort]*limiterEndpoint),
+	}
+	if maxGlobal > 0 {
+		lim.global = make(chan struct{}, maxGlobal)
+	}
+	return lim
+}
+
+// Acquire waits for a slot to exchange with the given endpoint.
+//
+// On success, it returns the function to release the slot, which the
+// caller MUST call exactly once, and the time spent queueing. On failure,
+// it returns the context error and the time spent queueing.
+func (lim *Limiter) Acquire(ctx context.Context, endpoint netip.AddrPort) (func(), time.Duration, error) {
+	t0 := time.Now()
+	var queued bool
+
+	// 1. acquire the per-endpoint slot first, so we do not hold a global
+	// slot while waiting for a busy endpoint
+	epsema := lim.refEndpoint(endpoint)
+	if epsema != nil {
+		ok, waited := limiterSemaAcquire(ctx, epsema)
+		queued = queued || waited
+		if !ok {
+			lim.unrefEndpoint(endpoint)
+			return nil, lim.record(t0, queued, false), ctx.Err()
+		}
+	}
+
+	// 2. acquire the global slot
+	if lim.global != nil {
+		ok, waited := limiterSemaAcquire(ctx, lim.global)
+		queued = queued || waited
+		if !ok {
+			if epsema != nil {
+				<-epsema
+				lim.unrefEndpoint(endpoint)
+			}
+			return nil, lim.record(t0, queued, false), ctx.Err()
+		}
+	}
+
+	// 3. build the release function
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			if lim.global != nil {
+				<-lim.global
+			}
+			if epsema != nil {
+				<-epsema
+				lim.unrefEndpoint(endpoint)
+			}
+		})
+	}
+	return release, lim.record(t0, queued, true), nil
+}
+
+// Stats returns a snapshot of the limiter metrics.
+func (lim *Limiter) Stats() LimiterStats {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.stats
+}
+
+// record updates the stats and returns the time spent queueing.
+func (lim *Limiter) record(t0 time.Time, queued, acquired bool) time.Duration {
+	var elapsed time.Duration
+	if queued {
+		elapsed = time.Since(t0)
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if acquired {
+		lim.stats.Acquired++
+	} else {
+		lim.stats.Canceled++
+	}
+	if queued {
+		lim.stats.Queued++
+		lim.stats.TotalQueueTime += elapsed
+		lim.stats.MaxQueueTime = max(lim.stats.MaxQueueTime, elapsed)
+	}
+	return elapsed
+}
+
+// refEndpoint returns the semaphore for the endpoint or nil if unlimited.
+func (lim *Limiter) refEndpoint(endpoint netip.AddrPort) chan struct{} {
+	if lim.perEndpoint <= 0 {
+		return nil
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	entry := lim.endpoints[endpoint]
+	if entry == nil {
+		entry = &limiterEndpoint{sema: make(chan struct{}, lim.perEndpoint)}
+		lim.endpoints[endpoint] = entry
+	}
+	entry.refs++
+	return entry.sema
+}
+
+// unrefEndpoint releases a reference to the semaphore for the endpoint.
+func (lim *Limiter) unrefEndpoint(endpoint netip.AddrPort) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	entry := lim.endpoints[endpoint]
+	if entry.refs--; entry.refs <= 0 {
+		delete(lim.endpoints, endpoint)
+	}
+}
+
+// limiterSemaAcquire acquires the semaphore and reports whether
+// it succeeded and whether it needed to wait.
+func limiterSemaAcquire(ctx context.Context, sema chan struct{}) (bool, bool) {
+	select {
+	case sema <- struct{}{}:
+		return true, false
+	default:
+	}
+	select {
+	case sema <- struct{}{}:
+		return true, true
+	case <-ctx.Done():
+		return false, true
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	lim := NewLimiter(0, 0)
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+
+	var releases []func()
+	for range 16 {
+		release, queued, err := lim.Acquire(context.Background(), endpoint)
+		require.NoError(t, err)
+		require.Zero(t, queued)
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+
+	require.Equal(t, LimiterStats{Acquired: 16}, lim.Stats())
+}
+
+func TestLimiterPerEndpoint(t *testing.T) {
+	lim := NewLimiter(0, 1)
+	endpoint1 := netip.MustParseAddrPort("127.0.0.1:53")
+	endpoint2 := netip.MustParseAddrPort("127.0.0.2:53")
+
+	release1, _, err := lim.Acquire(context.Background(), endpoint1)
+	require.NoError(t, err)
+
+	// A distinct endpoint is not affected by the first one being busy.
+	release2, queued, err := lim.Acquire(context.Background(), endpoint2)
+	require.NoError(t, err)
+	require.Zero(t, queued)
+	release2()
+
+	// The same endpoint must wait until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, queued, err = lim.Acquire(ctx, endpoint1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotZero(t, queued)
+
+	// After releasing, the endpoint is available again.
+	release1()
+	release1() // idempotent
+	release3, _, err := lim.Acquire(context.Background(), endpoint1)
+	require.NoError(t, err)
+	release3()
+
+	stats := lim.Stats()
+	require.Equal(t, uint64(3), stats.Acquired)
+	require.Equal(t, uint64(1), stats.Canceled)
+	require.Equal(t, uint64(1), stats.Queued)
+	require.Equal(t, stats.TotalQueueTime, stats.MaxQueueTime)
+	require.Empty(t, lim.endpoints)
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	lim := NewLimiter(1, 1)
+	endpoint1 := netip.MustParseAddrPort("127.0.0.1:53")
+	endpoint2 := netip.MustParseAddrPort("127.0.0.2:53")
+
+	release1, _, err := lim.Acquire(context.Background(), endpoint1)
+	require.NoError(t, err)
+
+	// A distinct endpoint must wait for the global slot.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = lim.Acquire(ctx, endpoint2)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Empty(t, lim.endpoints[endpoint2])
+
+	// Releasing the first slot wakes up a queued caller.
+	done := make(chan time.Duration)
+	go func() {
+		release, queued, err := lim.Acquire(context.Background(), endpoint2)
+		require.NoError(t, err)
+		release()
+		done <- queued
+	}()
+	time.Sleep(10 * time.Millisecond)
+	release1()
+	require.NotZero(t, <-done)
+}
+
+func TestTransportExchangeWithLimiter(t *testing.T) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+	dt := NewTransport(dialer, endpoint)
+	dt.Limiter = NewLimiter(1, 1)
+	var observed []time.Duration
+	dt.ObserveQueueTime = func(d time.Duration) {
+		observed = append(observed, d)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, observed, 1)
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		release, _, err := dt.Limiter.Acquire(context.Background(), endpoint)
+		require.NoError(t, err)
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = dt.Exchange(ctx, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Len(t, observed, 2)
+		require.NotZero(t, observed[1])
+	})
+}
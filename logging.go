@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// RedactNameFunc redacts a query name before it is logged.
+//
+// Use [RedactNameHash] or [RedactNameETLDPlusOne], or provide a custom function.
+type RedactNameFunc func(name string) string
+
+// RedactNameHash returns a [RedactNameFunc] replacing the name with the
+// hex-encoded HMAC-SHA256 of its canonical form, truncated to 16 bytes.
+//
+// Using a secret key prevents dictionary attacks on popular names, while
+// the same name still maps to the same value, which allows correlating logs.
+func RedactNameHash(key []byte) RedactNameFunc {
+	return func(name string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(dns.CanonicalName(name)))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+}
+
+// RedactNameETLDPlusOne is a [RedactNameFunc] truncating the name to its
+// effective TLD plus one label (e.g., "www.example.co.uk" becomes "example.co.uk.").
+//
+// Names that are effective TLDs themselves are returned unchanged, while
+// names we cannot parse are replaced with ".".
+func RedactNameETLDPlusOne(name string) string {
+	name = strings.TrimSuffix(dns.CanonicalName(name), ".")
+	if name == "" {
+		return "."
+	}
+	etld, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		if suffix, _ := publicsuffix.PublicSuffix(name); suffix == name {
+			return dns.Fqdn(name)
+		}
+		return "."
+	}
+	return dns.Fqdn(etld)
+}
+
+// logExchange logs the outcome of an exchange using the configured [*slog.Logger].
+func (dt *Transport) logExchange(ctx context.Context, name string, qtype uint16, t0 time.Time, err error) {
+	if dt.RedactName != nil {
+		name = dt.RedactName(name)
+	}
+	level := slog.LevelInfo
+	if err != nil {
+		level = slog.LevelWarn
+	}
+	id, _ := CorrelationID(ctx)
+	dt.Logger.LogAttrs(ctx, level, "dnsExchange",
+		slog.String("correlationID", id),
+		slog.String("endpoint", dt.endpointFor(ctx).String()),
+		slog.String("qname", name),
+		slog.String("qtype", dns.TypeToString[qtype]),
+		slog.Time("t0", t0),
+		slog.Duration("elapsed", dt.since(t0)),
+		slog.Any("err", err),
+	)
+}
@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactNameHash(t *testing.T) {
+	redact := RedactNameHash([]byte("secret"))
+
+	t.Run("is deterministic and case insensitive", func(t *testing.T) {
+		require.Equal(t, redact("www.example.com"), redact("WWW.Example.COM."))
+		require.Len(t, redact("www.example.com"), 32)
+	})
+
+	t.Run("depends on the key", func(t *testing.T) {
+		other := RedactNameHash([]byte("other"))
+		require.NotEqual(t, redact("www.example.com"), other("www.example.com"))
+	})
+
+	t.Run("does not leak the name", func(t *testing.T) {
+		require.NotContains(t, redact("www.example.com"), "example")
+	})
+}
+
+func TestRedactNameETLDPlusOne(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"subdomain", "www.example.com", "example.com."},
+		{"fqdn with uppercase", "WWW.Example.COM.", "example.com."},
+		{"multi-label suffix", "a.b.example.co.uk", "example.co.uk."},
+		{"public suffix", "co.uk", "co.uk."},
+		{"root", ".", "."},
+		{"empty", "", "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, RedactNameETLDPlusOne(tt.input))
+		})
+	}
+}
+
+func TestTransportLogger(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("www.example.com", netip.MustParseAddr("10.0.0.1"))
+	handler := dnstest.NewHandler(config)
+
+	// newTransport returns a [*Transport] logging JSON into the given buffer.
+	newTransport := func(buf *bytes.Buffer, dialer StreamOpenerDialer) *Transport {
+		dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+		dt.Logger = slog.New(slog.NewJSONHandler(buf, nil))
+		return dt
+	}
+
+	// decode parses the single logged line.
+	decode := func(t *testing.T, buf *bytes.Buffer) map[string]any {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+		return entry
+	}
+
+	t.Run("logs the full name without redaction", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		dt := newTransport(buf, NewStreamOpenerDialerHandler(handler))
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("www.example.com", dns.TypeA))
+		require.NoError(t, err)
+		entry := decode(t, buf)
+		require.Equal(t, "dnsExchange", entry["msg"])
+		require.Equal(t, "INFO", entry["level"])
+		require.Equal(t, "www.example.com", entry["qname"])
+		require.Equal(t, "A", entry["qtype"])
+		require.Equal(t, "127.0.0.1:53", entry["endpoint"])
+		require.Contains(t, entry, "t0")
+		require.Contains(t, entry, "elapsed")
+		require.Nil(t, entry["err"])
+	})
+
+	t.Run("applies the redaction function", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		dt := newTransport(buf, NewStreamOpenerDialerHandler(handler))
+		dt.RedactName = RedactNameETLDPlusOne
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("www.example.com", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "example.com.", decode(t, buf)["qname"])
+		require.NotContains(t, buf.String(), "www.example.com")
+	})
+
+	t.Run("logs failures as warnings", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		expected := errors.New("mocked error")
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return nil, expected
+			},
+		}
+		dt := newTransport(buf, dialer)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("www.example.com", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+		entry := decode(t, buf)
+		require.Equal(t, "WARN", entry["level"])
+		require.Equal(t, "mocked error", entry["err"])
+	})
+}
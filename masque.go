@@ -0,0 +1,325 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// ErrMASQUE indicates that the MASQUE proxy refused or failed our request.
+var ErrMASQUE = errors.New("dnsoverstream: MASQUE proxy error")
+
+// DefaultMASQUETemplate is the default URI template path used by
+// [*MASQUEDialer], which is the well-known one (RFC 9298 Section 3).
+const DefaultMASQUETemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+
+// masqueContextID is the context ID of the UDP payloads (RFC 9298 Section 4).
+var masqueContextID = []byte{0}
+
+// masqueInitialPacketSize is the QUIC packet size we use with the proxy by
+// default, which leaves room for tunneling QUIC packets of the default size.
+const masqueInitialPacketSize = 1350
+
+// MASQUEDialer implements [NetDialer] by tunneling UDP through an HTTP/3 proxy
+// using connect-udp (RFC 9298), so that DNS over UDP and DNS over QUIC (using
+// [*QUICDialer] with ConnectedUDP set and this dialer as the UDPDialer) work
+// from vantage points where we can only reach the proxy.
+//
+// DialContext establishes a new QUIC connection with the proxy for each call,
+// which we close along with the returned [net.Conn], and the context bounds
+// both the QUIC handshake and the CONNECT request. We pass the destination
+// host to the proxy as is, so that the proxy resolves domain names.
+//
+// We use quic-go's HTTP/3 client: we send and receive datagrams using QUIC
+// DATAGRAM frames (RFC 9297 Section 2.1) and we ignore the capsules received
+// on the request stream.
+//
+// Construct using [NewMASQUEDialer].
+type MASQUEDialer struct {
+	// Dialer is the MANDATORY [*QUICDialer] connecting to the proxy, whose
+	// [*tls.Config] must include "h3" in NextProtos (see [NewTLSConfigDNSOverHTTP3]).
+	//
+	// We use a copy of its QUICConfig enabling datagrams and, unless already
+	// set, using an InitialPacketSize large enough for tunneling QUIC.
+	Dialer *QUICDialer
+
+	// ProxyEndpoint is the MANDATORY proxy endpoint.
+	ProxyEndpoint netip.AddrPort
+
+	// Template is the OPTIONAL URI template path containing the
+	// {target_host} and {target_port} variables. If empty, we
+	// use [DefaultMASQUETemplate].
+	Template string
+
+	// Host is the OPTIONAL host used for the HTTP authority. If empty, we
+	// use the TLS ServerName of the Dialer or, if unknown, the endpoint.
+	Host string
+}
+
+// NewMASQUEDialer creates a new [*MASQUEDialer] using the given [*QUICDialer]
+// to connect to the proxy listening at the given endpoint.
+func NewMASQUEDialer(dialer *QUICDialer, proxy netip.AddrPort) *MASQUEDialer {
+	return &MASQUEDialer{Dialer: dialer, ProxyEndpoint: proxy}
+}
+
+var _ NetDialer = &MASQUEDialer{}
+
+// DialContext implements [NetDialer].
+//
+// We only support the "udp", "udp4", and "udp6" networks.
+func (d *MASQUEDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// 1. make sure we can proxy the network and the address
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("%w: unsupported network %q", ErrMASQUE, network)
+	}
+	path, err := masqueExpandTemplate(d.Template, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. establish the QUIC connection with datagrams enabled
+	qd := *d.Dialer
+	qd.QUICConfig = &quic.Config{}
+	if d.Dialer.QUICConfig != nil {
+		qd.QUICConfig = d.Dialer.QUICConfig.Clone()
+	}
+	qd.QUICConfig.EnableDatagrams = true
+	if qd.QUICConfig.InitialPacketSize == 0 {
+		qd.QUICConfig.InitialPacketSize = masqueInitialPacketSize
+	}
+	qconn, err := qd.Dial(ctx, d.ProxyEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. send the request bounded by the context
+	var serverName string
+	if d.Dialer.TLSConfig != nil {
+		serverName = d.Dialer.TLSConfig.ServerName
+	}
+	authority := httpsAuthority(d.Host, serverName, d.ProxyEndpoint)
+	stop := context.AfterFunc(ctx, func() { qconn.CloseWithError(http3NoError, "") })
+	conn, err := masqueConnect(ctx, qconn, authority, path, address)
+	if !stop() {
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, wrapContextError(ctx, err)
+	}
+	if err != nil {
+		qconn.CloseWithError(http3NoError, "")
+		return nil, wrapICMPError(err)
+	}
+	return conn, nil
+}
+
+// masqueExpandTemplate expands the URI template path for the given address,
+// percent-encoding the colons of IPv6 addresses (RFC 9298 Section 2).
+func masqueExpandTemplate(template, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if template == "" {
+		template = DefaultMASQUETemplate
+	}
+	host = strings.ReplaceAll(url.PathEscape(host), ":", "%3A")
+	return strings.NewReplacer("{target_host}", host, "{target_port}", port).Replace(template), nil
+}
+
+// masqueConnect sends the connect-udp request over the given QUIC connection
+// and returns the [net.Conn] for the tunnel when the proxy accepts it.
+func masqueConnect(ctx context.Context, qconn *quic.Conn, authority, path, address string) (net.Conn, error) {
+	// 1. create the HTTP/3 client connection enabling HTTP datagrams and wait
+	// for the proxy SETTINGS (RFC 9220 Section 3 and RFC 9297 Section 2.1.1)
+	cc := (&http3.Transport{EnableDatagrams: true, DisableCompression: true}).NewClientConn(qconn)
+	select {
+	case <-cc.ReceivedSettings():
+	case <-qconn.Context().Done():
+		return nil, context.Cause(qconn.Context())
+	}
+	if settings := cc.Settings(); !settings.EnableExtendedConnect || !settings.EnableDatagrams {
+		return nil, fmt.Errorf("%w: proxy does not support datagrams", ErrMASQUE)
+	}
+
+	// 2. send the extended CONNECT request (RFC 9220 and RFC 9298 Section 3.4)
+	URL, err := url.Parse("https://" + authority + path)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Proto:  "connect-udp",
+		Host:   authority,
+		URL:    URL,
+		Header: http.Header{
+			"Capsule-Protocol": {"?1"},
+			"User-Agent":       {""},
+		},
+	}
+	stream, err := cc.OpenRequestStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendRequestHeader(req); err != nil {
+		return nil, err
+	}
+
+	// 3. read the response headers
+	if err := masqueReadResponse(stream); err != nil {
+		stream.CancelWrite(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		stream.CancelRead(quic.StreamErrorCode(http3.ErrCodeRequestCanceled))
+		return nil, err
+	}
+
+	// 4. create the tunnel, which ends when the proxy closes the request stream
+	conn := &masqueConn{
+		qconn:  qconn,
+		stream: stream,
+		raddr:  masqueRemoteAddr(qconn, address),
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, stream)
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// masqueReadResponse reads the response headers until the final response
+// and returns an error unless the status code is 2xx.
+func masqueReadResponse(stream *http3.RequestStream) error {
+	for {
+		resp, err := stream.ReadResponse()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 100 && resp.StatusCode < 200 {
+			continue // skip informational responses (RFC 9114 Section 4.1)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%w: %w", ErrMASQUE, &HTTPSStatusError{StatusCode: resp.StatusCode})
+		}
+		return nil
+	}
+}
+
+// masqueRemoteAddr returns the address we use as RemoteAddr, which is the
+// target address when it is an endpoint and the proxy address otherwise.
+func masqueRemoteAddr(qconn *quic.Conn, address string) net.Addr {
+	if addrport, err := netip.ParseAddrPort(address); err == nil {
+		return net.UDPAddrFromAddrPort(addrport)
+	}
+	return qconn.RemoteAddr()
+}
+
+// masqueConn is a connected [net.Conn] sending and receiving datagrams
+// through a connect-udp tunnel using HTTP datagrams (RFC 9297).
+type masqueConn struct {
+	// qconn is the QUIC connection with the proxy.
+	qconn *quic.Conn
+
+	// stream is the connect-udp request stream.
+	stream *http3.RequestStream
+
+	// raddr is the address we return as RemoteAddr.
+	raddr net.Addr
+
+	// mu protects deadline.
+	mu sync.Mutex
+
+	// deadline is the read deadline.
+	deadline time.Time
+}
+
+// Read implements [net.Conn].
+//
+// We apply the read deadline when Read starts and drop the datagrams
+// using context IDs other than zero (RFC 9298 Section 4).
+func (c *masqueConn) Read(data []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	ctx := c.qconn.Context()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	for {
+		datagram, err := c.stream.ReceiveDatagram(ctx)
+		if errors.Is(err, context.DeadlineExceeded) && c.qconn.Context().Err() == nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if err != nil {
+			return 0, wrapICMPError(err)
+		}
+		if payload, ok := bytes.CutPrefix(datagram, masqueContextID); ok {
+			return copy(data, payload), nil
+		}
+	}
+}
+
+// Write implements [net.Conn].
+func (c *masqueConn) Write(data []byte) (int, error) {
+	datagram := make([]byte, 0, len(masqueContextID)+len(data))
+	datagram = append(datagram, masqueContextID...)
+	datagram = append(datagram, data...)
+	if err := c.stream.SendDatagram(datagram); err != nil {
+		return 0, wrapICMPError(err)
+	}
+	return len(data), nil
+}
+
+// Close implements [net.Conn].
+//
+// This closes the connection with the proxy using H3_NO_ERROR.
+func (c *masqueConn) Close() error {
+	return c.qconn.CloseWithError(http3NoError, "")
+}
+
+// LocalAddr implements [net.Conn].
+func (c *masqueConn) LocalAddr() net.Addr {
+	return c.qconn.LocalAddr()
+}
+
+// RemoteAddr implements [net.Conn].
+func (c *masqueConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline implements [net.Conn].
+func (c *masqueConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements [net.Conn].
+func (c *masqueConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements [net.Conn].
+//
+// We ignore the write deadline because sending datagrams does not block.
+func (c *masqueConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+// masqueTestProxy is a minimal connect-udp proxy for testing.
+type masqueTestProxy struct {
+	// status is the status code we send.
+	status int
+
+	// endpoint is the proxy endpoint.
+	endpoint netip.AddrPort
+
+	// mu protects fields.
+	mu sync.Mutex
+
+	// fields contains the fields of each request.
+	fields []map[string]string
+}
+
+// newMASQUETestProxy starts a [*masqueTestProxy] sending the given status code.
+func newMASQUETestProxy(t *testing.T, status int) *masqueTestProxy {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	proxy := &masqueTestProxy{status: status, endpoint: pconn.LocalAddr().(*net.UDPAddr).AddrPort()}
+	srv := &http3.Server{
+		Handler:         http.HandlerFunc(proxy.serve),
+		TLSConfig:       http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{newTestCert()}}),
+		QUICConfig:      &quic.Config{EnableDatagrams: true, InitialPacketSize: masqueInitialPacketSize},
+		EnableDatagrams: true,
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() { srv.Serve(pconn) })
+	t.Cleanup(func() {
+		srv.Close()
+		wg.Wait()
+		pconn.Close()
+	})
+	return proxy
+}
+
+// Fields returns the fields of each request.
+func (p *masqueTestProxy) Fields() []map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]map[string]string{}, p.fields...)
+}
+
+// serve handles a single request.
+func (p *masqueTestProxy) serve(w http.ResponseWriter, r *http.Request) {
+	// 1. record the request fields
+	fields := map[string]string{
+		":method":          r.Method,
+		":protocol":        r.Proto,
+		":scheme":          r.URL.Scheme,
+		":authority":       r.Host,
+		":path":            r.URL.RequestURI(),
+		"capsule-protocol": r.Header.Get("Capsule-Protocol"),
+	}
+	p.mu.Lock()
+	p.fields = append(p.fields, fields)
+	p.mu.Unlock()
+
+	// 2. send the response headers
+	w.WriteHeader(p.status)
+	if p.status != 200 {
+		return
+	}
+	stream := w.(http3.HTTPStreamer).HTTPStream()
+	defer stream.Close()
+
+	// 3. connect to the target
+	parts := strings.Split(fields[":path"], "/")
+	if len(parts) < 6 {
+		return
+	}
+	host := strings.ReplaceAll(parts[4], "%3A", ":")
+	udpConn, err := net.Dial("udp", net.JoinHostPort(host, parts[5]))
+	if err != nil {
+		return
+	}
+
+	// 4. relay the datagrams until the client closes the request stream
+	ctx, cancel := context.WithCancel(r.Context())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer udpConn.Close()
+	defer cancel()
+	wg.Go(func() {
+		defer cancel()
+		_, _ = io.Copy(io.Discard, stream)
+	})
+	wg.Go(func() {
+		buf := make([]byte, 1<<16)
+		for {
+			count, err := udpConn.Read(buf)
+			if err != nil {
+				return
+			}
+			stream.SendDatagram(append(bytes.Clone(masqueContextID), buf[:count]...))
+		}
+	})
+	for {
+		datagram, err := stream.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		if payload, ok := bytes.CutPrefix(datagram, masqueContextID); ok {
+			udpConn.Write(payload)
+		}
+	}
+}
+
+// newMASQUETestDialer returns a [*MASQUEDialer] for the given proxy trusting [testPKI].
+func newMASQUETestDialer(proxy *masqueTestProxy) *MASQUEDialer {
+	qd := &QUICDialer{TLSConfig: newTestClientTLSConfig("h3"), ConnectedUDP: true}
+	return NewMASQUEDialer(qd, proxy.endpoint)
+}
+
+func TestMASQUEDialer(t *testing.T) {
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+
+	t.Run("DNS over UDP through the proxy", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := newMASQUETestProxy(t, 200)
+		dt := NewTransport(NewStreamOpenerDialerUDP(newMASQUETestDialer(proxy)), netip.MustParseAddrPort(dnsSrv.Address()))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.Exchange(ctx, newQuery())
+		require.NoError(t, err)
+
+		fields := proxy.Fields()
+		require.Len(t, fields, 1)
+		endpoint := netip.MustParseAddrPort(dnsSrv.Address())
+		require.Equal(t, map[string]string{
+			":method":          "CONNECT",
+			":protocol":        "connect-udp",
+			":scheme":          "https",
+			":authority":       "example.com",
+			":path":            "/.well-known/masque/udp/127.0.0.1/" + strconv.Itoa(int(endpoint.Port())) + "/",
+			"capsule-protocol": "?1",
+		}, fields[0])
+	})
+
+	t.Run("DNS over QUIC through the proxy", func(t *testing.T) {
+		dnsSrv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		proxy := newMASQUETestProxy(t, 200)
+		qd := &QUICDialer{
+			TLSConfig:    newTestClientTLSConfig("doq"),
+			ConnectedUDP: true,
+			UDPDialer:    newMASQUETestDialer(proxy),
+		}
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qd), dnsSrv.Endpoint())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.Exchange(ctx, newQuery())
+		require.NoError(t, err)
+	})
+
+	t.Run("fails when the proxy refuses the request", func(t *testing.T) {
+		proxy := newMASQUETestProxy(t, 403)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := newMASQUETestDialer(proxy).DialContext(ctx, "udp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrMASQUE)
+		var statusErr *HTTPSStatusError
+		require.True(t, errors.As(err, &statusErr))
+		require.Equal(t, 403, statusErr.StatusCode)
+		require.Nil(t, conn)
+	})
+
+	t.Run("rejects unsupported networks", func(t *testing.T) {
+		dialer := NewMASQUEDialer(&QUICDialer{}, netip.MustParseAddrPort("127.0.0.1:443"))
+		conn, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrMASQUE)
+		require.Nil(t, conn)
+	})
+
+	t.Run("the read deadline expires", func(t *testing.T) {
+		proxy := newMASQUETestProxy(t, 200)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := newMASQUETestDialer(proxy).DialContext(ctx, "udp", "127.0.0.1:9")
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err = conn.Read(make([]byte, 512))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+}
+
+func TestMASQUEExpandTemplate(t *testing.T) {
+	cases := []struct {
+		template, address, expected string
+	}{
+		{"", "192.0.2.1:53", "/.well-known/masque/udp/192.0.2.1/53/"},
+		{"", "[2001:db8::1]:853", "/.well-known/masque/udp/2001%3Adb8%3A%3A1/853/"},
+		{"/masque?h={target_host}&p={target_port}", "dns.google:853", "/masque?h=dns.google&p=853"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.address, func(t *testing.T) {
+			path, err := masqueExpandTemplate(tc.template, tc.address)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, path)
+		})
+	}
+
+	_, err := masqueExpandTemplate("", "dns.google")
+	require.Error(t, err)
+}
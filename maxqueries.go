@@ -0,0 +1,74 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// DefaultMaxQueriesLimit is the default limit of [*Transport.MeasureMaxQueries].
+const DefaultMaxQueriesLimit = 10000
+
+// MaxQueriesResult is the result of [*Transport.MeasureMaxQueries].
+type MaxQueriesResult struct {
+	// Succeeded is the number of queries the server answered.
+	Succeeded int
+
+	// Close is how the server closed the connection, which is [ConnCloseNone]
+	// when we reached the limit or the context was done.
+	Close ConnCloseKind
+
+	// ErrorCode is the QUIC error code for [ConnCloseApplication]
+	// and [ConnCloseTransport], and zero otherwise.
+	ErrorCode uint64
+
+	// Err is the error of the first failed query or nil for [ConnCloseNone].
+	Err error
+
+	// Elapsed is the time spent sending queries.
+	Elapsed time.Duration
+}
+
+// MeasureMaxQueries dials a connection and sequentially sends the query over
+// it until the server closes the connection or fails, the context is done, or
+// we reach the limit, which allows to discover per-connection query limits.
+//
+// A response counts as successful regardless of its RCODE. If limit is zero
+// or negative, we use [DefaultMaxQueriesLimit]. The context bounds the whole
+// experiment and this method returns an error only if dialing fails.
+func (dt *Transport) MeasureMaxQueries(ctx context.Context, query *dnscodec.Query, limit int) (*MaxQueriesResult, error) {
+	// 1. dial the connection
+	if limit <= 0 {
+		limit = DefaultMaxQueriesLimit
+	}
+	conn, err := dt.Dial(ctx)
+	if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// 2. send queries until something fails
+	t0 := dt.now()
+	result := &MaxQueriesResult{}
+	for result.Succeeded < limit && ctx.Err() == nil {
+		_, err := streamExchange(ctx, dt, conn, query, parseValidatedMsg)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			result.Err = err
+			result.Close, result.ErrorCode = classifyConnClose(err)
+			break
+		}
+		result.Succeeded++
+	}
+	result.Elapsed = dt.since(t0)
+	return result, nil
+}
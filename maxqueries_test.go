@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newMaxQueriesTCPServer starts a DNS-over-TCP server that closes each
+// connection after answering maxQueries queries.
+func newMaxQueriesTCPServer(t *testing.T, maxQueries int64) netip.AddrPort {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	handler := dnstest.NewHandler(config)
+	var count atomic.Int64
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		// The tests use a single connection at a time.
+		w.WriteMsg(handler.PrepareResponse(query))
+		if count.Add(1) >= maxQueries {
+			w.Close()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return netip.MustParseAddrPort(srv.Address())
+}
+
+func TestMeasureMaxQueries(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("the server closes the connection", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), newMaxQueriesTCPServer(t, 3))
+		result, err := dt.MeasureMaxQueries(context.Background(), query, 0)
+		require.NoError(t, err)
+		require.Equal(t, 3, result.Succeeded)
+		require.Equal(t, ConnCloseFIN, result.Close)
+		require.Error(t, result.Err)
+	})
+
+	t.Run("we reach the limit", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), newMaxQueriesTCPServer(t, 100))
+		result, err := dt.MeasureMaxQueries(context.Background(), query, 5)
+		require.NoError(t, err)
+		require.Equal(t, 5, result.Succeeded)
+		require.Equal(t, ConnCloseNone, result.Close)
+		require.NoError(t, result.Err)
+	})
+
+	t.Run("the context is done", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), newMaxQueriesTCPServer(t, 100))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		dt.ObserveRawResponse = func([]byte) {
+			cancel()
+		}
+		result, err := dt.MeasureMaxQueries(ctx, query, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Succeeded)
+		require.Equal(t, ConnCloseNone, result.Close)
+		require.NoError(t, result.Err)
+	})
+
+	t.Run("the miekg/dns default limit", func(t *testing.T) {
+		config := dnstest.NewHandlerConfig()
+		config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", dnstest.NewHandler(config))
+		t.Cleanup(srv.Close)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+		result, err := dt.MeasureMaxQueries(context.Background(), query, 0)
+		require.NoError(t, err)
+		require.Equal(t, 128, result.Succeeded)
+		require.Equal(t, ConnCloseFIN, result.Close)
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return nil, expected
+			},
+		}
+		dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+		_, err := dt.MeasureMaxQueries(context.Background(), query, 0)
+		require.ErrorIs(t, err, expected)
+	})
+}
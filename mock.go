@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// FuncStream allows to mock any [Stream] in downstream tests.
+//
+// Each method calls the corresponding function field. When a field
+// is nil, SetDeadline, Write, and Close succeed without doing anything,
+// and Read returns [io.EOF], as if the server closed the stream.
+type FuncStream struct {
+	SetDeadlineFunc func(t time.Time) error
+	ReadFunc        func(p []byte) (int, error)
+	WriteFunc       func(p []byte) (int, error)
+	CloseFunc       func() error
+}
+
+var _ Stream = &FuncStream{}
+
+// SetDeadline implements [Stream].
+func (s *FuncStream) SetDeadline(t time.Time) error {
+	if s.SetDeadlineFunc != nil {
+		return s.SetDeadlineFunc(t)
+	}
+	return nil
+}
+
+// Read implements [Stream].
+func (s *FuncStream) Read(p []byte) (int, error) {
+	if s.ReadFunc != nil {
+		return s.ReadFunc(p)
+	}
+	return 0, io.EOF
+}
+
+// Write implements [Stream].
+func (s *FuncStream) Write(p []byte) (int, error) {
+	if s.WriteFunc != nil {
+		return s.WriteFunc(p)
+	}
+	return len(p), nil
+}
+
+// Close implements [Stream].
+func (s *FuncStream) Close() error {
+	if s.CloseFunc != nil {
+		return s.CloseFunc()
+	}
+	return nil
+}
+
+// FuncStreamOpener allows to mock any [StreamOpener] in downstream tests.
+//
+// Each method calls the corresponding function field. When a field is nil,
+// Close succeeds, MutateQuery mutates queries like for DNS over TCP, and
+// OpenStream returns a [*FuncStream] with all fields nil.
+//
+// Use [NewHandlerStreamOpener] instead when you need a [StreamOpener]
+// answering queries rather than one failing in specific ways.
+type FuncStreamOpener struct {
+	CloseFunc       func() error
+	MutateQueryFunc func(query *dnscodec.Query)
+	OpenStreamFunc  func() (Stream, error)
+}
+
+var _ StreamOpener = &FuncStreamOpener{}
+
+// NewFuncStreamOpener creates a new [*FuncStreamOpener] whose
+// OpenStream always returns the given [Stream].
+func NewFuncStreamOpener(stream Stream) *FuncStreamOpener {
+	return &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return stream, nil
+		},
+	}
+}
+
+// Close implements [StreamOpener].
+func (s *FuncStreamOpener) Close() error {
+	if s.CloseFunc != nil {
+		return s.CloseFunc()
+	}
+	return nil
+}
+
+// MutateQuery implements [StreamOpener].
+func (s *FuncStreamOpener) MutateQuery(query *dnscodec.Query) {
+	if s.MutateQueryFunc != nil {
+		s.MutateQueryFunc(query)
+		return
+	}
+	QueryParamsTCP().MutateQuery(query)
+}
+
+// OpenStream implements [StreamOpener].
+func (s *FuncStreamOpener) OpenStream() (Stream, error) {
+	if s.OpenStreamFunc != nil {
+		return s.OpenStreamFunc()
+	}
+	return &FuncStream{}, nil
+}
+
+// FuncStreamOpenerDialer allows to mock any [StreamOpenerDialer] in downstream tests.
+//
+// When DialContextFunc is nil, DialContext returns a [*FuncStreamOpener]
+// with all fields nil.
+type FuncStreamOpenerDialer struct {
+	DialContextFunc func(ctx context.Context, address netip.AddrPort) (StreamOpener, error)
+}
+
+var _ StreamOpenerDialer = &FuncStreamOpenerDialer{}
+
+// NewFuncStreamOpenerDialer creates a new [*FuncStreamOpenerDialer] whose
+// DialContext always returns the given [StreamOpener].
+func NewFuncStreamOpenerDialer(conn StreamOpener) *FuncStreamOpenerDialer {
+	return &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return conn, nil
+		},
+	}
+}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *FuncStreamOpenerDialer) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	if d.DialContextFunc != nil {
+		return d.DialContextFunc(ctx, address)
+	}
+	return &FuncStreamOpener{}, nil
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncStreamDefaults(t *testing.T) {
+	stream := &FuncStream{}
+	require.NoError(t, stream.SetDeadline(time.Now()))
+	count, err := stream.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+	_, err = stream.Read(make([]byte, 4))
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, stream.Close())
+}
+
+func TestFuncStreamFuncs(t *testing.T) {
+	expected := errors.New("mocked error")
+	stream := &FuncStream{
+		SetDeadlineFunc: func(t time.Time) error { return expected },
+		ReadFunc:        func(p []byte) (int, error) { return 0, expected },
+		WriteFunc:       func(p []byte) (int, error) { return 0, expected },
+		CloseFunc:       func() error { return expected },
+	}
+	require.ErrorIs(t, stream.SetDeadline(time.Now()), expected)
+	_, err := stream.Read(nil)
+	require.ErrorIs(t, err, expected)
+	_, err = stream.Write(nil)
+	require.ErrorIs(t, err, expected)
+	require.ErrorIs(t, stream.Close(), expected)
+}
+
+func TestFuncStreamOpener(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		conn := &FuncStreamOpener{}
+		require.NoError(t, conn.Close())
+		query := dnscodec.NewQuery("dns.google", dns.TypeA)
+		conn.MutateQuery(query)
+		require.Equal(t, QueryMaxSizeStream, query.MaxSize)
+		stream, err := conn.OpenStream()
+		require.NoError(t, err)
+		require.IsType(t, &FuncStream{}, stream)
+	})
+
+	t.Run("funcs", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		var mutated bool
+		conn := &FuncStreamOpener{
+			CloseFunc:       func() error { return expected },
+			MutateQueryFunc: func(query *dnscodec.Query) { mutated = true },
+			OpenStreamFunc:  func() (Stream, error) { return nil, expected },
+		}
+		require.ErrorIs(t, conn.Close(), expected)
+		conn.MutateQuery(dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.True(t, mutated)
+		_, err := conn.OpenStream()
+		require.ErrorIs(t, err, expected)
+	})
+
+	t.Run("NewFuncStreamOpener", func(t *testing.T) {
+		expected := &FuncStream{}
+		stream, err := NewFuncStreamOpener(expected).OpenStream()
+		require.NoError(t, err)
+		require.Same(t, expected, stream)
+	})
+}
+
+func TestFuncStreamOpenerDialer(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("127.0.0.1:53")
+
+	t.Run("defaults", func(t *testing.T) {
+		conn, err := (&FuncStreamOpenerDialer{}).DialContext(context.Background(), endpoint)
+		require.NoError(t, err)
+		require.IsType(t, &FuncStreamOpener{}, conn)
+	})
+
+	t.Run("NewFuncStreamOpenerDialer", func(t *testing.T) {
+		expected := &FuncStreamOpener{}
+		conn, err := NewFuncStreamOpenerDialer(expected).DialContext(context.Background(), endpoint)
+		require.NoError(t, err)
+		require.Same(t, expected, conn)
+	})
+
+	t.Run("with a transport", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		stream := &FuncStream{
+			WriteFunc: func(p []byte) (int, error) { return 0, expected },
+		}
+		dt := NewTransport(NewFuncStreamOpenerDialer(NewFuncStreamOpener(stream)), endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	})
+}
@@ -0,0 +1,8 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !race
+
+package dnsoverstream
+
+// raceEnabled indicates whether we are running with the race detector.
+const raceEnabled = false
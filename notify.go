@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNotifyRejected indicates that the server rejected a [*Notify].
+var ErrNotifyRejected = errors.New("dnsoverstream: NOTIFY rejected")
+
+// NotifyRejectedError is the error returned by [*Transport.ExchangeNotify]
+// when the acknowledgment has a nonzero RCODE, which carries the RCODE.
+//
+// Use [errors.As] to obtain it and [errors.Is] with [ErrNotifyRejected] to check it.
+type NotifyRejectedError struct {
+	// Rcode is the RCODE of the acknowledgment (e.g., [dns.RcodeNotAuth]).
+	Rcode int
+}
+
+// Error implements error.
+func (e *NotifyRejectedError) Error() string {
+	return fmt.Sprintf("%s (rcode %s)", ErrNotifyRejected, dns.RcodeToString[e.Rcode])
+}
+
+// Unwrap returns [ErrNotifyRejected].
+func (e *NotifyRejectedError) Unwrap() error {
+	return ErrNotifyRejected
+}
+
+// Notify is a structured NOTIFY message (RFC 1996).
+//
+// Construct using [NewNotify].
+type Notify struct {
+	// Zone is the MANDATORY name of the zone that changed.
+	Zone string
+
+	// QueryType is the MANDATORY type of the changed records, which
+	// [NewNotify] sets to [dns.TypeSOA] (RFC 1996 Section 3.2).
+	QueryType uint16
+
+	// SOA is the OPTIONAL current SOA record of the zone, which we send
+	// in the answer section as a hint (RFC 1996 Section 3.7).
+	SOA *dns.SOA
+}
+
+// NewNotify returns a new [*Notify] for the given zone.
+func NewNotify(zone string) *Notify {
+	return &Notify{Zone: zone, QueryType: dns.TypeSOA}
+}
+
+// msg returns the [*dns.Msg] corresponding to the [*Notify].
+func (n *Notify) msg() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetNotify(dns.Fqdn(n.Zone))
+	msg.Question[0].Qtype = n.QueryType
+	if n.SOA != nil {
+		msg.Answer = append(msg.Answer, n.SOA)
+	}
+	return msg
+}
+
+// NotifyAck is the acknowledgment of a [*Notify] parsed by [NotifyCodec].
+type NotifyAck struct {
+	// Authoritative is true when the server set the AA bit, meaning
+	// that it is authoritative for the zone.
+	Authoritative bool
+
+	// Msg is the acknowledgment message.
+	Msg *dns.Msg
+}
+
+// NotifyCodec is the [Codec] for [*Notify] messages, which is what
+// [*Transport.ExchangeNotify] uses.
+//
+// We send the message using [OpcodeCodec], which makes sure the acknowledgment
+// uses the NOTIFY opcode and matches the zone, and we additionally map a nonzero
+// RCODE to a [*NotifyRejectedError], so a nil error means the server accepted
+// the notification.
+type NotifyCodec struct{}
+
+var _ Codec[*Notify, *NotifyAck] = NotifyCodec{}
+
+// PackQuery implements [Codec].
+func (NotifyCodec) PackQuery(buf []byte, query *Notify, params QueryParams) ([]byte, error) {
+	return OpcodeCodec{}.PackQuery(buf, query.msg(), params)
+}
+
+// ParseResponse implements [Codec].
+func (NotifyCodec) ParseResponse(query *Notify, rawQuery, rawResp []byte) (*NotifyAck, error) {
+	resp, err := OpcodeCodec{}.ParseResponse(nil, rawQuery, rawResp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, &NotifyRejectedError{Rcode: resp.Rcode}
+	}
+	return &NotifyAck{Authoritative: resp.Authoritative, Msg: resp}, nil
+}
+
+// Question implements [Codec].
+func (NotifyCodec) Question(query *Notify) (string, uint16) {
+	return dns.Fqdn(query.Zone), query.QueryType
+}
+
+// ExchangeNotify is like [*Transport.Exchange] but sends the given [*Notify]
+// (RFC 1996) and returns the acknowledgment sent by the server.
+//
+// We send the message using [NotifyCodec], so that a nonzero RCODE (e.g.,
+// [dns.RcodeNotAuth]) becomes a [*NotifyRejectedError]. Use TLS to notify
+// secondary servers over an authenticated channel.
+func (dt *Transport) ExchangeNotify(ctx context.Context, notify *Notify) (*NotifyAck, error) {
+	return ExchangeCodec(ctx, dt, NotifyCodec{}, notify)
+}
+
+// ExchangeNotifyWithStreamOpener is like [*Transport.ExchangeWithStreamOpener]
+// but sends a [*Notify]. See [*Transport.ExchangeNotify] for more information.
+func (dt *Transport) ExchangeNotifyWithStreamOpener(ctx context.Context,
+	conn StreamOpener, notify *Notify) (*NotifyAck, error) {
+	return ExchangeCodecWithStreamOpener(ctx, dt, NotifyCodec{}, conn, notify)
+}
@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransportExchangeNotify(t *testing.T) {
+	t.Run("sends the NOTIFY using TLS", func(t *testing.T) {
+		endpoint, received := newOpcodeTestServer(t, true, func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Authoritative = true
+			return resp
+		})
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(&net.Dialer{}, newTestClientTLSConfig()))
+		dt := NewTransport(dialer, endpoint)
+
+		notify := NewNotify("example.com")
+		notify.SOA = newXFRTestSOA(7).(*dns.SOA)
+		ack, err := dt.ExchangeNotify(context.Background(), notify)
+		require.NoError(t, err)
+		require.True(t, ack.Authoritative)
+		require.Equal(t, dns.OpcodeNotify, ack.Msg.Opcode)
+		require.Equal(t, dns.RcodeSuccess, ack.Msg.Rcode)
+
+		msgs := received()
+		require.Len(t, msgs, 1)
+		require.Equal(t, dns.OpcodeNotify, msgs[0].Opcode)
+		require.True(t, msgs[0].Authoritative)
+		require.Equal(t, dns.Question{Name: "example.com.", Qtype: dns.TypeSOA, Qclass: dns.ClassINET}, msgs[0].Question[0])
+		require.Len(t, msgs[0].Answer, 1)
+		require.Equal(t, uint32(7), msgs[0].Answer[0].(*dns.SOA).Serial)
+	})
+
+	t.Run("sends the NOTIFY using TCP", func(t *testing.T) {
+		endpoint, received := newOpcodeTestServer(t, false, func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+
+		notify := NewNotify("example.com.")
+		notify.QueryType = dns.TypeA
+		ack, err := dt.ExchangeNotify(context.Background(), notify)
+		require.NoError(t, err)
+		require.False(t, ack.Authoritative)
+
+		msgs := received()
+		require.Len(t, msgs, 1)
+		require.Equal(t, dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, msgs[0].Question[0])
+		require.Empty(t, msgs[0].Answer)
+	})
+
+	t.Run("maps a nonzero RCODE to an error", func(t *testing.T) {
+		handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeNotAuth)
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		ack, err := dt.ExchangeNotify(context.Background(), NewNotify("example.com"))
+		require.ErrorIs(t, err, ErrNotifyRejected)
+		require.Nil(t, ack)
+		var rejectErr *NotifyRejectedError
+		require.True(t, errors.As(err, &rejectErr))
+		require.Equal(t, dns.RcodeNotAuth, rejectErr.Rcode)
+		require.Equal(t, "dnsoverstream: NOTIFY rejected (rcode NOTAUTH)", err.Error())
+	})
+
+	t.Run("rejects acknowledgments for another zone", func(t *testing.T) {
+		handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Question[0].Name = "example.org."
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		ack, err := dt.ExchangeNotify(context.Background(), NewNotify("example.com"))
+		require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+		require.Nil(t, ack)
+	})
+
+	t.Run("rejects acknowledgments using another opcode", func(t *testing.T) {
+		handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Opcode = dns.OpcodeQuery
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		ack, err := dt.ExchangeNotify(context.Background(), NewNotify("example.com"))
+		require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+		require.Nil(t, ack)
+	})
+}
+
+func TestTransportExchangeNotifyWithStreamOpener(t *testing.T) {
+	handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		return resp
+	})
+	dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+	conn, err := dt.Dial(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	for range 2 {
+		ack, err := dt.ExchangeNotifyWithStreamOpener(context.Background(), conn, NewNotify("example.com"))
+		require.NoError(t, err)
+		require.True(t, ack.Authoritative)
+	}
+}
@@ -0,0 +1,389 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/bassosimone/dnscodec"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ProtocolODoH is the protocol name used by [PoolKey] for Oblivious DoH.
+const ProtocolODoH = "odoh"
+
+// DefaultODoHConfigsPath is the well-known path where Oblivious DoH
+// targets publish their configs (see [FetchODoHConfigs]).
+const DefaultODoHConfigsPath = "/.well-known/odohconfigs"
+
+// ErrODoHInvalidConfigs indicates that we cannot parse the Oblivious DoH configs.
+var ErrODoHInvalidConfigs = errors.New("dnsoverstream: invalid Oblivious DoH configs")
+
+// ErrODoHUnsupportedConfig indicates that an [ODoHConfig] uses HPKE
+// algorithms we do not support (see [ODoHConfig.Supported]).
+var ErrODoHUnsupportedConfig = errors.New("dnsoverstream: unsupported Oblivious DoH config")
+
+// Oblivious DoH protocol constants (RFC 9230).
+const (
+	odohContentType         = "application/oblivious-dns-message"
+	odohConfigVersion       = 0x0001
+	odohMessageTypeQuery    = 0x01
+	odohMessageTypeResponse = 0x02
+)
+
+// ODoHConfig is the configuration of an Oblivious DoH target containing the
+// HPKE algorithms and public key to use for encrypting queries (RFC 9230
+// Section 6.1). Use [FetchODoHConfigs] or [ParseODoHConfigs] to obtain it.
+type ODoHConfig struct {
+	// KEMID is the HPKE KEM identifier.
+	KEMID uint16
+
+	// KDFID is the HPKE KDF identifier.
+	KDFID uint16
+
+	// AEADID is the HPKE AEAD identifier.
+	AEADID uint16
+
+	// PublicKey is the target HPKE public key.
+	PublicKey []byte
+}
+
+// Supported returns whether we support the config, which requires using
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and AES-128-GCM.
+func (c ODoHConfig) Supported() bool {
+	return c.KEMID == hpkeKEMX25519HKDFSHA256 && c.KDFID == hpkeKDFHKDFSHA256 &&
+		c.AEADID == hpkeAEADAES128GCM && len(c.PublicKey) == 32
+}
+
+// contents returns the serialized ObliviousDoHConfigContents.
+func (c ODoHConfig) contents() []byte {
+	data := binary.BigEndian.AppendUint16(nil, c.KEMID)
+	data = binary.BigEndian.AppendUint16(data, c.KDFID)
+	data = binary.BigEndian.AppendUint16(data, c.AEADID)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(c.PublicKey)))
+	return append(data, c.PublicKey...)
+}
+
+// keyID returns the identifier of the config (RFC 9230 Section 6.2).
+func (c ODoHConfig) keyID() ([]byte, error) {
+	prk, err := hkdf.Extract(sha256.New, c.contents(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Expand(sha256.New, prk, "odoh key id", hpkeHashSize)
+}
+
+// ParseODoHConfigs parses the ObliviousDoHConfigs structure published
+// by targets (RFC 9230 Section 6.1), skipping unknown versions.
+//
+// This function returns [ErrODoHInvalidConfigs] on parse errors.
+func ParseODoHConfigs(data []byte) ([]ODoHConfig, error) {
+	// 1. extract the list of configs
+	input := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&list) || !input.Empty() || list.Empty() {
+		return nil, ErrODoHInvalidConfigs
+	}
+
+	// 2. parse each config with a version we know
+	var configs []ODoHConfig
+	for !list.Empty() {
+		var (
+			version  uint16
+			contents cryptobyte.String
+		)
+		if !list.ReadUint16(&version) || !list.ReadUint16LengthPrefixed(&contents) {
+			return nil, ErrODoHInvalidConfigs
+		}
+		if version != odohConfigVersion {
+			continue
+		}
+		var (
+			config    ODoHConfig
+			publicKey cryptobyte.String
+		)
+		if !contents.ReadUint16(&config.KEMID) || !contents.ReadUint16(&config.KDFID) ||
+			!contents.ReadUint16(&config.AEADID) || !contents.ReadUint16LengthPrefixed(&publicKey) ||
+			publicKey.Empty() || !contents.Empty() {
+			return nil, ErrODoHInvalidConfigs
+		}
+		config.PublicKey = bytes.Clone(publicKey)
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// FetchODoHConfigs fetches the configs of the Oblivious DoH target at
+// address using the given dialer and [DefaultODoHConfigsPath].
+//
+// Note that fetching directly from the target reveals our address to it,
+// so privacy conscious callers should obtain the configs otherwise (e.g.,
+// through the DNS) and use [ParseODoHConfigs].
+func FetchODoHConfigs(ctx context.Context, dialer *StreamOpenerDialerHTTPS, address netip.AddrPort) ([]ODoHConfig, error) {
+	// 1. establish the HTTPS connection
+	conn, err := dialer.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	hc := conn.(*httpsConn)
+
+	// 2. fetch the configs using GET
+	URL, err := url.Parse(hc.url)
+	if err != nil {
+		return nil, err
+	}
+	URL.Path = DefaultODoHConfigsPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.cc.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPSStatusError{StatusCode: resp.StatusCode}
+	}
+
+	// 3. parse the configs, which must fit into the structure
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 2+1<<16))
+	if err != nil {
+		return nil, err
+	}
+	return ParseODoHConfigs(body)
+}
+
+// StreamOpenerDialerODoH implements [StreamOpenerDialer] for Oblivious DoH
+// (RFC 9230), where we encrypt the queries for a target using HPKE and send
+// them through an oblivious proxy using DNS over HTTPS, so that the proxy
+// does not see the queries and the target does not see our address.
+//
+// The [*Transport] hooks observe the plaintext DNS messages as usual, while
+// ObserveEncapsulatedQuery and ObserveEncapsulatedResponse observe the
+// encrypted messages that the proxy forwards.
+//
+// Construct using [NewStreamOpenerDialerODoH].
+type StreamOpenerDialerODoH struct {
+	// Proxy is the MANDATORY [*StreamOpenerDialerHTTPS] for connecting to
+	// the proxy, whose Path is the proxy path (e.g., "/proxy").
+	Proxy *StreamOpenerDialerHTTPS
+
+	// TargetHost is the MANDATORY host name of the target.
+	TargetHost string
+
+	// TargetPath is the OPTIONAL target path. If empty, we use [DefaultHTTPSPath].
+	TargetPath string
+
+	// Config is the MANDATORY target [ODoHConfig].
+	Config ODoHConfig
+
+	// ObserveEncapsulatedQuery is an optional hook called with each
+	// ObliviousDoHMessage containing an encrypted query.
+	ObserveEncapsulatedQuery func([]byte)
+
+	// ObserveEncapsulatedResponse is an optional hook called with each
+	// ObliviousDoHMessage received in response, before decrypting it.
+	ObserveEncapsulatedResponse func([]byte)
+}
+
+// NewStreamOpenerDialerODoH creates a new [*StreamOpenerDialerODoH].
+func NewStreamOpenerDialerODoH(proxy *StreamOpenerDialerHTTPS,
+	targetHost string, config ODoHConfig) *StreamOpenerDialerODoH {
+	return &StreamOpenerDialerODoH{
+		Proxy:      proxy,
+		TargetHost: targetHost,
+		Config:     config,
+	}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerODoH{}
+
+// DialContext implements [StreamOpenerDialer].
+//
+// The address is the endpoint of the proxy.
+func (d *StreamOpenerDialerODoH) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	// 1. make sure we can encrypt queries for the target
+	if !d.Config.Supported() {
+		return nil, fmt.Errorf("%w: kem=%#04x kdf=%#04x aead=%#04x", ErrODoHUnsupportedConfig,
+			d.Config.KEMID, d.Config.KDFID, d.Config.AEADID)
+	}
+	keyID, err := d.Config.keyID()
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. connect to the proxy
+	conn, err := d.Proxy.DialContext(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	hc := conn.(*httpsConn)
+
+	// 3. send the queries to the proxy using the target variables (RFC 9230 Section 4.1)
+	URL, err := url.Parse(hc.url)
+	if err != nil {
+		hc.Close()
+		return nil, err
+	}
+	URL.RawQuery = url.Values{
+		"targethost": {d.TargetHost},
+		"targetpath": {httpsPath(d.TargetPath)},
+	}.Encode()
+	hc.url = URL.String()
+	hc.envelope = &odohEnvelope{
+		config:          d.Config,
+		keyID:           keyID,
+		observeQuery:    d.ObserveEncapsulatedQuery,
+		observeResponse: d.ObserveEncapsulatedResponse,
+	}
+	return hc, nil
+}
+
+// odohEnvelope implements [httpsEnvelope] for Oblivious DoH.
+type odohEnvelope struct {
+	config          ODoHConfig
+	keyID           []byte
+	observeQuery    func([]byte)
+	observeResponse func([]byte)
+}
+
+// contentType implements [httpsEnvelope].
+func (e *odohEnvelope) contentType() string {
+	return odohContentType
+}
+
+// acceptsContentType implements [httpsEnvelope].
+func (e *odohEnvelope) acceptsContentType(value string) bool {
+	return value == odohContentType
+}
+
+// method implements [httpsEnvelope].
+func (e *odohEnvelope) method() string {
+	return http.MethodPost
+}
+
+// seal implements [httpsEnvelope].
+func (e *odohEnvelope) seal(rawQuery []byte) ([]byte, func(body []byte) ([]byte, error), error) {
+	// 1. encrypt the query for the target (RFC 9230 Section 6.3), without
+	// padding since the query already uses EDNS(0) padding
+	plaintext := odohAppendPlaintext(nil, rawQuery)
+	enc, hctx, err := hpkeSetupBaseS(e.config.PublicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := odohAppendAAD(nil, odohMessageTypeQuery, e.keyID)
+	ciphertext := hctx.seal(aad, plaintext)
+	body := odohAppendMessage(nil, odohMessageTypeQuery, e.keyID, append(enc, ciphertext...))
+	if e.observeQuery != nil {
+		e.observeQuery(body)
+	}
+
+	// 2. derive the response key from the context (RFC 9230 Section 6.4)
+	secret, err := hctx.export("odoh response", hpkeKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	open := func(body []byte) ([]byte, error) {
+		if e.observeResponse != nil {
+			e.observeResponse(body)
+		}
+		return odohOpenResponse(body, plaintext, secret)
+	}
+	return body, open, nil
+}
+
+// odohOpenResponse decrypts the response given the query plaintext and the
+// secret exported from its HPKE context (RFC 9230 Section 6.4).
+func odohOpenResponse(body, queryPlaintext, secret []byte) ([]byte, error) {
+	// 1. parse the ObliviousDoHMessage
+	var (
+		input      = cryptobyte.String(body)
+		msgType    uint8
+		nonce      cryptobyte.String
+		ciphertext cryptobyte.String
+	)
+	if !input.ReadUint8(&msgType) || msgType != odohMessageTypeResponse ||
+		!input.ReadUint16LengthPrefixed(&nonce) || !input.ReadUint16LengthPrefixed(&ciphertext) ||
+		!input.Empty() {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 2. derive the key and the nonce and decrypt
+	salt := binary.BigEndian.AppendUint16(bytes.Clone(queryPlaintext), uint16(len(nonce)))
+	salt = append(salt, nonce...)
+	key, aeadNonce, err := odohResponseKeyNonce(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, ciphertext, odohAppendAAD(nil, odohMessageTypeResponse, nonce))
+	if err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 3. extract the DNS message from the ObliviousDoHMessagePlaintext
+	var (
+		plain   = cryptobyte.String(plaintext)
+		msg     cryptobyte.String
+		padding cryptobyte.String
+	)
+	if !plain.ReadUint16LengthPrefixed(&msg) || msg.Empty() ||
+		!plain.ReadUint16LengthPrefixed(&padding) || !plain.Empty() ||
+		bytes.Count(padding, []byte{0}) != len(padding) {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	return msg, nil
+}
+
+// odohResponseKeyNonce derives the response key and nonce.
+func odohResponseKeyNonce(secret, salt []byte) ([]byte, []byte, error) {
+	prk, err := hkdf.Extract(sha256.New, secret, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hkdf.Expand(sha256.New, prk, "odoh key", hpkeKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "odoh nonce", hpkeNonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, nonce, nil
+}
+
+// odohAppendPlaintext appends the ObliviousDoHMessagePlaintext without padding.
+func odohAppendPlaintext(data, msg []byte) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(msg)))
+	data = append(data, msg...)
+	return binary.BigEndian.AppendUint16(data, 0)
+}
+
+// odohAppendAAD appends the additional data authenticated with the message.
+func odohAppendAAD(data []byte, msgType uint8, keyID []byte) []byte {
+	data = append(data, msgType)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(keyID)))
+	return append(data, keyID...)
+}
+
+// odohAppendMessage appends the ObliviousDoHMessage.
+func odohAppendMessage(data []byte, msgType uint8, keyID, encrypted []byte) []byte {
+	data = odohAppendAAD(data, msgType, keyID)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(encrypted)))
+	return append(data, encrypted...)
+}
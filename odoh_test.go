@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// odohTestMarshalConfigs serializes the ObliviousDoHConfigs structure.
+func odohTestMarshalConfigs(versions []uint16, configs ...ODoHConfig) []byte {
+	var list []byte
+	for idx, config := range configs {
+		contents := config.contents()
+		list = binary.BigEndian.AppendUint16(list, versions[idx])
+		list = binary.BigEndian.AppendUint16(list, uint16(len(contents)))
+		list = append(list, contents...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(list))), list...)
+}
+
+// odohTestTarget is an [http.Handler] implementing both an Oblivious DoH
+// proxy and target, which answers all queries using [dohTestAnswer].
+type odohTestTarget struct {
+	config ODoHConfig
+	key    *ecdh.PrivateKey
+
+	// padding is the number of padding bytes to add to responses.
+	padding int
+
+	// tamper corrupts the responses.
+	tamper bool
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// newODoHTestTarget creates a new [*odohTestTarget] using a new key.
+func newODoHTestTarget(t *testing.T) *odohTestTarget {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	config := ODoHConfig{
+		KEMID:     hpkeKEMX25519HKDFSHA256,
+		KDFID:     hpkeKDFHKDFSHA256,
+		AEADID:    hpkeAEADAES128GCM,
+		PublicKey: key.PublicKey().Bytes(),
+	}
+	return &odohTestTarget{config: config, key: key}
+}
+
+// ServeHTTP implements [http.Handler].
+func (tt *odohTestTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tt.mu.Lock()
+	tt.requests = append(tt.requests, r)
+	tt.mu.Unlock()
+
+	// 1. serve the configs
+	if r.Method == http.MethodGet && r.URL.Path == DefaultODoHConfigsPath {
+		w.Write(odohTestMarshalConfigs([]uint16{odohConfigVersion}, tt.config))
+		return
+	}
+
+	// 2. decrypt the query
+	body, err := io.ReadAll(r.Body)
+	if err != nil || r.Header.Get("Content-Type") != odohContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	keyID, err := tt.config.keyID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var (
+		input     = cryptobyte.String(body)
+		msgType   uint8
+		gotKeyID  cryptobyte.String
+		encrypted cryptobyte.String
+	)
+	if !input.ReadUint8(&msgType) || msgType != odohMessageTypeQuery ||
+		!input.ReadUint16LengthPrefixed(&gotKeyID) || !bytes.Equal(gotKeyID, keyID) ||
+		!input.ReadUint16LengthPrefixed(&encrypted) || len(encrypted) < 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hctx, err := hpkeSetupBaseR(encrypted[:32], tt.key, []byte("odoh query"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	queryPlaintext, err := hctx.open(odohAppendAAD(nil, odohMessageTypeQuery, keyID), encrypted[32:])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plain := cryptobyte.String(queryPlaintext)
+	var rawQuery cryptobyte.String
+	query := &dns.Msg{}
+	if !plain.ReadUint16LengthPrefixed(&rawQuery) || query.Unpack(rawQuery) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// 3. encrypt the response
+	rawResp, err := dohTestAnswer(query).Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	respPlaintext := binary.BigEndian.AppendUint16(nil, uint16(len(rawResp)))
+	respPlaintext = append(respPlaintext, rawResp...)
+	respPlaintext = binary.BigEndian.AppendUint16(respPlaintext, uint16(tt.padding))
+	respPlaintext = append(respPlaintext, make([]byte, tt.padding)...)
+	secret, err := hctx.export("odoh response", hpkeKeySize)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	nonce := make([]byte, max(hpkeKeySize, hpkeNonceSize))
+	rand.Read(nonce)
+	salt := binary.BigEndian.AppendUint16(bytes.Clone(queryPlaintext), uint16(len(nonce)))
+	salt = append(salt, nonce...)
+	key, aeadNonce, err := odohResponseKeyNonce(secret, salt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ciphertext := aead.Seal(nil, aeadNonce, respPlaintext, odohAppendAAD(nil, odohMessageTypeResponse, nonce))
+	resp := odohAppendMessage(nil, odohMessageTypeResponse, nonce, ciphertext)
+	if tt.tamper {
+		resp[len(resp)-1] ^= 0xff
+	}
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(resp)
+}
+
+// newODoHTestProxyDialer returns the [*StreamOpenerDialerHTTPS] for the proxy.
+func newODoHTestProxyDialer() *StreamOpenerDialerHTTPS {
+	proxy := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: newTestClientTLSConfig("h2")})
+	proxy.Path = "/proxy"
+	return proxy
+}
+
+func TestStreamOpenerDialerODoH(t *testing.T) {
+	t.Run("exchanges through the proxy", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		target.padding = 16
+		_, endpoint := newDoHTestServer(t, target)
+		var encQueries, encResponses, rawQueries [][]byte
+		dialer := NewStreamOpenerDialerODoH(newODoHTestProxyDialer(), "target.example.com", target.config)
+		dialer.ObserveEncapsulatedQuery = func(data []byte) { encQueries = append(encQueries, data) }
+		dialer.ObserveEncapsulatedResponse = func(data []byte) { encResponses = append(encResponses, data) }
+		dt := NewTransport(dialer, endpoint)
+		dt.ObserveRawQuery = func(data []byte) { rawQueries = append(rawQueries, data) }
+
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+		require.Len(t, target.requests, 1)
+		req := target.requests[0]
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "/proxy", req.URL.Path)
+		require.Equal(t, "target.example.com", req.URL.Query().Get("targethost"))
+		require.Equal(t, DefaultHTTPSPath, req.URL.Query().Get("targetpath"))
+		require.Equal(t, odohContentType, req.Header.Get("Accept"))
+
+		require.Len(t, encQueries, 1)
+		require.Equal(t, byte(odohMessageTypeQuery), encQueries[0][0])
+		require.Len(t, encResponses, 1)
+		require.Equal(t, byte(odohMessageTypeResponse), encResponses[0][0])
+		require.Len(t, rawQueries, 1)
+		require.NoError(t, (&dns.Msg{}).Unpack(rawQueries[0]))
+		require.NotContains(t, string(encQueries[0]), "google")
+	})
+
+	t.Run("uses the configured target path", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		_, endpoint := newDoHTestServer(t, target)
+		dialer := NewStreamOpenerDialerODoH(newODoHTestProxyDialer(), "target.example.com", target.config)
+		dialer.TargetPath = "/custom"
+		_, err := NewTransport(dialer, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, "/custom", target.requests[0].URL.Query().Get("targetpath"))
+	})
+
+	t.Run("fails with ErrServerMisbehaving when the response is tampered", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		target.tamper = true
+		_, endpoint := newDoHTestServer(t, target)
+		dialer := NewStreamOpenerDialerODoH(newODoHTestProxyDialer(), "target.example.com", target.config)
+		_, err := NewTransport(dialer, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+
+	t.Run("fails when the target does not know the config", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		_, endpoint := newDoHTestServer(t, target)
+		other := newODoHTestTarget(t)
+		dialer := NewStreamOpenerDialerODoH(newODoHTestProxyDialer(), "target.example.com", other.config)
+		_, err := NewTransport(dialer, endpoint).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		var statusErr *HTTPSStatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	})
+
+	t.Run("fails with ErrODoHUnsupportedConfig before dialing", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		config := target.config
+		config.AEADID = 0x0003 // ChaCha20Poly1305
+		dialer := NewStreamOpenerDialerODoH(newODoHTestProxyDialer(), "target.example.com", config)
+		_, err := dialer.DialContext(context.Background(), deadlineTestEndpoint)
+		require.ErrorIs(t, err, ErrODoHUnsupportedConfig)
+		require.ErrorContains(t, err, "aead=0x0003")
+	})
+}
+
+func TestFetchODoHConfigs(t *testing.T) {
+	t.Run("fetches the configs from the well-known path", func(t *testing.T) {
+		target := newODoHTestTarget(t)
+		_, endpoint := newDoHTestServer(t, target)
+		configs, err := FetchODoHConfigs(context.Background(), newODoHTestProxyDialer(), endpoint)
+		require.NoError(t, err)
+		require.Equal(t, []ODoHConfig{target.config}, configs)
+		require.Equal(t, http.MethodGet, target.requests[0].Method)
+		require.Equal(t, DefaultODoHConfigsPath, target.requests[0].URL.Path)
+	})
+
+	t.Run("fails with HTTPSStatusError when the target has no configs", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, http.NotFoundHandler())
+		_, err := FetchODoHConfigs(context.Background(), newODoHTestProxyDialer(), endpoint)
+		var statusErr *HTTPSStatusError
+		require.ErrorAs(t, err, &statusErr)
+		require.Equal(t, http.StatusNotFound, statusErr.StatusCode)
+	})
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	config := ODoHConfig{KEMID: 0x0020, KDFID: 0x0001, AEADID: 0x0001, PublicKey: bytes.Repeat([]byte{7}, 32)}
+
+	t.Run("skips unknown versions", func(t *testing.T) {
+		other := ODoHConfig{KEMID: 1, KDFID: 2, AEADID: 3, PublicKey: []byte{4}}
+		data := odohTestMarshalConfigs([]uint16{0xff03, odohConfigVersion}, other, config)
+		configs, err := ParseODoHConfigs(data)
+		require.NoError(t, err)
+		require.Equal(t, []ODoHConfig{config}, configs)
+	})
+
+	valid := odohTestMarshalConfigs([]uint16{odohConfigVersion}, config)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty input", nil},
+		{"empty list", []byte{0, 0}},
+		{"truncated list", valid[:len(valid)-1]},
+		{"trailing data", append(bytes.Clone(valid), 0)},
+		{"empty public key", odohTestMarshalConfigs([]uint16{odohConfigVersion}, ODoHConfig{})},
+	} {
+		t.Run("fails with "+tc.name, func(t *testing.T) {
+			_, err := ParseODoHConfigs(tc.data)
+			require.ErrorIs(t, err, ErrODoHInvalidConfigs)
+		})
+	}
+}
+
+func TestODoHConfigSupported(t *testing.T) {
+	config := ODoHConfig{KEMID: 0x0020, KDFID: 0x0001, AEADID: 0x0001, PublicKey: make([]byte, 32)}
+	require.True(t, config.Supported())
+
+	config.KDFID = 0x0002
+	require.False(t, config.Supported())
+
+	config.KDFID = 0x0001
+	config.PublicKey = make([]byte, 65)
+	require.False(t, config.Supported())
+}
+
+func TestODoHOpenResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body []byte
+	}{
+		{"empty body", nil},
+		{"query message type", odohAppendMessage(nil, odohMessageTypeQuery, []byte{1}, []byte{2})},
+		{"trailing data", append(odohAppendMessage(nil, odohMessageTypeResponse, []byte{1}, []byte{2}), 0)},
+		{"undecryptable message", odohAppendMessage(nil, odohMessageTypeResponse, make([]byte, 16), make([]byte, 32))},
+	} {
+		t.Run("fails with "+tc.name, func(t *testing.T) {
+			_, err := odohOpenResponse(tc.body, []byte{0, 0, 0, 0}, make([]byte, 16))
+			require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// ErrTLSNoPeerCertificates indicates that the server presented no certificates.
+var ErrTLSNoPeerCertificates = errors.New("dnsoverstream: server presented no certificates")
+
+// TLSPeerVerification is the outcome of verifying the certificate chain
+// presented by a server when using opportunistic DNS over TLS.
+type TLSPeerVerification struct {
+	// ServerName is the name against which we verified the chain.
+	ServerName string
+
+	// PeerCertificates is the chain presented by the server.
+	PeerCertificates []*x509.Certificate
+
+	// VerifyErr is nil when the chain is valid for ServerName and
+	// otherwise explains why it is not (e.g., [x509.UnknownAuthorityError]).
+	VerifyErr error
+}
+
+// NewTLSConfigDNSOverTLSOpportunistic returns the [*tls.Config] to use for the
+// opportunistic privacy profile of DNS over TLS (RFC 7858 Section 4.1), where
+// we complete the handshake even if we cannot authenticate the server.
+//
+// We still verify the chain presented by the server against serverName, which
+// may be an IP address, using the RootCAs of the returned config or the system
+// roots, and call observe with the [TLSPeerVerification], so that measurements
+// can distinguish a working TLS with a bogus certificate from a TLS failure.
+//
+// The observe hook runs during each handshake, before we send any query.
+func NewTLSConfigDNSOverTLSOpportunistic(serverName string, observe func(TLSPeerVerification)) *tls.Config {
+	config := NewTLSConfigDNSOverTLS(serverName)
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		name := serverName
+		if name == "" {
+			name = state.ServerName
+		}
+		observe(TLSPeerVerification{
+			ServerName:       name,
+			PeerCertificates: state.PeerCertificates,
+			VerifyErr:        tlsVerifyPeerCertificates(state.PeerCertificates, name, config.RootCAs),
+		})
+		return nil
+	}
+	return config
+}
+
+// NewTLSDialerDNSOverTLSOpportunistic returns the [*tls.Dialer] to use for the
+// opportunistic privacy profile of DNS over TLS, using [NewTLSConfigDNSOverTLSOpportunistic].
+func NewTLSDialerDNSOverTLSOpportunistic(serverName string, observe func(TLSPeerVerification)) *tls.Dialer {
+	return &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    NewTLSConfigDNSOverTLSOpportunistic(serverName, observe),
+	}
+}
+
+// tlsVerifyPeerCertificates verifies the chain like [crypto/tls] would do
+// when InsecureSkipVerify is false, using the system roots if roots is nil.
+func tlsVerifyPeerCertificates(certs []*x509.Certificate, serverName string, roots *x509.CertPool) error {
+	if len(certs) <= 0 {
+		return ErrTLSNoPeerCertificates
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTLSConfigDNSOverTLSOpportunistic(t *testing.T) {
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+	t.Cleanup(srv.Close)
+
+	cases := []struct {
+		name       string
+		serverName string
+		roots      *x509.CertPool
+		check      func(t *testing.T, err error)
+	}{{
+		name:       "the certificate is valid",
+		serverName: "example.com",
+		roots:      testPKI().CertPool(),
+		check: func(t *testing.T, err error) {
+			require.NoError(t, err)
+		},
+	}, {
+		name:       "the certificate is valid for the IP address",
+		serverName: "127.0.0.1",
+		roots:      testPKI().CertPool(),
+		check: func(t *testing.T, err error) {
+			require.NoError(t, err)
+		},
+	}, {
+		name:       "the certificate is signed by an unknown authority",
+		serverName: "example.com",
+		check: func(t *testing.T, err error) {
+			require.True(t, errors.As(err, &x509.UnknownAuthorityError{}))
+		},
+	}, {
+		name:       "the certificate is not valid for the name",
+		serverName: "dns.google",
+		roots:      testPKI().CertPool(),
+		check: func(t *testing.T, err error) {
+			require.True(t, errors.As(err, &x509.HostnameError{}))
+		},
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var observed []TLSPeerVerification
+			config := NewTLSConfigDNSOverTLSOpportunistic(tc.serverName, func(v TLSPeerVerification) {
+				observed = append(observed, v)
+			})
+			config.RootCAs = tc.roots
+			dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(&net.Dialer{}, config))
+			dt := NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+
+			// the exchange succeeds regardless of the certificate
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+
+			require.Len(t, observed, 1)
+			require.Equal(t, tc.serverName, observed[0].ServerName)
+			require.NotEmpty(t, observed[0].PeerCertificates)
+			tc.check(t, observed[0].VerifyErr)
+		})
+	}
+}
+
+func TestTLSVerifyPeerCertificates(t *testing.T) {
+	err := tlsVerifyPeerCertificates(nil, "example.com", nil)
+	require.ErrorIs(t, err, ErrTLSNoPeerCertificates)
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import "context"
+
+// streamOpenerOwnershipKey is the context key for the [StreamOpener] ownership.
+type streamOpenerOwnershipKey struct{}
+
+// WithStreamOpenerOwnership returns a copy of ctx telling whether the methods
+// taking a [StreamOpener] argument (e.g., [*Transport.ExchangeWithStreamOpener])
+// own it for the duration of the call.
+//
+// By default, the caller owns the [StreamOpener] and these methods NEVER close
+// it, even when the exchange fails or the context is done, so that the caller
+// can reuse it or close it according to its own policy. When owned is true,
+// these methods behave like [*Transport.Exchange] instead: they close the
+// [StreamOpener] as soon as the context is done, which interrupts blocking
+// reads, and when the call returns (or when the iteration ends for
+// [*Transport.ExchangeStreamWithStreamOpener]).
+func WithStreamOpenerOwnership(ctx context.Context, owned bool) context.Context {
+	return context.WithValue(ctx, streamOpenerOwnershipKey{}, owned)
+}
+
+// StreamOpenerOwnershipFromContext returns whether ctx transfers the ownership
+// of the [StreamOpener] (see [WithStreamOpenerOwnership]).
+func StreamOpenerOwnershipFromContext(ctx context.Context) bool {
+	owned, _ := ctx.Value(streamOpenerOwnershipKey{}).(bool)
+	return owned
+}
+
+// withBorrowedStreamOpener returns a copy of ctx saying that the caller owns
+// the [StreamOpener], which we use when we pass a connection we dialed to the
+// methods taking a [StreamOpener], since we are responsible for closing it.
+func withBorrowedStreamOpener(ctx context.Context) context.Context {
+	if !StreamOpenerOwnershipFromContext(ctx) {
+		return ctx
+	}
+	return WithStreamOpenerOwnership(ctx, false)
+}
+
+// closeWhenDone returns a copy of ctx and a cancel function, such that conn
+// is closed once the returned context is done, and the cancel function waits
+// at most the [*Transport] CloseTimeout for the close to complete.
+func closeWhenDone(ctx context.Context, dt *Transport, conn StreamOpener) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		<-ctx.Done()
+		closeWithTimeout(conn, dt.CloseTimeout)
+	}()
+	return ctx, func() {
+		cancel()
+		<-closed
+	}
+}
+
+// takeStreamOpenerOwnership is like [closeWhenDone] if ctx transfers the
+// ownership of conn, and otherwise returns ctx and a no-op cancel function.
+func takeStreamOpenerOwnership(ctx context.Context, dt *Transport, conn StreamOpener) (context.Context, context.CancelFunc) {
+	if !StreamOpenerOwnershipFromContext(ctx) {
+		return ctx, func() {}
+	}
+	return closeWhenDone(withBorrowedStreamOpener(ctx), dt, conn)
+}
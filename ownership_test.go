@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ownershipTestEndpoint is the endpoint used by the ownership tests.
+var ownershipTestEndpoint = netip.MustParseAddrPort("127.0.0.1:53")
+
+// ownershipTestHandler answers all queries using [dohTestAnswer].
+var ownershipTestHandler = HandlerFunc(dohTestAnswer)
+
+// newOwnershipTestOpener returns a [StreamOpener] answering queries using
+// [ownershipTestHandler] and counting how many times it is closed.
+func newOwnershipTestOpener(closed *atomic.Int64) StreamOpener {
+	conn := NewHandlerStreamOpener(ownershipTestHandler)
+	return &FuncStreamOpener{
+		CloseFunc: func() error {
+			closed.Add(1)
+			return conn.Close()
+		},
+		OpenStreamFunc: conn.OpenStream,
+	}
+}
+
+// ownershipTestExchanges contains all the methods taking a [StreamOpener].
+var ownershipTestExchanges = []struct {
+	name     string
+	exchange func(ctx context.Context, dt *Transport, conn StreamOpener) error
+}{
+	{"ExchangeWithStreamOpener", func(ctx context.Context, dt *Transport, conn StreamOpener) error {
+		_, err := dt.ExchangeWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		return err
+	}},
+	{"ExchangeRawWithStreamOpener", func(ctx context.Context, dt *Transport, conn StreamOpener) error {
+		_, err := dt.ExchangeRawWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		return err
+	}},
+	{"ExchangeDNSMessageWithStreamOpener", func(ctx context.Context, dt *Transport, conn StreamOpener) error {
+		query := &dnsmessage.Message{Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("dns.google."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}}}
+		_, err := dt.ExchangeDNSMessageWithStreamOpener(ctx, conn, query)
+		return err
+	}},
+	{"ExchangeStreamWithStreamOpener", func(ctx context.Context, dt *Transport, conn StreamOpener) error {
+		for _, err := range dt.ExchangeStreamWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA)) {
+			return err // stop after the first message like for the last message of an AXFR
+		}
+		return nil
+	}},
+}
+
+func TestStreamOpenerOwnership(t *testing.T) {
+	for _, tc := range ownershipTestExchanges {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("does not close caller-owned openers", func(t *testing.T) {
+				var closed atomic.Int64
+				conn := newOwnershipTestOpener(&closed)
+				dt := NewTransport(NewStreamOpenerDialerHandler(ownershipTestHandler), ownershipTestEndpoint)
+				ctx, cancel := context.WithCancel(context.Background())
+				for range 3 {
+					require.NoError(t, tc.exchange(ctx, dt, conn))
+				}
+
+				// the opener survives the context being done
+				cancel()
+				time.Sleep(10 * time.Millisecond)
+				require.NoError(t, tc.exchange(context.Background(), dt, conn))
+				require.Zero(t, closed.Load())
+			})
+
+			t.Run("does not close caller-owned openers on failure", func(t *testing.T) {
+				var closed atomic.Int64
+				expected := errors.New("mocked error")
+				conn := &FuncStreamOpener{
+					CloseFunc: func() error {
+						closed.Add(1)
+						return nil
+					},
+					OpenStreamFunc: func() (Stream, error) {
+						return &FuncStream{WriteFunc: func(p []byte) (int, error) {
+							return 0, expected
+						}}, nil
+					},
+				}
+				dt := NewTransport(NewStreamOpenerDialerHandler(ownershipTestHandler), ownershipTestEndpoint)
+				require.ErrorIs(t, tc.exchange(context.Background(), dt, conn), expected)
+				time.Sleep(10 * time.Millisecond)
+				require.Zero(t, closed.Load())
+			})
+
+			t.Run("closes owned openers when done", func(t *testing.T) {
+				var closed atomic.Int64
+				conn := newOwnershipTestOpener(&closed)
+				dt := NewTransport(NewStreamOpenerDialerHandler(ownershipTestHandler), ownershipTestEndpoint)
+				ctx := WithStreamOpenerOwnership(context.Background(), true)
+				require.NoError(t, tc.exchange(ctx, dt, conn))
+				require.Eventually(t, func() bool {
+					return closed.Load() == 1
+				}, time.Second, time.Millisecond)
+			})
+
+			t.Run("closes owned openers when the context is done", func(t *testing.T) {
+				var closed atomic.Int64
+				done := make(chan struct{})
+				conn := &FuncStreamOpener{
+					CloseFunc: func() error {
+						if closed.Add(1) == 1 {
+							close(done)
+						}
+						return nil
+					},
+					OpenStreamFunc: func() (Stream, error) {
+						return &FuncStream{ReadFunc: func(p []byte) (int, error) {
+							<-done // block until the opener is closed
+							return 0, errors.New("use of closed connection")
+						}}, nil
+					},
+				}
+				dt := NewTransport(NewStreamOpenerDialerHandler(ownershipTestHandler), ownershipTestEndpoint)
+				ctx, cancel := context.WithCancel(WithStreamOpenerOwnership(context.Background(), true))
+				time.AfterFunc(10*time.Millisecond, cancel)
+				require.ErrorIs(t, tc.exchange(ctx, dt, conn), context.Canceled)
+			})
+		})
+	}
+}
+
+func TestStreamOpenerOwnershipExchange(t *testing.T) {
+	t.Run("Exchange ignores the ownership when using the pool", func(t *testing.T) {
+		var closed atomic.Int64
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return newOwnershipTestOpener(&closed), nil
+			},
+		}
+		dt := NewTransport(dialer, ownershipTestEndpoint)
+		dt.Pool = NewPool(4)
+		ctx := WithStreamOpenerOwnership(context.Background(), true)
+		for range 3 {
+			_, err := dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Equal(t, uint64(2), dt.Pool.Stats().Hits)
+		require.Zero(t, closed.Load())
+	})
+}
+
+func TestStreamOpenerOwnershipFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.False(t, StreamOpenerOwnershipFromContext(ctx))
+	require.True(t, StreamOpenerOwnershipFromContext(WithStreamOpenerOwnership(ctx, true)))
+	require.False(t, StreamOpenerOwnershipFromContext(WithStreamOpenerOwnership(ctx, false)))
+	require.False(t, StreamOpenerOwnershipFromContext(withBorrowedStreamOpener(WithStreamOpenerOwnership(ctx, true))))
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// PaddingRecommendedBlockSize is the block size to which RFC 8467 Section 4.1
+// recommends servers pad responses when using Block-Length Padding.
+const PaddingRecommendedBlockSize = 468
+
+// paddingBlockSizes contains the block sizes [CheckResponsePadding] tries, in order.
+var paddingBlockSizes = []int{PaddingRecommendedBlockSize, 1024, 512, 256, 128, 64, 32, 16}
+
+// ResponsePadding describes the EDNS(0) padding (RFC 7830) of a response.
+type ResponsePadding struct {
+	// Padded indicates that the response contains the Padding option.
+	Padded bool
+
+	// PaddingLength is the length of the Padding option data.
+	PaddingLength int
+
+	// Size is the size of the raw response.
+	Size int
+
+	// BlockSize is the first of [PaddingRecommendedBlockSize] and the powers
+	// of two from 1024 down to 16 of which Size is a multiple, or zero when the
+	// response is not padded or Size is not a multiple of any of them.
+	//
+	// A single response only suggests the block size, since Size may be a
+	// multiple of a block by chance. Across many responses, the block size
+	// observed most frequently estimates the server padding policy.
+	BlockSize int
+
+	// Recommended indicates that the response is padded to a multiple
+	// of [PaddingRecommendedBlockSize] as RFC 8467 recommends.
+	Recommended bool
+}
+
+// CheckResponsePadding checks whether the raw response is padded, which
+// DoT and DoQ servers should do per RFC 8467, for padding-deployment studies.
+//
+// This function returns [dnscodec.ErrServerMisbehaving] if the response cannot be unpacked.
+func CheckResponsePadding(rawResp []byte) (ResponsePadding, error) {
+	// 1. unpack the response
+	resp := new(dns.Msg)
+	if err := resp.Unpack(rawResp); err != nil {
+		return ResponsePadding{}, dnscodec.ErrServerMisbehaving
+	}
+	info := ResponsePadding{Size: len(rawResp)}
+
+	// 2. search for the padding option
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+				info.Padded = true
+				info.PaddingLength += len(padding.Padding)
+			}
+		}
+	}
+	if !info.Padded {
+		return info, nil
+	}
+
+	// 3. infer the block size
+	for _, size := range paddingBlockSizes {
+		if info.Size%size == 0 {
+			info.BlockSize = size
+			break
+		}
+	}
+	info.Recommended = info.BlockSize == PaddingRecommendedBlockSize
+	return info, nil
+}
+
+// PaddingOracle computes the length of the EDNS(0) Padding option data (RFC
+// 7830) of a query given the packed query without padding, which allows to
+// prototype traffic-analysis defenses (e.g., padding to size buckets that
+// depend on the query name length). The Padding option header takes four
+// bytes in addition to the returned length.
+//
+// A negative length means sending the query without the Padding option.
+type PaddingOracle func(rawQuery []byte) int
+
+// NewBlockPaddingOracle returns a [PaddingOracle] padding queries to a multiple
+// of blockSize, like Block-Length Padding (RFC 8467 Section 4.1), which
+// recommends padding queries to a multiple of 128 bytes.
+func NewBlockPaddingOracle(blockSize int) PaddingOracle {
+	return func(rawQuery []byte) int {
+		size := len(rawQuery) + 4 // the Padding option header
+		return (blockSize - size%blockSize) % blockSize
+	}
+}
+
+// padQuery replaces the Padding option of the raw query with the one
+// computed by the oracle. Queries without EDNS(0) are left as is.
+func padQuery(oracle PaddingOracle, rawQuery []byte) ([]byte, error) {
+	// 1. unpack the query and remove the existing padding
+	msg := new(dns.Msg)
+	if err := msg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return rawQuery, nil
+	}
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+
+	// 2. ask the oracle and add the new padding
+	unpadded, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	length := oracle(unpadded)
+	if length < 0 {
+		return unpadded, nil
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, length)})
+	return msg.Pack()
+}
+
+// Padding checks the padding of the raw response using [CheckResponsePadding].
+func (r *RawResponse) Padding() (ResponsePadding, error) {
+	return CheckResponsePadding(r.Response)
+}
@@ -0,0 +1,168 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newPaddedTestResponse returns a raw response padded to the given size,
+// or unpadded if size is zero.
+func newPaddedTestResponse(t *testing.T, size int) []byte {
+	resp := new(dns.Msg)
+	resp.SetQuestion("dns.google.", dns.TypeA)
+	resp.Response = true
+	if size > 0 {
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		opt := resp.IsEdns0()
+		length := size - resp.Len() - 4
+		require.GreaterOrEqual(t, length, 0)
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, length)})
+	}
+	raw, err := resp.Pack()
+	require.NoError(t, err)
+	if size > 0 {
+		require.Len(t, raw, size)
+	}
+	return raw
+}
+
+func TestCheckResponsePadding(t *testing.T) {
+	t.Run("unpadded", func(t *testing.T) {
+		raw := newPaddedTestResponse(t, 0)
+		info, err := CheckResponsePadding(raw)
+		require.NoError(t, err)
+		require.Equal(t, ResponsePadding{Size: len(raw)}, info)
+	})
+
+	for _, tc := range []struct {
+		size        int
+		blockSize   int
+		recommended bool
+	}{
+		{468, 468, true},
+		{936, 468, true},
+		{128, 128, false},
+		{512, 512, false},
+		{100, 0, false},
+	} {
+		t.Run(fmt.Sprintf("padded to %d", tc.size), func(t *testing.T) {
+			info, err := CheckResponsePadding(newPaddedTestResponse(t, tc.size))
+			require.NoError(t, err)
+			require.True(t, info.Padded)
+			require.Positive(t, info.PaddingLength)
+			require.Equal(t, tc.size, info.Size)
+			require.Equal(t, tc.blockSize, info.BlockSize)
+			require.Equal(t, tc.recommended, info.Recommended)
+		})
+	}
+
+	t.Run("invalid response", func(t *testing.T) {
+		_, err := CheckResponsePadding([]byte{0x00})
+		require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+	})
+}
+
+func TestRawResponsePadding(t *testing.T) {
+	raw := &RawResponse{Response: newPaddedTestResponse(t, 468)}
+	info, err := raw.Padding()
+	require.NoError(t, err)
+	require.True(t, info.Recommended)
+}
+
+func TestTransportObserveResponsePadding(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	handler := dnstest.NewHandler(config)
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+		resp := handler.PrepareResponse(query)
+		resp.SetEdns0(dns.DefaultMsgSize, false)
+		opt := resp.IsEdns0()
+		length := PaddingRecommendedBlockSize - resp.Len() - 4
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, length)})
+		w.WriteMsg(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+	var observed []ResponsePadding
+	dt.ObserveResponsePadding = func(info ResponsePadding) {
+		observed = append(observed, info)
+	}
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, observed, 1)
+	require.True(t, observed[0].Recommended)
+	require.Equal(t, PaddingRecommendedBlockSize, observed[0].Size)
+}
+
+func TestNewBlockPaddingOracle(t *testing.T) {
+	oracle := NewBlockPaddingOracle(128)
+	require.Equal(t, 84, oracle(make([]byte, 40)))
+	require.Equal(t, 0, oracle(make([]byte, 124)))
+	require.Equal(t, 127, oracle(make([]byte, 125)))
+}
+
+func TestTransportPaddingOracle(t *testing.T) {
+	// queryPadding returns whether the raw query is padded and its length.
+	queryPadding := func(t *testing.T, rawQuery []byte) (bool, int) {
+		msg := new(dns.Msg)
+		require.NoError(t, msg.Unpack(rawQuery))
+		opt := msg.IsEdns0()
+		require.NotNil(t, opt)
+		for _, option := range opt.Option {
+			if padding, ok := option.(*dns.EDNS0_PADDING); ok {
+				return true, len(padding.Padding)
+			}
+		}
+		return false, 0
+	}
+
+	t.Run("pads the query using the oracle", func(t *testing.T) {
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		t.Cleanup(srv.Close)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+		var unpadded []int
+		dt.PaddingOracle = func(rawQuery []byte) int {
+			unpadded = append(unpadded, len(rawQuery))
+			return 256 - len(rawQuery) - 4
+		}
+		var rawQueries [][]byte
+		dt.ObserveRawQuery = func(rawQuery []byte) {
+			rawQueries = append(rawQueries, rawQuery)
+		}
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, rawQueries, 1)
+		require.Len(t, rawQueries[0], 256)
+		padded, length := queryPadding(t, rawQueries[0])
+		require.True(t, padded)
+		require.Equal(t, 256-unpadded[0]-4, length)
+	})
+
+	t.Run("a negative length removes the padding", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		t.Cleanup(srv.Close)
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(&net.Dialer{}, newTestClientTLSConfig()))
+		dt := NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+		dt.PaddingOracle = func(rawQuery []byte) int { return -1 }
+		var rawQueries [][]byte
+		dt.ObserveRawQuery = func(rawQuery []byte) {
+			rawQueries = append(rawQueries, rawQuery)
+		}
+		_, err := ExchangeCodec(context.Background(), dt, MsgCodec{}, new(dns.Msg).SetQuestion("dns.google.", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, rawQueries, 1)
+		padded, _ := queryPadding(t, rawQueries[0])
+		require.False(t, padded)
+	})
+}
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// pcapng block types and constants (draft-ietf-opsawg-pcapng).
+const (
+	pcapngBlockSectionHeader   = 0x0a0d0d0a
+	pcapngBlockInterface       = 0x00000001
+	pcapngBlockEnhancedPacket  = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngLinkTypeRaw          = 101 // LINKTYPE_RAW: IPv4 or IPv6 packets
+	pcapngSyntheticPort        = 53
+	pcapngSyntheticLocalPort   = 49152
+	pcapngSyntheticHopLimit    = 64
+	pcapngSyntheticProtocolUDP = 17
+)
+
+// PcapngWriter writes DNS messages as pcapng (draft-ietf-opsawg-pcapng) packets
+// with synthetic IP and UDP headers, so that the messages exchanged by any
+// protocol, including encrypted ones, open directly in Wireshark.
+//
+// We write the section header and the interface description before the
+// first packet. The writer is safe for concurrent use.
+//
+// Construct using [NewPcapngWriter].
+type PcapngWriter struct {
+	// LocalAddr is the OPTIONAL source address of the queries recorded
+	// using [*PcapngWriter.Observe]. If invalid, we use the loopback address
+	// of the endpoint family and port 49152.
+	LocalAddr netip.AddrPort
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// w is the underlying writer.
+	w io.Writer
+
+	// started indicates we wrote the section header and the interface.
+	started bool
+
+	// err is the first error writing packets using Observe.
+	err error
+}
+
+// NewPcapngWriter creates a new [*PcapngWriter] writing to w.
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{w: w}
+}
+
+// Observe records the raw queries and responses of the given [*Transport] by
+// chaining its ObserveRawQuery and ObserveRawResponse hooks, so call it once
+// after setting the hooks, if any, and before using the transport.
+//
+// The packets flow between LocalAddr and the endpoint the [*Transport] was
+// created with, using port 53 regardless of the protocol so that Wireshark
+// dissects them as DNS. Use [*PcapngWriter.Err] to check for write errors.
+func (pw *PcapngWriter) Observe(dt *Transport) {
+	remote := netip.AddrPortFrom(dt.endpoint.Addr().Unmap(), pcapngSyntheticPort)
+	local := pw.LocalAddr
+	if !local.IsValid() {
+		loopback := netip.IPv6Loopback()
+		if remote.Addr().Is4() {
+			loopback = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+		local = netip.AddrPortFrom(loopback, pcapngSyntheticLocalPort)
+	}
+
+	observeRawQuery := dt.ObserveRawQuery
+	dt.ObserveRawQuery = func(rawQuery []byte) {
+		pw.record(pw.WritePacket(dt.now(), local, remote, rawQuery))
+		if observeRawQuery != nil {
+			observeRawQuery(rawQuery)
+		}
+	}
+	observeRawResponse := dt.ObserveRawResponse
+	dt.ObserveRawResponse = func(rawResp []byte) {
+		pw.record(pw.WritePacket(dt.now(), remote, local, rawResp))
+		if observeRawResponse != nil {
+			observeRawResponse(rawResp)
+		}
+	}
+}
+
+// record saves the first error occurred when writing packets using Observe.
+func (pw *PcapngWriter) record(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// Err returns the first error occurred when writing the
+// packets recorded using [*PcapngWriter.Observe], if any.
+func (pw *PcapngWriter) Err() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// WritePacket writes the given payload captured at the given time as a UDP
+// datagram from src to dst, which must belong to the same address family.
+func (pw *PcapngWriter) WritePacket(t time.Time, src, dst netip.AddrPort, payload []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	// 1. write the section header and the interface description
+	if !pw.started {
+		if _, err := pw.w.Write(pcapngAppendHeader(nil)); err != nil {
+			return err
+		}
+		pw.started = true
+	}
+
+	// 2. write the enhanced packet block
+	packet := pcapngAppendPacket(nil, src, dst, payload)
+	micros := uint64(t.UnixMicro()) // the default if_tsresol
+	block := pcapngAppendBlockStart(nil, pcapngBlockEnhancedPacket, uint32(32+pcapngPadLen(len(packet))))
+	block = binary.LittleEndian.AppendUint32(block, 0) // interface ID
+	block = binary.LittleEndian.AppendUint32(block, uint32(micros>>32))
+	block = binary.LittleEndian.AppendUint32(block, uint32(micros))
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(packet)))
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(packet)))
+	block = append(block, packet...)
+	block = append(block, make([]byte, pcapngPadLen(len(packet))-len(packet))...)
+	block = binary.LittleEndian.AppendUint32(block, uint32(len(block)+4))
+	_, err := pw.w.Write(block)
+	return err
+}
+
+// pcapngAppendHeader appends the section header block and the
+// interface description block using [pcapngLinkTypeRaw].
+func pcapngAppendHeader(buf []byte) []byte {
+	// 1. section header block
+	buf = pcapngAppendBlockStart(buf, pcapngBlockSectionHeader, 28)
+	buf = binary.LittleEndian.AppendUint32(buf, pcapngByteOrderMagic)
+	buf = binary.LittleEndian.AppendUint16(buf, 1) // major version
+	buf = binary.LittleEndian.AppendUint16(buf, 0) // minor version
+	buf = binary.LittleEndian.AppendUint64(buf, ^uint64(0))
+	buf = binary.LittleEndian.AppendUint32(buf, 28)
+
+	// 2. interface description block
+	buf = pcapngAppendBlockStart(buf, pcapngBlockInterface, 20)
+	buf = binary.LittleEndian.AppendUint16(buf, pcapngLinkTypeRaw)
+	buf = binary.LittleEndian.AppendUint16(buf, 0) // reserved
+	buf = binary.LittleEndian.AppendUint32(buf, 0) // no snapshot length
+	return binary.LittleEndian.AppendUint32(buf, 20)
+}
+
+// pcapngAppendBlockStart appends the type and the total length of a block.
+func pcapngAppendBlockStart(buf []byte, blockType, length uint32) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	return binary.LittleEndian.AppendUint32(buf, length)
+}
+
+// pcapngPadLen returns length rounded up to a multiple of 32 bits.
+func pcapngPadLen(length int) int {
+	return (length + 3) &^ 3
+}
+
+// pcapngAppendPacket appends an IPv4 or IPv6 packet containing a UDP datagram.
+func pcapngAppendPacket(buf []byte, src, dst netip.AddrPort, payload []byte) []byte {
+	// 1. create the UDP datagram
+	srcAddr, dstAddr := src.Addr().Unmap(), dst.Addr().Unmap()
+	udpLength := 8 + len(payload)
+	datagram := binary.BigEndian.AppendUint16(nil, src.Port())
+	datagram = binary.BigEndian.AppendUint16(datagram, dst.Port())
+	datagram = binary.BigEndian.AppendUint16(datagram, uint16(udpLength))
+	datagram = binary.BigEndian.AppendUint16(datagram, 0) // checksum
+	datagram = append(datagram, payload...)
+
+	// 2. compute the UDP checksum using the pseudo header (RFC 768 and RFC 8200)
+	pseudo := append(srcAddr.AsSlice(), dstAddr.AsSlice()...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLength))
+	pseudo = binary.BigEndian.AppendUint32(pseudo, pcapngSyntheticProtocolUDP)
+	checksum := pcapngChecksum(append(pseudo, datagram...))
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(datagram[6:], checksum)
+
+	// 3. prepend the IP header
+	if srcAddr.Is4() {
+		header := []byte{0x45, 0x00}
+		header = binary.BigEndian.AppendUint16(header, uint16(20+udpLength))
+		header = append(header, 0, 0, 0, 0, pcapngSyntheticHopLimit, pcapngSyntheticProtocolUDP, 0, 0)
+		header = append(header, srcAddr.AsSlice()...)
+		header = append(header, dstAddr.AsSlice()...)
+		binary.BigEndian.PutUint16(header[10:], pcapngChecksum(header))
+		return append(append(buf, header...), datagram...)
+	}
+	buf = append(buf, 0x60, 0, 0, 0)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(udpLength))
+	buf = append(buf, pcapngSyntheticProtocolUDP, pcapngSyntheticHopLimit)
+	buf = append(buf, srcAddr.AsSlice()...)
+	buf = append(buf, dstAddr.AsSlice()...)
+	return append(buf, datagram...)
+}
+
+// pcapngChecksum returns the internet checksum of data (RFC 1071).
+func pcapngChecksum(data []byte) uint16 {
+	var sum uint32
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) > 0 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// pcapngTestPacket is a packet parsed by [parsePcapngTestPackets].
+type pcapngTestPacket struct {
+	micros   uint64
+	src, dst netip.AddrPort
+	payload  []byte
+}
+
+// parsePcapngTestPackets parses the pcapng data and the packets it contains,
+// verifying the block lengths and the IP and UDP checksums.
+func parsePcapngTestPackets(t *testing.T, data []byte) []pcapngTestPacket {
+	// 1. check the section header and the interface description
+	require.Equal(t, pcapngAppendHeader(nil), data[:48])
+	require.Equal(t, uint16(pcapngLinkTypeRaw), binary.LittleEndian.Uint16(data[36:]))
+	data = data[48:]
+
+	// 2. parse the enhanced packet blocks
+	var packets []pcapngTestPacket
+	for len(data) > 0 {
+		require.Equal(t, uint32(pcapngBlockEnhancedPacket), binary.LittleEndian.Uint32(data))
+		length := binary.LittleEndian.Uint32(data[4:])
+		require.Equal(t, length, binary.LittleEndian.Uint32(data[length-4:]))
+		micros := uint64(binary.LittleEndian.Uint32(data[12:]))<<32 | uint64(binary.LittleEndian.Uint32(data[16:]))
+		packet := data[28 : 28+binary.LittleEndian.Uint32(data[20:])]
+		data = data[length:]
+
+		// 3. parse the IP header and the UDP datagram
+		var src, dst netip.Addr
+		var pseudo, datagram []byte
+		switch packet[0] >> 4 {
+		case 4:
+			require.Zero(t, pcapngChecksum(packet[:20]))
+			src, dst = netip.AddrFrom4([4]byte(packet[12:16])), netip.AddrFrom4([4]byte(packet[16:20]))
+			datagram = packet[20:]
+		case 6:
+			src, dst = netip.AddrFrom16([16]byte(packet[8:24])), netip.AddrFrom16([16]byte(packet[24:40]))
+			datagram = packet[40:]
+		default:
+			t.Fatal("unexpected IP version")
+		}
+		pseudo = append(src.AsSlice(), dst.AsSlice()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(datagram)))
+		pseudo = binary.BigEndian.AppendUint32(pseudo, pcapngSyntheticProtocolUDP)
+		require.Zero(t, pcapngChecksum(append(pseudo, datagram...)))
+		require.Equal(t, len(datagram), int(binary.BigEndian.Uint16(datagram[4:])))
+		packets = append(packets, pcapngTestPacket{
+			micros:  micros,
+			src:     netip.AddrPortFrom(src, binary.BigEndian.Uint16(datagram)),
+			dst:     netip.AddrPortFrom(dst, binary.BigEndian.Uint16(datagram[2:])),
+			payload: datagram[8:],
+		})
+	}
+	return packets
+}
+
+func TestPcapngWriter(t *testing.T) {
+	t.Run("records the exchanges of a transport", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		t.Cleanup(srv.Close)
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(&net.Dialer{}, newTestClientTLSConfig()))
+		dt := NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+		var observed int
+		dt.ObserveRawQuery = func([]byte) { observed++ }
+		t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+		dt.TimeNow = func() time.Time { return t0 }
+
+		var buf bytes.Buffer
+		pw := NewPcapngWriter(&buf)
+		pw.Observe(dt)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.NoError(t, pw.Err())
+		require.Equal(t, 1, observed)
+
+		packets := parsePcapngTestPackets(t, buf.Bytes())
+		require.Len(t, packets, 2)
+		local := netip.MustParseAddrPort("127.0.0.1:49152")
+		remote := netip.MustParseAddrPort("127.0.0.1:53")
+		require.Equal(t, local, packets[0].src)
+		require.Equal(t, remote, packets[0].dst)
+		require.Equal(t, remote, packets[1].src)
+		require.Equal(t, local, packets[1].dst)
+		for idx, packet := range packets {
+			require.Equal(t, uint64(t0.UnixMicro()), packet.micros)
+			msg := new(dns.Msg)
+			require.NoError(t, msg.Unpack(packet.payload))
+			require.Equal(t, idx == 1, msg.Response)
+		}
+	})
+
+	t.Run("writes IPv6 packets", func(t *testing.T) {
+		var buf bytes.Buffer
+		pw := NewPcapngWriter(&buf)
+		src := netip.MustParseAddrPort("[2001:db8::1]:49152")
+		dst := netip.MustParseAddrPort("[2001:db8::2]:53")
+		require.NoError(t, pw.WritePacket(time.Now(), src, dst, []byte("odd")))
+		require.NoError(t, pw.WritePacket(time.Now(), dst, src, []byte("even")))
+		packets := parsePcapngTestPackets(t, buf.Bytes())
+		require.Len(t, packets, 2)
+		require.Equal(t, src, packets[0].src)
+		require.Equal(t, []byte("odd"), packets[0].payload)
+		require.Equal(t, []byte("even"), packets[1].payload)
+	})
+
+	t.Run("Err returns the first write error", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		pw := NewPcapngWriter(&netstub.FuncConn{
+			WriteFunc: func([]byte) (int, error) { return 0, expected },
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.MustParseAddrPort("127.0.0.1:53"))
+		pw.Observe(dt)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.ErrorIs(t, pw.Err(), expected)
+	})
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// ErrPersistentTransportClosed indicates that the [*PersistentTransport] is closed.
+var ErrPersistentTransportClosed = errors.New("dnsoverstream: persistent transport closed")
+
+// PersistentTransport dials a single connection and serializes the exchanges
+// over it until it breaks, automatically redialing at the next exchange,
+// which suits long-running monitoring agents wanting a stable connection
+// identity rather than a connection per exchange or a [*Pool].
+//
+// Since we cannot know the state of a connection after a failed exchange
+// (e.g., the response may arrive later), we close the connection after any
+// failed exchange and redial at the next one. We also close the connection
+// when the context is done during an exchange, which interrupts the exchange
+// even when the context has no deadline. Likewise, we close and
+// replace the connection when the server signals that it is closing it
+// (see [StreamOpenerClosing]), e.g., by sending a TCP FIN while idle.
+//
+// A [*PersistentTransport] is safe for concurrent use by multiple goroutines.
+//
+// Construct using [NewPersistentTransport].
+type PersistentTransport struct {
+	// Transport is the MANDATORY [*Transport] used to dial and exchange.
+	Transport *Transport
+
+	// ObserveDial is an optional hook called after each dial, including
+	// the redials, with the dial error or nil on success.
+	ObserveDial func(err error)
+
+	// ObserveClosing is an optional hook called when we drop the
+	// connection because the server signalled it is closing it.
+	ObserveClosing func()
+
+	// sem serializes the exchanges while honouring the context.
+	sem chan struct{}
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// conn is the current connection or nil.
+	conn StreamOpener
+
+	// stats tracks the current connection or the last one we closed.
+	stats *connStats
+
+	// closed indicates that Close was called.
+	closed bool
+}
+
+// NewPersistentTransport creates a new [*PersistentTransport] using the
+// given [*Transport], which dials lazily at the first exchange.
+func NewPersistentTransport(dt *Transport) *PersistentTransport {
+	return &PersistentTransport{Transport: dt, sem: make(chan struct{}, 1)}
+}
+
+// Exchange sends a [*dnscodec.Query] and receives a [*dnscodec.Response] over
+// the persistent connection, dialing it if needed, and waits for the previous
+// exchanges to complete first.
+//
+// This method returns [ErrPersistentTransportClosed] after Close.
+func (pt *PersistentTransport) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, error) {
+	// 1. wait for our turn
+	select {
+	case pt.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-pt.sem }()
+
+	// 2. obtain the connection, dialing if needed
+	conn, stats, err := pt.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. exchange dropping the connection when the context is done, which
+	// interrupts a blocked read when the context has no deadline, so that we
+	// redial at the next exchange rather than waiting forever
+	stop := context.AfterFunc(ctx, func() {
+		pt.drop(conn)
+	})
+	stats.begin()
+	resp, err := pt.Transport.ExchangeWithStreamOpener(withConnStats(withBorrowedStreamOpener(ctx), stats), conn, query)
+	stats.end(pt.Transport.now(), err)
+	if !stop() && err != nil {
+		return nil, wrapContextError(ctx, err) // the connection has already been dropped
+	}
+
+	// 4. drop the connection on failure
+	if err != nil {
+		pt.drop(conn)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// connection returns the current connection or dials a new one.
+//
+// The caller MUST hold the semaphore, so only one goroutine dials.
+func (pt *PersistentTransport) connection(ctx context.Context) (StreamOpener, *connStats, error) {
+	// 1. reuse the current connection
+	pt.mu.Lock()
+	if pt.closed {
+		pt.mu.Unlock()
+		return nil, nil, ErrPersistentTransportClosed
+	}
+	conn, stats := pt.conn, pt.stats
+	pt.mu.Unlock()
+
+	// 2. replace the connection the server is closing
+	if conn != nil && StreamOpenerClosing(conn) {
+		pt.drop(conn)
+		if pt.ObserveClosing != nil {
+			pt.ObserveClosing()
+		}
+		conn = nil
+	}
+	if conn != nil {
+		return conn, stats, nil
+	}
+
+	// 3. dial a new connection without holding the mutex
+	conn, err := pt.Transport.Dial(ctx)
+	if pt.ObserveDial != nil {
+		pt.ObserveDial(err)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stats = newConnStats(newPoolKey(pt.Transport.dialer, pt.Transport.endpointFor(ctx)), pt.Transport.now())
+
+	// 4. make sure we were not closed while dialing
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.closed {
+		conn.Close()
+		return nil, nil, ErrPersistentTransportClosed
+	}
+	pt.conn, pt.stats = conn, stats
+	return conn, stats, nil
+}
+
+// drop closes the given connection if it is still the current one, since
+// otherwise Close has already closed it.
+func (pt *PersistentTransport) drop(conn StreamOpener) {
+	pt.mu.Lock()
+	current := pt.conn == conn
+	if current {
+		pt.conn = nil
+		pt.stats.markClosed(nil)
+	}
+	pt.mu.Unlock()
+	if current {
+		conn.Close()
+	}
+}
+
+// Close closes the current connection, if any, and prevents further
+// exchanges, interrupting the exchange in progress, if any.
+func (pt *PersistentTransport) Close() error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.closed = true
+	conn := pt.conn
+	pt.conn = nil
+	if conn == nil {
+		return nil
+	}
+	pt.stats.markClosed(nil)
+	return conn.Close()
+}
+
+// ConnState returns a snapshot of the current connection or, if we closed
+// it, of the last connection, or nil if we did not dial yet.
+func (pt *PersistentTransport) ConnState() []ConnState {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.stats == nil {
+		return nil
+	}
+	return []ConnState{pt.stats.snapshot(pt.Transport.now())}
+}
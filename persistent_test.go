@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentTransport(t *testing.T) {
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+
+	t.Run("serializes the exchanges over a single connection", func(t *testing.T) {
+		endpoint, _ := newDSOTestServer(t, nil)
+		pt := NewPersistentTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+		var dials atomic.Int64
+		pt.ObserveDial = func(err error) {
+			require.NoError(t, err)
+			dials.Add(1)
+		}
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				resp, err := pt.Exchange(context.Background(), query)
+				require.NoError(t, err)
+				addrs, err := resp.RecordsA()
+				require.NoError(t, err)
+				require.Equal(t, []string{"8.8.8.8"}, addrs)
+			})
+		}
+		wg.Wait()
+		require.Equal(t, int64(1), dials.Load())
+	})
+
+	t.Run("redials after a failed exchange", func(t *testing.T) {
+		broken := &closeCountingOpener{FuncStreamOpener: FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				return &FuncStream{ReadFunc: func(p []byte) (int, error) { return 0, io.ErrUnexpectedEOF }}, nil
+			},
+		}}
+		var dials atomic.Int64
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				if dials.Add(1) == 1 {
+					return broken, nil
+				}
+				return NewHandlerStreamOpener(newBenchHandler()), nil
+			},
+		}
+		pt := NewPersistentTransport(NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53")))
+		defer pt.Close()
+
+		_, err := pt.Exchange(context.Background(), query)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, int64(1), broken.closed.Load())
+
+		for range 2 {
+			_, err = pt.Exchange(context.Background(), query)
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(2), dials.Load())
+	})
+
+	t.Run("interrupts the exchange when the context is canceled", func(t *testing.T) {
+		// the server reads the queries but never replies
+		endpoint, accepted := newPipelineTestServer(t, func(conn net.Conn) {
+			io.Copy(io.Discard, conn)
+		})
+		pt := NewPersistentTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+
+		for range 2 {
+			ctx, cancel := context.WithCancel(context.Background())
+			timer := time.AfterFunc(20*time.Millisecond, cancel)
+			_, err := pt.Exchange(ctx, query)
+			require.ErrorIs(t, err, context.Canceled)
+			timer.Stop()
+			cancel()
+		}
+		require.Equal(t, int64(2), accepted.Load())
+	})
+
+	t.Run("refuses exchanging after close", func(t *testing.T) {
+		conn := &closeCountingOpener{FuncStreamOpener: FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				return NewHandlerStreamOpener(newBenchHandler()).OpenStream()
+			},
+		}}
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				return conn, nil
+			},
+		}
+		pt := NewPersistentTransport(NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53")))
+		_, err := pt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+
+		require.NoError(t, pt.Close())
+		require.Equal(t, int64(1), conn.closed.Load())
+		_, err = pt.Exchange(context.Background(), query)
+		require.ErrorIs(t, err, ErrPersistentTransportClosed)
+	})
+}
@@ -0,0 +1,567 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// ErrPipelinedTransportClosed indicates that the [*PipelinedTransport] is closed.
+var ErrPipelinedTransportClosed = errors.New("dnsoverstream: pipelined transport closed")
+
+// ErrPipeliningUnsupported indicates that the [StreamOpener] does not support
+// pipelining, as is the case for DNS over QUIC and HTTPS, whose exchanges use
+// independent streams (see [*Transport.ExchangeConcurrentWithStreamOpener] instead).
+var ErrPipeliningUnsupported = errors.New("dnsoverstream: pipelining unsupported")
+
+// ErrPipelineFull indicates that all the message IDs of a pipelined
+// connection are in use by queries waiting for their responses.
+var ErrPipelineFull = errors.New("dnsoverstream: too many pipelined queries")
+
+// PipelinedTransport sends concurrent queries over a single DNS over TCP or
+// TLS connection without waiting for the previous responses, and matches the
+// responses, which servers may send out of order, using the message ID (RFC
+// 7766 Section 6.2.1.1), so bulk resolution does not wait a round trip for
+// each query, as it does with a [*PersistentTransport].
+//
+// When two queries in flight share the same message ID, we send the second one
+// using an unused ID, and restore the original ID in its response, which would
+// invalidate TSIG signatures, so use distinct IDs when signing queries.
+//
+// A failed exchange (e.g., because of a timeout) does not affect the other
+// exchanges and we discard its response if it arrives later. Instead, when
+// reading or writing fails (e.g., because the server closed the connection),
+// all the exchanges in flight fail, and we redial at the next exchange.
+//
+// This transport does not support DNS over QUIC, which sends each query over a
+// distinct stream, and DNS over HTTPS, whose connections are already concurrent,
+// so the exchanges fail with [ErrPipeliningUnsupported] when using them.
+//
+// A [*PipelinedTransport] is safe for concurrent use by multiple goroutines.
+//
+// Construct using [NewPipelinedTransport].
+type PipelinedTransport struct {
+	// Transport is the MANDATORY [*Transport] used to dial and exchange.
+	Transport *Transport
+
+	// ObserveDial is an optional hook called after each dial, including
+	// the redials, with the dial error or nil on success.
+	ObserveDial func(err error)
+
+	// sem serializes dialing while honouring the context.
+	sem chan struct{}
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// pipe is the current pipelined connection, possibly failed, or nil.
+	pipe *pipelineConn
+
+	// closed indicates that Close was called.
+	closed bool
+}
+
+// NewPipelinedTransport creates a new [*PipelinedTransport] using the
+// given [*Transport], which dials lazily at the first exchange.
+func NewPipelinedTransport(dt *Transport) *PipelinedTransport {
+	return &PipelinedTransport{Transport: dt, sem: make(chan struct{}, 1)}
+}
+
+// Exchange sends a [*dnscodec.Query] and receives a [*dnscodec.Response] over
+// the pipelined connection, dialing it if needed, without waiting for the
+// other exchanges in progress to complete.
+//
+// This method returns [ErrPipelinedTransportClosed] after Close.
+func (pt *PipelinedTransport) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, error) {
+	// 1. obtain the pipelined connection, dialing if needed
+	pipe, err := pt.pipeline(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. exchange using a stream bound to the context
+	conn := &pipelineStreamOpener{pipe: pipe, ctx: ctx}
+	defer conn.release()
+	pipe.stats.begin()
+	resp, err := pt.Transport.ExchangeWithStreamOpener(withConnStats(withBorrowedStreamOpener(ctx), pipe.stats), conn, query)
+	pipe.stats.end(pt.Transport.now(), err)
+	return resp, err
+}
+
+// pipeline returns the current pipelined connection or dials a new one.
+func (pt *PipelinedTransport) pipeline(ctx context.Context) (*pipelineConn, error) {
+	// 1. reuse the current connection unless it failed
+	if pipe, err := pt.current(); pipe != nil || err != nil {
+		return pipe, err
+	}
+
+	// 2. make sure only one goroutine dials
+	select {
+	case pt.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-pt.sem }()
+
+	// 3. another goroutine may have dialed while we were waiting
+	if pipe, err := pt.current(); pipe != nil || err != nil {
+		return pipe, err
+	}
+
+	// 4. dial a new connection without holding the mutex
+	conn, err := pt.Transport.Dial(ctx)
+	if pt.ObserveDial != nil {
+		pt.ObserveDial(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := newPoolKey(pt.Transport.dialer, pt.Transport.endpointFor(ctx))
+	pipe, err := newPipelineConn(conn, newConnStats(key, pt.Transport.now()))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// 5. make sure we were not closed while dialing
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.closed {
+		pipe.close(ErrPipelinedTransportClosed)
+		return nil, ErrPipelinedTransportClosed
+	}
+	pt.pipe = pipe
+	return pipe, nil
+}
+
+// current returns the current pipelined connection, if it did not fail, or
+// [ErrPipelinedTransportClosed] after Close, or nil and nil otherwise.
+func (pt *PipelinedTransport) current() (*pipelineConn, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.closed {
+		return nil, ErrPipelinedTransportClosed
+	}
+	if pt.pipe != nil && pt.pipe.failed() {
+		return nil, nil // the failure has already closed the connection
+	}
+	return pt.pipe, nil
+}
+
+// Close closes the current connection, if any, and prevents further
+// exchanges, failing the exchanges in progress, if any.
+func (pt *PipelinedTransport) Close() error {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.closed = true
+	if pt.pipe == nil {
+		return nil
+	}
+	return pt.pipe.close(ErrPipelinedTransportClosed)
+}
+
+// ConnState returns a snapshot of the current connection or, if it failed,
+// of the last connection, or nil if we did not dial yet.
+func (pt *PipelinedTransport) ConnState() []ConnState {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if pt.pipe == nil {
+		return nil
+	}
+	return []ConnState{pt.pipe.stats.snapshot(pt.Transport.now())}
+}
+
+// pipelineConn is a connection shared by pipelined queries, where a
+// background goroutine reads the responses and dispatches them.
+type pipelineConn struct {
+	// conn is the underlying [StreamOpener].
+	conn StreamOpener
+
+	// stream is the single [Stream] of a TCP or TLS connection.
+	stream Stream
+
+	// stats tracks the connection state.
+	stats *connStats
+
+	// wsem serializes writing the queries while honouring the context.
+	wsem chan struct{}
+
+	// done is closed when the connection fails.
+	done chan struct{}
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// pending maps the message IDs we sent to the streams awaiting responses.
+	pending map[uint16]*pipelineStream
+
+	// err is the error that caused the connection to fail.
+	err error
+}
+
+// newPipelineConn creates a [*pipelineConn] and starts reading the responses.
+//
+// This function fails with [ErrPipeliningUnsupported] when the streams
+// of conn are independent (e.g., when using DNS over QUIC).
+func newPipelineConn(conn StreamOpener, stats *connStats) (*pipelineConn, error) {
+	if _, ok := conn.(concurrentStreamOpener); ok {
+		return nil, ErrPipeliningUnsupported
+	}
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	pc := &pipelineConn{
+		conn:    conn,
+		stream:  stream,
+		stats:   stats,
+		wsem:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		pending: make(map[uint16]*pipelineStream),
+	}
+	go pc.readLoop()
+	return pc, nil
+}
+
+// readLoop reads and dispatches the responses until reading fails.
+func (pc *pipelineConn) readLoop() {
+	br := bufio.NewReader(pc.stream)
+	for {
+		frame, err := readPipelineFrame(br)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+		pc.dispatch(frame)
+	}
+}
+
+// readPipelineFrame reads a framed message including its length prefix.
+func readPipelineFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 2+int(binary.BigEndian.Uint16(header)))
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[2:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if len(frame) < 2+HeaderSize {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	return frame, nil
+}
+
+// dispatch delivers the framed response to the stream awaiting it.
+func (pc *pipelineConn) dispatch(frame []byte) {
+	wireID := binary.BigEndian.Uint16(frame[2:4])
+	pc.mu.Lock()
+	ps := pc.pending[wireID]
+	delete(pc.pending, wireID)
+	pc.mu.Unlock()
+	if ps == nil {
+		return // late response to an abandoned query
+	}
+	binary.BigEndian.PutUint16(frame[2:4], ps.id)
+	ps.response <- frame // does not block, since the channel is buffered
+}
+
+// register reserves a message ID for the given stream, which is
+// the original ID unless another query in flight is using it.
+func (pc *pipelineConn) register(ps *pipelineStream) (uint16, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return 0, pc.err
+	}
+	if len(pc.pending) > math.MaxUint16 {
+		return 0, ErrPipelineFull
+	}
+	wireID := ps.id
+	for pc.pending[wireID] != nil {
+		wireID = uint16(rand.N(math.MaxUint16 + 1))
+	}
+	pc.pending[wireID] = ps
+	return wireID, nil
+}
+
+// unregister releases the message ID reserved by the given stream, if any.
+func (pc *pipelineConn) unregister(ps *pipelineStream) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if ps.registered && pc.pending[ps.wireID] == ps {
+		delete(pc.pending, ps.wireID)
+	}
+}
+
+// write writes the framed query using the given deadline.
+//
+// While waiting for the other queries to be written, we give up when the
+// context is done, the deadline expires, or the connection fails. Instead,
+// since a partial write would corrupt the framing, we fail the connection
+// when writing fails, including because of the deadline.
+func (pc *pipelineConn) write(ctx context.Context, frame []byte, deadline time.Time) error {
+	// 1. wait for our turn
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case pc.wsem <- struct{}{}:
+	case <-pc.done:
+		return pc.failure()
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+	defer func() { <-pc.wsem }()
+
+	// 2. write the query
+	if sd, ok := pc.stream.(streamReadWriteDeadliner); ok {
+		_ = sd.SetWriteDeadline(deadline)
+		defer sd.SetWriteDeadline(time.Time{})
+	}
+	if _, err := pc.stream.Write(frame); err != nil {
+		pc.close(err)
+		return err
+	}
+	return nil
+}
+
+// failed returns whether the connection failed.
+func (pc *pipelineConn) failed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err != nil
+}
+
+// failure returns the error that caused the connection to fail.
+func (pc *pipelineConn) failure() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if errors.Is(pc.err, io.EOF) {
+		return io.ErrUnexpectedEOF // the server closed before responding
+	}
+	return pc.err
+}
+
+// close fails the connection with the given error, failing the exchanges in
+// flight, and closes the underlying connection, unless already failed.
+func (pc *pipelineConn) close(err error) error {
+	pc.mu.Lock()
+	if pc.err != nil {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.err = err
+	clear(pc.pending)
+	close(pc.done)
+	pc.mu.Unlock()
+	if errors.Is(err, ErrPipelinedTransportClosed) {
+		err = nil // not a connection error
+	}
+	pc.stats.markClosed(err)
+	return pc.conn.Close()
+}
+
+// pipelineStreamOpener is the [StreamOpener] used by a single pipelined exchange.
+type pipelineStreamOpener struct {
+	// pipe is the shared connection.
+	pipe *pipelineConn
+
+	// ctx is the context of the exchange.
+	ctx context.Context
+
+	// stream is the opened stream or nil.
+	stream *pipelineStream
+}
+
+var _ StreamOpener = &pipelineStreamOpener{}
+
+// Close implements [StreamOpener].
+func (o *pipelineStreamOpener) Close() error {
+	// The [*PipelinedTransport] owns the shared connection.
+	return nil
+}
+
+// MutateQuery implements [StreamOpener].
+func (o *pipelineStreamOpener) MutateQuery(msg *dnscodec.Query) {
+	o.pipe.conn.MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (o *pipelineStreamOpener) OpenStream() (Stream, error) {
+	o.stream = &pipelineStream{pipe: o.pipe, ctx: o.ctx, response: make(chan []byte, 1)}
+	return o.stream, nil
+}
+
+// release releases the message ID reserved by the exchange, if any,
+// so that we discard the response if it arrives later.
+func (o *pipelineStreamOpener) release() {
+	if o.stream != nil {
+		o.pipe.unregister(o.stream)
+	}
+}
+
+// pipelineStream implements [Stream] for a single pipelined exchange, by
+// buffering the framed query until complete, and then by returning the
+// framed response dispatched by the [*pipelineConn].
+//
+// Like the [Stream] returned by the other [StreamOpener], this type is
+// not safe for concurrent use by multiple goroutines.
+type pipelineStream struct {
+	// pipe is the shared connection.
+	pipe *pipelineConn
+
+	// ctx is the context of the exchange.
+	ctx context.Context
+
+	// id is the original message ID.
+	id uint16
+
+	// wireID is the message ID we sent.
+	wireID uint16
+
+	// registered indicates that we reserved wireID.
+	registered bool
+
+	// query contains the framed query written so far.
+	query []byte
+
+	// response receives the framed response.
+	response chan []byte
+
+	// unread contains the part of the framed response not read yet.
+	unread []byte
+
+	// received indicates that we received the response.
+	received bool
+
+	// readDeadline is the read deadline.
+	readDeadline time.Time
+
+	// writeDeadline is the write deadline.
+	writeDeadline time.Time
+}
+
+var _ Stream = &pipelineStream{}
+
+// errPipelineInvalidQuery indicates that the caller did not write a single framed query.
+var errPipelineInvalidQuery = errors.New("dnsoverstream: invalid pipelined query")
+
+// Write implements [Stream].
+func (s *pipelineStream) Write(data []byte) (int, error) {
+	// 1. buffer until we have the whole frame
+	if s.registered {
+		return 0, errPipelineInvalidQuery
+	}
+	s.query = append(s.query, data...)
+	if len(s.query) < 2 || len(s.query) < 2+int(binary.BigEndian.Uint16(s.query)) {
+		return len(data), nil
+	}
+	if len(s.query) != 2+int(binary.BigEndian.Uint16(s.query)) || len(s.query) < 2+HeaderSize {
+		return 0, errPipelineInvalidQuery
+	}
+
+	// 2. reserve a message ID and rewrite the query if needed
+	s.id = binary.BigEndian.Uint16(s.query[2:4])
+	wireID, err := s.pipe.register(s)
+	if err != nil {
+		return 0, err
+	}
+	s.wireID, s.registered = wireID, true
+	binary.BigEndian.PutUint16(s.query[2:4], wireID)
+
+	// 3. send the query
+	if err := s.pipe.write(s.ctx, s.query, s.writeDeadline); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Read implements [Stream].
+func (s *pipelineStream) Read(buff []byte) (int, error) {
+	if len(s.unread) <= 0 {
+		if s.received {
+			return 0, io.EOF
+		}
+		frame, err := s.wait()
+		if err != nil {
+			return 0, err
+		}
+		s.unread, s.received = frame, true
+	}
+	count := copy(buff, s.unread)
+	s.unread = s.unread[count:]
+	return count, nil
+}
+
+// wait waits for the framed response.
+func (s *pipelineStream) wait() ([]byte, error) {
+	if !s.registered {
+		return nil, errPipelineInvalidQuery
+	}
+	var expired <-chan time.Time
+	if !s.readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(s.readDeadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case frame := <-s.response:
+		return frame, nil
+	case <-s.pipe.done:
+		select {
+		case frame := <-s.response:
+			return frame, nil // dispatched just before failing
+		default:
+			return nil, s.pipe.failure()
+		}
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// Close implements [Stream].
+func (s *pipelineStream) Close() error {
+	// We do not close the stream midway, like for TCP.
+	return nil
+}
+
+// SetDeadline implements [Stream].
+func (s *pipelineStream) SetDeadline(t time.Time) error {
+	s.readDeadline, s.writeDeadline = t, t
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *pipelineStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *pipelineStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline = t
+	return nil
+}
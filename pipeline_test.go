@@ -0,0 +1,305 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newPipelineTestServer starts a TCP server invoking serve for each
+// connection and returns its endpoint and the number of accepted connections.
+func newPipelineTestServer(t *testing.T, serve func(conn net.Conn)) (netip.AddrPort, *atomic.Int64) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var (
+		accepted atomic.Int64
+		wg       sync.WaitGroup
+	)
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			wg.Go(func() {
+				defer conn.Close()
+				serve(conn)
+			})
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	return listener.Addr().(*net.TCPAddr).AddrPort(), &accepted
+}
+
+// pipelineTestReadQuery reads a framed query from conn.
+func pipelineTestReadQuery(conn net.Conn) (*dns.Msg, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return nil, err
+	}
+	query := new(dns.Msg)
+	if err := query.Unpack(raw); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// pipelineTestWriteAnswer writes the framed answer to query, which contains
+// an A record whose last byte is the number prefixing the query name.
+func pipelineTestWriteAnswer(conn net.Conn, query *dns.Msg) error {
+	var index byte
+	fmt.Sscanf(query.Question[0].Name, "q%d.", &index)
+	resp := new(dns.Msg)
+	resp.SetReply(query)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(10, 0, 0, index),
+	}}
+	raw, err := resp.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(appendStreamMsgFrame(nil, raw))
+	return err
+}
+
+func TestPipelinedTransport(t *testing.T) {
+	t.Run("matches responses sent out of order", func(t *testing.T) {
+		// the server answers in reverse order after receiving all the queries,
+		// which would deadlock unless we send the queries concurrently
+		const count = 4
+		endpoint, accepted := newPipelineTestServer(t, func(conn net.Conn) {
+			var queries []*dns.Msg
+			for range count {
+				query, err := pipelineTestReadQuery(conn)
+				if err != nil {
+					return
+				}
+				queries = append(queries, query)
+			}
+			for _, query := range slices.Backward(queries) {
+				if err := pipelineTestWriteAnswer(conn, query); err != nil {
+					return
+				}
+			}
+		})
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+
+		var wg sync.WaitGroup
+		for idx := range count {
+			wg.Go(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				query := dnscodec.NewQuery(fmt.Sprintf("q%d.example.com", idx), dns.TypeA)
+				resp, err := pt.Exchange(ctx, query)
+				require.NoError(t, err)
+				addrs, err := resp.RecordsA()
+				require.NoError(t, err)
+				require.Equal(t, []string{fmt.Sprintf("10.0.0.%d", idx)}, addrs)
+			})
+		}
+		wg.Wait()
+		require.Equal(t, int64(1), accepted.Load())
+	})
+
+	t.Run("rewrites colliding message IDs", func(t *testing.T) {
+		var (
+			mu  sync.Mutex
+			ids []uint16
+		)
+		endpoint, _ := newPipelineTestServer(t, func(conn net.Conn) {
+			var queries []*dns.Msg
+			for range 2 {
+				query, err := pipelineTestReadQuery(conn)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				ids = append(ids, query.Id)
+				mu.Unlock()
+				queries = append(queries, query)
+			}
+			for _, query := range queries {
+				if err := pipelineTestWriteAnswer(conn, query); err != nil {
+					return
+				}
+			}
+		})
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+
+		var wg sync.WaitGroup
+		for idx := range 2 {
+			wg.Go(func() {
+				query := dnscodec.NewQuery(fmt.Sprintf("q%d.example.com", idx), dns.TypeA)
+				query.ID = 4242
+				resp, err := pt.Exchange(context.Background(), query)
+				require.NoError(t, err)
+				require.Equal(t, uint16(4242), resp.Response.Id)
+				addrs, err := resp.RecordsA()
+				require.NoError(t, err)
+				require.Equal(t, []string{fmt.Sprintf("10.0.0.%d", idx)}, addrs)
+			})
+		}
+		wg.Wait()
+		require.Len(t, ids, 2)
+		require.NotEqual(t, ids[0], ids[1])
+		require.Contains(t, ids, uint16(4242))
+	})
+
+	t.Run("discards late responses to abandoned queries", func(t *testing.T) {
+		// the server delays answering the slow query until the next query
+		endpoint, accepted := newPipelineTestServer(t, func(conn net.Conn) {
+			var delayed []*dns.Msg
+			for {
+				query, err := pipelineTestReadQuery(conn)
+				if err != nil {
+					return
+				}
+				if strings.HasPrefix(query.Question[0].Name, "q1.") {
+					delayed = append(delayed, query)
+					continue
+				}
+				for _, query := range append(delayed, query) {
+					if err := pipelineTestWriteAnswer(conn, query); err != nil {
+						return
+					}
+				}
+				delayed = nil
+			}
+		})
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := pt.Exchange(ctx, dnscodec.NewQuery("q1.example.com", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		resp, err := pt.Exchange(context.Background(), dnscodec.NewQuery("q2.example.com", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.2"}, addrs)
+		require.Equal(t, int64(1), accepted.Load())
+	})
+
+	t.Run("fails the exchanges in flight when the server closes", func(t *testing.T) {
+		endpoint, accepted := newPipelineTestServer(t, func(conn net.Conn) {
+			pipelineTestReadQuery(conn)
+		})
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		defer pt.Close()
+
+		for range 2 {
+			_, err := pt.Exchange(context.Background(), dnscodec.NewQuery("q1.example.com", dns.TypeA))
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		}
+		require.Equal(t, int64(2), accepted.Load())
+	})
+
+	t.Run("refuses exchanging after close", func(t *testing.T) {
+		endpoint, _ := newPipelineTestServer(t, func(conn net.Conn) {
+			for {
+				query, err := pipelineTestReadQuery(conn)
+				if err != nil {
+					return
+				}
+				if err := pipelineTestWriteAnswer(conn, query); err != nil {
+					return
+				}
+			}
+		})
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint))
+		_, err := pt.Exchange(context.Background(), dnscodec.NewQuery("q1.example.com", dns.TypeA))
+		require.NoError(t, err)
+
+		require.NoError(t, pt.Close())
+		_, err = pt.Exchange(context.Background(), dnscodec.NewQuery("q1.example.com", dns.TypeA))
+		require.ErrorIs(t, err, ErrPipelinedTransportClosed)
+	})
+
+	t.Run("refuses DNS over QUIC", func(t *testing.T) {
+		srv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer pconn.Close()
+		quicDialer := NewQUICDialer(pconn, "example.com")
+		quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+		pt := NewPipelinedTransport(NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint()))
+		defer pt.Close()
+
+		_, err = pt.Exchange(context.Background(), dnscodec.NewQuery("q1.example.com", dns.TypeA))
+		require.ErrorIs(t, err, ErrPipeliningUnsupported)
+	})
+}
+
+func TestPipelineConnWrite(t *testing.T) {
+	// newBusyPipelineConn returns a [*pipelineConn] whose
+	// write lock is held by another query being written.
+	newBusyPipelineConn := func() *pipelineConn {
+		key := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+		pc := &pipelineConn{
+			conn:    &closeCountingOpener{},
+			stats:   newConnStats(key, time.Now()),
+			wsem:    make(chan struct{}, 1),
+			done:    make(chan struct{}),
+			pending: make(map[uint16]*pipelineStream),
+		}
+		pc.wsem <- struct{}{}
+		return pc
+	}
+
+	t.Run("gives up waiting when the context is done", func(t *testing.T) {
+		pc := newBusyPipelineConn()
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		err := pc.write(ctx, []byte{0, 0}, time.Time{})
+		require.ErrorIs(t, err, context.Canceled)
+		require.False(t, pc.failed())
+	})
+
+	t.Run("gives up waiting when the deadline expires", func(t *testing.T) {
+		pc := newBusyPipelineConn()
+		err := pc.write(context.Background(), []byte{0, 0}, time.Now().Add(10*time.Millisecond))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		require.False(t, pc.failed())
+	})
+
+	t.Run("gives up waiting when the connection fails", func(t *testing.T) {
+		pc := newBusyPipelineConn()
+		time.AfterFunc(10*time.Millisecond, func() { pc.close(io.EOF) })
+		err := pc.write(context.Background(), []byte{0, 0}, time.Time{})
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
+func TestNewPipelineConnRefusesConcurrentStreams(t *testing.T) {
+	_, err := newPipelineConn(&quicConnAdapter{}, nil)
+	require.ErrorIs(t, err, ErrPipeliningUnsupported)
+}
@@ -0,0 +1,201 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// ErrPolicyDowngrade indicates that the [*Policy] refused an exchange using a
+// weaker protocol, or an unverified certificate, than previously seen for the server.
+var ErrPolicyDowngrade = errors.New("dnsoverstream: refusing downgrade")
+
+// PolicyFacts contains what we learned about a server address.
+type PolicyFacts struct {
+	// SupportsTLS indicates that the server answered over DNS over TLS.
+	SupportsTLS bool
+
+	// SupportsQUIC indicates that the server answered over DNS over QUIC.
+	SupportsQUIC bool
+
+	// ValidCert indicates that the server presented a certificate
+	// that we verified, rather than one accepted without verification.
+	ValidCert bool
+}
+
+// encrypted returns whether the server supports an encrypted protocol.
+func (f PolicyFacts) encrypted() bool {
+	return f.SupportsTLS || f.SupportsQUIC
+}
+
+// PolicyStore stores the [PolicyFacts] of each server address.
+//
+// Implementations may persist the facts (e.g., on disk), so that a stub
+// resolver remembers them across restarts. Use [NewMemoryPolicyStore] for
+// an in-memory implementation. Implementations MUST be safe for concurrent
+// use by multiple goroutines.
+type PolicyStore interface {
+	// Load returns the facts about the address, which are the
+	// zero value when we do not know anything about it.
+	Load(addr netip.Addr) (PolicyFacts, error)
+
+	// Save saves the facts about the address.
+	Save(addr netip.Addr, facts PolicyFacts) error
+}
+
+// MemoryPolicyStore is an in-memory [PolicyStore].
+//
+// Construct using [NewMemoryPolicyStore].
+type MemoryPolicyStore struct {
+	// mu protects facts.
+	mu sync.Mutex
+
+	// facts contains the facts of each address.
+	facts map[netip.Addr]PolicyFacts
+}
+
+// NewMemoryPolicyStore creates a new [*MemoryPolicyStore].
+func NewMemoryPolicyStore() *MemoryPolicyStore {
+	return &MemoryPolicyStore{facts: make(map[netip.Addr]PolicyFacts)}
+}
+
+var _ PolicyStore = &MemoryPolicyStore{}
+
+// Load implements [PolicyStore].
+func (s *MemoryPolicyStore) Load(addr netip.Addr) (PolicyFacts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.facts[addr], nil
+}
+
+// Save implements [PolicyStore].
+func (s *MemoryPolicyStore) Save(addr netip.Addr, facts PolicyFacts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.facts[addr] = facts
+	return nil
+}
+
+// Policy is a trust-on-first-use policy refusing silent downgrades.
+//
+// Construct using [NewPolicy] and assign to [*Transport] Policy field. Share
+// the same [*Policy] across the transports of a stub resolver, so that the
+// facts learned using a protocol protect the exchanges using the others.
+//
+// After each successful exchange, we record in the [PolicyStore] whether the
+// server address supports DNS over TLS or QUIC and whether its certificate
+// was verified. Then, unless AllowDowngrade is set, we refuse with
+// [ErrPolicyDowngrade] to exchange in plaintext with an address supporting an
+// encrypted protocol, before dialing, and to accept a response over an
+// unverified certificate from an address whose certificate we verified.
+//
+// We key the facts by address rather than by endpoint, since the protocols
+// use distinct ports, and we consider DNS over TLS and QUIC equivalent, since
+// both encrypt and authenticate, so falling back from QUIC to TLS (e.g., when
+// UDP is blocked) is not a downgrade. We never refuse DNS over HTTPS, using
+// any HTTP version, Oblivious DoH, DNS over DTLS, or DNSCrypt, which are
+// encrypted as well, but we do not record facts about them, since they do not
+// imply a DoT or DoQ server. Custom [StreamOpenerDialer] types count as
+// plaintext, since we cannot know which protocol they use.
+type Policy struct {
+	// AllowDowngrade OPTIONALLY allows downgrades, while still recording
+	// the facts, e.g., when the user explicitly opts into plaintext.
+	AllowDowngrade bool
+
+	// store is the [PolicyStore].
+	store PolicyStore
+}
+
+// NewPolicy creates a new [*Policy] using the given [PolicyStore].
+func NewPolicy(store PolicyStore) *Policy {
+	return &Policy{store: store}
+}
+
+// check returns [ErrPolicyDowngrade] if exchanging with the endpoint
+// using the given protocol would be a downgrade.
+func (p *Policy) check(protocol string, endpoint netip.AddrPort) error {
+	if p.AllowDowngrade || protocol == ProtocolTLS || protocol == ProtocolQUIC ||
+		protocol == ProtocolDTLS || protocol == ProtocolDNSCrypt ||
+		protocol == ProtocolHTTPS || protocol == ProtocolHTTP1 || protocol == ProtocolHTTP3 ||
+		protocol == ProtocolODoH || protocol == ProtocolHTTPSJSON {
+		return nil
+	}
+	facts, err := p.store.Load(endpoint.Addr())
+	if err != nil {
+		return err
+	}
+	if facts.encrypted() {
+		return fmt.Errorf("%w: %s %s: server supports encryption", ErrPolicyDowngrade, protocol, endpoint)
+	}
+	return nil
+}
+
+// record records the facts learned by exchanging with the endpoint using the
+// given protocol and connection and returns [ErrPolicyDowngrade] if we accepted
+// an unverified certificate from an endpoint with a verified certificate.
+func (p *Policy) record(protocol string, endpoint netip.AddrPort, conn StreamOpener) error {
+	// 1. only the encrypted protocols teach us something
+	state, ok := streamOpenerTLSState(conn)
+	if !ok || (protocol != ProtocolTLS && protocol != ProtocolQUIC) {
+		return nil
+	}
+	verified := len(state.VerifiedChains) > 0
+
+	// 2. refuse an unverified certificate when we previously verified one
+	facts, err := p.store.Load(endpoint.Addr())
+	if err != nil {
+		return err
+	}
+	if facts.ValidCert && !verified && !p.AllowDowngrade {
+		return fmt.Errorf("%w: %s %s: server certificate previously verified", ErrPolicyDowngrade, protocol, endpoint)
+	}
+
+	// 3. save the updated facts, if needed
+	updated := facts
+	updated.SupportsTLS = facts.SupportsTLS || protocol == ProtocolTLS
+	updated.SupportsQUIC = facts.SupportsQUIC || protocol == ProtocolQUIC
+	updated.ValidCert = facts.ValidCert || verified
+	if updated == facts {
+		return nil
+	}
+	return p.store.Save(endpoint.Addr(), updated)
+}
+
+// policyCheck invokes [*Policy.check] when the [*Transport] has a [*Policy].
+func (dt *Transport) policyCheck(endpoint netip.AddrPort) error {
+	if dt.Policy == nil {
+		return nil
+	}
+	return dt.Policy.check(newPoolKey(dt.dialer, endpoint).Protocol, endpoint)
+}
+
+// policyRecord invokes [*Policy.record] when the [*Transport] has a [*Policy].
+func (dt *Transport) policyRecord(endpoint netip.AddrPort, conn StreamOpener) error {
+	if dt.Policy == nil {
+		return nil
+	}
+	return dt.Policy.record(newPoolKey(dt.dialer, endpoint).Protocol, endpoint, conn)
+}
+
+// streamOpenerTLSState returns the [tls.ConnectionState] of the TLS and
+// QUIC [StreamOpener] types once the handshake has completed.
+func streamOpenerTLSState(conn StreamOpener) (tls.ConnectionState, bool) {
+	switch conn := conn.(type) {
+	case *tlsStreamConn:
+		if tc, ok := conn.conn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			return state, state.HandshakeComplete
+		}
+	case *quicConnAdapter:
+		select {
+		case <-conn.qconn.HandshakeComplete():
+			return conn.qconn.ConnectionState().TLS, true
+		default:
+		}
+	}
+	return tls.ConnectionState{}, false
+}
@@ -0,0 +1,189 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// policyStoreStub is a [PolicyStore] failing with the configured errors.
+type policyStoreStub struct {
+	loadErr error
+	saveErr error
+	facts   PolicyFacts
+}
+
+var _ PolicyStore = &policyStoreStub{}
+
+// Load implements [PolicyStore].
+func (s *policyStoreStub) Load(addr netip.Addr) (PolicyFacts, error) {
+	return s.facts, s.loadErr
+}
+
+// Save implements [PolicyStore].
+func (s *policyStoreStub) Save(addr netip.Addr, facts PolicyFacts) error {
+	return s.saveErr
+}
+
+func TestMemoryPolicyStore(t *testing.T) {
+	store := NewMemoryPolicyStore()
+	addr := netip.MustParseAddr("8.8.8.8")
+
+	facts, err := store.Load(addr)
+	require.NoError(t, err)
+	require.Zero(t, facts)
+
+	expected := PolicyFacts{SupportsTLS: true, ValidCert: true}
+	require.NoError(t, store.Save(addr, expected))
+	facts, err = store.Load(addr)
+	require.NoError(t, err)
+	require.Equal(t, expected, facts)
+}
+
+func TestPolicyCheck(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("8.8.8.8:53")
+	encrypted := PolicyFacts{SupportsQUIC: true}
+
+	for _, tc := range []struct {
+		name           string
+		facts          PolicyFacts
+		protocol       string
+		allowDowngrade bool
+		expected       error
+	}{
+		{"unknown server", PolicyFacts{}, ProtocolTCP, false, nil},
+		{"plaintext to an encrypted server", encrypted, ProtocolTCP, false, ErrPolicyDowngrade},
+		{"custom dialer to an encrypted server", encrypted, "custom", false, ErrPolicyDowngrade},
+		{"allowed downgrade", encrypted, ProtocolTCP, true, nil},
+		{"fallback from QUIC to TLS", encrypted, ProtocolTLS, false, nil},
+		{"plaintext UDP to an encrypted server", encrypted, ProtocolUDP, false, ErrPolicyDowngrade},
+		{"DTLS to an encrypted server", encrypted, ProtocolDTLS, false, nil},
+		{"DNSCrypt to an encrypted server", encrypted, ProtocolDNSCrypt, false, nil},
+		{"ODoH to an encrypted server", encrypted, ProtocolODoH, false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy := NewPolicy(&policyStoreStub{facts: tc.facts})
+			policy.AllowDowngrade = tc.allowDowngrade
+			err := policy.check(tc.protocol, endpoint)
+			require.ErrorIs(t, err, tc.expected)
+		})
+	}
+
+	t.Run("store error", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		policy := NewPolicy(&policyStoreStub{loadErr: expected})
+		require.ErrorIs(t, policy.check(ProtocolTCP, endpoint), expected)
+	})
+}
+
+func TestTransportExchangeWithPolicy(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	handler := dnstest.NewHandler(config)
+	tlsSrv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), handler)
+	t.Cleanup(tlsSrv.Close)
+	tcpSrv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	t.Cleanup(tcpSrv.Close)
+
+	store := NewMemoryPolicyStore()
+	policy := NewPolicy(store)
+	tlsEndpoint := netip.MustParseAddrPort(tlsSrv.Address())
+	tcpEndpoint := netip.MustParseAddrPort(tcpSrv.Address())
+	exchange := func(dt *Transport) error {
+		dt.Policy = policy
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		return err
+	}
+
+	t.Run("plaintext is allowed before learning anything", func(t *testing.T) {
+		require.NoError(t, exchange(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), tcpEndpoint)))
+		facts, err := store.Load(tcpEndpoint.Addr())
+		require.NoError(t, err)
+		require.Zero(t, facts)
+	})
+
+	t.Run("we record the TLS support and the valid certificate", func(t *testing.T) {
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")})
+		require.NoError(t, exchange(NewTransport(dialer, tlsEndpoint)))
+		facts, err := store.Load(tlsEndpoint.Addr())
+		require.NoError(t, err)
+		require.Equal(t, PolicyFacts{SupportsTLS: true, ValidCert: true}, facts)
+	})
+
+	t.Run("we refuse plaintext before dialing", func(t *testing.T) {
+		dialer := &FuncStreamOpenerDialer{
+			DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+				panic("should not dial")
+			},
+		}
+		err := exchange(NewTransport(dialer, tcpEndpoint))
+		require.ErrorIs(t, err, ErrPolicyDowngrade)
+
+		dt := NewTransport(dialer, tcpEndpoint)
+		dt.Policy = policy
+		for _, err := range dt.ExchangeStream(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA)) {
+			require.ErrorIs(t, err, ErrPolicyDowngrade)
+		}
+	})
+
+	t.Run("we refuse an unverified certificate", func(t *testing.T) {
+		tlsConfig := newTestClientTLSConfig("dot")
+		tlsConfig.InsecureSkipVerify = true
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig})
+		err := exchange(NewTransport(dialer, tlsEndpoint))
+		require.ErrorIs(t, err, ErrPolicyDowngrade)
+	})
+
+	t.Run("explicitly allowed downgrades succeed", func(t *testing.T) {
+		policy.AllowDowngrade = true
+		defer func() { policy.AllowDowngrade = false }()
+		require.NoError(t, exchange(NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), tcpEndpoint)))
+	})
+}
+
+func TestTransportExchangeWithPolicyQUIC(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := newDoQTestServer(t, dnstest.NewHandler(config).PrepareResponse)
+
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pconn.Close()
+	quicDialer := NewQUICDialer(pconn, "example.com")
+	quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+	dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint())
+	store := NewMemoryPolicyStore()
+	dt.Policy = NewPolicy(store)
+
+	_, err = dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.NoError(t, err)
+	facts, err := store.Load(srv.Endpoint().Addr())
+	require.NoError(t, err)
+	require.Equal(t, PolicyFacts{SupportsQUIC: true, ValidCert: true}, facts)
+}
+
+func TestPolicyRecordStoreErrors(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+	t.Cleanup(srv.Close)
+	dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")})
+	expected := errors.New("mocked error")
+
+	for _, store := range []*policyStoreStub{{loadErr: expected}, {saveErr: expected}} {
+		dt := NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+		dt.Policy = NewPolicy(store)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	}
+}
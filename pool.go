@@ -0,0 +1,643 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PoolKey identifies a set of interchangeable idle connections in a [*Pool].
+type PoolKey struct {
+	// Protocol is the protocol name (e.g., [ProtocolUDP], [ProtocolTCP], [ProtocolTLS], [ProtocolQUIC], [ProtocolDTLS], [ProtocolDNSCrypt], [ProtocolHTTPS], [ProtocolHTTP1], [ProtocolHTTP3], [ProtocolODoH], [ProtocolHTTPSJSON], or [ProtocolUnix]).
+	Protocol string
+
+	// Endpoint is the server endpoint.
+	Endpoint netip.AddrPort
+
+	// ServerName is the TLS server name (SNI), the DNSCrypt provider name,
+	// or the Oblivious DoH target host, if any.
+	ServerName string
+
+	// Path is the Unix domain socket path or the DNS over HTTPS URL path, if any.
+	Path string
+
+	// Host is the configured DNS over HTTPS Host header, if any.
+	Host string
+
+	// Settings is an opaque summary of the other dialer settings affecting
+	// whether connections are interchangeable, such as the TLS trust settings
+	// and the [NetDialer] (e.g., a proxy), so that transports dialing with
+	// different settings never share connections.
+	Settings string
+}
+
+// PoolStats contains [*Pool] metrics.
+type PoolStats struct {
+	// Hits is the number of successful [*Pool.Get] calls.
+	Hits uint64
+
+	// Misses is the number of [*Pool.Get] calls without an idle connection.
+	Misses uint64
+
+	// Puts is the number of connections returned to the pool.
+	Puts uint64
+
+	// Evictions is the number of idle connections closed to honour
+	// MaxIdle and MaxIdlePerKey (see [EvictionCapacity]).
+	Evictions uint64
+
+	// Prewarmed is the number of connections dialed by [*Pool.Prewarm].
+	Prewarmed uint64
+
+	// Expired is the number of connections closed because they were idle
+	// for longer than IdleTimeout, the [PrewarmConfig] MaxIdleAge, or the
+	// timeout the server advertised using edns-tcp-keepalive (see [*Transport]
+	// TCPKeepalive), or because they were older than MaxLifetime.
+	Expired uint64
+
+	// Closing is the number of connections closed instead of being reused
+	// because the server signalled it is closing them (see [StreamOpenerClosing])
+	// or advertised a zero edns-tcp-keepalive timeout.
+	Closing uint64
+
+	// Idle is the number of idle connections currently in the pool.
+	Idle int
+}
+
+// DefaultPoolMaxIdle is the default maximum number of idle connections.
+const DefaultPoolMaxIdle = 128
+
+// DefaultPoolMaxIdlePerKey is the default maximum number of idle connections
+// for each [PoolKey] used by [NewPooledTransport].
+const DefaultPoolMaxIdlePerKey = 4
+
+// Pool is a pool of idle [StreamOpener] shared across endpoints.
+//
+// Construct using [NewPool] and assign to [*Transport] Pool field. Several
+// [*Transport] may share the same [*Pool] and idle connections are matched
+// using a [PoolKey]. When the number of idle connections exceeds MaxIdle, or
+// the number of idle connections for a [PoolKey] exceeds MaxIdlePerKey, the
+// least recently used connection is closed and evicted. Set IdleTimeout
+// and MaxLifetime to also evict the idle connections that are stale.
+//
+// Connections the server is closing (see [StreamOpenerClosing]) or idle for
+// longer than the edns-tcp-keepalive timeout the server advertised (see
+// [*Transport] TCPKeepalive) are neither pooled nor reused, while the
+// exchanges in progress on such connections complete normally, since
+// each borrowed connection has a single user.
+//
+// A [*Pool] is safe for concurrent use by multiple goroutines.
+type Pool struct {
+	// CloseTimeout is the OPTIONAL timeout for closing connections. We close
+	// evicted and expired connections in the background, and we wait at most
+	// this timeout for each connection in [*Pool.Close]. If zero or negative,
+	// we use [DefaultCloseTimeout].
+	CloseTimeout time.Duration
+
+	// MaxIdlePerKey is the OPTIONAL maximum number of idle connections for
+	// each [PoolKey], which bounds the connections kept for each endpoint.
+	// If zero or negative, only the maxIdle argument of [NewPool] applies.
+	MaxIdlePerKey int
+
+	// IdleTimeout is the OPTIONAL maximum time a connection may sit idle in
+	// the pool, which should be lower than the server idle timeout, so that we
+	// do not reuse connections the server is about to close. If zero or
+	// negative, idle connections do not expire.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the OPTIONAL maximum time since dialing after which we
+	// stop reusing a connection, which periodically spreads the connections
+	// across the servers behind a load balancer. If zero or negative,
+	// connections may be reused forever. Note that we do not interrupt
+	// the exchanges in progress, so we evict connections when they are idle.
+	MaxLifetime time.Duration
+
+	// ObserveEviction is an optional hook called with the [PoolKey] and the
+	// [EvictionReason] of each connection we close instead of keeping it idle
+	// or reusing it. We call it without holding the pool mutex, possibly
+	// from several goroutines at the same time.
+	ObserveEviction func(key PoolKey, reason EvictionReason)
+
+	// TimeNow is the OPTIONAL function returning the current time, which we
+	// use to expire idle connections (see IdleTimeout, MaxLifetime, and the
+	// [PrewarmConfig] MaxIdleAge). If nil, we use [time.Now].
+	TimeNow func() time.Time
+
+	// maxIdle is the maximum number of idle connections.
+	maxIdle int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// lru contains *poolEntry with the most recently used at the front.
+	lru *list.List
+
+	// idle maps a key to the list elements containing its idle connections.
+	idle map[PoolKey][]*list.Element
+
+	// busy contains the [*connStats] of the connections a [*Transport]
+	// borrowed from the pool or dialed and is currently using.
+	busy map[*connStats]struct{}
+
+	// stats contains the pool metrics.
+	stats PoolStats
+
+	// closed indicates that the pool has been closed.
+	closed bool
+}
+
+// poolEntry is an entry inside the [*Pool] LRU.
+type poolEntry struct {
+	key   PoolKey
+	conn  StreamOpener
+	since time.Time
+	stats *connStats
+}
+
+// NewPool creates a new [*Pool] holding at most maxIdle idle connections.
+//
+// A zero or negative maxIdle value means [DefaultPoolMaxIdle].
+func NewPool(maxIdle int) *Pool {
+	if maxIdle <= 0 {
+		maxIdle = DefaultPoolMaxIdle
+	}
+	return &Pool{
+		maxIdle: maxIdle,
+		lru:     list.New(),
+		idle:    make(map[PoolKey][]*list.Element),
+		busy:    make(map[*connStats]struct{}),
+	}
+}
+
+// now returns the current time using TimeNow or [time.Now].
+func (p *Pool) now() time.Time {
+	if p.TimeNow != nil {
+		return p.TimeNow()
+	}
+	return time.Now()
+}
+
+// NewPooledTransport is like [NewTransport] but returns a [*Transport] using
+// a dedicated [*Pool], so that high-volume users do not pay a handshake per
+// query, keeping at most maxIdle idle connections for each endpoint.
+//
+// A zero or negative maxIdle value means [DefaultPoolMaxIdlePerKey]. The
+// caller should close the [*Transport] Pool when done using the [*Transport].
+func NewPooledTransport(dialer StreamOpenerDialer, endpoint netip.AddrPort, maxIdle int) *Transport {
+	if maxIdle <= 0 {
+		maxIdle = DefaultPoolMaxIdlePerKey
+	}
+	dt := NewTransport(dialer, endpoint)
+	dt.Pool = NewPool(0)
+	dt.Pool.MaxIdlePerKey = maxIdle
+	return dt
+}
+
+// Get returns the most recently used idle connection for the given key.
+//
+// This method skips and closes in the background the idle connections
+// the server is closing (see [StreamOpenerClosing]) and the expired ones
+// (see IdleTimeout, MaxLifetime, and [*Transport] TCPKeepalive).
+//
+// The caller owns the returned connection and should either [*Pool.Put]
+// it back or close it when done.
+func (p *Pool) Get(key PoolKey) (StreamOpener, bool) {
+	conn, _, found := p.get(key)
+	return conn, found
+}
+
+// get is like [*Pool.Get] but also returns the connection [*connStats].
+//
+// We check whether the server is closing the connection without holding
+// the mutex, since the check may block for a short time (see [tlsPeerClosing]).
+func (p *Pool) get(key PoolKey) (StreamOpener, *connStats, bool) {
+	for {
+		entry, found := p.pop(key)
+		if !found {
+			return nil, nil, false
+		}
+		closing := StreamOpenerClosing(entry.conn)
+		p.mu.Lock()
+		if !closing {
+			p.stats.Hits++
+			p.mu.Unlock()
+			return entry.conn, entry.stats, true
+		}
+		p.stats.Closing++
+		p.mu.Unlock()
+		p.evict([]poolEviction{{key: key, conn: entry.conn, reason: EvictionClosing}})
+	}
+}
+
+// pop removes and returns the most recently used idle entry for the given
+// key, if any, and closes the expired idle connections.
+func (p *Pool) pop(key PoolKey) (*poolEntry, bool) {
+	p.mu.Lock()
+	evicted := p.sweepLocked(p.now())
+	defer func() {
+		p.mu.Unlock()
+		p.evict(evicted)
+	}()
+	elems := p.idle[key]
+	if len(elems) <= 0 {
+		p.stats.Misses++
+		return nil, false
+	}
+	elem := elems[len(elems)-1]
+	p.removeLocked(elem)
+	return elem.Value.(*poolEntry), true
+}
+
+// Put returns an idle connection to the pool.
+//
+// If the pool is full, this method closes the least recently used idle
+// connection. If the pool is closed, the server is closing conn (see
+// [StreamOpenerClosing]), or conn is older than MaxLifetime, this method
+// closes conn. In all cases, we close in the background to avoid blocking
+// the caller. This method also closes the expired idle connections.
+//
+// Since the pool does not know when we dialed conn, the [ConnState] Age
+// of conn counts the time elapsed since we first pooled it.
+func (p *Pool) Put(key PoolKey, conn StreamOpener) {
+	p.put(key, conn, newConnStats(key, p.now()))
+}
+
+// put is like [*Pool.Put] but uses the given [*connStats].
+func (p *Pool) put(key PoolKey, conn StreamOpener, stats *connStats) {
+	closing := StreamOpenerClosing(conn)
+	if timeout, found := stats.keepalive(); found && timeout <= 0 {
+		closing = true // the server asked us to close the connection
+	}
+	now := p.now()
+	p.mu.Lock()
+	evicted := p.sweepLocked(now)
+	defer func() {
+		p.mu.Unlock()
+		p.evict(evicted)
+	}()
+
+	// 1. close the connections we cannot reuse
+	refuse := func(reason EvictionReason) {
+		evicted = append(evicted, poolEviction{key: key, conn: conn, reason: reason})
+	}
+	switch {
+	case p.closed:
+		refuse(EvictionPoolClosed)
+		return
+	case closing:
+		p.stats.Closing++
+		refuse(EvictionClosing)
+		return
+	case p.MaxLifetime > 0 && now.Sub(stats.created) >= p.MaxLifetime:
+		p.stats.Expired++
+		refuse(EvictionMaxLifetime)
+		return
+	}
+
+	// 2. pool the connection and honour MaxIdlePerKey and MaxIdle
+	elem := p.lru.PushFront(&poolEntry{key: key, conn: conn, since: now, stats: stats})
+	p.idle[key] = append(p.idle[key], elem)
+	p.stats.Puts++
+	for p.MaxIdlePerKey > 0 && len(p.idle[key]) > p.MaxIdlePerKey {
+		oldest := p.idle[key][0]
+		p.removeLocked(oldest)
+		p.stats.Evictions++
+		evicted = append(evicted, poolEviction{key: key, conn: oldest.Value.(*poolEntry).conn, reason: EvictionCapacity})
+	}
+	for p.lru.Len() > p.maxIdle {
+		back := p.lru.Back()
+		p.removeLocked(back)
+		p.stats.Evictions++
+		entry := back.Value.(*poolEntry)
+		evicted = append(evicted, poolEviction{key: entry.key, conn: entry.conn, reason: EvictionCapacity})
+	}
+}
+
+// removeLocked removes the given element from the pool.
+//
+// The caller MUST hold the mutex.
+func (p *Pool) removeLocked(elem *list.Element) {
+	entry := elem.Value.(*poolEntry)
+	elems := p.idle[entry.key]
+	for idx, candidate := range elems {
+		if candidate == elem {
+			elems = append(elems[:idx], elems[idx+1:]...)
+			break
+		}
+	}
+	if len(elems) <= 0 {
+		delete(p.idle, entry.key)
+	} else {
+		p.idle[entry.key] = elems
+	}
+	p.lru.Remove(elem)
+}
+
+// track records that a [*Transport] is using the connection with the given stats.
+func (p *Pool) track(stats *connStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy[stats] = struct{}{}
+}
+
+// untrack records that a [*Transport] is not using the connection with the given stats.
+func (p *Pool) untrack(stats *connStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.busy, stats)
+}
+
+// connState returns the [ConnState] at now of the idle and busy connections
+// for the given key, sorted from the oldest.
+func (p *Pool) connState(key PoolKey, now time.Time) []ConnState {
+	p.mu.Lock()
+	var states []ConnState
+	for _, elem := range p.idle[key] {
+		states = append(states, elem.Value.(*poolEntry).stats.snapshot(now))
+	}
+	for stats := range p.busy {
+		if stats.key == key {
+			states = append(states, stats.snapshot(now))
+		}
+	}
+	p.mu.Unlock()
+	slices.SortFunc(states, func(a, b ConnState) int {
+		return cmp.Compare(b.Age, a.Age)
+	})
+	return states
+}
+
+// Stats returns a snapshot of the pool metrics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Idle = p.lru.Len()
+	return stats
+}
+
+// Close closes all the idle connections and prevents pooling new ones.
+//
+// This method closes the connections in parallel waiting at most CloseTimeout
+// for each of them and returns the joined errors, if any.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	var (
+		conns []StreamOpener
+		keys  []PoolKey
+	)
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*poolEntry)
+		conns = append(conns, entry.conn)
+		keys = append(keys, entry.key)
+	}
+	p.lru.Init()
+	p.idle = make(map[PoolKey][]*list.Element)
+	p.mu.Unlock()
+	err := closeAllWithTimeout(conns, p.CloseTimeout)
+	if p.ObserveEviction != nil {
+		for _, key := range keys {
+			p.ObserveEviction(key, EvictionPoolClosed)
+		}
+	}
+	return err
+}
+
+// Default values used by [*Pool.Prewarm].
+const (
+	// DefaultPrewarmInterval is the default [PrewarmConfig] Interval.
+	DefaultPrewarmInterval = 10 * time.Second
+
+	// DefaultPrewarmMaxIdleAge is the default [PrewarmConfig] MaxIdleAge.
+	DefaultPrewarmMaxIdleAge = 30 * time.Second
+)
+
+// PrewarmConfig configures [*Pool.Prewarm].
+type PrewarmConfig struct {
+	// Transports contains the MANDATORY transports to keep warm.
+	//
+	// Each [*Transport] should use the [*Pool] being prewarmed as its
+	// Pool field for the warm connections to be actually used.
+	Transports []*Transport
+
+	// Warm is the OPTIONAL number of idle connections to keep for
+	// each transport. If zero or negative, we use one connection.
+	Warm int
+
+	// Interval is the OPTIONAL interval between refreshes. If zero or
+	// negative, we use [DefaultPrewarmInterval].
+	Interval time.Duration
+
+	// MaxIdleAge is the OPTIONAL maximum time a connection may sit idle
+	// before we close and replace it. Set it lower than the server idle
+	// timeout so that we refresh connections before the server closes
+	// them. If zero or negative, we use [DefaultPrewarmMaxIdleAge].
+	MaxIdleAge time.Duration
+}
+
+// Prewarm keeps the configured number of warm connections for each
+// transport until the context is done.
+//
+// At each interval, Prewarm closes idle connections older than MaxIdleAge
+// and dials new connections until each transport has Warm idle connections.
+//
+// This method blocks until ctx is done, so you typically want to run it in
+// a background goroutine. Dial errors are ignored and retried at the next
+// interval. Dials are bounded by the interval duration.
+func (p *Pool) Prewarm(ctx context.Context, config *PrewarmConfig) {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultPrewarmInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.prewarmOnce(ctx, config, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prewarmOnce runs a single [*Pool.Prewarm] iteration.
+func (p *Pool) prewarmOnce(ctx context.Context, config *PrewarmConfig, timeout time.Duration) {
+	warm := max(config.Warm, 1)
+	maxIdleAge := config.MaxIdleAge
+	if maxIdleAge <= 0 {
+		maxIdleAge = DefaultPrewarmMaxIdleAge
+	}
+	for _, dt := range config.Transports {
+		key := newPoolKey(dt.dialer, dt.endpoint)
+		p.expire(key, p.now().Add(-maxIdleAge))
+		for count := p.count(key); count < warm && ctx.Err() == nil; count++ {
+			dialCtx, cancel := context.WithTimeout(ctx, timeout)
+			conn, err := dt.Dial(dialCtx)
+			cancel()
+			if err != nil {
+				break // retry at the next interval
+			}
+			p.mu.Lock()
+			p.stats.Prewarmed++
+			p.mu.Unlock()
+			p.put(key, conn, newConnStats(key, p.now()))
+		}
+	}
+}
+
+// count returns the number of idle connections for the given key.
+func (p *Pool) count(key PoolKey) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle[key])
+}
+
+// expire closes the idle connections for key that became idle before t.
+func (p *Pool) expire(key PoolKey, t time.Time) {
+	p.mu.Lock()
+	var evicted []poolEviction
+	for _, elem := range append([]*list.Element{}, p.idle[key]...) {
+		entry := elem.Value.(*poolEntry)
+		if entry.since.Before(t) {
+			p.removeLocked(elem)
+			p.stats.Expired++
+			evicted = append(evicted, poolEviction{key: key, conn: entry.conn, reason: EvictionIdleTimeout})
+		}
+	}
+	p.mu.Unlock()
+	p.evict(evicted)
+}
+
+// newPoolKey returns the [PoolKey] for the given dialer and endpoint.
+func newPoolKey(dialer StreamOpenerDialer, endpoint netip.AddrPort) PoolKey {
+	key := PoolKey{Endpoint: endpoint}
+	key.ServerName, _ = dialerServerName(dialer)
+	switch dialer := dialer.(type) {
+	case *StreamOpenerDialerUDP:
+		key.Protocol = ProtocolUDP
+		key.Settings = netDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerTCP:
+		key.Protocol = ProtocolTCP
+		key.Settings = netDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerUnix:
+		key.Protocol = ProtocolUnix
+		key.Path = dialer.Path
+		key.Settings = netDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerDTLS:
+		key.Protocol = ProtocolDTLS
+		key.Settings = identitySettings(dialer.Dialer)
+
+	case *StreamOpenerDialerDNSCrypt:
+		key.Protocol = ProtocolDNSCrypt
+		key.Settings = fmt.Sprintf("%s key=%x", netDialerSettings(dialer.Dialer), dialer.ProviderKey)
+
+	case *StreamOpenerDialerTLS:
+		key.Protocol = ProtocolTLS
+		key.Settings = tlsDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerHTTPS:
+		key.Protocol = ProtocolHTTPS
+		if dialer.HTTP1 {
+			key.Protocol = ProtocolHTTP1
+		}
+		key.Host, key.Path = dialer.Host, dialer.Path
+		key.Settings = tlsDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerODoH:
+		key.Protocol = ProtocolODoH
+		key.Host, key.Path = dialer.Proxy.Host, dialer.Proxy.Path
+		key.Settings = fmt.Sprintf("%s http1=%t target=%s key=%x", tlsDialerSettings(dialer.Proxy.Dialer),
+			dialer.Proxy.HTTP1, dialer.TargetPath, dialer.Config.PublicKey)
+
+	case *StreamOpenerDialerHTTPSJSON:
+		key.Protocol = ProtocolHTTPSJSON
+		key.Host, key.Path = dialer.Dialer.Host, dialer.Dialer.Path
+		key.Settings = fmt.Sprintf("%s http1=%t", tlsDialerSettings(dialer.Dialer.Dialer), dialer.Dialer.HTTP1)
+
+	case *StreamOpenerDialerQUIC:
+		key.Protocol = ProtocolQUIC
+		key.Settings = quicDialerSettings(dialer.Dialer)
+
+	case *StreamOpenerDialerHTTP3:
+		key.Protocol = ProtocolHTTP3
+		key.Host, key.Path = dialer.Host, dialer.Path
+		key.Settings = quicDialerSettings(dialer.Dialer)
+
+	default:
+		// Use the dialer identity for custom dialers since we cannot
+		// know whether two distinct instances are interchangeable.
+		key.Protocol = fmt.Sprintf("%T@%p", dialer, dialer)
+	}
+	return key
+}
+
+// identitySettings returns the [PoolKey] Settings of a dialer we cannot
+// inspect, which is its identity, since we cannot know whether two distinct
+// instances are interchangeable.
+func identitySettings(dialer any) string {
+	return fmt.Sprintf("%T@%p", dialer, dialer)
+}
+
+// netDialerSettings returns the [PoolKey] Settings of a [NetDialer].
+//
+// A [*net.Dialer] without LocalAddr and control functions dials like any
+// other, while we use the identity of the other dialers, which may bind to
+// an interface or tunnel the connections (e.g., [*SOCKS5Dialer]).
+func netDialerSettings(dialer NetDialer) string {
+	if nd, ok := dialer.(*net.Dialer); ok && (nd == nil ||
+		nd.LocalAddr == nil && nd.Control == nil && nd.ControlContext == nil) {
+		return "net"
+	}
+	return identitySettings(dialer)
+}
+
+// tlsDialerSettings returns the [PoolKey] Settings of a [TLSDialer].
+func tlsDialerSettings(dialer TLSDialer) string {
+	switch dialer := dialer.(type) {
+	case *tls.Dialer:
+		var netDialer NetDialer = dialer.NetDialer
+		return netDialerSettings(netDialer) + " " + tlsConfigSettings(dialer.Config)
+	case *NetTLSDialer:
+		return netDialerSettings(dialer.NetDialer) + " " + tlsConfigSettings(dialer.Config)
+	default:
+		return identitySettings(dialer)
+	}
+}
+
+// quicDialerSettings returns the [PoolKey] Settings of a [*QUICDialer],
+// including its [*quic.Transport], which owns the UDP socket.
+func quicDialerSettings(dialer *QUICDialer) string {
+	return fmt.Sprintf("transport=%p %s", dialer.Transport, tlsConfigSettings(dialer.TLSConfig))
+}
+
+// tlsConfigSettings returns the [PoolKey] Settings of a [*tls.Config], which
+// contain the settings determining which servers we trust, so that transports
+// verifying the server differently never share connections.
+//
+// Since we cannot compare functions, we use the config identity when it
+// customizes the verification or uses client certificates.
+func tlsConfigSettings(config *tls.Config) string {
+	switch {
+	case config == nil:
+		return "tls"
+	case config.VerifyPeerCertificate != nil || config.VerifyConnection != nil ||
+		len(config.Certificates) > 0 || config.GetClientCertificate != nil:
+		return identitySettings(config)
+	default:
+		return fmt.Sprintf("tls insecure=%t roots=%p", config.InsecureSkipVerify, config.RootCAs)
+	}
+}
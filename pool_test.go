@@ -0,0 +1,517 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// closeCountingOpener is a [StreamOpener] counting Close calls.
+type closeCountingOpener struct {
+	FuncStreamOpener
+	closed atomic.Int64
+}
+
+// Close implements [StreamOpener].
+func (c *closeCountingOpener) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+// requireEventuallyClosed waits for the connection to be closed once,
+// which is needed since we close connections in the background.
+func requireEventuallyClosed(t *testing.T, conn *closeCountingOpener) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return conn.closed.Load() == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestPoolGetPut(t *testing.T) {
+	pool := NewPool(4)
+	key := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+
+	_, found := pool.Get(key)
+	require.False(t, found)
+
+	conn := &closeCountingOpener{}
+	pool.Put(key, conn)
+
+	got, found := pool.Get(key)
+	require.True(t, found)
+	require.Same(t, conn, got)
+
+	_, found = pool.Get(key)
+	require.False(t, found)
+
+	require.Equal(t, PoolStats{Hits: 1, Misses: 2, Puts: 1}, pool.Stats())
+}
+
+func TestPoolKeysAreDistinct(t *testing.T) {
+	pool := NewPool(4)
+	endpoint := netip.MustParseAddrPort("127.0.0.1:853")
+	key1 := PoolKey{Protocol: "tls", Endpoint: endpoint, ServerName: "a.example.com"}
+	key2 := PoolKey{Protocol: "tls", Endpoint: endpoint, ServerName: "b.example.com"}
+
+	pool.Put(key1, &closeCountingOpener{})
+
+	_, found := pool.Get(key2)
+	require.False(t, found)
+	_, found = pool.Get(key1)
+	require.True(t, found)
+}
+
+func TestPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	pool := NewPool(2)
+	key1 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+	key2 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.2:53")}
+	key3 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.3:53")}
+	conn1, conn2, conn3 := &closeCountingOpener{}, &closeCountingOpener{}, &closeCountingOpener{}
+
+	pool.Put(key1, conn1)
+	pool.Put(key2, conn2)
+	pool.Put(key3, conn3)
+
+	requireEventuallyClosed(t, conn1)
+	require.Zero(t, conn2.closed.Load())
+	require.Zero(t, conn3.closed.Load())
+
+	_, found := pool.Get(key1)
+	require.False(t, found)
+
+	stats := pool.Stats()
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, 2, stats.Idle)
+}
+
+func TestPoolEvictsLeastRecentlyUsedPerKey(t *testing.T) {
+	pool := NewPool(0)
+	pool.MaxIdlePerKey = 2
+	key1 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+	key2 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.2:53")}
+	conn1, conn2, conn3, conn4 := &closeCountingOpener{}, &closeCountingOpener{}, &closeCountingOpener{}, &closeCountingOpener{}
+
+	pool.Put(key1, conn1)
+	pool.Put(key2, conn2)
+	pool.Put(key1, conn3)
+	pool.Put(key1, conn4)
+
+	requireEventuallyClosed(t, conn1)
+	require.Zero(t, conn2.closed.Load())
+	require.Zero(t, conn3.closed.Load())
+	require.Zero(t, conn4.closed.Load())
+
+	got, found := pool.Get(key1)
+	require.True(t, found)
+	require.Same(t, conn4, got)
+
+	stats := pool.Stats()
+	require.Equal(t, uint64(1), stats.Evictions)
+	require.Equal(t, 2, stats.Idle)
+}
+
+// blockingClosingOpener is a [StreamOpener] whose Closing, once block is
+// set, signals checking and waits for release before returning false.
+type blockingClosingOpener struct {
+	closeCountingOpener
+	block    atomic.Bool
+	checking chan struct{}
+	release  chan struct{}
+}
+
+// Closing implements closingNotifier.
+func (c *blockingClosingOpener) Closing() bool {
+	if c.block.Load() {
+		close(c.checking)
+		<-c.release
+	}
+	return false
+}
+
+func TestPoolGetChecksClosingWithoutTheLock(t *testing.T) {
+	pool := NewPool(0)
+	key1 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+	key2 := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.2:53")}
+	conn := &blockingClosingOpener{checking: make(chan struct{}), release: make(chan struct{})}
+	pool.Put(key1, conn)
+	conn.block.Store(true)
+
+	got := make(chan StreamOpener, 1)
+	go func() {
+		conn, _ := pool.Get(key1)
+		got <- conn
+	}()
+	<-conn.checking
+
+	// the pool remains usable while Get checks the connection
+	pool.Put(key2, &closeCountingOpener{})
+	require.Equal(t, 1, pool.Stats().Idle)
+
+	close(conn.release)
+	require.Same(t, conn, <-got)
+	require.Equal(t, uint64(1), pool.Stats().Hits)
+}
+
+func TestPoolClose(t *testing.T) {
+	pool := NewPool(0)
+	key := PoolKey{Protocol: "tcp", Endpoint: netip.MustParseAddrPort("127.0.0.1:53")}
+	conn1, conn2 := &closeCountingOpener{}, &closeCountingOpener{}
+
+	pool.Put(key, conn1)
+	require.NoError(t, pool.Close())
+	requireEventuallyClosed(t, conn1)
+
+	pool.Put(key, conn2)
+	requireEventuallyClosed(t, conn2)
+	require.Equal(t, 0, pool.Stats().Idle)
+}
+
+func TestNewPoolKey(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("127.0.0.1:853")
+
+	t.Run("udp", func(t *testing.T) {
+		key := newPoolKey(NewStreamOpenerDialerUDP(&net.Dialer{}), endpoint)
+		require.Equal(t, PoolKey{Protocol: "udp", Endpoint: endpoint, Settings: "net"}, key)
+	})
+
+	t.Run("dtls", func(t *testing.T) {
+		dialer := &net.Dialer{}
+		key := newPoolKey(NewStreamOpenerDialerDTLS(dialer), endpoint)
+		require.Equal(t, PoolKey{Protocol: "dtls", Endpoint: endpoint, Settings: identitySettings(dialer)}, key)
+	})
+
+	t.Run("dnscrypt", func(t *testing.T) {
+		key := newPoolKey(NewStreamOpenerDialerDNSCrypt(&net.Dialer{}, "2.dnscrypt-cert.example.com", []byte{0xab}), endpoint)
+		require.Equal(t, PoolKey{Protocol: "dnscrypt", Endpoint: endpoint,
+			ServerName: "2.dnscrypt-cert.example.com", Settings: "net key=ab"}, key)
+	})
+
+	t.Run("odoh", func(t *testing.T) {
+		proxy := NewStreamOpenerDialerHTTPS(NewTLSDialerDNSOverTLS("proxy.example.com"))
+		dialer := NewStreamOpenerDialerODoH(proxy, "target.example.com", ODoHConfig{PublicKey: []byte{0xab}})
+		key := newPoolKey(dialer, endpoint)
+		require.Equal(t, PoolKey{Protocol: "odoh", Endpoint: endpoint, ServerName: "target.example.com",
+			Settings: "net tls insecure=false roots=0x0 http1=false target=" + dialer.TargetPath + " key=ab"}, key)
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		key := newPoolKey(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		require.Equal(t, PoolKey{Protocol: "tcp", Endpoint: endpoint, Settings: "net"}, key)
+	})
+
+	t.Run("unix", func(t *testing.T) {
+		key := newPoolKey(NewStreamOpenerDialerUnix(&net.Dialer{}, "/run/dns.sock"), netip.AddrPort{})
+		require.Equal(t, PoolKey{Protocol: "unix", Path: "/run/dns.sock", Settings: "net"}, key)
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		key := newPoolKey(NewStreamOpenerDialerTLS(NewTLSDialerDNSOverTLS("dns.google")), endpoint)
+		require.Equal(t, PoolKey{Protocol: "tls", Endpoint: endpoint,
+			ServerName: "dns.google", Settings: "net tls insecure=false roots=0x0"}, key)
+	})
+
+	t.Run("tls with custom dialer", func(t *testing.T) {
+		dialer := &net.Dialer{}
+		key := newPoolKey(NewStreamOpenerDialerTLS(dialer), endpoint)
+		require.Equal(t, PoolKey{Protocol: "tls", Endpoint: endpoint, Settings: identitySettings(dialer)}, key)
+	})
+
+	t.Run("quic", func(t *testing.T) {
+		dialer := &QUICDialer{TLSConfig: &tls.Config{ServerName: "dns.adguard.com"}}
+		key := newPoolKey(NewStreamOpenerDialerQUIC(dialer), endpoint)
+		require.Equal(t, PoolKey{Protocol: "quic", Endpoint: endpoint,
+			ServerName: "dns.adguard.com", Settings: "transport=0x0 tls insecure=false roots=0x0"}, key)
+	})
+
+	t.Run("distinguishes the settings affecting the connections", func(t *testing.T) {
+		newTLSKey := func(mutate func(dialer *tls.Dialer)) PoolKey {
+			dialer := NewTLSDialerDNSOverTLS("dns.google")
+			mutate(dialer)
+			return newPoolKey(NewStreamOpenerDialerTLS(dialer), endpoint)
+		}
+		base := newTLSKey(func(dialer *tls.Dialer) {})
+		require.Equal(t, base, newTLSKey(func(dialer *tls.Dialer) {}))
+		for name, mutate := range map[string]func(dialer *tls.Dialer){
+			"insecure": func(dialer *tls.Dialer) { dialer.Config.InsecureSkipVerify = true },
+			"roots":    func(dialer *tls.Dialer) { dialer.Config.RootCAs = x509.NewCertPool() },
+			"verify": func(dialer *tls.Dialer) {
+				dialer.Config.VerifyConnection = func(tls.ConnectionState) error { return nil }
+			},
+			"net dialer": func(dialer *tls.Dialer) {
+				dialer.NetDialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}
+			},
+		} {
+			require.NotEqual(t, base, newTLSKey(mutate), name)
+		}
+
+		newHTTPSKey := func(path string) PoolKey {
+			dialer := NewStreamOpenerDialerHTTPS(NewTLSDialerDNSOverTLS("dns.google"))
+			dialer.Path = path
+			return newPoolKey(dialer, endpoint)
+		}
+		require.NotEqual(t, newHTTPSKey("/dns-query"), newHTTPSKey("/resolve"))
+
+		proxy := NewStreamOpenerDialerTCP(&SOCKS5Dialer{})
+		require.NotEqual(t, newPoolKey(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint), newPoolKey(proxy, endpoint))
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		dialer1, dialer2 := &FuncStreamOpenerDialer{}, &FuncStreamOpenerDialer{}
+		require.NotEqual(t, newPoolKey(dialer1, endpoint), newPoolKey(dialer2, endpoint))
+		require.Equal(t, newPoolKey(dialer1, endpoint), newPoolKey(dialer1, endpoint))
+	})
+}
+
+// newEchoStreamOpener returns a [*closeCountingOpener] answering any query.
+func newEchoStreamOpener(t *testing.T) *closeCountingOpener {
+	return &closeCountingOpener{
+		FuncStreamOpener: FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				stub := &FuncStream{}
+				var respReader *bytes.Reader
+				stub.WriteFunc = func(p []byte) (int, error) {
+					rawResp := buildRawResponseFromQuery(t, p[2:])
+					frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+					respReader = bytes.NewReader(frame)
+					return len(p), nil
+				}
+				stub.ReadFunc = func(p []byte) (int, error) {
+					return respReader.Read(p)
+				}
+				return stub, nil
+			},
+		},
+	}
+}
+
+func TestTransportExchangeWithPool(t *testing.T) {
+	var dials int
+	conn := newEchoStreamOpener(t)
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			dials++
+			return conn, nil
+		},
+	}
+
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.Pool = NewPool(1)
+
+	for range 3 {
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 1, dials)
+	require.Zero(t, conn.closed.Load())
+	require.Equal(t, PoolStats{Hits: 2, Misses: 1, Puts: 3, Idle: 1}, dt.Pool.Stats())
+}
+
+func TestNewPooledTransport(t *testing.T) {
+	var dials atomic.Int64
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			dials.Add(1)
+			return NewHandlerStreamOpener(newBenchHandler()), nil
+		},
+	}
+	dt := NewPooledTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"), 0)
+	defer dt.Pool.Close()
+	require.Equal(t, DefaultPoolMaxIdlePerKey, dt.Pool.MaxIdlePerKey)
+
+	// sequential exchanges reuse the same connection
+	for range 3 {
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), dials.Load())
+
+	// concurrent exchanges keep at most MaxIdlePerKey connections
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Go(func() {
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		})
+	}
+	wg.Wait()
+	require.LessOrEqual(t, dt.Pool.Stats().Idle, DefaultPoolMaxIdlePerKey)
+}
+
+func TestTransportExchangeWithPoolClosesOnError(t *testing.T) {
+	expected := errors.New("open stream failed")
+	conn := &closeCountingOpener{
+		FuncStreamOpener: FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				return nil, expected
+			},
+		},
+	}
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return conn, nil
+		},
+	}
+
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.Pool = NewPool(1)
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, expected)
+	requireEventuallyClosed(t, conn)
+	require.Equal(t, 0, dt.Pool.Stats().Idle)
+}
+
+func TestTransportExchangeWithPoolClosesOnTrailingData(t *testing.T) {
+	conn := newTrailingDataStreamOpener(t, []byte{0x00})
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return conn, nil
+		},
+	}
+
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.Pool = NewPool(1)
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, ErrTrailingData)
+	requireEventuallyClosed(t, conn)
+	require.Equal(t, 0, dt.Pool.Stats().Idle)
+}
+
+func TestTransportExchangeWithPoolDialError(t *testing.T) {
+	expected := errors.New("dial failed")
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return nil, expected
+		},
+	}
+
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.Pool = NewPool(1)
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, expected)
+}
+
+func TestPoolPrewarm(t *testing.T) {
+	var conns []*closeCountingOpener
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			conn := &closeCountingOpener{}
+			conns = append(conns, conn)
+			return conn, nil
+		},
+	}
+	pool := NewPool(0)
+	advance := newFakeClock(pool)
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.Pool = pool
+	config := &PrewarmConfig{
+		Transports: []*Transport{dt},
+		Warm:       2,
+		MaxIdleAge: time.Hour,
+	}
+
+	t.Run("dials the missing connections", func(t *testing.T) {
+		pool.prewarmOnce(context.Background(), config, time.Second)
+		require.Len(t, conns, 2)
+		require.Equal(t, 2, pool.Stats().Idle)
+		require.Equal(t, uint64(2), pool.Stats().Prewarmed)
+	})
+
+	t.Run("does not dial when already warm", func(t *testing.T) {
+		pool.prewarmOnce(context.Background(), config, time.Second)
+		require.Len(t, conns, 2)
+	})
+
+	t.Run("replaces expired connections", func(t *testing.T) {
+		advance(time.Hour + time.Nanosecond)
+		pool.prewarmOnce(context.Background(), config, time.Second)
+		require.Len(t, conns, 4)
+		requireEventuallyClosed(t, conns[0])
+		requireEventuallyClosed(t, conns[1])
+		stats := pool.Stats()
+		require.Equal(t, uint64(2), stats.Expired)
+		require.Equal(t, 2, stats.Idle)
+	})
+}
+
+func TestPoolPrewarmDialError(t *testing.T) {
+	var dials int
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			dials++
+			return nil, errors.New("dial failed")
+		},
+	}
+	pool := NewPool(0)
+	config := &PrewarmConfig{
+		Transports: []*Transport{NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))},
+		Warm:       3,
+	}
+
+	pool.prewarmOnce(context.Background(), config, time.Second)
+	require.Equal(t, 1, dials)
+	require.Equal(t, 0, pool.Stats().Idle)
+}
+
+func TestPoolPrewarmStopsWhenContextDone(t *testing.T) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return &closeCountingOpener{}, nil
+		},
+	}
+	pool := NewPool(0)
+	config := &PrewarmConfig{
+		Transports: []*Transport{NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))},
+		Interval:   time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	pool.Prewarm(ctx, config)
+	require.Equal(t, 1, pool.Stats().Idle)
+}
+
+func TestPoolDoesNotShareConnectionsAcrossTLSConfigs(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+	t.Cleanup(srv.Close)
+	endpoint := netip.MustParseAddrPort(srv.Address())
+	pool := NewPool(0)
+	defer pool.Close()
+
+	// the opportunistic transport does not verify the server
+	opportunistic := NewTransport(NewStreamOpenerDialerTLS(
+		NewTLSDialerDNSOverTLSOpportunistic("example.com", func(TLSPeerVerification) {})), endpoint)
+	opportunistic.Pool = pool
+	strict := NewTransport(NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")}), endpoint)
+	strict.Pool = pool
+
+	query := dnscodec.NewQuery("dns.google", dns.TypeA)
+	for _, dt := range []*Transport{opportunistic, strict, strict} {
+		_, err := dt.Exchange(context.Background(), query)
+		require.NoError(t, err)
+	}
+	stats := pool.Stats()
+	require.Equal(t, uint64(2), stats.Misses)
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, 2, stats.Idle)
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import "github.com/bassosimone/dnscodec"
+
+// Query flags applied by the MutateQuery method of each protocol.
+const (
+	// QueryFlagsUDP contains the [dnscodec] query flags used by DNS over UDP.
+	QueryFlagsUDP uint16 = 0
+
+	// QueryFlagsTCP contains the [dnscodec] query flags used by DNS over TCP.
+	QueryFlagsTCP uint16 = 0
+
+	// QueryFlagsTLS contains the [dnscodec] query flags used by DNS over TLS,
+	// which pads queries (RFC 8467) and requests DNSSEC records.
+	QueryFlagsTLS uint16 = dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec
+
+	// QueryFlagsQUIC contains the [dnscodec] query flags used by DNS over QUIC,
+	// which are the same used by DNS over TLS.
+	QueryFlagsQUIC uint16 = QueryFlagsTLS
+
+	// QueryFlagsDTLS contains the [dnscodec] query flags used by DNS over DTLS,
+	// which are the same used by DNS over TLS.
+	QueryFlagsDTLS uint16 = QueryFlagsTLS
+
+	// QueryFlagsDNSCrypt contains the [dnscodec] query flags used by DNSCrypt,
+	// which requests DNSSEC records but does not use EDNS(0) padding, since
+	// DNSCrypt pads the encrypted queries.
+	QueryFlagsDNSCrypt uint16 = dnscodec.QueryFlagDNSSec
+
+	// QueryFlagsHTTPS contains the [dnscodec] query flags used by DNS over HTTPS,
+	// which are the same used by DNS over TLS.
+	QueryFlagsHTTPS uint16 = QueryFlagsTLS
+
+	// QueryMaxSizeStream is the maximum response size advertised by
+	// DNS over TCP, TLS, QUIC, and HTTPS.
+	QueryMaxSizeStream uint16 = dnscodec.QueryMaxResponseSizeTCP
+
+	// QueryMaxSizeUDP is the maximum response size advertised by DNS over
+	// UDP, which avoids IP fragmentation (see DNS Flag Day 2020).
+	QueryMaxSizeUDP uint16 = dnscodec.QueryMaxResponseSizeUDP
+
+	// QueryMaxSizeDTLS is the maximum response size advertised by DNS over
+	// DTLS, which leaves room for the DTLS record overhead, since responses
+	// must fit into the path MTU (RFC 8094 Section 5).
+	QueryMaxSizeDTLS uint16 = QueryMaxSizeUDP - 64
+)
+
+// QueryParamsUDP returns the [QueryParams] preset applied by DNS over UDP.
+func QueryParamsUDP() QueryParams {
+	return QueryParams{Flags: QueryFlagsUDP, MaxSize: QueryMaxSizeUDP}
+}
+
+// QueryParamsTCP returns the [QueryParams] preset applied by DNS over TCP.
+//
+// Custom [StreamOpener] implementations can use the presets in MutateQuery.
+func QueryParamsTCP() QueryParams {
+	return QueryParams{Flags: QueryFlagsTCP, MaxSize: QueryMaxSizeStream}
+}
+
+// QueryParamsTLS returns the [QueryParams] preset applied by DNS over TLS.
+func QueryParamsTLS() QueryParams {
+	return QueryParams{Flags: QueryFlagsTLS, MaxSize: QueryMaxSizeStream}
+}
+
+// QueryParamsQUIC returns the [QueryParams] preset applied by DNS over QUIC,
+// which also requires a zero query ID (RFC 9250 Section 4.2.1).
+func QueryParamsQUIC() QueryParams {
+	return QueryParams{Flags: QueryFlagsQUIC, MaxSize: QueryMaxSizeStream, ZeroID: true}
+}
+
+// QueryParamsHTTPS returns the [QueryParams] preset applied by DNS over HTTPS,
+// which also uses a zero query ID (RFC 8484 Section 4.1).
+func QueryParamsHTTPS() QueryParams {
+	return QueryParams{Flags: QueryFlagsHTTPS, MaxSize: QueryMaxSizeStream, ZeroID: true}
+}
+
+// QueryParamsDTLS returns the [QueryParams] preset applied by DNS over DTLS.
+func QueryParamsDTLS() QueryParams {
+	return QueryParams{Flags: QueryFlagsDTLS, MaxSize: QueryMaxSizeDTLS}
+}
+
+// QueryParamsDNSCrypt returns the [QueryParams] preset applied by DNSCrypt.
+func QueryParamsDNSCrypt() QueryParams {
+	return QueryParams{Flags: QueryFlagsDNSCrypt, MaxSize: QueryMaxSizeUDP}
+}
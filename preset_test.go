@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryParamsPresets(t *testing.T) {
+	dt := &Transport{}
+	cases := []struct {
+		name     string
+		opener   StreamOpener
+		expected QueryParams
+	}{
+		{"UDP", NewUDPStreamOpener(nil), QueryParamsUDP()},
+		{"TCP", NewTCPStreamOpener(nil), QueryParamsTCP()},
+		{"TLS", NewTLSStreamOpener(nil), QueryParamsTLS()},
+		{"QUIC", NewQUICStreamOpener(nil), QueryParamsQUIC()},
+		{"DTLS", NewDTLSStreamOpener(nil), QueryParamsDTLS()},
+		{"HTTPS", &httpsConn{}, QueryParamsHTTPS()},
+		{"HTTP3", &http3Conn{}, QueryParamsHTTPS()},
+		{"handler", NewHandlerStreamOpener(nil), QueryParamsTCP()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, newQueryParams(dt, tc.opener))
+		})
+	}
+}
+
+func TestQueryParamsPresetsValues(t *testing.T) {
+	require.Equal(t, QueryParams{MaxSize: dnscodec.QueryMaxResponseSizeUDP}, QueryParamsUDP())
+	require.Equal(t, QueryParams{MaxSize: dnscodec.QueryMaxResponseSizeTCP}, QueryParamsTCP())
+	require.Equal(t, QueryParams{
+		Flags:   dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec,
+		MaxSize: dnscodec.QueryMaxResponseSizeTCP,
+	}, QueryParamsTLS())
+	require.Equal(t, QueryParams{
+		Flags:   dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec,
+		MaxSize: dnscodec.QueryMaxResponseSizeTCP,
+		ZeroID:  true,
+	}, QueryParamsQUIC())
+	require.Equal(t, QueryParamsQUIC(), QueryParamsHTTPS())
+}
+
+func TestQueryParamsPresetMutateQueryKeepsFlags(t *testing.T) {
+	query := dnscodec.NewQuery("example.com", 1)
+	query.Flags = dnscodec.QueryFlagDNSSec
+	QueryParamsTCP().MutateQuery(query)
+	require.Equal(t, uint16(dnscodec.QueryFlagDNSSec), query.Flags)
+}
@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ErrProxyUnsupportedScheme indicates that the proxy configured
+// in the environment uses a scheme we do not support.
+var ErrProxyUnsupportedScheme = errors.New("dnsoverstream: unsupported proxy scheme")
+
+// EnvironmentProxyDialer implements [NetDialer] by dialing through the proxy
+// configured in the environment, so that deployed probes use the egress path
+// of the environment, and connecting directly when there is no proxy.
+//
+// We read the environment when constructing, using HTTPS_PROXY or, when unset,
+// ALL_PROXY (or their lowercase versions), along with NO_PROXY, whose format
+// is the same used by [net/http]. Like [net/http], we connect directly to
+// loopback addresses. We use [*HTTPConnectDialer] for "http" and "https"
+// proxies and [*SOCKS5Dialer] for "socks5" and "socks5h" proxies.
+//
+// Since we do not honour the environment by default, callers must
+// opt in by using this dialer (e.g., as the [*NetTLSDialer] dialer).
+//
+// Construct using [NewEnvironmentProxyDialer].
+type EnvironmentProxyDialer struct {
+	// Dialer is the underlying [NetDialer] connecting either
+	// to the proxy or directly to the destination.
+	Dialer NetDialer
+
+	// proxy returns the proxy URL for the destination or nil.
+	proxy func(reqURL *url.URL) (*url.URL, error)
+}
+
+// NewEnvironmentProxyDialer creates a new [*EnvironmentProxyDialer] using the
+// given [NetDialer] and the proxy configuration of the environment.
+func NewEnvironmentProxyDialer(dialer NetDialer) *EnvironmentProxyDialer {
+	return newEnvironmentProxyDialer(dialer, os.Getenv)
+}
+
+// newEnvironmentProxyDialer is like [NewEnvironmentProxyDialer]
+// but reads the environment using the given getenv func.
+func newEnvironmentProxyDialer(dialer NetDialer, getenv func(string) string) *EnvironmentProxyDialer {
+	config := &httpproxy.Config{
+		HTTPSProxy: proxyEnvLookup(getenv, "HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy"),
+		NoProxy:    proxyEnvLookup(getenv, "NO_PROXY", "no_proxy"),
+	}
+	return &EnvironmentProxyDialer{Dialer: dialer, proxy: config.ProxyFunc()}
+}
+
+// proxyEnvLookup returns the value of the first nonempty variable.
+func proxyEnvLookup(getenv func(string) string, names ...string) string {
+	for _, name := range names {
+		if value := getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+var _ NetDialer = &EnvironmentProxyDialer{}
+
+// DialContext implements [NetDialer].
+//
+// The networks we support depend on the proxy: see [*HTTPConnectDialer]
+// and [*SOCKS5Dialer] for more information.
+func (d *EnvironmentProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer, err := d.dialerFor(address)
+	if err != nil {
+		return nil, err
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// dialerFor returns the [NetDialer] to use for connecting to the given address.
+func (d *EnvironmentProxyDialer) dialerFor(address string) (NetDialer, error) {
+	// 1. figure out whether we should use a proxy
+	proxyURL, err := d.proxy(&url.URL{Scheme: "https", Host: address})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.Dialer, nil
+	}
+
+	// 2. create the dialer for the proxy
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return NewHTTPConnectDialer(d.Dialer, proxyURL), nil
+
+	case "socks5", "socks5h":
+		port := proxyURL.Port()
+		if port == "" {
+			port = "1080"
+		}
+		dialer := NewSOCKS5Dialer(d.Dialer, net.JoinHostPort(proxyURL.Hostname(), port))
+		if proxyURL.User != nil {
+			dialer.Username = proxyURL.User.Username()
+			dialer.Password, _ = proxyURL.User.Password()
+		}
+		return dialer, nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrProxyUnsupportedScheme, proxyURL.Scheme)
+	}
+}
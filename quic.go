@@ -14,11 +14,15 @@
 package dnsoverstream
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bassosimone/dnscodec"
 	"github.com/quic-go/quic-go"
@@ -41,12 +45,40 @@ type QUICDialer struct {
 	// TLSConfig is the MANDATORY [*tls.Config].
 	TLSConfig *tls.Config
 
-	// Transport is the MANDATORY [*quic.Transport].
+	// Transport is the [*quic.Transport], which is MANDATORY
+	// unless ConnectedUDP is set, in which case we ignore it.
 	Transport *quic.Transport
+
+	// Allow0RTT OPTIONALLY sends queries as 0-RTT early data when resuming a
+	// session, which requires TLSConfig to have a ClientSessionCache.
+	//
+	// Early data may be replayed by an attacker (RFC 9250 Section 4.5), so
+	// only enable this for queries without side effects.
+	//
+	// When the server rejects early data, we wait for the handshake to complete
+	// and resend the query, and the exchange reports [HandshakeEarlyDataRejected].
+	Allow0RTT bool
+
+	// ConnectedUDP OPTIONALLY dials each connection using a dedicated UDP
+	// socket connected to the endpoint rather than using Transport, so that
+	// the kernel reports the ICMP errors it receives (e.g., port unreachable)
+	// and dialing or exchanging fails immediately with an error wrapping
+	// [ErrICMPUnreachable] rather than when the context is done (see also
+	// [ClassifyICMPUnreachable]). We close the socket along with the [*quic.Conn].
+	ConnectedUDP bool
+
+	// UDPDialer is the OPTIONAL [NetDialer] creating the connected UDP
+	// sockets when ConnectedUDP is set. If nil, we use a [*net.Dialer].
+	UDPDialer NetDialer
 }
 
 // NewQUICDialer creates a new [*QUICDialer] using the given serverName
 // for the [*tls.Config] and [net.PacketConn] for QUIC.
+//
+// The [net.PacketConn] may come from a userspace network stack, such as
+// wireguard-go's netstack, as long as it accepts [*net.UDPAddr] destinations.
+// In such a case, quic-go cannot use the [*net.UDPConn] optimizations
+// (e.g., GSO and ECN) but otherwise works as intended.
 func NewQUICDialer(pconn net.PacketConn, serverName string) *QUICDialer {
 	return &QUICDialer{
 		TLSConfig:  NewTLSConfigDNSOverQUIC(serverName),
@@ -56,9 +88,100 @@ func NewQUICDialer(pconn net.PacketConn, serverName string) *QUICDialer {
 }
 
 // Dial creates a [*quic.Conn] using the given argument and the structure fields.
+//
+// The context bounds the QUIC handshake, consistently with how the context
+// bounds the TCP connect and the TLS handshake for the other protocols.
 func (qdd *QUICDialer) Dial(ctx context.Context, address netip.AddrPort) (*quic.Conn, error) {
+	if qdd.ConnectedUDP {
+		return qdd.dialConnected(ctx, address)
+	}
+	return qdd.dialTransport(ctx, qdd.Transport, address)
+}
+
+// dialTransport dials using the given [*quic.Transport].
+func (qdd *QUICDialer) dialTransport(ctx context.Context, tr *quic.Transport, address netip.AddrPort) (*quic.Conn, error) {
 	udpAddr := net.UDPAddrFromAddrPort(address)
-	return qdd.Transport.Dial(ctx, udpAddr, qdd.TLSConfig, qdd.QUICConfig)
+	tlsConfig := tlsConfigForEndpoint(qdd.TLSConfig, address.String())
+	if qdd.Allow0RTT {
+		return tr.DialEarly(ctx, udpAddr, tlsConfig, qdd.QUICConfig)
+	}
+	return tr.Dial(ctx, udpAddr, tlsConfig, qdd.QUICConfig)
+}
+
+// dialConnected dials using a dedicated connected UDP socket.
+func (qdd *QUICDialer) dialConnected(ctx context.Context, address netip.AddrPort) (*quic.Conn, error) {
+	// 1. create the connected UDP socket
+	var dialer NetDialer = &net.Dialer{}
+	if qdd.UDPDialer != nil {
+		dialer = qdd.UDPDialer
+	}
+	conn, err := dialer.DialContext(ctx, "udp", address.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. dial using a dedicated transport
+	tr := &quic.Transport{Conn: &connectedPacketConn{conn: conn}}
+	qconn, err := qdd.dialTransport(ctx, tr, address)
+	if err != nil {
+		tr.Close()
+		conn.Close()
+		return nil, wrapICMPError(err)
+	}
+
+	// 3. release the transport and the socket along with the connection
+	context.AfterFunc(qconn.Context(), func() {
+		tr.Close()
+		conn.Close()
+	})
+	return qconn, nil
+}
+
+// connectedPacketConn adapts a connected UDP socket to [net.PacketConn].
+//
+// We intentionally do not embed the [net.Conn], since quic-go would otherwise
+// detect a [*net.UDPConn] and use WriteMsgUDP with a destination address,
+// which fails for connected sockets.
+type connectedPacketConn struct {
+	conn net.Conn
+}
+
+var _ net.PacketConn = &connectedPacketConn{}
+
+// ReadFrom implements [net.PacketConn].
+func (c *connectedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	count, err := c.conn.Read(p)
+	return count, c.conn.RemoteAddr(), err
+}
+
+// WriteTo implements [net.PacketConn].
+func (c *connectedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.conn.Write(p)
+}
+
+// Close implements [net.PacketConn].
+func (c *connectedPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+// LocalAddr implements [net.PacketConn].
+func (c *connectedPacketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// SetDeadline implements [net.PacketConn].
+func (c *connectedPacketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements [net.PacketConn].
+func (c *connectedPacketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements [net.PacketConn].
+func (c *connectedPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
 }
 
 // StreamOpenerDialerQUIC implements [StreamOpenerDialer] for DNS over QUIC.
@@ -81,7 +204,7 @@ var _ StreamOpenerDialer = &StreamOpenerDialerQUIC{}
 // This allows callers who already hold a QUIC connection to use
 // [*Transport.ExchangeWithStreamOpener] without dialing.
 func NewQUICStreamOpener(conn *quic.Conn) StreamOpener {
-	return &quicConnAdapter{qconn: conn, once: sync.Once{}}
+	return &quicConnAdapter{qconn: conn}
 }
 
 // DialContext implements [StreamOpenerDialer].
@@ -90,13 +213,16 @@ func (d *StreamOpenerDialerQUIC) DialContext(ctx context.Context, address netip.
 	if err != nil {
 		return nil, err
 	}
-	return &quicConnAdapter{conn, sync.Once{}}, nil
+	return &quicConnAdapter{qconn: conn}, nil
 }
 
 // quicConnAdapter adapts [*quic.Conn] to [StreamOpener].
 type quicConnAdapter struct {
 	qconn *quic.Conn
 	once  sync.Once
+
+	// earlyDataRejected indicates that the server rejected 0-RTT early data.
+	earlyDataRejected atomic.Bool
 }
 
 // Close implements [StreamOpener].
@@ -111,12 +237,189 @@ func (q *quicConnAdapter) Close() (err error) {
 
 // MutateQuery implements [StreamOpener].
 func (q *quicConnAdapter) MutateQuery(msg *dnscodec.Query) {
-	msg.Flags |= dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec
-	msg.ID = 0
-	msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+	QueryParamsQUIC().MutateQuery(msg)
 }
 
 // OpenStream implements [StreamOpener].
 func (q *quicConnAdapter) OpenStream() (Stream, error) {
+	return q.openStream(context.Background(), false)
+}
+
+// openStream opens a new [Stream] and, when wait is true, waits for the
+// server to allow opening a new stream, bounded by ctx, rather than failing
+// when we reached the maximum number of streams allowed by the server.
+func (q *quicConnAdapter) openStream(ctx context.Context, wait bool) (Stream, error) {
+	// 1. open the stream, which fails after the server rejected early data
+	// until we wait for the handshake to complete
+	var (
+		stream *quic.Stream
+		err    error
+	)
+	if wait {
+		stream, err = q.qconn.OpenStreamSync(ctx)
+	} else {
+		stream, err = q.qconn.OpenStream()
+	}
+	if errors.Is(err, quic.Err0RTTRejected) {
+		stream, err = q.openStreamAfterRejection(ctx)
+	}
+	if err != nil {
+		return nil, wrapICMPError(err)
+	}
+
+	// 2. use a stream that survives rejection if we are sending early data
+	var wrapped Stream = &quicStream{stream}
+	if !q.handshakeComplete() {
+		wrapped = &quicEarlyStream{quicStream: &quicStream{stream}, conn: q}
+	}
+	if doqUnframed(q.NegotiatedProtocol()) {
+		return &doqUnframedStream{Stream: wrapped}, nil
+	}
+	return wrapped, nil
+}
+
+// handshakeComplete returns whether the handshake has completed, which is
+// not the case while we are sending 0-RTT early data.
+func (q *quicConnAdapter) handshakeComplete() bool {
+	select {
+	case <-q.qconn.HandshakeComplete():
+		return true
+	default:
+		return false
+	}
+}
+
+// openStreamAfterRejection waits for the handshake to complete after the
+// server rejected early data and then opens a new stream.
+func (q *quicConnAdapter) openStreamAfterRejection(ctx context.Context) (*quic.Stream, error) {
+	if _, err := q.qconn.NextConnection(ctx); err != nil {
+		return nil, err
+	}
+	q.earlyDataRejected.Store(true)
 	return q.qconn.OpenStream()
 }
+
+// quicStream wraps [*quic.Stream] to surface the ICMP errors that caused
+// the connection to fail while reading or writing (see [ErrICMPUnreachable]).
+type quicStream struct {
+	*quic.Stream
+}
+
+// Read implements [Stream].
+func (s *quicStream) Read(buff []byte) (int, error) {
+	count, err := s.Stream.Read(buff)
+	if err != nil {
+		err = wrapICMPError(err)
+	}
+	return count, err
+}
+
+// Write implements [Stream].
+func (s *quicStream) Write(data []byte) (int, error) {
+	count, err := s.Stream.Write(data)
+	if err != nil {
+		err = wrapICMPError(err)
+	}
+	return count, err
+}
+
+// quicEarlyStream wraps a [*quicStream] opened before the handshake completes,
+// whose data we send as 0-RTT early data. Since the server may reject early
+// data, we buffer what we write and, on rejection, wait for the handshake
+// to complete and resend the buffered data using a new stream.
+type quicEarlyStream struct {
+	*quicStream
+	conn          *quicConnAdapter
+	written       bytes.Buffer
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// SetDeadline implements [Stream].
+func (s *quicEarlyStream) SetDeadline(t time.Time) error {
+	s.readDeadline, s.writeDeadline = t, t
+	return s.quicStream.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *quicEarlyStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline = t
+	return s.quicStream.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *quicEarlyStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline = t
+	return s.quicStream.SetWriteDeadline(t)
+}
+
+// Read implements [Stream].
+func (s *quicEarlyStream) Read(buff []byte) (int, error) {
+	count, err := s.quicStream.Read(buff)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if err := s.resend(s.readDeadline); err != nil {
+			return 0, err
+		}
+		return s.quicStream.Read(buff)
+	}
+	return count, err
+}
+
+// Write implements [Stream].
+func (s *quicEarlyStream) Write(data []byte) (int, error) {
+	s.written.Write(data)
+	count, err := s.quicStream.Write(data)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// resending includes the data we are writing
+		if err := s.resend(s.writeDeadline); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	return count, err
+}
+
+// Close implements [Stream].
+func (s *quicEarlyStream) Close() error {
+	s.closed = true
+	err := s.quicStream.Close()
+	if errors.Is(err, quic.Err0RTTRejected) {
+		return s.resend(s.writeDeadline)
+	}
+	return err
+}
+
+// resend resends the buffered data using a new stream after the server
+// rejected early data, waiting for the handshake until the given deadline.
+func (s *quicEarlyStream) resend(deadline time.Time) error {
+	// 1. wait for the handshake to complete and open a new stream
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	stream, err := s.conn.openStreamAfterRejection(ctx)
+	if err != nil {
+		return wrapICMPError(err)
+	}
+	s.quicStream = &quicStream{stream}
+
+	// 2. restore the deadlines
+	if err := s.quicStream.SetReadDeadline(s.readDeadline); err != nil {
+		return err
+	}
+	if err := s.quicStream.SetWriteDeadline(s.writeDeadline); err != nil {
+		return err
+	}
+
+	// 3. resend the data and the end of the stream
+	if _, err := s.quicStream.Write(s.written.Bytes()); err != nil {
+		return err
+	}
+	if s.closed {
+		return s.quicStream.Close()
+	}
+	return nil
+}
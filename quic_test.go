@@ -4,10 +4,19 @@ package dnsoverstream
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,3 +76,133 @@ func TestNewQUICDialer(t *testing.T) {
 	require.Equal(t, "dns.example.com", dialer.TLSConfig.ServerName)
 	require.Contains(t, dialer.TLSConfig.NextProtos, "doq")
 }
+
+// userspaceTestPacketConn hides the concrete [net.PacketConn] type, like
+// the packet connections created by userspace network stacks do.
+type userspaceTestPacketConn struct {
+	net.PacketConn
+}
+
+func TestQUICDialerCustomPacketConn(t *testing.T) {
+	srv := newDoQTestServer(t, func(query *dns.Msg) *dns.Msg {
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		return resp
+	})
+
+	lc := &net.ListenConfig{}
+	pconn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pconn.Close()
+
+	qdialer := NewQUICDialer(&userspaceTestPacketConn{pconn}, "example.com")
+	qdialer.TLSConfig = newTestClientTLSConfig("doq")
+	dt := NewTransport(NewStreamOpenerDialerQUIC(qdialer), srv.Endpoint())
+	_, err = dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.ErrorIs(t, err, dnscodec.ErrNoData)
+}
+
+func TestQUICDialerConnectedUDP(t *testing.T) {
+	t.Run("exchanges over a connected socket", func(t *testing.T) {
+		srv := newDoQTestServer(t, func(query *dns.Msg) *dns.Msg {
+			resp := &dns.Msg{}
+			resp.SetReply(query)
+			return resp
+		})
+		var closed atomic.Int64
+		qdialer := NewQUICDialer(nil, "example.com")
+		qdialer.TLSConfig = newTestClientTLSConfig("doq")
+		qdialer.ConnectedUDP = true
+		qdialer.UDPDialer = &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+				if err != nil {
+					return nil, err
+				}
+				return &userspaceTestConn{Conn: conn, closed: &closed}, nil
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qdialer), srv.Endpoint())
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		_, err = dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrNoData)
+
+		// closing the connection closes the socket
+		require.NoError(t, conn.Close())
+		require.Eventually(t, func() bool {
+			return closed.Load() >= 1
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("surfaces ICMP port unreachable", func(t *testing.T) {
+		// obtain a closed UDP port
+		lc := &net.ListenConfig{}
+		pconn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		endpoint := netip.MustParseAddrPort(pconn.LocalAddr().String())
+		require.NoError(t, pconn.Close())
+
+		qdialer := NewQUICDialer(nil, "example.com")
+		qdialer.ConnectedUDP = true
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = qdialer.Dial(ctx, endpoint)
+		require.ErrorIs(t, err, ErrICMPUnreachable)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+		require.Equal(t, ICMPUnreachablePort, ClassifyICMPUnreachable(err))
+		require.NoError(t, ctx.Err())
+	})
+
+	t.Run("surfaces ICMP port unreachable during the exchange", func(t *testing.T) {
+		// start a server that never answers and whose socket we can close
+		lc := &net.ListenConfig{}
+		pconn, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer pconn.Close()
+		listener, err := quic.Listen(pconn, &tls.Config{
+			Certificates: []tls.Certificate{newTestCert()},
+			NextProtos:   []string{"doq"},
+		}, &quic.Config{})
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				if _, err := listener.Accept(context.Background()); err != nil {
+					return
+				}
+			}
+		}()
+
+		qdialer := NewQUICDialer(nil, "example.com")
+		qdialer.TLSConfig = newTestClientTLSConfig("doq")
+		qdialer.ConnectedUDP = true
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qdialer), netip.MustParseAddrPort(pconn.LocalAddr().String()))
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		// closing the server socket causes the kernel to answer the
+		// next packets we send with ICMP port unreachable
+		require.NoError(t, pconn.Close())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = dt.ExchangeWithStreamOpener(ctx, conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrICMPUnreachable)
+		require.Equal(t, ICMPUnreachablePort, ClassifyICMPUnreachable(err))
+		require.NoError(t, ctx.Err())
+	})
+
+	t.Run("returns the UDP dialer error", func(t *testing.T) {
+		expected := errors.New("network unreachable")
+		qdialer := NewQUICDialer(nil, "example.com")
+		qdialer.ConnectedUDP = true
+		qdialer.UDPDialer = &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		}
+		_, err := qdialer.Dial(context.Background(), netip.MustParseAddrPort("127.0.0.1:853"))
+		require.ErrorIs(t, err, expected)
+	})
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// RawResponse is a DNS response that has not been parsed.
+//
+// Returned by [*Transport.ExchangeRaw] and [*Transport.ExchangeRawWithStreamOpener]
+// for use cases such as archiving wire data to parse it offline.
+type RawResponse struct {
+	// Query is the raw query we sent.
+	Query []byte
+
+	// Response is the raw response we received.
+	Response []byte
+
+	// Header is the response [Header] decoded without unpacking the
+	// whole response, for quick classification.
+	Header Header
+}
+
+// ExchangeRaw is like [*Transport.Exchange] but returns a [*RawResponse].
+//
+// This method skips unpacking and validating the response, which saves CPU
+// time at scale. The caller is responsible for validating the response.
+func (dt *Transport) ExchangeRaw(ctx context.Context, query *dnscodec.Query) (*RawResponse, error) {
+	return transportExchange(ctx, dt, query, dnscodecQuestion, dt.ExchangeRawWithStreamOpener)
+}
+
+// ExchangeRawWithStreamOpener is like [*Transport.ExchangeWithStreamOpener] but
+// returns a [*RawResponse]. See [*Transport.ExchangeRaw] for more information.
+func (dt *Transport) ExchangeRawWithStreamOpener(ctx context.Context, conn StreamOpener, query *dnscodec.Query) (*RawResponse, error) {
+	return streamExchange(ctx, dt, conn, query, parseRawResponse)
+}
+
+// parseRawResponse is the [parseFunc] used by [*Transport.ExchangeRawWithStreamOpener].
+func parseRawResponse(queryMsg *dns.Msg, rawQuery, rawResp []byte) (*RawResponse, error) {
+	// Only decode the header by hand.
+	hdr, err := DecodeHeader(rawResp)
+	if err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	resp := &RawResponse{
+		Query:    bytes.Clone(rawQuery),
+		Response: bytes.Clone(rawResp),
+		Header:   hdr,
+	}
+	return resp, nil
+}
@@ -0,0 +1,91 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeRawWithStreamOpener(t *testing.T) {
+	query := dnscodec.NewQuery("example.com", dns.TypeA)
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+
+	resp, err := dt.ExchangeRawWithStreamOpener(context.Background(), newEchoStreamOpener(t), query)
+	require.NoError(t, err)
+
+	queryMsg := &dns.Msg{}
+	require.NoError(t, queryMsg.Unpack(resp.Query))
+	respMsg := &dns.Msg{}
+	require.NoError(t, respMsg.Unpack(resp.Response))
+	require.Equal(t, query.ID, queryMsg.Id)
+	require.Equal(t, query.ID, resp.Header.ID)
+	require.True(t, resp.Header.Response)
+	require.Equal(t, uint16(1), resp.Header.ANCount)
+	require.Equal(t, dns.RcodeSuccess, resp.Header.Rcode)
+	require.Len(t, respMsg.Answer, 1)
+}
+
+func TestExchangeRawWithStreamOpenerRcode(t *testing.T) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			var respReader *bytes.Reader
+			stub.WriteFunc = func(p []byte) (int, error) {
+				queryMsg := &dns.Msg{}
+				require.NoError(t, queryMsg.Unpack(p[2:]))
+				resp := &dns.Msg{}
+				resp.SetRcode(queryMsg, dns.RcodeNameError)
+				rawResp, err := resp.Pack()
+				require.NoError(t, err)
+				respReader = bytes.NewReader(appendStreamMsgFrame(nil, rawResp))
+				return len(p), nil
+			}
+			stub.ReadFunc = func(p []byte) (int, error) {
+				return respReader.Read(p)
+			}
+			return stub, nil
+		},
+	}
+
+	// Note that Exchange would fail with NXDOMAIN here.
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	resp, err := dt.ExchangeRawWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeNameError, resp.Header.Rcode)
+}
+
+func TestExchangeRawWithStreamOpenerShortResponse(t *testing.T) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			frame := []byte{0x00, 0x01, 0xff}
+			return &FuncStream{
+				ReadFunc: bytes.NewReader(frame).Read,
+			}, nil
+		},
+	}
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	_, err := dt.ExchangeRawWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+	require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+}
+
+func TestExchangeRaw(t *testing.T) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return newEchoStreamOpener(t), nil
+		},
+	}
+
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	resp, err := dt.ExchangeRaw(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.Response)
+}
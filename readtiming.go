@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"time"
+)
+
+// ReadThroughput returns the rate, in bytes per second, at which we received
+// the response after its first bytes, which for multi-KB responses (e.g.,
+// DNSSEC or large TXT records) helps distinguishing slow servers, which have
+// a large TimeToFirstByte, from slow paths, which have a low throughput.
+//
+// It returns zero when we did not read the response or when we read
+// it all at once, in which case the throughput is not meaningful.
+func (t ExchangeTiming) ReadThroughput() float64 {
+	elapsed := t.TimeToLastByte - t.TimeToFirstByte
+	if t.ResponseSize <= 0 || elapsed <= 0 {
+		return 0
+	}
+	return float64(t.ResponseSize) / elapsed.Seconds()
+}
+
+// readTimerKey is the context key for the [*readTimer].
+type readTimerKey struct{}
+
+// readTimer records the response read timing into an [ExchangeTiming].
+type readTimer struct {
+	// timing is the [ExchangeTiming] to update.
+	timing *ExchangeTiming
+
+	// sent is when we finished sending the query.
+	sent time.Time
+}
+
+// withReadTimer returns a copy of ctx recording the response read timing
+// into timing when the [*Transport] has the ObserveTiming hook.
+func withReadTimer(ctx context.Context, dt *Transport, timing *ExchangeTiming) context.Context {
+	if dt.ObserveTiming == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, readTimerKey{}, &readTimer{timing: timing})
+}
+
+// readTimerFromContext returns the [*readTimer] carried by ctx or nil.
+func readTimerFromContext(ctx context.Context) *readTimer {
+	rt, _ := ctx.Value(readTimerKey{}).(*readTimer)
+	return rt
+}
+
+// querySent records that we finished sending the query.
+func (rt *readTimer) querySent(dt *Transport) {
+	if rt != nil {
+		rt.sent = dt.now()
+	}
+}
+
+// firstByte records that we received the first bytes of the response.
+func (rt *readTimer) firstByte(dt *Transport) {
+	if rt != nil && !rt.sent.IsZero() {
+		rt.timing.TimeToFirstByte = dt.since(rt.sent)
+	}
+}
+
+// lastByte records that we received the whole response of the given size.
+func (rt *readTimer) lastByte(dt *Transport, size int) {
+	if rt != nil && !rt.sent.IsZero() {
+		rt.timing.TimeToLastByte = dt.since(rt.sent)
+		rt.timing.ResponseSize = size
+	}
+}
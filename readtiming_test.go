@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeTimingReadThroughput(t *testing.T) {
+	timing := ExchangeTiming{
+		TimeToFirstByte: 100 * time.Millisecond,
+		TimeToLastByte:  600 * time.Millisecond,
+		ResponseSize:    4096,
+	}
+	require.Equal(t, float64(8192), timing.ReadThroughput())
+
+	timing.TimeToLastByte = timing.TimeToFirstByte
+	require.Zero(t, timing.ReadThroughput())
+	require.Zero(t, ExchangeTiming{}.ReadThroughput())
+}
+
+func TestTransportTimeToFirstByte(t *testing.T) {
+	// 1. start a TCP server answering after a delay and sending
+	// the second half of a large response after another delay
+	const delay = 100 * time.Millisecond
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	var rawResp []byte
+	wg.Go(func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		rawQuery := make([]byte, int(header[0])<<8|int(header[1]))
+		if _, err := io.ReadFull(conn, rawQuery); err != nil {
+			return
+		}
+		query := &dns.Msg{}
+		if err := query.Unpack(rawQuery); err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		resp.SetReply(query)
+		resp.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: query.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{strings.Repeat("x", 255), strings.Repeat("y", 255), strings.Repeat("z", 255)},
+		}}
+		rawResp, _ = resp.Pack()
+		frame := appendStreamMsgFrame(nil, rawResp)
+		time.Sleep(delay)
+		conn.Write(frame[:len(frame)/2])
+		time.Sleep(delay)
+		conn.Write(frame[len(frame)/2:])
+	})
+
+	// 2. exchange and collect the timing
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), listener.Addr().(*net.TCPAddr).AddrPort())
+	var timing ExchangeTiming
+	dt.ObserveTiming = func(value ExchangeTiming) { timing = value }
+	query := dnscodec.NewQuery("example.com", dns.TypeTXT)
+	query.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+	_, err = dt.Exchange(context.Background(), query)
+	require.NoError(t, err)
+	wg.Wait()
+
+	// 3. make sure we measured the two delays separately
+	require.GreaterOrEqual(t, timing.TimeToFirstByte, delay)
+	require.GreaterOrEqual(t, timing.TimeToLastByte-timing.TimeToFirstByte, delay)
+	require.Less(t, timing.TimeToLastByte, timing.ExchangeTime)
+	require.Equal(t, len(rawResp), timing.ResponseSize)
+	require.Positive(t, timing.ReadThroughput())
+}
+
+func TestTransportTimeToFirstByteWithoutObserveTiming(t *testing.T) {
+	dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.MustParseAddrPort("127.0.0.1:53"))
+	ctx := withReadTimer(context.Background(), dt, &ExchangeTiming{})
+	require.Nil(t, readTimerFromContext(ctx))
+}
@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// Attempt describes a single exchange attempt made by [*RetryPolicy].
+type Attempt struct {
+	// Protocol is the protocol name (e.g., [ProtocolTCP]).
+	Protocol string
+
+	// Endpoint is the endpoint we used.
+	Endpoint netip.AddrPort
+
+	// Timing is the [ExchangeTiming] of the attempt.
+	Timing ExchangeTiming
+
+	// Flags contains the [ResponseFlags] of the response or nil when we did
+	// not receive a response we could unpack. We also set Flags when the
+	// response code is an error (e.g., NXDOMAIN), in which case Err is not nil.
+	Flags *ResponseFlags
+
+	// Err is the error that occurred or nil on success.
+	Err error
+}
+
+// AttemptsError is the error returned by [*RetryPolicy.Exchange] when all
+// the attempts fail, which wraps the error of each attempt.
+type AttemptsError struct {
+	// Attempts contains all the failed attempts.
+	Attempts []Attempt
+}
+
+// Error implements error.
+func (e *AttemptsError) Error() string {
+	var parts []string
+	for _, attempt := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("%s %s: %s", attempt.Protocol, attempt.Endpoint, attempt.Err))
+	}
+	return fmt.Sprintf("dnsoverstream: all %d attempts failed: %s", len(e.Attempts), strings.Join(parts, "; "))
+}
+
+// Unwrap returns the error of each attempt, so that [errors.Is] works.
+func (e *AttemptsError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt.Err)
+	}
+	return errs
+}
+
+// RetryPolicy retries failed exchanges and falls back to other transports,
+// recording each [Attempt] so that failures remain diagnosable.
+//
+// Construct using [NewRetryPolicy].
+type RetryPolicy struct {
+	// Transports contains the MANDATORY transports to try in order.
+	Transports []*Transport
+
+	// MaxAttempts is the OPTIONAL number of attempts for each transport.
+	// If zero or negative, we try each transport once.
+	MaxAttempts int
+
+	// Backoff is the OPTIONAL time to wait between attempts.
+	Backoff time.Duration
+
+	// ShouldRetry is the OPTIONAL function deciding whether to try again
+	// after an error. If nil, we use [DefaultShouldRetry].
+	ShouldRetry func(err error) bool
+}
+
+// NewRetryPolicy creates a new [*RetryPolicy] trying each transport once.
+func NewRetryPolicy(transports ...*Transport) *RetryPolicy {
+	return &RetryPolicy{Transports: transports}
+}
+
+// DefaultShouldRetry returns false for the errors meaning that the server
+// answered definitively (i.e., [dnscodec.ErrNoName] and [dnscodec.ErrNoData])
+// and for context errors, and true otherwise.
+func DefaultShouldRetry(err error) bool {
+	switch {
+	case errors.Is(err, dnscodec.ErrNoName),
+		errors.Is(err, dnscodec.ErrNoData),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	default:
+		return true
+	}
+}
+
+// Exchange performs the exchange according to the policy and returns the
+// response along with all the attempts, including the successful one.
+//
+// On failure, the error is an [*AttemptsError] wrapping the errors of all
+// the attempts, unless the context is done while waiting to retry, in
+// which case we return the context error.
+func (rp *RetryPolicy) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, []Attempt, error) {
+	maxAttempts := max(rp.MaxAttempts, 1)
+	shouldRetry := rp.ShouldRetry
+	if shouldRetry == nil {
+		shouldRetry = DefaultShouldRetry
+	}
+
+	var attempts []Attempt
+	for _, dt := range rp.Transports {
+		for range maxAttempts {
+			// 1. wait before retrying
+			if len(attempts) > 0 && rp.Backoff > 0 {
+				timer := time.NewTimer(rp.Backoff)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, attempts, ctx.Err()
+				case <-timer.C:
+				}
+			}
+
+			// 2. perform the attempt and record it
+			resp, attempt := retryAttempt(ctx, dt, query)
+			attempts = append(attempts, attempt)
+			if attempt.Err == nil {
+				return resp, attempts, nil
+			}
+
+			// 3. stop trying when the error is definitive
+			if !shouldRetry(attempt.Err) {
+				return nil, attempts, &AttemptsError{Attempts: attempts}
+			}
+		}
+	}
+	return nil, attempts, &AttemptsError{Attempts: attempts}
+}
+
+// retryAttempt performs a single [Attempt] using the given [*Transport].
+func retryAttempt(ctx context.Context, dt *Transport, query *dnscodec.Query) (*dnscodec.Response, Attempt) {
+	// 1. use a shallow copy of the transport to collect the timing and flags,
+	// which we need regardless of whether the [Sampler] selects the attempt
+	attempt := Attempt{
+		Protocol: newPoolKey(dt.dialer, dt.endpointFor(ctx)).Protocol,
+		Endpoint: dt.endpointFor(ctx),
+	}
+	ctx, dt = sampleExchange(ctx, dt)
+	observer := *dt
+	observer.Sampler = nil
+	observer.ObserveTiming = func(timing ExchangeTiming) {
+		attempt.Timing = timing
+		if dt.ObserveTiming != nil {
+			dt.ObserveTiming(timing)
+		}
+	}
+	observer.ObserveRawResponse = func(rawResp []byte) {
+		if flags, err := DecodeResponseFlags(rawResp); err == nil {
+			attempt.Flags = &flags
+		}
+		if dt.ObserveRawResponse != nil {
+			dt.ObserveRawResponse(rawResp)
+		}
+	}
+
+	// 2. perform the exchange
+	resp, err := observer.Exchange(ctx, query)
+	attempt.Err = err
+	return resp, attempt
+}
@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newRetryTestTransport returns a TCP [*Transport] for the given endpoint whose
+// dialer fails with the given errors in order and then dials normally.
+func newRetryTestTransport(endpoint netip.AddrPort, errs ...error) *Transport {
+	dialer := &netstub.FuncDialer{
+		DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if len(errs) > 0 {
+				err := errs[0]
+				errs = errs[1:]
+				return nil, err
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	return NewTransport(NewStreamOpenerDialerTCP(dialer), endpoint)
+}
+
+// newRetryTestServer starts a loopback TCP server and returns its endpoint.
+func newRetryTestServer(t *testing.T) netip.AddrPort {
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+	t.Cleanup(srv.Close)
+	return netip.MustParseAddrPort(srv.Address())
+}
+
+func TestRetryPolicyExchange(t *testing.T) {
+	endpoint := newRetryTestServer(t)
+	refused := errors.New("connection refused")
+
+	t.Run("succeeds at the first attempt", func(t *testing.T) {
+		rp := NewRetryPolicy(newRetryTestTransport(endpoint))
+		resp, attempts, err := rp.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Len(t, attempts, 1)
+		require.Equal(t, ProtocolTCP, attempts[0].Protocol)
+		require.Equal(t, endpoint, attempts[0].Endpoint)
+		require.NoError(t, attempts[0].Err)
+		require.NotZero(t, attempts[0].Timing.ExchangeTime)
+		require.NotNil(t, attempts[0].Flags)
+		require.Equal(t, dns.RcodeSuccess, attempts[0].Flags.Rcode)
+	})
+
+	t.Run("retries and falls back recording all attempts", func(t *testing.T) {
+		other := netip.MustParseAddrPort("127.0.0.2:53")
+		rp := NewRetryPolicy(
+			newRetryTestTransport(other, refused, refused),
+			newRetryTestTransport(endpoint, refused),
+		)
+		rp.MaxAttempts = 2
+		rp.Backoff = time.Millisecond
+		resp, attempts, err := rp.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Len(t, attempts, 4)
+		for idx, attempt := range attempts[:3] {
+			require.ErrorIs(t, attempt.Err, refused, idx)
+		}
+		require.Equal(t, []netip.AddrPort{other, other, endpoint, endpoint}, []netip.AddrPort{
+			attempts[0].Endpoint, attempts[1].Endpoint, attempts[2].Endpoint, attempts[3].Endpoint,
+		})
+		require.NoError(t, attempts[3].Err)
+	})
+
+	t.Run("returns all the attempts on failure", func(t *testing.T) {
+		rp := NewRetryPolicy(newRetryTestTransport(endpoint, refused), newRetryTestTransport(endpoint, refused))
+		resp, attempts, err := rp.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.Nil(t, resp)
+		require.Len(t, attempts, 2)
+		require.Nil(t, attempts[0].Flags)
+		var aerr *AttemptsError
+		require.ErrorAs(t, err, &aerr)
+		require.Equal(t, attempts, aerr.Attempts)
+		require.ErrorIs(t, err, refused)
+		require.Contains(t, err.Error(), "all 2 attempts failed")
+	})
+
+	t.Run("stops at definitive errors", func(t *testing.T) {
+		rp := NewRetryPolicy(newRetryTestTransport(endpoint), newRetryTestTransport(endpoint))
+		resp, attempts, err := rp.Exchange(context.Background(), dnscodec.NewQuery("nonexistent.example.com", dns.TypeA))
+		require.Nil(t, resp)
+		require.Len(t, attempts, 1)
+		require.ErrorIs(t, err, dnscodec.ErrNoName)
+		require.NotNil(t, attempts[0].Flags)
+		require.Equal(t, dns.RcodeNameError, attempts[0].Flags.Rcode)
+	})
+
+	t.Run("calls the transport ObserveTiming", func(t *testing.T) {
+		dt := newRetryTestTransport(endpoint)
+		var timings []ExchangeTiming
+		dt.ObserveTiming = func(timing ExchangeTiming) {
+			timings = append(timings, timing)
+		}
+		_, attempts, err := NewRetryPolicy(dt).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, []ExchangeTiming{attempts[0].Timing}, timings)
+	})
+
+	t.Run("honours the context while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		rp := NewRetryPolicy(newRetryTestTransport(endpoint, refused), newRetryTestTransport(endpoint))
+		rp.Backoff = time.Hour
+		rp.ShouldRetry = func(err error) bool {
+			cancel()
+			return true
+		}
+		_, attempts, err := rp.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.Canceled)
+		require.Len(t, attempts, 1)
+	})
+}
+
+func TestDefaultShouldRetry(t *testing.T) {
+	require.False(t, DefaultShouldRetry(dnscodec.ErrNoName))
+	require.False(t, DefaultShouldRetry(dnscodec.ErrNoData))
+	require.False(t, DefaultShouldRetry(context.Canceled))
+	require.False(t, DefaultShouldRetry(context.DeadlineExceeded))
+	require.True(t, DefaultShouldRetry(dnscodec.ErrServerMisbehaving))
+	require.True(t, DefaultShouldRetry(errors.New("connection refused")))
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampler decides whether to observe the next exchange, which allows keeping the
+// overhead of logging and observing exchanges under control at high QPS.
+//
+// Use [NewCountSampler] or [NewRateSampler], or provide a custom function.
+// The function MUST be safe for concurrent use.
+type Sampler func() bool
+
+// NewCountSampler returns a [Sampler] observing the first exchange and then one
+// exchange every n. Values of n smaller than two observe every exchange.
+func NewCountSampler(n int) Sampler {
+	var count atomic.Uint64
+	return func() bool {
+		return n <= 1 || (count.Add(1)-1)%uint64(n) == 0
+	}
+}
+
+// NewRateSampler returns a [Sampler] observing at most perSecond exchanges
+// within each one-second window, starting a window at the first exchange
+// following the end of the previous one.
+func NewRateSampler(perSecond int) Sampler {
+	var (
+		mu    sync.Mutex
+		start time.Time
+		count int
+	)
+	return func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if now := time.Now(); now.Sub(start) >= time.Second {
+			start, count = now, 0
+		}
+		count++
+		return count <= perSecond
+	}
+}
+
+// samplingKey is the context key for the sampling decision.
+type samplingKey struct{}
+
+// sampleExchange returns the [*Transport] to use for the exchange along with a
+// context carrying the sampling decision, so that we decide once per exchange
+// even when an exchange method invokes a WithStreamOpener method.
+//
+// When the Sampler does not select the exchange, the returned [*Transport] is
+// a copy of dt without the Logger and the Observe hooks.
+func sampleExchange(ctx context.Context, dt *Transport) (context.Context, *Transport) {
+	if dt.Sampler == nil {
+		return ctx, dt
+	}
+	sampled, found := ctx.Value(samplingKey{}).(bool)
+	if !found {
+		sampled = dt.Sampler()
+		ctx = context.WithValue(ctx, samplingKey{}, sampled)
+	}
+	if sampled {
+		return ctx, dt
+	}
+	unobserved := *dt
+	unobserved.ObserveRawQuery = nil
+	unobserved.ObserveRawResponse = nil
+	unobserved.ObserveResponsePadding = nil
+	unobserved.ObserveResponseCompression = nil
+	unobserved.ObserveTrailingData = nil
+	unobserved.ObserveQueueTime = nil
+	unobserved.ObserveTiming = nil
+	unobserved.ObserveTCPKeepalive = nil
+	unobserved.Logger = nil
+	return ctx, &unobserved
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCountSampler(t *testing.T) {
+	sampler := NewCountSampler(3)
+	var got []bool
+	for range 7 {
+		got = append(got, sampler())
+	}
+	require.Equal(t, []bool{true, false, false, true, false, false, true}, got)
+
+	sampler = NewCountSampler(0)
+	require.True(t, sampler())
+	require.True(t, sampler())
+}
+
+func TestNewRateSampler(t *testing.T) {
+	sampler := NewRateSampler(2)
+	require.True(t, sampler())
+	require.True(t, sampler())
+	require.False(t, sampler())
+}
+
+func TestTransportSampler(t *testing.T) {
+	newTransport := func() *Transport {
+		dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.MustParseAddrPort("127.0.0.1:53"))
+		dt.Sampler = NewCountSampler(2)
+		return dt
+	}
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+
+	t.Run("observes only the sampled exchanges", func(t *testing.T) {
+		dt := newTransport()
+		var queries, responses, timings, logs int
+		dt.ObserveRawQuery = func([]byte) { queries++ }
+		dt.ObserveRawResponse = func([]byte) { responses++ }
+		dt.ObserveTiming = func(ExchangeTiming) { timings++ }
+		dt.Logger = slog.New(&countingSlogHandler{Handler: slog.NewTextHandler(io.Discard, nil), count: &logs})
+		for range 4 {
+			_, err := dt.Exchange(context.Background(), newQuery())
+			require.NoError(t, err)
+		}
+		require.Equal(t, []int{2, 2, 2, 2}, []int{queries, responses, timings, logs})
+	})
+
+	t.Run("observes the TCP keepalive of the sampled exchanges only", func(t *testing.T) {
+		endpoint, _, keepalives := newKeepaliveTestServer(t, 100)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		dt.Sampler = NewCountSampler(2)
+		dt.TCPKeepalive = true
+		var observed int
+		dt.ObserveTCPKeepalive = func(time.Duration) { observed++ }
+		for range 4 {
+			_, err := dt.Exchange(context.Background(), newQuery())
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(4), keepalives.Load())
+		require.Equal(t, 2, observed)
+	})
+
+	t.Run("RetryPolicy still records the flags of each attempt", func(t *testing.T) {
+		dt := newTransport()
+		var responses int
+		dt.ObserveRawResponse = func([]byte) { responses++ }
+		for range 2 {
+			_, attempts, err := NewRetryPolicy(dt).Exchange(context.Background(), newQuery())
+			require.NoError(t, err)
+			require.NotNil(t, attempts[0].Flags)
+		}
+		require.Equal(t, 1, responses)
+	})
+}
+
+// countingSlogHandler is a [slog.Handler] counting the records.
+type countingSlogHandler struct {
+	slog.Handler
+	count *int
+}
+
+// Handle implements [slog.Handler].
+func (h *countingSlogHandler) Handle(ctx context.Context, record slog.Record) error {
+	*h.count++
+	return h.Handler.Handle(ctx, record)
+}
@@ -0,0 +1,286 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrInvalidServerName indicates that the name we should use to authenticate
+// the server (RFC 8310 calls it the authentication domain name) is invalid.
+var ErrInvalidServerName = errors.New("dnsoverstream: invalid server name")
+
+// ErrServerNameMismatch indicates that the names configured for authenticating
+// the server disagree (e.g., the HTTP Host and the TLS ServerName), which
+// typically means the server name was plumbed incorrectly.
+var ErrServerNameMismatch = errors.New("dnsoverstream: server name mismatch")
+
+// ServerConfig describes an encrypted DNS server along with the name we use
+// to authenticate it, so that the TLS ServerName, the HTTP authority, and the
+// endpoint we dial all derive from a single source.
+//
+// Construct using [ParseServerURL] or by filling the fields and then use
+// [NewTransportFromServerConfig] to create the [*Transport].
+type ServerConfig struct {
+	// Protocol is the MANDATORY protocol, which is one of [ProtocolTLS],
+	// [ProtocolQUIC], [ProtocolHTTPS], [ProtocolHTTP1], or [ProtocolHTTP3].
+	Protocol string
+
+	// ServerName is the MANDATORY name we use to authenticate the server,
+	// which is either a domain name or an IP address.
+	ServerName string
+
+	// Endpoint is the MANDATORY endpoint we dial.
+	Endpoint netip.AddrPort
+
+	// Path is the OPTIONAL URL path for DNS over HTTPS. If empty, we
+	// use [DefaultHTTPSPath]. We ignore it for the other protocols.
+	Path string
+}
+
+// ParseServerURL parses a URL such as "tls://dns.google", "quic://[2a10:50c0::ad1:ff]",
+// or "https://dns.google/dns-query" and returns the corresponding [*ServerConfig].
+//
+// The "dot", "doq", and "h3" schemes are aliases for [ProtocolTLS], [ProtocolQUIC],
+// and [ProtocolHTTP3]. The server name is the URL host. When the host is an IP
+// address, addr is OPTIONAL and, if valid, must be equal to the host. Otherwise,
+// addr is MANDATORY since resolving the host is the caller's job. We use the
+// URL port or the default port for the protocol.
+//
+// This function returns errors wrapping [ErrUnknownProtocol], [ErrInvalidEndpoint],
+// [ErrInvalidServerName], or [ErrServerNameMismatch].
+func ParseServerURL(rawURL string, addr netip.Addr) (*ServerConfig, error) {
+	// 1. parse the URL and reject what we cannot honour
+	URL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEndpoint, err)
+	}
+	if URL.User != nil || URL.RawQuery != "" || URL.Fragment != "" || URL.Opaque != "" {
+		return nil, fmt.Errorf("%w: %q: unexpected userinfo, query, or fragment", ErrInvalidEndpoint, rawURL)
+	}
+
+	// 2. map the scheme to the protocol and the default port
+	config := &ServerConfig{}
+	var port uint16
+	switch strings.ToLower(URL.Scheme) {
+	case ProtocolTLS, "dot":
+		config.Protocol, port = ProtocolTLS, DefaultPortTLS
+	case ProtocolQUIC, "doq":
+		config.Protocol, port = ProtocolQUIC, DefaultPortQUIC
+	case ProtocolHTTPS:
+		config.Protocol, port = ProtocolHTTPS, DefaultPortHTTPS
+	case ProtocolHTTP3, "h3":
+		config.Protocol, port = ProtocolHTTP3, DefaultPortHTTPS
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, URL.Scheme)
+	}
+
+	// 3. only DNS over HTTPS has a meaningful path
+	path := strings.TrimSuffix(URL.Path, "/")
+	switch config.Protocol {
+	case ProtocolHTTPS, ProtocolHTTP3:
+		config.Path = URL.Path
+	default:
+		if path != "" {
+			return nil, fmt.Errorf("%w: %q: unexpected path", ErrInvalidEndpoint, rawURL)
+		}
+	}
+
+	// 4. use the URL port if present
+	if value := URL.Port(); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || parsed == 0 {
+			return nil, fmt.Errorf("%w: %q: invalid port", ErrInvalidEndpoint, rawURL)
+		}
+		port = uint16(parsed)
+	}
+
+	// 5. derive the server name and the address from the host
+	host := URL.Hostname()
+	if hostaddr, err := netip.ParseAddr(host); err == nil {
+		if addr.IsValid() && addr.WithZone("") != hostaddr.WithZone("") {
+			return nil, fmt.Errorf("%w: %q: address %s", ErrServerNameMismatch, rawURL, addr)
+		}
+		if !addr.IsValid() {
+			addr = hostaddr
+		}
+		host = hostaddr.WithZone("").String()
+	}
+	if !addr.IsValid() {
+		return nil, fmt.Errorf("%w: %q: missing address for %q", ErrInvalidEndpoint, rawURL, host)
+	}
+	config.ServerName = host
+	config.Endpoint = netip.AddrPortFrom(addr, port)
+
+	// 6. make sure the server name is usable
+	if err := checkServerName(config.ServerName); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checkServerName returns an error wrapping [ErrInvalidServerName] if
+// the name is neither an IP address without zone nor a domain name.
+func checkServerName(name string) error {
+	if addr, err := netip.ParseAddr(name); err == nil {
+		if addr.Zone() != "" {
+			return fmt.Errorf("%w: %q", ErrInvalidServerName, name)
+		}
+		return nil
+	}
+	if name == "" || strings.HasSuffix(name, ".") {
+		return fmt.Errorf("%w: %q", ErrInvalidServerName, name)
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidServerName, name)
+	}
+	return nil
+}
+
+// NewTransportFromServerConfig creates a new [*Transport] using the presets
+// for the configured protocol, where the server name becomes both the TLS
+// ServerName and, for DNS over HTTPS, the HTTP authority.
+//
+// This function returns errors wrapping [ErrUnknownProtocol], [ErrInvalidEndpoint],
+// or [ErrInvalidServerName].
+func NewTransportFromServerConfig(config *ServerConfig) (*Transport, error) {
+	// 1. verify the configuration
+	if err := checkServerName(config.ServerName); err != nil {
+		return nil, err
+	}
+	if !config.Endpoint.IsValid() || config.Endpoint.Port() == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidEndpoint, config.Endpoint)
+	}
+
+	// 2. create the dialer using the presets
+	var dialer StreamOpenerDialer
+	switch config.Protocol {
+	case ProtocolTLS:
+		dialer = NewStreamOpenerDialerTLS(NewTLSDialerDNSOverTLS(config.ServerName))
+	case ProtocolQUIC:
+		dialer = NewStreamOpenerDialerQUIC(newServerConfigQUICDialer(NewTLSConfigDNSOverQUIC(config.ServerName)))
+	case ProtocolHTTPS:
+		https := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: NewTLSConfigDNSOverHTTPS(config.ServerName)})
+		https.Path = config.Path
+		dialer = https
+	case ProtocolHTTP1:
+		https := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: &tls.Config{
+			NextProtos: []string{"http/1.1"},
+			ServerName: config.ServerName,
+		}})
+		https.Path = config.Path
+		https.HTTP1 = true
+		dialer = https
+	case ProtocolHTTP3:
+		http3 := NewStreamOpenerDialerHTTP3(newServerConfigQUICDialer(NewTLSConfigDNSOverHTTP3(config.ServerName)))
+		http3.Path = config.Path
+		dialer = http3
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownProtocol, config.Protocol)
+	}
+	return NewTransport(dialer, config.Endpoint), nil
+}
+
+// newServerConfigQUICDialer returns a [*QUICDialer] using a connected UDP socket
+// for each connection, so that closing the connection also closes the socket.
+func newServerConfigQUICDialer(config *tls.Config) *QUICDialer {
+	return &QUICDialer{TLSConfig: config, ConnectedUDP: true}
+}
+
+// ServerName returns the name the [*Transport] uses to authenticate the server,
+// which allows to verify the server name plumbing before exchanging messages.
+//
+// For TLS, QUIC, and DNS over HTTPS, this is the TLS ServerName or, when empty,
+// the endpoint address, which is what the dialers verify the certificate against.
+// For DNSCrypt, this is the provider name, and for Oblivious DoH, this is the
+// target host. For protocols that do not authenticate the server (e.g., UDP) or
+// custom dialers, this is empty.
+//
+// This method returns an error wrapping [ErrServerNameMismatch] when the HTTP
+// Host of DNS over HTTPS is configured and disagrees with the TLS ServerName.
+func (dt *Transport) ServerName() (string, error) {
+	// 1. obtain the configured names
+	name, authenticated := dialerServerName(dt.dialer)
+	host := dialerHTTPHost(dt.dialer)
+
+	// 2. make sure the HTTP authority refers to the same server
+	if host != "" && name != "" {
+		if hostname := tlsServerNameFromAddress(host); !strings.EqualFold(hostname, name) {
+			return "", fmt.Errorf("%w: HTTP host %q but TLS server name %q", ErrServerNameMismatch, host, name)
+		}
+	}
+
+	// 3. fall back to the endpoint like the dialers do
+	if name == "" && authenticated {
+		name = tlsServerNameFromAddress(dt.endpoint.String())
+	}
+	return name, nil
+}
+
+// dialerServerName returns the configured server name of the dialer, which
+// may be empty, and whether the dialer authenticates the server using TLS.
+func dialerServerName(dialer StreamOpenerDialer) (string, bool) {
+	switch dialer := dialer.(type) {
+	case *StreamOpenerDialerDNSCrypt:
+		return dialer.ProviderName, false
+
+	case *StreamOpenerDialerTLS:
+		return tlsDialerServerName(dialer.Dialer), true
+
+	case *StreamOpenerDialerHTTPS:
+		return tlsDialerServerName(dialer.Dialer), true
+
+	case *StreamOpenerDialerODoH:
+		return dialer.TargetHost, false
+
+	case *StreamOpenerDialerHTTPSJSON:
+		return tlsDialerServerName(dialer.Dialer.Dialer), true
+
+	case *StreamOpenerDialerQUIC:
+		return quicDialerServerName(dialer.Dialer), true
+
+	case *StreamOpenerDialerHTTP3:
+		return quicDialerServerName(dialer.Dialer), true
+
+	default:
+		return "", false
+	}
+}
+
+// dialerHTTPHost returns the configured HTTP Host of the dialer, if any.
+func dialerHTTPHost(dialer StreamOpenerDialer) string {
+	switch dialer := dialer.(type) {
+	case *StreamOpenerDialerHTTPS:
+		return dialer.Host
+	case *StreamOpenerDialerHTTPSJSON:
+		return dialer.Dialer.Host
+	case *StreamOpenerDialerHTTP3:
+		return dialer.Host
+	default:
+		return ""
+	}
+}
+
+// tlsDialerServerName returns the ServerName of a [*tls.Dialer] or [*NetTLSDialer].
+func tlsDialerServerName(dialer TLSDialer) string {
+	if config, ok := tlsDialerConfig(dialer); ok && config != nil {
+		return config.ServerName
+	}
+	return ""
+}
+
+// quicDialerServerName returns the ServerName of a [*QUICDialer].
+func quicDialerServerName(dialer *QUICDialer) string {
+	if dialer != nil && dialer.TLSConfig != nil {
+		return dialer.TLSConfig.ServerName
+	}
+	return ""
+}
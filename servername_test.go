@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"crypto/tls"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseServerURL(t *testing.T) {
+	addr := netip.MustParseAddr("8.8.8.8")
+
+	t.Run("valid URLs", func(t *testing.T) {
+		cases := []struct {
+			rawURL   string
+			addr     netip.Addr
+			expected ServerConfig
+		}{
+			{"tls://dns.google", addr, ServerConfig{
+				Protocol: ProtocolTLS, ServerName: "dns.google", Endpoint: netip.MustParseAddrPort("8.8.8.8:853"),
+			}},
+			{"dot://dns.google:443", addr, ServerConfig{
+				Protocol: ProtocolTLS, ServerName: "dns.google", Endpoint: netip.MustParseAddrPort("8.8.8.8:443"),
+			}},
+			{"doq://[2a10:50c0::ad1:ff]", netip.Addr{}, ServerConfig{
+				Protocol: ProtocolQUIC, ServerName: "2a10:50c0::ad1:ff", Endpoint: netip.MustParseAddrPort("[2a10:50c0::ad1:ff]:853"),
+			}},
+			{"https://dns.google/dns-query", addr, ServerConfig{
+				Protocol: ProtocolHTTPS, ServerName: "dns.google", Endpoint: netip.MustParseAddrPort("8.8.8.8:443"), Path: "/dns-query",
+			}},
+			{"h3://8.8.8.8/resolve", addr, ServerConfig{
+				Protocol: ProtocolHTTP3, ServerName: "8.8.8.8", Endpoint: netip.MustParseAddrPort("8.8.8.8:443"), Path: "/resolve",
+			}},
+		}
+		for _, tc := range cases {
+			t.Run(tc.rawURL, func(t *testing.T) {
+				config, err := ParseServerURL(tc.rawURL, tc.addr)
+				require.NoError(t, err)
+				require.Equal(t, tc.expected, *config)
+			})
+		}
+	})
+
+	t.Run("invalid URLs", func(t *testing.T) {
+		cases := []struct {
+			rawURL   string
+			addr     netip.Addr
+			expected error
+		}{
+			{"udp://8.8.8.8", netip.Addr{}, ErrUnknownProtocol},
+			{"tls://dns.google", netip.Addr{}, ErrInvalidEndpoint},
+			{"tls://dns.google/dns-query", addr, ErrInvalidEndpoint},
+			{"tls://dns.google:0", addr, ErrInvalidEndpoint},
+			{"https://user@dns.google/dns-query", addr, ErrInvalidEndpoint},
+			{"https://dns.google/dns-query?dns=AAAA", addr, ErrInvalidEndpoint},
+			{"tls://1.1.1.1", addr, ErrServerNameMismatch},
+			{"tls://dns.google.", addr, ErrInvalidServerName},
+			{"tls://", addr, ErrInvalidServerName},
+		}
+		for _, tc := range cases {
+			t.Run(tc.rawURL, func(t *testing.T) {
+				config, err := ParseServerURL(tc.rawURL, tc.addr)
+				require.ErrorIs(t, err, tc.expected)
+				require.Nil(t, config)
+			})
+		}
+	})
+}
+
+func TestNewTransportFromServerConfig(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("8.8.8.8:853")
+
+	t.Run("derives the server name for each protocol", func(t *testing.T) {
+		for _, protocol := range []string{ProtocolTLS, ProtocolQUIC, ProtocolHTTPS, ProtocolHTTP1, ProtocolHTTP3} {
+			t.Run(protocol, func(t *testing.T) {
+				config := &ServerConfig{Protocol: protocol, ServerName: "dns.google", Endpoint: endpoint, Path: "/resolve"}
+				dt, err := NewTransportFromServerConfig(config)
+				require.NoError(t, err)
+				name, err := dt.ServerName()
+				require.NoError(t, err)
+				require.Equal(t, "dns.google", name)
+				key := newPoolKey(dt.dialer, dt.endpoint)
+				require.Equal(t, protocol, key.Protocol)
+				require.Equal(t, endpoint, key.Endpoint)
+				require.Equal(t, "dns.google", key.ServerName)
+			})
+		}
+	})
+
+	t.Run("uses the path for DNS over HTTPS", func(t *testing.T) {
+		config := &ServerConfig{Protocol: ProtocolHTTPS, ServerName: "dns.google", Endpoint: endpoint, Path: "/resolve"}
+		dt, err := NewTransportFromServerConfig(config)
+		require.NoError(t, err)
+		require.Equal(t, "https://dns.google/resolve", dt.dialer.(*StreamOpenerDialerHTTPS).url(endpoint))
+	})
+
+	t.Run("rejects invalid configurations", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			config   ServerConfig
+			expected error
+		}{
+			{"empty server name", ServerConfig{Protocol: ProtocolTLS, Endpoint: endpoint}, ErrInvalidServerName},
+			{"scoped address", ServerConfig{Protocol: ProtocolTLS, ServerName: "fe80::1%eth0", Endpoint: endpoint}, ErrInvalidServerName},
+			{"missing endpoint", ServerConfig{Protocol: ProtocolTLS, ServerName: "dns.google"}, ErrInvalidEndpoint},
+			{"unencrypted protocol", ServerConfig{Protocol: ProtocolUDP, ServerName: "dns.google", Endpoint: endpoint}, ErrUnknownProtocol},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				dt, err := NewTransportFromServerConfig(&tc.config)
+				require.ErrorIs(t, err, tc.expected)
+				require.Nil(t, dt)
+			})
+		}
+	})
+}
+
+func TestTransportServerName(t *testing.T) {
+	endpoint := netip.MustParseAddrPort("[2001:4860:4860::8888]:853")
+
+	t.Run("falls back to the endpoint address for TLS", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTLS(&tls.Dialer{}), endpoint)
+		name, err := dt.ServerName()
+		require.NoError(t, err)
+		require.Equal(t, "2001:4860:4860::8888", name)
+	})
+
+	t.Run("is empty for unauthenticated protocols", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(nil), endpoint)
+		name, err := dt.ServerName()
+		require.NoError(t, err)
+		require.Empty(t, name)
+	})
+
+	t.Run("is the provider name for DNSCrypt", func(t *testing.T) {
+		dt := NewTransport(&StreamOpenerDialerDNSCrypt{ProviderName: "2.dnscrypt-cert.example.com"}, endpoint)
+		name, err := dt.ServerName()
+		require.NoError(t, err)
+		require.Equal(t, "2.dnscrypt-cert.example.com", name)
+	})
+
+	t.Run("accepts an HTTP host agreeing with the TLS server name", func(t *testing.T) {
+		dialer := NewStreamOpenerDialerHTTPS(&tls.Dialer{Config: NewTLSConfigDNSOverHTTPS("dns.google")})
+		dialer.Host = "DNS.google:443"
+		name, err := NewTransport(dialer, endpoint).ServerName()
+		require.NoError(t, err)
+		require.Equal(t, "dns.google", name)
+	})
+
+	t.Run("fails when the HTTP host disagrees with the TLS server name", func(t *testing.T) {
+		dialer := NewStreamOpenerDialerHTTP3(&QUICDialer{TLSConfig: NewTLSConfigDNSOverHTTP3("dns.google")})
+		dialer.Host = "dns.quad9.net"
+		name, err := NewTransport(dialer, endpoint).ServerName()
+		require.ErrorIs(t, err, ErrServerNameMismatch)
+		require.Empty(t, name)
+	})
+}
@@ -0,0 +1,351 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"container/list"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SessionTicketStore persists the serialized TLS sessions used by
+// [*PersistentSessionCache] across process restarts.
+//
+// Implementations must be safe for concurrent use.
+type SessionTicketStore interface {
+	// LoadSessionTicket returns the session stored for key, or
+	// [os.ErrNotExist] when there is no such session.
+	LoadSessionTicket(key string) ([]byte, error)
+
+	// StoreSessionTicket stores the session for key, or deletes
+	// the session for key when data is nil.
+	StoreSessionTicket(key string, data []byte) error
+}
+
+// DefaultSessionCacheMaxSessions is the default maximum number of sessions
+// a [*PersistentSessionCache] keeps in memory.
+const DefaultSessionCacheMaxSessions = 64
+
+// PersistentSessionCache is a [tls.ClientSessionCache] that persists the
+// sessions using a [SessionTicketStore], so that short-lived processes can
+// still measure session resumption and 0-RTT.
+//
+// The cache keys are those chosen by [crypto/tls] or quic-go, which is the
+// server name or, when there is none, the server address. When dialing using
+// [*StreamOpenerDialerTLS], [*StreamOpenerDialerHTTPS], or [*QUICDialer], we
+// also include the endpoint in the keys, so that the endpoints sharing the same
+// server name (e.g., the instances of a resolver) do not share the sessions.
+// The persisted sessions include the state quic-go needs for 0-RTT (see
+// [QUICDialer] Allow0RTT).
+//
+// We keep the recently used sessions in memory and access the store without
+// holding the mutex, so that a slow store does not block the other handshakes.
+//
+// Assign to the ClientSessionCache field of the [*tls.Config].
+//
+// Construct using [NewPersistentSessionCache].
+type PersistentSessionCache struct {
+	// ObserveError is an optional hook called with the errors occurring
+	// when loading or storing sessions, which we otherwise ignore, since
+	// [tls.ClientSessionCache] cannot return errors.
+	ObserveError func(err error)
+
+	// MaxSessions is the OPTIONAL maximum number of sessions we keep in
+	// memory, evicting the least recently used ones, which remain in the
+	// store. If zero or negative, we use [DefaultSessionCacheMaxSessions].
+	MaxSessions int
+
+	// store is the [SessionTicketStore].
+	store SessionTicketStore
+
+	// mu protects lru and sessions.
+	mu sync.Mutex
+
+	// lru contains the [*sessionCacheEntry] in memory, most recently used first.
+	lru *list.List
+
+	// sessions maps each key to its lru element.
+	sessions map[string]*list.Element
+}
+
+// sessionCacheEntry is an entry inside the [*PersistentSessionCache] LRU.
+type sessionCacheEntry struct {
+	key string
+	cs  *tls.ClientSessionState
+}
+
+// NewPersistentSessionCache creates a new [*PersistentSessionCache] using the given store.
+func NewPersistentSessionCache(store SessionTicketStore) *PersistentSessionCache {
+	return &PersistentSessionCache{
+		store:    store,
+		lru:      list.New(),
+		sessions: make(map[string]*list.Element),
+	}
+}
+
+var _ tls.ClientSessionCache = &PersistentSessionCache{}
+
+// persistedSession is the serialized form of a [*tls.ClientSessionState].
+type persistedSession struct {
+	// Ticket is the session ticket.
+	Ticket []byte `json:"ticket"`
+
+	// State is the serialized [*tls.SessionState].
+	State []byte `json:"state"`
+}
+
+// Get implements [tls.ClientSessionCache].
+func (c *PersistentSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	// 1. use the session we already have in memory
+	c.mu.Lock()
+	if elem, found := c.sessions[key]; found {
+		c.lru.MoveToFront(elem)
+		cs := elem.Value.(*sessionCacheEntry).cs
+		c.mu.Unlock()
+		return cs, true
+	}
+	c.mu.Unlock()
+
+	// 2. otherwise, attempt to load the session from the store
+	cs, err := c.load(key)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			c.observeError(err)
+		}
+		return nil, false
+	}
+
+	// 3. prefer a session stored by a concurrent Put while loading
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.sessions[key]; found {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*sessionCacheEntry).cs, true
+	}
+	c.addLocked(key, cs)
+	return cs, true
+}
+
+// addLocked adds or replaces the session for key and evicts the
+// least recently used sessions exceeding MaxSessions.
+//
+// The caller MUST hold the mutex.
+func (c *PersistentSessionCache) addLocked(key string, cs *tls.ClientSessionState) {
+	if elem, found := c.sessions[key]; found {
+		elem.Value.(*sessionCacheEntry).cs = cs
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.sessions[key] = c.lru.PushFront(&sessionCacheEntry{key: key, cs: cs})
+	maxSessions := c.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultSessionCacheMaxSessions
+	}
+	for c.lru.Len() > maxSessions {
+		c.removeLocked(c.lru.Back())
+	}
+}
+
+// removeLocked removes the given element from memory.
+//
+// The caller MUST hold the mutex.
+func (c *PersistentSessionCache) removeLocked(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.sessions, elem.Value.(*sessionCacheEntry).key)
+}
+
+// load loads and parses the session for key from the store.
+func (c *PersistentSessionCache) load(key string) (*tls.ClientSessionState, error) {
+	data, err := c.store.LoadSessionTicket(key)
+	if err != nil {
+		return nil, err
+	}
+	var ps persistedSession
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, err
+	}
+	state, err := tls.ParseSessionState(ps.State)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(ps.Ticket, state)
+}
+
+// Put implements [tls.ClientSessionCache].
+//
+// A nil cs deletes the session for key, which [crypto/tls] does
+// when the server does not accept resuming the session.
+func (c *PersistentSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	// 1. update the sessions in memory
+	c.mu.Lock()
+	if cs == nil {
+		if elem, found := c.sessions[key]; found {
+			c.removeLocked(elem)
+		}
+	} else {
+		c.addLocked(key, cs)
+	}
+	c.mu.Unlock()
+
+	// 2. update the store without holding the mutex
+	if cs == nil {
+		c.observeError(c.store.StoreSessionTicket(key, nil))
+		return
+	}
+	data, err := c.serialize(cs)
+	if err != nil {
+		c.observeError(err)
+		return
+	}
+	c.observeError(c.store.StoreSessionTicket(key, data))
+}
+
+// serialize serializes the given [*tls.ClientSessionState].
+func (c *PersistentSessionCache) serialize(cs *tls.ClientSessionState) ([]byte, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, errors.New("dnsoverstream: session without resumption state")
+	}
+	rawState, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(persistedSession{Ticket: ticket, State: rawState})
+}
+
+// observeError calls ObserveError with non-nil errors.
+func (c *PersistentSessionCache) observeError(err error) {
+	if err != nil && c.ObserveError != nil {
+		c.ObserveError(err)
+	}
+}
+
+// endpointSessionCache is the view of a [*PersistentSessionCache]
+// whose keys include the endpoint we are dialing.
+type endpointSessionCache struct {
+	cache    *PersistentSessionCache
+	endpoint string
+}
+
+var _ tls.ClientSessionCache = &endpointSessionCache{}
+
+// Get implements [tls.ClientSessionCache].
+func (c *endpointSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.key(key))
+}
+
+// Put implements [tls.ClientSessionCache].
+func (c *endpointSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.key(key), cs)
+}
+
+// key returns the key including the endpoint (e.g., "dns.google@8.8.8.8:853").
+func (c *endpointSessionCache) key(key string) string {
+	return key + "@" + c.endpoint
+}
+
+// tlsConfigForEndpoint returns config or, when its ClientSessionCache is
+// a [*PersistentSessionCache], a clone whose cache keys include endpoint.
+func tlsConfigForEndpoint(config *tls.Config, endpoint string) *tls.Config {
+	if config == nil {
+		return nil
+	}
+	cache, ok := config.ClientSessionCache.(*PersistentSessionCache)
+	if !ok {
+		return config
+	}
+	config = config.Clone()
+	config.ClientSessionCache = &endpointSessionCache{cache: cache, endpoint: endpoint}
+	return config
+}
+
+// tlsDialerForEndpoint is like [tlsConfigForEndpoint] but returns a copy
+// of a [*tls.Dialer] or [*NetTLSDialer] using the resulting config.
+func tlsDialerForEndpoint(dialer TLSDialer, endpoint string) TLSDialer {
+	config, ok := tlsDialerConfig(dialer)
+	if !ok {
+		return dialer
+	}
+	if scoped := tlsConfigForEndpoint(config, endpoint); scoped != config {
+		return tlsDialerWithConfig(dialer, scoped)
+	}
+	return dialer
+}
+
+// FileSessionTicketStore implements [SessionTicketStore] storing each
+// session as a file inside a directory, which we create if needed.
+//
+// The sessions allow resuming TLS connections, hence the files contain
+// secrets and we create them readable only by the current user.
+//
+// Construct using [NewFileSessionTicketStore].
+type FileSessionTicketStore struct {
+	// dir is the directory containing the sessions.
+	dir string
+}
+
+// NewFileSessionTicketStore creates a new [*FileSessionTicketStore] using dir.
+func NewFileSessionTicketStore(dir string) *FileSessionTicketStore {
+	return &FileSessionTicketStore{dir: dir}
+}
+
+var _ SessionTicketStore = &FileSessionTicketStore{}
+
+// LoadSessionTicket implements [SessionTicketStore].
+func (s *FileSessionTicketStore) LoadSessionTicket(key string) ([]byte, error) {
+	return os.ReadFile(s.path(key))
+}
+
+// StoreSessionTicket implements [SessionTicketStore].
+//
+// We write a temporary file and rename it, so that concurrent
+// processes never read a partially written session.
+func (s *FileSessionTicketStore) StoreSessionTicket(key string, data []byte) error {
+	// 1. handle deleting the session
+	path := s.path(key)
+	if data == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	// 2. write the session to a temporary file
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(s.dir, "session-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	// 3. atomically replace the previous session
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file containing the session for key, which
+// we hex encode, since keys may contain characters not valid in file names.
+func (s *FileSessionTicketStore) path(key string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(key))+".json")
+}
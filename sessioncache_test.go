@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentSessionCache(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+
+	t.Run("resumes TLS sessions after a restart", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+		t.Cleanup(srv.Close)
+		dir := t.TempDir()
+		observe, kinds := collectHandshakeKinds()
+
+		// each iteration simulates a new process using the same directory
+		for range 2 {
+			tlsConfig := newTestClientTLSConfig("dot")
+			tlsConfig.ClientSessionCache = NewPersistentSessionCache(NewFileSessionTicketStore(dir))
+			dt := NewTransport(NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig}), netip.MustParseAddrPort(srv.Address()))
+			dt.ObserveTiming = observe
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Equal(t, []HandshakeKind{HandshakeFull, HandshakeResumed}, kinds())
+	})
+
+	t.Run("sends QUIC 0-RTT early data after a restart", func(t *testing.T) {
+		srv := newDoQTestServer(t, dnstest.NewHandler(config).PrepareResponse)
+		dir := t.TempDir()
+		observe, kinds := collectHandshakeKinds()
+
+		for range 2 {
+			pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer pconn.Close()
+			quicDialer := NewQUICDialer(pconn, "example.com")
+			quicDialer.TLSConfig = newTestClientTLSConfig("doq")
+			quicDialer.TLSConfig.ClientSessionCache = NewPersistentSessionCache(NewFileSessionTicketStore(dir))
+			quicDialer.Allow0RTT = true
+			dt := NewTransport(NewStreamOpenerDialerQUIC(quicDialer), srv.Endpoint())
+			dt.ObserveTiming = observe
+			_, err = dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Equal(t, []HandshakeKind{HandshakeFull, HandshakeEarlyData}, kinds())
+	})
+
+	t.Run("keeps the sessions of each endpoint separate", func(t *testing.T) {
+		cache := NewPersistentSessionCache(NewFileSessionTicketStore(t.TempDir()))
+		var endpoints []string
+		for range 2 {
+			srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+			t.Cleanup(srv.Close)
+			tlsConfig := newTestClientTLSConfig("dot")
+			tlsConfig.ClientSessionCache = cache
+			dt := NewTransport(NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig}), netip.MustParseAddrPort(srv.Address()))
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+			endpoints = append(endpoints, srv.Address())
+		}
+		serverName := newTestClientTLSConfig("dot").ServerName
+		for _, endpoint := range endpoints {
+			_, found := cache.Get(serverName + "@" + endpoint)
+			require.True(t, found)
+		}
+		_, found := cache.Get(serverName)
+		require.False(t, found)
+	})
+
+	t.Run("deletes the sessions crypto/tls invalidates", func(t *testing.T) {
+		dir := t.TempDir()
+		store := NewFileSessionTicketStore(dir)
+		require.NoError(t, store.StoreSessionTicket("example.com", []byte("{}")))
+		cache := NewPersistentSessionCache(store)
+		cache.Put("example.com", nil)
+		_, err := store.LoadSessionTicket("example.com")
+		require.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("ignores corrupt sessions", func(t *testing.T) {
+		store := NewFileSessionTicketStore(t.TempDir())
+		require.NoError(t, store.StoreSessionTicket("example.com", []byte("{")))
+		cache := NewPersistentSessionCache(store)
+		var errs []error
+		cache.ObserveError = func(err error) {
+			errs = append(errs, err)
+		}
+		_, found := cache.Get("example.com")
+		require.False(t, found)
+		require.Len(t, errs, 1)
+
+		// a missing session is not an error
+		_, found = cache.Get("dns.google")
+		require.False(t, found)
+		require.Len(t, errs, 1)
+	})
+
+	t.Run("keeps at most MaxSessions sessions in memory", func(t *testing.T) {
+		cache := NewPersistentSessionCache(NewFileSessionTicketStore(t.TempDir()))
+		cache.ObserveError = func(err error) {} // cannot serialize empty sessions
+		cache.MaxSessions = 2
+		cache.Put("a.example.com", &tls.ClientSessionState{})
+		cache.Put("b.example.com", &tls.ClientSessionState{})
+		_, found := cache.Get("a.example.com")
+		require.True(t, found)
+		cache.Put("c.example.com", &tls.ClientSessionState{})
+
+		require.Equal(t, 2, cache.lru.Len())
+		require.Len(t, cache.sessions, 2)
+		require.NotContains(t, cache.sessions, "b.example.com")
+		require.Contains(t, cache.sessions, "a.example.com")
+		require.Contains(t, cache.sessions, "c.example.com")
+	})
+
+	t.Run("does not hold the lock while storing sessions", func(t *testing.T) {
+		store := &blockingSessionTicketStore{
+			SessionTicketStore: NewFileSessionTicketStore(t.TempDir()),
+			storing:            make(chan struct{}),
+			release:            make(chan struct{}),
+		}
+		cache := NewPersistentSessionCache(store)
+		cache.ObserveError = func(err error) {}
+		cs := &tls.ClientSessionState{}
+		cache.addLocked("dns.google", cs)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			cache.Put("example.com", nil)
+		}()
+		<-store.storing
+		got, found := cache.Get("dns.google")
+		require.True(t, found)
+		require.Same(t, cs, got)
+		close(store.release)
+		<-done
+	})
+}
+
+func TestFileSessionTicketStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store := NewFileSessionTicketStore(dir)
+
+	require.NoError(t, store.StoreSessionTicket("[::1]:853", []byte("first")))
+	require.NoError(t, store.StoreSessionTicket("[::1]:853", []byte("second")))
+	data, err := store.LoadSessionTicket("[::1]:853")
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), data)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	require.NoError(t, store.StoreSessionTicket("[::1]:853", nil))
+	require.NoError(t, store.StoreSessionTicket("[::1]:853", nil))
+	_, err = store.LoadSessionTicket("[::1]:853")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// blockingSessionTicketStore is a [SessionTicketStore] whose StoreSessionTicket
+// signals storing and then blocks until release is closed.
+type blockingSessionTicketStore struct {
+	SessionTicketStore
+	storing chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSessionTicketStore) StoreSessionTicket(key string, data []byte) error {
+	close(s.storing)
+	<-s.release
+	return s.SessionTicketStore.StoreSessionTicket(key, data)
+}
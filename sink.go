@@ -0,0 +1,246 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrSinkClosed indicates that we cannot write to a closed [*FileSink].
+var ErrSinkClosed = errors.New("dnsoverstream: sink closed")
+
+// DefaultFileSinkBatchSize is the default number of observations
+// a [*FileSink] buffers before writing them to the file.
+const DefaultFileSinkBatchSize = 128
+
+// DefaultFileSinkFlushInterval is the default time after which a [*FileSink]
+// writes the buffered observations on the next write.
+const DefaultFileSinkFlushInterval = time.Second
+
+// Sink persists observations, such as [ExchangeTiming], so that
+// measurement tools do not need to implement their own writers.
+//
+// Implementations must be safe for concurrent use, since the [*Transport]
+// hooks may run concurrently, for example:
+//
+//	dt.ObserveTiming = func(timing ExchangeTiming) {
+//		sink.WriteObservation(timing)
+//	}
+type Sink interface {
+	// WriteObservation persists the given observation.
+	WriteObservation(v any) error
+}
+
+// FileSink implements [Sink] by appending each observation to a file as a
+// line of JSON (JSONL), buffering observations to write them in batches, and
+// rotating the file when it becomes too large or too old.
+//
+// We write a batch when it contains MaxBatchSize observations or when writing
+// an observation more than FlushInterval after the first buffered one, so
+// call Flush or Close to write the observations buffered at the end of a run.
+//
+// When rotating, we rename the file by appending the UTC time of the rotation
+// to its name (e.g., "results.jsonl.20260102T150405.000000000Z") and write
+// the subsequent observations to a new file having the original name.
+//
+// Construct using [NewFileSink].
+type FileSink struct {
+	// MaxBatchSize is the OPTIONAL number of observations to buffer before
+	// writing them. If zero, we use [DefaultFileSinkBatchSize].
+	MaxBatchSize int
+
+	// FlushInterval is the OPTIONAL interval after which we write the buffered
+	// observations, which happens on the first write after FlushInterval has
+	// elapsed, since we do not use a timer. If zero, we use
+	// [DefaultFileSinkFlushInterval].
+	FlushInterval time.Duration
+
+	// MaxFileSize OPTIONALLY rotates the file before a write would make it
+	// larger than this number of bytes. If zero, we do not rotate by size.
+	MaxFileSize int64
+
+	// MaxFileAge OPTIONALLY rotates the file before writing when we opened it
+	// at least this long ago. If zero, we do not rotate by age.
+	MaxFileAge time.Duration
+
+	// TimeNow is the OPTIONAL function returning the current time.
+	// If nil, we use [time.Now].
+	TimeNow func() time.Time
+
+	// path is the path of the current file.
+	path string
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// batch contains the buffered JSONL lines.
+	batch []byte
+
+	// count is the number of buffered observations.
+	count int
+
+	// batchStart is when we buffered the first observation of the batch.
+	batchStart time.Time
+
+	// file is the current file or nil if we did not open it yet.
+	file *os.File
+
+	// size is the size of the current file.
+	size int64
+
+	// opened is when we opened the current file.
+	opened time.Time
+
+	// closed indicates that Close was called.
+	closed bool
+}
+
+// NewFileSink creates a new [*FileSink] writing to the file at path, which we
+// create, or append to when it exists, when writing the first batch.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+var _ Sink = &FileSink{}
+
+// WriteObservation implements [Sink].
+//
+// This method returns [ErrSinkClosed] after Close and, when it writes a batch,
+// the error occurred writing, in which case we drop the batch.
+func (s *FileSink) WriteObservation(v any) error {
+	// 1. serialize the observation outside of the lock
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// 2. buffer the observation
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSinkClosed
+	}
+	now := s.now()
+	if s.count <= 0 {
+		s.batchStart = now
+	}
+	s.batch = append(append(s.batch, data...), '\n')
+	s.count++
+
+	// 3. write the batch when it is full or too old
+	if s.count >= s.maxBatchSize() || now.Sub(s.batchStart) >= s.flushInterval() {
+		return s.flushLocked(now)
+	}
+	return nil
+}
+
+// Flush writes the buffered observations to the file.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked(s.now())
+}
+
+// Close writes the buffered observations and closes the file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.flushLocked(s.now())
+	if s.file != nil {
+		err = errors.Join(err, s.file.Close())
+		s.file = nil
+	}
+	return err
+}
+
+// flushLocked writes the batch rotating the file if needed.
+func (s *FileSink) flushLocked(now time.Time) error {
+	// 1. make sure there is something to write
+	if s.count <= 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch, s.count = s.batch[:0], 0
+
+	// 2. rotate the file if needed
+	if s.file != nil && s.shouldRotate(now, len(batch)) {
+		if err := s.rotateLocked(now); err != nil {
+			return err
+		}
+	}
+
+	// 3. open the file if needed
+	if s.file == nil {
+		if err := s.openLocked(now); err != nil {
+			return err
+		}
+	}
+
+	// 4. write the batch
+	count, err := s.file.Write(batch)
+	s.size += int64(count)
+	return err
+}
+
+// shouldRotate returns whether we should rotate before writing size bytes.
+func (s *FileSink) shouldRotate(now time.Time, size int) bool {
+	return (s.MaxFileSize > 0 && s.size > 0 && s.size+int64(size) > s.MaxFileSize) ||
+		(s.MaxFileAge > 0 && now.Sub(s.opened) >= s.MaxFileAge)
+}
+
+// openLocked opens the file for appending.
+func (s *FileSink) openLocked(now time.Time) error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size, s.opened = file, info.Size(), now
+	return nil
+}
+
+// rotateLocked closes the file and renames it using the current time.
+func (s *FileSink) rotateLocked(now time.Time) error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path, s.path+"."+now.UTC().Format("20060102T150405.000000000Z"))
+}
+
+// maxBatchSize returns MaxBatchSize or [DefaultFileSinkBatchSize].
+func (s *FileSink) maxBatchSize() int {
+	if s.MaxBatchSize > 0 {
+		return s.MaxBatchSize
+	}
+	return DefaultFileSinkBatchSize
+}
+
+// flushInterval returns FlushInterval or [DefaultFileSinkFlushInterval].
+func (s *FileSink) flushInterval() time.Duration {
+	if s.FlushInterval > 0 {
+		return s.FlushInterval
+	}
+	return DefaultFileSinkFlushInterval
+}
+
+// now returns the current time using TimeNow or [time.Now].
+func (s *FileSink) now() time.Time {
+	if s.TimeNow != nil {
+		return s.TimeNow()
+	}
+	return time.Now()
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// sinkTestObservation is the observation used by the [*FileSink] tests.
+type sinkTestObservation struct {
+	Seq int `json:"seq"`
+}
+
+// readSinkTestLines returns the JSONL lines of the file at path.
+func readSinkTestLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFileSink(t *testing.T) {
+	t.Run("writes observations in batches", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		sink := NewFileSink(path)
+		sink.MaxBatchSize = 3
+		sink.FlushInterval = time.Hour
+
+		for idx := range 2 {
+			require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: idx}))
+		}
+		_, err := os.Stat(path)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 2}))
+		require.Equal(t, []string{`{"seq":0}`, `{"seq":1}`, `{"seq":2}`}, readSinkTestLines(t, path))
+
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 3}))
+		require.Len(t, readSinkTestLines(t, path), 3)
+		require.NoError(t, sink.Flush())
+		require.Len(t, readSinkTestLines(t, path), 4)
+	})
+
+	t.Run("writes batches older than the flush interval", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+		sink := NewFileSink(path)
+		sink.FlushInterval = time.Second
+		sink.TimeNow = func() time.Time { return now }
+
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 0}))
+		_, err := os.Stat(path)
+		require.ErrorIs(t, err, os.ErrNotExist)
+
+		now = now.Add(time.Second)
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 1}))
+		require.Len(t, readSinkTestLines(t, path), 2)
+	})
+
+	t.Run("rotates by size", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+		sink := NewFileSink(path)
+		sink.MaxBatchSize = 1
+		sink.MaxFileSize = 20 // two observations
+		sink.TimeNow = func() time.Time { return now }
+
+		for idx := range 3 {
+			require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: idx}))
+		}
+		require.NoError(t, sink.Close())
+		require.Equal(t, []string{`{"seq":0}`, `{"seq":1}`},
+			readSinkTestLines(t, path+".20260102T150405.000000000Z"))
+		require.Equal(t, []string{`{"seq":2}`}, readSinkTestLines(t, path))
+	})
+
+	t.Run("rotates by age", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+		sink := NewFileSink(path)
+		sink.MaxBatchSize = 1
+		sink.MaxFileAge = time.Minute
+		sink.TimeNow = func() time.Time { return now }
+
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 0}))
+		now = now.Add(time.Minute)
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 1}))
+		require.NoError(t, sink.Close())
+		require.Equal(t, []string{`{"seq":0}`}, readSinkTestLines(t, path+".20260102T150505.000000000Z"))
+		require.Equal(t, []string{`{"seq":1}`}, readSinkTestLines(t, path))
+	})
+
+	t.Run("appends to an existing file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		require.NoError(t, os.WriteFile(path, []byte("{\"seq\":0}\n"), 0600))
+		sink := NewFileSink(path)
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{Seq: 1}))
+		require.NoError(t, sink.Close())
+		require.Len(t, readSinkTestLines(t, path), 2)
+	})
+
+	t.Run("refuses writing after close", func(t *testing.T) {
+		sink := NewFileSink(filepath.Join(t.TempDir(), "results.jsonl"))
+		require.NoError(t, sink.Close())
+		require.NoError(t, sink.Close())
+		require.ErrorIs(t, sink.WriteObservation(sinkTestObservation{}), ErrSinkClosed)
+	})
+
+	t.Run("returns errors opening the file", func(t *testing.T) {
+		sink := NewFileSink(filepath.Join(t.TempDir(), "missing", "results.jsonl"))
+		require.NoError(t, sink.WriteObservation(sinkTestObservation{}))
+		require.ErrorIs(t, sink.Close(), os.ErrNotExist)
+	})
+
+	t.Run("persists concurrent transport observations", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "results.jsonl")
+		sink := NewFileSink(path)
+		dt := NewTransport(NewStreamOpenerDialerHandler(newBenchHandler()), netip.MustParseAddrPort("127.0.0.1:53"))
+		dt.ObserveTiming = func(timing ExchangeTiming) {
+			require.NoError(t, sink.WriteObservation(timing))
+		}
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+				require.NoError(t, err)
+			})
+		}
+		wg.Wait()
+		require.NoError(t, sink.Close())
+
+		lines := readSinkTestLines(t, path)
+		require.Len(t, lines, 8)
+		for _, line := range lines {
+			var timing ExchangeTiming
+			require.NoError(t, json.Unmarshal([]byte(line), &timing))
+			require.NotZero(t, timing.TotalTime)
+		}
+	})
+}
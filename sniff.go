@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// ErrSniffUnknownProtocol indicates that [*Sniffer] could not complete
+// any handshake and therefore cannot guess the protocol.
+var ErrSniffUnknownProtocol = errors.New("dnsoverstream: cannot identify the protocol")
+
+// SniffProbe is a handshake performed by [*Sniffer], which is the evidence
+// supporting the protocol that [*Sniffer] guesses.
+type SniffProbe struct {
+	// Network is "tcp" for the TLS handshake and "udp" for the QUIC handshake.
+	Network string
+
+	// NextProtos contains the protocols we offered using ALPN.
+	NextProtos []string
+
+	// NegotiatedProtocol is the protocol the server selected using ALPN,
+	// which is empty if the handshake failed or the server did not use ALPN.
+	NegotiatedProtocol string
+
+	// Protocol is the protocol we infer from the handshake (e.g.,
+	// [ProtocolTLS]), which is empty if the handshake failed.
+	Protocol string
+
+	// Elapsed is the time spent performing the handshake.
+	Elapsed time.Duration
+
+	// Err is the handshake error or nil on success.
+	Err error
+}
+
+// SniffResult is the result of [*Sniffer.Sniff].
+type SniffResult struct {
+	// Endpoint is the endpoint we probed.
+	Endpoint netip.AddrPort
+
+	// Protocol is the best-guess protocol, which is one of [ProtocolTLS],
+	// [ProtocolQUIC], [ProtocolHTTPS], [ProtocolHTTP1], or [ProtocolHTTP3],
+	// or empty if we could not identify the protocol.
+	Protocol string
+
+	// Dialer is the [StreamOpenerDialer] for Protocol, which allows to
+	// feed the result to other measurements (e.g., the conformance
+	// package), or nil if we could not identify the protocol.
+	Dialer StreamOpenerDialer
+
+	// Probes contains a [SniffProbe] for each handshake we performed.
+	Probes []SniffProbe
+}
+
+// Sniffer identifies the protocol served by an unknown encrypted endpoint
+// using the protocols the server selects using ALPN.
+//
+// We perform, in parallel, a TLS handshake offering "dot", "h2", and
+// "http/1.1" and a QUIC handshake offering "doq" and "h3". We prefer the
+// DNS specific protocols, then the HTTP ones, and finally DNS over TLS
+// when the server completes the TLS handshake without using ALPN, which is
+// common for DNS over TLS servers. When two probes have the same rank, we
+// prefer TLS. Inspect the [SniffProbe] list to assess the guess.
+//
+// Construct using [NewSniffer].
+type Sniffer struct {
+	// TLSConfig is the MANDATORY [*tls.Config] (e.g., to set the ServerName),
+	// whose NextProtos we replace with the protocols of each probe.
+	TLSConfig *tls.Config
+
+	// NetDialer is the OPTIONAL [NetDialer] creating the TCP connections and
+	// the connected UDP sockets. If nil, we use a [*net.Dialer].
+	NetDialer NetDialer
+}
+
+// NewSniffer creates a new [*Sniffer] using the given [*tls.Config].
+func NewSniffer(tlsConfig *tls.Config) *Sniffer {
+	return &Sniffer{TLSConfig: tlsConfig}
+}
+
+// sniffRank returns the preference of a probed protocol, where
+// smaller values are better, given the negotiated protocol.
+func sniffRank(negotiated string) int {
+	switch negotiated {
+	case "dot", "doq":
+		return 0
+	case "h2", "h3", "http/1.1":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Sniff performs the handshakes with the given endpoint and returns the
+// [*SniffResult], which also contains the probes when we fail.
+//
+// The context bounds all the handshakes. We return an error wrapping
+// [ErrSniffUnknownProtocol] and the probe errors if all handshakes fail.
+func (s *Sniffer) Sniff(ctx context.Context, address netip.AddrPort) (*SniffResult, error) {
+	// 1. perform the handshakes in parallel
+	result := &SniffResult{Endpoint: address, Probes: make([]SniffProbe, 2)}
+	var wg sync.WaitGroup
+	wg.Go(func() { result.Probes[0] = s.probeTLS(ctx, address) })
+	wg.Go(func() { result.Probes[1] = s.probeQUIC(ctx, address) })
+	wg.Wait()
+
+	// 2. pick the successful probe with the best rank
+	var (
+		best *SniffProbe
+		errs []error
+	)
+	for idx := range result.Probes {
+		probe := &result.Probes[idx]
+		if probe.Err != nil {
+			errs = append(errs, probe.Err)
+			continue
+		}
+		if best == nil || sniffRank(probe.NegotiatedProtocol) < sniffRank(best.NegotiatedProtocol) {
+			best = probe
+		}
+	}
+	if best == nil {
+		return result, fmt.Errorf("%w: %s: %w", ErrSniffUnknownProtocol, address, errors.Join(errs...))
+	}
+
+	// 3. create the dialer for the protocol we guessed
+	result.Protocol = best.Protocol
+	result.Dialer = s.newDialer(best.Protocol)
+	return result, nil
+}
+
+// probeTLS performs the TLS handshake.
+func (s *Sniffer) probeTLS(ctx context.Context, address netip.AddrPort) SniffProbe {
+	probe := SniffProbe{Network: "tcp", NextProtos: []string{"dot", "h2", "http/1.1"}}
+	t0 := time.Now()
+	conn, err := NewNetTLSDialer(s.netDialer(), s.tlsConfig(probe.NextProtos...)).DialContext(ctx, "tcp", address.String())
+	probe.Elapsed = time.Since(t0)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer conn.Close()
+	probe.NegotiatedProtocol = tlsNegotiatedProtocol(conn)
+	switch probe.NegotiatedProtocol {
+	case "h2":
+		probe.Protocol = ProtocolHTTPS
+	case "http/1.1":
+		probe.Protocol = ProtocolHTTP1
+	default:
+		probe.Protocol = ProtocolTLS
+	}
+	return probe
+}
+
+// probeQUIC performs the QUIC handshake.
+func (s *Sniffer) probeQUIC(ctx context.Context, address netip.AddrPort) SniffProbe {
+	probe := SniffProbe{Network: "udp", NextProtos: []string{"doq", "h3"}}
+	t0 := time.Now()
+	qconn, err := s.quicDialer(probe.NextProtos...).Dial(ctx, address)
+	probe.Elapsed = time.Since(t0)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer qconn.CloseWithError(0, "")
+	probe.NegotiatedProtocol = qconn.ConnectionState().TLS.NegotiatedProtocol
+	switch probe.NegotiatedProtocol {
+	case "h3":
+		probe.Protocol = ProtocolHTTP3
+	default:
+		probe.Protocol = ProtocolQUIC
+	}
+	return probe
+}
+
+// newDialer returns the [StreamOpenerDialer] for the given protocol.
+func (s *Sniffer) newDialer(protocol string) StreamOpenerDialer {
+	switch protocol {
+	case ProtocolHTTPS:
+		return NewStreamOpenerDialerHTTPS(NewNetTLSDialer(s.netDialer(), s.tlsConfig("h2")))
+	case ProtocolHTTP1:
+		dialer := NewStreamOpenerDialerHTTPS(NewNetTLSDialer(s.netDialer(), s.tlsConfig("http/1.1")))
+		dialer.HTTP1 = true
+		return dialer
+	case ProtocolQUIC:
+		return NewStreamOpenerDialerQUIC(s.quicDialer("doq"))
+	case ProtocolHTTP3:
+		return NewStreamOpenerDialerHTTP3(s.quicDialer("h3"))
+	default:
+		return NewStreamOpenerDialerTLS(NewNetTLSDialer(s.netDialer(), s.tlsConfig("dot")))
+	}
+}
+
+// quicDialer returns a [*QUICDialer] using a connected UDP socket for each
+// connection, so that closing the connection also closes the socket.
+func (s *Sniffer) quicDialer(nextProtos ...string) *QUICDialer {
+	return &QUICDialer{
+		TLSConfig:    s.tlsConfig(nextProtos...),
+		ConnectedUDP: true,
+		UDPDialer:    s.netDialer(),
+	}
+}
+
+// tlsConfig returns a clone of the [*tls.Config] using the given protocols.
+func (s *Sniffer) tlsConfig(nextProtos ...string) *tls.Config {
+	config := s.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.NextProtos = nextProtos
+	return config
+}
+
+// netDialer returns the configured [NetDialer] or a [*net.Dialer].
+func (s *Sniffer) netDialer() NetDialer {
+	if s.NetDialer != nil {
+		return s.NetDialer
+	}
+	return &net.Dialer{}
+}
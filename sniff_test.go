@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newSniffTestDoTListener starts a TLS server negotiating "dot" that only
+// completes handshakes and returns its endpoint.
+func newSniffTestDoTListener(t *testing.T) netip.AddrPort {
+	config := &tls.Config{Certificates: []tls.Certificate{newTestCert()}, NextProtos: []string{"dot"}}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return netip.MustParseAddrPort(listener.Addr().String())
+}
+
+// sniffTestExchange exchanges a query using the dialer guessed by [*Sniffer].
+func sniffTestExchange(t *testing.T, result *SniffResult) {
+	dt := NewTransport(result.Dialer, result.Endpoint)
+	resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+	require.NoError(t, err)
+	addrs, err := resp.RecordsA()
+	require.NoError(t, err)
+	require.NotEmpty(t, addrs)
+}
+
+func TestSniffer(t *testing.T) {
+	newContext := func(t *testing.T) context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	t.Run("DNS over TLS without ALPN", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer srv.Close()
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), netip.MustParseAddrPort(srv.Address()))
+		require.NoError(t, err)
+		require.Equal(t, ProtocolTLS, result.Protocol)
+		require.Len(t, result.Probes, 2)
+		require.Equal(t, "tcp", result.Probes[0].Network)
+		require.Equal(t, []string{"dot", "h2", "http/1.1"}, result.Probes[0].NextProtos)
+		require.Empty(t, result.Probes[0].NegotiatedProtocol)
+		require.NoError(t, result.Probes[0].Err)
+		require.Equal(t, "udp", result.Probes[1].Network)
+		require.Error(t, result.Probes[1].Err)
+		require.Empty(t, result.Probes[1].Protocol)
+		sniffTestExchange(t, result)
+	})
+
+	t.Run("DNS over HTTPS", func(t *testing.T) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), endpoint)
+		require.NoError(t, err)
+		require.Equal(t, ProtocolHTTPS, result.Protocol)
+		require.Equal(t, "h2", result.Probes[0].NegotiatedProtocol)
+		sniffTestExchange(t, result)
+	})
+
+	t.Run("DNS over QUIC", func(t *testing.T) {
+		srv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), srv.Endpoint())
+		require.NoError(t, err)
+		require.Equal(t, ProtocolQUIC, result.Protocol)
+		require.Equal(t, "doq", result.Probes[1].NegotiatedProtocol)
+		sniffTestExchange(t, result)
+	})
+
+	t.Run("DNS over HTTP/3", func(t *testing.T) {
+		endpoint := newDoH3TestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), endpoint)
+		require.NoError(t, err)
+		require.Equal(t, ProtocolHTTP3, result.Protocol)
+		require.IsType(t, &StreamOpenerDialerHTTP3{}, result.Dialer)
+	})
+
+	t.Run("prefers DNS over QUIC to DNS over TLS without ALPN", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer srv.Close()
+		doq := newDoQTestServerAt(t, srv.Address(), newTestCert(), func(query *dns.Msg) []*dns.Msg {
+			return []*dns.Msg{newBenchHandler().PrepareResponse(query)}
+		})
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), doq.Endpoint())
+		require.NoError(t, err)
+		require.NoError(t, result.Probes[0].Err)
+		require.Equal(t, ProtocolQUIC, result.Protocol)
+	})
+
+	t.Run("prefers DNS over TLS to DNS over QUIC with the same rank", func(t *testing.T) {
+		endpoint := newSniffTestDoTListener(t)
+		newDoQTestServerAt(t, endpoint.String(), newTestCert(), func(query *dns.Msg) []*dns.Msg {
+			return []*dns.Msg{newBenchHandler().PrepareResponse(query)}
+		})
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), endpoint)
+		require.NoError(t, err)
+		require.Equal(t, "dot", result.Probes[0].NegotiatedProtocol)
+		require.Equal(t, "doq", result.Probes[1].NegotiatedProtocol)
+		require.Equal(t, ProtocolTLS, result.Protocol)
+	})
+
+	t.Run("fails with ErrSniffUnknownProtocol when all handshakes fail", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		endpoint := netip.MustParseAddrPort(listener.Addr().String())
+		listener.Close()
+		result, err := NewSniffer(newTestClientTLSConfig()).Sniff(newContext(t), endpoint)
+		require.ErrorIs(t, err, ErrSniffUnknownProtocol)
+		require.Empty(t, result.Protocol)
+		require.Nil(t, result.Dialer)
+		require.Len(t, result.Probes, 2)
+		for _, probe := range result.Probes {
+			require.Error(t, probe.Err)
+		}
+	})
+}
+
+func TestSniffRank(t *testing.T) {
+	require.Less(t, sniffRank("dot"), sniffRank("h2"))
+	require.Equal(t, sniffRank("dot"), sniffRank("doq"))
+	require.Less(t, sniffRank("h3"), sniffRank(""))
+}
@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrSocketOptionUnsupported indicates that [SocketOptions] contains an option
+// that the current platform does not support. Use [SupportedSocketOptions] to
+// check which options are available before configuring them.
+var ErrSocketOptionUnsupported = errors.New("dnsoverstream: socket option not supported")
+
+// SocketOptions contains socket options applied when creating sockets.
+//
+// Use [*SocketOptions.Control] as the Control field of a [*net.Dialer] (e.g.,
+// for TCP, TLS, UDP, and HTTPS) or of a [*net.ListenConfig] (e.g., for the
+// UDP socket used by QUIC). The zero value applies no options.
+//
+// The options map to the analogous platform options as follows:
+//
+//   - Interface: SO_BINDTODEVICE on Linux, IP_BOUND_IF and IPV6_BOUND_IF on
+//     macOS, and IP_UNICAST_IF and IPV6_UNICAST_IF on Windows.
+//
+//   - TCPUserTimeout: TCP_USER_TIMEOUT on Linux, TCP_RXT_CONNDROPTIME on
+//     macOS, and TCP_MAXRT on Windows (the latter two use seconds, so we round
+//     the timeout up to the next second).
+//
+//   - TOS: IP_TOS and IPV6_TCLASS on Linux and macOS. Windows ignores IP_TOS
+//     unless using the QoS APIs, so we report TOS as unsupported there.
+//
+// Setting an option the platform does not support fails with an error
+// wrapping [ErrSocketOptionUnsupported] rather than being silently ignored.
+type SocketOptions struct {
+	// Interface is the OPTIONAL name of the network interface to bind
+	// sockets to (e.g., "eth0"), to measure using a specific network.
+	Interface string
+
+	// TCPUserTimeout is the OPTIONAL maximum time transmitted data may
+	// remain unacknowledged before closing the TCP connection. We do not
+	// apply this option to UDP sockets.
+	TCPUserTimeout time.Duration
+
+	// TOS is the OPTIONAL IPv4 type of service or IPv6 traffic class
+	// (e.g., 0xb8 for DSCP EF). Zero means not setting the option.
+	TOS int
+}
+
+// SocketOptionsSupport reports which [SocketOptions] fields the current
+// platform supports, as returned by [SupportedSocketOptions].
+type SocketOptionsSupport struct {
+	// Interface indicates whether [SocketOptions] Interface is supported.
+	Interface bool
+
+	// TCPUserTimeout indicates whether [SocketOptions] TCPUserTimeout is supported.
+	TCPUserTimeout bool
+
+	// TOS indicates whether [SocketOptions] TOS is supported.
+	TOS bool
+}
+
+// SupportedSocketOptions returns the [SocketOptionsSupport] of the current platform.
+func SupportedSocketOptions() SocketOptionsSupport {
+	return socketOptionsSupport
+}
+
+// Check returns an error wrapping [ErrSocketOptionUnsupported] if opts
+// contains options that the current platform does not support.
+func (opts *SocketOptions) Check() error {
+	support := SupportedSocketOptions()
+	var unsupported []string
+	if opts.Interface != "" && !support.Interface {
+		unsupported = append(unsupported, "Interface")
+	}
+	if opts.TCPUserTimeout != 0 && !support.TCPUserTimeout {
+		unsupported = append(unsupported, "TCPUserTimeout")
+	}
+	if opts.TOS != 0 && !support.TOS {
+		unsupported = append(unsupported, "TOS")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%w: %s on %s", ErrSocketOptionUnsupported,
+			strings.Join(unsupported, ", "), runtime.GOOS)
+	}
+	return nil
+}
+
+// Control applies the options to a socket before connecting or binding it.
+//
+// The signature is compatible with the Control field of [*net.Dialer]
+// and [*net.ListenConfig], which pass networks such as "tcp4" or "udp6".
+func (opts *SocketOptions) Control(network, address string, conn syscall.RawConn) error {
+	// 1. refuse the options the platform does not support
+	if err := opts.Check(); err != nil {
+		return err
+	}
+
+	// 2. apply the options to the file descriptor
+	var err error
+	cerr := conn.Control(func(fd uintptr) {
+		err = opts.apply(fd, network)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// apply applies the options to the given file descriptor.
+func (opts *SocketOptions) apply(fd uintptr, network string) error {
+	ipv6 := strings.HasSuffix(network, "6")
+	if opts.Interface != "" {
+		if err := socketSetInterface(fd, ipv6, opts.Interface); err != nil {
+			return fmt.Errorf("dnsoverstream: cannot bind to interface %s: %w", opts.Interface, err)
+		}
+	}
+	if opts.TCPUserTimeout != 0 && strings.HasPrefix(network, "tcp") {
+		if err := socketSetTCPUserTimeout(fd, opts.TCPUserTimeout); err != nil {
+			return fmt.Errorf("dnsoverstream: cannot set TCP user timeout: %w", err)
+		}
+	}
+	if opts.TOS != 0 {
+		if err := socketSetTOS(fd, ipv6, opts.TOS); err != nil {
+			return fmt.Errorf("dnsoverstream: cannot set TOS: %w", err)
+		}
+	}
+	return nil
+}
+
+// socketTimeoutSeconds converts timeout to seconds rounding up, for the
+// platforms using seconds as the user timeout granularity.
+func socketTimeoutSeconds(timeout time.Duration) int {
+	return int((timeout + time.Second - 1) / time.Second)
+}
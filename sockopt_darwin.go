@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build darwin
+
+package dnsoverstream
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketOptionsSupport is the [SocketOptionsSupport] of macOS.
+var socketOptionsSupport = SocketOptionsSupport{
+	Interface:      true,
+	TCPUserTimeout: true,
+	TOS:            true,
+}
+
+// socketSetInterface binds the socket to the interface using IP_BOUND_IF
+// or IPV6_BOUND_IF, which take the interface index.
+func socketSetInterface(fd uintptr, ipv6 bool, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_BOUND_IF, iface.Index)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_BOUND_IF, iface.Index)
+}
+
+// socketSetTCPUserTimeout sets TCP_RXT_CONNDROPTIME, which uses seconds.
+func socketSetTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_RXT_CONNDROPTIME, socketTimeoutSeconds(timeout))
+}
+
+// socketSetTOS sets IP_TOS or IPV6_TCLASS.
+func socketSetTOS(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
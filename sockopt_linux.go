@@ -0,0 +1,36 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build linux
+
+package dnsoverstream
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketOptionsSupport is the [SocketOptionsSupport] of Linux.
+var socketOptionsSupport = SocketOptionsSupport{
+	Interface:      true,
+	TCPUserTimeout: true,
+	TOS:            true,
+}
+
+// socketSetInterface binds the socket to the interface using SO_BINDTODEVICE.
+func socketSetInterface(fd uintptr, ipv6 bool, name string) error {
+	return unix.BindToDevice(int(fd), name)
+}
+
+// socketSetTCPUserTimeout sets TCP_USER_TIMEOUT, which uses milliseconds.
+func socketSetTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
+}
+
+// socketSetTOS sets IP_TOS or IPV6_TCLASS.
+func socketSetTOS(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+}
@@ -0,0 +1,71 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build linux
+
+package dnsoverstream
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// sockoptTestGetInt returns the value of an integer socket option of conn.
+func sockoptTestGetInt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	require.NoError(t, err)
+	var (
+		value int
+		gerr  error
+	)
+	require.NoError(t, raw.Control(func(fd uintptr) {
+		value, gerr = unix.GetsockoptInt(int(fd), level, opt)
+	}))
+	require.NoError(t, gerr)
+	return value
+}
+
+func TestSocketOptionsLinux(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	t.Run("sets TCP_USER_TIMEOUT and IP_TOS for TCP", func(t *testing.T) {
+		opts := &SocketOptions{TCPUserTimeout: 1500 * time.Millisecond, TOS: 0xb8}
+		conn, err := (&net.Dialer{Control: opts.Control}).Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		tcpConn := conn.(*net.TCPConn)
+		require.Equal(t, 1500, sockoptTestGetInt(t, tcpConn, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT))
+		require.Equal(t, 0xb8, sockoptTestGetInt(t, tcpConn, unix.IPPROTO_IP, unix.IP_TOS))
+	})
+
+	t.Run("sets IP_TOS but not TCP_USER_TIMEOUT for UDP", func(t *testing.T) {
+		opts := &SocketOptions{TCPUserTimeout: time.Second, TOS: 0xb8}
+		conn, err := (&net.Dialer{Control: opts.Control}).Dial("udp", "127.0.0.1:53")
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, 0xb8, sockoptTestGetInt(t, conn.(*net.UDPConn), unix.IPPROTO_IP, unix.IP_TOS))
+	})
+
+	t.Run("binds to the loopback interface", func(t *testing.T) {
+		opts := &SocketOptions{Interface: "lo"}
+		conn, err := (&net.Dialer{Control: opts.Control}).Dial("tcp", listener.Addr().String())
+		if errors.Is(err, syscall.EPERM) {
+			t.Skip("binding to an interface requires privileges on this kernel")
+		}
+		require.NoError(t, err)
+		conn.Close()
+	})
+
+	t.Run("fails binding to a nonexistent interface", func(t *testing.T) {
+		opts := &SocketOptions{Interface: "nonexistent0"}
+		_, err := (&net.Dialer{Control: opts.Control}).Dial("tcp", listener.Addr().String())
+		require.ErrorContains(t, err, "cannot bind to interface nonexistent0")
+	})
+}
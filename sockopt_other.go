@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !linux && !darwin && !windows
+
+package dnsoverstream
+
+import "time"
+
+// socketOptionsSupport is the [SocketOptionsSupport] of the other platforms.
+var socketOptionsSupport = SocketOptionsSupport{}
+
+// socketSetInterface is never called because we do not support Interface.
+func socketSetInterface(fd uintptr, ipv6 bool, name string) error {
+	return ErrSocketOptionUnsupported
+}
+
+// socketSetTCPUserTimeout is never called because we do not support TCPUserTimeout.
+func socketSetTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return ErrSocketOptionUnsupported
+}
+
+// socketSetTOS is never called because we do not support TOS.
+func socketSetTOS(fd uintptr, ipv6 bool, tos int) error {
+	return ErrSocketOptionUnsupported
+}
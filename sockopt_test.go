@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// withSocketOptionsSupport temporarily replaces the platform support.
+func withSocketOptionsSupport(t *testing.T, support SocketOptionsSupport) {
+	saved := socketOptionsSupport
+	socketOptionsSupport = support
+	t.Cleanup(func() { socketOptionsSupport = saved })
+}
+
+func TestSupportedSocketOptions(t *testing.T) {
+	support := SupportedSocketOptions()
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		require.Equal(t, SocketOptionsSupport{Interface: true, TCPUserTimeout: true, TOS: true}, support)
+	case "windows":
+		require.Equal(t, SocketOptionsSupport{Interface: true, TCPUserTimeout: true}, support)
+	default:
+		require.Equal(t, SocketOptionsSupport{}, support)
+	}
+}
+
+func TestSocketOptionsCheck(t *testing.T) {
+	t.Run("succeeds with the zero value even without support", func(t *testing.T) {
+		withSocketOptionsSupport(t, SocketOptionsSupport{})
+		require.NoError(t, (&SocketOptions{}).Check())
+	})
+
+	t.Run("reports all the unsupported options", func(t *testing.T) {
+		withSocketOptionsSupport(t, SocketOptionsSupport{TCPUserTimeout: true})
+		opts := &SocketOptions{Interface: "eth0", TCPUserTimeout: time.Second, TOS: 0xb8}
+		err := opts.Check()
+		require.ErrorIs(t, err, ErrSocketOptionUnsupported)
+		require.ErrorContains(t, err, "Interface, TOS on "+runtime.GOOS)
+		require.NotContains(t, err.Error(), "TCPUserTimeout")
+	})
+
+	t.Run("succeeds when all the options are supported", func(t *testing.T) {
+		withSocketOptionsSupport(t, SocketOptionsSupport{Interface: true, TCPUserTimeout: true, TOS: true})
+		opts := &SocketOptions{Interface: "eth0", TCPUserTimeout: time.Second, TOS: 0xb8}
+		require.NoError(t, opts.Check())
+	})
+}
+
+func TestSocketOptionsControl(t *testing.T) {
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+	defer srv.Close()
+	endpoint := netip.MustParseAddrPort(srv.Address())
+
+	t.Run("the zero value works with all dialers", func(t *testing.T) {
+		dialer := &net.Dialer{Control: (&SocketOptions{}).Control}
+		dt := NewTransport(NewStreamOpenerDialerTCP(dialer), endpoint)
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.4.4", "8.8.8.8"}, addrs)
+	})
+
+	t.Run("dialing fails instead of ignoring unsupported options", func(t *testing.T) {
+		withSocketOptionsSupport(t, SocketOptionsSupport{})
+		dialer := &net.Dialer{Control: (&SocketOptions{TOS: 0xb8}).Control}
+		dt := NewTransport(NewStreamOpenerDialerTCP(dialer), endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrSocketOptionUnsupported)
+	})
+}
+
+func TestSocketTimeoutSeconds(t *testing.T) {
+	require.Equal(t, 0, socketTimeoutSeconds(0))
+	require.Equal(t, 1, socketTimeoutSeconds(time.Millisecond))
+	require.Equal(t, 1, socketTimeoutSeconds(time.Second))
+	require.Equal(t, 2, socketTimeoutSeconds(1500*time.Millisecond))
+}
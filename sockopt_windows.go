@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build windows
+
+package dnsoverstream
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// socketOptionsSupport is the [SocketOptionsSupport] of Windows.
+//
+// Windows ignores IP_TOS unless using the QoS APIs, so we do not support TOS.
+var socketOptionsSupport = SocketOptionsSupport{
+	Interface:      true,
+	TCPUserTimeout: true,
+	TOS:            false,
+}
+
+// Windows socket options missing from [windows].
+const (
+	windowsIPUnicastIF   = 31 // IP_UNICAST_IF
+	windowsIPv6UnicastIF = 31 // IPV6_UNICAST_IF
+)
+
+// socketSetInterface binds the socket to the interface using IP_UNICAST_IF,
+// which takes the index in network byte order, or IPV6_UNICAST_IF, which
+// takes the index in host byte order.
+func socketSetInterface(fd uintptr, ipv6 bool, name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, windowsIPv6UnicastIF, iface.Index)
+	}
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(iface.Index))
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP,
+		windowsIPUnicastIF, int(binary.NativeEndian.Uint32(index[:])))
+}
+
+// socketSetTCPUserTimeout sets TCP_MAXRT, which uses seconds.
+func socketSetTCPUserTimeout(fd uintptr, timeout time.Duration) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_TCP, windows.TCP_MAXRT, socketTimeoutSeconds(timeout))
+}
+
+// socketSetTOS is never called because we do not support TOS.
+func socketSetTOS(fd uintptr, ipv6 bool, tos int) error {
+	return ErrSocketOptionUnsupported
+}
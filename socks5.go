@@ -0,0 +1,399 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+)
+
+// ErrSOCKS5 indicates that the SOCKS5 proxy refused or failed our request.
+var ErrSOCKS5 = errors.New("dnsoverstream: SOCKS5 proxy error")
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5PasswordVersion = 0x01
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+	socks5AtypIPv4        = 0x01
+	socks5AtypDomain      = 0x03
+	socks5AtypIPv6        = 0x04
+)
+
+// SOCKS5Dialer implements [NetDialer] by connecting through a SOCKS5 proxy
+// (RFC 1928), such as a local Tor client, so that DNS over TCP and DNS over
+// TLS (using [*NetTLSDialer]) work through the proxy.
+//
+// We also support UDP using the UDP ASSOCIATE command, so that DNS over UDP
+// and DNS over QUIC (using [*QUICDialer] with ConnectedUDP set and this
+// dialer as the UDPDialer) work through proxies supporting it. Note that
+// Tor does not support UDP ASSOCIATE.
+//
+// DialContext performs the SOCKS5 handshake, so the context bounds both
+// the TCP connect to the proxy and the handshake. We pass the destination
+// host to the proxy as is, so that the proxy resolves domain names.
+//
+// Construct using [NewSOCKS5Dialer].
+type SOCKS5Dialer struct {
+	// Dialer is the underlying [NetDialer] connecting to the proxy.
+	Dialer NetDialer
+
+	// ProxyAddress is the MANDATORY proxy address (e.g., "127.0.0.1:9050").
+	ProxyAddress string
+
+	// Username is the OPTIONAL username for the username/password
+	// authentication (RFC 1929). If empty, we do not authenticate.
+	Username string
+
+	// Password is the OPTIONAL password used along with Username.
+	Password string
+}
+
+// NewSOCKS5Dialer creates a new [*SOCKS5Dialer] using the given [NetDialer]
+// to connect to the proxy listening at proxyAddress.
+func NewSOCKS5Dialer(dialer NetDialer, proxyAddress string) *SOCKS5Dialer {
+	return &SOCKS5Dialer{Dialer: dialer, ProxyAddress: proxyAddress}
+}
+
+var _ NetDialer = &SOCKS5Dialer{}
+
+// DialContext implements [NetDialer].
+//
+// We support the "tcp", "tcp4", "tcp6", "udp", "udp4", and "udp6" networks.
+//
+// For UDP, we return a connected [net.Conn] sending datagrams to the address
+// through the relay of the proxy, which lives as long as the TCP connection
+// with the proxy, which we close along with the returned [net.Conn].
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// 1. make sure we can proxy the network
+	var cmd byte
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		cmd = socks5CmdConnect
+	case "udp", "udp4", "udp6":
+		cmd = socks5CmdUDPAssociate
+	default:
+		return nil, fmt.Errorf("%w: unsupported network %q", ErrSOCKS5, network)
+	}
+
+	// 2. connect to the proxy
+	conn, err := d.Dialer.DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. perform the handshake bounded by the context
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	result, err := d.dialCommand(ctx, conn, cmd, network, address)
+	if !stop() {
+		if result != nil {
+			result.Close()
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, wrapContextError(ctx, err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return result, nil
+}
+
+// dialCommand performs the handshake for the given command and returns the
+// [net.Conn] to use, which wraps conn for UDP ASSOCIATE.
+func (d *SOCKS5Dialer) dialCommand(ctx context.Context,
+	conn net.Conn, cmd byte, network, address string) (net.Conn, error) {
+	// 1. handle the CONNECT command
+	if cmd == socks5CmdConnect {
+		if _, err := d.handshake(conn, cmd, address); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	// 2. encode the datagrams header first, so that we fail early for bad addresses
+	header, err := socks5AppendAddress([]byte{0x00, 0x00, 0x00}, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. ask the proxy to relay datagrams for us, noting that we do not know
+	// which address we will use, so we send the unspecified address
+	relayAddress, err := d.handshake(conn, cmd, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. the proxy may return the unspecified address meaning "use my address"
+	relayHost, relayPort, err := net.SplitHostPort(relayAddress)
+	if err != nil {
+		return nil, err
+	}
+	if addr, err := netip.ParseAddr(relayHost); err == nil && addr.IsUnspecified() {
+		if relayHost, _, err = net.SplitHostPort(d.ProxyAddress); err != nil {
+			return nil, err
+		}
+	}
+
+	// 5. create the connected UDP socket for talking with the relay
+	relay, err := d.Dialer.DialContext(ctx, network, net.JoinHostPort(relayHost, relayPort))
+	if err != nil {
+		return nil, err
+	}
+	udpConn := &socks5UDPConn{
+		Conn:    relay,
+		control: conn,
+		header:  header,
+		raddr:   relay.RemoteAddr(),
+		rbuf:    make([]byte, 1<<16),
+	}
+	if addrport, err := netip.ParseAddrPort(address); err == nil {
+		udpConn.raddr = net.UDPAddrFromAddrPort(addrport)
+	}
+
+	// 6. the association ends when the proxy closes the TCP connection
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+	return udpConn, nil
+}
+
+// handshake authenticates with the proxy and sends the given command for
+// the given address, returning the address bound by the proxy.
+func (d *SOCKS5Dialer) handshake(conn net.Conn, cmd byte, address string) (string, error) {
+	// 1. encode the request first, so that we fail early for bad addresses
+	request, err := socks5AppendAddress([]byte{socks5Version, cmd, 0x00}, address)
+	if err != nil {
+		return "", err
+	}
+
+	// 2. negotiate the authentication method
+	method := byte(socks5AuthNone)
+	if d.Username != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return "", err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socks5Version {
+		return "", fmt.Errorf("%w: unexpected version %d", ErrSOCKS5, reply[0])
+	}
+	if reply[1] != method {
+		return "", fmt.Errorf("%w: no acceptable authentication method", ErrSOCKS5)
+	}
+
+	// 3. authenticate using username and password (RFC 1929)
+	if method == socks5AuthPassword {
+		if len(d.Username) > 255 || len(d.Password) > 255 {
+			return "", fmt.Errorf("%w: username or password too long", ErrSOCKS5)
+		}
+		auth := []byte{socks5PasswordVersion, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return "", err
+		}
+		if reply[1] != 0x00 {
+			return "", fmt.Errorf("%w: authentication failed", ErrSOCKS5)
+		}
+	}
+
+	// 4. send the request and read the reply
+	if _, err := conn.Write(request); err != nil {
+		return "", err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("%w: unexpected version %d", ErrSOCKS5, header[0])
+	}
+	if header[1] != 0x00 {
+		return "", fmt.Errorf("%w: %s", ErrSOCKS5, socks5ReplyString(header[1]))
+	}
+	return socks5ReadAddress(conn)
+}
+
+// socks5UDPConn is a connected [net.Conn] sending and receiving datagrams
+// through the relay of a SOCKS5 proxy (RFC 1928 Section 7).
+//
+// We do not support fragmentation, so we drop fragmented datagrams.
+type socks5UDPConn struct {
+	// Conn is the connected UDP socket for talking with the relay.
+	net.Conn
+
+	// control is the TCP connection with the proxy.
+	control net.Conn
+
+	// header is the header we prepend to each datagram.
+	header []byte
+
+	// raddr is the address we return as RemoteAddr.
+	raddr net.Addr
+
+	// rmu protects rbuf.
+	rmu sync.Mutex
+
+	// rbuf is the buffer for reading datagrams.
+	rbuf []byte
+}
+
+// Read implements [net.Conn].
+func (c *socks5UDPConn) Read(data []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		count, err := c.Conn.Read(c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if payload, ok := socks5DecodeDatagram(c.rbuf[:count]); ok {
+			return copy(data, payload), nil
+		}
+	}
+}
+
+// Write implements [net.Conn].
+func (c *socks5UDPConn) Write(data []byte) (int, error) {
+	datagram := make([]byte, 0, len(c.header)+len(data))
+	datagram = append(datagram, c.header...)
+	datagram = append(datagram, data...)
+	if _, err := c.Conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Close implements [net.Conn].
+func (c *socks5UDPConn) Close() error {
+	c.control.Close()
+	return c.Conn.Close()
+}
+
+// RemoteAddr implements [net.Conn].
+func (c *socks5UDPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// socks5DecodeDatagram returns the payload of a datagram received from the
+// relay, or false when the datagram is invalid or fragmented.
+func socks5DecodeDatagram(datagram []byte) ([]byte, bool) {
+	if len(datagram) < 4 || datagram[2] != 0x00 {
+		return nil, false
+	}
+	reader := bytes.NewReader(datagram[3:])
+	if _, err := socks5ReadAddress(reader); err != nil {
+		return nil, false
+	}
+	return datagram[len(datagram)-reader.Len():], true
+}
+
+// socks5AppendAddress appends the SOCKS5 encoding of address to buf.
+func socks5AppendAddress(buf []byte, address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrSOCKS5, portString)
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addr = addr.WithZone("").Unmap()
+		if addr.Is4() {
+			buf = append(buf, socks5AtypIPv4)
+		} else {
+			buf = append(buf, socks5AtypIPv6)
+		}
+		buf = append(buf, addr.AsSlice()...)
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("%w: invalid host %q", ErrSOCKS5, host)
+		}
+		buf = append(buf, socks5AtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// socks5ReadAddress reads a SOCKS5 encoded address and returns it as "host:port".
+func socks5ReadAddress(reader io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(reader, atyp); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case socks5AtypIPv4:
+		host = make([]byte, 4)
+	case socks5AtypIPv6:
+		host = make([]byte, 16)
+	case socks5AtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("%w: unknown address type %d", ErrSOCKS5, atyp[0])
+	}
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	hostString := string(host)
+	if addr, ok := netip.AddrFromSlice(host); ok && atyp[0] != socks5AtypDomain {
+		hostString = addr.String()
+	}
+	return net.JoinHostPort(hostString, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socks5ReplyString returns a description of a SOCKS5 reply code (RFC 1928 Section 6).
+func socks5ReplyString(code byte) string {
+	switch code {
+	case 0x01:
+		return "general SOCKS server failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown reply code %d", code)
+	}
+}
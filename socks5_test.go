@@ -0,0 +1,373 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// socks5TestServer is a minimal SOCKS5 proxy for testing.
+type socks5TestServer struct {
+	// listener is the proxy listener.
+	listener net.Listener
+
+	// username and password, if set, require authentication.
+	username, password string
+
+	// reply, if nonzero, is the reply code we send instead of connecting.
+	reply byte
+
+	// stall, if set, makes the proxy never answer the greeting.
+	stall bool
+
+	// udp, if set, enables the UDP ASSOCIATE command.
+	udp bool
+
+	// wg tracks the goroutines we must wait for when closing.
+	wg sync.WaitGroup
+
+	// mu protects targets.
+	mu sync.Mutex
+
+	// targets contains the addresses the clients asked to connect to.
+	targets []string
+}
+
+// newSOCKS5TestServer starts a [*socks5TestServer] configured by config.
+func newSOCKS5TestServer(t *testing.T, config func(srv *socks5TestServer)) *socks5TestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &socks5TestServer{listener: listener}
+	if config != nil {
+		config(srv)
+	}
+	srv.wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.wg.Go(func() { srv.serve(conn) })
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		srv.wg.Wait()
+	})
+	return srv
+}
+
+// Address returns the proxy address.
+func (srv *socks5TestServer) Address() string {
+	return srv.listener.Addr().String()
+}
+
+// Targets returns the addresses the clients asked to connect to.
+func (srv *socks5TestServer) Targets() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string{}, srv.targets...)
+}
+
+// serve handles a client connection.
+func (srv *socks5TestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	if srv.stall {
+		io.Copy(io.Discard, conn)
+		return
+	}
+
+	// 1. negotiate the authentication method
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5AuthNone)
+	if srv.username != "" {
+		method = socks5AuthPassword
+	}
+	if !containsByte(methods, method) {
+		conn.Write([]byte{socks5Version, 0xff})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+
+	// 2. check the username and the password
+	if method == socks5AuthPassword {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		username := make([]byte, header[1])
+		if _, err := io.ReadFull(conn, username); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return
+		}
+		password := make([]byte, header[0])
+		if _, err := io.ReadFull(conn, password); err != nil {
+			return
+		}
+		if string(username) != srv.username || string(password) != srv.password {
+			conn.Write([]byte{socks5PasswordVersion, 0x01})
+			return
+		}
+		conn.Write([]byte{socks5PasswordVersion, 0x00})
+	}
+
+	// 3. read the request
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	target, err := socks5ReadAddress(conn)
+	if err != nil {
+		return
+	}
+
+	// 4. handle the UDP ASSOCIATE command
+	bound := []byte{socks5Version, srv.reply, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if srv.reply == 0x00 && request[1] == socks5CmdUDPAssociate && srv.udp {
+		srv.associate(conn)
+		return
+	}
+	srv.mu.Lock()
+	srv.targets = append(srv.targets, target)
+	srv.mu.Unlock()
+
+	// 5. connect to the target and relay
+	if srv.reply != 0x00 {
+		conn.Write(bound)
+		return
+	}
+	if request[1] != socks5CmdConnect {
+		bound[1] = 0x07
+		conn.Write(bound)
+		return
+	}
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		bound[1] = 0x05
+		conn.Write(bound)
+		return
+	}
+	defer upstream.Close()
+	conn.Write(bound)
+	srv.wg.Go(func() { io.Copy(upstream, conn) })
+	io.Copy(conn, upstream)
+}
+
+// associate relays datagrams for a client until conn is closed, replying
+// with the unspecified address to exercise using the proxy address.
+func (srv *socks5TestServer) associate(conn net.Conn) {
+	// 1. create the relay socket and tell the client its port
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	conn.Write([]byte{socks5Version, 0x00, 0x00, socks5AtypIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+
+	// 2. close the relay when the client closes the TCP connection
+	srv.wg.Go(func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	})
+
+	// 3. relay the datagrams between the client and the targets
+	var client netip.AddrPort
+	buf := make([]byte, 1<<16)
+	for {
+		count, source, err := relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		if !client.IsValid() || source == client {
+			client = source
+			reader := bytes.NewReader(buf[3:count])
+			target, err := socks5ReadAddress(reader)
+			if err != nil {
+				continue
+			}
+			srv.mu.Lock()
+			srv.targets = append(srv.targets, target)
+			srv.mu.Unlock()
+			relay.WriteToUDPAddrPort(buf[count-reader.Len():count], netip.MustParseAddrPort(target))
+			continue
+		}
+		datagram, _ := socks5AppendAddress([]byte{0x00, 0x00, 0x00}, source.String())
+		relay.WriteToUDPAddrPort(append(datagram, buf[:count]...), client)
+	}
+}
+
+// containsByte returns whether data contains value.
+func containsByte(data []byte, value byte) bool {
+	for _, entry := range data {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+
+	t.Run("DNS over TCP through the proxy", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := newSOCKS5TestServer(t, nil)
+		dialer := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address())
+		dt := NewTransport(NewStreamOpenerDialerTCP(dialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+		require.Equal(t, []string{dnsSrv.Address()}, proxy.Targets())
+	})
+
+	t.Run("DNS over TLS through the proxy with authentication", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) {
+			srv.username, srv.password = "alice", "secret"
+		})
+		dialer := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address())
+		dialer.Username, dialer.Password = "alice", "secret"
+		tlsDialer := NewNetTLSDialer(dialer, newTestClientTLSConfig())
+		dt := NewTransport(NewStreamOpenerDialerTLS(tlsDialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+	})
+
+	t.Run("passes domain names to the proxy", func(t *testing.T) {
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) { srv.reply = 0x04 })
+		conn, err := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address()).DialContext(context.Background(), "tcp", "dns.google:853")
+		require.ErrorIs(t, err, ErrSOCKS5)
+		require.ErrorContains(t, err, "host unreachable")
+		require.Nil(t, conn)
+		require.Equal(t, []string{"dns.google:853"}, proxy.Targets())
+	})
+
+	t.Run("fails with wrong credentials", func(t *testing.T) {
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) {
+			srv.username, srv.password = "alice", "secret"
+		})
+		dialer := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address())
+		dialer.Username, dialer.Password = "alice", "wrong"
+		conn, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrSOCKS5)
+		require.ErrorContains(t, err, "authentication failed")
+		require.Nil(t, conn)
+	})
+
+	t.Run("fails without credentials when the proxy requires them", func(t *testing.T) {
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) {
+			srv.username, srv.password = "alice", "secret"
+		})
+		conn, err := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address()).DialContext(context.Background(), "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrSOCKS5)
+		require.ErrorContains(t, err, "no acceptable authentication method")
+		require.Nil(t, conn)
+	})
+
+	t.Run("DNS over UDP through the proxy", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer dnsSrv.Close()
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) { srv.udp = true })
+		dialer := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address())
+		dt := NewTransport(NewStreamOpenerDialerUDP(dialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+		require.Equal(t, []string{dnsSrv.Address()}, proxy.Targets())
+	})
+
+	t.Run("DNS over QUIC through the proxy", func(t *testing.T) {
+		dnsSrv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) { srv.udp = true })
+		qd := &QUICDialer{
+			TLSConfig:    newTestClientTLSConfig("doq"),
+			ConnectedUDP: true,
+			UDPDialer:    NewSOCKS5Dialer(&net.Dialer{}, proxy.Address()),
+		}
+		dt := NewTransport(NewStreamOpenerDialerQUIC(qd), dnsSrv.Endpoint())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.Exchange(ctx, newQuery())
+		require.NoError(t, err)
+		require.Contains(t, proxy.Targets(), dnsSrv.Endpoint().String())
+	})
+
+	t.Run("fails when the proxy does not support UDP", func(t *testing.T) {
+		proxy := newSOCKS5TestServer(t, nil)
+		conn, err := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address()).DialContext(context.Background(), "udp", "127.0.0.1:53")
+		require.ErrorIs(t, err, ErrSOCKS5)
+		require.ErrorContains(t, err, "command not supported")
+		require.Nil(t, conn)
+	})
+
+	t.Run("rejects unsupported networks", func(t *testing.T) {
+		conn, err := NewSOCKS5Dialer(&net.Dialer{}, "127.0.0.1:1").DialContext(context.Background(), "unix", "/tmp/dns.sock")
+		require.ErrorIs(t, err, ErrSOCKS5)
+		require.Nil(t, conn)
+	})
+
+	t.Run("the context bounds the handshake", func(t *testing.T) {
+		proxy := newSOCKS5TestServer(t, func(srv *socks5TestServer) { srv.stall = true })
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		conn, err := NewSOCKS5Dialer(&net.Dialer{}, proxy.Address()).DialContext(ctx, "tcp", "127.0.0.1:53")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Nil(t, conn)
+	})
+}
+
+func TestSOCKS5AppendAddress(t *testing.T) {
+	cases := []struct {
+		address  string
+		expected []byte
+	}{
+		{"8.8.8.8:53", []byte{socks5AtypIPv4, 8, 8, 8, 8, 0, 53}},
+		{"[::ffff:8.8.8.8]:53", []byte{socks5AtypIPv4, 8, 8, 8, 8, 0, 53}},
+		{"[2001:4860:4860::8888]:853", append(append([]byte{socks5AtypIPv6},
+			netip.MustParseAddr("2001:4860:4860::8888").AsSlice()...), 0x03, 0x55)},
+		{"dns.google:443", append([]byte{socks5AtypDomain, 10}, append([]byte("dns.google"), 0x01, 0xbb)...)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.address, func(t *testing.T) {
+			encoded, err := socks5AppendAddress(nil, tc.address)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, encoded)
+		})
+	}
+}
+
+func TestSOCKS5DecodeDatagram(t *testing.T) {
+	datagram := []byte{0x00, 0x00, 0x00, socks5AtypIPv4, 8, 8, 8, 8, 0, 53, 0xde, 0xad}
+	payload, ok := socks5DecodeDatagram(datagram)
+	require.True(t, ok)
+	require.Equal(t, []byte{0xde, 0xad}, payload)
+
+	datagram[2] = 0x01 // fragmented
+	_, ok = socks5DecodeDatagram(datagram)
+	require.False(t, ok)
+
+	_, ok = socks5DecodeDatagram(datagram[:6])
+	require.False(t, ok)
+}
@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHDialer implements [NetDialer] by opening channels through an SSH
+// connection, so that we can query a resolver reachable from an SSH jump host
+// using DNS over TCP, DNS over TLS (using [*NetTLSDialer]), or DNS over a
+// Unix domain socket on the jump host.
+//
+// SSH channels do not support deadlines, so we emulate them by closing the
+// connection when the most recently set deadline expires. Therefore, the
+// connection is not usable after a deadline expires and reading and writing
+// share the same deadline.
+//
+// We pass the destination host to the SSH server as is, so that the SSH
+// server resolves domain names. We never close the SSH client.
+//
+// Construct using [NewSSHDialer].
+type SSHDialer struct {
+	// Client is the MANDATORY connected [*ssh.Client].
+	Client *ssh.Client
+}
+
+// NewSSHDialer creates a new [*SSHDialer] using the given [*ssh.Client].
+func NewSSHDialer(client *ssh.Client) *SSHDialer {
+	return &SSHDialer{Client: client}
+}
+
+var _ NetDialer = &SSHDialer{}
+
+// DialContext implements [NetDialer].
+//
+// We support the "tcp", "tcp4", "tcp6", and "unix" networks.
+func (d *SSHDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Client.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, wrapContextError(ctx, err)
+	}
+	return &sshConn{Conn: conn}, nil
+}
+
+// sshConn wraps a [net.Conn] using an SSH channel to emulate deadlines.
+type sshConn struct {
+	net.Conn
+
+	// mu protects timer and expired.
+	mu sync.Mutex
+
+	// timer closes the connection when the deadline expires.
+	timer *time.Timer
+
+	// expired is true once a deadline has expired.
+	expired bool
+}
+
+// Read implements [net.Conn].
+func (c *sshConn) Read(data []byte) (int, error) {
+	count, err := c.Conn.Read(data)
+	return count, c.maybeDeadlineError(err)
+}
+
+// Write implements [net.Conn].
+func (c *sshConn) Write(data []byte) (int, error) {
+	count, err := c.Conn.Write(data)
+	return count, c.maybeDeadlineError(err)
+}
+
+// Close implements [net.Conn].
+func (c *sshConn) Close() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// SetDeadline implements [net.Conn].
+func (c *sshConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	if !t.IsZero() {
+		c.timer = time.AfterFunc(time.Until(t), c.expire)
+	}
+	return nil
+}
+
+// SetReadDeadline implements [net.Conn].
+func (c *sshConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// SetWriteDeadline implements [net.Conn].
+func (c *sshConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// expire marks the connection as expired and closes it.
+func (c *sshConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// maybeDeadlineError returns [os.ErrDeadlineExceeded] when err
+// is caused by closing the connection because of the deadline.
+func (c *sshConn) maybeDeadlineError(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
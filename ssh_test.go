@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshTestServer is a minimal SSH server forwarding "direct-tcpip" channels.
+type sshTestServer struct {
+	// wg tracks the goroutines we must wait for when closing.
+	wg sync.WaitGroup
+
+	// mu protects targets.
+	mu sync.Mutex
+
+	// targets contains the addresses the clients asked to connect to.
+	targets []string
+}
+
+// newSSHTestClient starts an [*sshTestServer] and returns a connected [*ssh.Client].
+func newSSHTestClient(t *testing.T) (*ssh.Client, *sshTestServer) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &sshTestServer{}
+	srv.wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.wg.Go(func() { srv.serve(conn, config) })
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		srv.wg.Wait()
+	})
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "nobody",
+		HostKeyCallback: ssh.FixedHostKey(signer.PublicKey()),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client, srv
+}
+
+// Targets returns the addresses the clients asked to connect to.
+func (srv *sshTestServer) Targets() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string{}, srv.targets...)
+}
+
+// serve handles an SSH connection.
+func (srv *sshTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		srv.wg.Go(func() { srv.forward(newChannel) })
+	}
+}
+
+// forward handles a "direct-tcpip" channel (RFC 4254 Section 7.2).
+func (srv *sshTestServer) forward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if newChannel.ChannelType() != "direct-tcpip" {
+		newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		return
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	target := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	srv.mu.Lock()
+	srv.targets = append(srv.targets, target)
+	srv.mu.Unlock()
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer upstream.Close()
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+	srv.wg.Go(func() {
+		io.Copy(upstream, channel)
+		upstream.Close() // the client is done
+	})
+	io.Copy(channel, upstream)
+}
+
+func TestSSHDialer(t *testing.T) {
+	newQuery := func() *dnscodec.Query { return dnscodec.NewQuery("dns.google", dns.TypeA) }
+
+	t.Run("DNS over TCP through the SSH connection", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer dnsSrv.Close()
+		client, sshSrv := newSSHTestClient(t)
+		dt := NewTransport(NewStreamOpenerDialerTCP(NewSSHDialer(client)), netip.MustParseAddrPort(dnsSrv.Address()))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := dt.Exchange(ctx, newQuery())
+		require.NoError(t, err)
+		require.Equal(t, []string{dnsSrv.Address()}, sshSrv.Targets())
+	})
+
+	t.Run("DNS over TLS through the SSH connection", func(t *testing.T) {
+		dnsSrv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer dnsSrv.Close()
+		client, _ := newSSHTestClient(t)
+		tlsDialer := NewNetTLSDialer(NewSSHDialer(client), newTestClientTLSConfig())
+		dt := NewTransport(NewStreamOpenerDialerTLS(tlsDialer), netip.MustParseAddrPort(dnsSrv.Address()))
+		_, err := dt.Exchange(context.Background(), newQuery())
+		require.NoError(t, err)
+	})
+
+	t.Run("fails when the SSH server cannot connect", func(t *testing.T) {
+		client, _ := newSSHTestClient(t)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+		conn, err := NewSSHDialer(client).DialContext(context.Background(), "tcp", address)
+		require.Error(t, err)
+		require.Nil(t, conn)
+	})
+
+	t.Run("the context deadline bounds reading the response", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		wg.Go(func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(io.Discard, conn) // never answer
+		})
+		client, _ := newSSHTestClient(t)
+		dt := NewTransport(NewStreamOpenerDialerTCP(NewSSHDialer(client)),
+			netip.MustParseAddrPort(listener.Addr().String()))
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err = dt.Exchange(ctx, newQuery())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestSSHConnDeadline(t *testing.T) {
+	t.Run("clearing the deadline stops the timer", func(t *testing.T) {
+		left, right := net.Pipe()
+		defer right.Close()
+		conn := &sshConn{Conn: left}
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Millisecond)))
+		require.NoError(t, conn.SetDeadline(time.Time{}))
+		time.Sleep(50 * time.Millisecond)
+		go right.Write([]byte("x"))
+		buf := make([]byte, 1)
+		_, err := conn.Read(buf)
+		require.NoError(t, err)
+	})
+
+	t.Run("the connection is unusable after the deadline expires", func(t *testing.T) {
+		left, right := net.Pipe()
+		defer right.Close()
+		conn := &sshConn{Conn: left}
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+		_, err := conn.Read(make([]byte, 1))
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		require.ErrorIs(t, conn.SetWriteDeadline(time.Time{}), os.ErrDeadlineExceeded)
+	})
+}
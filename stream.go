@@ -19,19 +19,35 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"log/slog"
 	"math"
+	"net"
 	"net/netip"
 	"time"
 
 	"github.com/bassosimone/dnscodec"
-	"github.com/bassosimone/runtimex"
 	"github.com/miekg/dns"
 )
 
+// ErrQueryTooLarge indicates that a query does not fit into the 2-byte length
+// prefix used by DNS over TCP, TLS, and QUIC (RFC 1035 Section 4.2.2).
+var ErrQueryTooLarge = errors.New("dnsoverstream: query too large")
+
+// ErrTrailingData indicates that the server sent data after the response
+// frame, so that we cannot know where the next frame begins and the connection
+// is not reusable. We discard the response, and [*Pool] closes the connection.
+var ErrTrailingData = errors.New("dnsoverstream: trailing data after response")
+
 // Stream is a stream suitable for DNS over TCP, TLS, or QUIC.
+//
+// Use [FuncStream] to mock it in tests.
 type Stream interface {
 	// SetDeadline sets the I/O deadline.
+	//
+	// Streams MAY also implement SetReadDeadline and SetWriteDeadline, like
+	// [net.Conn], which we use for the [*Transport] ReadTimeout and WriteTimeout.
 	SetDeadline(t time.Time) error
 
 	// We can obviously do I/O with the [Stream].
@@ -48,6 +64,8 @@ type Stream interface {
 }
 
 // StreamOpener abstracts over [net.Conn], [*tls.Conn], or [*quic.Conn].
+//
+// Use [FuncStreamOpener] to mock it in tests.
 type StreamOpener interface {
 	// Close closes the connection.
 	//
@@ -73,6 +91,8 @@ type StreamOpener interface {
 // Implementations include [*StreamOpenerDialerTCP], [*StreamOpenerDialerTLS],
 // and [*StreamOpenerDialerQUIC]. Users may also provide custom implementations
 // for advanced use cases such as using utls or uquic.
+//
+// Use [FuncStreamOpenerDialer] to mock it in tests.
 type StreamOpenerDialer interface {
 	// DialContext creates a new [StreamOpener].
 	DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error)
@@ -83,7 +103,15 @@ type StreamOpenerDialer interface {
 // Construct using [NewTransport] with a [StreamOpenerDialer] implementation.
 //
 // Transport creates a new connection for each Exchange call and targets the
-// specific [netip.AddrPort] endpoint configured at construction time.
+// specific [netip.AddrPort] endpoint configured at construction time, unless
+// the context overrides the endpoint using [WithEndpoint].
+//
+// The context deadline, if any, bounds the whole exchange with the same
+// semantics for TCP, TLS, and QUIC: the dialer uses the context for the TCP
+// connect and the TLS or QUIC handshake, and the exchange sets the context
+// deadline as the [Stream] deadline for sending the query and reading the
+// response. Use ObserveTiming to know how the time was spent, and WriteTimeout
+// and ReadTimeout to further bound sending the query and reading the response.
 type Transport struct {
 	// dialer is the [StreamOpenerDialer] to build the [StreamOpener] for exchanging messages.
 	dialer StreamOpenerDialer
@@ -91,93 +119,614 @@ type Transport struct {
 	// endpoint is the server endpoint to use to query.
 	endpoint netip.AddrPort
 
+	// QueryClass is the OPTIONAL question class to use.
+	//
+	// The zero value means [dns.ClassINET], which is what [*dnscodec.Query]
+	// uses by default. Set to, e.g., [dns.ClassCHAOS] to send CHAOS queries
+	// such as the ones used to identify a server (e.g., "version.bind").
+	//
+	// When using [dns.ClassANY], we accept the answers of any class.
+	QueryClass uint16
+
+	// NoRecursion OPTIONALLY clears the RD bit of queries, which is what
+	// iterative resolvers do when querying authoritative servers.
+	NoRecursion bool
+
+	// TCPKeepalive OPTIONALLY adds the edns-tcp-keepalive option (RFC 7828)
+	// to the DNS over TCP and TLS queries, asking the server to advertise how
+	// long it keeps idle connections open. When set, the [*Pool] honours the
+	// advertised timeout, by not reusing connections idle for longer and by not
+	// pooling connections whose timeout is zero. We never add the option to DNS
+	// over QUIC queries, since RFC 9250 Section 5.5.2 forbids it, nor to DNS
+	// over HTTPS queries. Note that setting Verbatim does not prevent adding it.
+	TCPKeepalive bool
+
+	// NoCompression OPTIONALLY disables name compression (RFC 1035 Section
+	// 4.1.4) in the messages we send using [MsgCodec] and [OpcodeCodec], which
+	// otherwise honour the Compress field of the [*dns.Msg]. We never compress
+	// the queries created from [*dnscodec.Query], which contain a single name.
+	NoCompression bool
+
+	// Verbatim OPTIONALLY disables calling MutateQuery, so that we send the
+	// caller's [*dnscodec.Query] as provided (e.g., keeping its ID, flags, and
+	// EDNS(0) maximum size), for experiments that must control every header bit.
+	//
+	// QueryClass and NoRecursion still apply, since the caller sets them. Note
+	// that we refuse responses larger than the query MaxSize, which we do not
+	// adjust for the protocol anymore, and that the protocol requirements (e.g.,
+	// the zero ID of DNS over QUIC) become the caller's responsibility.
+	Verbatim bool
+
+	// Pool is the OPTIONAL [*Pool] of idle connections.
+	//
+	// When set, Exchange reuses idle connections from the pool and returns
+	// connections to the pool after successful exchanges. When nil, Exchange
+	// uses a new connection for each exchange.
+	Pool *Pool
+
+	// Limiter is the OPTIONAL [*Limiter] bounding concurrent exchanges.
+	//
+	// When set, Exchange waits for a slot before dialing or reusing
+	// a connection and fails with the context error if the context
+	// is done while waiting.
+	Limiter *Limiter
+
+	// MemoryBudget is the OPTIONAL [*MemoryBudget] bounding the memory
+	// used by simultaneously buffered responses.
+	MemoryBudget *MemoryBudget
+
+	// Policy is the OPTIONAL [*Policy] refusing silent downgrades below
+	// the best protocol previously seen for the server.
+	Policy *Policy
+
+	// LatencyTracker is the OPTIONAL [*LatencyTracker] recording the total
+	// time of each Exchange, including when it fails, per endpoint.
+	LatencyTracker *LatencyTracker
+
+	// ReadBufferSize is the OPTIONAL size of the buffer for reading responses,
+	// which we recycle across exchanges. A small size suits small answers, while
+	// a size larger than the responses minimizes the read calls. If zero or
+	// negative, we use [DefaultReadBufferSize].
+	ReadBufferSize int
+
+	// CloseTimeout is the OPTIONAL timeout for closing connections.
+	//
+	// Closing may block on dead network paths (e.g., when sending a QUIC
+	// CONNECTION_CLOSE or a TLS close_notify), so Exchange waits at most this
+	// timeout for the close to complete, which then continues in the background,
+	// so that teardown does not inflate its latency further. If zero or
+	// negative, we use [DefaultCloseTimeout].
+	CloseTimeout time.Duration
+
+	// WriteTimeout is the OPTIONAL timeout for sending the query, which fails
+	// with [ErrWriteTimeout] when it expires before the context deadline.
+	WriteTimeout time.Duration
+
+	// ReadTimeout is the OPTIONAL timeout for receiving the response after
+	// sending the query (or each message for [*Transport.ExchangeStream]),
+	// which fails with [ErrReadTimeout] when it expires before the context
+	// deadline. Use it along with WriteTimeout to distinguish servers slow to
+	// accept the query from servers slow to answer.
+	//
+	// The UDP, HTTPS, and HTTP/3 streams send the query when we start reading
+	// the response, so ReadTimeout bounds the whole round trip for them.
+	ReadTimeout time.Duration
+
 	// ObserveRawQuery is an optional hook called with a copy of the raw DNS query.
 	ObserveRawQuery func([]byte)
 
 	// ObserveRawResponse is an optional hook called with a copy of the raw DNS response.
 	ObserveRawResponse func([]byte)
+
+	// PaddingOracle OPTIONALLY computes the EDNS(0) padding of each query,
+	// replacing the padding required by the protocol in use. Because setting
+	// it is explicit, we also use it when Verbatim is set.
+	PaddingOracle PaddingOracle
+
+	// ObserveResponsePadding is an optional hook called with the
+	// [ResponsePadding] of each response that we can unpack.
+	ObserveResponsePadding func(ResponsePadding)
+
+	// ObserveResponseCompression is an optional hook called with the
+	// [ResponseCompression] of each response that we can unpack.
+	ObserveResponseCompression func(ResponseCompression)
+
+	// ObserveTrailingData is an optional hook called with a copy of the data
+	// following the response frame, in which case we fail with [ErrTrailingData].
+	//
+	// We only detect the trailing data received along with the response.
+	ObserveTrailingData func([]byte)
+
+	// ObserveQueueTime is an optional hook called with the time spent waiting
+	// for the [*Limiter], if any, including when waiting fails.
+	ObserveQueueTime func(time.Duration)
+
+	// ObserveTiming is an optional hook called at the end of each Exchange,
+	// including when it fails, with the per-phase [ExchangeTiming].
+	ObserveTiming func(ExchangeTiming)
+
+	// ObserveTCPKeepalive is an optional hook called with the idle timeout
+	// advertised by the server using the edns-tcp-keepalive option, if any,
+	// when TCPKeepalive is set.
+	ObserveTCPKeepalive func(time.Duration)
+
+	// Logger is the OPTIONAL [*slog.Logger] used to log the outcome
+	// of each Exchange, including the query name and type.
+	Logger *slog.Logger
+
+	// TimeNow is the OPTIONAL function returning the current time, which is the
+	// single clock source for the timestamps and durations we log and observe,
+	// except for the [*Limiter] queue time and the [ConnState] of the pooled
+	// connections, which use the [*Pool] clock. If nil, we use [time.Now].
+	TimeNow func() time.Time
+
+	// RedactName is the OPTIONAL [RedactNameFunc] applied to query names
+	// before logging them, for operators who must not log full names.
+	RedactName RedactNameFunc
+
+	// Executor is the OPTIONAL [Executor] running the concurrent attempts
+	// and exchanges of the features built on top of this [*Transport]. If
+	// nil, we spawn a goroutine for each of them.
+	Executor Executor
+
+	// Sampler OPTIONALLY selects the exchanges to log and observe using the
+	// Logger and the Observe hooks, which do not see the other exchanges.
+	//
+	// We decide once per exchange, so all the outputs see the same exchanges.
+	// The LatencyTracker, which only updates counters, sees all of them.
+	Sampler Sampler
+}
+
+// now returns the current time using TimeNow or [time.Now].
+func (dt *Transport) now() time.Time {
+	if dt.TimeNow != nil {
+		return dt.TimeNow()
+	}
+	return time.Now()
+}
+
+// since returns the time elapsed since t0 using [*Transport.now].
+func (dt *Transport) since(t0 time.Time) time.Duration {
+	return dt.now().Sub(t0)
+}
+
+// ExchangeTiming is the per-phase breakdown of the time spent by Exchange.
+//
+// StartTime is a wall-clock time suitable for archival, while the durations
+// use the monotonic clock reading (see [time.Time]) and are suitable for analysis.
+type ExchangeTiming struct {
+	// StartTime is the time when the exchange started.
+	StartTime time.Time
+
+	// TotalTime is the total time spent by the exchange.
+	TotalTime time.Duration
+
+	// QueueTime is the time spent waiting for the [*Limiter].
+	QueueTime time.Duration
+
+	// DialTime is the time spent dialing, which includes the TCP connect
+	// and the TLS or QUIC handshake. It is zero when reusing a connection.
+	DialTime time.Duration
+
+	// ExchangeTime is the time spent opening the [Stream], sending the
+	// query, and receiving and parsing the response.
+	ExchangeTime time.Duration
+
+	// TimeToFirstByte is the time elapsed between sending the query and
+	// receiving the first bytes of the response, which for UDP, HTTPS, and
+	// HTTP/3 includes sending the query (see the ReadTimeout field).
+	TimeToFirstByte time.Duration
+
+	// TimeToLastByte is the time elapsed between sending the query and
+	// receiving the whole response. See also [ExchangeTiming.ReadThroughput].
+	TimeToLastByte time.Duration
+
+	// ResponseSize is the size of the raw response.
+	ResponseSize int
+
+	// Reused indicates whether we reused a connection from the [*Pool].
+	Reused bool
+
+	// Handshake is the [HandshakeKind] of the connection, which for reused
+	// connections is the kind of the handshake performed when dialing.
+	Handshake HandshakeKind
+
+	// CorrelationID is the exchange correlation ID (see [WithCorrelationID]).
+	CorrelationID string
 }
 
 // NewTransport creates a new [*Transport] with the given [StreamOpenerDialer] and endpoint.
 //
 // Use [NewStreamOpenerDialerTCP], [NewStreamOpenerDialerTLS], or [NewStreamOpenerDialerQUIC]
 // to create dialers for common protocols, or provide a custom implementation.
+//
+// The endpoint may be a link-local IPv6 address with a zone (e.g., [fe80::1%eth0]:53),
+// which the TCP, TLS, and QUIC dialers honour. When the TLS ServerName is empty, TLS and
+// QUIC verify the server certificate against the address without the zone.
 func NewTransport(dialer StreamOpenerDialer, endpoint netip.AddrPort) *Transport {
 	return &Transport{dialer: dialer, endpoint: endpoint}
 }
 
-// Dial creates a new [StreamOpener] with the endpoint associated with this [*Transport].
+// Dial creates a new [StreamOpener] with the endpoint associated with this [*Transport]
+// or with the endpoint overridden using [WithEndpoint].
 //
 // This method enables building long-lived connections and reusing them across
 // multiple exchanges via [*Transport.ExchangeWithStreamOpener].
 func (dt *Transport) Dial(ctx context.Context) (StreamOpener, error) {
-	return dt.dialer.DialContext(ctx, dt.endpoint)
+	return dt.dialer.DialContext(ctx, dt.endpointFor(ctx))
 }
 
 // Exchange sends a [*dnscodec.Query] and receives a [*dnscodec.Response].
 func (dt *Transport) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, error) {
-	// 1. create the connection
-	conn, err := dt.Dial(ctx)
+	return transportExchange(ctx, dt, query, dnscodecQuestion, dt.ExchangeWithStreamOpener)
+}
+
+// exchangeFunc is the type of [*Transport.ExchangeWithStreamOpener] and similar methods.
+type exchangeFunc[Q, T any] func(ctx context.Context, conn StreamOpener, query Q) (T, error)
+
+// questionFunc returns the query name and type we log.
+type questionFunc[Q any] func(query Q) (name string, qtype uint16)
+
+// dnscodecQuestion is the [questionFunc] for [*dnscodec.Query].
+func dnscodecQuestion(query *dnscodec.Query) (string, uint16) {
+	return query.Name, query.Type
+}
+
+// transportExchange implements [*Transport.Exchange] and similar methods.
+func transportExchange[Q, T any](ctx context.Context, dt *Transport, query Q,
+	question questionFunc[Q], exchange exchangeFunc[Q, T]) (_ T, err error) {
+	// 0. collect the per-phase timing and log the outcome when requested and
+	// sampled, using the same correlation ID for all the observations.
+	ctx, dt = sampleExchange(ctx, dt)
+	var timing ExchangeTiming
+	if dt.Logger != nil || dt.ObserveTiming != nil {
+		ctx, timing.CorrelationID = ensureCorrelationID(ctx)
+		timing.StartTime = dt.now()
+	}
+	if dt.Logger != nil {
+		defer func() {
+			name, qtype := question(query)
+			dt.logExchange(ctx, name, qtype, timing.StartTime, err)
+		}()
+	}
+	if dt.ObserveTiming != nil {
+		defer func() {
+			timing.TotalTime = dt.since(timing.StartTime)
+			dt.ObserveTiming(timing)
+		}()
+	}
+	if dt.LatencyTracker != nil {
+		t0, endpoint := dt.now(), dt.endpointFor(ctx)
+		defer func() {
+			dt.LatencyTracker.Record(endpoint, dt.since(t0), err)
+		}()
+	}
+
+	// 1. honour the concurrency limits when configured.
+	var zero T
+	if dt.Limiter != nil {
+		release, queued, err := dt.Limiter.Acquire(ctx, dt.endpointFor(ctx))
+		timing.QueueTime = queued
+		if dt.ObserveQueueTime != nil {
+			dt.ObserveQueueTime(queued)
+		}
+		if err != nil {
+			return zero, err
+		}
+		defer release()
+	}
+
+	// 2. refuse downgrades when configured.
+	if err := dt.policyCheck(dt.endpointFor(ctx)); err != nil {
+		return zero, err
+	}
+
+	// 3. use the pool when configured.
+	if dt.Pool != nil {
+		return transportExchangeWithPool(ctx, dt, query, exchange, &timing)
+	}
+
+	// 4. create the connection
+	conn, err := dialTimed(ctx, dt, &timing)
 	if err != nil {
-		return nil, err
+		return zero, wrapContextError(ctx, err)
 	}
 
-	// 2. Use a single connection for request, which is what the standard library
+	// 5. Use a single connection for request, which is what the standard library
 	// does as well for and is more robust in terms of residual censorship.
 	//
 	// Make sure we react to context being canceled early.
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := closeWhenDone(ctx, dt, conn)
 	defer cancel()
-	go func() {
-		defer conn.Close()
-		<-ctx.Done()
-	}()
 
-	// 3. defer to ExchangeWithStreamOpener.
-	return dt.ExchangeWithStreamOpener(ctx, conn, query)
+	// 6. defer to the exchange function.
+	return exchangeTimed(ctx, dt, conn, query, exchange, &timing)
+}
+
+// dialTimed is like [*Transport.Dial] but records the [ExchangeTiming] DialTime.
+func dialTimed(ctx context.Context, dt *Transport, timing *ExchangeTiming) (StreamOpener, error) {
+	t0 := dt.now()
+	conn, err := dt.Dial(ctx)
+	timing.DialTime = dt.since(t0)
+	return conn, err
+}
+
+// exchangeTimed invokes exchange and records the [ExchangeTiming] ExchangeTime.
+func exchangeTimed[Q, T any](ctx context.Context, dt *Transport, conn StreamOpener,
+	query Q, exchange exchangeFunc[Q, T], timing *ExchangeTiming) (T, error) {
+	t0 := dt.now()
+	resp, err := exchange(withReadTimer(withBorrowedStreamOpener(ctx), dt, timing), conn, query)
+	timing.ExchangeTime = dt.since(t0)
+	timing.Handshake = StreamOpenerHandshakeKind(conn)
+	if err == nil {
+		if err := dt.policyRecord(dt.endpointFor(ctx), conn); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	return resp, err
+}
+
+// transportExchangeWithPool is like transportExchange but uses the configured [*Pool].
+func transportExchangeWithPool[Q, T any](ctx context.Context, dt *Transport,
+	query Q, exchange exchangeFunc[Q, T], timing *ExchangeTiming) (T, error) {
+	// 1. reuse an idle connection or create a new one
+	key := newPoolKey(dt.dialer, dt.endpointFor(ctx))
+	conn, stats, found := dt.Pool.get(key)
+	timing.Reused = found
+	if !found {
+		var err error
+		if conn, err = dialTimed(ctx, dt, timing); err != nil {
+			var zero T
+			return zero, wrapContextError(ctx, err)
+		}
+		stats = newConnStats(key, dt.Pool.now())
+	}
+
+	// 2. close the connection if the context is done during the exchange
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	// 3. perform the exchange tracking the connection state
+	dt.Pool.track(stats)
+	stats.begin()
+	resp, err := exchangeTimed(withConnStats(ctx, stats), dt, conn, query, exchange, timing)
+	stats.end(dt.Pool.now(), err)
+	dt.Pool.untrack(stats)
+
+	// 4. only return healthy connections to the pool
+	if !stop() {
+		return resp, err // the connection has already been closed
+	}
+	if err != nil {
+		closeWithTimeout(conn, dt.CloseTimeout)
+		return resp, err
+	}
+	dt.Pool.put(key, conn, stats)
+	return resp, nil
 }
 
 // ExchangeWithStreamOpener sends a [*dnscodec.Query] and receives a [*dnscodec.Response].
 //
 // This method allows reusing a long-lived connection across multiple exchanges.
+// It does not close conn unless ctx transfers its ownership to this method
+// using [WithStreamOpenerOwnership].
 func (dt *Transport) ExchangeWithStreamOpener(ctx context.Context, conn StreamOpener, query *dnscodec.Query) (*dnscodec.Response, error) {
-	// 1. Open the stream for sending the DoTCP, DoT, or DoQ query.
-	stream, err := conn.OpenStream()
+	return streamExchange(ctx, dt, conn, query, parseResponse)
+}
+
+// parseFunc parses the raw response given the query message and the raw query.
+//
+// The rawQuery and rawResp buffers are recycled after parseFunc returns.
+type parseFunc[T any] func(queryMsg *dns.Msg, rawQuery, rawResp []byte) (T, error)
+
+// parseResponse is the [parseFunc] used by [*Transport.ExchangeWithStreamOpener].
+func parseResponse(queryMsg *dns.Msg, rawQuery, rawResp []byte) (*dnscodec.Response, error) {
+	// Note that Unpack copies the data it needs, so it is safe to
+	// recycle the buffer containing the raw response.
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(rawResp); err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+	if len(queryMsg.Question) == 1 && queryMsg.Question[0].Qclass == dns.ClassANY {
+		return parseResponseClassANY(queryMsg, respMsg)
+	}
+	return dnscodec.ParseResponse(queryMsg, respMsg)
+}
+
+// parseResponseClassANY is like [dnscodec.ParseResponse] but treats the ANY
+// question class as a wildcard, since [dnscodec.ResponseExtractValidAnswers]
+// only accepts the answers whose class is equal to the question class.
+func parseResponseClassANY(queryMsg, respMsg *dns.Msg) (*dnscodec.Response, error) {
+	// 1. validate the response like dnscodec.ParseResponse does
+	q0, err := dnscodec.ValidateResponseForQuery(queryMsg, respMsg)
 	if err != nil {
 		return nil, err
 	}
+	if err := dnscodec.ResponseErrorFromRCODE(respMsg); err != nil {
+		return nil, err
+	}
+
+	// 2. extract the valid answers of each class in the response
+	var (
+		classes = make(map[uint16]bool)
+		valid   = make(map[dns.RR]bool)
+	)
+	for _, rr := range respMsg.Answer {
+		if classes[rr.Header().Class] {
+			continue
+		}
+		classes[rr.Header().Class] = true
+		question := q0
+		question.Qclass = rr.Header().Class
+		rrs, _ := dnscodec.ResponseExtractValidAnswers(question, respMsg)
+		for _, rr := range rrs {
+			valid[rr] = true
+		}
+	}
+
+	// 3. return the valid answers in the response order
+	var rrs []dns.RR
+	for _, rr := range respMsg.Answer {
+		if valid[rr] {
+			rrs = append(rrs, rr)
+		}
+	}
+	if len(rrs) <= 0 {
+		return nil, dnscodec.ErrNoData
+	}
+	return &dnscodec.Response{Query: queryMsg, Response: respMsg, ValidRRs: rrs}, nil
+}
+
+// streamExchange implements [*Transport.ExchangeWithStreamOpener] and similar methods.
+func streamExchange[T any](ctx context.Context, dt *Transport, conn StreamOpener, query *dnscodec.Query, parse parseFunc[T]) (T, error) {
+	var queryMsg *dns.Msg
+	pack := func(buf []byte) ([]byte, uint16, error) {
+		var (
+			rawQuery []byte
+			err      error
+		)
+		query, queryMsg, rawQuery, err = streamPackQuery(dt, conn, query, buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		return rawQuery, query.MaxSize, nil
+	}
+	return streamRoundTrip(ctx, dt, conn, pack, func(rawQuery, rawResp []byte) (T, error) {
+		return parse(queryMsg, rawQuery, rawResp)
+	})
+}
+
+// streamRoundTrip implements [streamExchange] and [ExchangeCodecWithStreamOpener].
+//
+// The pack function serializes the query into the given buffer and returns the
+// raw query along with the maximum response size. The parse function receives
+// the raw query we sent and the raw response, which we recycle afterwards.
+func streamRoundTrip[T any](ctx context.Context, dt *Transport, conn StreamOpener,
+	pack func(buf []byte) ([]byte, uint16, error), parse func(rawQuery, rawResp []byte) (T, error)) (T, error) {
+	ctx, dt = sampleExchange(ctx, dt)
+
+	// 1. Open the stream for sending the DoTCP, DoT, or DoQ query,
+	// closing the connection when done if we own it.
+	ctx, cancel := takeStreamOpenerOwnership(ctx, dt, conn)
+	defer cancel()
+	var zero T
+	stream, err := conn.OpenStream()
+	if err != nil {
+		return zero, wrapContextError(ctx, err)
+	}
 	defer stream.Close()
 
 	// 2. Use the context deadline to limit the query lifetime.
-	if deadline, ok := ctx.Deadline(); ok {
-		_ = stream.SetDeadline(deadline)
+	if streamSetDeadline(ctx, dt, stream) {
 		defer stream.SetDeadline(time.Time{})
 	}
 
-	// 3. Mutate and serialize the query.
+	// 3. Serialize and send the query.
+	packBuf := getStreamBuffer(streamBufferSize)
+	defer putStreamBuffer(packBuf)
+	rawQuery, maxSize, err := pack(*packBuf)
+	if err != nil {
+		return zero, err
+	}
+	if rawQuery, err = streamSendRawQuery(ctx, dt, conn, stream, rawQuery, maxSize); err != nil {
+		return zero, err
+	}
+
+	// 4. Wrap the stream to avoid issuing too many reads
+	// then read the response header and message
+	streamSetReadDeadline(ctx, dt, stream)
+	br := getStreamReader(dt, stream)
+	defer putStreamReader(br)
+	frame, err := streamReadFrame(ctx, dt, br, int(maxSize))
+	if err != nil {
+		streamCancelReadOnEarlyAbort(stream, err)
+		return zero, err
+	}
+	defer frame.done()
+	if err := streamCheckTrailingData(dt, br); err != nil {
+		return zero, err
+	}
+	if dt.TCPKeepalive && streamOpenerTCPKeepalive(conn) {
+		streamObserveTCPKeepalive(ctx, dt, frame.bytes())
+	}
+
+	// 5. Parse the response and return
+	return parse(rawQuery, frame.bytes())
+}
+
+// streamPackQuery mutates and serializes the query.
+//
+// It returns the mutated query, the query message, and the raw query, which
+// lives inside buf, so the caller must not recycle buf before it is done
+// using the raw query.
+func streamPackQuery(dt *Transport, conn StreamOpener,
+	query *dnscodec.Query, buf []byte) (*dnscodec.Query, *dns.Msg, []byte, error) {
 	query = query.Clone()
-	conn.MutateQuery(query)
+	if !dt.Verbatim {
+		conn.MutateQuery(query)
+	}
 	queryMsg, err := query.NewMsg()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	if dt.QueryClass != 0 {
+		queryMsg.Question[0].Qclass = dt.QueryClass
+	}
+	if dt.NoRecursion {
+		queryMsg.RecursionDesired = false
 	}
-	rawQuery, err := queryMsg.Pack()
+	rawQuery, err := queryMsg.PackBuffer(buf)
 	if err != nil {
+		return nil, nil, nil, err
+	}
+	return query, queryMsg, rawQuery, nil
+}
+
+// streamSendRawQuery finalizes the raw query, by adding the edns-tcp-keepalive
+// option when configured and by applying the [PaddingOracle], and sends it over
+// the stream. It returns the raw query we actually sent.
+//
+// We use maxSize when we need to add the EDNS(0) OPT record.
+func streamSendRawQuery(ctx context.Context, dt *Transport, conn StreamOpener,
+	stream Stream, rawQuery []byte, maxSize uint16) ([]byte, error) {
+	// 1. Finalize the raw query.
+	var err error
+	if dt.TCPKeepalive && streamOpenerTCPKeepalive(conn) {
+		if rawQuery, err = queryAddTCPKeepalive(rawQuery, maxSize); err != nil {
+			return nil, err
+		}
+	}
+	if dt.PaddingOracle != nil {
+		if rawQuery, err = padQuery(dt.PaddingOracle, rawQuery); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. Send the raw query.
+	if err := streamWriteQuery(ctx, dt, stream, rawQuery); err != nil {
 		return nil, err
 	}
+	return rawQuery, nil
+}
+
+// streamWriteQuery observes the raw query, sends it over the stream, and
+// closes the stream for writing.
+func streamWriteQuery(ctx context.Context, dt *Transport, stream Stream, rawQuery []byte) error {
+	// 1. Observe the raw query.
 	if dt.ObserveRawQuery != nil {
 		dt.ObserveRawQuery(bytes.Clone(rawQuery))
 	}
 
-	// 4. Wrap the query into a frame
-	rawQueryFrame := newStreamMsgFrame(rawQuery)
-
-	// 5. Send the query.
-	if _, err := stream.Write(rawQueryFrame); err != nil {
-		return nil, err
+	// 2. Wrap the query into a frame and send it.
+	streamSetWriteDeadline(ctx, dt, stream)
+	if err := writeStreamMsgFrame(stream, rawQuery); err != nil {
+		return wrapTimeoutError(ctx, dt.WriteTimeout, ErrWriteTimeout, err)
 	}
+	readTimerFromContext(ctx).querySent(dt)
 
-	// 6. Ensure we close the [Stream] when using DoQ to signal the
+	// 3. Ensure we close the [Stream] when using DoQ to signal the
 	// upstream server that it is okay to send a response.
 	//
 	// RFC 9250 is very clear in this respect:
@@ -192,42 +741,139 @@ func (dt *Transport) ExchangeWithStreamOpener(ctx context.Context, conn StreamOp
 	//
 	// Obviously, this is a no-op for TCP/TLS
 	stream.Close()
+	return nil
+}
 
-	// 7. Wrap the stream to avoid issuing too many reads
-	// then read the response header and message
-	br := bufio.NewReader(stream)
+// streamFrame is a raw message read using [streamReadFrame].
+type streamFrame struct {
+	// buf is the pooled buffer containing the raw message.
+	buf *[]byte
+
+	// release releases the [*MemoryBudget] or is nil.
+	release func()
+}
+
+// bytes returns the raw message.
+func (f streamFrame) bytes() []byte {
+	return *f.buf
+}
+
+// done recycles the buffer and releases the memory budget.
+func (f streamFrame) done() {
+	putStreamBuffer(f.buf)
+	if f.release != nil {
+		f.release()
+	}
+}
+
+// streamReadFrame reads a single framed message not larger than maxSize.
+//
+// On success, the caller MUST call the frame done method when done.
+func streamReadFrame(ctx context.Context, dt *Transport, r io.Reader, maxSize int) (streamFrame, error) {
 	header := make([]byte, 2)
-	if _, err := io.ReadFull(br, header); err != nil {
-		return nil, err
+	if _, err := io.ReadFull(r, header); err != nil {
+		return streamFrame{}, wrapTimeoutError(ctx, dt.ReadTimeout, ErrReadTimeout, err)
 	}
+	rt := readTimerFromContext(ctx)
+	rt.firstByte(dt)
 	length := int(header[0])<<8 | int(header[1])
-	if length > int(query.MaxSize) {
-		return nil, dnscodec.ErrServerMisbehaving
+	if length > maxSize {
+		return streamFrame{}, dnscodec.ErrServerMisbehaving
 	}
-	rawResp := make([]byte, length)
-	if _, err := io.ReadFull(br, rawResp); err != nil {
-		return nil, err
+	var frame streamFrame
+	if dt.MemoryBudget != nil {
+		release, err := dt.MemoryBudget.Acquire(ctx, int64(length))
+		if err != nil {
+			return streamFrame{}, err
+		}
+		frame.release = release
+	}
+	frame.buf = getStreamBuffer(length)
+	count, err := streamReadEarlyAbort(ctx, r, *frame.buf)
+	if err == nil {
+		_, err = io.ReadFull(r, (*frame.buf)[count:])
+	}
+	if err != nil {
+		frame.done()
+		return streamFrame{}, wrapTimeoutError(ctx, dt.ReadTimeout, ErrReadTimeout, err)
 	}
+	rt.lastByte(dt, length)
 	if dt.ObserveRawResponse != nil {
-		dt.ObserveRawResponse(bytes.Clone(rawResp))
+		dt.ObserveRawResponse(bytes.Clone(*frame.buf))
+	}
+	if dt.ObserveResponsePadding != nil {
+		if info, err := CheckResponsePadding(*frame.buf); err == nil {
+			dt.ObserveResponsePadding(info)
+		}
+	}
+	if dt.ObserveResponseCompression != nil {
+		if info, err := CheckResponseCompression(*frame.buf); err == nil {
+			dt.ObserveResponseCompression(info)
+		}
 	}
+	return frame, nil
+}
 
-	// 8. Parse the response and return
-	respMsg := new(dns.Msg)
-	if err := respMsg.Unpack(rawResp); err != nil {
-		return nil, dnscodec.ErrServerMisbehaving
+// streamCheckTrailingData returns [ErrTrailingData] when the reader has
+// buffered data after the response frame.
+func streamCheckTrailingData(dt *Transport, br *bufio.Reader) error {
+	if br.Buffered() <= 0 {
+		return nil
 	}
-	return dnscodec.ParseResponse(queryMsg, respMsg)
+	if dt.ObserveTrailingData != nil {
+		trailing, _ := br.Peek(br.Buffered())
+		dt.ObserveTrailingData(bytes.Clone(trailing))
+	}
+	return ErrTrailingData
 }
 
-// newStreamMsgFrame creates a new raw frame for sending a message over a stream.
-func newStreamMsgFrame(rawMsg []byte) []byte {
+// streamFrameCopyThreshold is the maximum message size for which
+// [writeStreamMsgFrame] copies the message into a contiguous frame.
+const streamFrameCopyThreshold = streamBufferSize - 2
+
+// streamBuffersWriter is implemented by [Stream] types that can write
+// several buffers at once (e.g., using writev for TCP).
+type streamBuffersWriter interface {
+	WriteBuffers(v net.Buffers) (int64, error)
+}
+
+// writeStreamMsgFrame writes the frame for sending a message over a stream.
+//
+// For small messages, we build a contiguous frame using a pooled buffer, so
+// that we issue a single write. For large messages (e.g., dynamic updates), we
+// avoid copying by writing the length prefix and the message separately, using
+// a single writev call when the stream supports [streamBuffersWriter].
+//
+// This function returns [ErrQueryTooLarge] if the message does not fit a frame.
+func writeStreamMsgFrame(stream Stream, rawMsg []byte) error {
 	// Per RFC 1035 Section 4.2.2, DNS over TCP uses a 2-byte length prefix,
-	// limiting messages to 65535 bytes. This is a protocol invariant that
-	// miekg/dns should never violate.
-	runtimex.Assert(len(rawMsg) <= math.MaxUint16)
-	rawMsgFrame := []byte{byte(len(rawMsg) >> 8)}
-	rawMsgFrame = append(rawMsgFrame, byte(len(rawMsg)))
+	// limiting messages to 65535 bytes. A caller-supplied message may be larger
+	// than that, so we must fail gracefully rather than crashing.
+	if len(rawMsg) > math.MaxUint16 {
+		return ErrQueryTooLarge
+	}
+	if len(rawMsg) <= streamFrameCopyThreshold {
+		frameBuf := getStreamBuffer(0)
+		defer putStreamBuffer(frameBuf)
+		*frameBuf = appendStreamMsgFrame(*frameBuf, rawMsg)
+		_, err := stream.Write(*frameBuf)
+		return err
+	}
+	header := []byte{byte(len(rawMsg) >> 8), byte(len(rawMsg))}
+	bufs := net.Buffers{header, rawMsg}
+	if bw, ok := stream.(streamBuffersWriter); ok {
+		_, err := bw.WriteBuffers(bufs)
+		return err
+	}
+	_, err := bufs.WriteTo(stream)
+	return err
+}
+
+// appendStreamMsgFrame appends to dst the raw frame for sending a message over a stream.
+//
+// The caller MUST ensure that len(rawMsg) does not exceed [math.MaxUint16].
+func appendStreamMsgFrame(dst, rawMsg []byte) []byte {
+	rawMsgFrame := append(dst, byte(len(rawMsg)>>8), byte(len(rawMsg)))
 	rawMsgFrame = append(rawMsgFrame, rawMsg...)
 	return rawMsgFrame
 }
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"net/netip"
 	"strings"
@@ -18,75 +19,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-type streamOpenerStub struct {
-	// openStream creates a new stream.
-	openStream func() (Stream, error)
-
-	// mutateQuery modifies the DNS query.
-	mutateQuery func(msg *dnscodec.Query)
-}
-
-// Close implements [StreamOpener].
-func (s *streamOpenerStub) Close() error {
-	return nil
-}
-
-// MutateQuery implements [StreamOpener].
-func (s *streamOpenerStub) MutateQuery(msg *dnscodec.Query) {
-	if s.mutateQuery != nil {
-		s.mutateQuery(msg)
-	}
-}
-
-// OpenStream implements [StreamOpener].
-func (s *streamOpenerStub) OpenStream() (Stream, error) {
-	return s.openStream()
-}
-
-type streamStub struct {
-	// setDeadline sets the stream deadline.
-	setDeadline func(t time.Time) error
-
-	// read reads from the stream.
-	read func(p []byte) (int, error)
-
-	// write writes to the stream.
-	write func(p []byte) (int, error)
-
-	// close closes the stream.
-	close func() error
-}
-
-// SetDeadline implements [Stream].
-func (s *streamStub) SetDeadline(t time.Time) error {
-	return s.setDeadline(t)
-}
-
-// Read implements [Stream].
-func (s *streamStub) Read(p []byte) (int, error) {
-	return s.read(p)
-}
-
-// Write implements [Stream].
-func (s *streamStub) Write(p []byte) (int, error) {
-	return s.write(p)
-}
-
-// Close implements [Stream].
-func (s *streamStub) Close() error {
-	return s.close()
-}
-
-// newStreamStub creates a stream stub with default no-op implementations.
-func newStreamStub() *streamStub {
-	return &streamStub{
-		setDeadline: func(t time.Time) error { return nil },
-		read:        func(p []byte) (int, error) { return 0, io.EOF },
-		write:       func(p []byte) (int, error) { return 0, nil },
-		close:       func() error { return nil },
-	}
-}
-
 // errorAfterReader returns the given error after exhausting the reader.
 type errorAfterReader struct {
 	r   *bytes.Reader
@@ -130,8 +62,8 @@ func buildRawResponseFromQuery(t *testing.T, rawQuery []byte) []byte {
 func TestExchangeWithStreamOpenerOpenStreamError(t *testing.T) {
 	expected := errors.New("open stream failed")
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
 			return nil, expected
 		},
 	}
@@ -144,14 +76,14 @@ func TestExchangeWithStreamOpenerCloneAndMutateQuery(t *testing.T) {
 	query := dnscodec.NewQuery("example.com", dns.TypeA)
 	orig := *query
 	var rawWritten []byte
-	conn := &streamOpenerStub{
-		mutateQuery: func(msg *dnscodec.Query) {
+	conn := &FuncStreamOpener{
+		MutateQueryFunc: func(msg *dnscodec.Query) {
 			// Mimic TCP behavior for this test.
 			msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
 		},
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
-			stub.write = func(p []byte) (int, error) {
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.WriteFunc = func(p []byte) (int, error) {
 				rawWritten = append([]byte{}, p...)
 				return len(p), nil
 			}
@@ -172,6 +104,47 @@ func TestExchangeWithStreamOpenerCloneAndMutateQuery(t *testing.T) {
 	require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeTCP), msg.IsEdns0().UDPSize())
 }
 
+func TestExchangeWithStreamOpenerVerbatim(t *testing.T) {
+	query := dnscodec.NewQuery("example.com", dns.TypeA)
+	query.ID = 1234
+	query.MaxSize = 512
+	var rawWritten []byte
+	conn := &FuncStreamOpener{
+		MutateQueryFunc: func(msg *dnscodec.Query) {
+			// Mimic QUIC behavior for this test.
+			msg.Flags |= dnscodec.QueryFlagBlockLengthPadding
+			msg.ID = 0
+			msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+		},
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.WriteFunc = func(p []byte) (int, error) {
+				rawWritten = append([]byte{}, p...)
+				return len(p), nil
+			}
+			return stub, nil
+		},
+	}
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	dt.Verbatim = true
+	dt.NoRecursion = true
+	_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, query)
+	require.Error(t, err)
+	require.NotEmpty(t, rawWritten)
+
+	msg := &dns.Msg{}
+	require.NoError(t, msg.Unpack(rawWritten[2:]))
+	require.Equal(t, uint16(1234), msg.Id)
+	require.False(t, msg.RecursionDesired)
+	opt := msg.IsEdns0()
+	require.NotNil(t, opt)
+	require.Equal(t, uint16(512), opt.UDPSize())
+	for _, option := range opt.Option {
+		require.NotEqual(t, uint16(dns.EDNS0PADDING), option.Option())
+	}
+}
+
 func TestExchangeWithStreamOpenerObserveRawQuery(t *testing.T) {
 	query := dnscodec.NewQuery("example.com", dns.TypeA)
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
@@ -181,11 +154,11 @@ func TestExchangeWithStreamOpenerObserveRawQuery(t *testing.T) {
 		rawResp    []byte
 		respReader *bytes.Reader
 	)
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
 
-			stub.write = func(p []byte) (int, error) {
+			stub.WriteFunc = func(p []byte) (int, error) {
 				rawWritten = append([]byte{}, p...)
 				rawResp = buildRawResponseFromQuery(t, rawWritten[2:])
 				frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
@@ -193,7 +166,7 @@ func TestExchangeWithStreamOpenerObserveRawQuery(t *testing.T) {
 				return len(p), nil
 			}
 
-			stub.read = func(p []byte) (int, error) {
+			stub.ReadFunc = func(p []byte) (int, error) {
 				if respReader == nil {
 					return 0, io.EOF
 				}
@@ -218,10 +191,10 @@ func TestExchangeWithStreamOpenerObserveRawQuery(t *testing.T) {
 
 func TestExchangeWithStreamOpenerFrameLength(t *testing.T) {
 	var rawWritten []byte
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
-			stub.write = func(p []byte) (int, error) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.WriteFunc = func(p []byte) (int, error) {
 				rawWritten = append([]byte{}, p...)
 				return len(p), nil
 			}
@@ -246,18 +219,18 @@ func TestExchangeWithStreamOpenerObserveRawResponse(t *testing.T) {
 		rawResp    []byte
 		respReader *bytes.Reader
 	)
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
 
-			stub.write = func(p []byte) (int, error) {
+			stub.WriteFunc = func(p []byte) (int, error) {
 				rawResp = buildRawResponseFromQuery(t, p[2:])
 				frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
 				respReader = bytes.NewReader(frame)
 				return len(p), nil
 			}
 
-			stub.read = func(p []byte) (int, error) {
+			stub.ReadFunc = func(p []byte) (int, error) {
 				if respReader == nil {
 					return 0, io.EOF
 				}
@@ -280,13 +253,92 @@ func TestExchangeWithStreamOpenerObserveRawResponse(t *testing.T) {
 	require.Equal(t, rawResp, hookResp)
 }
 
+// newTrailingDataStreamOpener returns a [*closeCountingOpener] answering any
+// query with a response frame followed by the given trailing data.
+func newTrailingDataStreamOpener(t *testing.T, trailing []byte) *closeCountingOpener {
+	return &closeCountingOpener{
+		FuncStreamOpener: FuncStreamOpener{
+			OpenStreamFunc: func() (Stream, error) {
+				stub := &FuncStream{}
+				var respReader *bytes.Reader
+				stub.WriteFunc = func(p []byte) (int, error) {
+					rawResp := buildRawResponseFromQuery(t, p[2:])
+					frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+					respReader = bytes.NewReader(append(frame, trailing...))
+					return len(p), nil
+				}
+				stub.ReadFunc = func(p []byte) (int, error) {
+					return respReader.Read(p)
+				}
+				return stub, nil
+			},
+		},
+	}
+}
+
+func TestExchangeWithStreamOpenerTrailingData(t *testing.T) {
+	trailing := []byte{0x00, 0x10, 0xde, 0xad}
+
+	t.Run("fails and reports the trailing data", func(t *testing.T) {
+		var observed []byte
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+		dt.ObserveTrailingData = func(p []byte) {
+			observed = p
+		}
+		conn := newTrailingDataStreamOpener(t, trailing)
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.ErrorIs(t, err, ErrTrailingData)
+		require.Nil(t, resp)
+		require.Equal(t, trailing, observed)
+	})
+
+	t.Run("applies to raw exchanges", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+		conn := newTrailingDataStreamOpener(t, trailing)
+		_, err := dt.ExchangeRawWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.ErrorIs(t, err, ErrTrailingData)
+	})
+
+	t.Run("applies to codec exchanges", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+		conn := newTrailingDataStreamOpener(t, trailing)
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeA)
+		_, err := ExchangeCodecWithStreamOpener(context.Background(), dt, MsgCodec{}, conn, query)
+		require.ErrorIs(t, err, ErrTrailingData)
+	})
+
+	t.Run("without trailing data", func(t *testing.T) {
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+		dt.ObserveTrailingData = func(p []byte) {
+			t.Fatal("unexpected trailing data")
+		}
+		conn := newTrailingDataStreamOpener(t, nil)
+		_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+	})
+}
+
+func TestExchangeWithStreamOpenerReadBufferSize(t *testing.T) {
+	// Use a buffer smaller than the response to exercise multiple reads.
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	dt.ReadBufferSize = 16
+	for range 3 {
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), newEchoStreamOpener(t), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"1.1.1.1"}, addrs)
+	}
+}
+
 func TestExchangeWithStreamOpenerSetsDeadline(t *testing.T) {
 	deadline := time.Now().Add(time.Second)
 	var gotDeadline []time.Time
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
-			stub.setDeadline = func(t time.Time) error {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.SetDeadlineFunc = func(t time.Time) error {
 				gotDeadline = append(gotDeadline, t)
 				return nil
 			}
@@ -308,10 +360,10 @@ func TestExchangeWithStreamOpenerSetsDeadline(t *testing.T) {
 
 func TestExchangeWithStreamOpenerClosesStream(t *testing.T) {
 	var closed bool
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			stub := newStreamStub()
-			stub.close = func() error {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			stub.CloseFunc = func() error {
 				closed = true
 				return nil
 			}
@@ -327,11 +379,9 @@ func TestExchangeWithStreamOpenerClosesStream(t *testing.T) {
 
 func TestExchangeWithStreamOpenerNewMsgError(t *testing.T) {
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			return &streamStub{
-				close: func() error { return nil },
-			}, nil
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{}, nil
 		},
 	}
 
@@ -344,11 +394,9 @@ func TestExchangeWithStreamOpenerPackError(t *testing.T) {
 	name := tooLongLabel + ".example.com"
 
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			return &streamStub{
-				close: func() error { return nil },
-			}, nil
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{}, nil
 		},
 	}
 
@@ -359,11 +407,10 @@ func TestExchangeWithStreamOpenerPackError(t *testing.T) {
 func TestExchangeWithStreamOpenerWriteError(t *testing.T) {
 	expected := errors.New("write failed")
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			return &streamStub{
-				write: func(p []byte) (int, error) { return 0, expected },
-				close: func() error { return nil },
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{
+				WriteFunc: func(p []byte) (int, error) { return 0, expected },
 			}, nil
 		},
 	}
@@ -375,12 +422,10 @@ func TestExchangeWithStreamOpenerWriteError(t *testing.T) {
 func TestExchangeWithStreamOpenerReadHeaderError(t *testing.T) {
 	expected := errors.New("read header failed")
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
-			return &streamStub{
-				read:  func(p []byte) (int, error) { return 0, expected },
-				write: func(p []byte) (int, error) { return len(p), nil },
-				close: func() error { return nil },
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			return &FuncStream{
+				ReadFunc: func(p []byte) (int, error) { return 0, expected },
 			}, nil
 		},
 	}
@@ -392,16 +437,14 @@ func TestExchangeWithStreamOpenerReadHeaderError(t *testing.T) {
 func TestExchangeWithStreamOpenerReadBodyError(t *testing.T) {
 	expected := errors.New("read body failed")
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
 			headerOnly := &errorAfterReader{
 				r:   bytes.NewReader([]byte{0x00, 0x01}),
 				err: expected,
 			}
-			return &streamStub{
-				read:  headerOnly.Read,
-				write: func(p []byte) (int, error) { return len(p), nil },
-				close: func() error { return nil },
+			return &FuncStream{
+				ReadFunc: headerOnly.Read,
 			}, nil
 		},
 	}
@@ -412,18 +455,16 @@ func TestExchangeWithStreamOpenerReadBodyError(t *testing.T) {
 
 func TestExchangeWithStreamOpenerResponseExceedsMaxSize(t *testing.T) {
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		mutateQuery: func(msg *dnscodec.Query) {
+	conn := &FuncStreamOpener{
+		MutateQueryFunc: func(msg *dnscodec.Query) {
 			// Set a small MaxSize to trigger the check.
 			msg.MaxSize = 100
 		},
-		openStream: func() (Stream, error) {
+		OpenStreamFunc: func() (Stream, error) {
 			// Return a length header indicating 200 bytes, which exceeds MaxSize of 100.
 			frame := []byte{0x00, 0xc8} // 200 in big-endian
-			return &streamStub{
-				read:  bytes.NewReader(frame).Read,
-				write: func(p []byte) (int, error) { return len(p), nil },
-				close: func() error { return nil },
+			return &FuncStream{
+				ReadFunc: bytes.NewReader(frame).Read,
 			}, nil
 		},
 	}
@@ -434,13 +475,11 @@ func TestExchangeWithStreamOpenerResponseExceedsMaxSize(t *testing.T) {
 
 func TestExchangeWithStreamOpenerUnpackError(t *testing.T) {
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
 			frame := []byte{0x00, 0x01, 0xff}
-			return &streamStub{
-				read:  bytes.NewReader(frame).Read,
-				write: func(p []byte) (int, error) { return len(p), nil },
-				close: func() error { return nil },
+			return &FuncStream{
+				ReadFunc: bytes.NewReader(frame).Read,
 			}, nil
 		},
 	}
@@ -452,8 +491,8 @@ func TestExchangeWithStreamOpenerUnpackError(t *testing.T) {
 func TestExchangeWithStreamOpenerParseResponseError(t *testing.T) {
 	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
 	query := dnscodec.NewQuery("example.com", dns.TypeA)
-	conn := &streamOpenerStub{
-		openStream: func() (Stream, error) {
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
 			// Prepare a message that is not a response to get ErrInvalidResponse
 			resp := &dns.Msg{}
 			resp.SetRcode(&dns.Msg{Question: []dns.Question{{
@@ -464,10 +503,8 @@ func TestExchangeWithStreamOpenerParseResponseError(t *testing.T) {
 			rawResp, err := resp.Pack()
 			require.NoError(t, err)
 			frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
-			return &streamStub{
-				read:  bytes.NewReader(frame).Read,
-				write: func(p []byte) (int, error) { return len(p), nil },
-				close: func() error { return nil },
+			return &FuncStream{
+				ReadFunc: bytes.NewReader(frame).Read,
 			}, nil
 		},
 	}
@@ -476,42 +513,31 @@ func TestExchangeWithStreamOpenerParseResponseError(t *testing.T) {
 	require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
 }
 
-// streamOpenerDialerStub implements [StreamOpenerDialer] for testing.
-type streamOpenerDialerStub struct {
-	// dialContext creates a new [StreamOpener].
-	dialContext func(ctx context.Context, address netip.AddrPort) (StreamOpener, error)
-}
-
-// DialContext implements [StreamOpenerDialer].
-func (d *streamOpenerDialerStub) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
-	return d.dialContext(ctx, address)
-}
-
 func TestNewTransportWithCustomDialer(t *testing.T) {
 	query := dnscodec.NewQuery("example.com", dns.TypeA)
 	var (
 		gotMutate bool
 		rawResp   []byte
 	)
-	dialer := &streamOpenerDialerStub{
-		dialContext: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
-			return &streamOpenerStub{
-				mutateQuery: func(msg *dnscodec.Query) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return &FuncStreamOpener{
+				MutateQueryFunc: func(msg *dnscodec.Query) {
 					gotMutate = true
 					msg.Flags |= dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec
 					msg.ID = 0
 					msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
 				},
-				openStream: func() (Stream, error) {
-					stub := newStreamStub()
+				OpenStreamFunc: func() (Stream, error) {
+					stub := &FuncStream{}
 
-					stub.write = func(p []byte) (int, error) {
+					stub.WriteFunc = func(p []byte) (int, error) {
 						rawResp = buildRawResponseFromQuery(t, p[2:])
 						return len(p), nil
 					}
 
 					var respReader *bytes.Reader
-					stub.read = func(p []byte) (int, error) {
+					stub.ReadFunc = func(p []byte) (int, error) {
 						if respReader == nil {
 							frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
 							respReader = bytes.NewReader(frame)
@@ -534,8 +560,8 @@ func TestNewTransportWithCustomDialer(t *testing.T) {
 
 func TestNewTransportWithCustomDialerDialError(t *testing.T) {
 	expected := errors.New("dial failed")
-	dialer := &streamOpenerDialerStub{
-		dialContext: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
 			return nil, expected
 		},
 	}
@@ -545,3 +571,279 @@ func TestNewTransportWithCustomDialerDialError(t *testing.T) {
 	require.ErrorIs(t, err, expected)
 }
 
+func TestExchangeWithStreamOpenerQueryClass(t *testing.T) {
+	var rawWritten []byte
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+
+			var respReader *bytes.Reader
+			stub.WriteFunc = func(p []byte) (int, error) {
+				rawWritten = append([]byte{}, p...)
+
+				queryMsg := &dns.Msg{}
+				require.NoError(t, queryMsg.Unpack(p[2:]))
+				resp := &dns.Msg{}
+				resp.SetReply(queryMsg)
+				resp.Answer = []dns.RR{&dns.TXT{
+					Hdr: dns.RR_Header{
+						Name:   queryMsg.Question[0].Name,
+						Rrtype: dns.TypeTXT,
+						Class:  dns.ClassCHAOS,
+						Ttl:    0,
+					},
+					Txt: []string{"9.18.0"},
+				}}
+				rawResp, err := resp.Pack()
+				require.NoError(t, err)
+
+				frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+				respReader = bytes.NewReader(frame)
+				return len(p), nil
+			}
+
+			stub.ReadFunc = func(p []byte) (int, error) {
+				if respReader == nil {
+					return 0, io.EOF
+				}
+				return respReader.Read(p)
+			}
+
+			return stub, nil
+		},
+	}
+
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	dt.QueryClass = dns.ClassCHAOS
+	resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("version.bind", dns.TypeTXT))
+	require.NoError(t, err)
+
+	msg := &dns.Msg{}
+	require.NoError(t, msg.Unpack(rawWritten[2:]))
+	require.Equal(t, uint16(dns.ClassCHAOS), msg.Question[0].Qclass)
+	require.Len(t, resp.ValidRRs, 1)
+	require.Equal(t, []string{"9.18.0"}, resp.ValidRRs[0].(*dns.TXT).Txt)
+}
+
+// newQueryClassTestStreamOpener returns a [*FuncStreamOpener] answering with
+// an IN class A record, along with a function returning the written query.
+func newQueryClassTestStreamOpener(t *testing.T) (*FuncStreamOpener, func() *dns.Msg) {
+	var written *dns.Msg
+	conn := &FuncStreamOpener{
+		OpenStreamFunc: func() (Stream, error) {
+			stub := &FuncStream{}
+			var respReader *bytes.Reader
+			stub.WriteFunc = func(p []byte) (int, error) {
+				written = &dns.Msg{}
+				require.NoError(t, written.Unpack(p[2:]))
+				resp := &dns.Msg{}
+				resp.SetReply(written)
+				resp.Answer = []dns.RR{&dns.A{
+					Hdr: dns.RR_Header{Name: written.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.IPv4(10, 0, 0, 1),
+				}}
+				rawResp, err := resp.Pack()
+				require.NoError(t, err)
+				respReader = bytes.NewReader(appendStreamMsgFrame(nil, rawResp))
+				return len(p), nil
+			}
+			stub.ReadFunc = func(p []byte) (int, error) {
+				if respReader == nil {
+					return 0, io.EOF
+				}
+				return respReader.Read(p)
+			}
+			return stub, nil
+		},
+	}
+	return conn, func() *dns.Msg { return written }
+}
+
+func TestExchangeWithStreamOpenerDefaultQueryClass(t *testing.T) {
+	conn, written := newQueryClassTestStreamOpener(t)
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+	resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.Equal(t, uint16(dns.ClassINET), written().Question[0].Qclass)
+	addrs, err := resp.RecordsA()
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.1"}, addrs)
+}
+
+func TestExchangeWithStreamOpenerQueryClassANY(t *testing.T) {
+	t.Run("accepts the answers of any class", func(t *testing.T) {
+		conn, written := newQueryClassTestStreamOpener(t)
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+		dt.QueryClass = dns.ClassANY
+		resp, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, uint16(dns.ClassANY), written().Question[0].Qclass)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"10.0.0.1"}, addrs)
+	})
+
+	t.Run("still rejects answers for other names", func(t *testing.T) {
+		queryMsg := new(dns.Msg)
+		queryMsg.SetQuestion("example.com.", dns.TypeA)
+		queryMsg.Question[0].Qclass = dns.ClassANY
+		respMsg := new(dns.Msg)
+		respMsg.SetReply(queryMsg)
+		respMsg.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, 1),
+		}}
+		_, err := parseResponseClassANY(queryMsg, respMsg)
+		require.ErrorIs(t, err, dnscodec.ErrNoData)
+	})
+}
+
+func TestWriteStreamMsgFrame(t *testing.T) {
+	t.Run("small messages use a single write", func(t *testing.T) {
+		var writes [][]byte
+		stub := &FuncStream{}
+		stub.WriteFunc = func(p []byte) (int, error) {
+			writes = append(writes, append([]byte{}, p...))
+			return len(p), nil
+		}
+
+		require.NoError(t, writeStreamMsgFrame(stub, []byte{0x01, 0x02}))
+		require.Equal(t, [][]byte{{0x00, 0x02, 0x01, 0x02}}, writes)
+	})
+
+	t.Run("large messages are not copied", func(t *testing.T) {
+		var writes [][]byte
+		stub := &FuncStream{}
+		stub.WriteFunc = func(p []byte) (int, error) {
+			writes = append(writes, p)
+			return len(p), nil
+		}
+
+		rawMsg := make([]byte, streamFrameCopyThreshold+1)
+		require.NoError(t, writeStreamMsgFrame(stub, rawMsg))
+		require.Len(t, writes, 2)
+		require.Equal(t, []byte{byte(len(rawMsg) >> 8), byte(len(rawMsg))}, writes[0])
+		require.Same(t, &rawMsg[0], &writes[1][0])
+	})
+
+	t.Run("large messages near the maximum size", func(t *testing.T) {
+		var written int
+		stub := &FuncStream{}
+		stub.WriteFunc = func(p []byte) (int, error) {
+			written += len(p)
+			return len(p), nil
+		}
+
+		rawMsg := make([]byte, math.MaxUint16)
+		require.NoError(t, writeStreamMsgFrame(stub, rawMsg))
+		require.Equal(t, math.MaxUint16+2, written)
+	})
+
+	t.Run("too large messages", func(t *testing.T) {
+		var written int
+		stub := &FuncStream{}
+		stub.WriteFunc = func(p []byte) (int, error) {
+			written += len(p)
+			return len(p), nil
+		}
+
+		err := writeStreamMsgFrame(stub, make([]byte, math.MaxUint16+1))
+		require.ErrorIs(t, err, ErrQueryTooLarge)
+		require.Zero(t, written)
+	})
+
+	t.Run("write errors are propagated", func(t *testing.T) {
+		expected := errors.New("write failed")
+		stub := &FuncStream{}
+		stub.WriteFunc = func(p []byte) (int, error) {
+			return 0, expected
+		}
+
+		require.ErrorIs(t, writeStreamMsgFrame(stub, []byte{0x01}), expected)
+		require.ErrorIs(t, writeStreamMsgFrame(stub, make([]byte, streamFrameCopyThreshold+1)), expected)
+	})
+}
+
+func TestTransportObserveTiming(t *testing.T) {
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			time.Sleep(time.Millisecond)
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	var timings []ExchangeTiming
+	dt.ObserveTiming = func(timing ExchangeTiming) {
+		timings = append(timings, timing)
+	}
+
+	t.Run("without pool", func(t *testing.T) {
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.NoError(t, err)
+		require.Len(t, timings, 1)
+		require.GreaterOrEqual(t, timings[0].DialTime, time.Millisecond)
+		require.NotZero(t, timings[0].ExchangeTime)
+		require.False(t, timings[0].Reused)
+	})
+
+	t.Run("with pool", func(t *testing.T) {
+		dt.Pool = NewPool(1)
+		defer func() { dt.Pool = nil }()
+		for range 2 {
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Len(t, timings, 3)
+		require.NotZero(t, timings[1].DialTime)
+		require.False(t, timings[1].Reused)
+		require.Zero(t, timings[2].DialTime)
+		require.NotZero(t, timings[2].ExchangeTime)
+		require.True(t, timings[2].Reused)
+	})
+
+	t.Run("dial failure", func(t *testing.T) {
+		dialer.DialContextFunc = func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return nil, errors.New("dial failed")
+		}
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+		require.Error(t, err)
+		require.Len(t, timings, 4)
+		require.NotZero(t, timings[3].DialTime)
+		require.Zero(t, timings[3].ExchangeTime)
+	})
+}
+
+func TestTransportTimeNow(t *testing.T) {
+	// Use a fake clock advancing by one second each time we read it.
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var ticks int
+	dialer := &FuncStreamOpenerDialer{
+		DialContextFunc: func(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+			return newEchoStreamOpener(t), nil
+		},
+	}
+	dt := NewTransport(dialer, netip.MustParseAddrPort("127.0.0.1:53"))
+	dt.TimeNow = func() time.Time {
+		now := t0.Add(time.Duration(ticks) * time.Second)
+		ticks++
+		return now
+	}
+	var timings []ExchangeTiming
+	dt.ObserveTiming = func(timing ExchangeTiming) {
+		timings = append(timings, timing)
+	}
+
+	_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("example.com", dns.TypeA))
+	require.NoError(t, err)
+	require.Len(t, timings, 1)
+	require.Equal(t, ExchangeTiming{
+		StartTime:       t0,
+		TotalTime:       8 * time.Second,
+		DialTime:        time.Second,
+		ExchangeTime:    4 * time.Second,
+		TimeToFirstByte: time.Second,
+		TimeToLastByte:  2 * time.Second,
+		ResponseSize:    56,
+		CorrelationID:   timings[0].CorrelationID,
+	}, timings[0])
+}
@@ -0,0 +1,301 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// stressExchanges is the number of exchanges performed by each stress test.
+const stressExchanges = 300
+
+// stressParallelism is the number of goroutines performing exchanges.
+const stressParallelism = 8
+
+// leakSnapshot contains the resources we check for leaks.
+type leakSnapshot struct {
+	// goroutines is the number of goroutines.
+	goroutines int
+
+	// fds is the number of open file descriptors or -1 if unknown.
+	fds int
+}
+
+// String implements [fmt.Stringer].
+func (s leakSnapshot) String() string {
+	return fmt.Sprintf("goroutines=%d fds=%d", s.goroutines, s.fds)
+}
+
+// takeLeakSnapshot returns the current [leakSnapshot].
+func takeLeakSnapshot() leakSnapshot {
+	snap := leakSnapshot{goroutines: runtime.NumGoroutine(), fds: -1}
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		snap.fds = len(entries)
+	}
+	return snap
+}
+
+// takeBaselineLeakSnapshot is like [takeLeakSnapshot] but first waits for
+// the goroutines of the previous tests that are still exiting (e.g., those
+// closing connections in the background), which would otherwise mask leaks.
+func takeBaselineLeakSnapshot() leakSnapshot {
+	snap := takeLeakSnapshot()
+	for range 50 {
+		time.Sleep(10 * time.Millisecond)
+		next := takeLeakSnapshot()
+		if next.goroutines >= snap.goroutines && next.fds >= snap.fds {
+			break
+		}
+		snap = next
+	}
+	return snap
+}
+
+// requireNoLeaks fails unless the goroutines and the file descriptors
+// eventually return to the levels of the before [leakSnapshot].
+func requireNoLeaks(t *testing.T, before leakSnapshot) {
+	t.Helper()
+	var after leakSnapshot
+	ok := assertEventually(func() bool {
+		after = takeLeakSnapshot()
+		return after.goroutines <= before.goroutines && after.fds <= before.fds
+	}, 5*time.Second, 10*time.Millisecond)
+	if !ok {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Fatalf("leak detected: before %s, after %s\n%s", before, after, buf)
+	}
+}
+
+// assertEventually is like [require.Eventually] but returns the outcome.
+func assertEventually(condition func() bool, waitFor, tick time.Duration) bool {
+	deadline := time.Now().Add(waitFor)
+	for {
+		if condition() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(tick)
+	}
+}
+
+// socketCounter wraps a [NetDialer] to count the sockets it creates
+// that are still open, which for QUIC counts the live connections.
+type socketCounter struct {
+	dialer NetDialer
+	open   atomic.Int64
+}
+
+// DialContext implements [NetDialer].
+func (sc *socketCounter) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := sc.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	sc.open.Add(1)
+	var once sync.Once
+	return &netstub.FuncConn{
+		ReadFunc:  conn.Read,
+		WriteFunc: conn.Write,
+		CloseFunc: func() error {
+			once.Do(func() { sc.open.Add(-1) })
+			return conn.Close()
+		},
+		LocalAddrFunc:   conn.LocalAddr,
+		RemoteAddrFunc:  conn.RemoteAddr,
+		SetDeadlineFunc: conn.SetDeadline,
+		SetReadDeadFunc: conn.SetReadDeadline,
+		SetWriteDeaFunc: conn.SetWriteDeadline,
+	}, nil
+}
+
+// stressCase is a protocol exercised by the stress tests.
+type stressCase struct {
+	name string
+
+	// newTransport starts a server and returns a [*Transport] using it along
+	// with the [*socketCounter] counting the client sockets.
+	newTransport func(t *testing.T) (*Transport, *socketCounter)
+}
+
+// stressCases contains the protocols exercised by the stress tests.
+var stressCases = []stressCase{
+	{"udp", func(t *testing.T) (*Transport, *socketCounter) {
+		srv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		t.Cleanup(srv.Close)
+		sc := &socketCounter{dialer: &net.Dialer{}}
+		return NewTransport(NewStreamOpenerDialerUDP(sc), netip.MustParseAddrPort(srv.Address())), sc
+	}},
+
+	{"tcp", func(t *testing.T) (*Transport, *socketCounter) {
+		srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		t.Cleanup(srv.Close)
+		sc := &socketCounter{dialer: &net.Dialer{}}
+		return NewTransport(NewStreamOpenerDialerTCP(sc), netip.MustParseAddrPort(srv.Address())), sc
+	}},
+
+	{"tls", func(t *testing.T) (*Transport, *socketCounter) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		t.Cleanup(srv.Close)
+		sc := &socketCounter{dialer: &net.Dialer{}}
+		dialer := NewNetTLSDialer(sc, newTestClientTLSConfig("dot"))
+		return NewTransport(NewStreamOpenerDialerTLS(dialer), netip.MustParseAddrPort(srv.Address())), sc
+	}},
+
+	{"quic", func(t *testing.T) (*Transport, *socketCounter) {
+		srv := newDoQTestServer(t, newBenchHandler().PrepareResponse)
+		sc := &socketCounter{dialer: &net.Dialer{}}
+		qd := &QUICDialer{
+			TLSConfig:    newTestClientTLSConfig("doq"),
+			ConnectedUDP: true,
+			UDPDialer:    sc,
+		}
+		return NewTransport(NewStreamOpenerDialerQUIC(qd), srv.Endpoint()), sc
+	}},
+
+	{"https", func(t *testing.T) (*Transport, *socketCounter) {
+		_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+		sc := &socketCounter{dialer: &net.Dialer{}}
+		dialer := NewStreamOpenerDialerHTTPS(NewNetTLSDialer(sc, newTestClientTLSConfig("h2")))
+		return NewTransport(dialer, endpoint), sc
+	}},
+}
+
+// runStressExchanges performs [stressExchanges] exchanges using dt from
+// [stressParallelism] goroutines, some of which time out or are canceled.
+func runStressExchanges(t *testing.T, dt *Transport) {
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Int64
+		next   atomic.Int64
+	)
+	for range stressParallelism {
+		wg.Go(func() {
+			for idx := next.Add(1); idx <= stressExchanges; idx = next.Add(1) {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if idx%10 == 0 {
+					cancel() // exercise the paths where the context is already done
+				}
+				_, err := dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+				if err != nil && ctx.Err() == nil {
+					failed.Add(1)
+				}
+				cancel()
+			}
+		})
+	}
+	wg.Wait()
+	require.Zero(t, failed.Load())
+}
+
+func TestStressExchangeLeaks(t *testing.T) {
+	for _, tc := range stressCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("without pool", func(t *testing.T) {
+				dt, sc := tc.newTransport(t)
+				before := takeBaselineLeakSnapshot()
+				runStressExchanges(t, dt)
+				requireNoLeaks(t, before)
+				require.Zero(t, sc.open.Load())
+			})
+
+			t.Run("with pool", func(t *testing.T) {
+				dt, sc := tc.newTransport(t)
+				before := takeBaselineLeakSnapshot()
+				dt.Pool = NewPool(stressParallelism / 2)
+				runStressExchanges(t, dt)
+				require.Eventually(t, func() bool { // we close evicted connections in the background
+					return sc.open.Load() <= stressParallelism/2
+				}, 5*time.Second, 10*time.Millisecond)
+				require.NoError(t, dt.Pool.Close())
+				requireNoLeaks(t, before)
+				require.Zero(t, sc.open.Load())
+			})
+		})
+	}
+}
+
+func TestStressTimeoutLeaks(t *testing.T) {
+	// exchanges with servers that never answer, so that they all time out
+	cases := []struct {
+		name      string
+		newDialer func(sc *socketCounter) StreamOpenerDialer
+		listen    func(t *testing.T) netip.AddrPort
+	}{
+		{"udp", func(sc *socketCounter) StreamOpenerDialer {
+			return NewStreamOpenerDialerUDP(sc)
+		}, func(t *testing.T) netip.AddrPort {
+			pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { pconn.Close() })
+			return netip.MustParseAddrPort(pconn.LocalAddr().String())
+		}},
+
+		{"tcp", func(sc *socketCounter) StreamOpenerDialer {
+			return NewStreamOpenerDialerTCP(sc)
+		}, func(t *testing.T) netip.AddrPort {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			t.Cleanup(func() { listener.Close() })
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						io.Copy(io.Discard, conn) // never answer
+					}()
+				}
+			}()
+			return netip.MustParseAddrPort(listener.Addr().String())
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint := tc.listen(t)
+			sc := &socketCounter{dialer: &net.Dialer{}}
+			dt := NewTransport(tc.newDialer(sc), endpoint)
+			dt.Pool = NewPool(stressParallelism)
+			before := takeBaselineLeakSnapshot()
+
+			var wg sync.WaitGroup
+			for range stressParallelism {
+				wg.Go(func() {
+					for range stressExchanges / stressParallelism / 4 {
+						ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+						_, err := dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+						cancel()
+						require.ErrorIs(t, err, context.DeadlineExceeded)
+					}
+				})
+			}
+			wg.Wait()
+
+			require.Zero(t, dt.Pool.Stats().Idle)
+			require.Eventually(t, func() bool {
+				return sc.open.Load() == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			requireNoLeaks(t, before)
+		})
+	}
+}
@@ -11,7 +11,11 @@ import (
 	"github.com/bassosimone/dnscodec"
 )
 
-// NetDialer is typically [*net.Dialer].
+// NetDialer is typically [*net.Dialer] or the dialer of a userspace
+// network stack, such as wireguard-go's netstack.
+//
+// We do not assume that the connections are [*net.TCPConn], so they
+// may be any [net.Conn] implementation.
 type NetDialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
@@ -60,7 +64,7 @@ func (s *tcpStreamConn) Close() error {
 
 // MutateQuery implements [StreamOpener].
 func (s *tcpStreamConn) MutateQuery(msg *dnscodec.Query) {
-	msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+	QueryParamsTCP().MutateQuery(msg)
 }
 
 // OpenStream implements [StreamOpener].
@@ -89,7 +93,23 @@ func (s *tcpStream) SetDeadline(t time.Time) error {
 	return s.conn.SetDeadline(t)
 }
 
+// SetReadDeadline sets the read deadline.
+func (s *tcpStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *tcpStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
 // Write implements [Stream].
 func (s *tcpStream) Write(data []byte) (int, error) {
 	return s.conn.Write(data)
 }
+
+// WriteBuffers writes several buffers at once, which uses
+// writev when the underlying connection supports it.
+func (s *tcpStream) WriteBuffers(v net.Buffers) (int64, error) {
+	return v.WriteTo(s.conn)
+}
@@ -4,6 +4,7 @@ package dnsoverstream
 
 import (
 	"errors"
+	"net"
 	"testing"
 	"time"
 
@@ -47,6 +48,27 @@ func TestNewTCPStreamOpener(t *testing.T) {
 		require.NoError(t, opener.Close())
 	})
 
+	t.Run("WriteBuffers writes all the buffers", func(t *testing.T) {
+		var written []byte
+		conn := &netstub.FuncConn{
+			WriteFunc: func(b []byte) (int, error) {
+				written = append(written, b...)
+				return len(b), nil
+			},
+		}
+
+		opener := NewTCPStreamOpener(conn)
+		stream, err := opener.OpenStream()
+		require.NoError(t, err)
+
+		bw, ok := stream.(streamBuffersWriter)
+		require.True(t, ok)
+		n, err := bw.WriteBuffers(net.Buffers{[]byte("hel"), []byte("lo")})
+		require.NoError(t, err)
+		require.Equal(t, int64(5), n)
+		require.Equal(t, []byte("hello"), written)
+	})
+
 	t.Run("SetDeadline works", func(t *testing.T) {
 		var gotDeadline time.Time
 		conn := &netstub.FuncConn{
@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/pkitest"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI is the PKI shared by tests requiring TLS.
+var testPKI = sync.OnceValue(func() *pkitest.PKI {
+	return pkitest.MustNewPKI("testdata")
+})
+
+// newTestCert creates a certificate valid for example.com and 127.0.0.1.
+func newTestCert() tls.Certificate {
+	return testPKI().MustNewCert(&pkitest.SelfSignedCertConfig{
+		CommonName:   "example.com",
+		DNSNames:     []string{"example.com"},
+		IPAddrs:      []net.IP{net.IPv4(127, 0, 0, 1)},
+		Organization: []string{"Example"},
+	})
+}
+
+// newTestClientTLSConfig returns the client [*tls.Config] trusting [testPKI].
+func newTestClientTLSConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		NextProtos: nextProtos,
+		RootCAs:    testPKI().CertPool(),
+		ServerName: "example.com",
+	}
+}
+
+// doqTestServer is a minimal DNS-over-QUIC server for testing, which
+// accepts 0-RTT early data from clients resuming a session.
+type doqTestServer struct {
+	listener *quic.EarlyListener
+	wg       sync.WaitGroup
+}
+
+// newDoQTestServer starts a [*doqTestServer] on 127.0.0.1 using handler.
+//
+// The server is closed automatically when the test completes.
+func newDoQTestServer(t testing.TB, handler func(query *dns.Msg) *dns.Msg) *doqTestServer {
+	return newDoQTestServerMulti(t, func(query *dns.Msg) []*dns.Msg {
+		return []*dns.Msg{handler(query)}
+	})
+}
+
+// newDoQTestServerMulti is like [newDoQTestServer] but the handler may return
+// several messages, which the server sends on the same stream before closing
+// it, as it happens for zone transfers (RFC 9250 Section 4.3).
+func newDoQTestServerMulti(t testing.TB, handler func(query *dns.Msg) []*dns.Msg) *doqTestServer {
+	return newDoQTestServerAt(t, "127.0.0.1:0", newTestCert(), handler)
+}
+
+// newDoQTestServerAt is like [newDoQTestServerMulti] but listens at
+// the given address using the given certificate.
+func newDoQTestServerAt(t testing.TB, address string,
+	cert tls.Certificate, handler func(query *dns.Msg) []*dns.Msg) *doqTestServer {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}
+	return newDoQTestServerConfig(t, address, tlsConfig, &quic.Config{Allow0RTT: true}, handler)
+}
+
+// newDoQTestServerConfig is like [newDoQTestServerAt] but uses the
+// given TLS and QUIC configurations rather than the defaults.
+func newDoQTestServerConfig(t testing.TB, address string, tlsConfig *tls.Config,
+	quicConfig *quic.Config, handler func(query *dns.Msg) []*dns.Msg) *doqTestServer {
+	pconn, err := net.ListenPacket("udp", address)
+	require.NoError(t, err)
+	listener, err := quic.ListenEarly(pconn, tlsConfig, quicConfig)
+	require.NoError(t, err)
+
+	srv := &doqTestServer{listener: listener}
+	srv.wg.Add(1)
+	go srv.serve(handler)
+
+	t.Cleanup(func() {
+		listener.Close()
+		pconn.Close()
+		srv.wg.Wait()
+	})
+	return srv
+}
+
+// Endpoint returns the server endpoint.
+func (srv *doqTestServer) Endpoint() netip.AddrPort {
+	return srv.listener.Addr().(*net.UDPAddr).AddrPort()
+}
+
+// serve accepts and serves connections until the listener is closed.
+func (srv *doqTestServer) serve(handler func(query *dns.Msg) []*dns.Msg) {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		srv.wg.Add(1)
+		go srv.serveConn(conn, handler)
+	}
+}
+
+// serveConn serves the streams of a single connection.
+func (srv *doqTestServer) serveConn(conn *quic.Conn, handler func(query *dns.Msg) []*dns.Msg) {
+	defer srv.wg.Done()
+	defer conn.CloseWithError(0, "")
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go serveTestStream(stream, handler)
+	}
+}
+
+// serveTestStream reads a single framed query and writes the framed responses.
+func serveTestStream(stream io.ReadWriteCloser, handler func(query *dns.Msg) []*dns.Msg) {
+	defer stream.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return
+	}
+	rawQuery := make([]byte, int(header[0])<<8|int(header[1]))
+	if _, err := io.ReadFull(stream, rawQuery); err != nil {
+		return
+	}
+	query := &dns.Msg{}
+	if err := query.Unpack(rawQuery); err != nil {
+		return
+	}
+	for _, resp := range handler(query) {
+		rawResp, err := resp.Pack()
+		if err != nil {
+			return
+		}
+		frame := append([]byte{byte(len(rawResp) >> 8), byte(len(rawResp))}, rawResp...)
+		if _, err := stream.Write(frame); err != nil {
+			return
+		}
+	}
+}
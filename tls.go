@@ -5,6 +5,8 @@ package dnsoverstream
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"time"
@@ -28,17 +30,157 @@ func NewTLSDialerDNSOverTLS(serverName string) *tls.Dialer {
 	}
 }
 
+// NewTLSConfigDNSOverTLS443 returns the [*tls.Config] to use for DNS-over-TLS
+// with resolvers serving it on port 443 (see [DefaultPortTLS443]).
+//
+// Besides "dot", we also offer the HTTPS protocols using ALPN, so that servers
+// only speaking HTTPS complete the handshake rather than failing with a
+// no_application_protocol alert, which allows [*StreamOpenerDialerTLS] to
+// detect that we accidentally dialed an HTTPS endpoint and fail with
+// [ErrTLSHTTPSEndpoint]. Use [StreamOpenerNegotiatedProtocol] to know
+// which protocol the server actually selected.
+func NewTLSConfigDNSOverTLS443(serverName string) *tls.Config {
+	return &tls.Config{
+		NextProtos: []string{"dot", "h2", "http/1.1"},
+		ServerName: serverName,
+	}
+}
+
+// NewTLSDialerDNSOverTLS443 returns the [*tls.Dialer] to use for DNS-over-TLS
+// on port 443, using [NewTLSConfigDNSOverTLS443].
+func NewTLSDialerDNSOverTLS443(serverName string) *tls.Dialer {
+	return &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config:    NewTLSConfigDNSOverTLS443(serverName),
+	}
+}
+
+// ErrTLSHTTPSEndpoint indicates that, when dialing DNS over TLS, the server
+// negotiated an HTTPS protocol (i.e., "h2" or "http/1.1") using ALPN, which
+// means the endpoint serves HTTPS rather than DNS over TLS.
+var ErrTLSHTTPSEndpoint = errors.New("dnsoverstream: server negotiated HTTPS rather than DNS over TLS")
+
 // TLSDialer is typically [*tls.Dialer] or a compatible TLS dialer such as utls.
 type TLSDialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+// NetTLSDialer is like [*tls.Dialer] but accepts any [NetDialer] rather than
+// requiring a [*net.Dialer], which allows to perform DNS over TLS through
+// userspace network stacks such as gVisor's netstack or wireguard-go.
+//
+// Construct using [NewNetTLSDialer].
+type NetTLSDialer struct {
+	// NetDialer is the MANDATORY [NetDialer] creating the TCP connections.
+	NetDialer NetDialer
+
+	// Config is the OPTIONAL [*tls.Config]. Like [*tls.Dialer], when the
+	// ServerName is empty we use the host of the address we dial.
+	Config *tls.Config
+}
+
+// NewNetTLSDialer creates a new [*NetTLSDialer].
+func NewNetTLSDialer(dialer NetDialer, config *tls.Config) *NetTLSDialer {
+	return &NetTLSDialer{NetDialer: dialer, Config: config}
+}
+
+var _ TLSDialer = &NetTLSDialer{}
+
+// DialContext implements [TLSDialer].
+//
+// The context bounds both the TCP connect and the TLS handshake.
+func (d *NetTLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// 1. establish the TCP connection
+	conn, err := d.NetDialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. use the host as the server name when needed
+	config := d.Config
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = tlsServerNameFromAddress(address)
+	}
+
+	// 3. perform the TLS handshake
+	tconn := tls.Client(conn, config)
+	if err := tconn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// tlsServerNameFromAddress returns the host of the address, without the IPv6 zone.
+func tlsServerNameFromAddress(address string) string {
+	if endpoint, err := netip.ParseAddrPort(address); err == nil {
+		return endpoint.Addr().WithZone("").String()
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// tlsDialerConfig returns the [*tls.Config] of a [*tls.Dialer] or [*NetTLSDialer].
+func tlsDialerConfig(dialer TLSDialer) (*tls.Config, bool) {
+	switch dialer := dialer.(type) {
+	case *tls.Dialer:
+		return dialer.Config, true
+	case *NetTLSDialer:
+		return dialer.Config, true
+	default:
+		return nil, false
+	}
+}
+
+// tlsDialerWithConfig returns a copy of a [*tls.Dialer] or [*NetTLSDialer] using config.
+func tlsDialerWithConfig(dialer TLSDialer, config *tls.Config) TLSDialer {
+	switch dialer := dialer.(type) {
+	case *tls.Dialer:
+		clone := *dialer
+		clone.Config = config
+		return &clone
+	case *NetTLSDialer:
+		clone := *dialer
+		clone.Config = config
+		return &clone
+	default:
+		return dialer
+	}
+}
+
 // StreamOpenerDialerTLS implements [StreamOpenerDialer] for DNS over TLS.
 //
 // Construct using [NewStreamOpenerDialerTLS].
 type StreamOpenerDialerTLS struct {
 	// Dialer is the underlying [TLSDialer].
 	Dialer TLSDialer
+
+	// ObserveTLSEvent is an optional hook called with each [TLSEvent]
+	// occurring on the connections we dial, including long after the
+	// handshake, which is useful when reusing connections.
+	//
+	// This hook requires Dialer to be a [*tls.Dialer] or a [*NetTLSDialer]
+	// and is ignored otherwise.
+	ObserveTLSEvent func(TLSEvent)
+
+	// AllowEarlyData OPTIONALLY sends the first query of each connection as
+	// TLS 1.3 early data when resuming a session, resending the query after the
+	// handshake when the server rejects the early data, which allows to measure
+	// the deployment of early data, reported using [HandshakeKind].
+	//
+	// This option requires Dialer to be a [TLSEarlyDataDialer] and is ignored
+	// otherwise. When enabled, we defer dialing until we write the first query,
+	// so dial errors occur when exchanging and we do not observe TLS events.
+	//
+	// Early data may be replayed by an attacker (RFC 8446 Section 8), so
+	// only enable this for queries without side effects.
+	AllowEarlyData bool
 }
 
 // NewStreamOpenerDialerTLS creates a new [*StreamOpenerDialerTLS].
@@ -57,21 +199,59 @@ var _ StreamOpenerDialer = &StreamOpenerDialerTLS{}
 //
 // The caller is responsible for ensuring the connection is actually a TLS connection.
 func NewTLSStreamOpener(conn net.Conn) StreamOpener {
-	return &tlsStreamConn{conn}
+	return &tlsStreamConn{conn: conn}
 }
 
 // DialContext implements [StreamOpenerDialer].
+//
+// This method fails with [ErrTLSHTTPSEndpoint] when the server negotiates
+// an HTTPS protocol using ALPN (see [NewTLSConfigDNSOverTLS443]).
 func (d *StreamOpenerDialerTLS) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
-	conn, err := d.Dialer.DialContext(ctx, "tcp", address.String())
+	// 1. defer dialing if we are sending the query as early data
+	if dialer, ok := d.Dialer.(TLSEarlyDataDialer); ok && d.AllowEarlyData {
+		return &tlsEarlyStreamConn{dialer: dialer, address: address}, nil
+	}
+
+	// 2. establish the TLS connection, observing it if needed
+	var (
+		conn     net.Conn
+		err      error
+		observer *tlsEventObserver
+	)
+	dialer := tlsDialerForEndpoint(d.Dialer, address.String())
+	if _, ok := tlsDialerConfig(dialer); ok && d.ObserveTLSEvent != nil {
+		observer = newTLSEventObserver(address, d.ObserveTLSEvent)
+		conn, err = observer.dialContext(ctx, dialer, address.String())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address.String())
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &tlsStreamConn{conn}, nil
+
+	// 3. make sure we did not accidentally dial an HTTPS endpoint
+	if proto := tlsNegotiatedProtocol(conn); proto == "h2" || proto == "http/1.1" {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s negotiated %q", ErrTLSHTTPSEndpoint, address, proto)
+	}
+	return &tlsStreamConn{conn: conn, observer: observer}, nil
+}
+
+// tlsNegotiatedProtocol returns the protocol negotiated using ALPN when
+// the connection is a [*tls.Conn] and the empty string otherwise.
+func tlsNegotiatedProtocol(conn net.Conn) string {
+	if tc, ok := conn.(*tls.Conn); ok {
+		return tc.ConnectionState().NegotiatedProtocol
+	}
+	return ""
 }
 
 // tlsStreamConn implements [StreamOpener] for TLS.
 type tlsStreamConn struct {
 	conn net.Conn
+
+	// observer is the OPTIONAL [*tlsEventObserver].
+	observer *tlsEventObserver
 }
 
 // Close implements [StreamOpener].
@@ -81,18 +261,20 @@ func (s *tlsStreamConn) Close() error {
 
 // MutateQuery implements [StreamOpener].
 func (s *tlsStreamConn) MutateQuery(msg *dnscodec.Query) {
-	msg.Flags |= dnscodec.QueryFlagBlockLengthPadding | dnscodec.QueryFlagDNSSec
-	msg.MaxSize = dnscodec.QueryMaxResponseSizeTCP
+	QueryParamsTLS().MutateQuery(msg)
 }
 
 // OpenStream implements [StreamOpener].
 func (s *tlsStreamConn) OpenStream() (Stream, error) {
-	return &tlsStream{s.conn}, nil
+	return &tlsStream{conn: s.conn, observer: s.observer}, nil
 }
 
 // tlsStream implements [Stream] for TLS.
 type tlsStream struct {
 	conn net.Conn
+
+	// observer is the OPTIONAL [*tlsEventObserver].
+	observer *tlsEventObserver
 }
 
 // Close implements [Stream].
@@ -103,7 +285,11 @@ func (s *tlsStream) Close() error {
 
 // Read implements [Stream].
 func (s *tlsStream) Read(buff []byte) (int, error) {
-	return s.conn.Read(buff)
+	count, err := s.conn.Read(buff)
+	if err != nil && s.observer != nil {
+		s.observer.checkReadError(err)
+	}
+	return count, err
 }
 
 // SetDeadline implements [Stream].
@@ -111,7 +297,23 @@ func (s *tlsStream) SetDeadline(t time.Time) error {
 	return s.conn.SetDeadline(t)
 }
 
+// SetReadDeadline sets the read deadline.
+func (s *tlsStream) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *tlsStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
 // Write implements [Stream].
 func (s *tlsStream) Write(data []byte) (int, error) {
 	return s.conn.Write(data)
 }
+
+// WriteBuffers writes several buffers at once, which uses
+// writev when the underlying connection supports it.
+func (s *tlsStream) WriteBuffers(v net.Buffers) (int64, error) {
+	return v.WriteTo(s.conn)
+}
@@ -3,12 +3,19 @@
 package dnsoverstream
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
 	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -47,6 +54,27 @@ func TestNewTLSStreamOpener(t *testing.T) {
 		require.NoError(t, opener.Close())
 	})
 
+	t.Run("WriteBuffers writes all the buffers", func(t *testing.T) {
+		var written []byte
+		conn := &netstub.FuncConn{
+			WriteFunc: func(b []byte) (int, error) {
+				written = append(written, b...)
+				return len(b), nil
+			},
+		}
+
+		opener := NewTLSStreamOpener(conn)
+		stream, err := opener.OpenStream()
+		require.NoError(t, err)
+
+		bw, ok := stream.(streamBuffersWriter)
+		require.True(t, ok)
+		n, err := bw.WriteBuffers(net.Buffers{[]byte("hel"), []byte("lo")})
+		require.NoError(t, err)
+		require.Equal(t, int64(5), n)
+		require.Equal(t, []byte("hello"), written)
+	})
+
 	t.Run("SetDeadline works", func(t *testing.T) {
 		var gotDeadline time.Time
 		conn := &netstub.FuncConn{
@@ -118,3 +146,151 @@ func TestNewTLSDialerDNSOverTLS(t *testing.T) {
 	require.Equal(t, "dns.example.com", dialer.Config.ServerName)
 	require.Contains(t, dialer.Config.NextProtos, "dot")
 }
+
+func TestNewTLSConfigDNSOverTLS443(t *testing.T) {
+	cfg := NewTLSConfigDNSOverTLS443("dns.example.com")
+
+	require.Equal(t, "dns.example.com", cfg.ServerName)
+	require.Equal(t, []string{"dot", "h2", "http/1.1"}, cfg.NextProtos)
+}
+
+func TestNewTLSDialerDNSOverTLS443(t *testing.T) {
+	dialer := NewTLSDialerDNSOverTLS443("dns.example.com")
+
+	require.NotNil(t, dialer.NetDialer)
+	require.NotNil(t, dialer.Config)
+	require.Equal(t, "dns.example.com", dialer.Config.ServerName)
+	require.Equal(t, "dot", dialer.Config.NextProtos[0])
+}
+
+func TestStreamOpenerDialerTLSHTTPSEndpoint(t *testing.T) {
+	_, endpoint := newDoHTestServer(t, newDoHTestHandler(dohTestAnswer, nil))
+
+	t.Run("fails with ErrTLSHTTPSEndpoint when the server negotiates h2", func(t *testing.T) {
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot", "h2", "http/1.1")})
+		conn, err := dialer.DialContext(context.Background(), endpoint)
+		require.ErrorIs(t, err, ErrTLSHTTPSEndpoint)
+		require.ErrorContains(t, err, `negotiated "h2"`)
+		require.Nil(t, conn)
+	})
+
+	t.Run("fails with ErrTLSHTTPSEndpoint when observing TLS events", func(t *testing.T) {
+		var events []TLSEvent
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot", "h2")})
+		dialer.ObserveTLSEvent = func(ev TLSEvent) { events = append(events, ev) }
+		_, err := dialer.DialContext(context.Background(), endpoint)
+		require.ErrorIs(t, err, ErrTLSHTTPSEndpoint)
+		require.NotEmpty(t, events)
+	})
+
+	t.Run("succeeds with DoT servers not using ALPN", func(t *testing.T) {
+		srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), newBenchHandler())
+		defer srv.Close()
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot", "h2", "http/1.1")})
+		dt := NewTransport(dialer, netip.MustParseAddrPort(srv.Address()))
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Empty(t, StreamOpenerNegotiatedProtocol(conn))
+		_, err = dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+	})
+}
+
+// userspaceTestConn hides the concrete [net.Conn] type, like the
+// connections created by userspace network stacks do.
+type userspaceTestConn struct {
+	net.Conn
+	closed *atomic.Int64
+}
+
+// Close implements [net.Conn].
+func (c *userspaceTestConn) Close() error {
+	c.closed.Add(1)
+	return c.Conn.Close()
+}
+
+// newUserspaceTestDialer returns a [NetDialer] returning [*userspaceTestConn]
+// along with the counter of the connections closed.
+func newUserspaceTestDialer() (NetDialer, *atomic.Int64) {
+	closed := &atomic.Int64{}
+	dialer := &netstub.FuncDialer{
+		DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			return &userspaceTestConn{Conn: conn, closed: closed}, nil
+		},
+	}
+	return dialer, closed
+}
+
+func TestNetTLSDialer(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+	t.Cleanup(srv.Close)
+	endpoint := netip.MustParseAddrPort(srv.Address())
+
+	t.Run("exchanges using a custom NetDialer", func(t *testing.T) {
+		netDialer, _ := newUserspaceTestDialer()
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(netDialer, newTestClientTLSConfig("dot")))
+		dt := NewTransport(dialer, endpoint)
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.8.8"}, addrs)
+		require.Equal(t, "example.com", newPoolKey(dialer, endpoint).ServerName)
+	})
+
+	t.Run("uses the address as the server name by default", func(t *testing.T) {
+		netDialer, _ := newUserspaceTestDialer()
+		tlsConfig := newTestClientTLSConfig("dot")
+		tlsConfig.ServerName = ""
+		dt := NewTransport(NewStreamOpenerDialerTLS(NewNetTLSDialer(netDialer, tlsConfig)), endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Empty(t, tlsConfig.ServerName)
+	})
+
+	t.Run("closes the connection when the handshake fails", func(t *testing.T) {
+		netDialer, closed := newUserspaceTestDialer()
+		tlsConfig := newTestClientTLSConfig("dot")
+		tlsConfig.ServerName = "wrong.example.com"
+		_, err := NewNetTLSDialer(netDialer, tlsConfig).DialContext(context.Background(), "tcp", endpoint.String())
+		var verr *tls.CertificateVerificationError
+		require.ErrorAs(t, err, &verr)
+		require.Equal(t, int64(1), closed.Load())
+	})
+
+	t.Run("returns the dial error", func(t *testing.T) {
+		expected := errors.New("network unreachable")
+		netDialer := &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return nil, expected
+			},
+		}
+		_, err := NewNetTLSDialer(netDialer, nil).DialContext(context.Background(), "tcp", endpoint.String())
+		require.ErrorIs(t, err, expected)
+	})
+
+	t.Run("supports ObserveTLSEvent", func(t *testing.T) {
+		netDialer, _ := newUserspaceTestDialer()
+		recorder := &tlsEventRecorder{}
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(netDialer, newTestClientTLSConfig("dot")))
+		dialer.ObserveTLSEvent = recorder.observe
+		conn, err := NewTransport(dialer, endpoint).Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, []TLSEventKind{TLSEventHandshake}, recorder.kinds())
+	})
+}
+
+func TestTLSServerNameFromAddress(t *testing.T) {
+	require.Equal(t, "127.0.0.1", tlsServerNameFromAddress("127.0.0.1:853"))
+	require.Equal(t, "fe80::1", tlsServerNameFromAddress("[fe80::1%eth0]:853"))
+	require.Equal(t, "dns.google", tlsServerNameFromAddress("dns.google:853"))
+	require.Equal(t, "dns.google", tlsServerNameFromAddress("dns.google"))
+}
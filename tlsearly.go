@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// TLSEarlyDataDialer is a [TLSDialer] able to send TLS 1.3 early data (RFC 8446
+// Section 2.3) when resuming a session, which [crypto/tls] does not support
+// on the client side, so this is typically implemented using another TLS
+// library (see [*StreamOpenerDialerTLS] AllowEarlyData).
+type TLSEarlyDataDialer interface {
+	TLSDialer
+
+	// DialEarlyContext dials a TLS connection sending earlyData as 0-RTT early
+	// data when resuming a session, and returns the connection along with the
+	// [HandshakeKind], which MUST be [HandshakeEarlyData] only if the server
+	// accepted the early data, so that we resend it otherwise.
+	DialEarlyContext(ctx context.Context, network, address string,
+		earlyData []byte) (net.Conn, HandshakeKind, error)
+}
+
+// tlsEarlyStreamConn implements [StreamOpener] for TLS with early data.
+//
+// We dial when writing the first query, which we send as early data, falling
+// back to resending the query when the server does not accept the early data.
+type tlsEarlyStreamConn struct {
+	dialer  TLSEarlyDataDialer
+	address netip.AddrPort
+
+	// mu protects the following fields.
+	mu sync.Mutex
+
+	// conn is the connection or nil if we did not dial yet.
+	conn net.Conn
+
+	// kind is the [HandshakeKind] returned when dialing.
+	kind HandshakeKind
+
+	// closed indicates that Close was called.
+	closed bool
+}
+
+// Close implements [StreamOpener].
+func (c *tlsEarlyStreamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// MutateQuery implements [StreamOpener].
+func (c *tlsEarlyStreamConn) MutateQuery(msg *dnscodec.Query) {
+	QueryParamsTLS().MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (c *tlsEarlyStreamConn) OpenStream() (Stream, error) {
+	return &tlsEarlyStream{parent: c}, nil
+}
+
+// HandshakeKind returns the [HandshakeKind] returned when dialing.
+func (c *tlsEarlyStreamConn) HandshakeKind() HandshakeKind {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kind
+}
+
+// NegotiatedProtocol returns the protocol negotiated using ALPN.
+func (c *tlsEarlyStreamConn) NegotiatedProtocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ""
+	}
+	return tlsNegotiatedProtocol(c.conn)
+}
+
+// dial returns the connection, dialing and sending the early data if needed,
+// and returns whether the caller must still write the early data.
+func (c *tlsEarlyStreamConn) dial(deadline time.Time, earlyData []byte) (net.Conn, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 1. reuse the connection if we already dialed
+	if c.conn != nil {
+		return c.conn, true, nil
+	}
+	if c.closed {
+		return nil, false, net.ErrClosed
+	}
+
+	// 2. dial sending the early data
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	conn, kind, err := c.dialer.DialEarlyContext(ctx, "tcp", c.address.String(), earlyData)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// 3. make sure we did not accidentally dial an HTTPS endpoint
+	if proto := tlsNegotiatedProtocol(conn); proto == "h2" || proto == "http/1.1" {
+		conn.Close()
+		return nil, false, fmt.Errorf("%w: %s negotiated %q", ErrTLSHTTPSEndpoint, c.address, proto)
+	}
+	if kind == HandshakeUnknown {
+		if tc, ok := conn.(*tls.Conn); ok {
+			kind = tlsHandshakeKind(tc.ConnectionState())
+		}
+	}
+	c.conn, c.kind = conn, kind
+	return conn, kind != HandshakeEarlyData, nil
+}
+
+// tlsEarlyStream implements [Stream] for TLS with early data.
+type tlsEarlyStream struct {
+	parent        *tlsEarlyStreamConn
+	conn          net.Conn
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// Close implements [Stream].
+func (s *tlsEarlyStream) Close() error {
+	// We do not close the stream midway for TLS.
+	return nil
+}
+
+// Read implements [Stream].
+func (s *tlsEarlyStream) Read(buff []byte) (int, error) {
+	if err := s.connect(s.readDeadline); err != nil {
+		return 0, err
+	}
+	return s.conn.Read(buff)
+}
+
+// Write implements [Stream].
+//
+// The first write to the first stream dials sending the data as early data and
+// resends the data after the handshake when the server does not accept it.
+func (s *tlsEarlyStream) Write(data []byte) (int, error) {
+	if s.conn != nil {
+		return s.conn.Write(data)
+	}
+	conn, resend, err := s.parent.dial(s.writeDeadline, data)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.setConn(conn); err != nil {
+		return 0, err
+	}
+	if resend {
+		return conn.Write(data)
+	}
+	return len(data), nil
+}
+
+// SetDeadline implements [Stream].
+func (s *tlsEarlyStream) SetDeadline(t time.Time) error {
+	s.readDeadline, s.writeDeadline = t, t
+	if s.conn != nil {
+		return s.conn.SetDeadline(t)
+	}
+	return nil
+}
+
+// SetReadDeadline sets the read deadline.
+func (s *tlsEarlyStream) SetReadDeadline(t time.Time) error {
+	s.readDeadline = t
+	if s.conn != nil {
+		return s.conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline.
+func (s *tlsEarlyStream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline = t
+	if s.conn != nil {
+		return s.conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// connect dials without early data if we did not dial yet.
+func (s *tlsEarlyStream) connect(deadline time.Time) error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, _, err := s.parent.dial(deadline, nil)
+	if err != nil {
+		return err
+	}
+	return s.setConn(conn)
+}
+
+// setConn sets the connection and applies the deadlines.
+func (s *tlsEarlyStream) setConn(conn net.Conn) error {
+	s.conn = conn
+	if err := conn.SetReadDeadline(s.readDeadline); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(s.writeDeadline)
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsEarlyDataDialerStub is a [TLSEarlyDataDialer] simulating early data
+// using [*tls.Dialer], since [crypto/tls] cannot send early data.
+type tlsEarlyDataDialerStub struct {
+	*tls.Dialer
+
+	// accept indicates whether the server accepts the early data, in
+	// which case we write the early data after the handshake.
+	accept bool
+
+	// err is the OPTIONAL error to return when dialing.
+	err error
+}
+
+var _ TLSEarlyDataDialer = &tlsEarlyDataDialerStub{}
+
+// DialEarlyContext implements [TLSEarlyDataDialer].
+func (d *tlsEarlyDataDialerStub) DialEarlyContext(ctx context.Context,
+	network, address string, earlyData []byte) (net.Conn, HandshakeKind, error) {
+	if d.err != nil {
+		return nil, HandshakeUnknown, d.err
+	}
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, HandshakeUnknown, err
+	}
+	if !d.accept {
+		return conn, HandshakeEarlyDataRejected, nil
+	}
+	if _, err := conn.Write(earlyData); err != nil {
+		conn.Close()
+		return nil, HandshakeUnknown, err
+	}
+	return conn, HandshakeEarlyData, nil
+}
+
+func TestStreamOpenerDialerTLSAllowEarlyData(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		accept   bool
+		expected HandshakeKind
+	}{
+		{"when the server accepts early data", true, HandshakeEarlyData},
+		{"when the server rejects early data", false, HandshakeEarlyDataRejected},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, received := newOpcodeTestServer(t, true, dohTestAnswer)
+			dialer := NewStreamOpenerDialerTLS(&tlsEarlyDataDialerStub{
+				Dialer: &tls.Dialer{Config: newTestClientTLSConfig()},
+				accept: tc.accept,
+			})
+			dialer.AllowEarlyData = true
+			dt := NewTransport(dialer, endpoint)
+			observe, kinds := collectHandshakeKinds()
+			dt.ObserveTiming = observe
+
+			resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+			addrs, err := resp.RecordsA()
+			require.NoError(t, err)
+			require.Equal(t, []string{"8.8.8.8"}, addrs)
+
+			// the server receives the query exactly once
+			require.Len(t, received(), 1)
+			require.Equal(t, []HandshakeKind{tc.expected}, kinds())
+		})
+	}
+
+	t.Run("returns dial errors when exchanging", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := NewStreamOpenerDialerTLS(&tlsEarlyDataDialerStub{err: expected})
+		dialer.AllowEarlyData = true
+		endpoint, _ := newOpcodeTestServer(t, true, dohTestAnswer)
+		dt := NewTransport(dialer, endpoint)
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	})
+
+	t.Run("is ignored without a TLSEarlyDataDialer", func(t *testing.T) {
+		endpoint, _ := newOpcodeTestServer(t, true, dohTestAnswer)
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig()})
+		dialer.AllowEarlyData = true
+		dt := NewTransport(dialer, endpoint)
+		observe, kinds := collectHandshakeKinds()
+		dt.ObserveTiming = observe
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.Equal(t, []HandshakeKind{HandshakeFull}, kinds())
+	})
+}
@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// TLSEventKind is the kind of a [TLSEvent].
+//
+// Note that [crypto/tls] processes TLS 1.3 KeyUpdate messages internally
+// without exposing them, so we cannot observe key updates.
+type TLSEventKind int
+
+const (
+	// TLSEventHandshake indicates that the initial handshake completed.
+	TLSEventHandshake TLSEventKind = iota
+
+	// TLSEventSessionTicket indicates that the server issued a session ticket,
+	// which, for TLS 1.3, may happen at any time after the handshake.
+	TLSEventSessionTicket
+
+	// TLSEventRenegotiation indicates that the server started a TLS 1.2
+	// renegotiation that the [*tls.Config] Renegotiation setting allowed and
+	// that reached the verification of the server certificate.
+	TLSEventRenegotiation
+
+	// TLSEventRenegotiationRefused indicates that the server requested a
+	// TLS 1.2 renegotiation that the [*tls.Config] Renegotiation setting
+	// refused, which breaks the connection.
+	TLSEventRenegotiationRefused
+)
+
+// String returns the event kind name.
+func (k TLSEventKind) String() string {
+	switch k {
+	case TLSEventHandshake:
+		return "handshake"
+	case TLSEventSessionTicket:
+		return "sessionTicket"
+	case TLSEventRenegotiation:
+		return "renegotiation"
+	case TLSEventRenegotiationRefused:
+		return "renegotiationRefused"
+	default:
+		return "unknown"
+	}
+}
+
+// TLSEvent is a TLS event occurring on a DNS-over-TLS connection, which is
+// useful to study long-lived connections (see [*StreamOpenerDialerTLS]).
+type TLSEvent struct {
+	// Kind is the [TLSEventKind].
+	Kind TLSEventKind
+
+	// ConnID identifies the connection within the process, which allows
+	// to correlate the events of a long-lived connection.
+	ConnID uint64
+
+	// Endpoint is the server endpoint.
+	Endpoint netip.AddrPort
+
+	// Time is the time when the event occurred.
+	Time time.Time
+
+	// State is the connection state for [TLSEventHandshake] and
+	// [TLSEventRenegotiation], and nil otherwise.
+	State *tls.ConnectionState
+}
+
+// tlsEventConnID is the counter used to assign [TLSEvent] ConnID values.
+var tlsEventConnID atomic.Uint64
+
+// tlsEventObserver emits the [TLSEvent] of a single connection.
+type tlsEventObserver struct {
+	// connID is the connection ID.
+	connID uint64
+
+	// endpoint is the server endpoint.
+	endpoint netip.AddrPort
+
+	// handshakes counts the verified handshakes.
+	handshakes atomic.Int64
+
+	// observe is the user-provided hook.
+	observe func(TLSEvent)
+}
+
+// newTLSEventObserver creates a new [*tlsEventObserver].
+func newTLSEventObserver(endpoint netip.AddrPort, observe func(TLSEvent)) *tlsEventObserver {
+	return &tlsEventObserver{
+		connID:   tlsEventConnID.Add(1),
+		endpoint: endpoint,
+		observe:  observe,
+	}
+}
+
+// emit emits a [TLSEvent] of the given kind.
+func (o *tlsEventObserver) emit(kind TLSEventKind, state *tls.ConnectionState) {
+	o.observe(TLSEvent{
+		Kind:     kind,
+		ConnID:   o.connID,
+		Endpoint: o.endpoint,
+		Time:     time.Now(),
+		State:    state,
+	})
+}
+
+// dialContext dials using a clone of the [*tls.Dialer] or [*NetTLSDialer] whose
+// [*tls.Config] reports the events of the connection, which requires a
+// per-connection config, and emits [TLSEventHandshake] on success.
+func (o *tlsEventObserver) dialContext(ctx context.Context, td TLSDialer, address string) (net.Conn, error) {
+	config, _ := tlsDialerConfig(td)
+	conn, err := tlsDialerWithConfig(td, o.wrapConfig(config)).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		o.emit(TLSEventHandshake, &state)
+	}
+	return conn, nil
+}
+
+// wrapConfig returns a clone of config reporting the connection events.
+func (o *tlsEventObserver) wrapConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+
+	// 1. VerifyConnection runs for each handshake, so calls after
+	// the first one mean that the server renegotiated.
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		if o.handshakes.Add(1) > 1 {
+			o.emit(TLSEventRenegotiation, &state)
+		}
+		return nil
+	}
+
+	// 2. the client stores the tickets it receives into the cache, so
+	// we install a per-connection cache when the config has none, which
+	// does not enable resumption across connections.
+	if !config.SessionTicketsDisabled {
+		cache := config.ClientSessionCache
+		if cache == nil {
+			cache = tls.NewLRUClientSessionCache(1)
+		}
+		config.ClientSessionCache = &tlsEventSessionCache{cache, o}
+	}
+	return config
+}
+
+// tlsEventSessionCache wraps a [tls.ClientSessionCache] to emit [TLSEventSessionTicket].
+type tlsEventSessionCache struct {
+	tls.ClientSessionCache
+	observer *tlsEventObserver
+}
+
+// Put implements [tls.ClientSessionCache].
+func (c *tlsEventSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(sessionKey, cs)
+	if cs != nil { // a nil cs means that the client is evicting the entry
+		c.observer.emit(TLSEventSessionTicket, nil)
+	}
+}
+
+// checkReadError emits [TLSEventRenegotiationRefused] when the
+// error means that we refused a renegotiation.
+func (o *tlsEventObserver) checkReadError(err error) {
+	if isTLSRenegotiationRefused(err) {
+		o.emit(TLSEventRenegotiationRefused, nil)
+	}
+}
+
+// isTLSRenegotiationRefused returns whether the error returned by [*tls.Conn]
+// Read means that we sent a no_renegotiation alert to the server.
+func isTLSRenegotiationRefused(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "local error" &&
+		opErr.Err != nil && opErr.Err.Error() == "tls: no renegotiation"
+}
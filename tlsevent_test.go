@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsEventRecorder records the observed [TLSEvent].
+type tlsEventRecorder struct {
+	mu     sync.Mutex
+	events []TLSEvent
+}
+
+// observe is the hook to assign to ObserveTLSEvent.
+func (r *tlsEventRecorder) observe(ev TLSEvent) {
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	r.mu.Unlock()
+}
+
+// kinds returns the kinds of the recorded events.
+func (r *tlsEventRecorder) kinds() []TLSEventKind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var kinds []TLSEventKind
+	for _, ev := range r.events {
+		kinds = append(kinds, ev.Kind)
+	}
+	return kinds
+}
+
+func TestStreamOpenerDialerTLSObserveTLSEvent(t *testing.T) {
+	config := dnstest.NewHandlerConfig()
+	config.AddNetipAddr("dns.google", netip.MustParseAddr("8.8.8.8"))
+	srv := dnstest.MustNewTLSServer(&net.ListenConfig{}, "127.0.0.1:0", newTestCert(), dnstest.NewHandler(config))
+	t.Cleanup(srv.Close)
+	endpoint := netip.MustParseAddrPort(srv.Address())
+
+	t.Run("observes the handshake and the session tickets", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")})
+		dialer.ObserveTLSEvent = recorder.observe
+		dt := NewTransport(dialer, endpoint)
+
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		require.Equal(t, []TLSEventKind{TLSEventHandshake}, recorder.kinds())
+
+		// TLS 1.3 servers send the session tickets after the handshake
+		// and the client processes them when reading the response.
+		for range 2 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		kinds := recorder.kinds()
+		require.Greater(t, len(kinds), 1)
+		require.Equal(t, TLSEventHandshake, kinds[0])
+		for _, kind := range kinds[1:] {
+			require.Equal(t, TLSEventSessionTicket, kind)
+		}
+
+		first := recorder.events[0]
+		require.NotNil(t, first.State)
+		require.True(t, first.State.HandshakeComplete)
+		require.Equal(t, endpoint, first.Endpoint)
+		require.NotZero(t, first.ConnID)
+		for _, ev := range recorder.events {
+			require.Equal(t, first.ConnID, ev.ConnID)
+		}
+	})
+
+	t.Run("uses distinct IDs for distinct connections", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: newTestClientTLSConfig("dot")})
+		dialer.ObserveTLSEvent = recorder.observe
+		for range 2 {
+			conn, err := dialer.DialContext(context.Background(), endpoint)
+			require.NoError(t, err)
+			conn.Close()
+		}
+		require.Len(t, recorder.events, 2)
+		require.NotEqual(t, recorder.events[0].ConnID, recorder.events[1].ConnID)
+	})
+
+	t.Run("does not modify the caller's config", func(t *testing.T) {
+		tlsConfig := newTestClientTLSConfig("dot")
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig})
+		dialer.ObserveTLSEvent = (&tlsEventRecorder{}).observe
+		conn, err := dialer.DialContext(context.Background(), endpoint)
+		require.NoError(t, err)
+		conn.Close()
+		require.Nil(t, tlsConfig.VerifyConnection)
+		require.Nil(t, tlsConfig.ClientSessionCache)
+	})
+
+	t.Run("dial error", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		tlsConfig := newTestClientTLSConfig("dot")
+		tlsConfig.ServerName = "www.example.org" // not in the certificate
+		dialer := NewStreamOpenerDialerTLS(&tls.Dialer{Config: tlsConfig})
+		dialer.ObserveTLSEvent = recorder.observe
+		_, err := dialer.DialContext(context.Background(), endpoint)
+		require.Error(t, err)
+		require.Empty(t, recorder.kinds())
+	})
+
+	t.Run("ignored for other dialers", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		td := &tls.Dialer{Config: newTestClientTLSConfig("dot")}
+		dialer := NewStreamOpenerDialerTLS(&netstub.FuncDialer{DialContextFunc: td.DialContext})
+		dialer.ObserveTLSEvent = recorder.observe
+		conn, err := dialer.DialContext(context.Background(), endpoint)
+		require.NoError(t, err)
+		conn.Close()
+		require.Empty(t, recorder.kinds())
+	})
+}
+
+func TestTLSEventObserverWrapConfig(t *testing.T) {
+	t.Run("reports renegotiations", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		observer := newTLSEventObserver(netip.AddrPort{}, recorder.observe)
+		config := observer.wrapConfig(nil)
+		require.NoError(t, config.VerifyConnection(tls.ConnectionState{}))
+		require.Empty(t, recorder.kinds())
+		require.NoError(t, config.VerifyConnection(tls.ConnectionState{Version: tls.VersionTLS12}))
+		require.Equal(t, []TLSEventKind{TLSEventRenegotiation}, recorder.kinds())
+		require.Equal(t, uint16(tls.VersionTLS12), recorder.events[0].State.Version)
+	})
+
+	t.Run("honours the original VerifyConnection", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		recorder := &tlsEventRecorder{}
+		observer := newTLSEventObserver(netip.AddrPort{}, recorder.observe)
+		config := observer.wrapConfig(&tls.Config{
+			VerifyConnection: func(tls.ConnectionState) error { return expected },
+		})
+		require.ErrorIs(t, config.VerifyConnection(tls.ConnectionState{}), expected)
+		require.ErrorIs(t, config.VerifyConnection(tls.ConnectionState{}), expected)
+		require.Empty(t, recorder.kinds())
+	})
+
+	t.Run("wraps the existing session cache", func(t *testing.T) {
+		recorder := &tlsEventRecorder{}
+		observer := newTLSEventObserver(netip.AddrPort{}, recorder.observe)
+		cache := tls.NewLRUClientSessionCache(4)
+		config := observer.wrapConfig(&tls.Config{ClientSessionCache: cache})
+		config.ClientSessionCache.Put("key", &tls.ClientSessionState{})
+		config.ClientSessionCache.Put("key", nil)
+		require.Equal(t, []TLSEventKind{TLSEventSessionTicket}, recorder.kinds())
+		_, found := cache.Get("key")
+		require.False(t, found)
+	})
+
+	t.Run("honours SessionTicketsDisabled", func(t *testing.T) {
+		observer := newTLSEventObserver(netip.AddrPort{}, (&tlsEventRecorder{}).observe)
+		config := observer.wrapConfig(&tls.Config{SessionTicketsDisabled: true})
+		require.Nil(t, config.ClientSessionCache)
+	})
+}
+
+func TestTLSStreamRenegotiationRefused(t *testing.T) {
+	refused := &net.OpError{Op: "local error", Err: errors.New("tls: no renegotiation")}
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected []TLSEventKind
+	}{
+		{"renegotiation refused", refused, []TLSEventKind{TLSEventRenegotiationRefused}},
+		{"other error", errors.New("connection reset by peer"), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &tlsEventRecorder{}
+			conn := &netstub.FuncConn{
+				ReadFunc: func([]byte) (int, error) { return 0, tc.err },
+			}
+			opener := &tlsStreamConn{conn: conn, observer: newTLSEventObserver(netip.AddrPort{}, recorder.observe)}
+			stream, err := opener.OpenStream()
+			require.NoError(t, err)
+			_, err = stream.Read(make([]byte, 16))
+			require.ErrorIs(t, err, tc.err)
+			require.Equal(t, tc.expected, recorder.kinds())
+		})
+	}
+}
+
+func TestTLSEventKindString(t *testing.T) {
+	require.Equal(t, "handshake", TLSEventHandshake.String())
+	require.Equal(t, "sessionTicket", TLSEventSessionTicket.String())
+	require.Equal(t, "renegotiation", TLSEventRenegotiation.String())
+	require.Equal(t, "renegotiationRefused", TLSEventRenegotiationRefused.String())
+	require.Equal(t, "unknown", TLSEventKind(-1).String())
+}
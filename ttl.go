@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"github.com/miekg/dns"
+)
+
+// TTLChange records a TTL modified by [TTLClamp.Apply] or [NormalizeTTLs].
+type TTLChange struct {
+	// RR is the modified resource record.
+	RR dns.RR
+
+	// Original is the TTL before the modification.
+	Original uint32
+
+	// Modified is the TTL after the modification.
+	Modified uint32
+}
+
+// TTLClamp clamps TTLs to a range, which forwarders and caches
+// commonly do to avoid both excessive churn and stale data.
+//
+// The zero value does not modify TTLs.
+type TTLClamp struct {
+	// MinTTL is the OPTIONAL minimum TTL. Zero means no minimum.
+	MinTTL uint32
+
+	// MaxTTL is the OPTIONAL maximum TTL. Zero means no maximum.
+	MaxTTL uint32
+}
+
+// Clamp returns the given TTL clamped to the configured range.
+//
+// When both bounds are set and MinTTL exceeds MaxTTL, MaxTTL wins.
+func (c TTLClamp) Clamp(ttl uint32) uint32 {
+	if c.MinTTL > 0 && ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl
+}
+
+// Apply clamps the TTLs of the given records in place and returns the
+// changes, so callers can report the original and the clamped values.
+//
+// We skip OPT records, whose TTL field contains EDNS(0) flags.
+func (c TTLClamp) Apply(rrs []dns.RR) []TTLChange {
+	var changes []TTLChange
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if ttl := c.Clamp(hdr.Ttl); ttl != hdr.Ttl {
+			changes = append(changes, TTLChange{RR: rr, Original: hdr.Ttl, Modified: ttl})
+			hdr.Ttl = ttl
+		}
+	}
+	return changes
+}
+
+// NormalizeTTLs sets the TTL of each record to the minimum TTL of
+// its RRset in place and returns the changes.
+//
+// RFC 2181 Section 5.2 requires all the records of an RRset to have the same
+// TTL and says that clients should treat differing TTLs as if they were all
+// set to the minimum one. We skip OPT records, like [TTLClamp.Apply].
+func NormalizeTTLs(rrs []dns.RR) []TTLChange {
+	// 1. find the minimum TTL of each RRset
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+		class  uint16
+	}
+	minimum := make(map[rrsetKey]uint32)
+	keyOf := func(hdr *dns.RR_Header) rrsetKey {
+		return rrsetKey{dns.CanonicalName(hdr.Name), hdr.Rrtype, hdr.Class}
+	}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := keyOf(hdr)
+		if ttl, found := minimum[key]; !found || hdr.Ttl < ttl {
+			minimum[key] = hdr.Ttl
+		}
+	}
+
+	// 2. apply the minimum TTL to each record
+	var changes []TTLChange
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if ttl := minimum[keyOf(hdr)]; ttl != hdr.Ttl {
+			changes = append(changes, TTLChange{RR: rr, Original: hdr.Ttl, Modified: ttl})
+			hdr.Ttl = ttl
+		}
+	}
+	return changes
+}
+
+// MinTTL returns the minimum TTL of the given records, skipping OPT
+// records, and false when there are no records to consider.
+//
+// This is the TTL a cache should use for the whole set of records.
+func MinTTL(rrs []dns.RR) (uint32, bool) {
+	var (
+		found  bool
+		result uint32
+	)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		if !found || hdr.Ttl < result {
+			result, found = hdr.Ttl, true
+		}
+	}
+	return result, found
+}
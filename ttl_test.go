@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newTTLTestRR returns an A record with the given name and TTL.
+func newTTLTestRR(name string, ttl uint32) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: net.IPv4(10, 0, 0, 1),
+	}
+}
+
+// newTTLTestOPT returns an OPT record whose TTL field contains the DO bit.
+func newTTLTestOPT() dns.RR {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetDo()
+	return opt
+}
+
+func TestTTLClamp(t *testing.T) {
+	t.Run("Clamp", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			clamp    TTLClamp
+			ttl      uint32
+			expected uint32
+		}{
+			{"zero value", TTLClamp{}, 7, 7},
+			{"below minimum", TTLClamp{MinTTL: 60}, 7, 60},
+			{"above maximum", TTLClamp{MaxTTL: 3600}, 86400, 3600},
+			{"within range", TTLClamp{MinTTL: 60, MaxTTL: 3600}, 300, 300},
+			{"inverted range", TTLClamp{MinTTL: 600, MaxTTL: 60}, 7, 60},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				require.Equal(t, tt.expected, tt.clamp.Clamp(tt.ttl))
+			})
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		low, ok, high, opt := newTTLTestRR("a.", 5), newTTLTestRR("b.", 300), newTTLTestRR("c.", 86400), newTTLTestOPT()
+		origOPT := opt.Header().Ttl
+		changes := TTLClamp{MinTTL: 60, MaxTTL: 3600}.Apply([]dns.RR{low, ok, high, opt})
+		require.Equal(t, []TTLChange{
+			{RR: low, Original: 5, Modified: 60},
+			{RR: high, Original: 86400, Modified: 3600},
+		}, changes)
+		require.Equal(t, uint32(60), low.Header().Ttl)
+		require.Equal(t, uint32(300), ok.Header().Ttl)
+		require.Equal(t, uint32(3600), high.Header().Ttl)
+		require.Equal(t, origOPT, opt.Header().Ttl)
+	})
+}
+
+func TestNormalizeTTLs(t *testing.T) {
+	first, second, other := newTTLTestRR("example.com.", 300), newTTLTestRR("EXAMPLE.com.", 60), newTTLTestRR("other.com.", 600)
+	changes := NormalizeTTLs([]dns.RR{first, second, other, newTTLTestOPT()})
+	require.Equal(t, []TTLChange{{RR: first, Original: 300, Modified: 60}}, changes)
+	require.Equal(t, uint32(60), first.Header().Ttl)
+	require.Equal(t, uint32(60), second.Header().Ttl)
+	require.Equal(t, uint32(600), other.Header().Ttl)
+}
+
+func TestMinTTL(t *testing.T) {
+	t.Run("without records", func(t *testing.T) {
+		ttl, found := MinTTL([]dns.RR{newTTLTestOPT()})
+		require.False(t, found)
+		require.Zero(t, ttl)
+	})
+
+	t.Run("with records", func(t *testing.T) {
+		ttl, found := MinTTL([]dns.RR{newTTLTestRR("a.", 300), newTTLTestRR("b.", 0), newTTLTestOPT()})
+		require.True(t, found)
+		require.Zero(t, ttl)
+	})
+}
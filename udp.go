@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+)
+
+// StreamOpenerDialerUDP implements [StreamOpenerDialer] for DNS over UDP
+// (RFC 1035), so that it is possible to compare plaintext DNS over UDP with
+// the other protocols using the same [*Transport] and [*dnscodec.Query].
+//
+// Even though UDP is datagram based, each [Stream] accepts and returns
+// length-prefixed frames like DNS over TCP: the [Stream] sends the query
+// as a datagram when the caller starts reading and returns the first datagram
+// whose query ID matches, ignoring others (e.g., late responses to previous
+// queries). We do not retry over TCP when the response is truncated, since
+// the caller may want to observe truncation by inspecting the response.
+//
+// Construct using [NewStreamOpenerDialerUDP].
+type StreamOpenerDialerUDP struct {
+	// Dialer is the underlying [NetDialer].
+	Dialer NetDialer
+}
+
+// NewStreamOpenerDialerUDP creates a new [*StreamOpenerDialerUDP].
+func NewStreamOpenerDialerUDP(dialer NetDialer) *StreamOpenerDialerUDP {
+	return &StreamOpenerDialerUDP{Dialer: dialer}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerUDP{}
+
+// NewUDPStreamOpener creates a [StreamOpener] from an existing connected
+// UDP socket, such as the one returned by [*net.Dialer] for "udp".
+//
+// This allows callers who already hold a UDP socket to use
+// [*Transport.ExchangeWithStreamOpener] without dialing.
+func NewUDPStreamOpener(conn net.Conn) StreamOpener {
+	return &udpStreamConn{conn: conn, params: QueryParamsUDP()}
+}
+
+// DialContext implements [StreamOpenerDialer].
+//
+// We create a connected UDP socket, so that the kernel delivers ICMP errors
+// (see [ErrICMPUnreachable]) and only datagrams from the endpoint.
+func (d *StreamOpenerDialerUDP) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	conn, err := d.Dialer.DialContext(ctx, "udp", address.String())
+	if err != nil {
+		return nil, err
+	}
+	return &udpStreamConn{conn: conn, params: QueryParamsUDP()}, nil
+}
+
+// udpStreamConn implements [StreamOpener] for UDP and DTLS.
+type udpStreamConn struct {
+	conn   net.Conn
+	mu     sync.Mutex
+	params QueryParams
+
+	// envelope is the OPTIONAL [udpEnvelope] (e.g., for DNSCrypt).
+	envelope udpEnvelope
+}
+
+// errUDPDatagramMismatch indicates that a datagram is not the response
+// to the current query, so we should ignore it and keep reading.
+var errUDPDatagramMismatch = errors.New("dnsoverstream: datagram does not match the query")
+
+// udpEnvelope transforms the datagrams exchanged by a [*udpStreamConn].
+type udpEnvelope interface {
+	// seal returns the datagram to send for the raw query along with the
+	// function returning the raw response given a received datagram, which
+	// fails with [errUDPDatagramMismatch] for unrelated datagrams.
+	seal(rawQuery []byte) ([]byte, func(datagram []byte) ([]byte, error), error)
+}
+
+// Close implements [StreamOpener].
+func (s *udpStreamConn) Close() error {
+	return s.conn.Close()
+}
+
+// MutateQuery implements [StreamOpener].
+func (s *udpStreamConn) MutateQuery(msg *dnscodec.Query) {
+	s.params.MutateQuery(msg)
+}
+
+// OpenStream implements [StreamOpener].
+func (s *udpStreamConn) OpenStream() (Stream, error) {
+	return &udpStream{conn: s}, nil
+}
+
+// roundTrip sends the raw query and returns the raw response.
+//
+// Since all the streams share the socket, we send one query at a time.
+func (s *udpStreamConn) roundTrip(rawQuery []byte, deadline time.Time) ([]byte, error) {
+	// 1. wait for previous queries to complete and honour the deadline
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.conn.SetDeadline(deadline)
+	defer s.conn.SetDeadline(time.Time{})
+
+	// 2. prepare the datagram and the function opening the response
+	datagram, open := rawQuery, udpOpenPlain(rawQuery)
+	if s.envelope != nil {
+		var err error
+		if datagram, open, err = s.envelope.seal(rawQuery); err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. send the query
+	if _, err := s.conn.Write(datagram); err != nil {
+		return nil, wrapICMPError(err)
+	}
+
+	// 4. receive until we see the response to the query
+	buff := make([]byte, 1<<16)
+	for {
+		count, err := s.conn.Read(buff)
+		if err != nil {
+			return nil, wrapICMPError(err)
+		}
+		rawResp, err := open(buff[:count])
+		if errors.Is(err, errUDPDatagramMismatch) {
+			continue
+		}
+		return rawResp, err
+	}
+}
+
+// udpOpenPlain returns the function accepting the datagrams with the same ID of rawQuery.
+func udpOpenPlain(rawQuery []byte) func(datagram []byte) ([]byte, error) {
+	return func(datagram []byte) ([]byte, error) {
+		if len(datagram) < 2 || !bytes.Equal(datagram[:2], rawQuery[:2]) {
+			return nil, errUDPDatagramMismatch
+		}
+		return datagram, nil
+	}
+}
+
+// udpStream implements [Stream] for UDP and DTLS.
+//
+// Like [*httpsStream], it buffers the query frame written by the caller,
+// sends the query when the caller starts reading, and returns the response
+// as a frame, so that the framing is the same as for the other protocols.
+type udpStream struct {
+	conn     *udpStreamConn
+	deadline time.Time
+	query    bytes.Buffer
+	resp     io.Reader
+}
+
+// Close implements [Stream].
+func (s *udpStream) Close() error {
+	// We complete the exchange when reading, so there is nothing to do.
+	return nil
+}
+
+// Read implements [Stream].
+func (s *udpStream) Read(buff []byte) (int, error) {
+	if s.resp == nil {
+		// 1. remove the length prefix from the query frame
+		frame := s.query.Bytes()
+		if len(frame) < 4 || int(binary.BigEndian.Uint16(frame)) != len(frame)-2 {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		// 2. exchange and wrap the response into a frame
+		rawResp, err := s.conn.roundTrip(frame[2:], s.deadline)
+		if err != nil {
+			return 0, err
+		}
+		respFrame := binary.BigEndian.AppendUint16(nil, uint16(len(rawResp)))
+		s.resp = bytes.NewReader(append(respFrame, rawResp...))
+	}
+	return s.resp.Read(buff)
+}
+
+// SetDeadline implements [Stream].
+func (s *udpStream) SetDeadline(t time.Time) error {
+	s.deadline = t
+	return nil
+}
+
+// Write implements [Stream].
+func (s *udpStream) Write(data []byte) (int, error) {
+	return s.query.Write(data)
+}
@@ -0,0 +1,177 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/bassosimone/netstub"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamOpenerDialerUDP(t *testing.T) {
+	t.Run("exchanges with a loopback server", func(t *testing.T) {
+		srv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer srv.Close()
+		dt := NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"8.8.4.4", "8.8.8.8"}, addrs)
+	})
+
+	t.Run("reuses the socket for multiple exchanges", func(t *testing.T) {
+		srv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", newBenchHandler())
+		defer srv.Close()
+		dt := NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+
+		conn, err := dt.Dial(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		for range 3 {
+			_, err := dt.ExchangeWithStreamOpener(context.Background(), conn, dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+	})
+
+	t.Run("fails when the server does not answer", func(t *testing.T) {
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer pconn.Close()
+		dt := NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), netip.MustParseAddrPort(pconn.LocalAddr().String()))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err = dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Equal(t, ICMPUnreachableNone, ClassifyICMPUnreachable(err))
+	})
+
+	t.Run("surfaces ICMP port unreachable", func(t *testing.T) {
+		pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+		endpoint := netip.MustParseAddrPort(pconn.LocalAddr().String())
+		require.NoError(t, pconn.Close())
+		dt := NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), endpoint)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = dt.Exchange(ctx, dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrICMPUnreachable)
+		require.Equal(t, ICMPUnreachablePort, ClassifyICMPUnreachable(err))
+	})
+
+	t.Run("propagates dial errors", func(t *testing.T) {
+		expected := errors.New("mocked error")
+		dialer := &netstub.FuncDialer{
+			DialContextFunc: func(ctx context.Context, network, address string) (net.Conn, error) {
+				require.Equal(t, "udp", network)
+				return nil, expected
+			},
+		}
+		dt := NewTransport(NewStreamOpenerDialerUDP(dialer), netip.MustParseAddrPort("127.0.0.1:53"))
+		_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, expected)
+	})
+}
+
+func TestNewUDPStreamOpener(t *testing.T) {
+	t.Run("ignores responses with a different ID", func(t *testing.T) {
+		var rawQuery []byte
+		var reads int
+		conn := &netstub.FuncConn{
+			WriteFunc: func(b []byte) (int, error) {
+				rawQuery = append([]byte{}, b...)
+				return len(b), nil
+			},
+			ReadFunc: func(b []byte) (int, error) {
+				reads++
+				if reads == 1 {
+					return copy(b, []byte{rawQuery[0] ^ 0xff, rawQuery[1], 0}), nil
+				}
+				return copy(b, rawQuery), nil
+			},
+			SetDeadlineFunc: func(time.Time) error { return nil },
+		}
+
+		stream, err := NewUDPStreamOpener(conn).OpenStream()
+		require.NoError(t, err)
+		_, err = stream.Write([]byte{0, 3, 0xab, 0xcd, 0xef})
+		require.NoError(t, err)
+		require.NoError(t, stream.Close())
+
+		data, err := io.ReadAll(stream)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 3, 0xab, 0xcd, 0xef}, data)
+		require.Equal(t, 2, reads)
+	})
+
+	t.Run("sets the socket deadline", func(t *testing.T) {
+		deadline := time.Now().Add(time.Minute)
+		var deadlines []time.Time
+		expected := errors.New("mocked error")
+		conn := &netstub.FuncConn{
+			WriteFunc: func(b []byte) (int, error) {
+				return 0, expected
+			},
+			SetDeadlineFunc: func(t time.Time) error {
+				deadlines = append(deadlines, t)
+				return nil
+			},
+		}
+
+		stream, err := NewUDPStreamOpener(conn).OpenStream()
+		require.NoError(t, err)
+		require.NoError(t, stream.SetDeadline(deadline))
+		_, err = stream.Write([]byte{0, 2, 0xab, 0xcd})
+		require.NoError(t, err)
+
+		_, err = stream.Read(make([]byte, 8))
+		require.ErrorIs(t, err, expected)
+		require.Equal(t, []time.Time{deadline, {}}, deadlines)
+	})
+
+	t.Run("rejects malformed query frames", func(t *testing.T) {
+		stream, err := NewUDPStreamOpener(nil).OpenStream()
+		require.NoError(t, err)
+		_, err = stream.Write([]byte{0, 7, 0xab, 0xcd})
+		require.NoError(t, err)
+
+		_, err = stream.Read(make([]byte, 8))
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+
+	t.Run("Close closes the socket", func(t *testing.T) {
+		var closed bool
+		conn := &netstub.FuncConn{
+			CloseFunc: func() error {
+				closed = true
+				return nil
+			},
+		}
+		require.NoError(t, NewUDPStreamOpener(conn).Close())
+		require.True(t, closed)
+	})
+}
+
+func TestUdpStreamConnMutateQuery(t *testing.T) {
+	opener := NewUDPStreamOpener(nil)
+	query := dnscodec.NewQuery("example.com", 1)
+
+	opener.MutateQuery(query)
+
+	require.Equal(t, uint16(dnscodec.QueryMaxResponseSizeUDP), query.MaxSize)
+	require.Zero(t, query.Flags&dnscodec.QueryFlagBlockLengthPadding)
+	require.Zero(t, query.Flags&dnscodec.QueryFlagDNSSec)
+}
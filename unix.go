@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net/netip"
+)
+
+// ProtocolUnix is the protocol name used by [PoolKey] for DNS over
+// Unix domain sockets.
+const ProtocolUnix = "unix"
+
+// StreamOpenerDialerUnix implements [StreamOpenerDialer] for DNS over a Unix
+// domain stream socket using the same 2-byte length framing of DNS over TCP,
+// which allows to test local resolvers and sandboxed helpers using the same
+// [*Transport] code paths used for remote servers.
+//
+// Since a Unix domain socket has no IP endpoint, DialContext ignores the
+// endpoint and dials Path, so use the zero [netip.AddrPort] as the endpoint.
+//
+// Construct using [NewStreamOpenerDialerUnix].
+type StreamOpenerDialerUnix struct {
+	// Dialer is the underlying [NetDialer].
+	Dialer NetDialer
+
+	// Path is the MANDATORY path of the Unix domain socket.
+	Path string
+}
+
+// NewStreamOpenerDialerUnix creates a new [*StreamOpenerDialerUnix].
+func NewStreamOpenerDialerUnix(dialer NetDialer, path string) *StreamOpenerDialerUnix {
+	return &StreamOpenerDialerUnix{Dialer: dialer, Path: path}
+}
+
+var _ StreamOpenerDialer = &StreamOpenerDialerUnix{}
+
+// DialContext implements [StreamOpenerDialer].
+func (d *StreamOpenerDialerUnix) DialContext(ctx context.Context, address netip.AddrPort) (StreamOpener, error) {
+	conn, err := d.Dialer.DialContext(ctx, "unix", d.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpStreamConn{conn: conn}, nil
+}
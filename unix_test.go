@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// unixTestListenConfig allows [dnstest.MustNewTCPServer] to listen
+// on a Unix domain socket, since the framing is the same.
+type unixTestListenConfig struct {
+	path string
+}
+
+// Listen implements [dnstest.TCPListenConfig].
+func (lc *unixTestListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	return (&net.ListenConfig{}).Listen(ctx, "unix", lc.path)
+}
+
+// newUnixTestServer starts a DNS server on a Unix domain socket and returns its path.
+func newUnixTestServer(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "dns.sock")
+	srv := dnstest.MustNewTCPServer(&unixTestListenConfig{path: path}, "", newBenchHandler())
+	t.Cleanup(srv.Close)
+	return path
+}
+
+func TestStreamOpenerDialerUnix(t *testing.T) {
+	t.Run("exchanges using the 2-byte framing", func(t *testing.T) {
+		path := newUnixTestServer(t)
+		dt := NewTransport(NewStreamOpenerDialerUnix(&net.Dialer{}, path), netip.AddrPort{})
+		resp, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		addrs, err := resp.RecordsA()
+		require.NoError(t, err)
+		require.Equal(t, []string{"8.8.4.4", "8.8.8.8"}, addrs)
+	})
+
+	t.Run("reuses connections using the pool", func(t *testing.T) {
+		path := newUnixTestServer(t)
+		dt := NewTransport(NewStreamOpenerDialerUnix(&net.Dialer{}, path), netip.AddrPort{})
+		dt.Pool = NewPool(1)
+		defer dt.Pool.Close()
+		for range 2 {
+			_, err := dt.Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+			require.NoError(t, err)
+		}
+		require.Equal(t, uint64(1), dt.Pool.Stats().Hits)
+	})
+
+	t.Run("fails when the socket does not exist", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "missing.sock")
+		dialer := NewStreamOpenerDialerUnix(&net.Dialer{}, path)
+		opener, err := dialer.DialContext(context.Background(), netip.AddrPort{})
+		require.Error(t, err)
+		require.Nil(t, opener)
+	})
+}
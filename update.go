@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// OpcodeCodec is the [Codec] for [*dns.Msg] messages using any opcode,
+// such as dynamic updates (RFC 2136), which [dnscodec.NewQuery] cannot
+// express because they contain zone, prerequisite, and update sections.
+//
+// Unlike [MsgCodec], we send a copy of the message applying neither the
+// question class nor the RD bit, which are specific to queries, but we still
+// zero the ID for DoQ, honour NoCompression, and add an EDNS(0) OPT record,
+// padded when required by the protocol, unless the message contains an OPT
+// or a TSIG record.
+//
+// The response must have the same ID and opcode and may omit the zone section
+// (RFC 2136 Section 3.8). We do not map the RCODE to errors, so the caller
+// should check it (e.g., [dns.RcodeRefused] or [dns.RcodeNotAuth]).
+type OpcodeCodec struct{}
+
+var _ Codec[*dns.Msg, *dns.Msg] = OpcodeCodec{}
+
+// PackQuery implements [Codec].
+func (OpcodeCodec) PackQuery(buf []byte, query *dns.Msg, params QueryParams) ([]byte, error) {
+	msg := query.Copy()
+	if params.ZeroID {
+		msg.Id = 0
+	}
+	if params.NoCompression {
+		msg.Compress = false
+	}
+	if !params.Verbatim && msg.IsEdns0() == nil && msg.IsTsig() == nil {
+		msg.SetEdns0(params.MaxSize, false)
+		if params.Flags&dnscodec.QueryFlagBlockLengthPadding != 0 {
+			msgPadToBlockLength(msg)
+		}
+	}
+	return msg.PackBuffer(buf)
+}
+
+// ParseResponse implements [Codec].
+func (OpcodeCodec) ParseResponse(query *dns.Msg, rawQuery, rawResp []byte) (*dns.Msg, error) {
+	// 1. parse the query we sent and the response
+	queryMsg := new(dns.Msg)
+	if err := queryMsg.Unpack(rawQuery); err != nil {
+		return nil, err
+	}
+	respMsg := new(dns.Msg)
+	if err := respMsg.Unpack(rawResp); err != nil {
+		return nil, dnscodec.ErrServerMisbehaving
+	}
+
+	// 2. make sure the response matches the query
+	if !respMsg.Response || respMsg.Id != queryMsg.Id || respMsg.Opcode != queryMsg.Opcode {
+		return nil, dnscodec.ErrInvalidResponse
+	}
+	if len(respMsg.Question) <= 0 {
+		return respMsg, nil
+	}
+	if _, err := dnscodec.ValidateResponseForQuery(queryMsg, respMsg); err != nil {
+		return nil, err
+	}
+	return respMsg, nil
+}
+
+// Question implements [Codec].
+func (OpcodeCodec) Question(query *dns.Msg) (string, uint16) {
+	return MsgCodec{}.Question(query)
+}
+
+// ExchangeUpdate is like [*Transport.Exchange] but sends a dynamic update
+// (RFC 2136) using [OpcodeCodec] and returns the server response.
+//
+// Build the update using [*dns.Msg.SetUpdate] along with the methods adding
+// the prerequisites (e.g., [*dns.Msg.NameUsed]) and the updates (e.g.,
+// [*dns.Msg.Insert]). Dynamic updates are TCP-first, hence this method is
+// most useful with TCP and TLS, which also carry updates of any size.
+func (dt *Transport) ExchangeUpdate(ctx context.Context, update *dns.Msg) (*dns.Msg, error) {
+	return ExchangeCodec(ctx, dt, OpcodeCodec{}, update)
+}
+
+// ExchangeUpdateWithStreamOpener is like [*Transport.ExchangeWithStreamOpener]
+// but uses [OpcodeCodec]. See [*Transport.ExchangeUpdate] for more information.
+func (dt *Transport) ExchangeUpdateWithStreamOpener(ctx context.Context,
+	conn StreamOpener, update *dns.Msg) (*dns.Msg, error) {
+	return ExchangeCodecWithStreamOpener(ctx, dt, OpcodeCodec{}, conn, update)
+}
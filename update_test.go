@@ -0,0 +1,137 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newOpcodeTestServer starts a TCP or TLS server replying to each message using
+// reply, since [*dns.Server] refuses updates, and returns the server endpoint
+// along with the function returning the messages received so far.
+func newOpcodeTestServer(t *testing.T, useTLS bool, reply func(req *dns.Msg) *dns.Msg) (netip.AddrPort, func() []*dns.Msg) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if useTLS {
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{newTestCert()}})
+	}
+	var (
+		mu       sync.Mutex
+		received []*dns.Msg
+		wg       sync.WaitGroup
+	)
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				serveTestStream(conn, func(req *dns.Msg) []*dns.Msg {
+					mu.Lock()
+					received = append(received, req)
+					mu.Unlock()
+					return []*dns.Msg{reply(req)}
+				})
+			})
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	return listener.Addr().(*net.TCPAddr).AddrPort(), func() []*dns.Msg {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*dns.Msg{}, received...)
+	}
+}
+
+// newUpdateTestMsg returns an update of example.com adding an A record.
+func newUpdateTestMsg(t *testing.T) *dns.Msg {
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	rr, err := dns.NewRR("www.example.com. 3600 IN A 192.0.2.1")
+	require.NoError(t, err)
+	update.Insert([]dns.RR{rr})
+	return update
+}
+
+func TestTransportExchangeUpdate(t *testing.T) {
+	t.Run("sends the update using TCP", func(t *testing.T) {
+		endpoint, received := newOpcodeTestServer(t, false, func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeRefused)
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+
+		update := newUpdateTestMsg(t)
+		resp, err := dt.ExchangeUpdate(context.Background(), update)
+		require.NoError(t, err)
+		require.Equal(t, dns.OpcodeUpdate, resp.Opcode)
+		require.Equal(t, dns.RcodeRefused, resp.Rcode)
+
+		msgs := received()
+		require.Len(t, msgs, 1)
+		require.Equal(t, dns.OpcodeUpdate, msgs[0].Opcode)
+		require.Equal(t, update.Id, msgs[0].Id)
+		require.Len(t, msgs[0].Ns, 1)
+		require.Equal(t, "192.0.2.1", msgs[0].Ns[0].(*dns.A).A.String())
+		require.NotNil(t, msgs[0].IsEdns0())
+		require.Len(t, update.Extra, 0) // we do not modify the caller's message
+	})
+
+	t.Run("pads the update using TLS", func(t *testing.T) {
+		endpoint, received := newOpcodeTestServer(t, true, func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			return resp
+		})
+		dialer := NewStreamOpenerDialerTLS(NewNetTLSDialer(&net.Dialer{}, newTestClientTLSConfig()))
+		dt := NewTransport(dialer, endpoint)
+		var rawQuery []byte
+		dt.ObserveRawQuery = func(data []byte) { rawQuery = data }
+
+		resp, err := dt.ExchangeUpdate(context.Background(), newUpdateTestMsg(t))
+		require.NoError(t, err)
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.Len(t, received(), 1)
+		require.Zero(t, len(rawQuery)%128)
+	})
+
+	t.Run("accepts responses without the zone section", func(t *testing.T) {
+		handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Question = nil
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		resp, err := dt.ExchangeUpdate(context.Background(), newUpdateTestMsg(t))
+		require.NoError(t, err)
+		require.Empty(t, resp.Question)
+	})
+
+	t.Run("rejects responses using another opcode", func(t *testing.T) {
+		handler := HandlerFunc(func(req *dns.Msg) *dns.Msg {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Opcode = dns.OpcodeQuery
+			return resp
+		})
+		dt := NewTransport(NewStreamOpenerDialerHandler(handler), netip.MustParseAddrPort("127.0.0.1:53"))
+		resp, err := dt.ExchangeUpdate(context.Background(), newUpdateTestMsg(t))
+		require.ErrorIs(t, err, dnscodec.ErrInvalidResponse)
+		require.Nil(t, resp)
+	})
+}
@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ErrVerifyInconsistent indicates that the transports used by [*Verifier]
+// returned different answers, which may mean that a path tampers with
+// the responses or that the servers are out of sync.
+var ErrVerifyInconsistent = errors.New("dnsoverstream: inconsistent answers")
+
+// ErrVerifyIncomplete indicates that [*Verifier] could not compare the
+// answers because some transports failed to obtain a response.
+var ErrVerifyIncomplete = errors.New("dnsoverstream: cannot compare answers")
+
+// ErrVerifyTooFewTransports indicates that [*Verifier] has fewer
+// than two transports and therefore cannot cross-check answers.
+var ErrVerifyTooFewTransports = errors.New("dnsoverstream: need at least two transports to verify")
+
+// VerifyAnswer is the answer obtained by [*Verifier] using a transport.
+type VerifyAnswer struct {
+	// Attempt describes the exchange.
+	Attempt
+
+	// Response is the response or nil on failure.
+	Response *dnscodec.Response
+
+	// Answer is the canonical form of the answer we compare, which contains
+	// the sorted valid RRs with zero TTL, "NXDOMAIN" or "NODATA" for negative
+	// answers, and is empty when the exchange failed otherwise.
+	Answer []string
+}
+
+// VerifyResult is the result of [*Verifier.Exchange].
+type VerifyResult struct {
+	// Answers contains a [VerifyAnswer] for each transport, in order.
+	Answers []VerifyAnswer
+
+	// Consistent is true when all transports obtained the same answer.
+	Consistent bool
+}
+
+// Verifier sends each query using two or more transports in parallel (e.g.,
+// DNS over TLS and DNS over QUIC to the same provider) and compares the
+// answers, which is useful to assess reliability and to detect tampering.
+//
+// We consider the answers consistent when they contain the same RRs,
+// ignoring the TTLs and the order, or when they are the same negative answer.
+//
+// We run the exchanges using the Executor of the first [*Transport].
+//
+// Construct using [NewVerifier].
+type Verifier struct {
+	// Transports contains the MANDATORY transports, which must be at least two.
+	Transports []*Transport
+}
+
+// NewVerifier creates a new [*Verifier] using the given transports.
+func NewVerifier(transports ...*Transport) *Verifier {
+	return &Verifier{Transports: transports}
+}
+
+// Exchange sends the query using all the transports and returns the response of
+// the first transport along with the [*VerifyResult], which is non-nil whenever
+// we performed the exchanges.
+//
+// We return an error wrapping [ErrVerifyIncomplete] and the transport errors
+// when some transports fail to obtain an answer, and an error wrapping
+// [ErrVerifyInconsistent] when the answers differ. When all transports obtain
+// the same negative answer, we return the error of the first transport (e.g.,
+// wrapping [dnscodec.ErrNoName]), consistently with [*Transport.Exchange].
+func (v *Verifier) Exchange(ctx context.Context, query *dnscodec.Query) (*dnscodec.Response, *VerifyResult, error) {
+	// 1. make sure we can compare answers
+	if len(v.Transports) < 2 {
+		return nil, nil, ErrVerifyTooFewTransports
+	}
+
+	// 2. perform the exchanges in parallel
+	result := &VerifyResult{Answers: make([]VerifyAnswer, len(v.Transports))}
+	var wg sync.WaitGroup
+	for idx, dt := range v.Transports {
+		v.Transports[0].executeGroup(&wg, func() {
+			resp, attempt := retryAttempt(ctx, dt, query)
+			result.Answers[idx] = VerifyAnswer{
+				Attempt:  attempt,
+				Response: resp,
+				Answer:   verifyCanonicalAnswer(resp, attempt.Err),
+			}
+		})
+	}
+	wg.Wait()
+
+	// 3. make sure all transports obtained an answer
+	var errs []error
+	for _, answer := range result.Answers {
+		if answer.Answer == nil {
+			errs = append(errs, answer.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, result, fmt.Errorf("%w: %w", ErrVerifyIncomplete, errors.Join(errs...))
+	}
+
+	// 4. compare the answers
+	first := result.Answers[0]
+	for _, answer := range result.Answers[1:] {
+		if !slices.Equal(first.Answer, answer.Answer) {
+			return nil, result, fmt.Errorf("%w: %s %s and %s %s", ErrVerifyInconsistent,
+				first.Protocol, first.Endpoint, answer.Protocol, answer.Endpoint)
+		}
+	}
+	result.Consistent = true
+	return first.Response, result, first.Err
+}
+
+// verifyCanonicalAnswer returns the canonical form of the answer we compare
+// or nil if the exchange failed without a definitive answer.
+func verifyCanonicalAnswer(resp *dnscodec.Response, err error) []string {
+	switch {
+	case errors.Is(err, dnscodec.ErrNoName):
+		return []string{"NXDOMAIN"}
+	case errors.Is(err, dnscodec.ErrNoData):
+		return []string{"NODATA"}
+	case err != nil:
+		return nil
+	}
+	answer := make([]string, 0, len(resp.ValidRRs))
+	for _, rr := range resp.ValidRRs {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		answer = append(answer, rr.String())
+	}
+	slices.Sort(answer)
+	return answer
+}
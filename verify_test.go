@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/bassosimone/dnstest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newVerifyTestTransportUDP returns a DNS over UDP [*Transport] for a server using handler.
+func newVerifyTestTransportUDP(t *testing.T, handler dns.Handler) *Transport {
+	srv := dnstest.MustNewUDPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	t.Cleanup(srv.Close)
+	return NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+}
+
+// newVerifyTestTransportTCP returns a DNS over TCP [*Transport] for a server using handler.
+func newVerifyTestTransportTCP(t *testing.T, handler dns.Handler) *Transport {
+	srv := dnstest.MustNewTCPServer(&net.ListenConfig{}, "127.0.0.1:0", handler)
+	t.Cleanup(srv.Close)
+	return NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.MustParseAddrPort(srv.Address()))
+}
+
+func TestVerifierExchange(t *testing.T) {
+	t.Run("reports consistent answers", func(t *testing.T) {
+		dt1, dt2 := newVerifyTestTransportUDP(t, newBenchHandler()), newVerifyTestTransportTCP(t, newBenchHandler())
+		resp, result, err := NewVerifier(dt1, dt2).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.True(t, result.Consistent)
+		require.Len(t, result.Answers, 2)
+		require.Equal(t, ProtocolUDP, result.Answers[0].Protocol)
+		require.Equal(t, ProtocolTCP, result.Answers[1].Protocol)
+		require.Equal(t, result.Answers[0].Answer, result.Answers[1].Answer)
+		require.Len(t, result.Answers[0].Answer, 2)
+		require.Same(t, resp, result.Answers[0].Response)
+	})
+
+	t.Run("reports inconsistent answers", func(t *testing.T) {
+		config := dnstest.NewHandlerConfig()
+		config.AddNetipAddr("dns.google", netip.MustParseAddr("10.0.0.1"))
+		dt1, dt2 := newVerifyTestTransportUDP(t, newBenchHandler()), newVerifyTestTransportTCP(t, dnstest.NewHandler(config))
+		resp, result, err := NewVerifier(dt1, dt2).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrVerifyInconsistent)
+		require.Nil(t, resp)
+		require.False(t, result.Consistent)
+		require.NotEqual(t, result.Answers[0].Answer, result.Answers[1].Answer)
+	})
+
+	t.Run("treats equal negative answers as consistent", func(t *testing.T) {
+		dt1, dt2 := newVerifyTestTransportUDP(t, newBenchHandler()), newVerifyTestTransportTCP(t, newBenchHandler())
+		resp, result, err := NewVerifier(dt1, dt2).Exchange(context.Background(), dnscodec.NewQuery("nonexistent.example", dns.TypeA))
+		require.ErrorIs(t, err, dnscodec.ErrNoName)
+		require.Nil(t, resp)
+		require.True(t, result.Consistent)
+		require.Equal(t, []string{"NXDOMAIN"}, result.Answers[1].Answer)
+	})
+
+	t.Run("fails when a transport cannot obtain an answer", func(t *testing.T) {
+		dt1 := newVerifyTestTransportUDP(t, newBenchHandler())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		endpoint := netip.MustParseAddrPort(listener.Addr().String())
+		listener.Close()
+		dt2 := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+		resp, result, err := NewVerifier(dt1, dt2).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrVerifyIncomplete)
+		require.Nil(t, resp)
+		require.False(t, result.Consistent)
+		require.NotEmpty(t, result.Answers[0].Answer)
+		require.Error(t, result.Answers[1].Err)
+		require.Nil(t, result.Answers[1].Answer)
+	})
+
+	t.Run("requires at least two transports", func(t *testing.T) {
+		dt1 := NewTransport(NewStreamOpenerDialerUDP(&net.Dialer{}), netip.AddrPort{})
+		resp, result, err := NewVerifier(dt1).Exchange(context.Background(), dnscodec.NewQuery("dns.google", dns.TypeA))
+		require.ErrorIs(t, err, ErrVerifyTooFewTransports)
+		require.Nil(t, resp)
+		require.Nil(t, result)
+	})
+}
+
+func TestVerifyCanonicalAnswerIgnoresTTLAndOrder(t *testing.T) {
+	rr1, err := dns.NewRR("dns.google. 300 IN A 8.8.8.8")
+	require.NoError(t, err)
+	rr2, err := dns.NewRR("dns.google. 60 IN A 8.8.4.4")
+	require.NoError(t, err)
+	a := verifyCanonicalAnswer(&dnscodec.Response{ValidRRs: []dns.RR{rr1, rr2}}, nil)
+	rr1.Header().Ttl, rr2.Header().Ttl = 5, 7
+	b := verifyCanonicalAnswer(&dnscodec.Response{ValidRRs: []dns.RR{rr2, rr1}}, nil)
+	require.Equal(t, a, b)
+	require.Equal(t, uint32(5), rr1.Header().Ttl)
+}
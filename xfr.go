@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+)
+
+// ErrZoneTransfer indicates that the messages of a zone transfer are not
+// bracketed by SOA records as required by RFC 5936 and RFC 1995.
+var ErrZoneTransfer = errors.New("dnsoverstream: invalid zone transfer")
+
+// ExchangeXFR is like [*Transport.ExchangeXFRWithStreamOpener] but
+// dials a new connection, which is closed when the iteration ends.
+//
+// See [*Transport.ExchangeStream] for how we use the [*Limiter], the
+// [*Pool], and the [*Policy].
+func (dt *Transport) ExchangeXFR(ctx context.Context, query *dnscodec.Query) iter.Seq2[*dns.Msg, error] {
+	return xfrIterate(query, dt.ExchangeStream(ctx, query))
+}
+
+// ExchangeXFRWithStreamOpener sends an AXFR or IXFR [*dnscodec.Query] and
+// returns an iterator over the messages of the zone transfer.
+//
+// Unlike [*Transport.ExchangeStreamWithStreamOpener], we detect the last message
+// using the SOA records bracketing the transfer (RFC 5936 Section 2.2 and RFC
+// 1995 Section 4), so the iteration ends after the last message also when using
+// TCP and TLS (XoT), where the connection stays open. An IXFR response consisting
+// of a single SOA record, which means the zone did not change, is also complete.
+//
+// The iteration stops with [ErrZoneTransfer] if the first record is not an
+// SOA record, with the error mapped from the RCODE if the server refuses the
+// transfer, and with [io.ErrUnexpectedEOF] if the stream ends before the last
+// message. As for any exchange, ObserveRawResponse is invoked for each message.
+func (dt *Transport) ExchangeXFRWithStreamOpener(ctx context.Context,
+	conn StreamOpener, query *dnscodec.Query) iter.Seq2[*dns.Msg, error] {
+	return xfrIterate(query, dt.ExchangeStreamWithStreamOpener(ctx, conn, query))
+}
+
+// xfrIterate wraps the iterator over the messages answering the
+// query to stop after the last message of the zone transfer.
+func xfrIterate(query *dnscodec.Query, messages iter.Seq2[*dns.Msg, error]) iter.Seq2[*dns.Msg, error] {
+	return func(yield func(*dns.Msg, error) bool) {
+		// 1. make sure the query is actually a zone transfer
+		if query.Type != dns.TypeAXFR && query.Type != dns.TypeIXFR {
+			yield(nil, dnscodec.ErrInvalidQuery)
+			return
+		}
+
+		// 2. yield messages until the closing SOA record
+		tracker := &xfrTracker{incremental: query.Type == dns.TypeIXFR}
+		for msg, err := range messages {
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if msg.Rcode != dns.RcodeSuccess {
+				yield(nil, dnscodec.ResponseErrorFromRCODE(msg))
+				return
+			}
+			done, err := tracker.update(msg)
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !yield(msg, nil) || done {
+				return
+			}
+		}
+
+		// 3. the stream ended before the closing SOA record (e.g., DoQ FIN)
+		yield(nil, io.ErrUnexpectedEOF)
+	}
+}
+
+// xfrTracker tracks the SOA records bracketing a zone transfer.
+type xfrTracker struct {
+	// incremental indicates this is an IXFR.
+	incremental bool
+
+	// deltas indicates the IXFR response contains
+	// differences rather than the whole zone.
+	deltas bool
+
+	// records is the number of records seen so far.
+	records int
+
+	// serial is the serial of the opening SOA record.
+	serial uint32
+
+	// brackets counts the SOA records with serial.
+	brackets int
+}
+
+// update processes the answer records of the next message and
+// returns whether this message completes the zone transfer.
+func (t *xfrTracker) update(msg *dns.Msg) (bool, error) {
+	for _, rr := range msg.Answer {
+		t.records++
+		soa, ok := rr.(*dns.SOA)
+
+		// 1. the first record must be the SOA record
+		if t.records == 1 {
+			if !ok {
+				return false, ErrZoneTransfer
+			}
+			t.serial, t.brackets = soa.Serial, 1
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		// 2. a second SOA record with an older serial starts the
+		// differences sequences of an IXFR (RFC 1995 Section 4)
+		if t.records == 2 && t.incremental && soa.Serial != t.serial {
+			t.deltas = true
+		}
+		if soa.Serial != t.serial {
+			continue
+		}
+
+		// 3. differences sequences end by adding the current SOA record,
+		// hence the current serial appears three times, otherwise twice
+		t.brackets++
+		if (t.brackets == 2 && !t.deltas) || t.brackets == 3 {
+			return true, nil
+		}
+	}
+
+	// 4. a single SOA record means the IXFR client is up to date
+	return t.incremental && t.records == 1, nil
+}
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package dnsoverstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/dnscodec"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// newXFRTestSOA returns the SOA record of example.com with the given serial.
+func newXFRTestSOA(serial uint32) dns.RR {
+	return &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Serial: serial,
+	}
+}
+
+// newXFRTestA returns an A record of example.com with the given last octet.
+func newXFRTestA(octet byte) dns.RR {
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IPv4(10, 0, 0, octet),
+	}
+}
+
+// newXFRTestTCPServer starts a TCP server answering each query using a message
+// for each element of answers and then keeping the connection open.
+func newXFRTestTCPServer(t *testing.T, answers [][]dns.RR) netip.AddrPort {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				defer conn.Close()
+				serveTestStream(&xfrTestKeepOpenConn{conn}, func(query *dns.Msg) []*dns.Msg {
+					var msgs []*dns.Msg
+					for _, answer := range answers {
+						resp := &dns.Msg{}
+						resp.SetReply(query)
+						resp.Authoritative = true
+						resp.Answer = answer
+						msgs = append(msgs, resp)
+					}
+					return msgs
+				})
+				io.Copy(io.Discard, conn) // wait for the client to close
+			})
+		}
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		wg.Wait()
+	})
+	return listener.Addr().(*net.TCPAddr).AddrPort()
+}
+
+// xfrTestKeepOpenConn prevents [serveTestStream] from closing the connection.
+type xfrTestKeepOpenConn struct {
+	net.Conn
+}
+
+// Close implements [io.Closer].
+func (c *xfrTestKeepOpenConn) Close() error {
+	return nil
+}
+
+func TestTransportExchangeXFR(t *testing.T) {
+	cases := []struct {
+		name     string
+		qtype    uint16
+		answers  [][]dns.RR
+		messages int
+		err      error
+	}{{
+		name:  "AXFR",
+		qtype: dns.TypeAXFR,
+		answers: [][]dns.RR{
+			{newXFRTestSOA(7), newXFRTestA(1)},
+			{newXFRTestA(2), newXFRTestSOA(7)},
+		},
+		messages: 2,
+	}, {
+		name:     "AXFR using a single message",
+		qtype:    dns.TypeAXFR,
+		answers:  [][]dns.RR{{newXFRTestSOA(7), newXFRTestA(1), newXFRTestSOA(7)}},
+		messages: 1,
+	}, {
+		name:  "IXFR using differences sequences",
+		qtype: dns.TypeIXFR,
+		answers: [][]dns.RR{
+			{newXFRTestSOA(7), newXFRTestSOA(5), newXFRTestA(1), newXFRTestSOA(6)},
+			{newXFRTestA(2), newXFRTestSOA(6), newXFRTestSOA(7), newXFRTestA(3)},
+			{newXFRTestSOA(7)},
+		},
+		messages: 3,
+	}, {
+		name:     "IXFR falling back to a whole zone transfer",
+		qtype:    dns.TypeIXFR,
+		answers:  [][]dns.RR{{newXFRTestSOA(7), newXFRTestA(1)}, {newXFRTestSOA(7)}},
+		messages: 2,
+	}, {
+		name:     "IXFR when the client is up to date",
+		qtype:    dns.TypeIXFR,
+		answers:  [][]dns.RR{{newXFRTestSOA(7)}},
+		messages: 1,
+	}, {
+		name:    "the first record is not an SOA record",
+		qtype:   dns.TypeAXFR,
+		answers: [][]dns.RR{{newXFRTestA(1), newXFRTestSOA(7)}},
+		err:     ErrZoneTransfer,
+	}, {
+		name:  "the query is not a zone transfer",
+		qtype: dns.TypeA,
+		err:   dnscodec.ErrInvalidQuery,
+	}}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint := newXFRTestTCPServer(t, tc.answers)
+			dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), endpoint)
+			var observed int
+			dt.ObserveRawResponse = func([]byte) { observed++ }
+
+			// the server keeps the connection open, hence we would
+			// block until the deadline without detecting the last message
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var messages int
+			var lastErr error
+			for msg, err := range dt.ExchangeXFR(ctx, dnscodec.NewQuery("example.com", tc.qtype)) {
+				if err != nil {
+					lastErr = err
+					continue
+				}
+				require.NotNil(t, msg)
+				messages++
+			}
+			require.ErrorIs(t, lastErr, tc.err)
+			require.Equal(t, tc.messages, messages)
+			require.NoError(t, ctx.Err())
+			if tc.err == nil {
+				require.Equal(t, tc.messages, observed)
+			}
+		})
+	}
+}
+
+func TestTransportExchangeXFRWithStreamOpener(t *testing.T) {
+	dt := NewTransport(NewStreamOpenerDialerTCP(&net.Dialer{}), netip.AddrPort{})
+
+	t.Run("returns io.ErrUnexpectedEOF without the closing SOA record", func(t *testing.T) {
+		stream := &FuncStream{}
+		stream.WriteFunc = func(p []byte) (int, error) {
+			query := &dns.Msg{}
+			require.NoError(t, query.Unpack(p[2:]))
+			resp := &dns.Msg{}
+			resp.SetReply(query)
+			resp.Answer = []dns.RR{newXFRTestSOA(7), newXFRTestA(1)}
+			raw, err := resp.Pack()
+			require.NoError(t, err)
+			stream.ReadFunc = (&errorAfterReader{r: bytes.NewReader(appendStreamMsgFrame(nil, raw)), err: io.EOF}).Read
+			return len(p), nil
+		}
+		opener := &FuncStreamOpener{OpenStreamFunc: func() (Stream, error) { return stream, nil }}
+		var errs []error
+		for _, err := range dt.ExchangeXFRWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeAXFR)) {
+			errs = append(errs, err)
+		}
+		require.Len(t, errs, 2)
+		require.NoError(t, errs[0])
+		require.ErrorIs(t, errs[1], io.ErrUnexpectedEOF)
+	})
+
+	t.Run("maps the RCODE when the server refuses the transfer", func(t *testing.T) {
+		stream := &FuncStream{}
+		stream.WriteFunc = func(p []byte) (int, error) {
+			query := &dns.Msg{}
+			require.NoError(t, query.Unpack(p[2:]))
+			resp := &dns.Msg{}
+			resp.SetRcode(query, dns.RcodeRefused)
+			raw, err := resp.Pack()
+			require.NoError(t, err)
+			stream.ReadFunc = bytes.NewReader(appendStreamMsgFrame(nil, raw)).Read
+			return len(p), nil
+		}
+		opener := &FuncStreamOpener{OpenStreamFunc: func() (Stream, error) { return stream, nil }}
+		for msg, err := range dt.ExchangeXFRWithStreamOpener(context.Background(), opener, dnscodec.NewQuery("example.com", dns.TypeAXFR)) {
+			require.Nil(t, msg)
+			require.ErrorIs(t, err, dnscodec.ErrServerMisbehaving)
+		}
+	})
+}